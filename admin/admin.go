@@ -0,0 +1,188 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin adds the endpoints operators use to look at and steer a running proxy to the
+// debug HTTP port, next to /metrics, /admin/stats, /admin/log and the pprof handlers:
+//
+//	curl localhost:11299/healthz
+//	curl localhost:11299/readyz
+//	curl localhost:11299/admin/config
+//	curl -X POST 'localhost:11299/admin/maintenance?enabled=true'
+//
+// /healthz answers as long as the process is up. /readyz fails while any readiness check fails or
+// the proxy is in maintenance mode, so a load balancer can move traffic off of it before it's
+// worked on. TierCheck makes a readiness check that writes through to a tier's backends. /healthz
+// doesn't run the checks, since restarting the proxy won't bring a dead backend back.
+package admin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hongst/rend/metrics"
+)
+
+var MetricMaintenance = metrics.AddIntGauge("admin_maintenance", nil)
+
+func init() {
+	http.Handle("/healthz", http.HandlerFunc(serveHealth))
+	http.Handle("/readyz", http.HandlerFunc(serveReady))
+	http.Handle("/admin/config", http.HandlerFunc(serveConfig))
+	http.Handle("/admin/maintenance", http.HandlerFunc(serveMaintenance))
+}
+
+var maintenance atomic.Bool
+
+// SetMaintenance turns maintenance mode on or off
+func SetMaintenance(enabled bool) {
+	maintenance.Store(enabled)
+	if enabled {
+		metrics.SetIntGauge(MetricMaintenance, 1)
+	} else {
+		metrics.SetIntGauge(MetricMaintenance, 0)
+	}
+}
+
+// InMaintenance returns whether maintenance mode is on
+func InMaintenance() bool {
+	return maintenance.Load()
+}
+
+type readyCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	checksLock sync.Mutex
+	checks     []readyCheck
+)
+
+// AddReadyCheck adds a check that /readyz runs. The proxy is only ready while every check
+// returns nil.
+func AddReadyCheck(name string, check func() error) {
+	checksLock.Lock()
+	checks = append(checks, readyCheck{name, check})
+	checksLock.Unlock()
+}
+
+// Ready runs the readiness checks and returns the reasons the proxy isn't ready, if any
+func Ready() []string {
+	var reasons []string
+	if InMaintenance() {
+		reasons = append(reasons, "maintenance: enabled")
+	}
+
+	checksLock.Lock()
+	cs := checks
+	checksLock.Unlock()
+
+	for _, c := range cs {
+		if err := c.check(); err != nil {
+			reasons = append(reasons, c.name+": "+err.Error())
+		}
+	}
+	return reasons
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	reasons := Ready()
+	if len(reasons) == 0 {
+		fmt.Fprintln(w, "OK")
+		return
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	for _, reason := range reasons {
+		fmt.Fprintln(w, reason)
+	}
+}
+
+var (
+	redactedLock sync.Mutex
+	redacted     = make(map[string]bool)
+)
+
+// Redact hides the values of the named flags, like secrets, in /admin/config
+func Redact(names ...string) {
+	redactedLock.Lock()
+	for _, name := range names {
+		redacted[name] = true
+	}
+	redactedLock.Unlock()
+}
+
+// Config returns the value of every command line flag, with the values of redacted flags that
+// are set replaced
+func Config() map[string]string {
+	redactedLock.Lock()
+	defer redactedLock.Unlock()
+
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if redacted[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+		config[f.Name] = value
+	})
+	return config
+}
+
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(Config())
+}
+
+type maintenanceBody struct {
+	Enabled  bool     `json:"enabled"`
+	NotReady []string `json:"not_ready"`
+}
+
+// serveMaintenance shows whether maintenance mode is on on GET. A POST or PUT with enabled turns
+// it on or off.
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost, http.MethodPut:
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		SetMaintenance(enabled)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenanceBody{
+		Enabled:  InMaintenance(),
+		NotReady: Ready(),
+	})
+}
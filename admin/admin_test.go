@@ -0,0 +1,99 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/admin"
+)
+
+func get(method, url string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	return w
+}
+
+func TestReady(t *testing.T) {
+	if w := get("GET", "/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("Expected /healthz to be OK, got %d", w.Code)
+	}
+
+	failing := true
+	admin.AddReadyCheck("backend", func() error {
+		if failing {
+			return errors.New("down")
+		}
+		return nil
+	})
+
+	w := get("GET", "/readyz")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "backend: down") {
+		t.Fatalf("Expected /readyz to fail with the check's reason, got %d %q", w.Code, w.Body.String())
+	}
+
+	failing = false
+	if w := get("GET", "/readyz"); w.Code != http.StatusOK {
+		t.Fatalf("Expected /readyz to be OK, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Maintenance mode takes the proxy out of rotation without failing /healthz
+	if w := get("POST", "/admin/maintenance?enabled=true"); w.Code != http.StatusOK {
+		t.Fatalf("Expected maintenance mode to be turned on, got %d %q", w.Code, w.Body.String())
+	}
+	defer admin.SetMaintenance(false)
+
+	if w := get("GET", "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected /readyz to fail in maintenance mode, got %d", w.Code)
+	}
+	if w := get("GET", "/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("Expected /healthz to be OK in maintenance mode, got %d", w.Code)
+	}
+
+	var body struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.Unmarshal(get("GET", "/admin/maintenance").Body.Bytes(), &body); err != nil || !body.Enabled {
+		t.Fatalf("Expected maintenance mode to be shown as on, got %+v, %v", body, err)
+	}
+
+	if w := get("POST", "/admin/maintenance?enabled=maybe"); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad request, got %d", w.Code)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	flag.String("admin-test-plain", "visible", "")
+	flag.String("admin-test-secret", "hunter2", "")
+	admin.Redact("admin-test-secret")
+
+	var config map[string]string
+	if err := json.Unmarshal(get("GET", "/admin/config").Body.Bytes(), &config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config["admin-test-plain"] != "visible" {
+		t.Fatalf("Expected the flag's value, got %q", config["admin-test-plain"])
+	}
+	if config["admin-test-secret"] != "REDACTED" {
+		t.Fatalf("Expected the secret to be redacted, got %q", config["admin-test-secret"])
+	}
+}
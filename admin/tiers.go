@@ -0,0 +1,136 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+var (
+	errWrongValue = errors.New("get returned a different value than was set")
+	errCheckSlow  = errors.New("check timed out")
+)
+
+// TierCheck returns a readiness check that sets, gets and deletes key through a handler made by
+// hc, so a tier whose backends are down or too slow takes the proxy out of rotation. The check
+// fails if any step fails or the three together take longer than timeout. The handler is kept
+// between checks and made again after one fails.
+func TierCheck(hc handlers.HandlerConst, key []byte, timeout time.Duration) func() error {
+	c := &tierCheck{hc: hc, key: key, timeout: timeout}
+	return c.check
+}
+
+type tierCheck struct {
+	hc      handlers.HandlerConst
+	key     []byte
+	timeout time.Duration
+
+	// lock is held for a whole check so handlers are never used by two checks at once
+	lock sync.Mutex
+	h    handlers.Handler
+}
+
+func (c *tierCheck) check() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.h == nil {
+		h, err := c.hc()
+		if err != nil {
+			return err
+		}
+		c.h = h
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func(h handlers.Handler) {
+		done <- probe(ctx, h, c.key)
+	}(c.h)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			c.h.Close()
+			c.h = nil
+		}
+		return err
+
+	case <-ctx.Done():
+		// The probe is still using the handler, so it's closed once the probe gives up on the
+		// deadline. The next check makes a new one.
+		go func(h handlers.Handler) {
+			<-done
+			h.Close()
+		}(c.h)
+		c.h = nil
+		return errCheckSlow
+	}
+}
+
+// probe does one round of set, get and delete
+func probe(ctx context.Context, h handlers.Handler, key []byte) error {
+	data := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	if err := h.Set(common.SetRequest{Key: key, Data: data, Exptime: 60, Ctx: ctx}); err != nil {
+		return errors.New("set: " + err.Error())
+	}
+
+	resIn, errsIn := h.Get(common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+		Ctx:     ctx,
+	})
+
+	// The get is read to the end so the handler isn't left blocked sending
+	getErr := errWrongValue
+	for resIn != nil || errsIn != nil {
+		select {
+		case res, ok := <-resIn:
+			if !ok {
+				resIn = nil
+				continue
+			}
+			if !res.Miss && bytes.Equal(res.Data, data) {
+				getErr = nil
+			}
+		case err, ok := <-errsIn:
+			if !ok {
+				errsIn = nil
+				continue
+			}
+			getErr = errors.New("get: " + err.Error())
+		}
+	}
+	if getErr != nil {
+		return getErr
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: key, Ctx: ctx}); err != nil && err != common.ErrKeyNotFound {
+		return errors.New("delete: " + err.Error())
+	}
+	return nil
+}
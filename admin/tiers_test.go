@@ -0,0 +1,88 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/admin"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+)
+
+// hangingHandler doesn't answer a set until a little after its deadline. It sends on closed when
+// it's closed, saying whether a set was still running.
+type hangingHandler struct {
+	handlers.Handler
+	busy   *int32
+	closed chan bool
+}
+
+func (h hangingHandler) Set(cmd common.SetRequest) error {
+	atomic.StoreInt32(h.busy, 1)
+	defer atomic.StoreInt32(h.busy, 0)
+	<-cmd.Ctx.Done()
+	time.Sleep(20 * time.Millisecond)
+	return common.ErrTimeout
+}
+
+func (h hangingHandler) Close() error {
+	h.closed <- atomic.LoadInt32(h.busy) == 1
+	return nil
+}
+
+func TestTierCheck(t *testing.T) {
+	check := admin.TierCheck(inmem.New, []byte("health"), time.Second)
+	for i := 0; i < 3; i++ {
+		if err := check(); err != nil {
+			t.Fatalf("Expected a working tier to pass, got %v", err)
+		}
+	}
+
+	var made int
+	closed := make(chan bool, 2)
+	hang := func() (handlers.Handler, error) {
+		made++
+		return hangingHandler{busy: new(int32), closed: closed}, nil
+	}
+
+	check = admin.TierCheck(hang, []byte("health"), 20*time.Millisecond)
+	start := time.Now()
+	if err := check(); err == nil {
+		t.Fatal("Expected a hanging tier to fail")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the check to time out quickly, took %v", d)
+	}
+
+	// The hung handler is closed once the set gives up, not while it's still running
+	select {
+	case busy := <-closed:
+		if busy {
+			t.Fatal("Expected the handler to be closed after the set returned")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the hung handler to be closed")
+	}
+
+	// and replaced
+	check()
+	if made != 2 {
+		t.Fatalf("Expected a new handler after a failed check, made %d", made)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binprot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricAuditResponses          = metrics.AddCounter("binary_audit_responses", nil)
+	MetricAuditViolationsMagic    = metrics.AddCounter("binary_audit_violations_magic", nil)
+	MetricAuditViolationsDataType = metrics.AddCounter("binary_audit_violations_data_type", nil)
+	MetricAuditViolationsOpaque   = metrics.AddCounter("binary_audit_violations_opaque", nil)
+	MetricAuditViolationsCAS      = metrics.AddCounter("binary_audit_violations_cas", nil)
+)
+
+// NewAuditedBinaryParserResponder is like NewBinaryParserResponder but checks every response
+// header as it is written to the connection. Each response must be a response (magic 0x81) with
+// the raw data type, carry one of the opaque values of the request being answered, and have no
+// CAS value if it is an error. Violations are logged and counted but the response is still sent.
+// This is slower and is meant for catching pipelining bugs between the parser, orcas, and
+// responder.
+func NewAuditedBinaryParserResponder(reader *bufio.Reader, w io.Writer) (BinaryParser, BinaryResponder) {
+	a := &auditor{}
+	state := &batchState{
+		keyed: make(map[uint32]bool),
+		audit: a,
+	}
+	return BinaryParser{
+		reader: reader,
+		state:  state,
+	}, BinaryResponder{
+		writer: bufio.NewWriter(&auditWriter{w: w, a: a}),
+		state:  state,
+	}
+}
+
+// auditor holds the opaque values the responses to the current request may use
+type auditor struct {
+	opaques map[uint32]bool
+}
+
+func (a *auditor) expect(req common.Request) {
+	a.opaques = make(map[uint32]bool)
+
+	switch r := req.(type) {
+	case nil:
+		// Parse errors have no request, so no opaque is known
+	case common.GetRequest:
+		for _, o := range r.Opaques {
+			a.opaques[o] = true
+		}
+		if r.NoopEnd {
+			a.opaques[r.NoopOpaque] = true
+		}
+	default:
+		a.opaques[req.GetOpaque()] = true
+	}
+}
+
+func (a *auditor) check(header []byte) {
+	metrics.IncCounter(MetricAuditResponses)
+
+	opcode := header[1]
+	status := binary.BigEndian.Uint16(header[6:8])
+	opaque := binary.BigEndian.Uint32(header[12:16])
+	cas := binary.BigEndian.Uint64(header[16:24])
+
+	if header[0] != MagicResponse {
+		metrics.IncCounter(MetricAuditViolationsMagic)
+		log.Printf("Audit: response for opcode 0x%02x has magic 0x%02x\n", opcode, header[0])
+	}
+	if header[5] != 0 {
+		metrics.IncCounter(MetricAuditViolationsDataType)
+		log.Printf("Audit: response for opcode 0x%02x has data type 0x%02x\n", opcode, header[5])
+	}
+	if !a.opaques[opaque] {
+		metrics.IncCounter(MetricAuditViolationsOpaque)
+		log.Printf("Audit: response for opcode 0x%02x has opaque %d not in the request\n", opcode, opaque)
+	}
+	if status != StatusSuccess && cas != 0 {
+		metrics.IncCounter(MetricAuditViolationsCAS)
+		log.Printf("Audit: error response for opcode 0x%02x has CAS %d\n", opcode, cas)
+	}
+}
+
+// auditWriter follows the stream of responses written through it and has each header checked.
+// Headers and bodies may be split across writes in any way.
+type auditWriter struct {
+	w io.Writer
+	a *auditor
+
+	header    [resHeaderLen]byte
+	headerLen int
+	bodyLeft  uint32
+}
+
+func (aw *auditWriter) Write(p []byte) (int, error) {
+	for buf := p; len(buf) > 0; {
+		if aw.bodyLeft > 0 {
+			skip := uint32(len(buf))
+			if skip > aw.bodyLeft {
+				skip = aw.bodyLeft
+			}
+			aw.bodyLeft -= skip
+			buf = buf[skip:]
+			continue
+		}
+
+		n := copy(aw.header[aw.headerLen:], buf)
+		aw.headerLen += n
+		buf = buf[n:]
+
+		if aw.headerLen == resHeaderLen {
+			aw.a.check(aw.header[:])
+			aw.bodyLeft = binary.BigEndian.Uint32(aw.header[8:12])
+			aw.headerLen = 0
+		}
+	}
+
+	return aw.w.Write(p)
+}
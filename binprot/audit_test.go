@@ -0,0 +1,74 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package binprot_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+func counter(name string) uint64 {
+	for _, c := range metrics.Counters() {
+		if c.Name == name {
+			return c.Val
+		}
+	}
+	return 0
+}
+
+func TestAuditOpaque(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBuffer([]byte{
+		0x80,       // Magic
+		0x04,       // Delete opcode
+		0x00, 0x01, // key length
+		0x00,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x01, // total body length
+		0x00, 0x00, 0x00, 0x05, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+		'a', // Key
+	}))
+	out := &bytes.Buffer{}
+	p, res := binprot.NewAuditedBinaryParserResponder(r, out)
+
+	if _, _, _, err := p.Parse(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	responses := counter("binary_audit_responses")
+	violations := counter("binary_audit_violations_opaque")
+
+	res.Delete(5, false)
+	if counter("binary_audit_responses") != responses+1 || counter("binary_audit_violations_opaque") != violations {
+		t.Fatal("Expected a valid response to pass the audit")
+	}
+
+	res.Error(9, common.RequestDelete, common.ErrKeyNotFound, false)
+	if counter("binary_audit_responses") != responses+2 || counter("binary_audit_violations_opaque") != violations+1 {
+		t.Fatal("Expected a response with the wrong opaque to be counted")
+	}
+
+	// The responses still go out
+	if out.Len() != 2*24 {
+		t.Fatalf("Unexpected response length %d", out.Len())
+	}
+}
@@ -23,12 +23,13 @@ import (
 )
 
 // Data commands are those that send a header, key, exptime, and data
-func writeDataCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize uint32) error {
+func writeDataCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize uint32, cas uint64) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	// key + extras + body
 	extrasLen := 8
 	totalBodyLength := len(key) + extrasLen + int(dataSize)
 	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength)
+	header.CASToken = cas
 
 	writeRequestHeader(w, header)
 
@@ -45,29 +46,30 @@ func writeDataCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, d
 	return err
 }
 
-func WriteSetCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error {
+func WriteSetCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32, cas uint64) error {
 	//fmt.Printf("Set: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeDataCmdCommon(w, OpcodeSet, key, flags, exptime, dataSize)
+	return writeDataCmdCommon(w, OpcodeSet, key, flags, exptime, dataSize, cas)
 }
 
-func WriteAddCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error {
+func WriteAddCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32, cas uint64) error {
 	//fmt.Printf("Add: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeDataCmdCommon(w, OpcodeAdd, key, flags, exptime, dataSize)
+	return writeDataCmdCommon(w, OpcodeAdd, key, flags, exptime, dataSize, cas)
 }
 
-func WriteReplaceCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error {
+func WriteReplaceCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32, cas uint64) error {
 	//fmt.Printf("Replace: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeDataCmdCommon(w, OpcodeReplace, key, flags, exptime, dataSize)
+	return writeDataCmdCommon(w, OpcodeReplace, key, flags, exptime, dataSize, cas)
 }
 
-func writeAppendPrependCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize uint32) error {
+func writeAppendPrependCmdCommon(w io.Writer, opcode uint8, key []byte, flags, exptime, dataSize uint32, cas uint64) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	// key + body
 	totalBodyLength := len(key) + int(dataSize)
 	header := makeRequestHeader(opcode, len(key), 0, totalBodyLength)
+	header.CASToken = cas
 
 	writeRequestHeader(w, header)
 
@@ -79,22 +81,23 @@ func writeAppendPrependCmdCommon(w io.Writer, opcode uint8, key []byte, flags, e
 	return err
 }
 
-func WriteAppendCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error {
+func WriteAppendCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32, cas uint64) error {
 	//fmt.Printf("Append: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeAppendPrependCmdCommon(w, OpcodeAppend, key, flags, exptime, dataSize)
+	return writeAppendPrependCmdCommon(w, OpcodeAppend, key, flags, exptime, dataSize, cas)
 }
 
-func WritePrependCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32) error {
+func WritePrependCmd(w io.Writer, key []byte, flags, exptime, dataSize uint32, cas uint64) error {
 	//fmt.Printf("Prepend: key: %v | flags: %v | exptime: %v | dataSize: %v | totalBodyLength: %v\n",
 	//string(key), flags, exptime, dataSize, totalBodyLength)
-	return writeAppendPrependCmdCommon(w, OpcodePrepend, key, flags, exptime, dataSize)
+	return writeAppendPrependCmdCommon(w, OpcodePrepend, key, flags, exptime, dataSize, cas)
 }
 
 // Key commands send the header and key only
-func writeKeyCmd(w io.Writer, opcode uint8, key []byte) error {
+func writeKeyCmd(w io.Writer, opcode uint8, key []byte, cas uint64) error {
 	// opcode, keyLength, extraLength, totalBodyLength
 	header := makeRequestHeader(opcode, len(key), 0, len(key))
+	header.CASToken = cas
 	writeRequestHeader(w, header)
 
 	n, err := w.Write(key)
@@ -107,27 +110,40 @@ func writeKeyCmd(w io.Writer, opcode uint8, key []byte) error {
 
 func WriteGetCmd(w io.Writer, key []byte) error {
 	//fmt.Printf("Get: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGet, key)
+	return writeKeyCmd(w, OpcodeGet, key, 0)
 }
 
 func WriteGetQCmd(w io.Writer, key []byte) error {
 	//fmt.Printf("GetQ: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGetQ, key)
+	return writeKeyCmd(w, OpcodeGetQ, key, 0)
 }
 
 func WriteGetECmd(w io.Writer, key []byte) error {
 	//fmt.Printf("GetE: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGetE, key)
+	return writeKeyCmd(w, OpcodeGetE, key, 0)
 }
 
 func WriteGetEQCmd(w io.Writer, key []byte) error {
 	//fmt.Printf("GetEQ: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeGetEQ, key)
+	return writeKeyCmd(w, OpcodeGetEQ, key, 0)
 }
 
-func WriteDeleteCmd(w io.Writer, key []byte) error {
+// WriteFlushCmd writes a flush command. The delay is sent as the 4 byte extras only if it is
+// non-zero, same as memcached's own clients.
+func WriteFlushCmd(w io.Writer, delay uint32) error {
+	if delay == 0 {
+		return writeKeyCmd(w, OpcodeFlush, nil, 0)
+	}
+	return writeKeyExptimeCmd(w, OpcodeFlush, nil, delay)
+}
+
+func WriteStatCmd(w io.Writer, group []byte) error {
+	return writeKeyCmd(w, OpcodeStat, group, 0)
+}
+
+func WriteDeleteCmd(w io.Writer, key []byte, cas uint64) error {
 	//fmt.Printf("Delete: key: %v | totalBodyLength: %v\n", string(key), len(key))
-	return writeKeyCmd(w, OpcodeDelete, key)
+	return writeKeyCmd(w, OpcodeDelete, key, cas)
 }
 
 // Key Exptime commands send the header, key, and an exptime
@@ -170,6 +186,47 @@ func WriteGATQCmd(w io.Writer, key []byte, exptime uint32) error {
 	return writeKeyExptimeCmd(w, OpcodeGatQ, key, exptime)
 }
 
+// Arithmetic commands send the header, delta, initial value, exptime, and key
+func writeArithCmd(w io.Writer, opcode uint8, key []byte, delta, initial uint64, exptime uint32) error {
+	// opcode, keyLength, extraLength, totalBodyLength
+	// key + extras
+	extrasLen := 20
+	totalBodyLength := len(key) + extrasLen
+	header := makeRequestHeader(opcode, len(key), extrasLen, totalBodyLength)
+
+	writeRequestHeader(w, header)
+
+	buf := make([]byte, len(key)+20)
+	binary.BigEndian.PutUint64(buf[0:8], delta)
+	binary.BigEndian.PutUint64(buf[8:16], initial)
+	binary.BigEndian.PutUint32(buf[16:20], exptime)
+	copy(buf[20:], key)
+
+	n, err := w.Write(buf)
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+
+	reqHeadPool.Put(header)
+
+	return err
+}
+
+func WriteIncrCmd(w io.Writer, key []byte, delta, initial uint64, exptime uint32) error {
+	//fmt.Printf("Incr: key: %v | delta: %v | initial: %v | exptime: %v\n", string(key),
+	//delta, initial, exptime)
+	return writeArithCmd(w, OpcodeIncrement, key, delta, initial, exptime)
+}
+
+func WriteDecrCmd(w io.Writer, key []byte, delta, initial uint64, exptime uint32) error {
+	//fmt.Printf("Decr: key: %v | delta: %v | initial: %v | exptime: %v\n", string(key),
+	//delta, initial, exptime)
+	return writeArithCmd(w, OpcodeDecrement, key, delta, initial, exptime)
+}
+
+// The version command is also just a header
+func WriteVersionCmd(w io.Writer) error {
+	return writeKeyCmd(w, OpcodeVersion, nil, 0)
+}
+
 // And the noop command is just a header
 func WriteNoopCmd(w io.Writer) error {
 	// opcode, keyLength, extraLength, totalBodyLength
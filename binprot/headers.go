@@ -41,7 +41,7 @@ type RequestHeader struct {
 	VBucket         uint16 // Not used
 	TotalBodyLength uint32
 	OpaqueToken     uint32 // Echoed to the client
-	CASToken        uint64 // Unused in current implementation
+	CASToken        uint64
 }
 
 const resHeaderLen = 24
@@ -129,9 +129,7 @@ func readRequestHeader(r io.Reader) (RequestHeader, error) {
 	rh.VBucket = 0
 	rh.TotalBodyLength = binary.BigEndian.Uint32(buf[8:12])
 	rh.OpaqueToken = binary.BigEndian.Uint32(buf[12:16])
-	// ignore CAS, unused in rend
-	//rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
-	rh.CASToken = 0
+	rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
 
 	bufPool.Put(buf)
 	metrics.IncCounter(MetricBinaryRequestHeadersParsed)
@@ -153,10 +151,7 @@ func writeRequestHeader(w io.Writer, rh RequestHeader) error {
 	binary.BigEndian.PutUint32(buf[8:12], rh.TotalBodyLength)
 	binary.BigEndian.PutUint32(buf[12:16], rh.OpaqueToken)
 
-	// zero CAS region
-	for i := 16; i < 24; i++ {
-		buf[i] = 0
-	}
+	binary.BigEndian.PutUint64(buf[16:24], rh.CASToken)
 
 	n, err := w.Write(buf)
 	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
@@ -191,9 +186,7 @@ func ReadResponseHeader(r io.Reader) (ResponseHeader, error) {
 	rh.Status = binary.BigEndian.Uint16(buf[6:8])
 	rh.TotalBodyLength = binary.BigEndian.Uint32(buf[8:12])
 	rh.OpaqueToken = binary.BigEndian.Uint32(buf[12:16])
-	// ignore CAS, unused in rend
-	//rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
-	rh.CASToken = 0
+	rh.CASToken = binary.BigEndian.Uint64(buf[16:24])
 
 	bufPool.Put(buf)
 	metrics.IncCounter(MetricBinaryResponseHeadersParsed)
@@ -214,10 +207,7 @@ func writeResponseHeader(w io.Writer, rh ResponseHeader) error {
 	binary.BigEndian.PutUint32(buf[8:12], rh.TotalBodyLength)
 	binary.BigEndian.PutUint32(buf[12:16], rh.OpaqueToken)
 
-	// zero CAS region
-	for i := 16; i < 24; i++ {
-		buf[i] = 0
-	}
+	binary.BigEndian.PutUint64(buf[16:24], rh.CASToken)
 
 	n, err := w.Write(buf)
 	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"log"
 
 	"github.com/hongst/rend/common"
@@ -103,16 +104,82 @@ import (
 //     Key                 : The textual string "Hello"
 //     Value               : None
 
+// Sample Incr request
+// Field        (offset) (value)
+//     Magic        (0)    : 0x80
+//     Opcode       (1)    : 0x05
+//     Key length   (2,3)  : 0x0005
+//     Extra length (4)    : 0x14
+//     Data type    (5)    : 0x00
+//     VBucket      (6,7)  : 0x0000
+//     Total body   (8-11) : 0x00000019
+//     Opaque       (12-15): 0x00000000
+//     CAS          (16-23): 0x0000000000000000
+//     Extras              :
+//       Delta      (24-31): 0x0000000000000001
+//       Initial    (32-39): 0x0000000000000000
+//       Expiry     (40-43): 0x00000e10
+//     Key                 : The textual string "Hello"
+//     Value               : None
+
 type BinaryParser struct {
 	reader *bufio.Reader
+	state  *batchState
 }
 
+// NewBinaryParser creates a parser that does not share state with a responder. GETK and GETKQ
+// requests will be parsed, but any responder will reply to them as if they were GET and GETQ.
+// Use NewBinaryParserResponder to return keys properly.
 func NewBinaryParser(reader *bufio.Reader) BinaryParser {
 	return BinaryParser{
 		reader: reader,
 	}
 }
 
+// NewBinaryParserResponder creates a parser and responder pair for a single connection. The two
+// share the state of the current get batch so the responses to GETK and GETKQ include the key.
+func NewBinaryParserResponder(reader *bufio.Reader, writer *bufio.Writer) (BinaryParser, BinaryResponder) {
+	state := &batchState{
+		keyed: make(map[uint32]bool),
+	}
+	return BinaryParser{
+		reader: reader,
+		state:  state,
+	}, BinaryResponder{
+		writer: writer,
+		state:  state,
+	}
+}
+
+// batchState holds the opaques of the gets in the current batch that asked for the key to be
+// returned with the value. When auditing, it also has the auditor that checks the responses.
+type batchState struct {
+	keyed map[uint32]bool
+	audit *auditor
+}
+
+func (s *batchState) reset() {
+	if s != nil && len(s.keyed) > 0 {
+		s.keyed = make(map[uint32]bool)
+	}
+}
+
+func (s *batchState) setKeyed(opaque uint32) {
+	if s != nil {
+		s.keyed[opaque] = true
+	}
+}
+
+func (s *batchState) isKeyed(opaque uint32) bool {
+	return s != nil && s.keyed[opaque]
+}
+
+func (s *batchState) expect(req common.Request) {
+	if s != nil && s.audit != nil {
+		s.audit.expect(req)
+	}
+}
+
 // Gets can be pipelined by sending many headers at once to the server.
 // In this case, it is to our advantage to read as many as we can before replying
 // to the client. The form of a pipelined get is a series of GETQ headers, followed
@@ -126,6 +193,12 @@ func NewBinaryParser(reader *bufio.Reader) BinaryParser {
 // spymemcached's implementation ^^^
 
 func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	req, reqType, start, err := b.parse()
+	b.state.expect(req)
+	return req, reqType, start, err
+}
+
+func (b BinaryParser) parse() (common.Request, common.RequestType, uint64, error) {
 	// read in the full header before any variable length fields
 	reqHeader, err := readRequestHeader(b.reader)
 	start := timer.Now()
@@ -135,6 +208,8 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		return nil, common.RequestUnknown, start, err
 	}
 
+	b.state.reset()
+
 	switch reqHeader.Opcode {
 	case OpcodeSet:
 		return setRequest(b.reader, reqHeader, common.RequestSet, false, start)
@@ -161,8 +236,8 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 	case OpcodePrependQ:
 		return appendPrependRequest(b.reader, reqHeader, common.RequestPrepend, true, start)
 
-	case OpcodeGetQ:
-		req, err := readBatchGet(b.reader, reqHeader)
+	case OpcodeGetQ, OpcodeGetKQ:
+		req, err := readBatchGet(b.reader, reqHeader, b.state)
 		if err != nil {
 			log.Println("Error reading batch get")
 			return nil, common.RequestGet, start, err
@@ -170,7 +245,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 
 		return req, common.RequestGet, start, nil
 
-	case OpcodeGet:
+	case OpcodeGet, OpcodeGetK:
 		// key
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
@@ -178,6 +253,10 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 			return nil, common.RequestGet, start, err
 		}
 
+		if reqHeader.Opcode == OpcodeGetK {
+			b.state.setKeyed(reqHeader.OpaqueToken)
+		}
+
 		return common.GetRequest{
 			Keys:    [][]byte{key},
 			Opaques: []uint32{reqHeader.OpaqueToken},
@@ -211,7 +290,7 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 			NoopEnd: false,
 		}, common.RequestGetE, start, nil
 
-	case OpcodeGat:
+	case OpcodeGat, OpcodeGatQ, OpcodeGatK, OpcodeGatKQ:
 		// exptime, key
 		exptime, err := readUInt32(b.reader)
 		if err != nil {
@@ -219,20 +298,38 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 			return nil, common.RequestGat, start, err
 		}
 
+		sig, err := readSignature(b.reader, reqHeader, 4)
+		if err != nil {
+			log.Println("Error reading signature")
+			return nil, common.RequestGat, start, err
+		}
+
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
 			log.Println("Error reading key")
 			return nil, common.RequestGat, start, err
 		}
 
+		if reqHeader.Opcode == OpcodeGatK || reqHeader.Opcode == OpcodeGatKQ {
+			b.state.setKeyed(reqHeader.OpaqueToken)
+		}
+
 		return common.GATRequest{
-			Key:     key,
-			Exptime: exptime,
-			Opaque:  reqHeader.OpaqueToken,
+			Key:       key,
+			Exptime:   exptime,
+			Opaque:    reqHeader.OpaqueToken,
+			Quiet:     reqHeader.Opcode == OpcodeGatQ || reqHeader.Opcode == OpcodeGatKQ,
+			Signature: sig,
 		}, common.RequestGat, start, nil
 
-	case OpcodeDelete:
+	case OpcodeDelete, OpcodeDeleteQ:
 		// key
+		sig, err := readSignature(b.reader, reqHeader, 0)
+		if err != nil {
+			log.Println("Error reading signature")
+			return nil, common.RequestDelete, start, err
+		}
+
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
 			log.Println("Error reading key")
@@ -240,10 +337,23 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		}
 
 		return common.DeleteRequest{
-			Key:    key,
-			Opaque: reqHeader.OpaqueToken,
+			Key:       key,
+			Opaque:    reqHeader.OpaqueToken,
+			Quiet:     reqHeader.Opcode == OpcodeDeleteQ,
+			Cas:       reqHeader.CASToken,
+			Signature: sig,
 		}, common.RequestDelete, start, nil
 
+	case OpcodeIncrement:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestIncr, false, start)
+	case OpcodeIncrementQ:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestIncr, true, start)
+
+	case OpcodeDecrement:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestDecr, false, start)
+	case OpcodeDecrementQ:
+		return incrDecrRequest(b.reader, reqHeader, common.RequestDecr, true, start)
+
 	case OpcodeTouch:
 		// exptime, key
 		exptime, err := readUInt32(b.reader)
@@ -252,6 +362,12 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 			return nil, common.RequestTouch, start, err
 		}
 
+		sig, err := readSignature(b.reader, reqHeader, 4)
+		if err != nil {
+			log.Println("Error reading signature")
+			return nil, common.RequestTouch, start, err
+		}
+
 		key, err := readString(b.reader, reqHeader.KeyLength)
 		if err != nil {
 			log.Println("Error reading key")
@@ -259,9 +375,10 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		}
 
 		return common.TouchRequest{
-			Key:     key,
-			Exptime: exptime,
-			Opaque:  reqHeader.OpaqueToken,
+			Key:       key,
+			Exptime:   exptime,
+			Opaque:    reqHeader.OpaqueToken,
+			Signature: sig,
 		}, common.RequestTouch, start, nil
 
 	case OpcodeNoop:
@@ -284,6 +401,99 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 		return common.VersionRequest{
 			Opaque: reqHeader.OpaqueToken,
 		}, common.RequestVersion, start, nil
+
+	case OpcodeVerbosity:
+		// verbosity level
+		level, err := readUInt32(b.reader)
+		if err != nil {
+			log.Println("Error reading verbosity level")
+			return nil, common.RequestVerbosity, start, err
+		}
+
+		return common.VerbosityRequest{
+			Level:  level,
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestVerbosity, start, nil
+
+	case OpcodeFlush, OpcodeFlushQ:
+		// optional delay, optional signature
+		var delay uint32
+		var baseExtras uint8
+		if reqHeader.ExtraLength == 4 || reqHeader.ExtraLength == 4+SignatureLength {
+			if delay, err = readUInt32(b.reader); err != nil {
+				log.Println("Error reading flush delay")
+				return nil, common.RequestFlush, start, err
+			}
+			baseExtras = 4
+		}
+
+		sig, err := readSignature(b.reader, reqHeader, baseExtras)
+		if err != nil {
+			log.Println("Error reading signature")
+			return nil, common.RequestFlush, start, err
+		}
+
+		return common.FlushRequest{
+			Delay:     delay,
+			Opaque:    reqHeader.OpaqueToken,
+			Quiet:     reqHeader.Opcode == OpcodeFlushQ,
+			Signature: sig,
+		}, common.RequestFlush, start, nil
+
+	case OpcodeStat:
+		// optional stats group as the key
+		group, err := readString(b.reader, reqHeader.KeyLength)
+		if err != nil {
+			log.Println("Error reading stats group")
+			return nil, common.RequestStats, start, err
+		}
+
+		return common.StatsRequest{
+			Group:  group,
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestStats, start, nil
+
+	case OpcodeSASLListMechs:
+		return common.SASLListMechsRequest{
+			Opaque: reqHeader.OpaqueToken,
+		}, common.RequestSASLListMechs, start, nil
+
+	case OpcodeSASLAuth:
+		// mechanism as the key, auth data as the value. A body that doesn't add up is skipped so
+		// the stream stays in sync for the error response.
+		keyExtras := uint32(reqHeader.KeyLength) + uint32(reqHeader.ExtraLength)
+		if reqHeader.TotalBodyLength < keyExtras || reqHeader.TotalBodyLength-keyExtras > MaxSASLDataLength {
+			n, err := io.CopyN(ioutil.Discard, b.reader, int64(reqHeader.TotalBodyLength))
+			metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+			if err != nil {
+				return nil, common.RequestSASLAuth, start, err
+			}
+			return nil, common.RequestSASLAuth, start, common.ErrBadLength
+		}
+
+		// No extras are defined for auth
+		if _, err := readString(b.reader, uint16(reqHeader.ExtraLength)); err != nil {
+			log.Println("Error reading SASL extras")
+			return nil, common.RequestSASLAuth, start, err
+		}
+
+		mech, err := readString(b.reader, reqHeader.KeyLength)
+		if err != nil {
+			log.Println("Error reading SASL mechanism")
+			return nil, common.RequestSASLAuth, start, err
+		}
+
+		data, err := readValue(b.reader, reqHeader.TotalBodyLength-keyExtras)
+		if err != nil {
+			log.Println("Error reading SASL auth data")
+			return nil, common.RequestSASLAuth, start, err
+		}
+
+		return common.SASLAuthRequest{
+			Mechanism: mech,
+			Data:      data,
+			Opaque:    reqHeader.OpaqueToken,
+		}, common.RequestSASLAuth, start, nil
 	}
 
 	log.Printf("Error processing request: unknown command. Command: %X\nWhole request:%#v", reqHeader.Opcode, reqHeader)
@@ -291,22 +501,26 @@ func (b BinaryParser) Parse() (common.Request, common.RequestType, uint64, error
 	return nil, common.RequestUnknown, start, common.ErrUnknownCmd
 }
 
-func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error) {
+func readBatchGet(r io.Reader, header RequestHeader, state *batchState) (common.GetRequest, error) {
 	var keys [][]byte
 	var opaques []uint32
 	var quiet []bool
 	var noopOpaque uint32
 	var noopEnd bool
 
-	// while GETQ
+	// while GETQ or GETKQ
 	// read key, read header
-	for header.Opcode == OpcodeGetQ {
+	for header.Opcode == OpcodeGetQ || header.Opcode == OpcodeGetKQ {
 		// key
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
 			return common.GetRequest{}, err
 		}
 
+		if header.Opcode == OpcodeGetKQ {
+			state.setKeyed(header.OpaqueToken)
+		}
+
 		keys = append(keys, key)
 		opaques = append(opaques, header.OpaqueToken)
 		quiet = append(quiet, true)
@@ -319,13 +533,17 @@ func readBatchGet(r io.Reader, header RequestHeader) (common.GetRequest, error)
 		}
 	}
 
-	if header.Opcode == OpcodeGet {
+	if header.Opcode == OpcodeGet || header.Opcode == OpcodeGetK {
 		// key
 		key, err := readString(r, header.KeyLength)
 		if err != nil {
 			return common.GetRequest{}, err
 		}
 
+		if header.Opcode == OpcodeGetK {
+			state.setKeyed(header.OpaqueToken)
+		}
+
 		keys = append(keys, key)
 		opaques = append(opaques, header.OpaqueToken)
 		quiet = append(quiet, false)
@@ -431,6 +649,12 @@ func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType
 		return common.SetRequest{}, reqType, start, err
 	}
 
+	sig, err := readSignature(r, reqHeader, 8)
+	if err != nil {
+		log.Println("Error reading signature")
+		return common.SetRequest{}, reqType, start, err
+	}
+
 	key, err := readString(r, reqHeader.KeyLength)
 	if err != nil {
 		log.Println("Error reading key")
@@ -441,52 +665,180 @@ func setRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType
 		uint32(reqHeader.ExtraLength) -
 		uint32(reqHeader.KeyLength)
 
+	// Large values of unsigned sets can go to the handler straight from the connection
+	if sig == nil && common.StreamValue(uint64(realLength)) {
+		return common.SetRequest{
+			Quiet:   quiet,
+			Key:     key,
+			Flags:   flags,
+			Exptime: exptime,
+			Opaque:  reqHeader.OpaqueToken,
+			Cas:     reqHeader.CASToken,
+			Stream:  common.NewValueReader(r, int64(realLength), 0),
+			Length:  int(realLength),
+		}, reqType, start, nil
+	}
+
 	// Read in the body of the set request
-	dataBuf := make([]byte, realLength)
-	n, err := io.ReadAtLeast(r, dataBuf, int(realLength))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
-	if err != nil {
+	dataBuf, err := readValue(r, realLength)
+	if err == common.ErrValueTooBig {
+		return common.SetRequest{
+			Quiet:  quiet,
+			Key:    key,
+			Opaque: reqHeader.OpaqueToken,
+		}, reqType, start, err
+	} else if err != nil {
 		return common.SetRequest{}, reqType, start, err
 	}
 
 	return common.SetRequest{
-		Quiet:   quiet,
-		Key:     key,
-		Flags:   flags,
-		Exptime: exptime,
-		Opaque:  reqHeader.OpaqueToken,
-		Data:    dataBuf,
+		Quiet:     quiet,
+		Key:       key,
+		Flags:     flags,
+		Exptime:   exptime,
+		Opaque:    reqHeader.OpaqueToken,
+		Cas:       reqHeader.CASToken,
+		Data:      dataBuf,
+		Signature: sig,
 	}, reqType, start, nil
 }
 
 func appendPrependRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
 	// key, value
+	sig, err := readSignature(r, reqHeader, 0)
+	if err != nil {
+		log.Println("Error reading signature")
+		return common.SetRequest{}, reqType, start, err
+	}
+
 	key, err := readString(r, reqHeader.KeyLength)
 	if err != nil {
 		log.Println("Error reading key")
 		return common.SetRequest{}, reqType, start, err
 	}
 
-	realLength := reqHeader.TotalBodyLength - uint32(reqHeader.KeyLength)
+	realLength := reqHeader.TotalBodyLength -
+		uint32(reqHeader.ExtraLength) -
+		uint32(reqHeader.KeyLength)
 
 	// Read in the body of the set request
-	dataBuf := make([]byte, realLength)
-	n, err := io.ReadAtLeast(r, dataBuf, int(realLength))
-	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
-	if err != nil {
+	dataBuf, err := readValue(r, realLength)
+	if err == common.ErrValueTooBig {
+		return common.SetRequest{
+			Quiet:  quiet,
+			Key:    key,
+			Opaque: reqHeader.OpaqueToken,
+		}, reqType, start, err
+	} else if err != nil {
 		return common.SetRequest{}, reqType, start, err
 	}
 
 	return common.SetRequest{
-		Quiet:   quiet,
-		Key:     key,
-		Flags:   0,
-		Exptime: 0,
-		Opaque:  reqHeader.OpaqueToken,
-		Data:    dataBuf,
+		Quiet:     quiet,
+		Key:       key,
+		Flags:     0,
+		Exptime:   0,
+		Opaque:    reqHeader.OpaqueToken,
+		Cas:       reqHeader.CASToken,
+		Data:      dataBuf,
+		Signature: sig,
 	}, reqType, start, nil
 }
 
+// readValue reads the value of a store command. Values over the maximum value size are discarded
+// instead so the connection stays in sync for the error response.
+func readValue(r io.Reader, length uint32) ([]byte, error) {
+	if common.ValueTooBig(uint64(length)) {
+		n, err := io.CopyN(ioutil.Discard, r, int64(length))
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+		if err != nil {
+			return nil, err
+		}
+		return nil, common.ErrValueTooBig
+	}
+
+	dataBuf := make([]byte, length)
+	n, err := io.ReadAtLeast(r, dataBuf, int(length))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return dataBuf, nil
+}
+
+func incrDecrRequest(r io.Reader, reqHeader RequestHeader, reqType common.RequestType, quiet bool, start uint64) (common.IncrDecrRequest, common.RequestType, uint64, error) {
+	// delta, initial, exptime, key
+	delta, err := readUInt64(r)
+	if err != nil {
+		log.Println("Error reading delta")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	initial, err := readUInt64(r)
+	if err != nil {
+		log.Println("Error reading initial value")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	exptime, err := readUInt32(r)
+	if err != nil {
+		log.Println("Error reading exptime")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	sig, err := readSignature(r, reqHeader, 20)
+	if err != nil {
+		log.Println("Error reading signature")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	key, err := readString(r, reqHeader.KeyLength)
+	if err != nil {
+		log.Println("Error reading key")
+		return common.IncrDecrRequest{}, reqType, start, err
+	}
+
+	return common.IncrDecrRequest{
+		Quiet:     quiet,
+		Key:       key,
+		Delta:     delta,
+		Initial:   initial,
+		Exptime:   exptime,
+		Opaque:    reqHeader.OpaqueToken,
+		Signature: sig,
+	}, reqType, start, nil
+}
+
+// MaxSASLDataLength is the largest auth data accepted in a SASL auth request
+const MaxSASLDataLength = 4096
+
+// SignatureLength is the size of the request signature that a client may
+// append to the normal extras of a mutation command. A signed set would then
+// have an extras length of 16 instead of 8, a signed delete 8 instead of 0.
+const SignatureLength = 8
+
+// readSignature reads the request signature, if any, that follows the normal
+// extras for the command. The baseExtras param is the standard extras length
+// for the opcode.
+func readSignature(r io.Reader, reqHeader RequestHeader, baseExtras uint8) ([]byte, error) {
+	switch reqHeader.ExtraLength {
+	case baseExtras:
+		return nil, nil
+	case baseExtras + SignatureLength:
+		return readString(r, SignatureLength)
+	}
+
+	// Discard the unknown extras so the stream stays in sync
+	if reqHeader.ExtraLength > baseExtras {
+		if _, err := readString(r, uint16(reqHeader.ExtraLength-baseExtras)); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
 func readString(r io.Reader, l uint16) ([]byte, error) {
 	buf := make([]byte, l)
 	n, err := io.ReadAtLeast(r, buf, int(l))
@@ -509,3 +861,15 @@ func readUInt32(r io.Reader) (uint32, error) {
 
 	return binary.BigEndian.Uint32(buf), nil
 }
+
+func readUInt64(r io.Reader) (uint64, error) {
+	buf := make([]byte, 8)
+
+	n, err := io.ReadAtLeast(r, buf, 8)
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	if err != nil {
+		return uint64(0), err
+	}
+
+	return binary.BigEndian.Uint64(buf), nil
+}
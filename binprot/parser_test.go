@@ -36,7 +36,7 @@ func TestUnknownCommand(t *testing.T) {
 		0x00, 0x00, 0x00, 0x00, // CAS
 		0x00, 0x00, 0x00, 0x00, // CAS
 	}))
-	req, reqType, err := binprot.NewBinaryParser(r).Parse()
+	req, reqType, _, err := binprot.NewBinaryParser(r).Parse()
 
 	if req != nil {
 		t.Fatal("Expected request struct to be nil")
@@ -48,3 +48,258 @@ func TestUnknownCommand(t *testing.T) {
 		t.Fatal("Expected error to be Unknown Command")
 	}
 }
+
+func TestDeleteSignature(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBuffer([]byte{
+		0x80,       // Magic
+		0x04,       // Delete opcode
+		0x00, 0x01, // key length
+		0x08,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x09, // total body length
+		0x00, 0x00, 0x00, 0xA5, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x01, 0x02, 0x03, 0x04, // Signature
+		0x05, 0x06, 0x07, 0x08, // Signature
+		'k', // Key
+	}))
+	req, reqType, _, err := binprot.NewBinaryParser(r).Parse()
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestDelete {
+		t.Fatal("Expected request type to be Delete")
+	}
+	dr := req.(common.DeleteRequest)
+	if !bytes.Equal(dr.Key, []byte("k")) {
+		t.Fatalf("Expected key to be k, got %s", dr.Key)
+	}
+	if !bytes.Equal(dr.Signature, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Fatalf("Unexpected signature %v", dr.Signature)
+	}
+}
+
+func TestStreamedSet(t *testing.T) {
+	common.SetStreamValueSize(4)
+	defer common.SetStreamValueSize(0)
+
+	r := bufio.NewReader(bytes.NewBuffer([]byte{
+		0x80,       // Magic
+		0x01,       // Set opcode
+		0x00, 0x01, // key length
+		0x08,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x0E, // total body length
+		0x00, 0x00, 0x00, 0xA5, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x07, // Flags
+		0x00, 0x00, 0x00, 0x00, // Exptime
+		'k',                     // Key
+		'v', 'a', 'l', 'u', 'e', // Value
+		0x80, // Start of the next request
+	}))
+	req, reqType, _, err := binprot.NewBinaryParser(r).Parse()
+
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestSet {
+		t.Fatal("Expected request type to be Set")
+	}
+	sr := req.(common.SetRequest)
+	if sr.Stream == nil || sr.Data != nil || sr.Length != 5 || sr.Flags != 7 {
+		t.Fatalf("Expected a streamed value, got %+v", sr)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(sr.Stream)
+	if buf.String() != "value" {
+		t.Fatalf("Expected the value to be streamed, got %q", buf.String())
+	}
+	if b, _ := r.ReadByte(); b != 0x80 {
+		t.Fatalf("Expected the stream to end with the value")
+	}
+}
+
+func TestGetKQBatch(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBuffer([]byte{
+		0x80,       // Magic
+		0x0d,       // GetKQ opcode
+		0x00, 0x01, // key length
+		0x00,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x01, // total body length
+		0x00, 0x00, 0x00, 0x01, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+		'a',        // Key
+		0x80,       // Magic
+		0x09,       // GetQ opcode
+		0x00, 0x01, // key length
+		0x00,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x01, // total body length
+		0x00, 0x00, 0x00, 0x02, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+		'b',        // Key
+		0x80,       // Magic
+		0x0a,       // Noop opcode
+		0x00, 0x00, // key length
+		0x00,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x00, // total body length
+		0x00, 0x00, 0x00, 0x03, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+	}))
+	out := &bytes.Buffer{}
+	p, res := binprot.NewBinaryParserResponder(r, bufio.NewWriter(out))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestGet {
+		t.Fatal("Expected request type to be Get")
+	}
+	gr := req.(common.GetRequest)
+	if len(gr.Keys) != 2 || !gr.NoopEnd || gr.NoopOpaque != 3 {
+		t.Fatalf("Unexpected request %+v", gr)
+	}
+
+	res.Get(common.GetResponse{Key: []byte("a"), Data: []byte("x"), Opaque: 1, Quiet: true})
+	res.Get(common.GetResponse{Key: []byte("b"), Opaque: 2, Quiet: true, Miss: true})
+	if out.Len() != 0 {
+		t.Fatalf("Expected quiet responses to be buffered, got %d bytes", out.Len())
+	}
+	res.GetEnd(gr.NoopOpaque, gr.NoopEnd)
+
+	// GetK response with key and value, then the noop. The miss is not sent.
+	if out.Len() != 24+4+1+1+24 {
+		t.Fatalf("Unexpected response length %d", out.Len())
+	}
+	b := out.Bytes()
+	if b[1] != 0x0c || b[3] != 0x01 || b[28] != 'a' || b[29] != 'x' || b[31] != 0x0a {
+		t.Fatalf("Unexpected response % x", b)
+	}
+}
+
+func TestGATKQ(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBuffer([]byte{
+		0x80,       // Magic
+		0x24,       // GatKQ opcode
+		0x00, 0x01, // key length
+		0x04,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x05, // total body length
+		0x00, 0x00, 0x00, 0x07, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x3c, // Exptime
+		'a', // Key
+	}))
+	out := &bytes.Buffer{}
+	p, res := binprot.NewBinaryParserResponder(r, bufio.NewWriter(out))
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reqType != common.RequestGat {
+		t.Fatal("Expected request type to be Gat")
+	}
+	gr := req.(common.GATRequest)
+	if string(gr.Key) != "a" || gr.Exptime != 60 || !gr.Quiet || gr.Opaque != 7 {
+		t.Fatalf("Unexpected request %+v", gr)
+	}
+
+	// A quiet miss sends nothing and a quiet hit is buffered
+	res.GAT(common.GetResponse{Key: gr.Key, Opaque: gr.Opaque, Quiet: gr.Quiet, Miss: true})
+	res.GAT(common.GetResponse{Key: gr.Key, Data: []byte("x"), Opaque: gr.Opaque, Quiet: gr.Quiet})
+	if out.Len() != 0 {
+		t.Fatalf("Expected quiet responses to be buffered, got %d bytes", out.Len())
+	}
+	res.Noop(0)
+
+	// GatK response with key and value, then the noop
+	if out.Len() != 24+4+1+1+24 {
+		t.Fatalf("Unexpected response length %d", out.Len())
+	}
+	b := out.Bytes()
+	if b[1] != 0x23 || b[3] != 0x01 || b[28] != 'a' || b[29] != 'x' || b[31] != 0x0a {
+		t.Fatalf("Unexpected response % x", b)
+	}
+}
+
+// saslAuth returns a SASL auth request with the given header lengths and body, followed by a noop
+func saslAuth(keyLength uint16, extraLength uint8, bodyLength uint32, body []byte) []byte {
+	req := []byte{
+		0x80,                                  // Magic
+		0x21,                                  // SASL auth opcode
+		byte(keyLength >> 8), byte(keyLength), // key length
+		extraLength, // Extra length
+		0x00,        // Data type
+		0x00, 0x00,  // VBucket
+		byte(bodyLength >> 24), byte(bodyLength >> 16), byte(bodyLength >> 8), byte(bodyLength), // total body length
+		0x00, 0x00, 0x00, 0xA5, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+	}
+	req = append(req, body...)
+	return append(req,
+		0x80,       // Magic
+		0x0A,       // Noop opcode
+		0x00, 0x00, // key length
+		0x00,       // Extra length
+		0x00,       // Data type
+		0x00, 0x00, // VBucket
+		0x00, 0x00, 0x00, 0x00, // total body length
+		0x00, 0x00, 0x00, 0x00, // opaque token
+		0x00, 0x00, 0x00, 0x00, // CAS
+		0x00, 0x00, 0x00, 0x00, // CAS
+	)
+}
+
+func TestSASLAuth(t *testing.T) {
+	body := append([]byte{0x00, 0x00, 0x00, 0x00}, "PLAIN\x00user\x00pass"...)
+	r := bufio.NewReader(bytes.NewBuffer(saslAuth(5, 4, uint32(len(body)), body)))
+	req, reqType, _, err := binprot.NewBinaryParser(r).Parse()
+
+	if err != nil || reqType != common.RequestSASLAuth {
+		t.Fatalf("Expected a SASL auth request, got %v %v", reqType, err)
+	}
+	ar := req.(common.SASLAuthRequest)
+	if string(ar.Mechanism) != "PLAIN" || string(ar.Data) != "\x00user\x00pass" {
+		t.Fatalf("Unexpected request %+v", ar)
+	}
+}
+
+func TestSASLAuthBadLength(t *testing.T) {
+	big := make([]byte, binprot.MaxSASLDataLength+6)
+	copy(big, "PLAIN")
+
+	for name, req := range map[string][]byte{
+		"KeyPastBody":    saslAuth(5, 0, 2, []byte("PL")),
+		"ExtrasPastBody": saslAuth(5, 4, 6, []byte("PLAIN\x00")),
+		"TooBig":         saslAuth(5, 0, uint32(len(big)), big),
+	} {
+		p := binprot.NewBinaryParser(bufio.NewReader(bytes.NewBuffer(req)))
+
+		if _, _, _, err := p.Parse(); err != common.ErrBadLength {
+			t.Fatalf("%s: expected a bad length, got %v", name, err)
+		}
+		if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestNoop {
+			t.Fatalf("%s: expected the next request to be a noop, got %v %v", name, reqType, err)
+		}
+	}
+}
@@ -17,6 +17,8 @@ package binprot
 import (
 	"bufio"
 	"encoding/binary"
+	"io"
+	"strings"
 
 	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/metrics"
@@ -116,8 +118,24 @@ import (
 //     Key                 : None
 //     Value               : None
 
+// Sample Incr response
+// Field        (offset) (value)
+//     Magic        (0)    : 0x81
+//     Opcode       (1)    : 0x05
+//     Key length   (2,3)  : 0x0000
+//     Extra length (4)    : 0x00
+//     Data type    (5)    : 0x00
+//     Status       (6,7)  : 0x0000
+//     Total body   (8-11) : 0x00000008
+//     Opaque       (12-15): 0x00000000
+//     CAS          (16-23): 0x0000000000000000
+//     Extras              : None
+//     Key                 : None
+//     Value        (24-31): 0x0000000000000005
+
 type BinaryResponder struct {
 	writer *bufio.Writer
+	state  *batchState
 }
 
 func NewBinaryResponder(writer *bufio.Writer) BinaryResponder {
@@ -128,35 +146,35 @@ func NewBinaryResponder(writer *bufio.Writer) BinaryResponder {
 
 func (b BinaryResponder) Set(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeSet, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeSet, 0, 0, 0, opaque, 0, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Add(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeAdd, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeAdd, 0, 0, 0, opaque, 0, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Replace(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeReplace, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeReplace, 0, 0, 0, opaque, 0, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Append(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeAppend, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeAppend, 0, 0, 0, opaque, 0, true)
 	}
 	return nil
 }
 
 func (b BinaryResponder) Prepend(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodePrepend, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodePrepend, 0, 0, 0, opaque, 0, true)
 	}
 	return nil
 }
@@ -169,17 +187,29 @@ func (b BinaryResponder) Get(response common.GetResponse) error {
 		return nil
 	}
 
-	return getCommon(b.writer, response, OpcodeGet)
+	// Hits for quiet gets are buffered until the end of the batch so a pipelined batch goes
+	// out in as few writes as possible.
+	if b.state.isKeyed(response.Opaque) {
+		return getCommon(b.writer, response, OpcodeGetK, response.Key, !response.Quiet)
+	}
+	return getCommon(b.writer, response, OpcodeGet, nil, !response.Quiet)
+}
+
+// CanStream reports whether gets can be answered from a GetResponse.Stream, which is always true
+// for the binary protocol.
+func (b BinaryResponder) CanStream() bool {
+	return true
 }
 
 func (b BinaryResponder) GetEnd(opaque uint32, noopEnd bool) error {
 	// if Noop was the end of the pipelined batch gets, respond with a Noop header
 	// otherwise, stay quiet as the last get would be a GET and not a GETQ
 	if noopEnd {
-		return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, 0, true)
 	}
 
-	return nil
+	// Make sure any buffered quiet hits are sent
+	return b.writer.Flush()
 }
 
 func (b BinaryResponder) GAT(response common.GetResponse) error {
@@ -190,7 +220,11 @@ func (b BinaryResponder) GAT(response common.GetResponse) error {
 		return nil
 	}
 
-	return getCommon(b.writer, response, OpcodeGat)
+	// Like quiet gets, hits for quiet GATs are buffered until a Noop or a non-quiet command
+	if b.state.isKeyed(response.Opaque) {
+		return getCommon(b.writer, response, OpcodeGatK, response.Key, !response.Quiet)
+	}
+	return getCommon(b.writer, response, OpcodeGat, nil, !response.Quiet)
 }
 
 func (b BinaryResponder) GetE(response common.GetEResponse) error {
@@ -203,7 +237,7 @@ func (b BinaryResponder) GetE(response common.GetEResponse) error {
 
 	// total body length = extras (flags & exptime, 8 bytes) + data length
 	totalBodyLength := len(response.Data) + 8
-	writeSuccessResponseHeader(b.writer, OpcodeGetE, 0, 8, totalBodyLength, response.Opaque, false)
+	writeSuccessResponseHeader(b.writer, OpcodeGetE, 0, 8, totalBodyLength, response.Opaque, response.Cas, false)
 	binary.Write(b.writer, binary.BigEndian, response.Flags)
 	binary.Write(b.writer, binary.BigEndian, response.Exptime)
 	b.writer.Write(response.Data)
@@ -215,32 +249,80 @@ func (b BinaryResponder) GetE(response common.GetEResponse) error {
 	return nil
 }
 
-func (b BinaryResponder) Delete(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeDelete, 0, 0, 0, opaque, true)
+func (b BinaryResponder) Delete(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer, OpcodeDelete, 0, 0, 0, opaque, 0, true)
+	}
+	return nil
 }
 
 func (b BinaryResponder) Touch(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeTouch, 0, 0, 0, opaque, true)
+	return writeSuccessResponseHeader(b.writer, OpcodeTouch, 0, 0, 0, opaque, 0, true)
 }
 
 func (b BinaryResponder) Noop(opaque uint32) error {
-	return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, true)
+	return writeSuccessResponseHeader(b.writer, OpcodeNoop, 0, 0, 0, opaque, 0, true)
 }
 
 func (b BinaryResponder) Quit(opaque uint32, quiet bool) error {
 	if !quiet {
-		return writeSuccessResponseHeader(b.writer, OpcodeQuit, 0, 0, 0, opaque, true)
+		return writeSuccessResponseHeader(b.writer, OpcodeQuit, 0, 0, 0, opaque, 0, true)
 	}
 	return nil
 }
 
-func (b BinaryResponder) Version(opaque uint32) error {
-	if err := writeSuccessResponseHeader(b.writer, OpcodeVersion, 0, 0, len(common.VersionString), opaque, false); err != nil {
-		return err
+func (b BinaryResponder) Version(opaque uint32, version string) error {
+	return stringCommon(b.writer, OpcodeVersion, opaque, version)
+}
+
+func (b BinaryResponder) Flush(opaque uint32, quiet bool) error {
+	if !quiet {
+		return writeSuccessResponseHeader(b.writer, OpcodeFlush, 0, 0, 0, opaque, 0, true)
 	}
-	n, _ := b.writer.WriteString(common.VersionString)
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
-	return b.writer.Flush()
+	return nil
+}
+
+// Verbosity has no quiet variant in the binary protocol, so it always responds.
+func (b BinaryResponder) Verbosity(opaque uint32, quiet bool) error {
+	return writeSuccessResponseHeader(b.writer, OpcodeVerbosity, 0, 0, 0, opaque, 0, true)
+}
+
+// Stats sends each stat as its own response with the name as the key and the value as the value,
+// followed by an empty response to mark the end.
+func (b BinaryResponder) Stats(opaque uint32, stats []common.Stat) error {
+	for _, stat := range stats {
+		totalBodyLength := len(stat.Name) + len(stat.Value)
+		if err := writeSuccessResponseHeader(b.writer, OpcodeStat, len(stat.Name), 0, totalBodyLength, opaque, 0, false); err != nil {
+			return err
+		}
+		b.writer.WriteString(stat.Name)
+		b.writer.WriteString(stat.Value)
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
+	}
+
+	return writeSuccessResponseHeader(b.writer, OpcodeStat, 0, 0, 0, opaque, 0, true)
+}
+
+func (b BinaryResponder) SASLListMechs(opaque uint32, mechs []string) error {
+	return stringCommon(b.writer, OpcodeSASLListMechs, opaque, strings.Join(mechs, " "))
+}
+
+func (b BinaryResponder) SASLAuth(opaque uint32) error {
+	return stringCommon(b.writer, OpcodeSASLAuth, opaque, "Authenticated")
+}
+
+func (b BinaryResponder) Incr(opaque uint32, value uint64, quiet bool) error {
+	if !quiet {
+		return arithCommon(b.writer, OpcodeIncrement, opaque, value)
+	}
+	return nil
+}
+
+func (b BinaryResponder) Decr(opaque uint32, value uint64, quiet bool) error {
+	if !quiet {
+		return arithCommon(b.writer, OpcodeDecrement, opaque, value)
+	}
+	return nil
 }
 
 func (b BinaryResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
@@ -255,7 +337,9 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 		return OpcodeGet
 	case rt == common.RequestGet && !quiet:
 		return OpcodeGet
-	case rt == common.RequestGat:
+	case rt == common.RequestGat && quiet:
+		return OpcodeGatQ
+	case rt == common.RequestGat && !quiet:
 		return OpcodeGat
 	case rt == common.RequestGetE:
 		return OpcodeGetE
@@ -285,28 +369,85 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 		return OpcodeDelete
 	case rt == common.RequestTouch:
 		return OpcodeTouch
+	case rt == common.RequestIncr && quiet:
+		return OpcodeIncrementQ
+	case rt == common.RequestIncr && !quiet:
+		return OpcodeIncrement
+	case rt == common.RequestDecr && quiet:
+		return OpcodeDecrementQ
+	case rt == common.RequestDecr && !quiet:
+		return OpcodeDecrement
+	case rt == common.RequestFlush && quiet:
+		return OpcodeFlushQ
+	case rt == common.RequestFlush && !quiet:
+		return OpcodeFlush
+	case rt == common.RequestVerbosity:
+		return OpcodeVerbosity
+	case rt == common.RequestStats:
+		return OpcodeStat
+	case rt == common.RequestSASLListMechs:
+		return OpcodeSASLListMechs
+	case rt == common.RequestSASLAuth:
+		return OpcodeSASLAuth
 	default:
 		return OpcodeInvalid
 	}
 }
 
-func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8) error {
-	// total body length = extras (flags, 4 bytes) + data length
-	totalBodyLength := len(response.Data) + 4
-	writeSuccessResponseHeader(w, opcode, 0, 4, totalBodyLength, response.Opaque, false)
+func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8, key []byte, flush bool) error {
+	length := len(response.Data)
+	if response.Stream != nil {
+		length = response.Length
+	}
+
+	// total body length = extras (flags, 4 bytes) + key length + data length
+	totalBodyLength := length + len(key) + 4
+	writeSuccessResponseHeader(w, opcode, len(key), 4, totalBodyLength, response.Opaque, response.Cas, false)
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf, response.Flags)
 	w.Write(buf)
-	w.Write(response.Data)
+	w.Write(key)
+	if response.Stream != nil {
+		// A streamed value has to be complete before anything else can be written
+		if _, err := io.CopyN(w, response.Stream, int64(length)); err != nil {
+			return err
+		}
+	} else {
+		w.Write(response.Data)
+	}
+	if flush {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
+	return nil
+}
+
+func stringCommon(w *bufio.Writer, opcode uint8, opaque uint32, value string) error {
+	if err := writeSuccessResponseHeader(w, opcode, 0, 0, len(value), opaque, 0, false); err != nil {
+		return err
+	}
+	n, _ := w.WriteString(value)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	return w.Flush()
+}
+
+func arithCommon(w *bufio.Writer, opcode uint8, opaque uint32, value uint64) error {
+	// total body length = value (8 bytes)
+	writeSuccessResponseHeader(w, opcode, 0, 0, 8, opaque, 0, false)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	w.Write(buf)
 	if err := w.Flush(); err != nil {
 		return err
 	}
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(totalBodyLength))
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, 8)
 	return nil
 }
 
 func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraLength,
-	totalBodyLength int, opaque uint32, flush bool) error {
+	totalBodyLength int, opaque uint32, cas uint64, flush bool) error {
 
 	header := resHeadPool.Get().(ResponseHeader)
 
@@ -318,7 +459,7 @@ func writeSuccessResponseHeader(w *bufio.Writer, opcode uint8, keyLength, extraL
 	header.Status = StatusSuccess
 	header.TotalBodyLength = uint32(totalBodyLength)
 	header.OpaqueToken = opaque
-	header.CASToken = uint64(0)
+	header.CASToken = cas
 
 	if err := writeResponseHeader(w, header); err != nil {
 		resHeadPool.Put(header)
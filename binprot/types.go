@@ -27,7 +27,7 @@ const (
 	MagicResponse = uint8(0x81)
 
 	// All opcodes as defined in memcached
-	// Minus SASL and range ops
+	// Minus range ops
 	OpcodeGet        = uint8(0x00)
 	OpcodeSet        = uint8(0x01)
 	OpcodeAdd        = uint8(0x02)
@@ -55,12 +55,18 @@ const (
 	OpcodeFlushQ     = uint8(0x18)
 	OpcodeAppendQ    = uint8(0x19)
 	OpcodePrependQ   = uint8(0x1a)
+	OpcodeVerbosity  = uint8(0x1b)
 	OpcodeTouch      = uint8(0x1c)
 	OpcodeGat        = uint8(0x1d)
 	OpcodeGatQ       = uint8(0x1e)
-	OpcodeGatK       = uint8(0x23)
-	OpcodeGatKQ      = uint8(0x24)
-	OpcodeInvalid    = uint8(0xFF)
+
+	OpcodeSASLListMechs = uint8(0x20)
+	OpcodeSASLAuth      = uint8(0x21)
+	OpcodeSASLStep      = uint8(0x22)
+
+	OpcodeGatK    = uint8(0x23)
+	OpcodeGatKQ   = uint8(0x24)
+	OpcodeInvalid = uint8(0xFF)
 
 	OpcodeGetE  = uint8(0x40)
 	OpcodeGetEQ = uint8(0x41)
@@ -123,7 +129,7 @@ func errorToCode(err error) uint16 {
 		return StatusKeyExists
 	case common.ErrValueTooBig:
 		return StatusE2big
-	case common.ErrInvalidArgs:
+	case common.ErrInvalidArgs, common.ErrBadKey:
 		return StatusEinval
 	case common.ErrItemNotStored:
 		return StatusNotStored
@@ -141,7 +147,7 @@ func errorToCode(err error) uint16 {
 		return StatusInternalError
 	case common.ErrBusy:
 		return StatusBusy
-	case common.ErrTempFailure:
+	case common.ErrTempFailure, common.ErrTimeout:
 		return StatusTempFailure
 	}
 	return StatusInvalid
@@ -60,6 +60,9 @@ var (
 			return make([][]byte, 0, 26)
 		},
 	}
+
+	// pacer is shared by all of the task generators so together they keep to --rate
+	pacer = common.NewPacer(f.Rate, f.RateJitter)
 )
 
 func init() {
@@ -98,8 +101,13 @@ func main() {
 	fmt.Printf("Performing %v operations total with:\n"+
 		"\t%v communication goroutines\n"+
 		"\tcommands %v\n"+
+		"\tkeys from the %v distribution\n"+
 		"\tover the %v protocol\n\n",
-		f.NumOps, f.NumWorkers, usedCmds, protString)
+		f.NumOps, f.NumWorkers, usedCmds, f.KeyDist, protString)
+
+	if f.Rate > 0 {
+		fmt.Printf("Pacing operations to %v per second\n\n", f.Rate)
+	}
 
 	tasks := make(chan *common.Task)
 	taskGens := new(sync.WaitGroup)
@@ -239,23 +247,40 @@ func main() {
 
 func cmdGenerator(tasks chan<- *common.Task, taskGens *sync.WaitGroup, numTasks int, cmd common.Op) {
 	r := rand.New(rand.NewSource(common.RandSeed()))
+	keys := common.NewKeyGen(r, common.KeyConfig{
+		Dist:        f.KeyDist,
+		Length:      f.KeyLength,
+		Keyspace:    f.Keyspace,
+		Skew:        f.ZipfSkew,
+		HotKeys:     f.HotKeys,
+		HotFraction: f.HotFraction,
+	})
+	sizes := common.NewSizeGen(r, common.SizeConfig{
+		Dist:          f.ValueDist,
+		Size:          f.ValueSize,
+		Min:           f.ValueMin,
+		Max:           f.ValueMax,
+		Sigma:         f.ValueSigma,
+		LargeFraction: f.ValueLargeFraction,
+		LargeMin:      f.ValueLargeMin,
+		LargeMax:      f.ValueLargeMax,
+	})
 
 	for i := 0; i < numTasks; i++ {
 		task := taskPool.Get().(*common.Task)
 		task.Cmd = cmd
-		task.Key = common.RandData(r, f.KeyLength, false)
-		task.Value = taskValue(r, cmd)
+		task.Key = keys()
+		task.Value = taskValue(r, sizes, cmd)
+		pacer.Wait()
 		tasks <- task
 	}
 
 	taskGens.Done()
 }
 
-func taskValue(r *rand.Rand, cmd common.Op) []byte {
+func taskValue(r *rand.Rand, sizes common.SizeGen, cmd common.Op) []byte {
 	if cmd == common.Set || cmd == common.Add || cmd == common.Replace {
-		// Random length between 1k and 10k
-		valLen := r.Intn(9*1024) + 1024
-		return common.RandData(r, valLen, true)
+		return common.RandData(r, sizes(), true)
 	}
 
 	return nil
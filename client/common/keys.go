@@ -0,0 +1,107 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import "math"
+import "math/rand"
+
+// Key distributions for generated operations
+const (
+	// Every key is as likely as any other
+	KeyDistUniform = "uniform"
+	// Keys are ranked and the chance of each falls off with its rank, so a few keys get most of
+	// the operations, like the popular items of a real cache
+	KeyDistZipfian = "zipfian"
+	// A fixed set of hot keys gets a fixed share of the operations and the rest are uniform
+	KeyDistHotspot = "hotspot"
+)
+
+// KeyGen returns the key for the next operation
+type KeyGen func() []byte
+
+// KeyConfig describes the keys of generated operations
+type KeyConfig struct {
+	// One of the KeyDist constants
+	Dist string
+	// Length of the keys, which are made of uppercase letters
+	Length int
+	// Number of different keys to draw from, so keys come up again and gets can hit. 0 means
+	// every key of the length, which is also the most there can be.
+	Keyspace int
+	// Exponent of the zipfian distribution. Must be more than 1.
+	Skew float64
+	// For hotspot, HotFraction of the keys come from the first HotKeys keys
+	HotKeys     int
+	HotFraction float64
+}
+
+// NewKeyGen makes a KeyGen that draws keys from r as conf describes
+func NewKeyGen(r *rand.Rand, conf KeyConfig) KeyGen {
+	n := keySpace(conf.Length)
+	if conf.Keyspace > 0 && uint64(conf.Keyspace) < n {
+		n = uint64(conf.Keyspace)
+	}
+
+	// uniform draws any key of the keyspace
+	uniform := func() []byte {
+		if conf.Keyspace <= 0 {
+			return RandData(r, conf.Length, false)
+		}
+		return indexKey(uint64(r.Int63n(int64(n))), conf.Length)
+	}
+
+	switch conf.Dist {
+	case KeyDistZipfian:
+		z := rand.NewZipf(r, conf.Skew, 1, n-1)
+		return func() []byte {
+			return indexKey(z.Uint64(), conf.Length)
+		}
+
+	case KeyDistHotspot:
+		hot := uint64(conf.HotKeys)
+		if hot > n {
+			hot = n
+		}
+		return func() []byte {
+			if r.Float64() < conf.HotFraction {
+				return indexKey(uint64(r.Int63n(int64(hot))), conf.Length)
+			}
+			return uniform()
+		}
+
+	default:
+		return uniform
+	}
+}
+
+// keySpace returns the number of keys of the given length, capped so it fits in an int64
+func keySpace(length int) uint64 {
+	n := uint64(1)
+	for i := 0; i < length && n <= math.MaxInt64/26; i++ {
+		n *= 26
+	}
+	return n
+}
+
+// indexKey returns the key with the given index. The index is written in base 26 at the end of
+// the key and the rest is padded with A's.
+func indexKey(i uint64, length int) []byte {
+	key := make([]byte, length)
+	for j := length - 1; j >= 0; j-- {
+		key[j] = 'A' + byte(i%26)
+		i /= 26
+	}
+	return key
+}
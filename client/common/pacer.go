@@ -0,0 +1,69 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import "math/rand"
+import "sync"
+import "time"
+
+// Pacer spaces out operations so that together they run at a target rate. Every operation waits
+// for its own slot, and the gap between slots is jittered so the load doesn't arrive in lockstep.
+type Pacer struct {
+	interval time.Duration
+	jitter   float64
+
+	lock sync.Mutex
+	r    *rand.Rand
+	next time.Time
+}
+
+// maxBehind is how far a pacer lets its slots fall behind. A pacer that falls further behind
+// starts again from now instead of bursting to catch up.
+const maxBehind = time.Second
+
+// NewPacer makes a Pacer for rate operations per second. Each gap is changed by a random amount
+// of up to jitter times itself, so jitter is between 0 and 1. A Pacer with a rate of 0 doesn't
+// wait at all.
+func NewPacer(rate, jitter float64) *Pacer {
+	p := &Pacer{
+		jitter: jitter,
+		r:      rand.New(rand.NewSource(RandSeed())),
+	}
+	if rate > 0 {
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return p
+}
+
+// Wait blocks until the caller's slot comes up
+func (p *Pacer) Wait() {
+	if p.interval == 0 {
+		return
+	}
+
+	p.lock.Lock()
+	now := time.Now()
+	if p.next.Before(now.Add(-maxBehind)) {
+		p.next = now
+	}
+	slot := p.next
+	gap := float64(p.interval) * (1 + p.jitter*(2*p.r.Float64()-1))
+	p.next = p.next.Add(time.Duration(gap))
+	p.lock.Unlock()
+
+	if d := time.Until(slot); d > 0 {
+		time.Sleep(d)
+	}
+}
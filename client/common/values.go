@@ -0,0 +1,92 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import "math"
+import "math/rand"
+
+// Value size distributions for generated sets
+const (
+	// Every value is Size bytes
+	SizeDistFixed = "fixed"
+	// Sizes are spread evenly from Min up to but not including Max
+	SizeDistUniform = "uniform"
+	// Sizes are lognormal around a median of Size bytes, so most are close to it and a few are
+	// much bigger, like the values of a real cache
+	SizeDistLognormal = "lognormal"
+	// Most sizes are uniform from Min to Max, and LargeFraction of them are uniform from LargeMin
+	// to LargeMax instead, to mix small values with ones that take many chunks
+	SizeDistMixed = "mixed"
+)
+
+// MaxValueSize caps the size of generated values
+const MaxValueSize = 64 * 1024 * 1024
+
+// SizeGen returns the size of the value for the next set
+type SizeGen func() int
+
+// SizeConfig describes the sizes of the values of generated sets
+type SizeConfig struct {
+	// One of the SizeDist constants
+	Dist string
+	// Size of fixed values and the median of lognormal ones
+	Size int
+	// Range of uniform values and of the small values of the mixed distribution
+	Min, Max int
+	// Spread of lognormal values. The sizes of about two thirds of them are within a factor of
+	// e^Sigma of the median.
+	Sigma float64
+	// Share and range of the large values of the mixed distribution
+	LargeFraction      float64
+	LargeMin, LargeMax int
+}
+
+// NewSizeGen makes a SizeGen that draws sizes from r as conf describes
+func NewSizeGen(r *rand.Rand, conf SizeConfig) SizeGen {
+	switch conf.Dist {
+	case SizeDistFixed:
+		return func() int {
+			return conf.Size
+		}
+
+	case SizeDistLognormal:
+		mu := math.Log(float64(conf.Size))
+		return func() int {
+			size := math.Exp(mu + conf.Sigma*r.NormFloat64())
+			return int(math.Max(1, math.Min(size, MaxValueSize)))
+		}
+
+	case SizeDistMixed:
+		return func() int {
+			if r.Float64() < conf.LargeFraction {
+				return between(r, conf.LargeMin, conf.LargeMax)
+			}
+			return between(r, conf.Min, conf.Max)
+		}
+
+	default:
+		return func() int {
+			return between(r, conf.Min, conf.Max)
+		}
+	}
+}
+
+// between returns a random size from lo up to but not including hi, or lo if hi isn't more
+func between(r *rand.Rand, lo, hi int) int {
+	if hi <= lo {
+		return lo
+	}
+	return r.Intn(hi-lo) + lo
+}
@@ -30,6 +30,21 @@ var NumWorkers int
 var Port int
 var Pprof string
 var Host string
+var Rate float64
+var RateJitter float64
+var KeyDist string
+var Keyspace int
+var ZipfSkew float64
+var HotKeys int
+var HotFraction float64
+var ValueDist string
+var ValueSize int
+var ValueMin int
+var ValueMax int
+var ValueSigma float64
+var ValueLargeFraction float64
+var ValueLargeMin int
+var ValueLargeMax int
 
 // Flags
 func init() {
@@ -42,9 +57,27 @@ func init() {
 	flag.IntVar(&KeyLength, "key-length", 4, "Length in bytes of each key. Smaller values mean more overlap.")
 	flag.IntVar(&KeyLength, "kl", 4, "Length in bytes of each key. Smaller values mean more overlap. (shorthand)")
 
+	flag.StringVar(&KeyDist, "key-dist", "uniform", "Distribution of the keys of generated operations: uniform, zipfian or hotspot.")
+	flag.IntVar(&Keyspace, "keyspace", 0, "Number of different keys to draw from, so keys are reused and gets can hit. 0 means every key of --key-length.")
+	flag.Float64Var(&ZipfSkew, "zipf-skew", 1.1, "Skew of the zipfian key distribution. Must be more than 1. Higher values put more of the operations on fewer keys.")
+	flag.IntVar(&HotKeys, "hot-keys", 100, "Number of hot keys in the hotspot key distribution.")
+	flag.Float64Var(&HotFraction, "hot-fraction", 0.9, "Share of the operations that go to the hot keys in the hotspot key distribution, between 0 and 1.")
+
+	flag.StringVar(&ValueDist, "value-dist", "uniform", "Distribution of the sizes of the values of generated sets: fixed, uniform, lognormal or mixed.")
+	flag.IntVar(&ValueSize, "value-size", 4096, "Size in bytes of fixed values, and the median size of lognormal values.")
+	flag.IntVar(&ValueMin, "value-min", 1024, "Smallest uniform value, and smallest small value of the mixed distribution.")
+	flag.IntVar(&ValueMax, "value-max", 10240, "Uniform values, and the small values of the mixed distribution, are smaller than this.")
+	flag.Float64Var(&ValueSigma, "value-sigma", 1, "Spread of lognormal value sizes. About two thirds are within a factor of e^sigma of --value-size.")
+	flag.Float64Var(&ValueLargeFraction, "value-large-fraction", 0.05, "Share of the values of the mixed distribution that are large, between 0 and 1.")
+	flag.IntVar(&ValueLargeMin, "value-large-min", 512*1024, "Smallest large value of the mixed distribution.")
+	flag.IntVar(&ValueLargeMax, "value-large-max", 4*1024*1024, "Large values of the mixed distribution are smaller than this.")
+
 	flag.IntVar(&NumOps, "num-ops", 1000000, "Total number of operations to perform.")
 	flag.IntVar(&NumOps, "n", 1000000, "Total number of operations to perform. (shorthand)")
 
+	flag.Float64Var(&Rate, "rate", 0, "Target operations per second, so latency can be measured at a set load. 0 means as fast as possible.")
+	flag.Float64Var(&RateJitter, "rate-jitter", 0.1, "Largest random change to each gap between operations with --rate, as a fraction of the gap from 0 to 1.")
+
 	flag.IntVar(&NumWorkers, "workers", 10, "Number of communication goroutines to run.")
 	flag.IntVar(&NumWorkers, "w", 10, "Number of communication goroutines to run.")
 
@@ -63,6 +96,34 @@ func init() {
 		os.Exit(1)
 	}
 
+	if KeyDist != "uniform" && KeyDist != "zipfian" && KeyDist != "hotspot" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch ValueDist {
+	case "fixed", "uniform", "lognormal", "mixed":
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if ValueSize <= 0 || ValueMin <= 0 || ValueMax < ValueMin || ValueSigma < 0 ||
+		ValueLargeFraction < 0 || ValueLargeFraction > 1 || ValueLargeMin <= 0 || ValueLargeMax < ValueLargeMin {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if ZipfSkew <= 1 || HotKeys <= 0 || HotFraction < 0 || HotFraction > 1 || Keyspace < 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if Rate < 0 || RateJitter < 0 || RateJitter > 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
 	if !Binary && !Text {
 		Text = true
 	}
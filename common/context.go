@@ -0,0 +1,46 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import "context"
+
+// WithContext returns req with ctx as its context, for the requests that are passed on to the
+// handlers. Other requests are returned as they are.
+func WithContext(req Request, ctx context.Context) Request {
+	switch r := req.(type) {
+	case SetRequest:
+		r.Ctx = ctx
+		return r
+	case GetRequest:
+		r.Ctx = ctx
+		return r
+	case GATRequest:
+		r.Ctx = ctx
+		return r
+	case DeleteRequest:
+		r.Ctx = ctx
+		return r
+	case TouchRequest:
+		r.Ctx = ctx
+		return r
+	case IncrDecrRequest:
+		r.Ctx = ctx
+		return r
+	case FlushRequest:
+		r.Ctx = ctx
+		return r
+	}
+	return req
+}
@@ -21,7 +21,10 @@
 package common
 
 import (
+	"context"
 	"errors"
+	"io"
+	"time"
 
 	"github.com/hongst/rend/metrics"
 )
@@ -44,6 +47,7 @@ var (
 	ErrBadLength  = errors.New("CLIENT_ERROR length is not a valid integer")
 	ErrBadFlags   = errors.New("CLIENT_ERROR flags is not a valid integer")
 	ErrBadExptime = errors.New("CLIENT_ERROR exptime is not a valid integer")
+	ErrBadKey     = errors.New("CLIENT_ERROR bad command line format")
 
 	ErrNoError        = errors.New("Success")
 	ErrKeyNotFound    = errors.New("ERROR Key not found")
@@ -59,6 +63,14 @@ var (
 	ErrInternal       = errors.New("ERROR Internal error")
 	ErrBusy           = errors.New("ERROR Busy")
 	ErrTempFailure    = errors.New("ERROR Temporary error")
+
+	// ErrTimeout means a backend took too long to respond. The connection to it has already been
+	// closed, so the request can be retried.
+	ErrTimeout = errors.New("ERROR Backend timeout")
+
+	// ErrStreamAborted means a streamed get response could not be finished after its header was
+	// already sent. It is not an app error because the only way out is to drop the connection.
+	ErrStreamAborted = errors.New("ERROR Stream aborted")
 )
 
 // IsAppError differentiates between protocol-defined errors that are relatively benign and other
@@ -78,7 +90,8 @@ func IsAppError(err error) bool {
 		err == ErrNotSupported ||
 		err == ErrInternal ||
 		err == ErrBusy ||
-		err == ErrTempFailure
+		err == ErrTempFailure ||
+		err == ErrTimeout
 }
 
 // RequestType is the protocol-agnostic identifier for the command
@@ -131,6 +144,29 @@ const (
 
 	// RequestVersion replies with a string designating the current software version
 	RequestVersion
+
+	// RequestIncr increments the numeric value stored at a key and returns the new value
+	RequestIncr
+
+	// RequestDecr decrements the numeric value stored at a key and returns the new value. The
+	// value will not go below 0.
+	RequestDecr
+
+	// RequestSASLListMechs asks for the SASL mechanisms the server supports
+	RequestSASLListMechs
+
+	// RequestSASLAuth authenticates the connection using one of the supported SASL mechanisms
+	RequestSASLAuth
+
+	// RequestStats returns statistics about the proxy and the backends behind it
+	RequestStats
+
+	// RequestFlush invalidates all items in the cache, optionally after a delay
+	RequestFlush
+
+	// RequestVerbosity sets the logging verbosity. It is accepted for compatibility and does
+	// not change anything.
+	RequestVerbosity
 )
 
 // RequestParser represents an interface to parse incoming requests. Each protocol provides its own
@@ -156,14 +192,29 @@ type Responder interface {
 	GetEnd(opaque uint32, noopEnd bool) error
 	GetE(response GetEResponse) error
 	GAT(response GetResponse) error
-	Delete(opaque uint32) error
+	Delete(opaque uint32, quiet bool) error
 	Touch(opaque uint32) error
 	Noop(opaque uint32) error
 	Quit(opaque uint32, quiet bool) error
-	Version(opaque uint32) error
+	Version(opaque uint32, version string) error
+	Incr(opaque uint32, value uint64, quiet bool) error
+	Decr(opaque uint32, value uint64, quiet bool) error
+	SASLListMechs(opaque uint32, mechs []string) error
+	SASLAuth(opaque uint32) error
+	Stats(opaque uint32, stats []Stat) error
+	Flush(opaque uint32, quiet bool) error
+	Verbosity(opaque uint32, quiet bool) error
 	Error(opaque uint32, reqType RequestType, err error, quiet bool) error
 }
 
+// StreamingResponder is implemented by a Responder that can write a get hit straight from
+// GetResponse.Stream instead of GetResponse.Data. CanStream may depend on the current command, so
+// it must be asked again for every get.
+type StreamingResponder interface {
+	Responder
+	CanStream() bool
+}
+
 type Request interface {
 	GetOpaque() uint32
 	IsQuiet() bool
@@ -178,6 +229,23 @@ type SetRequest struct {
 	Exptime uint32
 	Opaque  uint32
 	Quiet   bool
+
+	// Cas is the CAS value the item must currently have for the set to succeed. A value of 0
+	// means the set is unconditional.
+	Cas uint64
+
+	// Signature is the optional client-provided HMAC used to authorize the
+	// mutation when request signing is enabled. It is nil if not sent.
+	Signature []byte
+
+	// Stream, when not nil, replaces Data with a reader for the Length bytes of the value, still
+	// on the client connection. See SetStreamValueSize.
+	Stream io.Reader
+	Length int
+
+	// Ctx, if not nil, carries the deadline of the request. Backends that haven't answered by
+	// then are cut off. See WithContext.
+	Ctx context.Context
 }
 
 func (r SetRequest) GetOpaque() uint32 {
@@ -197,6 +265,21 @@ type GetRequest struct {
 	Quiet      []bool
 	NoopOpaque uint32
 	NoopEnd    bool
+
+	// Stream allows the handler to answer hits with a GetResponse.Stream. It must only be set by
+	// code that reads every stream it receives to the end before waiting on the next response.
+	Stream bool
+
+	// Lease asks for a lease of this many seconds on a key that misses, so that only one client
+	// recomputes it. It is only used for requests with a single key. 0 asks for none.
+	Lease uint32
+
+	// Cas says the client wants the CAS value of each hit, as with gets. Orcas with more than one
+	// tier answer these from the tier that CAS writes are checked against.
+	Cas bool
+
+	// Ctx is the context of the request, the same as SetRequest.Ctx
+	Ctx context.Context
 }
 
 func (r GetRequest) GetOpaque() uint32 {
@@ -213,9 +296,12 @@ func (r GetRequest) IsQuiet() bool {
 // DeleteRequest corresponds to common.RequestDelete. It contains all the information required to
 // fulfill a delete request.
 type DeleteRequest struct {
-	Key    []byte
-	Opaque uint32
-	Quiet  bool
+	Key       []byte
+	Opaque    uint32
+	Quiet     bool
+	Cas       uint64
+	Signature []byte
+	Ctx       context.Context
 }
 
 func (r DeleteRequest) GetOpaque() uint32 {
@@ -229,10 +315,12 @@ func (r DeleteRequest) IsQuiet() bool {
 // TouchRequest corresponds to common.RequestTouch. It contains all the information required to
 // fulfill a touch request.
 type TouchRequest struct {
-	Key     []byte
-	Exptime uint32
-	Opaque  uint32
-	Quiet   bool
+	Key       []byte
+	Exptime   uint32
+	Opaque    uint32
+	Quiet     bool
+	Signature []byte
+	Ctx       context.Context
 }
 
 func (r TouchRequest) GetOpaque() uint32 {
@@ -246,10 +334,12 @@ func (r TouchRequest) IsQuiet() bool {
 // GATRequest corresponds to common.RequestGat. It contains all the information required to fulfill
 // a get-and-touch request.
 type GATRequest struct {
-	Key     []byte
-	Exptime uint32
-	Opaque  uint32
-	Quiet   bool
+	Key       []byte
+	Exptime   uint32
+	Opaque    uint32
+	Quiet     bool
+	Signature []byte
+	Ctx       context.Context
 }
 
 func (r GATRequest) GetOpaque() uint32 {
@@ -260,6 +350,66 @@ func (r GATRequest) IsQuiet() bool {
 	return r.Quiet
 }
 
+// MaxRelativeExptime is the largest exptime memcached treats as relative to now. Anything larger
+// is an absolute unix timestamp.
+const MaxRelativeExptime = 60 * 60 * 24 * 30
+
+// RelativeExptime converts a TTL in seconds that is always relative to now, as used by protocols
+// other than memcached, into a memcached exptime.
+func RelativeExptime(seconds int64) uint32 {
+	if seconds > MaxRelativeExptime {
+		return uint32(time.Now().Unix() + seconds)
+	}
+	return uint32(seconds)
+}
+
+// CapExptime lowers an exptime, relative or absolute, to at most maxTTL seconds from now. An
+// exptime of 0, which never expires, becomes maxTTL. A maxTTL of 0 means no cap.
+func CapExptime(exptime, maxTTL uint32) uint32 {
+	if maxTTL == 0 {
+		return exptime
+	}
+	if exptime == 0 {
+		return maxTTL
+	}
+	if exptime <= MaxRelativeExptime {
+		if exptime > maxTTL {
+			return maxTTL
+		}
+		return exptime
+	}
+	if limit := uint32(time.Now().Unix()) + maxTTL; exptime > limit {
+		return limit
+	}
+	return exptime
+}
+
+// NoInitialExptime is used in an IncrDecrRequest's Exptime to signal that the item should not
+// be created if it does not exist. This matches the value used by memcached.
+const NoInitialExptime = 0xFFFFFFFF
+
+// IncrDecrRequest corresponds to common.RequestIncr and common.RequestDecr. It contains all the
+// information required to fulfill an increment or decrement request. If the key does not exist,
+// it is created with the Initial value unless Exptime is NoInitialExptime.
+type IncrDecrRequest struct {
+	Key       []byte
+	Delta     uint64
+	Initial   uint64
+	Exptime   uint32
+	Opaque    uint32
+	Quiet     bool
+	Signature []byte
+	Ctx       context.Context
+}
+
+func (r IncrDecrRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r IncrDecrRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
 // QuitRequest corresponds to common.RequestQuit. It contains all the information required to
 // fulfill a quit request.
 type QuitRequest struct {
@@ -303,6 +453,93 @@ func (r VersionRequest) IsQuiet() bool {
 	return false
 }
 
+// VerbosityRequest corresponds to common.RequestVerbosity. The level is kept only so it can be
+// logged; rend has no verbosity setting of its own.
+type VerbosityRequest struct {
+	Level  uint32
+	Opaque uint32
+	Quiet  bool
+}
+
+func (r VerbosityRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r VerbosityRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// SASLListMechsRequest corresponds to common.RequestSASLListMechs
+type SASLListMechsRequest struct {
+	Opaque uint32
+}
+
+func (r SASLListMechsRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r SASLListMechsRequest) IsQuiet() bool {
+	return false
+}
+
+// SASLAuthRequest corresponds to common.RequestSASLAuth. The format of the data depends on the
+// mechanism.
+type SASLAuthRequest struct {
+	Mechanism []byte
+	Data      []byte
+	Opaque    uint32
+}
+
+func (r SASLAuthRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r SASLAuthRequest) IsQuiet() bool {
+	return false
+}
+
+// StatsRequest corresponds to common.RequestStats. The group is empty for general stats or is a
+// group name like "items" or "slabs" that is passed on to the backends.
+type StatsRequest struct {
+	Group  []byte
+	Opaque uint32
+}
+
+func (r StatsRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r StatsRequest) IsQuiet() bool {
+	return false
+}
+
+// FlushRequest corresponds to common.RequestFlush. Delay is the number of seconds to wait before
+// the flush takes effect. 0 means immediately.
+type FlushRequest struct {
+	Delay  uint32
+	Opaque uint32
+	Quiet  bool
+
+	// Signature is the optional client-provided HMAC used to authorize the
+	// flush when request signing is enabled. It is signed with an empty key.
+	Signature []byte
+	Ctx       context.Context
+}
+
+func (r FlushRequest) GetOpaque() uint32 {
+	return r.Opaque
+}
+
+func (r FlushRequest) IsQuiet() bool {
+	return r.Quiet
+}
+
+// Stat is a single name and value pair in a stats response
+type Stat struct {
+	Name  string
+	Value string
+}
+
 // GetResponse is used in both RequestGet and RequestGat handling. Both respond in the same manner
 // but with different opcodes. It is binary-protocol specific, but is still a part of the interface
 // of responder to make the handling code more protocol-agnostic.
@@ -311,10 +548,31 @@ type GetResponse struct {
 	Data   []byte
 	Opaque uint32
 	Flags  uint32
+	Cas    uint64
 	Miss   bool
 	Quiet  bool
+
+	// Stream, when not nil, replaces Data for a hit on a GetRequest with Stream set. It yields
+	// exactly Length bytes or fails with an error, and must be read to the end by the receiver.
+	Stream io.Reader
+	Length int
+
+	// Lease says whether a miss for a GetRequest with Lease set came with a lease
+	Lease LeaseResult
 }
 
+// LeaseResult is the answer to a lease asked for by a GetRequest
+type LeaseResult int
+
+const (
+	// LeaseNone means no lease was asked for or the key hit
+	LeaseNone LeaseResult = iota
+	// LeaseGranted means the client got the lease and should compute and set the value
+	LeaseGranted
+	// LeaseHeld means another client holds the lease and is expected to set the value soon
+	LeaseHeld
+)
+
 // GetEResponse is used in the GetE protocol extension
 type GetEResponse struct {
 	Key     []byte
@@ -322,6 +580,7 @@ type GetEResponse struct {
 	Opaque  uint32
 	Flags   uint32
 	Exptime uint32
+	Cas     uint64
 	Miss    bool
 	Quiet   bool
 }
@@ -0,0 +1,59 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+// MaxKeyLength is the longest key memcached accepts
+const MaxKeyLength = 250
+
+// ValidateKey checks that a key is one memcached would accept in the text protocol: between 1 and
+// MaxKeyLength bytes with no spaces or control characters. The binary protocol is less strict,
+// but a key that can't be used from both would be unreachable from text clients.
+func ValidateKey(key []byte) error {
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return ErrBadKey
+	}
+
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return ErrBadKey
+		}
+	}
+
+	return nil
+}
+
+// ValidateKeys checks every key in a request with ValidateKey. Requests without keys are valid.
+func ValidateKeys(req Request) error {
+	switch r := req.(type) {
+	case SetRequest:
+		return ValidateKey(r.Key)
+	case GetRequest:
+		for _, key := range r.Keys {
+			if err := ValidateKey(key); err != nil {
+				return err
+			}
+		}
+	case DeleteRequest:
+		return ValidateKey(r.Key)
+	case TouchRequest:
+		return ValidateKey(r.Key)
+	case GATRequest:
+		return ValidateKey(r.Key)
+	case IncrDecrRequest:
+		return ValidateKey(r.Key)
+	}
+
+	return nil
+}
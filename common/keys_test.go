@@ -0,0 +1,60 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hongst/rend/common"
+)
+
+func TestValidateKey(t *testing.T) {
+	valid := [][]byte{
+		[]byte("a"),
+		[]byte("foo:bar/baz-1"),
+		bytes.Repeat([]byte("k"), common.MaxKeyLength),
+	}
+	for _, key := range valid {
+		if err := common.ValidateKey(key); err != nil {
+			t.Fatalf("Expected %q to be valid, got %v", key, err)
+		}
+	}
+
+	invalid := [][]byte{
+		nil,
+		[]byte("foo bar"),
+		[]byte("foo\r\nbar"),
+		[]byte("foo\x00"),
+		[]byte("foo\x7f"),
+		bytes.Repeat([]byte("k"), common.MaxKeyLength+1),
+	}
+	for _, key := range invalid {
+		if err := common.ValidateKey(key); err != common.ErrBadKey {
+			t.Fatalf("Expected %q to be invalid, got %v", key, err)
+		}
+	}
+}
+
+func TestValidateKeys(t *testing.T) {
+	req := common.GetRequest{Keys: [][]byte{[]byte("a"), []byte("b c")}}
+	if err := common.ValidateKeys(req); err != common.ErrBadKey {
+		t.Fatalf("Expected a bad key in a batch get to be caught, got %v", err)
+	}
+
+	if err := common.ValidateKeys(common.NoopRequest{}); err != nil {
+		t.Fatalf("Expected requests without keys to be valid, got %v", err)
+	}
+}
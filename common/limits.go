@@ -0,0 +1,46 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+// maxValueSize is the largest value accepted in a request, or 0 for no limit
+var maxValueSize uint64
+
+// SetMaxValueSize sets the largest value the parsers accept in a request. A larger value is
+// discarded as it is read instead of being buffered, and the request fails with ErrValueTooBig.
+// A size of 0, the default, means there is no limit.
+func SetMaxValueSize(size uint64) {
+	maxValueSize = size
+}
+
+// ValueTooBig reports whether a value of the given length is over the maximum value size
+func ValueTooBig(length uint64) bool {
+	return maxValueSize > 0 && length > maxValueSize
+}
+
+// streamValueSize is the smallest value that is streamed to the handlers, or 0 to never stream
+var streamValueSize uint64
+
+// SetStreamValueSize sets the length from which the parsers hand the values of sets, adds and
+// replaces to the handlers as a SetRequest.Stream instead of reading them into memory first. Only
+// handlers that read SetRequest.Stream may be used once it is set. A size of 0, the default, turns
+// streaming off.
+func SetStreamValueSize(size uint64) {
+	streamValueSize = size
+}
+
+// StreamValue reports whether a value of the given length should be streamed
+func StreamValue(length uint64) bool {
+	return streamValueSize > 0 && length >= streamValueSize && !ValueTooBig(length)
+}
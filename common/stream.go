@@ -0,0 +1,98 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/hongst/rend/metrics"
+)
+
+// valueReader reads a value straight from a client connection, and the bytes that follow it in
+// the request once the value has been read.
+type valueReader struct {
+	r       io.Reader
+	left    int64
+	trailer int64
+}
+
+// NewValueReader returns a reader for a value of length bytes at the front of r. Once the value
+// has been read, the trailer bytes after it, such as the "\r\n" of the text protocol, are skipped
+// so that the next request can be parsed.
+func NewValueReader(r io.Reader, length, trailer int64) io.Reader {
+	return &valueReader{
+		r:       r,
+		left:    length,
+		trailer: trailer,
+	}
+}
+
+func (v *valueReader) Read(p []byte) (int, error) {
+	if v.left == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > v.left {
+		p = p[:v.left]
+	}
+
+	n, err := v.r.Read(p)
+	metrics.IncCounterBy(MetricBytesReadRemote, uint64(n))
+	v.left -= int64(n)
+
+	if v.left == 0 && v.trailer > 0 {
+		n2, terr := io.CopyN(ioutil.Discard, v.r, v.trailer)
+		metrics.IncCounterBy(MetricBytesReadRemote, uint64(n2))
+		v.trailer = 0
+		if terr != nil {
+			return n, terr
+		}
+	}
+
+	if err == io.EOF && v.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// SkipValue reads what is left of a streamed value so that the next request can be parsed, as
+// the handler may not have read all of it, e.g. if an add failed. Requests without a streamed
+// value are left alone.
+func SkipValue(req Request) error {
+	set, ok := req.(SetRequest)
+	if !ok || set.Stream == nil {
+		return nil
+	}
+	_, err := io.Copy(ioutil.Discard, set.Stream)
+	return err
+}
+
+// BufferValue returns the request with a streamed value read into Data, for code that needs the
+// whole value at once. Requests without a streamed value are returned as they are.
+func BufferValue(req SetRequest) (SetRequest, error) {
+	if req.Stream == nil {
+		return req, nil
+	}
+
+	data := make([]byte, req.Length)
+	if _, err := io.ReadFull(req.Stream, data); err != nil {
+		return req, err
+	}
+
+	req.Data = data
+	req.Stream = nil
+	return req, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/common"
+)
+
+func TestValueReader(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("hello world\r\nget foo\r\n"))
+	data, err := ioutil.ReadAll(common.NewValueReader(r, 11, 2))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("Expected the value, got %q and %v", data, err)
+	}
+
+	rest, _ := r.ReadString('\n')
+	if rest != "get foo\r\n" {
+		t.Fatalf("Expected the next request after the value, got %q", rest)
+	}
+
+	_, err = ioutil.ReadAll(common.NewValueReader(strings.NewReader("short"), 11, 0))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected a short value to fail, got %v", err)
+	}
+}
+
+func TestSkipValue(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("hello world\r\nget foo\r\n"))
+	req := common.SetRequest{Stream: common.NewValueReader(r, 11, 2), Length: 11}
+
+	// A handler that gave up part way through the value
+	buf := make([]byte, 3)
+	io.ReadFull(req.Stream, buf)
+
+	if err := common.SkipValue(req); err != nil {
+		t.Fatalf("Error skipping value: %v", err)
+	}
+	rest, _ := r.ReadString('\n')
+	if rest != "get foo\r\n" {
+		t.Fatalf("Expected the next request after the value, got %q", rest)
+	}
+
+	if err := common.SkipValue(common.GetRequest{}); err != nil {
+		t.Fatalf("Expected requests without values to be left alone, got %v", err)
+	}
+}
+
+func TestBufferValue(t *testing.T) {
+	req := common.SetRequest{
+		Stream: common.NewValueReader(strings.NewReader("hello world"), 11, 0),
+		Length: 11,
+	}
+
+	req, err := common.BufferValue(req)
+	if err != nil {
+		t.Fatalf("Error buffering value: %v", err)
+	}
+	if req.Stream != nil || string(req.Data) != "hello world" {
+		t.Fatalf("Expected the value in Data, got %q", req.Data)
+	}
+}
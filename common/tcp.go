@@ -0,0 +1,78 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net"
+	"time"
+)
+
+// DefaultKeepAlive is the period of TCP keepalive probes when TCPOptions doesn't set one
+const DefaultKeepAlive = 30 * time.Second
+
+// TCPOptions tune the TCP connections to clients or backends. The zero value keeps the defaults.
+type TCPOptions struct {
+	// KeepAlive is the period of TCP keepalive probes. 0 uses DefaultKeepAlive and a negative
+	// period turns keepalive off.
+	KeepAlive time.Duration
+	// Nagle turns Nagle's algorithm back on so small writes are batched into fewer packets. Go
+	// turns it off (TCP_NODELAY) by default, which keeps latency down.
+	Nagle bool
+	// ReadBuffer and WriteBuffer are the sizes of the socket's receive and send buffers
+	// (SO_RCVBUF and SO_SNDBUF). 0 leaves the OS default.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// Apply sets the options on conn. Connections that aren't TCP, like unix sockets, are left as
+// they are.
+func (o TCPOptions) Apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.KeepAlive < 0 {
+		if err := tc.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else {
+		period := o.KeepAlive
+		if period == 0 {
+			period = DefaultKeepAlive
+		}
+		if err := tc.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tc.SetKeepAlivePeriod(period); err != nil {
+			return err
+		}
+	}
+
+	if err := tc.SetNoDelay(!o.Nagle); err != nil {
+		return err
+	}
+	if o.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+)
+
+func TestTCPOptionsApply(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	for _, opts := range []common.TCPOptions{
+		{},
+		{KeepAlive: 10 * time.Second, Nagle: true, ReadBuffer: 64 * 1024, WriteBuffer: 64 * 1024},
+		{KeepAlive: -1},
+	} {
+		if err := opts.Apply(conn); err != nil {
+			t.Errorf("Unexpected error applying %+v: %v", opts, err)
+		}
+	}
+}
+
+func TestTCPOptionsIgnoresOtherConns(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	if err := (common.TCPOptions{ReadBuffer: 1024}).Apply(c1); err != nil {
+		t.Fatalf("Expected connections that aren't TCP to be left alone, got %v", err)
+	}
+}
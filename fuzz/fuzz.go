@@ -0,0 +1,129 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fuzz holds fuzzing targets for the request parsers. Each target feeds arbitrary bytes
+// to a parser the same way the server loop does and panics if the parser gets stuck on the
+// stream. Parser panics are left to propagate so the fuzzer reports them.
+//
+// The Text and Binary functions follow the go-fuzz signature. The same targets are run by the
+// native Go fuzzer through FuzzText and FuzzBinary in the tests, seeded from TextSeeds and
+// BinarySeeds:
+//
+//	go test -fuzz FuzzBinary ./fuzz
+package fuzz
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/textprot"
+)
+
+// maxRequests bounds the number of requests read from a single input. Every request consumes at
+// least one byte, so an input can't contain more requests than it has bytes.
+const maxRequests = 1 << 16
+
+// maxValueSize matches the proxy's default so large lengths in the input are discarded as they
+// would be in production instead of being allocated.
+const maxValueSize = 1024 * 1024
+
+func init() {
+	common.SetMaxValueSize(maxValueSize)
+}
+
+// Text runs the text protocol parser over the input. It returns 1 if at least one request was
+// parsed so go-fuzz gives priority to the input, and 0 otherwise.
+func Text(data []byte) int {
+	cr := &countingReader{r: bytes.NewReader(data)}
+	br := bufio.NewReader(cr)
+	return run(textprot.NewTextParser(br), cr, br)
+}
+
+// Binary runs the binary protocol parser over the input. It returns 1 if at least one request
+// was parsed so go-fuzz gives priority to the input, and 0 otherwise.
+func Binary(data []byte) int {
+	cr := &countingReader{r: bytes.NewReader(data)}
+	br := bufio.NewReader(cr)
+	p, _ := binprot.NewBinaryParserResponder(br, bufio.NewWriter(io.Discard))
+	return run(p, cr, br)
+}
+
+// run parses requests until the connection would be closed. An error the server recovers from
+// has to leave the parser at the start of the next request, which means it must have consumed
+// some of the input. Otherwise the server would read the same bad request forever.
+func run(rp common.RequestParser, cr *countingReader, br *bufio.Reader) int {
+	parsed := 0
+	consumed := 0
+
+	for i := 0; i < maxRequests; i++ {
+		_, reqType, _, err := rp.Parse()
+
+		now := cr.n - br.Buffered()
+		progress := now > consumed
+		consumed = now
+
+		if err != nil {
+			if !recoverable(err) {
+				// The server closes the connection
+				return parsed
+			}
+			if !progress {
+				panic(fmt.Sprintf("parser did not resynchronize after %v at offset %d", err, consumed))
+			}
+			continue
+		}
+
+		if !progress {
+			panic(fmt.Sprintf("parser returned request type %d without reading input at offset %d", reqType, consumed))
+		}
+
+		parsed = 1
+		if reqType == common.RequestQuit {
+			return parsed
+		}
+	}
+
+	panic("parser read more requests than the input has bytes")
+}
+
+// recoverable mirrors the parse errors that server.DefaultServer.Loop responds to and keeps the
+// connection open for. Any other error closes the connection.
+func recoverable(err error) bool {
+	switch err {
+	case common.ErrBadRequest,
+		common.ErrBadLength,
+		common.ErrBadFlags,
+		common.ErrBadExptime,
+		common.ErrValueTooBig:
+		return true
+	}
+	return false
+}
+
+// countingReader counts the bytes handed to the bufio.Reader above it so the harness can tell
+// how far the parser has read.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuzz_test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/hongst/rend/fuzz"
+)
+
+func TestMain(m *testing.M) {
+	// The parsers log every malformed request
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestTextSeeds(t *testing.T) {
+	for _, seed := range fuzz.TextSeeds {
+		fuzz.Text(seed)
+	}
+}
+
+func TestBinarySeeds(t *testing.T) {
+	for _, seed := range fuzz.BinarySeeds {
+		fuzz.Binary(seed)
+	}
+}
+
+func FuzzText(f *testing.F) {
+	for _, seed := range fuzz.TextSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.Text(data)
+	})
+}
+
+func FuzzBinary(f *testing.F) {
+	for _, seed := range fuzz.BinarySeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzz.Binary(data)
+	})
+}
@@ -0,0 +1,161 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuzz
+
+import (
+	"encoding/binary"
+
+	"github.com/hongst/rend/binprot"
+)
+
+// TextSeeds has a well formed example of every text protocol command, plus a few of the
+// malformed requests the parser has to recover from.
+var TextSeeds = [][]byte{
+	[]byte("set foo 0 0 3\r\nbar\r\n"),
+	[]byte("add foo 1 60 3\r\nbar\r\n"),
+	[]byte("replace foo 0 0 3 noreply\r\nbar\r\n"),
+	[]byte("append foo 0 0 3\r\nbar\r\n"),
+	[]byte("prepend foo 0 0 3\r\nbar\r\n"),
+	[]byte("cas foo 0 0 3 12345\r\nbar\r\n"),
+	[]byte("get foo\r\n"),
+	[]byte("get foo bar baz\r\n"),
+	[]byte("gets foo\r\n"),
+	[]byte("delete foo\r\n"),
+	[]byte("touch foo 60\r\n"),
+	[]byte("incr foo 1\r\n"),
+	[]byte("decr foo 1 noreply\r\n"),
+	[]byte("flush_all\r\n"),
+	[]byte("flush_all 10 noreply\r\n"),
+	[]byte("verbosity 1\r\n"),
+	[]byte("stats\r\n"),
+	[]byte("stats settings\r\n"),
+	[]byte("noop\r\n"),
+	[]byte("version\r\n"),
+	[]byte("quit\r\n"),
+	[]byte("mn\r\n"),
+	[]byte("mg foo v f t k c\r\n"),
+	[]byte("ms foo 3 T60 F5 I\r\nbar\r\n"),
+	[]byte("md foo q\r\n"),
+	[]byte("ma foo MI D5 N60 J10\r\n"),
+	[]byte("set foo 0 0 -1\r\nbar\r\nget foo\r\n"),
+	[]byte("set foo zero 0 3\r\nbar\r\nget foo\r\n"),
+	[]byte("set foo 0 0 4294967295\r\nbar\r\n"),
+	[]byte("touch foo\r\nget foo\r\n"),
+}
+
+// BinarySeeds has a well formed frame for every binary opcode the parser accepts, plus a few
+// malformed frames.
+var BinarySeeds = [][]byte{
+	binFrame(binprot.OpcodeSet, storeExtras(), "foo", "bar"),
+	binFrame(binprot.OpcodeSetQ, storeExtras(), "foo", "bar"),
+	binFrame(binprot.OpcodeAdd, storeExtras(), "foo", "bar"),
+	binFrame(binprot.OpcodeAddQ, storeExtras(), "foo", "bar"),
+	binFrame(binprot.OpcodeReplace, storeExtras(), "foo", "bar"),
+	binFrame(binprot.OpcodeReplaceQ, storeExtras(), "foo", "bar"),
+	binFrame(binprot.OpcodeAppend, nil, "foo", "bar"),
+	binFrame(binprot.OpcodeAppendQ, nil, "foo", "bar"),
+	binFrame(binprot.OpcodePrepend, nil, "foo", "bar"),
+	binFrame(binprot.OpcodePrependQ, nil, "foo", "bar"),
+	binFrame(binprot.OpcodeGet, nil, "foo", ""),
+	binFrame(binprot.OpcodeGetK, nil, "foo", ""),
+	concat(
+		binFrame(binprot.OpcodeGetQ, nil, "foo", ""),
+		binFrame(binprot.OpcodeGetKQ, nil, "bar", ""),
+		binFrame(binprot.OpcodeGet, nil, "baz", ""),
+	),
+	concat(
+		binFrame(binprot.OpcodeGetQ, nil, "foo", ""),
+		binFrame(binprot.OpcodeNoop, nil, "", ""),
+	),
+	binFrame(binprot.OpcodeGetE, nil, "foo", ""),
+	concat(
+		binFrame(binprot.OpcodeGetEQ, nil, "foo", ""),
+		binFrame(binprot.OpcodeNoop, nil, "", ""),
+	),
+	binFrame(binprot.OpcodeGat, uint32s(60), "foo", ""),
+	binFrame(binprot.OpcodeGatQ, uint32s(60), "foo", ""),
+	binFrame(binprot.OpcodeGatK, uint32s(60), "foo", ""),
+	binFrame(binprot.OpcodeGatKQ, uint32s(60), "foo", ""),
+	binFrame(binprot.OpcodeTouch, uint32s(60), "foo", ""),
+	binFrame(binprot.OpcodeDelete, nil, "foo", ""),
+	binFrame(binprot.OpcodeDeleteQ, nil, "foo", ""),
+	binFrame(binprot.OpcodeIncrement, arithExtras(), "foo", ""),
+	binFrame(binprot.OpcodeIncrementQ, arithExtras(), "foo", ""),
+	binFrame(binprot.OpcodeDecrement, arithExtras(), "foo", ""),
+	binFrame(binprot.OpcodeDecrementQ, arithExtras(), "foo", ""),
+	binFrame(binprot.OpcodeNoop, nil, "", ""),
+	binFrame(binprot.OpcodeQuit, nil, "", ""),
+	binFrame(binprot.OpcodeQuitQ, nil, "", ""),
+	binFrame(binprot.OpcodeVersion, nil, "", ""),
+	binFrame(binprot.OpcodeVerbosity, uint32s(1), "", ""),
+	binFrame(binprot.OpcodeFlush, nil, "", ""),
+	binFrame(binprot.OpcodeFlushQ, uint32s(10), "", ""),
+	binFrame(binprot.OpcodeStat, nil, "", ""),
+	binFrame(binprot.OpcodeStat, nil, "settings", ""),
+	binFrame(binprot.OpcodeSASLListMechs, nil, "", ""),
+	binFrame(binprot.OpcodeSASLAuth, nil, "PLAIN", "\x00user\x00pass"),
+	concat(
+		binFrame(binprot.OpcodeGetQ, nil, "foo", ""),
+		binFrame(binprot.OpcodeSet, storeExtras(), "foo", "bar"),
+	),
+	binFrame(binprot.OpcodeGet, nil, "foo", "")[:20],
+	[]byte{0x81, 0x00, 0x00, 0x00},
+	binFrame(binprot.OpcodeInvalid, nil, "foo", ""),
+}
+
+// binFrame builds a request frame with a fixed opaque and no CAS
+func binFrame(opcode uint8, extras []byte, key, value string) []byte {
+	buf := make([]byte, binprot.ReqHeaderLen, binprot.ReqHeaderLen+len(extras)+len(key)+len(value))
+	buf[0] = binprot.MagicRequest
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], 0xdeadbeef)
+
+	buf = append(buf, extras...)
+	buf = append(buf, key...)
+	return append(buf, value...)
+}
+
+// storeExtras are the flags and exptime of a set, add, or replace
+func storeExtras() []byte {
+	return uint32s(0xcafe, 60)
+}
+
+// arithExtras are the delta, initial value, and exptime of an incr or decr
+func arithExtras() []byte {
+	buf := make([]byte, 20)
+	binary.BigEndian.PutUint64(buf[0:8], 1)
+	binary.BigEndian.PutUint64(buf[8:16], 0)
+	binary.BigEndian.PutUint32(buf[16:20], 60)
+	return buf
+}
+
+func uint32s(vals ...uint32) []byte {
+	buf := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint32(buf[4*i:], v)
+	}
+	return buf
+}
+
+func concat(frames ...[]byte) []byte {
+	var buf []byte
+	for _, f := range frames {
+		buf = append(buf, f...)
+	}
+	return buf
+}
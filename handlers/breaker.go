@@ -0,0 +1,401 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricBreakerOpened   = metrics.AddCounter("handler_breaker_opened", nil)
+	MetricBreakerClosed   = metrics.AddCounter("handler_breaker_closed", nil)
+	MetricBreakerRejected = metrics.AddCounter("handler_breaker_rejected", nil)
+	MetricBreakerFailures = metrics.AddCounter("handler_breaker_failures", nil)
+	MetricBreakerSlow     = metrics.AddCounter("handler_breaker_slow", nil)
+	MetricBreakerOpen     = metrics.AddIntGauge("handler_breaker_open", nil)
+)
+
+// BreakerConfig decides when a Breaker opens and how it recovers
+type BreakerConfig struct {
+	// Window is the length of each period over which the error rate is measured
+	Window time.Duration
+	// MinRequests is the fewest requests in a window before the error rate is considered
+	MinRequests int
+	// ErrorRate is the fraction of failed requests in a window that opens the breaker
+	ErrorRate float64
+	// SlowCall counts requests that take longer than this as failures. 0 disables it.
+	SlowCall time.Duration
+	// OpenTimeout is how long the breaker stays open before letting probes through
+	OpenTimeout time.Duration
+	// Probes is the number of requests let through when half open. The breaker closes if all of
+	// them succeed and opens again as soon as one fails.
+	Probes int
+}
+
+var DefaultBreakerConfig = BreakerConfig{
+	Window:      10 * time.Second,
+	MinRequests: 20,
+	ErrorRate:   0.5,
+	SlowCall:    0,
+	OpenTimeout: 5 * time.Second,
+	Probes:      5,
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Breaker is a circuit breaker shared by all of the handlers it wraps. Once enough requests to the
+// backend fail or are too slow, it opens and requests are rejected with ErrTempFailure without
+// reaching the backend, so a sick backend is shed quickly instead of making every request wait for
+// it. After OpenTimeout a few probe requests are let through to see if it has recovered.
+type Breaker struct {
+	conf BreakerConfig
+	now  func() time.Time
+
+	mu    sync.Mutex
+	state breakerState
+	// windowStart, requests and failures measure the error rate while closed
+	windowStart time.Time
+	requests    int
+	failures    int
+	// openedAt is when the breaker last opened
+	openedAt time.Time
+	// probes is the number of probes let through while half open and passed the number that
+	// succeeded
+	probes int
+	passed int
+}
+
+func NewBreaker(conf BreakerConfig) *Breaker {
+	return &Breaker{
+		conf: conf,
+		now:  time.Now,
+	}
+}
+
+// Open reports whether requests would currently be rejected. It is meant for callers that can do
+// without the backend entirely, like an orca that can serve from L1 alone.
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return b.now().Sub(b.openedAt) < b.conf.OpenTimeout
+	case breakerHalfOpen:
+		return b.probes >= b.conf.Probes
+	}
+	return false
+}
+
+// allow decides if a request may go to the backend
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen {
+		if b.now().Sub(b.openedAt) < b.conf.OpenTimeout {
+			metrics.IncCounter(MetricBreakerRejected)
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probes = 0
+		b.passed = 0
+	}
+
+	if b.state == breakerHalfOpen {
+		if b.probes >= b.conf.Probes {
+			metrics.IncCounter(MetricBreakerRejected)
+			return false
+		}
+		b.probes++
+	}
+
+	return true
+}
+
+// record updates the breaker with the result of a request that was allowed through
+func (b *Breaker) record(err error, dur time.Duration) {
+	failed := breakerFailure(err)
+	if failed {
+		metrics.IncCounter(MetricBreakerFailures)
+	} else if b.conf.SlowCall > 0 && dur > b.conf.SlowCall {
+		metrics.IncCounter(MetricBreakerSlow)
+		failed = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		b.passed++
+		if b.passed >= b.conf.Probes {
+			metrics.IncCounter(MetricBreakerClosed)
+			metrics.SetIntGauge(MetricBreakerOpen, 0)
+			b.state = breakerClosed
+			b.windowStart = b.now()
+			b.requests = 0
+			b.failures = 0
+		}
+
+	case breakerClosed:
+		now := b.now()
+		if now.Sub(b.windowStart) >= b.conf.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+
+		b.requests++
+		if failed {
+			b.failures++
+		}
+
+		if b.requests >= b.conf.MinRequests &&
+			float64(b.failures) >= b.conf.ErrorRate*float64(b.requests) {
+			b.open()
+		}
+	}
+
+	// Results that come back while open are from requests made before it opened
+}
+
+// breakerFailure decides if an error counts against the backend. Most application errors are
+// normal answers, but a temporary failure, busy or timeout error means the backend is struggling.
+// Other handlers, like the reconnecting one, also turn broken connections into those errors.
+func breakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !common.IsAppError(err) ||
+		err == common.ErrTempFailure ||
+		err == common.ErrBusy ||
+		err == common.ErrTimeout
+}
+
+// open must be called with the lock held
+func (b *Breaker) open() {
+	metrics.IncCounter(MetricBreakerOpened)
+	metrics.SetIntGauge(MetricBreakerOpen, 1)
+	b.state = breakerOpen
+	b.openedAt = b.now()
+}
+
+// Wrap returns a constructor for handlers made by hc whose requests go through the breaker
+func (b *Breaker) Wrap(hc HandlerConst) HandlerConst {
+	return func() (Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return breakerHandler{h, b}, nil
+	}
+}
+
+type breakerHandler struct {
+	h Handler
+	b *Breaker
+}
+
+// do runs op if the breaker allows it and records the result
+func (h breakerHandler) do(op func() error) error {
+	if !h.b.allow() {
+		return common.ErrTempFailure
+	}
+	start := time.Now()
+	err := op()
+	h.b.record(err, time.Since(start))
+	return err
+}
+
+func (h breakerHandler) Set(cmd common.SetRequest) error {
+	return h.do(func() error { return h.h.Set(cmd) })
+}
+
+func (h breakerHandler) Add(cmd common.SetRequest) error {
+	return h.do(func() error { return h.h.Add(cmd) })
+}
+
+func (h breakerHandler) Replace(cmd common.SetRequest) error {
+	return h.do(func() error { return h.h.Replace(cmd) })
+}
+
+func (h breakerHandler) Append(cmd common.SetRequest) error {
+	return h.do(func() error { return h.h.Append(cmd) })
+}
+
+func (h breakerHandler) Prepend(cmd common.SetRequest) error {
+	return h.do(func() error { return h.h.Prepend(cmd) })
+}
+
+// Get records the result once all of the responses have been passed on
+func (h breakerHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	if !h.b.allow() {
+		go func() {
+			close(dataOut)
+			errorOut <- common.ErrTempFailure
+			close(errorOut)
+		}()
+		return dataOut, errorOut
+	}
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		start := time.Now()
+		resChan, errChan := h.h.Get(cmd)
+		var err error
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				dataOut <- res
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				err = e
+				errorOut <- e
+			}
+		}
+
+		h.b.record(err, time.Since(start))
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE records the result once all of the responses have been passed on
+func (h breakerHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	if !h.b.allow() {
+		go func() {
+			close(dataOut)
+			errorOut <- common.ErrTempFailure
+			close(errorOut)
+		}()
+		return dataOut, errorOut
+	}
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		start := time.Now()
+		resChan, errChan := h.h.GetE(cmd)
+		var err error
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				dataOut <- res
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				err = e
+				errorOut <- e
+			}
+		}
+
+		h.b.record(err, time.Since(start))
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h breakerHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.do(func() error {
+		var err error
+		res, err = h.h.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h breakerHandler) Delete(cmd common.DeleteRequest) error {
+	return h.do(func() error { return h.h.Delete(cmd) })
+}
+
+func (h breakerHandler) Touch(cmd common.TouchRequest) error {
+	return h.do(func() error { return h.h.Touch(cmd) })
+}
+
+func (h breakerHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	var v uint64
+	err := h.do(func() error {
+		var err error
+		v, err = h.h.Incr(cmd)
+		return err
+	})
+	return v, err
+}
+
+func (h breakerHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	var v uint64
+	err := h.do(func() error {
+		var err error
+		v, err = h.h.Decr(cmd)
+		return err
+	})
+	return v, err
+}
+
+// Stats, Flush, Version and Close are administrative and always go to the backend
+
+func (h breakerHandler) Stats(group []byte) ([]common.Stat, error) {
+	return h.h.Stats(group)
+}
+
+func (h breakerHandler) Flush(cmd common.FlushRequest) error {
+	return h.h.Flush(cmd)
+}
+
+func (h breakerHandler) Version() (string, error) {
+	return h.h.Version()
+}
+
+func (h breakerHandler) Close() error {
+	return h.h.Close()
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/null"
+)
+
+// flakyHandler fails sets with an IO error while failing is set and counts the sets it sees
+type flakyHandler struct {
+	handlers.Handler
+	failing *int32
+	sets    *int32
+}
+
+func (h flakyHandler) Set(cmd common.SetRequest) error {
+	atomic.AddInt32(h.sets, 1)
+	if atomic.LoadInt32(h.failing) != 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+func TestBreaker(t *testing.T) {
+	var failing, sets int32 = 1, 0
+	b := handlers.NewBreaker(handlers.BreakerConfig{
+		Window:      time.Hour,
+		MinRequests: 4,
+		ErrorRate:   0.5,
+		OpenTimeout: 20 * time.Millisecond,
+		Probes:      2,
+	})
+	h, _ := b.Wrap(func() (handlers.Handler, error) {
+		n, _ := null.New()
+		return flakyHandler{n, &failing, &sets}, nil
+	})()
+
+	set := func() error {
+		return h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+	}
+
+	// Too few requests to judge the error rate
+	for i := 0; i < 3; i++ {
+		if err := set(); err != io.EOF {
+			t.Fatalf("Expected the backend's error, got %v", err)
+		}
+	}
+	if b.Open() {
+		t.Fatal("Expected the breaker to stay closed below the minimum number of requests")
+	}
+
+	set()
+	if !b.Open() {
+		t.Fatal("Expected the breaker to open")
+	}
+
+	// Requests are rejected without reaching the backend while open
+	if err := set(); err != common.ErrTempFailure {
+		t.Fatalf("Expected ErrTempFailure, got %v", err)
+	}
+	if sets != 4 {
+		t.Fatalf("Expected 4 sets to reach the backend, got %d", sets)
+	}
+
+	// A failed probe opens it again
+	time.Sleep(30 * time.Millisecond)
+	if b.Open() {
+		t.Fatal("Expected the breaker to let probes through after the timeout")
+	}
+	set()
+	if !b.Open() {
+		t.Fatal("Expected a failed probe to open the breaker again")
+	}
+
+	// Enough successful probes close it
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(30 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if err := set(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if b.Open() {
+		t.Fatal("Expected successful probes to close the breaker")
+	}
+	if err := set(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+// Decorator wraps the handlers made by a HandlerConst to add behavior that cuts across all
+// handlers, like retries or a circuit breaker, without the handlers having to know about it.
+// A decorator usually returns a handler that embeds the one it wraps and overrides only the
+// methods it cares about.
+type Decorator func(HandlerConst) HandlerConst
+
+// Chain returns hc with the decorators applied in order. The first decorator wraps hc directly and
+// the last one is outermost, so it sees each request first:
+//
+//	Chain(hc, Reconnect, Retry(conf))
+//
+// retries requests that fail on a handler that reconnects. Nil decorators are skipped, which
+// lets optional ones be left out without building the list conditionally.
+func Chain(hc HandlerConst, ds ...Decorator) HandlerConst {
+	for _, d := range ds {
+		if d != nil {
+			hc = d(hc)
+		}
+	}
+	return hc
+}
+
+// Reconnect is Reconnecting as a Decorator
+func Reconnect(hc HandlerConst) HandlerConst {
+	return Reconnecting(hc)
+}
+
+// Pool returns a Decorator that shares size handlers between connections, like Pooled
+func Pool(size int) Decorator {
+	return func(hc HandlerConst) HandlerConst {
+		return Pooled(hc, size)
+	}
+}
+
+// Retry returns a Decorator that retries transient failures, like Retrying
+func Retry(conf RetryConfig) Decorator {
+	return func(hc HandlerConst) HandlerConst {
+		return Retrying(hc, conf)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/null"
+)
+
+// tracingHandler records its name when a set passes through it
+type tracingHandler struct {
+	handlers.Handler
+	name  string
+	trace *[]string
+}
+
+func (h tracingHandler) Set(cmd common.SetRequest) error {
+	*h.trace = append(*h.trace, h.name)
+	return h.Handler.Set(cmd)
+}
+
+func tracing(name string, trace *[]string) handlers.Decorator {
+	return func(hc handlers.HandlerConst) handlers.HandlerConst {
+		return func() (handlers.Handler, error) {
+			h, err := hc()
+			if err != nil {
+				return nil, err
+			}
+			return tracingHandler{h, name, trace}, nil
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var trace []string
+	hc := handlers.Chain(null.New, tracing("inner", &trace), nil, tracing("outer", &trace))
+
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Error creating handler: %v", err)
+	}
+	if err := h.Set(common.SetRequest{Key: []byte("foo")}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	if want := []string{"outer", "inner"}; !reflect.DeepEqual(trace, want) {
+		t.Fatalf("Expected the set to pass through %v, got %v", want, trace)
+	}
+}
+
+func TestChainNone(t *testing.T) {
+	hc := handlers.Chain(null.New)
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Error creating handler: %v", err)
+	}
+	if v, _ := h.Version(); v != "null" {
+		t.Fatalf("Expected the undecorated handler, got version %q", v)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/store"
+)
+
+// New opens the store and returns a constructor for handlers that use it
+func New(conf Config) (handlers.HandlerConst, error) {
+	s, err := Open(conf)
+	if err != nil {
+		return nil, err
+	}
+	return store.New(s), nil
+}
+
+func (s *Store) Lock() {
+	s.mu.Lock()
+}
+
+func (s *Store) Unlock() {
+	s.mu.Unlock()
+}
+
+// RLocker returns the same lock as Lock, since reads move items in the LRU and remove expired ones
+func (s *Store) RLocker() sync.Locker {
+	return &s.mu
+}
+
+func (s *Store) Name() string {
+	return "disk"
+}
+
+func (s *Store) Now() uint32 {
+	return s.now()
+}
+
+func (s *Store) Get(key string, withData bool) (store.Item, bool, error) {
+	e, ok, err := s.lookup(key)
+	if err != nil || !ok {
+		return store.Item{}, false, err
+	}
+
+	item := store.Item{
+		Flags:   e.flags,
+		Exptime: e.exptime,
+		Cas:     e.cas,
+	}
+	if withData {
+		if item.Data, err = s.value(e); err != nil {
+			return store.Item{}, false, err
+		}
+	}
+
+	return item, true, nil
+}
+
+func (s *Store) Put(key string, item store.Item) error {
+	_, err := s.put(key, item.Data, item.Flags, item.Exptime, item.Cas)
+	return err
+}
+
+func (s *Store) Delete(key string) error {
+	return s.remove(key)
+}
+
+// Touch rewrites the item with the new exptime, so the change survives a restart
+func (s *Store) Touch(key string, exptime uint32) error {
+	e, ok, err := s.lookup(key)
+	if err != nil || !ok {
+		return err
+	}
+
+	data, err := s.value(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.put(key, data, e.flags, exptime, e.cas)
+	return err
+}
+
+func (s *Store) Flush(at uint32) error {
+	if at == 0 {
+		return s.flush()
+	}
+
+	var keys []string
+	for key, e := range s.index {
+		if e.exptime == 0 || e.exptime > at {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		if err := s.Touch(key, at); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) Stats() []common.Stat {
+	var bytes uint64
+	for _, e := range s.index {
+		bytes += uint64(e.length)
+	}
+
+	return []common.Stat{
+		{Name: "curr_items", Value: strconv.Itoa(len(s.index))},
+		{Name: "bytes", Value: strconv.FormatUint(bytes, 10)},
+		{Name: "limit_maxbytes", Value: strconv.FormatUint(s.conf.MaxBytes, 10)},
+		{Name: "disk_bytes", Value: strconv.FormatInt(s.size, 10)},
+	}
+}
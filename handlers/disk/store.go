@@ -0,0 +1,502 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package disk is a handler that keeps the data in a file on local disk, so it survives a
+// restart of the process. It is meant to be used as the L2 behind a memcached L1.
+//
+// The file is an append-only log of records. Each set appends the whole item and each delete
+// appends a tombstone. An index of where the latest version of each key lives is kept in
+// memory and rebuilt from the log when the file is opened. Values are only read from disk when
+// they are requested. Old versions of items take up space in the log until it is compacted,
+// which happens when more than half of the file is garbage. This uses no dependencies outside
+// the standard library.
+package disk
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/handlers/store"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricEvictions   = metrics.AddCounter("disk_evictions", nil)
+	MetricExpired     = metrics.AddCounter("disk_expired", nil)
+	MetricCompactions = metrics.AddCounter("disk_compactions", nil)
+	MetricIOErrors    = metrics.AddCounter("disk_io_errors", nil)
+	MetricTornRecords = metrics.AddCounter("disk_torn_records", nil)
+)
+
+const (
+	recordPut    = byte(1)
+	recordDelete = byte(2)
+
+	// Record header
+	// Field        (offset)
+	//     CRC32        (0-3)  : Castagnoli CRC of the rest of the record
+	//     Kind         (4)    : recordPut or recordDelete
+	//     Flags        (5-8)
+	//     Exptime      (9-12) : absolute unix time, 0 for never
+	//     CAS          (13-20)
+	//     Key length   (21,22)
+	//     Value length (23-26)
+	//     Key
+	//     Value
+	headerLen = 27
+
+	// The log isn't compacted until it has at least this much garbage, so small stores don't
+	// rewrite their file over and over
+	minCompactGarbage = 16 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorrupt = errors.New("Corrupt record")
+
+// Config holds the settings for a store
+type Config struct {
+	// Path is the file the data is kept in. It is created if it doesn't exist.
+	Path string
+	// MaxBytes is the most data the store holds, counting keys, values and record headers.
+	// The least recently used items are evicted to stay under it. 0 means no limit.
+	MaxBytes uint64
+	// ExpiryInterval is how often expired items are removed in the background. Expired items
+	// are never returned in between, but they take up space until they are removed.
+	ExpiryInterval time.Duration
+}
+
+type entry struct {
+	// offset of the value in the file
+	offset  int64
+	length  uint32
+	flags   uint32
+	exptime uint32
+	cas     uint64
+	// elem is the entry's place in the LRU list
+	elem *list.Element
+}
+
+func recordSize(key string, length uint32) uint64 {
+	return uint64(headerLen + len(key) + int(length))
+}
+
+// Store is the log file and its index. All access goes through the mutex.
+type Store struct {
+	conf Config
+	now  func() uint32
+
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	index map[string]*entry
+	// lru has the keys, most recently used at the front
+	lru *list.List
+	// live is the size of the records the index points to. The rest of the file is garbage.
+	live uint64
+	cas  uint64
+
+	done chan struct{}
+}
+
+// Open opens the store at conf.Path and loads its index
+func Open(conf Config) (*Store, error) {
+	f, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		conf:  conf,
+		now:   func() uint32 { return uint32(time.Now().Unix()) },
+		f:     f,
+		index: make(map[string]*entry),
+		lru:   list.New(),
+		done:  make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if conf.ExpiryInterval > 0 {
+		go s.expireLoop()
+	}
+
+	return s, nil
+}
+
+// load replays the log to build the index. A record cut short by a crash while it was being
+// written is dropped, along with anything after it.
+func (s *Store) load() error {
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, 1<<62))
+	now := s.now()
+	var offset int64
+
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Dropping torn record at offset %d of %s: %v\n", offset, s.conf.Path, err)
+			metrics.IncCounter(MetricTornRecords)
+			if err := s.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		if rec.cas > s.cas {
+			s.cas = rec.cas
+		}
+
+		s.unlink(rec.key)
+		if rec.kind == recordPut && (rec.exptime == 0 || rec.exptime >= now) {
+			s.link(rec.key, &entry{
+				offset:  offset + headerLen + int64(len(rec.key)),
+				length:  uint32(len(rec.value)),
+				flags:   rec.flags,
+				exptime: rec.exptime,
+				cas:     rec.cas,
+			})
+		}
+
+		offset += n
+	}
+
+	s.size = offset
+
+	// The limit may have been lowered since the file was written
+	return s.evict()
+}
+
+type record struct {
+	kind    byte
+	key     string
+	value   []byte
+	flags   uint32
+	exptime uint32
+	cas     uint64
+}
+
+// readRecord reads the next record and returns it with its size. io.EOF means the log ended
+// cleanly between records.
+func readRecord(r *bufio.Reader) (record, int64, error) {
+	var header [headerLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return record{}, 0, err
+	}
+
+	keyLen := binary.BigEndian.Uint16(header[21:23])
+	valLen := binary.BigEndian.Uint32(header[23:27])
+
+	body := make([]byte, int(keyLen)+int(valLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, 0, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, body)
+	if crc != binary.BigEndian.Uint32(header[0:4]) {
+		return record{}, 0, errCorrupt
+	}
+
+	rec := record{
+		kind:    header[4],
+		key:     string(body[:keyLen]),
+		value:   body[keyLen:],
+		flags:   binary.BigEndian.Uint32(header[5:9]),
+		exptime: binary.BigEndian.Uint32(header[9:13]),
+		cas:     binary.BigEndian.Uint64(header[13:21]),
+	}
+	if rec.kind != recordPut && rec.kind != recordDelete {
+		return record{}, 0, errCorrupt
+	}
+
+	return rec, int64(headerLen + len(body)), nil
+}
+
+func encodeRecord(kind byte, key string, value []byte, flags, exptime uint32, cas uint64) []byte {
+	buf := make([]byte, headerLen+len(key)+len(value))
+	buf[4] = kind
+	binary.BigEndian.PutUint32(buf[5:9], flags)
+	binary.BigEndian.PutUint32(buf[9:13], exptime)
+	binary.BigEndian.PutUint64(buf[13:21], cas)
+	binary.BigEndian.PutUint16(buf[21:23], uint16(len(key)))
+	binary.BigEndian.PutUint32(buf[23:27], uint32(len(value)))
+	copy(buf[headerLen:], key)
+	copy(buf[headerLen+len(key):], value)
+	binary.BigEndian.PutUint32(buf[0:4], crc32.Checksum(buf[4:], crcTable))
+	return buf
+}
+
+// link adds the entry to the index. s.mu must be held.
+func (s *Store) link(key string, e *entry) {
+	e.elem = s.lru.PushFront(key)
+	s.index[key] = e
+	s.live += recordSize(key, e.length)
+}
+
+// unlink removes the key from the index, if it is there. s.mu must be held.
+func (s *Store) unlink(key string) {
+	if e, ok := s.index[key]; ok {
+		s.lru.Remove(e.elem)
+		delete(s.index, key)
+		s.live -= recordSize(key, e.length)
+	}
+}
+
+// lookup returns the live entry for the key. An expired entry is removed. s.mu must be held.
+func (s *Store) lookup(key string) (*entry, bool, error) {
+	e, ok := s.index[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	if e.exptime != 0 && e.exptime < s.now() {
+		metrics.IncCounter(MetricExpired)
+		return nil, false, s.remove(key)
+	}
+
+	s.lru.MoveToFront(e.elem)
+	return e, true, nil
+}
+
+// value reads the entry's value from the file. s.mu must be held.
+func (s *Store) value(e *entry) ([]byte, error) {
+	buf := make([]byte, e.length)
+	if _, err := s.f.ReadAt(buf, e.offset); err != nil {
+		metrics.IncCounter(MetricIOErrors)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// nextCas returns a new unique CAS value. s.mu must be held.
+func (s *Store) nextCas() uint64 {
+	s.cas++
+	return s.cas
+}
+
+// append writes the record at the end of the file and returns the record's offset. s.mu must
+// be held.
+func (s *Store) append(rec []byte) (int64, error) {
+	offset := s.size
+	if _, err := s.f.WriteAt(rec, offset); err != nil {
+		metrics.IncCounter(MetricIOErrors)
+		// Anything partly written is overwritten by the next record
+		return 0, err
+	}
+	s.size += int64(len(rec))
+	return offset, nil
+}
+
+// put stores a new version of the item and evicts old items if the store is over its size. A
+// cas of 0 gives the item a new CAS value. s.mu must be held.
+func (s *Store) put(key string, value []byte, flags, exptime uint32, cas uint64) (uint64, error) {
+	if s.conf.MaxBytes > 0 && recordSize(key, uint32(len(value))) > s.conf.MaxBytes {
+		return 0, store.ErrTooLarge
+	}
+
+	if cas == 0 {
+		cas = s.nextCas()
+	}
+	offset, err := s.append(encodeRecord(recordPut, key, value, flags, exptime, cas))
+	if err != nil {
+		return 0, err
+	}
+
+	s.unlink(key)
+	s.link(key, &entry{
+		offset:  offset + headerLen + int64(len(key)),
+		length:  uint32(len(value)),
+		flags:   flags,
+		exptime: exptime,
+		cas:     cas,
+	})
+
+	if err := s.evict(); err != nil {
+		return 0, err
+	}
+
+	return cas, s.maybeCompact()
+}
+
+// evict removes the least recently used items until the store is under its size. s.mu must be
+// held.
+func (s *Store) evict() error {
+	for s.conf.MaxBytes > 0 && s.live > s.conf.MaxBytes {
+		oldest := s.lru.Back().Value.(string)
+		metrics.IncCounter(MetricEvictions)
+		if err := s.remove(oldest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove writes a tombstone for the key so it stays deleted after a restart. s.mu must be held.
+func (s *Store) remove(key string) error {
+	if _, err := s.append(encodeRecord(recordDelete, key, nil, 0, 0, 0)); err != nil {
+		return err
+	}
+	s.unlink(key)
+	return nil
+}
+
+// maybeCompact compacts the log once more than half of it is garbage. s.mu must be held.
+func (s *Store) maybeCompact() error {
+	garbage := uint64(s.size) - s.live
+	if garbage < minCompactGarbage || garbage < s.live {
+		return nil
+	}
+	return s.compact()
+}
+
+// compact writes the live records to a new file and swaps it in for the old one. The new file
+// is synced before the rename, so a crash leaves either the old file or the new one. s.mu must
+// be held.
+func (s *Store) compact() error {
+	metrics.IncCounter(MetricCompactions)
+
+	tmp := s.conf.Path + ".compact"
+	nf, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		metrics.IncCounter(MetricIOErrors)
+		return err
+	}
+
+	fail := func(err error) error {
+		metrics.IncCounter(MetricIOErrors)
+		nf.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w := bufio.NewWriter(nf)
+	offsets := make(map[string]int64, len(s.index))
+	var size int64
+
+	// Oldest first, so the order of the LRU list survives a restart
+	for elem := s.lru.Back(); elem != nil; elem = elem.Prev() {
+		key := elem.Value.(string)
+		e := s.index[key]
+
+		value, err := s.value(e)
+		if err != nil {
+			return fail(err)
+		}
+
+		rec := encodeRecord(recordPut, key, value, e.flags, e.exptime, e.cas)
+		if _, err := w.Write(rec); err != nil {
+			return fail(err)
+		}
+
+		offsets[key] = size + headerLen + int64(len(key))
+		size += int64(len(rec))
+	}
+
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := nf.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, s.conf.Path); err != nil {
+		return fail(err)
+	}
+
+	s.f.Close()
+	s.f = nf
+	s.size = size
+	for key, offset := range offsets {
+		s.index[key].offset = offset
+	}
+
+	return nil
+}
+
+// flush removes every item and starts a new, empty log. s.mu must be held.
+func (s *Store) flush() error {
+	s.index = make(map[string]*entry)
+	s.lru.Init()
+	s.live = 0
+	return s.compact()
+}
+
+// expireLoop removes expired items in the background until the store is closed
+func (s *Store) expireLoop() {
+	t := time.NewTicker(s.conf.ExpiryInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.mu.Lock()
+			if err := s.expire(); err != nil {
+				log.Println("Error expiring items in", s.conf.Path, err.Error())
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// expire removes all of the expired items and syncs the file. s.mu must be held.
+func (s *Store) expire() error {
+	now := s.now()
+
+	for key, e := range s.index {
+		if e.exptime != 0 && e.exptime < now {
+			metrics.IncCounter(MetricExpired)
+			if err := s.remove(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.f.Sync(); err != nil {
+		metrics.IncCounter(MetricIOErrors)
+		return err
+	}
+
+	return s.maybeCompact()
+}
+
+// Close stops the background expiry and closes the file
+func (s *Store) Close() error {
+	close(s.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.f.Sync(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
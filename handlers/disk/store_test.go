@@ -0,0 +1,200 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/store"
+)
+
+func open(t *testing.T, conf Config) (*Store, store.Handler) {
+	s, err := Open(conf)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	return s, store.NewHandler(s)
+}
+
+func get(t *testing.T, h store.Handler, key string) (common.GetResponse, bool) {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	for err := range errChan {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res := <-resChan
+	return res, !res.Miss
+}
+
+func set(t *testing.T, h store.Handler, key, value string, exptime uint32) {
+	if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(value), Exptime: exptime}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	conf := Config{Path: filepath.Join(t.TempDir(), "data")}
+
+	s, h := open(t, conf)
+	set(t, h, "foo", "bar", 0)
+	set(t, h, "baz", "qux", 0)
+	set(t, h, "foo", "bar2", 0)
+	if err := h.Delete(common.DeleteRequest{Key: []byte("baz")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res, _ := get(t, h, "foo")
+	s.Close()
+
+	s, h = open(t, conf)
+	defer s.Close()
+
+	if after, ok := get(t, h, "foo"); !ok || string(after.Data) != "bar2" || after.Cas != res.Cas {
+		t.Fatalf("Expected the latest value to survive a restart, got %+v", after)
+	}
+	if _, ok := get(t, h, "baz"); ok {
+		t.Fatal("Expected the delete to survive a restart")
+	}
+
+	// CAS values keep increasing after the restart
+	set(t, h, "new", "value", 0)
+	if after, _ := get(t, h, "new"); after.Cas <= res.Cas {
+		t.Fatalf("Expected a new CAS value, got %d after %d", after.Cas, res.Cas)
+	}
+}
+
+func TestTornRecord(t *testing.T) {
+	conf := Config{Path: filepath.Join(t.TempDir(), "data")}
+
+	s, h := open(t, conf)
+	set(t, h, "foo", "bar", 0)
+	size := s.size
+	s.Close()
+
+	// Half of a record, as if the process died while writing it
+	rec := encodeRecord(recordPut, "baz", []byte("qux"), 0, 0, 10)
+	f, _ := os.OpenFile(conf.Path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(rec[:len(rec)/2])
+	f.Close()
+
+	s, h = open(t, conf)
+	defer s.Close()
+
+	if res, ok := get(t, h, "foo"); !ok || string(res.Data) != "bar" {
+		t.Fatalf("Expected the complete record to load, got %+v", res)
+	}
+	if fi, _ := os.Stat(conf.Path); fi.Size() != size {
+		t.Fatalf("Expected the torn record to be truncated to %d, got %d", size, fi.Size())
+	}
+}
+
+func TestEviction(t *testing.T) {
+	conf := Config{
+		Path:     filepath.Join(t.TempDir(), "data"),
+		MaxBytes: 2 * recordSize("a", 3),
+	}
+
+	s, h := open(t, conf)
+	defer s.Close()
+
+	set(t, h, "a", "aaa", 0)
+	set(t, h, "b", "bbb", 0)
+	get(t, h, "a")
+	set(t, h, "c", "ccc", 0)
+
+	if _, ok := get(t, h, "b"); ok {
+		t.Fatal("Expected the least recently used item to be evicted")
+	}
+	if _, ok := get(t, h, "a"); !ok {
+		t.Fatal("Expected the recently read item to stay")
+	}
+
+	if err := h.Set(common.SetRequest{Key: []byte("d"), Data: make([]byte, conf.MaxBytes)}); err != common.ErrValueTooBig {
+		t.Fatalf("Expected an item larger than the store to be rejected, got %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	conf := Config{Path: filepath.Join(t.TempDir(), "data")}
+
+	s, h := open(t, conf)
+	now := uint32(time.Now().Unix())
+	s.now = func() uint32 { return now }
+
+	set(t, h, "short", "value", 10)
+	set(t, h, "long", "value", 100)
+
+	now += 50
+	s.mu.Lock()
+	if err := s.expire(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := s.index["short"]; ok {
+		t.Fatal("Expected the expired item to be removed")
+	}
+	s.mu.Unlock()
+	s.Close()
+
+	// The items are loaded with the real time, which is before the long one expires
+	s, h = open(t, conf)
+	defer s.Close()
+	s.now = func() uint32 { return now }
+
+	if _, ok := get(t, h, "short"); ok {
+		t.Fatal("Expected the expired item to stay removed after a restart")
+	}
+	if _, ok := get(t, h, "long"); !ok {
+		t.Fatal("Expected the unexpired item to survive")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	conf := Config{Path: filepath.Join(t.TempDir(), "data")}
+
+	s, h := open(t, conf)
+	for i := 0; i < 100; i++ {
+		set(t, h, "foo", "bar", 0)
+	}
+	set(t, h, "baz", "qux", 0)
+
+	s.mu.Lock()
+	before := s.size
+	if err := s.compact(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.size >= before || uint64(s.size) != s.live {
+		t.Fatalf("Expected only live records after compaction, got %d of %d", s.size, s.live)
+	}
+	s.mu.Unlock()
+
+	// Writes after the compaction go to the new file
+	set(t, h, "after", "compaction", 0)
+	s.Close()
+
+	s, h = open(t, conf)
+	defer s.Close()
+
+	for key, value := range map[string]string{"foo": "bar", "baz": "qux", "after": "compaction"} {
+		if res, ok := get(t, h, key); !ok || string(res.Data) != value {
+			t.Fatalf("Expected %s to be %s after compaction, got %+v", key, value, res)
+		}
+	}
+}
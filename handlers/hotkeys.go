@@ -0,0 +1,382 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricHotKeyHits = metrics.AddCounter("handler_hot_key_hits", nil)
+	GaugeHotKeys     = metrics.AddIntGauge("handler_hot_keys", nil)
+)
+
+// HotKeyConfig holds the settings used by NewHotKeys.
+type HotKeyConfig struct {
+	// SampleRate is how many requests there are for each one that is counted
+	SampleRate int
+	// Threshold is how many requests a second make a key hot
+	Threshold int
+	// TTL is how long the value of a hot key is served from memory before it is read again
+	TTL time.Duration
+	// MaxKeys is the most keys that are hot at once. The busiest ones are picked.
+	MaxKeys int
+}
+
+// HotKeys finds the keys that get so many requests that their backend connection can't keep up,
+// and keeps their values in memory so the reads are spread over the proxy instead. Requests are
+// sampled and counted for a second at a time, and the keys above the threshold in one second are
+// hot for the next. It is shared by all connections.
+//
+// Writes made through the proxy drop the key from memory, and a get that was reading the key
+// while it was written doesn't put its value back. Writes made elsewhere are only seen once the
+// value's TTL is up, so a hot key can be stale for up to the TTL.
+type HotKeys struct {
+	conf    HotKeyConfig
+	counter uint64
+
+	lock        sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+	hot         map[string]struct{}
+	values      map[string]hotValue
+	// gens counts the writes to each hot key. epoch changes whenever the hot keys are picked
+	// again or all values are dropped, which resets the counts.
+	gens  map[string]uint64
+	epoch uint64
+}
+
+type hotValue struct {
+	data    []byte
+	flags   uint32
+	cas     uint64
+	expires time.Time
+}
+
+// hotGen is the generation of a key's value when a get for it was sent. The value read is only
+// kept if the key is still at the same generation when it comes back.
+type hotGen struct {
+	epoch uint64
+	gen   uint64
+}
+
+func NewHotKeys(conf HotKeyConfig) *HotKeys {
+	return &HotKeys{
+		conf:        conf,
+		windowStart: time.Now(),
+		counts:      make(map[string]int),
+		hot:         make(map[string]struct{}),
+		values:      make(map[string]hotValue),
+		gens:        make(map[string]uint64),
+	}
+}
+
+// HotKeyCached serves the hot keys found by hk from memory for gets to the handlers made by hc.
+// Get with GetE is passed through, but still counts towards finding hot keys.
+func HotKeyCached(hc HandlerConst, hk *HotKeys) HandlerConst {
+	return func() (Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return hotKeyHandler{Handler: h, hk: hk}, nil
+	}
+}
+
+// HotKeyCache returns a Decorator that serves hot keys from memory, like HotKeyCached
+func HotKeyCache(hk *HotKeys) Decorator {
+	return func(hc HandlerConst) HandlerConst {
+		return HotKeyCached(hc, hk)
+	}
+}
+
+// sample counts one in SampleRate of the keys and starts a new window when a second is up
+func (hk *HotKeys) sample(keys [][]byte) {
+	for _, key := range keys {
+		if atomic.AddUint64(&hk.counter, 1)%uint64(hk.conf.SampleRate) != 0 {
+			continue
+		}
+
+		hk.lock.Lock()
+		hk.counts[string(key)]++
+		if elapsed := time.Since(hk.windowStart); elapsed >= time.Second {
+			hk.rotate(elapsed)
+		}
+		hk.lock.Unlock()
+	}
+}
+
+// rotate picks the hot keys from the counts of the window that just ended. The values of keys
+// that are no longer hot are dropped. It must be called with the lock held.
+func (hk *HotKeys) rotate(elapsed time.Duration) {
+	type keyCount struct {
+		key   string
+		count int
+	}
+
+	var hot []keyCount
+	for key, count := range hk.counts {
+		if float64(count*hk.conf.SampleRate)/elapsed.Seconds() >= float64(hk.conf.Threshold) {
+			hot = append(hot, keyCount{key, count})
+		}
+	}
+	sort.Slice(hot, func(i, j int) bool { return hot[i].count > hot[j].count })
+	if len(hot) > hk.conf.MaxKeys {
+		hot = hot[:hk.conf.MaxKeys]
+	}
+
+	hk.hot = make(map[string]struct{}, len(hot))
+	for _, kc := range hot {
+		hk.hot[kc.key] = struct{}{}
+	}
+	for key := range hk.values {
+		if _, ok := hk.hot[key]; !ok {
+			delete(hk.values, key)
+		}
+	}
+
+	hk.counts = make(map[string]int)
+	hk.gens = make(map[string]uint64)
+	hk.epoch++
+	hk.windowStart = time.Now()
+	metrics.SetIntGauge(GaugeHotKeys, uint64(len(hk.hot)))
+}
+
+// lookup says whether the key is hot and returns its value if it's in memory. The generation is
+// what store needs to keep a value read from the handler instead.
+func (hk *HotKeys) lookup(key []byte) (hotValue, hotGen, bool, bool) {
+	hk.lock.Lock()
+	defer hk.lock.Unlock()
+
+	gen := hotGen{epoch: hk.epoch, gen: hk.gens[string(key)]}
+	if _, ok := hk.hot[string(key)]; !ok {
+		return hotValue{}, gen, false, false
+	}
+	v, ok := hk.values[string(key)]
+	if !ok || time.Now().After(v.expires) {
+		return hotValue{}, gen, true, false
+	}
+	return v, gen, true, true
+}
+
+// store keeps the value of a hot key in memory unless the key was written since gen
+func (hk *HotKeys) store(res common.GetResponse, gen hotGen) {
+	hk.lock.Lock()
+	defer hk.lock.Unlock()
+
+	if _, ok := hk.hot[string(res.Key)]; !ok {
+		return
+	}
+	if gen.epoch != hk.epoch || gen.gen != hk.gens[string(res.Key)] {
+		return
+	}
+	hk.values[string(res.Key)] = hotValue{
+		data:    append([]byte(nil), res.Data...),
+		flags:   res.Flags,
+		cas:     res.Cas,
+		expires: time.Now().Add(hk.conf.TTL),
+	}
+}
+
+// forget drops the value of a key that was written. Only hot keys are counted, since the others
+// are never stored and a key only turns hot in a new epoch.
+func (hk *HotKeys) forget(key []byte) {
+	hk.lock.Lock()
+	defer hk.lock.Unlock()
+	delete(hk.values, string(key))
+	if _, ok := hk.hot[string(key)]; ok {
+		hk.gens[string(key)]++
+	}
+}
+
+// forgetAll drops every value after a flush
+func (hk *HotKeys) forgetAll() {
+	hk.lock.Lock()
+	defer hk.lock.Unlock()
+	hk.values = make(map[string]hotValue)
+	hk.gens = make(map[string]uint64)
+	hk.epoch++
+}
+
+type hotKeyHandler struct {
+	Handler
+	hk *HotKeys
+}
+
+func (h hotKeyHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	h.hk.sample(cmd.Keys)
+
+	values := make([]hotValue, len(cmd.Keys))
+	gens := make([]hotGen, len(cmd.Keys))
+	cached := make([]bool, len(cmd.Keys))
+	var hot bool
+	var rest []int
+
+	for k, key := range cmd.Keys {
+		var isHot bool
+		values[k], gens[k], isHot, cached[k] = h.hk.lookup(key)
+		hot = hot || isHot
+		if !cached[k] {
+			rest = append(rest, k)
+		}
+	}
+
+	if !hot {
+		return h.Handler.Get(cmd)
+	}
+
+	var resIn <-chan common.GetResponse
+	var errsIn <-chan error
+	if len(rest) > 0 {
+		resIn, errsIn = h.Handler.Get(subRequest(cmd, rest))
+	}
+
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		// The answers from memory are put back in between the ones from the handler, which come
+		// in the same order as their keys
+		for k, key := range cmd.Keys {
+			if cached[k] {
+				metrics.IncCounter(MetricHotKeyHits)
+				dataOut <- common.GetResponse{
+					Key:    key,
+					Data:   values[k].data,
+					Flags:  values[k].flags,
+					Cas:    values[k].cas,
+					Opaque: cmd.Opaques[k],
+					Quiet:  cmd.Quiet[k],
+				}
+				continue
+			}
+
+			res, err, ok := nextGet(resIn, errsIn)
+			if err != nil {
+				errorOut <- err
+				drainGet(resIn, errsIn)
+				return
+			}
+			if !ok {
+				return
+			}
+			if !res.Miss && res.Stream == nil {
+				h.hk.store(res, gens[k])
+			}
+			dataOut <- res
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// nextGet waits for the next response or error of a get. ok is false when both are done.
+func nextGet(resIn <-chan common.GetResponse, errsIn <-chan error) (common.GetResponse, error, bool) {
+	for resIn != nil || errsIn != nil {
+		select {
+		case res, ok := <-resIn:
+			if !ok {
+				resIn = nil
+				continue
+			}
+			return res, nil, true
+		case err, ok := <-errsIn:
+			if !ok {
+				errsIn = nil
+				continue
+			}
+			return common.GetResponse{}, err, true
+		}
+	}
+	return common.GetResponse{}, nil, false
+}
+
+// drainGet reads what's left of a get so the handler isn't left blocked
+func drainGet(resIn <-chan common.GetResponse, errsIn <-chan error) {
+	for {
+		if _, _, ok := nextGet(resIn, errsIn); !ok {
+			return
+		}
+	}
+}
+
+func (h hotKeyHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	h.hk.sample(cmd.Keys)
+	return h.Handler.GetE(cmd)
+}
+
+func (h hotKeyHandler) Set(cmd common.SetRequest) error {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Set(cmd)
+}
+
+func (h hotKeyHandler) Add(cmd common.SetRequest) error {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Add(cmd)
+}
+
+func (h hotKeyHandler) Replace(cmd common.SetRequest) error {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Replace(cmd)
+}
+
+func (h hotKeyHandler) Append(cmd common.SetRequest) error {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Append(cmd)
+}
+
+func (h hotKeyHandler) Prepend(cmd common.SetRequest) error {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Prepend(cmd)
+}
+
+func (h hotKeyHandler) Delete(cmd common.DeleteRequest) error {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Delete(cmd)
+}
+
+func (h hotKeyHandler) Touch(cmd common.TouchRequest) error {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Touch(cmd)
+}
+
+func (h hotKeyHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.GAT(cmd)
+}
+
+func (h hotKeyHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Incr(cmd)
+}
+
+func (h hotKeyHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	defer h.hk.forget(cmd.Key)
+	return h.Handler.Decr(cmd)
+}
+
+func (h hotKeyHandler) Flush(cmd common.FlushRequest) error {
+	defer h.hk.forgetAll()
+	return h.Handler.Flush(cmd)
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+func hotGet(t *testing.T, h handlers.Handler, keys ...string) []common.GetResponse {
+	req := common.GetRequest{}
+	for i, key := range keys {
+		req.Keys = append(req.Keys, []byte(key))
+		req.Opaques = append(req.Opaques, uint32(i))
+		req.Quiet = append(req.Quiet, false)
+	}
+
+	resChan, errChan := h.Get(req)
+	var ret []common.GetResponse
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			ret = append(ret, res)
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	return ret
+}
+
+// casHandler answers gets from a mapHandler with cas on every hit. While hold is set the answers
+// wait for it to be closed.
+type casHandler struct {
+	*mapHandler
+	cas  uint64
+	hold chan struct{}
+}
+
+func (h *casHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resIn, errs := h.mapHandler.Get(cmd)
+	hold := h.hold
+
+	res := make(chan common.GetResponse)
+	go func() {
+		defer close(res)
+		if hold != nil {
+			<-hold
+		}
+		for r := range resIn {
+			if !r.Miss {
+				r.Cas = h.cas
+			}
+			res <- r
+		}
+	}()
+	return res, errs
+}
+
+func TestHotKeyCached(t *testing.T) {
+	backend := &casHandler{mapHandler: newMapHandler(), cas: 7}
+	backend.data["foo"] = "bar"
+	backend.data["qux"] = "quux"
+
+	hk := handlers.NewHotKeys(handlers.HotKeyConfig{
+		SampleRate: 1,
+		Threshold:  1,
+		TTL:        time.Minute,
+		MaxKeys:    1,
+	})
+	h, _ := handlers.Chain(func() (handlers.Handler, error) { return backend, nil }, handlers.HotKeyCache(hk))()
+
+	for i := 0; i < 5; i++ {
+		hotGet(t, h, "foo")
+	}
+	hotGet(t, h, "qux")
+	time.Sleep(1100 * time.Millisecond)
+
+	// This get ends the window, which makes foo hot, and puts its value in memory
+	hotGet(t, h, "foo")
+
+	backend.mu.Lock()
+	backend.data["foo"] = "baz"
+	backend.data["qux"] = "corge"
+	backend.mu.Unlock()
+
+	t.Run("ServedFromMemory", func(t *testing.T) {
+		res := hotGet(t, h, "qux", "foo", "nope")
+		if len(res) != 3 {
+			t.Fatalf("Expected 3 responses, got %d", len(res))
+		}
+		if string(res[0].Key) != "qux" || string(res[0].Data) != "corge" || res[0].Opaque != 0 {
+			t.Fatalf("Expected qux to be read from the backend, got %+v", res[0])
+		}
+		if string(res[1].Key) != "foo" || string(res[1].Data) != "bar" || res[1].Opaque != 1 || res[1].Cas != 7 {
+			t.Fatalf("Expected foo to be served from memory, got %+v", res[1])
+		}
+		if string(res[2].Key) != "nope" || !res[2].Miss || res[2].Opaque != 2 {
+			t.Fatalf("Expected a miss for nope, got %+v", res[2])
+		}
+	})
+
+	t.Run("WriteInvalidates", func(t *testing.T) {
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("grault")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		backend.mu.Lock()
+		backend.data["foo"] = "garply"
+		backend.mu.Unlock()
+
+		res := hotGet(t, h, "foo")
+		if len(res) != 1 || string(res[0].Data) != "garply" {
+			t.Fatalf("Expected foo to be read again after a set, got %+v", res)
+		}
+	})
+	t.Run("WriteDuringGet", func(t *testing.T) {
+		// The set drops the value of foo, so the get reads it from the backend. The second set
+		// lands while the answer is on its way back.
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("garply")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		backend.hold = make(chan struct{})
+		done := make(chan []common.GetResponse)
+		go func() { done <- hotGet(t, h, "foo") }()
+		time.Sleep(50 * time.Millisecond)
+
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("waldo")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		close(backend.hold)
+		if res := <-done; len(res) != 1 || string(res[0].Data) != "garply" {
+			t.Fatalf("Expected the get to see the old value, got %+v", res)
+		}
+		backend.hold = nil
+
+		res := hotGet(t, h, "foo")
+		if len(res) != 1 || string(res[0].Data) != "waldo" {
+			t.Fatalf("Expected the old value not to be kept, got %+v", res)
+		}
+	})
+}
@@ -15,6 +15,7 @@
 package inmem
 
 import (
+	"strconv"
 	"sync"
 	"time"
 
@@ -25,6 +26,7 @@ import (
 type entry struct {
 	exptime uint32
 	flags   uint32
+	cas     uint64
 	data    []byte
 }
 
@@ -35,6 +37,8 @@ func (e entry) isExpired() bool {
 type Handler struct {
 	data  map[string]entry
 	mutex *sync.RWMutex
+	// cas is the last CAS value handed out. Only modified under the write lock.
+	cas uint64
 }
 
 var singleton = &Handler{
@@ -47,9 +51,36 @@ func New() (handlers.Handler, error) {
 	return singleton, nil
 }
 
+// checkCas verifies the CAS given in a request against the current entry.
+func checkCas(e entry, ok bool, cas uint64) error {
+	if cas == 0 {
+		return nil
+	}
+	if !ok || e.isExpired() {
+		return common.ErrKeyNotFound
+	}
+	if e.cas != cas {
+		return common.ErrKeyExists
+	}
+	return nil
+}
+
+// nextCas returns a new unique CAS value. Must be called with the write lock held.
+func (h *Handler) nextCas() uint64 {
+	h.cas++
+	return h.cas
+}
+
 func (h *Handler) Set(cmd common.SetRequest) error {
 	h.mutex.Lock()
 
+	e, ok := h.data[string(cmd.Key)]
+
+	if err := checkCas(e, ok, cmd.Cas); err != nil {
+		h.mutex.Unlock()
+		return err
+	}
+
 	var exptime uint32
 	if cmd.Exptime > 0 {
 		exptime = uint32(time.Now().Unix()) + cmd.Exptime
@@ -59,6 +90,7 @@ func (h *Handler) Set(cmd common.SetRequest) error {
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -68,10 +100,7 @@ func (h *Handler) Set(cmd common.SetRequest) error {
 func (h *Handler) Add(cmd common.SetRequest) error {
 	h.mutex.Lock()
 
-	e, ok := h.data[string(cmd.Key)]
-
-	if ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
+	if e, ok := h.data[string(cmd.Key)]; ok && !e.isExpired() {
 		h.mutex.Unlock()
 		return common.ErrKeyExists
 	}
@@ -85,6 +114,7 @@ func (h *Handler) Add(cmd common.SetRequest) error {
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -102,6 +132,11 @@ func (h *Handler) Replace(cmd common.SetRequest) error {
 		return common.ErrKeyNotFound
 	}
 
+	if err := checkCas(e, ok, cmd.Cas); err != nil {
+		h.mutex.Unlock()
+		return err
+	}
+
 	var exptime uint32
 	if cmd.Exptime > 0 {
 		exptime = uint32(time.Now().Unix()) + cmd.Exptime
@@ -111,6 +146,7 @@ func (h *Handler) Replace(cmd common.SetRequest) error {
 		data:    cmd.Data,
 		exptime: exptime,
 		flags:   cmd.Flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -128,10 +164,16 @@ func (h *Handler) Append(cmd common.SetRequest) error {
 		return common.ErrKeyNotFound
 	}
 
+	if err := checkCas(e, ok, cmd.Cas); err != nil {
+		h.mutex.Unlock()
+		return err
+	}
+
 	h.data[string(cmd.Key)] = entry{
 		data:    append(e.data, cmd.Data...),
 		exptime: e.exptime,
 		flags:   e.flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -149,10 +191,16 @@ func (h *Handler) Prepend(cmd common.SetRequest) error {
 		return common.ErrKeyNotFound
 	}
 
+	if err := checkCas(e, ok, cmd.Cas); err != nil {
+		h.mutex.Unlock()
+		return err
+	}
+
 	h.data[string(cmd.Key)] = entry{
 		data:    append(cmd.Data, e.data...),
 		exptime: e.exptime,
 		flags:   e.flags,
+		cas:     h.nextCas(),
 	}
 
 	h.mutex.Unlock()
@@ -184,6 +232,7 @@ func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
 			Flags:  e.flags,
+			Cas:    e.cas,
 			Key:    bk,
 			Data:   e.data,
 		}
@@ -222,6 +271,7 @@ func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-cha
 			Opaque:  cmd.Opaques[idx],
 			Exptime: e.exptime,
 			Flags:   e.flags,
+			Cas:     e.cas,
 			Key:     bk,
 			Data:    e.data,
 		}
@@ -244,6 +294,7 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 		h.mutex.Unlock()
 		return common.GetResponse{
 			Miss:   true,
+			Quiet:  cmd.Quiet,
 			Opaque: cmd.Opaque,
 			Key:    cmd.Key,
 		}, nil
@@ -261,8 +312,10 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 	return common.GetResponse{
 		Miss:   false,
+		Quiet:  cmd.Quiet,
 		Opaque: cmd.Opaque,
 		Flags:  e.flags,
+		Cas:    e.cas,
 		Key:    cmd.Key,
 		Data:   e.data,
 	}, nil
@@ -270,6 +323,14 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 func (h *Handler) Delete(cmd common.DeleteRequest) error {
 	h.mutex.Lock()
+
+	e, ok := h.data[string(cmd.Key)]
+
+	if err := checkCas(e, ok, cmd.Cas); err != nil {
+		h.mutex.Unlock()
+		return err
+	}
+
 	delete(h.data, string(cmd.Key))
 	h.mutex.Unlock()
 	return nil
@@ -299,6 +360,109 @@ func (h *Handler) Touch(cmd common.TouchRequest) error {
 	return nil
 }
 
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecrCommon(cmd, true)
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecrCommon(cmd, false)
+}
+
+func (h *Handler) incrDecrCommon(cmd common.IncrDecrRequest, incr bool) (uint64, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	e, ok := h.data[string(cmd.Key)]
+
+	if !ok || e.isExpired() {
+		delete(h.data, string(cmd.Key))
+
+		if cmd.Exptime == common.NoInitialExptime {
+			return 0, common.ErrKeyNotFound
+		}
+
+		var exptime uint32
+		if cmd.Exptime > 0 {
+			exptime = uint32(time.Now().Unix()) + cmd.Exptime
+		}
+
+		h.data[string(cmd.Key)] = entry{
+			data:    []byte(strconv.FormatUint(cmd.Initial, 10)),
+			exptime: exptime,
+			cas:     h.nextCas(),
+		}
+
+		return cmd.Initial, nil
+	}
+
+	val, err := strconv.ParseUint(string(e.data), 10, 64)
+	if err != nil {
+		return 0, common.ErrBadIncDecValue
+	}
+
+	// Increments wrap at 64 bits and decrements stop at 0, same as memcached
+	if incr {
+		val += cmd.Delta
+	} else if cmd.Delta > val {
+		val = 0
+	} else {
+		val -= cmd.Delta
+	}
+
+	e.data = []byte(strconv.FormatUint(val, 10))
+	e.cas = h.nextCas()
+	h.data[string(cmd.Key)] = e
+
+	return val, nil
+}
+
+// Version returns a fixed string since there is no separate server behind the in-memory handler.
+func (h *Handler) Version() (string, error) {
+	return "inmem", nil
+}
+
+// Flush removes all the data. With a delay, every current item expires at the flush time instead
+// if it would otherwise live longer.
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if cmd.Delay == 0 {
+		h.data = make(map[string]entry)
+		return nil
+	}
+
+	flushTime := uint32(time.Now().Unix()) + cmd.Delay
+	for k, e := range h.data {
+		if e.exptime == 0 || e.exptime > flushTime {
+			e.exptime = flushTime
+			h.data[k] = e
+		}
+	}
+
+	return nil
+}
+
+// Stats only has general stats. There are no groups for the in-memory handler.
+func (h *Handler) Stats(group []byte) ([]common.Stat, error) {
+	if len(group) > 0 {
+		return nil, nil
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var bytes uint64
+	for _, e := range h.data {
+		bytes += uint64(len(e.data))
+	}
+
+	return []common.Stat{
+		{Name: "curr_items", Value: strconv.Itoa(len(h.data))},
+		{Name: "bytes", Value: strconv.FormatUint(bytes, 10)},
+	}, nil
+}
+
 func (h *Handler) Close() error {
 	return nil
 }
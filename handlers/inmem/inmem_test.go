@@ -0,0 +1,61 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+)
+
+func newHandler() *Handler {
+	return &Handler{
+		data:  make(map[string]entry),
+		mutex: new(sync.RWMutex),
+	}
+}
+
+func TestAddLiveKey(t *testing.T) {
+	h := newHandler()
+	key := []byte("foo")
+
+	if err := h.Add(common.SetRequest{Key: key, Data: []byte("bar")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := h.Add(common.SetRequest{Key: key, Data: []byte("baz")}); err != common.ErrKeyExists {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+	if e := h.data["foo"]; string(e.data) != "bar" {
+		t.Fatalf("Expected the original value, got %q", e.data)
+	}
+}
+
+func TestAddExpiredKey(t *testing.T) {
+	h := newHandler()
+	h.data["foo"] = entry{
+		data:    []byte("bar"),
+		exptime: uint32(time.Now().Unix()) - 10,
+		cas:     h.nextCas(),
+	}
+
+	if err := h.Add(common.SetRequest{Key: []byte("foo"), Data: []byte("baz")}); err != nil {
+		t.Fatalf("Expected add over an expired key to succeed, got %v", err)
+	}
+	if e := h.data["foo"]; string(e.data) != "baz" || e.isExpired() {
+		t.Fatalf("Expected the new value, got %q", e.data)
+	}
+}
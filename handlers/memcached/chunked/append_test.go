@@ -0,0 +1,273 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/memcached/memcachedtest"
+)
+
+// storedMeta reads the metadata of key straight out of the fake memcached
+func storedMeta(t *testing.T, s *memcachedtest.Server, key string) metadata {
+	data, ok := s.Get(key + "-meta")
+	if !ok {
+		t.Fatalf("Expected metadata for %s", key)
+	}
+	md, err := readMetadata(bytes.NewReader(data), len(data))
+	if err != nil {
+		t.Fatalf("Error reading metadata: %v", err)
+	}
+	return md
+}
+
+func newAppendHandler(t *testing.T, s *memcachedtest.Server) Handler {
+	return NewHandler(s.Dial(t)).WithChunkSize(MinChunkSize)
+}
+
+func TestAppendInPlace(t *testing.T) {
+	s := memcachedtest.NewServer(t)
+	h := newAppendHandler(t, s)
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("abc"), Flags: 7}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	dataSize := int(storedMeta(t, s, "foo").ChunkSize)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		chunks uint32
+	}{
+		{"within the last chunk", []byte("def"), 1},
+		{"filling the last chunk", bytes.Repeat([]byte("g"), dataSize-6), 1},
+		{"into new chunks", bytes.Repeat([]byte("h"), 2*dataSize+1), 4},
+	}
+
+	expected := []byte("abc")
+	for _, test := range tests {
+		before := storedMeta(t, s, "foo")
+
+		if err := h.Append(common.SetRequest{Key: []byte("foo"), Data: test.data}); err != nil {
+			t.Fatalf("%s: error appending: %v", test.name, err)
+		}
+		expected = append(expected, test.data...)
+
+		md := storedMeta(t, s, "foo")
+		if md.Token != before.Token || md.NumChunks != test.chunks || md.Length != uint32(len(expected)) {
+			t.Fatalf("%s: expected the item to be extended in place to %d chunks, got %+v", test.name, test.chunks, md)
+		}
+		if s.Len() != int(md.NumChunks)+1 {
+			t.Fatalf("%s: expected the replaced chunk to be deleted, got %d items", test.name, s.Len())
+		}
+
+		res := getValue(t, h, "foo")
+		if res.Miss || !bytes.Equal(res.Data, expected) || res.Flags != 7 {
+			t.Fatalf("%s: expected the appended value, got miss: %v, %q", test.name, res.Miss, res.Data)
+		}
+	}
+}
+
+func TestAppendInPlaceEmpty(t *testing.T) {
+	s := memcachedtest.NewServer(t)
+	h := newAppendHandler(t, s)
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Flags: 7}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if md := storedMeta(t, s, "foo"); md.NumChunks != 0 {
+		t.Fatalf("Expected an empty value to have no chunks, got %d", md.NumChunks)
+	}
+
+	if err := h.Append(common.SetRequest{Key: []byte("foo"), Data: []byte("abc")}); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+
+	res := getValue(t, h, "foo")
+	if res.Miss || string(res.Data) != "abc" || res.Flags != 7 {
+		t.Fatalf("Expected the appended data to be the value, got miss: %v, %q", res.Miss, res.Data)
+	}
+}
+
+func TestAppendInPlaceTokenMismatch(t *testing.T) {
+	s := memcachedtest.NewServer(t)
+	h := newAppendHandler(t, s)
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("abc")}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	// The last chunk was overwritten by another item since the metadata was written
+	tail, _ := s.Get("foo-0")
+	other := append([]byte(nil), tail...)
+	other[0]++
+	s.Put("foo-0", other)
+
+	if err := h.Append(common.SetRequest{Key: []byte("foo"), Data: []byte("def")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected a miss, got %v", err)
+	}
+	if data, _ := s.Get("foo-0"); !bytes.Equal(data, other) {
+		t.Fatalf("Expected the chunk to be left alone")
+	}
+}
+
+func TestAppendInPlaceMetaChanged(t *testing.T) {
+	s := memcachedtest.NewServer(t)
+	h := newAppendHandler(t, s)
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("abc")}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	cas := getValue(t, h, "foo").Cas
+	before, _ := s.Get("foo-meta")
+
+	// The metadata changes after the chunks are written and before the new metadata is
+	s.SetHook(func(conn int, req common.Request) error {
+		if set, ok := req.(common.SetRequest); ok && string(set.Key) == "foo-meta" {
+			s.Put("foo-meta", before)
+		}
+		return nil
+	})
+
+	if err := h.Append(common.SetRequest{Key: []byte("foo"), Data: []byte("def"), Cas: cas}); err != common.ErrKeyExists {
+		t.Fatalf("Expected the metadata CAS to fail, got %v", err)
+	}
+	s.SetHook(nil)
+
+	// The new chunk is deleted and the old one was never touched
+	if s.Len() != 2 {
+		t.Fatalf("Expected only the metadata and the old chunk to be left, got %d items", s.Len())
+	}
+	res := getValue(t, h, "foo")
+	if res.Miss || string(res.Data) != "abc" {
+		t.Fatalf("Expected the old value, got miss: %v, %q", res.Miss, res.Data)
+	}
+}
+
+func TestAppendInPlaceRace(t *testing.T) {
+	s := memcachedtest.NewServer(t)
+	h := newAppendHandler(t, s)
+	other := newAppendHandler(t, s)
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("abc")}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	// Another append finishes after the chunks of the first are written and before its metadata
+	var raced bool
+	var otherErr error
+	s.SetHook(func(conn int, req common.Request) error {
+		if set, ok := req.(common.SetRequest); ok && string(set.Key) == "foo-meta" && set.Cas != 0 && !raced {
+			raced = true
+			otherErr = other.Append(common.SetRequest{Key: []byte("foo"), Data: []byte("xyz")})
+		}
+		return nil
+	})
+
+	if err := h.Append(common.SetRequest{Key: []byte("foo"), Data: []byte("def")}); err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	s.SetHook(nil)
+	if otherErr != nil {
+		t.Fatalf("Error appending on the other connection: %v", otherErr)
+	}
+
+	// The losing append starts over on top of the winner instead of mixing its data in
+	res := getValue(t, h, "foo")
+	if res.Miss || string(res.Data) != "abcxyzdef" {
+		t.Fatalf("Expected both appends, got miss: %v, %q", res.Miss, res.Data)
+	}
+}
+
+func TestAppendInPlaceSegments(t *testing.T) {
+	s := memcachedtest.NewServer(t)
+	h := newAppendHandler(t, s)
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("abc")}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	first := storedMeta(t, s, "foo")
+	chunk := bytes.Repeat([]byte("d"), int(first.ChunkSize))
+	expected := []byte("abc")
+
+	// Each append crosses into a new chunk and so leaves a new segment, until there are too many
+	for i := 1; i <= maxSegments+1; i++ {
+		if err := h.Append(common.SetRequest{Key: []byte("foo"), Data: chunk}); err != nil {
+			t.Fatalf("Error appending: %v", err)
+		}
+		expected = append(expected, chunk...)
+
+		md := storedMeta(t, s, "foo")
+		if i <= maxSegments && (md.Token != first.Token || len(md.Segments) != i) {
+			t.Fatalf("Expected append %d to leave %d segments, got %d", i, i, len(md.Segments))
+		}
+		if i > maxSegments && (md.Token == first.Token || len(md.Segments) != 0) {
+			t.Fatalf("Expected the item to be rewritten without segments, got %d", len(md.Segments))
+		}
+
+		// Replaced chunks are deleted
+		if s.Len() != int(md.NumChunks)+1 {
+			t.Fatalf("Expected %d chunks and the metadata, got %d items", md.NumChunks, s.Len())
+		}
+
+		res := getValue(t, h, "foo")
+		if res.Miss || !bytes.Equal(res.Data, expected) {
+			t.Fatalf("Expected the appended value, got miss: %v, %d bytes", res.Miss, len(res.Data))
+		}
+	}
+}
+
+func TestAppendRewritesEncodedItems(t *testing.T) {
+	keyring, err := NewKeyring(1, map[uint16][]byte{1: bytes.Repeat([]byte("k"), 32)})
+	if err != nil {
+		t.Fatalf("Error creating keyring: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		with func(Handler) Handler
+	}{
+		{"compressed", func(h Handler) Handler { return h.WithCompression(Flate, 1) }},
+		{"encrypted", func(h Handler) Handler { return h.WithEncryption(keyring) }},
+		{"deduplicated", func(h Handler) Handler { return h.WithDedup() }},
+	}
+
+	for _, test := range tests {
+		s := memcachedtest.NewServer(t)
+		h := test.with(newAppendHandler(t, s))
+
+		value := bytes.Repeat([]byte("a"), 1000)
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: value}); err != nil {
+			t.Fatalf("%s: error setting: %v", test.name, err)
+		}
+		before := storedMeta(t, s, "foo")
+
+		if err := h.Append(common.SetRequest{Key: []byte("foo"), Data: []byte("bcd")}); err != nil {
+			t.Fatalf("%s: error appending: %v", test.name, err)
+		}
+
+		// A rewrite stores the item again with a new token
+		if md := storedMeta(t, s, "foo"); md.Token == before.Token {
+			t.Fatalf("%s: expected the whole item to be rewritten", test.name)
+		}
+
+		res := getValue(t, h, "foo")
+		if res.Miss || !bytes.Equal(res.Data, append(value, "bcd"...)) {
+			t.Fatalf("%s: expected the appended value, got miss: %v, %d bytes", test.name, res.Miss, len(res.Data))
+		}
+	}
+}
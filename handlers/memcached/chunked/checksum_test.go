@@ -0,0 +1,79 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+)
+
+func TestChunkChecksum(t *testing.T) {
+	buf := &bytes.Buffer{}
+	h := Handler{rw: bufio.NewReadWriter(bufio.NewReader(buf), bufio.NewWriter(buf))}
+
+	md := metadata{Checksums: true}
+	copy(md.Token[:], "0123456789abcdef")
+
+	// A short last chunk, which is stored without padding
+	data := []byte("some data")
+	const chunkSize = 32
+	r := newChunkLimitedReader(bytes.NewReader(data), chunkSize, int64(len(data)))
+	cmd := common.SetRequest{Key: []byte("foo")}
+
+	if err := h.writeChunk(cmd, 0, md, r); err != nil {
+		t.Fatalf("Error writing chunk: %v", err)
+	}
+	h.rw.Flush()
+
+	// Skip the header, flags, exptime and key of the set to get to the value
+	keyLen := len(chunkKey([]byte("foo"), 0))
+	value := buf.Bytes()[binprot.ReqHeaderLen+8+keyLen:]
+	if len(value) != tokenSize+len(data)+checksumSize {
+		t.Fatalf("Expected a %d byte chunk, got %d", tokenSize+len(data)+checksumSize, len(value))
+	}
+
+	verify := func(value []byte) error {
+		token := value[:tokenSize]
+		chunk := value[tokenSize : tokenSize+len(data)]
+		rest := bufio.NewReader(bytes.NewReader(value[tokenSize+len(data):]))
+		return verifyChunk(rest, token, chunk, 0)
+	}
+
+	if err := verify(value); err != nil {
+		t.Fatalf("Expected the checksum to match, got %v", err)
+	}
+
+	for _, i := range []int{0, tokenSize + 1, tokenSize + len(data) - 1, len(value) - 1} {
+		corrupt := append([]byte(nil), value...)
+		corrupt[i] ^= 0x10
+		if err := verify(corrupt); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected a corrupt byte at %d to be a miss, got %v", i, err)
+		}
+	}
+}
+
+func TestChunkSizeChecksums(t *testing.T) {
+	h := Handler{chunkMaxSize: DefaultChunkSize}
+	data, full := h.chunkSize(3, 0)
+	cdata, cfull := h.WithChecksums().chunkSize(3, 0)
+
+	if cfull != full || cdata != data-checksumSize {
+		t.Fatalf("Expected checksums to take %d bytes of data, got %d/%d and %d/%d", checksumSize, data, full, cdata, cfull)
+	}
+}
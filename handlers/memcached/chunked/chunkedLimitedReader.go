@@ -32,7 +32,7 @@ func newChunkLimitedReader(reader io.Reader, chunkSize, totalSize int64) chunked
 }
 
 // This reader is ***NOT THREAD SAFE***
-// It will read *past* the end of the total size to fill in the remainder of a chunk
+// It stops at the end of the total size, so the last chunk is only as long as the data left for it
 // effectively acts as a chunk iterator over the input stream
 type chunkedLimitedReader struct {
 	d *clrData
@@ -51,25 +51,11 @@ type clrData struct {
 
 // io.Reader's interface implements this as a value method, not a pointer method.
 func (c chunkedLimitedReader) Read(p []byte) (n int, err error) {
-	// If we've already read all our chunks and the remainders are <= 0, we're done
-	if c.d.doneChunks >= c.d.numChunks || (c.d.remaining <= 0 && c.d.chunkRem <= 0) {
+	// If we've already read all our chunks or all of the data, we're done
+	if c.d.doneChunks >= c.d.numChunks || c.d.remaining <= 0 {
 		return 0, io.EOF
 	}
 
-	// Data is done, returning only buffer bytes now
-	if c.d.remaining <= 0 {
-		if int64(len(p)) > c.d.chunkRem {
-			p = p[0:c.d.chunkRem]
-		}
-
-		for i := range p {
-			p[i] = 0
-		}
-
-		c.d.chunkRem -= int64(len(p))
-		return len(p), nil
-	}
-
 	// Data is not yet done, but chunk is
 	if c.d.chunkRem <= 0 {
 		return 0, io.EOF
@@ -95,6 +81,14 @@ func (c chunkedLimitedReader) NextChunk() {
 	}
 }
 
+// ChunkLen returns how many bytes of data are left in the current chunk
+func (c chunkedLimitedReader) ChunkLen() int64 {
+	if c.d.remaining < c.d.chunkRem {
+		return c.d.remaining
+	}
+	return c.d.chunkRem
+}
+
 func (c chunkedLimitedReader) More() bool {
 	return c.d.doneChunks < c.d.numChunks
 }
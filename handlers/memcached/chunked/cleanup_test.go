@@ -0,0 +1,61 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+)
+
+func TestCleanupPartialSet(t *testing.T) {
+	responses := &bytes.Buffer{}
+	w := bufio.NewWriter(responses)
+	res := binprot.NewBinaryResponder(w)
+	res.Delete(0, false)
+	res.Delete(0, false)
+	res.Error(0, common.RequestDelete, common.ErrKeyNotFound, false)
+	w.Flush()
+
+	written := &bytes.Buffer{}
+	h := Handler{rw: bufio.NewReadWriter(bufio.NewReader(responses), bufio.NewWriter(written))}
+
+	if err := h.cleanupPartialSet([]byte("foo"), metadata{NumChunks: 2}, false, common.ErrNoMem); err != nil {
+		t.Fatalf("Error cleaning up: %v", err)
+	}
+	if responses.Len() != 0 || h.rw.Reader.Buffered() != 0 {
+		t.Fatalf("Expected every response to be read")
+	}
+
+	p := binprot.NewBinaryParser(bufio.NewReader(written))
+	for _, key := range []string{"foo-meta", "foo-0", "foo-1"} {
+		req, reqType, _, err := p.Parse()
+		if err != nil || reqType != common.RequestDelete {
+			t.Fatalf("Expected a delete, got %v and %v", reqType, err)
+		}
+		if got := string(req.(common.DeleteRequest).Key); got != key {
+			t.Fatalf("Expected a delete of %s, got %s", key, got)
+		}
+	}
+
+	// Nothing can be sent after an I/O error
+	written.Reset()
+	if err := h.cleanupPartialSet([]byte("foo"), metadata{NumChunks: 2}, false, bufio.ErrBufferFull); err != nil || written.Len() != 0 {
+		t.Fatalf("Expected no cleanup after an I/O error")
+	}
+}
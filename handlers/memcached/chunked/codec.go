@@ -0,0 +1,147 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricCompressed         = metrics.AddCounter("chunked_compressed", nil)
+	MetricCompressSkipped    = metrics.AddCounter("chunked_compress_skipped", nil)
+	MetricCompressErrors     = metrics.AddCounter("chunked_compress_errors", nil)
+	MetricDecompressErrors   = metrics.AddCounter("chunked_decompress_errors", nil)
+	MetricCompressBytesSaved = metrics.AddCounter("chunked_compress_bytes_saved", nil)
+)
+
+// Codec compresses values before they are split into chunks. Its ID is stored in the metadata of
+// each item it compresses so the item can be decompressed by any handler that has the codec
+// registered, whatever codec that handler uses for new items.
+type Codec interface {
+	// ID identifies the codec in stored items. It must not be 0, which means uncompressed, and
+	// must never change once items have been stored with it.
+	ID() uint8
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// Codec IDs. Only Flate is built in, since the others need libraries outside of the standard
+// library. Codecs for them should use these IDs when registered.
+const (
+	CodecFlate  uint8 = 1
+	CodecSnappy uint8 = 2
+	CodecLZ4    uint8 = 3
+	CodecZstd   uint8 = 4
+)
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[uint8]Codec{
+		CodecFlate: Flate,
+	}
+)
+
+// RegisterCodec makes a codec available for compressing and decompressing items. It replaces any
+// codec registered with the same ID.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	codecs[c.ID()] = c
+	codecsLock.Unlock()
+}
+
+// LookupCodec returns the codec registered with the ID, if any
+func LookupCodec(id uint8) (Codec, bool) {
+	codecsLock.RLock()
+	c, ok := codecs[id]
+	codecsLock.RUnlock()
+	return c, ok
+}
+
+// Flate compresses with DEFLATE at the fastest level, which does well on the JSON and other text
+// that make up most large values.
+var Flate Codec = flateCodec{}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() uint8 { return CodecFlate }
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// compress returns the data compressed with the handler's codec and the ID to store with it, or
+// the data as it is and 0 if it is too small or doesn't get smaller.
+func (h Handler) compress(data []byte) ([]byte, uint8) {
+	if h.codec == nil || len(data) < h.compressMin {
+		return data, 0
+	}
+
+	compressed, err := h.codec.Compress(data)
+	if err != nil {
+		metrics.IncCounter(MetricCompressErrors)
+		return data, 0
+	}
+	if len(compressed) >= len(data) {
+		metrics.IncCounter(MetricCompressSkipped)
+		return data, 0
+	}
+
+	metrics.IncCounter(MetricCompressed)
+	metrics.IncCounterBy(MetricCompressBytesSaved, uint64(len(data)-len(compressed)))
+	return compressed, h.codec.ID()
+}
+
+// decompress returns the original value of an item read with the metadata
+func decompress(md metadata, data []byte) ([]byte, error) {
+	if md.Codec == 0 {
+		return data, nil
+	}
+
+	c, ok := LookupCodec(md.Codec)
+	if !ok {
+		metrics.IncCounter(MetricDecompressErrors)
+		return nil, fmt.Errorf("Item compressed with unknown codec %d", md.Codec)
+	}
+
+	data, err := c.Decompress(data)
+	if err != nil {
+		metrics.IncCounter(MetricDecompressErrors)
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"github.com/hongst/rend/common"
+)
+
+func TestCompress(t *testing.T) {
+	h := Handler{}.WithCompression(Flate, 100)
+
+	json := bytes.Repeat([]byte(`{"id": 12345, "title": "Some Show", "rating": 4.5},`), 100)
+	data, codec := h.compress(json)
+	if codec != CodecFlate || len(data) >= len(json) {
+		t.Fatalf("Expected the value to be compressed, got codec %d and %d bytes", codec, len(data))
+	}
+
+	orig, err := decompress(metadata{Codec: codec}, data)
+	if err != nil {
+		t.Fatalf("Error decompressing: %v", err)
+	}
+	if !bytes.Equal(orig, json) {
+		t.Fatal("Expected to get the original value back")
+	}
+
+	if _, codec := h.compress(json[:50]); codec != 0 {
+		t.Fatal("Expected a value under the minimum to be left alone")
+	}
+
+	random := make([]byte, 1000)
+	rand.Read(random)
+	if data, codec := h.compress(random); codec != 0 || !bytes.Equal(data, random) {
+		t.Fatal("Expected a value that doesn't shrink to be left alone")
+	}
+
+	if _, codec := (Handler{}).compress(json); codec != 0 {
+		t.Fatal("Expected no compression without a codec")
+	}
+
+	if _, err := decompress(metadata{Codec: 200}, data); err == nil {
+		t.Fatal("Expected an error for an unknown codec")
+	}
+}
+
+func TestMetadataCodec(t *testing.T) {
+	for _, md := range []metadata{
+		{Length: 10, NumChunks: 1, ChunkSize: 1000},
+		{Length: 10, NumChunks: 1, ChunkSize: 1000, Codec: CodecFlate},
+		{Length: 10, NumChunks: 1, ChunkSize: 1000, Cipher: CipherAESGCM, KeyVersion: 300},
+		{Length: 10, NumChunks: 1, ChunkSize: 1000, Checksums: true},
+		{Length: 10, NumChunks: 2, ChunkSize: 8, Dedup: true, Hashes: [][tokenSize]byte{{1}, {2}}},
+		{Length: 20, NumChunks: 3, ChunkSize: 8, Segments: []segment{{Start: 1, Token: [tokenSize]byte{1}}, {Start: 2, Token: [tokenSize]byte{2}}}},
+	} {
+		buf := &bytes.Buffer{}
+		if err := writeMetadata(buf, md); err != nil {
+			t.Fatalf("Error writing metadata: %v", err)
+		}
+		if buf.Len() != int(md.size()) {
+			t.Fatalf("Expected %d bytes of metadata, got %d", md.size(), buf.Len())
+		}
+
+		read, err := readMetadata(buf, int(md.size()))
+		if err != nil {
+			t.Fatalf("Error reading metadata: %v", err)
+		}
+		if md.extended() {
+			md.Version = metadataVersion
+		}
+		if !reflect.DeepEqual(read, md) {
+			t.Fatalf("Expected %+v, got %+v", md, read)
+		}
+	}
+}
+
+func TestMetadataLegacy(t *testing.T) {
+	header := &bytes.Buffer{}
+	writeMetadata(header, metadata{Length: 10, NumChunks: 1, ChunkSize: 1000})
+
+	// Extensions from before the version byte
+	for _, ext := range [][]byte{
+		{CodecFlate, CipherAESGCM, 0x01, 0x2C},
+		{CodecFlate, CipherAESGCM, 0x01, 0x2C, flagChecksums, 0, 0, 0},
+	} {
+		buf := bytes.NewBuffer(append(append([]byte(nil), header.Bytes()...), ext...))
+		read, err := readMetadata(buf, buf.Len())
+		if err != nil {
+			t.Fatalf("Error reading metadata: %v", err)
+		}
+		if read.Codec != CodecFlate || read.Cipher != CipherAESGCM || read.KeyVersion != 300 || read.Version != 0 {
+			t.Fatalf("Unexpected metadata %+v", read)
+		}
+		if read.Checksums != (len(ext) == 8) {
+			t.Fatalf("Expected checksums only in the 8 byte extension")
+		}
+	}
+
+	// A version from the future is a miss, but is read in full
+	ext := make([]byte, 16)
+	ext[0] = metadataVersion + 1
+	buf := bytes.NewBuffer(append(append([]byte(nil), header.Bytes()...), ext...))
+	if _, err := readMetadata(buf, buf.Len()); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected an unknown version to be a miss, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Expected the metadata to be read in full")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricEncrypted         = metrics.AddCounter("chunked_encrypted", nil)
+	MetricDecryptErrors     = metrics.AddCounter("chunked_decrypt_errors", nil)
+	MetricDecryptUnknownKey = metrics.AddCounter("chunked_decrypt_unknown_key", nil)
+)
+
+// CipherAESGCM marks items encrypted with AES-GCM. The stored data is the nonce followed by the
+// sealed value, and the item's key is the additional data so data can't be moved between keys.
+const CipherAESGCM uint8 = 1
+
+var errUnknownKeyVersion = errors.New("Item encrypted with an unknown key version")
+
+// Keyring holds the keys used to encrypt items at rest. New items are encrypted with the current
+// key and the key's version is stored with them, so after a rotation items written with older
+// keys can still be read as long as those keys stay in the keyring.
+//
+// Keys can come from anywhere: a file, as read by LoadKeyring, or a KMS that hands out data keys
+// to be passed to NewKeyring.
+type Keyring struct {
+	current uint16
+	aeads   map[uint16]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from AES keys of 16, 24 or 32 bytes by version. The current
+// version must be one of them.
+func NewKeyring(current uint16, keys map[uint16][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("No key for the current version %d", current)
+	}
+
+	k := &Keyring{
+		current: current,
+		aeads:   make(map[uint16]cipher.AEAD, len(keys)),
+	}
+	for version, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("Key version %d: %v", version, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[version] = aead
+	}
+
+	return k, nil
+}
+
+// LoadKeyring reads a keyring from a file with one key per line, as the version and the hex
+// encoded key separated by a space. The highest version is the current key. Blank lines and lines
+// starting with # are skipped.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[uint16][]byte)
+	var current uint16
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a version and a key", path, line)
+		}
+		version, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad version: %v", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key: %v", path, line, err)
+		}
+
+		keys[uint16(version)] = key
+		if uint16(version) > current || len(keys) == 1 {
+			current = uint16(version)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return NewKeyring(current, keys)
+}
+
+// seal encrypts the data for the key with the current key and returns it and the key's version
+func (k *Keyring) seal(key, data []byte) ([]byte, uint16, error) {
+	aead := k.aeads[k.current]
+
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, 0, err
+	}
+
+	return aead.Seal(out, out, data, key), k.current, nil
+}
+
+func (k *Keyring) open(key, data []byte, version uint16) ([]byte, error) {
+	aead, ok := k.aeads[version]
+	if !ok {
+		metrics.IncCounter(MetricDecryptUnknownKey)
+		return nil, errUnknownKeyVersion
+	}
+	if len(data) < aead.NonceSize() {
+		metrics.IncCounter(MetricDecryptErrors)
+		return nil, errors.New("Encrypted item too short")
+	}
+
+	data, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], key)
+	if err != nil {
+		metrics.IncCounter(MetricDecryptErrors)
+		return nil, err
+	}
+	return data, nil
+}
+
+// encrypt encrypts the data for the key if the handler has a keyring. It returns the data to
+// store and the cipher and key version to record in the metadata.
+func (h Handler) encrypt(key, data []byte) ([]byte, uint8, uint16, error) {
+	if h.keyring == nil {
+		return data, 0, 0, nil
+	}
+
+	sealed, version, err := h.keyring.seal(key, data)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	metrics.IncCounter(MetricEncrypted)
+	return sealed, CipherAESGCM, version, nil
+}
+
+// decrypt returns the data of an item read with the metadata as it was before encryption
+func (h Handler) decrypt(key []byte, md metadata, data []byte) ([]byte, error) {
+	if md.Cipher == 0 {
+		return data, nil
+	}
+	if md.Cipher != CipherAESGCM || h.keyring == nil {
+		metrics.IncCounter(MetricDecryptErrors)
+		return nil, fmt.Errorf("Item encrypted with cipher %d, which this handler can't decrypt", md.Cipher)
+	}
+	return h.keyring.open(key, data, md.KeyVersion)
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	v1 := bytes.Repeat([]byte{1}, 32)
+	v2 := bytes.Repeat([]byte{2}, 16)
+
+	old, err := NewKeyring(1, map[uint16][]byte{1: v1})
+	if err != nil {
+		t.Fatalf("Error creating keyring: %v", err)
+	}
+	rotated, err := NewKeyring(2, map[uint16][]byte{1: v1, 2: v2})
+	if err != nil {
+		t.Fatalf("Error creating keyring: %v", err)
+	}
+
+	value := bytes.Repeat([]byte("some value "), 100)
+	key := []byte("foo")
+
+	h := Handler{}.WithCompression(Flate, 0).WithEncryption(old)
+	data, codec := h.compress(value)
+	data, ciph, version, err := h.encrypt(key, data)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	md := metadata{Codec: codec, Cipher: ciph, KeyVersion: version}
+	if ciph != CipherAESGCM || version != 1 {
+		t.Fatalf("Expected AES-GCM with key version 1, got cipher %d version %d", ciph, version)
+	}
+
+	// Items written before a rotation can still be read after it
+	h = h.WithEncryption(rotated)
+	got, err := h.decode(key, md, data)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Fatal("Expected to get the original value back")
+	}
+
+	if _, _, version, _ := h.encrypt(key, value); version != 2 {
+		t.Fatalf("Expected new items to use the current key, got version %d", version)
+	}
+
+	// The data is bound to its key
+	if _, err := h.decode([]byte("bar"), md, data); err == nil {
+		t.Fatal("Expected an error decrypting with the wrong item key")
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := h.decode(key, md, tampered); err == nil {
+		t.Fatal("Expected an error decrypting tampered data")
+	}
+
+	if _, err := (Handler{}).decode(key, md, data); err == nil {
+		t.Fatal("Expected an error decrypting without a keyring")
+	}
+
+	md.KeyVersion = 9
+	if _, err := h.decode(key, md, data); err != errUnknownKeyVersion {
+		t.Fatalf("Expected an unknown key version error, got %v", err)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	f, err := ioutil.TempFile("", "keyring")
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("# keys\n3 " + string(bytes.Repeat([]byte("ab"), 32)) + "\n\n1 " + string(bytes.Repeat([]byte("cd"), 16)) + "\n")
+	f.Close()
+
+	k, err := LoadKeyring(f.Name())
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+	if k.current != 3 || len(k.aeads) != 2 {
+		t.Fatalf("Expected 2 keys with version 3 current, got %d keys with %d current", len(k.aeads), k.current)
+	}
+
+	if _, err := NewKeyring(1, map[uint16][]byte{2: make([]byte, 16)}); err == nil {
+		t.Fatal("Expected an error without the current key")
+	}
+	if _, err := NewKeyring(1, map[uint16][]byte{1: make([]byte, 10)}); err == nil {
+		t.Fatal("Expected an error for a bad key size")
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+// Deduplicated items store each chunk under a key made from a hash of its content instead of the
+// item's key, so items with the same data share the chunks. The hash takes the place of the token
+// in the chunk as well. Shared chunks don't expire. Each one has a reference count in memcached
+// instead that is raised when an item using it is stored and lowered when that item is deleted or
+// overwritten, and the chunk is deleted when the count gets to 0.
+//
+// Items that expire or are evicted don't lower the counts, so their chunks stay until memcached
+// evicts them. Racing overwrites of the same key can both lower the counts of the old chunks,
+// which frees them early. Items still using them are then misses like any other item with a
+// missing chunk.
+
+// dedupKeyLen is the length of the key of a shared chunk
+const dedupKeyLen = 2*tokenSize + len("-dedup")
+
+// hashChunks returns the hashes of the chunks data is split into
+func hashChunks(data []byte, chunkSize int) [][tokenSize]byte {
+	hashes := make([][tokenSize]byte, (len(data)+chunkSize-1)/chunkSize)
+	for i := range hashes {
+		start, end := chunkSliceIndices(chunkSize, i, len(data))
+		sum := sha256.Sum256(data[start:end])
+		copy(hashes[i][:], sum[:])
+	}
+	return hashes
+}
+
+func hashKey(hash [tokenSize]byte, suffix string) []byte {
+	key := make([]byte, 2*tokenSize, 2*tokenSize+len(suffix))
+	hex.Encode(key, hash[:])
+	return append(key, suffix...)
+}
+
+// dedupKey returns the key a shared chunk is stored under. The suffix keeps it from ever looking
+// like the key of a metadata item or a regular chunk.
+func dedupKey(hash [tokenSize]byte) []byte {
+	return hashKey(hash, "-dedup")
+}
+
+// refsKey returns the key of the reference count of a shared chunk
+func refsKey(hash [tokenSize]byte) []byte {
+	return hashKey(hash, "-refs")
+}
+
+// chunkToken returns the token chunk i of the item should have. Extra responses to a batch get
+// can ask for a chunk past the end, which matches nothing.
+func (md metadata) chunkToken(chunk int) []byte {
+	if !md.Dedup {
+		if seg, ok := md.segment(chunk); ok {
+			return seg.Token[:]
+		}
+		return md.Token[:]
+	}
+	if chunk >= len(md.Hashes) {
+		return nil
+	}
+	return md.Hashes[chunk][:]
+}
+
+// chunkExptime returns the expiration time to store or touch the chunks of the item with
+func (md metadata) chunkExptime(exptime uint32) uint32 {
+	if md.Dedup {
+		return 0
+	}
+	return exptime
+}
+
+// ownedChunks returns how many chunks belong to the item alone and can be deleted with it
+func (md metadata) ownedChunks() int {
+	if md.Dedup {
+		return 0
+	}
+	return int(md.NumChunks)
+}
+
+// storeDedup stores a deduplicated item. The counts of its chunks are raised before the chunks are
+// written so a delete of another item with the same chunks can't free them in the meantime. The
+// counts of the item it replaces are lowered once it is stored.
+func (h Handler) storeDedup(cmd common.SetRequest, reqType common.RequestType, md metadata, r chunkedLimitedReader) error {
+	var old metadata
+	if reqType != common.RequestAdd {
+		var err error
+		if _, old, err = getMetadata(h.rw, cmd.Key); err != nil && err != common.ErrKeyNotFound {
+			return err
+		}
+	}
+
+	if err := h.addRefs(md.Hashes); err != nil {
+		return err
+	}
+
+	if err := h.storeItem(cmd, reqType, md, r); err != nil {
+		if common.IsAppError(err) {
+			if ioerr := h.releaseRefs(md.Hashes); ioerr != nil {
+				return ioerr
+			}
+		}
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetDedup)
+
+	if old.Dedup {
+		return h.releaseRefs(old.Hashes)
+	}
+	return nil
+}
+
+// addRefs raises the reference counts of shared chunks, starting the ones that don't exist yet at
+// 1. If any can't be raised the ones that were are lowered again and the error is returned.
+func (h Handler) addRefs(hashes [][tokenSize]byte) error {
+	for _, hash := range hashes {
+		if err := binprot.WriteIncrCmd(h.rw.Writer, refsKey(hash), 1, 1, 0); err != nil {
+			return err
+		}
+	}
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+
+	var added [][tokenSize]byte
+	var ret error
+	for _, hash := range hashes {
+		if _, _, err := arithCmdLocal(h.rw); err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			if ret == nil {
+				ret = err
+			}
+			continue
+		}
+		added = append(added, hash)
+	}
+
+	if ret != nil {
+		if ioerr := h.releaseRefs(added); ioerr != nil {
+			return ioerr
+		}
+	}
+	return ret
+}
+
+// releaseRefs lowers the reference counts of shared chunks and deletes the chunks no item uses any
+// more. A count is only deleted if it hasn't changed since it got to 0, and its chunk only after
+// that, so a chunk that was just picked up by another item is left alone. Only I/O errors are
+// returned. A count that is missing or can't be changed leaves the chunk to be evicted.
+func (h Handler) releaseRefs(hashes [][tokenSize]byte) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	for _, hash := range hashes {
+		// An expiration of all 1s keeps memcached from creating a count that is missing
+		if err := binprot.WriteDecrCmd(h.rw.Writer, refsKey(hash), 1, 0, 0xffffffff); err != nil {
+			return err
+		}
+	}
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+
+	var unused [][tokenSize]byte
+	var cas []uint64
+	for _, hash := range hashes {
+		refs, c, err := arithCmdLocal(h.rw)
+		if err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			continue
+		}
+		if refs == 0 {
+			unused = append(unused, hash)
+			cas = append(cas, c)
+		}
+	}
+	if len(unused) == 0 {
+		return nil
+	}
+
+	for i, hash := range unused {
+		if err := binprot.WriteDeleteCmd(h.rw.Writer, refsKey(hash), cas[i]); err != nil {
+			return err
+		}
+	}
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+
+	var freed [][tokenSize]byte
+	for _, hash := range unused {
+		if err := simpleCmdLocal(h.rw, false); err != nil {
+			if !common.IsAppError(err) {
+				return err
+			}
+			continue
+		}
+		freed = append(freed, hash)
+	}
+	if len(freed) == 0 {
+		return nil
+	}
+
+	for _, hash := range freed {
+		if err := binprot.WriteDeleteCmd(h.rw.Writer, dedupKey(hash), 0); err != nil {
+			return err
+		}
+	}
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+
+	for range freed {
+		if err := simpleCmdLocal(h.rw, false); err != nil && !common.IsAppError(err) {
+			return err
+		}
+	}
+
+	metrics.IncCounterBy(MetricDedupChunksFreed, uint64(len(freed)))
+	return nil
+}
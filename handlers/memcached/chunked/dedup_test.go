@@ -0,0 +1,123 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+)
+
+func TestHashChunks(t *testing.T) {
+	a := hashChunks([]byte("0123456789abcdef0123"), 10)
+	b := hashChunks([]byte("01234567890123"), 10)
+
+	if len(a) != 2 || len(b) != 2 {
+		t.Fatalf("Expected 2 hashes each, got %d and %d", len(a), len(b))
+	}
+	if a[0] != b[0] {
+		t.Fatalf("Expected the same chunk to have the same hash")
+	}
+	if a[1] == b[1] {
+		t.Fatalf("Expected different chunks to have different hashes")
+	}
+	if key := dedupKey(a[0]); len(key) != dedupKeyLen {
+		t.Fatalf("Expected a %d byte key, got %q", dedupKeyLen, key)
+	}
+}
+
+func TestWriteDedupChunk(t *testing.T) {
+	data := []byte("some data")
+	md := metadata{Dedup: true, Hashes: hashChunks(data, 32)}
+	copy(md.Token[:], "0123456789abcdef")
+
+	buf := &bytes.Buffer{}
+	h := Handler{rw: bufio.NewReadWriter(bufio.NewReader(&bytes.Buffer{}), bufio.NewWriter(buf))}
+	r := newChunkLimitedReader(bytes.NewReader(data), 32, int64(len(data)))
+	cmd := common.SetRequest{Key: []byte("foo"), Exptime: 100}
+
+	if err := h.writeChunk(cmd, 0, md, r); err != nil {
+		t.Fatalf("Error writing chunk: %v", err)
+	}
+	h.rw.Flush()
+
+	req, reqType, _, err := binprot.NewBinaryParser(bufio.NewReader(buf)).Parse()
+	if err != nil || reqType != common.RequestSet {
+		t.Fatalf("Expected a set, got %v and %v", reqType, err)
+	}
+	set := req.(common.SetRequest)
+	if !bytes.Equal(set.Key, dedupKey(md.Hashes[0])) {
+		t.Fatalf("Expected the chunk to be stored under its hash, got %q", set.Key)
+	}
+	if set.Exptime != 0 {
+		t.Fatalf("Expected a shared chunk not to expire, got %d", set.Exptime)
+	}
+	if !bytes.Equal(set.Data[:tokenSize], md.Hashes[0][:]) || !bytes.Equal(set.Data[tokenSize:], data) {
+		t.Fatalf("Expected the hash and the data, got %q", set.Data)
+	}
+}
+
+func TestReleaseRefs(t *testing.T) {
+	hashes := hashChunks([]byte("0123456789abcdef0123"), 10)
+
+	responses := &bytes.Buffer{}
+	w := bufio.NewWriter(responses)
+	res := binprot.NewBinaryResponder(w)
+	// The first chunk isn't used any more, the second still is
+	res.Decr(0, 0, false)
+	res.Decr(0, 2, false)
+	res.Delete(0, false)
+	res.Delete(0, false)
+	w.Flush()
+
+	written := &bytes.Buffer{}
+	h := Handler{rw: bufio.NewReadWriter(bufio.NewReader(responses), bufio.NewWriter(written))}
+
+	if err := h.releaseRefs(hashes); err != nil {
+		t.Fatalf("Error releasing chunks: %v", err)
+	}
+	if responses.Len() != 0 || h.rw.Reader.Buffered() != 0 {
+		t.Fatalf("Expected every response to be read")
+	}
+
+	p := binprot.NewBinaryParser(bufio.NewReader(written))
+	for _, expected := range []struct {
+		reqType common.RequestType
+		key     []byte
+	}{
+		{common.RequestDecr, refsKey(hashes[0])},
+		{common.RequestDecr, refsKey(hashes[1])},
+		{common.RequestDelete, refsKey(hashes[0])},
+		{common.RequestDelete, dedupKey(hashes[0])},
+	} {
+		req, reqType, _, err := p.Parse()
+		if err != nil || reqType != expected.reqType {
+			t.Fatalf("Expected a %v, got %v and %v", expected.reqType, reqType, err)
+		}
+		var key []byte
+		switch r := req.(type) {
+		case common.IncrDecrRequest:
+			key = r.Key
+		case common.DeleteRequest:
+			key = r.Key
+		}
+		if !bytes.Equal(key, expected.key) {
+			t.Fatalf("Expected %s, got %s", expected.key, key)
+		}
+	}
+}
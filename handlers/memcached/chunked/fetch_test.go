@@ -0,0 +1,65 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFetchChunksParallel(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	md := metadata{Length: uint32(len(data)), NumChunks: 5, ChunkSize: 8}
+	copy(md.Token[:], "0123456789abcdef")
+
+	var chunks [][]byte
+	for i := 0; i < len(data); i += 8 {
+		chunks = append(chunks, data[i:i+8])
+	}
+
+	conn := func(chunks [][]byte) *bufio.ReadWriter {
+		return bufio.NewReadWriter(streamResponses(md, chunks), bufio.NewWriter(ioutil.Discard))
+	}
+
+	// Two connections split the five chunks into runs of three and two
+	h := Handler{
+		rw:       conn(chunks[:3]),
+		fetchers: []*bufio.ReadWriter{conn(chunks[3:])},
+		fetchMin: 2,
+	}
+
+	dataBuf := make([]byte, len(data))
+	miss, err := h.fetchChunks([]byte("foo"), md, dataBuf)
+	if err != nil || miss {
+		t.Fatalf("Expected a hit, got miss %v and %v", miss, err)
+	}
+	if !bytes.Equal(dataBuf, data) {
+		t.Fatalf("Expected %q, got %q", data, dataBuf)
+	}
+
+	// A quiet get for a missing chunk sends nothing back
+	h = Handler{
+		rw:       conn(chunks[:3]),
+		fetchers: []*bufio.ReadWriter{conn(chunks[4:])},
+		fetchMin: 2,
+	}
+
+	miss, err = h.fetchChunks([]byte("foo"), md, make([]byte, len(data)))
+	if err != nil || !miss {
+		t.Fatalf("Expected a miss, got miss %v and %v", miss, err)
+	}
+}
@@ -17,8 +17,11 @@ package chunked
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/hongst/rend/binprot"
@@ -31,6 +34,9 @@ var (
 	MetricCmdSetErrorsOOML1 = metrics.AddCounter("cmd_set_errors_oom_l1", nil)
 	MetricCmdSetErrorsOOML2 = metrics.AddCounter("cmd_set_errors_oom_l2", nil)
 
+	MetricCmdSetPartialCleanup       = metrics.AddCounter("cmd_set_partial_cleanup", nil)
+	MetricCmdSetPartialCleanupErrors = metrics.AddCounter("cmd_set_partial_cleanup_errors", nil)
+
 	MetricCmdTouchMissesMeta    = metrics.AddCounter("cmd_touch_misses_meta", nil)
 	MetricCmdTouchMissesMetaL1  = metrics.AddCounter("cmd_touch_misses_meta_l1", nil)
 	MetricCmdTouchMissesMetaL2  = metrics.AddCounter("cmd_touch_misses_meta_l2", nil)
@@ -75,6 +81,11 @@ var (
 	MetricCmdGatMissesTokenL1 = metrics.AddCounter("cmd_gat_misses_token_l1", nil)
 	MetricCmdGatMissesTokenL2 = metrics.AddCounter("cmd_gat_misses_token_l2", nil)
 
+	MetricCmdGatMetaSet          = metrics.AddCounter("cmd_gat_meta_set", nil)
+	MetricCmdGatMetaSetErrors    = metrics.AddCounter("cmd_gat_meta_set_errors", nil)
+	MetricCmdGatMetaSetSuccesses = metrics.AddCounter("cmd_gat_meta_set_successes", nil)
+	MetricCmdGatMetaSetRaces     = metrics.AddCounter("cmd_gat_meta_set_races", nil)
+
 	MetricCmdAppendMissesMeta    = metrics.AddCounter("cmd_append_misses_meta", nil)
 	MetricCmdAppendMissesMetaL1  = metrics.AddCounter("cmd_append_misses_meta_l1", nil)
 	MetricCmdAppendMissesMetaL2  = metrics.AddCounter("cmd_append_misses_meta_l2", nil)
@@ -85,6 +96,10 @@ var (
 	MetricCmdAppendMissesTokenL1 = metrics.AddCounter("cmd_append_misses_token_l1", nil)
 	MetricCmdAppendMissesTokenL2 = metrics.AddCounter("cmd_append_misses_token_l2", nil)
 
+	MetricCmdAppendInPlace = metrics.AddCounter("cmd_append_in_place", nil)
+
+	MetricChunkChecksumMismatches = metrics.AddCounter("chunked_checksum_mismatches", nil)
+
 	MetricCmdPrependMissesMeta    = metrics.AddCounter("cmd_prepend_misses_meta", nil)
 	MetricCmdPrependMissesMetaL1  = metrics.AddCounter("cmd_prepend_misses_meta_l1", nil)
 	MetricCmdPrependMissesMetaL2  = metrics.AddCounter("cmd_prepend_misses_meta_l2", nil)
@@ -94,6 +109,14 @@ var (
 	MetricCmdPrependMissesToken   = metrics.AddCounter("cmd_prepend_misses_token", nil)
 	MetricCmdPrependMissesTokenL1 = metrics.AddCounter("cmd_prepend_misses_token_l1", nil)
 	MetricCmdPrependMissesTokenL2 = metrics.AddCounter("cmd_prepend_misses_token_l2", nil)
+
+	MetricCmdGetStreamed      = metrics.AddCounter("cmd_get_streamed", nil)
+	MetricCmdSetStreamed      = metrics.AddCounter("cmd_set_streamed", nil)
+	MetricCmdGetParallel      = metrics.AddCounter("cmd_get_parallel", nil)
+	MetricCmdGetStreamAborted = metrics.AddCounter("cmd_get_stream_aborted", nil)
+
+	MetricCmdSetDedup      = metrics.AddCounter("cmd_set_dedup", nil)
+	MetricDedupChunksFreed = metrics.AddCounter("chunked_dedup_chunks_freed", nil)
 )
 
 func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
@@ -114,14 +137,141 @@ func readResponseHeader(r *bufio.Reader) (binprot.ResponseHeader, error) {
 type Handler struct {
 	rw   *bufio.ReadWriter
 	conn io.ReadWriteCloser
+	// pipelined sends all of the chunks of a set before reading any of the responses
+	pipelined bool
+	// chunkMaxSize is the size of a whole chunk item in memcached for new sets
+	chunkMaxSize int
+	// adaptiveMax is the largest chunk size an item can get when chunk sizes are picked per item.
+	// Zero means every item uses chunkMaxSize.
+	adaptiveMax int
+	// codec compresses new items of at least compressMin bytes. Nil means no compression.
+	codec       Codec
+	compressMin int
+	// keyring, if set, encrypts new items and decrypts encrypted ones
+	keyring *Keyring
+	// checksums adds a checksum to each chunk of new items
+	checksums bool
+	// streamMin is the length from which hits are streamed when the request allows it. Zero means
+	// values are never streamed.
+	streamMin int
+	// fetchers are more connections to the same memcached. The chunks of items with at least
+	// fetchMin chunks are fetched over all of them and rw at once.
+	fetchers   []*bufio.ReadWriter
+	fetchConns []io.ReadWriteCloser
+	fetchMin   int
+	// dedup stores the chunks of new items under the hashes of their content so they are shared
+	dedup bool
 }
 
 func NewHandler(conn io.ReadWriteCloser) Handler {
 	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 	return Handler{
-		rw:   rw,
-		conn: conn,
+		rw:           rw,
+		conn:         conn,
+		chunkMaxSize: DefaultChunkSize,
+	}
+}
+
+// NewPipelinedHandler creates a handler that writes all the chunks of a set in one flush and
+// then reads all of the responses, instead of waiting for each chunk's response before sending
+// the next. This saves a round trip to memcached per chunk on large values. The responses to
+// chunk sets are small, so memcached will not block on writing them while the chunks are sent.
+func NewPipelinedHandler(conn io.ReadWriteCloser) Handler {
+	h := NewHandler(conn)
+	h.pipelined = true
+	return h
+}
+
+// WithChunkSize returns a copy of the handler that splits new items into chunks that take up size
+// bytes in memcached, including memcached's own overhead. It should be the chunk size of the slab
+// class the chunks are meant to go in. Items keep the chunk size they were stored with, so
+// existing items are still read correctly after a change. Sizes below MinChunkSize are raised
+// to it.
+func (h Handler) WithChunkSize(size int) Handler {
+	if size < MinChunkSize {
+		size = MinChunkSize
+	}
+	h.chunkMaxSize = size
+	return h
+}
+
+// WithAdaptiveChunks returns a copy of the handler that picks the chunk size of each new item from
+// its length instead of always using the same one, so that mid-sized items take one chunk and
+// large ones take fewer, bigger chunks. The sizes start at the handler's chunk size and grow by
+// memcached's default slab growth factor of 1.25 up to max, so the chunks still land in a small
+// set of slab classes. An item gets the smallest size that holds it in one chunk, or chunks of
+// the largest size if none does. Max should be no more than memcached's slab chunk max.
+func (h Handler) WithAdaptiveChunks(max int) Handler {
+	h.adaptiveMax = max
+	return h
+}
+
+// WithCompression returns a copy of the handler that compresses the values of new items of at
+// least min bytes with the codec before splitting them into chunks. Values that don't get smaller
+// are stored as they are. Compressed items are decompressed on reads no matter which codec the
+// handler uses, as long as theirs is registered.
+func (h Handler) WithCompression(c Codec, min int) Handler {
+	h.codec = c
+	h.compressMin = min
+	return h
+}
+
+// WithEncryption returns a copy of the handler that encrypts the values of new items with the
+// current key in the keyring, after compression and before they are split into chunks. Items
+// encrypted with any key in the keyring can be read. Items that aren't encrypted are still read
+// as they are, so encryption can be turned on for a cache that already has data in it.
+func (h Handler) WithEncryption(k *Keyring) Handler {
+	h.keyring = k
+	return h
+}
+
+// WithChecksums returns a copy of the handler that ends each chunk of new items with a CRC-32 of
+// the chunk. Reads check it, so a chunk that was corrupted in memcached makes the item a miss
+// instead of returning bad data. Each chunk holds 4 bytes less data. Items without checksums are
+// still read as they are.
+func (h Handler) WithChecksums() Handler {
+	h.checksums = true
+	return h
+}
+
+// WithStreaming returns a copy of the handler that streams hits of at least min bytes to requests
+// that allow it, one chunk at a time, instead of reading the whole value first. The first chunk is
+// read before the response goes out so an item whose chunks were all evicted is still a miss, but
+// any later chunk that is missing or bad aborts the stream. Compressed and encrypted items are
+// always read whole.
+func (h Handler) WithStreaming(min int) Handler {
+	h.streamMin = min
+	return h
+}
+
+// WithParallelFetch returns a copy of the handler that fetches the chunks of items with at least
+// min chunks over conns as well as its own connection, all at the same time, and puts them back
+// together in order. The conns must be to the same memcached and are closed with the handler.
+func (h Handler) WithParallelFetch(conns []io.ReadWriteCloser, min int) Handler {
+	h.fetchers = make([]*bufio.ReadWriter, len(conns))
+	for i, conn := range conns {
+		h.fetchers[i] = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	}
+	h.fetchConns = conns
+	h.fetchMin = min
+	return h
+}
+
+// WithDedup returns a copy of the handler that stores the chunks of new items under a hash of their
+// content, so items with the same data share their chunks. Shared chunks are reference counted and
+// freed when the last item using them is deleted or overwritten. See dedup.go for the details.
+func (h Handler) WithDedup() Handler {
+	h.dedup = true
+	return h
+}
+
+// decode turns the data of an item as stored back into the value that was set
+func (h Handler) decode(key []byte, md metadata, data []byte) ([]byte, error) {
+	data, err := h.decrypt(key, md, data)
+	if err != nil {
+		return nil, err
 	}
+	return decompress(md, data)
 }
 
 func (h Handler) reset() {
@@ -132,7 +282,13 @@ func (h Handler) reset() {
 // Closes the Handler's underlying io.ReadWriteCloser.
 // Any calls to the handler after a Close() are invalid.
 func (h Handler) Close() error {
-	return h.conn.Close()
+	err := h.conn.Close()
+	for _, conn := range h.fetchConns {
+		if cerr := conn.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 func (h Handler) Set(cmd common.SetRequest) error {
@@ -148,10 +304,11 @@ func (h Handler) Replace(cmd common.SetRequest) error {
 }
 
 const (
-	// TODO: Make configurable at command line
-	// might be a constructor argument
-	// Slab 12, ~1KB per chunk
-	chunkMaxSize = 1184
+	// DefaultChunkSize fits chunks in slab 12, ~1KB per chunk
+	DefaultChunkSize = 1184
+
+	// MinChunkSize leaves room for some data next to the longest key and the token in a chunk
+	MinChunkSize = 512
 
 	// Format of headers in memcached:
 	//
@@ -171,9 +328,28 @@ const (
 	chunkOverhead = 67 + 4
 )
 
-func chunkSize(keylen int) (dataSize, fullSize uint32) {
-	fullSize = uint32(chunkMaxSize - chunkOverhead - keylen)
-	dataSize = fullSize - tokenSize
+// slabGrowthFactor is memcached's default -f, the ratio between the chunk sizes of slab classes
+const slabGrowthFactor = 1.25
+
+func (h Handler) chunkSize(keylen, length int) (dataSize, fullSize uint32) {
+	perChunk := tokenSize
+	if h.checksums {
+		perChunk += checksumSize
+	}
+
+	size := h.chunkMaxSize
+	for size-chunkOverhead-keylen-perChunk < length {
+		// memcached aligns chunk sizes to 8 bytes
+		next := int(float64(size) * slabGrowthFactor)
+		next += (8 - next%8) % 8
+		if next > h.adaptiveMax {
+			break
+		}
+		size = next
+	}
+
+	fullSize = uint32(size - chunkOverhead - keylen)
+	dataSize = fullSize - uint32(perChunk)
 	return
 }
 
@@ -205,90 +381,126 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 		return nil
 	}
 
+	// A streamed value is split into chunks as it is read from the client, unless it has to be
+	// compressed or encrypted as a whole first or its chunks need to be hashed before they are
+	// written
+	if cmd.Stream != nil && (h.codec != nil || h.keyring != nil || h.dedup) {
+		var err error
+		if cmd, err = common.BufferValue(cmd); err != nil {
+			return err
+		}
+	}
+
+	var src io.Reader
+	var data []byte
+	var length int
+	var codec, ciph uint8
+	var keyVersion uint16
+	if cmd.Stream != nil {
+		src, length = cmd.Stream, cmd.Length
+		metrics.IncCounter(MetricCmdSetStreamed)
+	} else {
+		var c, ci uint8
+		var kv uint16
+		var err error
+		data, c = h.compress(cmd.Data)
+		if data, ci, kv, err = h.encrypt(cmd.Key, data); err != nil {
+			return err
+		}
+		src, length = bytes.NewBuffer(data), len(data)
+		codec, ciph, keyVersion = c, ci, kv
+	}
+
+	keyLen := len(cmd.Key)
+	if h.dedup {
+		keyLen = dedupKeyLen
+	}
+
 	// Specialized chunk reader to make the code here much simpler
-	dataSize, fullSize := chunkSize(len(cmd.Key))
-	limChunkReader := newChunkLimitedReader(bytes.NewBuffer(cmd.Data), int64(dataSize), int64(len(cmd.Data)))
-	numChunks := int(math.Ceil(float64(len(cmd.Data)) / float64(dataSize)))
+	dataSize, _ := h.chunkSize(keyLen, length)
+	limChunkReader := newChunkLimitedReader(src, int64(dataSize), int64(length))
+	numChunks := int(math.Ceil(float64(length) / float64(dataSize)))
 	token := <-tokens
 
-	metaKey := metaKey(cmd.Key)
 	metaData := metadata{
-		Length:    uint32(len(cmd.Data)),
-		OrigFlags: cmd.Flags,
-		NumChunks: uint32(numChunks),
-		ChunkSize: dataSize,
-		Token:     token,
-		Instime:   uint32(time.Now().Unix()),
-		Exptime:   exp,
+		Length:     uint32(length),
+		OrigFlags:  cmd.Flags,
+		NumChunks:  uint32(numChunks),
+		ChunkSize:  dataSize,
+		Token:      token,
+		Instime:    uint32(time.Now().Unix()),
+		Exptime:    exp,
+		Codec:      codec,
+		Cipher:     ciph,
+		KeyVersion: keyVersion,
+		Checksums:  h.checksums,
 	}
 
-	// Write metadata key
-	// TODO: should there be a unique flags value for chunked data?
-	switch reqType {
-	case common.RequestSet:
-		if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize); err != nil {
-			return err
-		}
-	case common.RequestAdd:
-		if err := binprot.WriteAddCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize); err != nil {
-			return err
+	if h.dedup {
+		metaData.Dedup = true
+		metaData.Hashes = hashChunks(data, int(dataSize))
+		return h.storeDedup(cmd, reqType, metaData, limChunkReader)
+	}
+
+	return h.storeItem(cmd, reqType, metaData, limChunkReader)
+}
+
+// storeItem writes the chunks of an item and then its metadata. The metadata is only written once
+// memcached has the chunks, so a reader that finds it never finds chunks that are still to come.
+// Readers of the metadata of the item being replaced see a miss as soon as its chunks are
+// overwritten, since the tokens of the new chunks don't match.
+//
+// The chunks of an add, replace or set with a CAS value are stored under keys made from the token
+// of the new item instead, the same way as those of an append in place. Two of them racing for the
+// same key can't overwrite each other's chunks or those of the item in place, so the metadata
+// write decides the winner only once all of the chunks are there. The loser deletes its chunks.
+// The chunks of the item that was replaced are left to the janitor.
+func (h Handler) storeItem(cmd common.SetRequest, reqType common.RequestType, metaData metadata, limChunkReader chunkedLimitedReader) error {
+	conditional := reqType != common.RequestSet || cmd.Cas != 0
+	if conditional && !metaData.Dedup && metaData.NumChunks > 0 {
+		// The keys of these chunks are longer, so a key near the limit can't have them
+		if len(segmentChunkKey(cmd.Key, int(metaData.NumChunks)-1, metaData.Token)) > common.MaxKeyLength {
+			return common.ErrBadKey
 		}
-	case common.RequestReplace:
-		if err := binprot.WriteReplaceCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metadataSize); err != nil {
+		metaData.Segments = []segment{{Start: 0, Token: metaData.Token}}
+	}
+
+	if h.pipelined {
+		// The metadata of a conditional set waits for the responses of the chunks, since it can't
+		// be stored if one of them failed
+		if err := h.setChunksPipelined(cmd, reqType, metaData, limChunkReader, !conditional); err != nil || !conditional {
 			return err
 		}
-	default:
-		// I know. It's all wrong. By rights we shouldn't even be here. But we are.
-		panic("Unrecognized request type in realHandleSet!")
+	} else if err := h.setChunks(cmd, metaData, limChunkReader, conditional); err != nil {
+		return err
 	}
 
-	// Write value
-	writeMetadata(h.rw, metaData)
-
-	if err := h.rw.Flush(); err != nil {
+	if err := h.writeMetadataCmd(cmd, reqType, metaData); err != nil {
 		return err
 	}
 
-	// Read server's response
-	resHeader, err := readResponseHeader(h.rw.Reader)
-	if err != nil {
-		// Discard response body
-		n, ioerr := h.rw.Discard(int(resHeader.TotalBodyLength))
-		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
-		if ioerr != nil {
+	// For Add and Replace, the error here will be common.ErrKeyExists or common.ErrKeyNotFound
+	// respectively. For each, this is the right response to send to the requestor.
+	if err := simpleCmdLocal(h.rw, true); err != nil {
+		if ioerr := h.cleanupPartialSet(cmd.Key, metaData, conditional, err); ioerr != nil {
 			return ioerr
 		}
-
-		// For Add and Replace, the error here will be common.ErrKeyExists or common.ErrKeyNotFound
-		// respectively. For each, this is the right response to send to the requestor. The error
-		// here is overloaded because it would signal a true error for sets, but a normal "error"
-		// response for Add and Replace.
 		return err
 	}
 
+	return nil
+}
+
+// setChunks writes the chunks of an item one at a time, reading the response to each before
+// writing the next.
+func (h Handler) setChunks(cmd common.SetRequest, metaData metadata, limChunkReader chunkedLimitedReader, conditional bool) error {
 	// Write all the data chunks
-	// TODO: Clean up if a data chunk write fails
 	// Failure can mean the write failing at the I/O level
 	// or at the memcached level, e.g. response == ERROR
+	// Only the second kind can be cleaned up, see cleanupPartialSet
 	chunkNum := 0
 	for limChunkReader.More() {
-		// Build this chunk's key
-		key := chunkKey(cmd.Key, chunkNum)
-
-		// Write the key
-		if err := binprot.WriteSetCmd(h.rw.Writer, key, cmd.Flags, cmd.Exptime, fullSize); err != nil {
-			return err
-		}
-		// Write token
-		n, err := h.rw.Write(token[:])
-		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
-		if err != nil {
-			return err
-		}
-		// Write value
-		n2, err := io.Copy(h.rw.Writer, limChunkReader)
-		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n2))
-		if err != nil {
+		if err := h.writeChunk(cmd, chunkNum, metaData, limChunkReader); err != nil {
 			return err
 		}
 		// There's some additional overhead here calling Flush() because it causes a write() syscall
@@ -299,7 +511,7 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 		}
 
 		// Read server's response
-		resHeader, err = readResponseHeader(h.rw.Reader)
+		resHeader, err := readResponseHeader(h.rw.Reader)
 		if err != nil {
 			if err == common.ErrNoMem {
 				metrics.IncCounter(MetricCmdSetErrorsOOM)
@@ -316,6 +528,10 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 				return ioerr
 			}
 
+			if ioerr := h.cleanupPartialSet(cmd.Key, metaData, conditional, err); ioerr != nil {
+				return ioerr
+			}
+
 			return err
 		}
 
@@ -327,8 +543,187 @@ func (h Handler) handleSetCommon(cmd common.SetRequest, reqType common.RequestTy
 	return nil
 }
 
+// writeMetadataCmd writes the command that stores the metadata of an item without flushing it. The
+// meta key is built here because building the chunk keys may have reused the same backing array.
+func (h Handler) writeMetadataCmd(cmd common.SetRequest, reqType common.RequestType, metaData metadata) error {
+	metaKey := metaKey(cmd.Key)
+
+	// TODO: should there be a unique flags value for chunked data?
+	switch reqType {
+	case common.RequestSet:
+		if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metaData.size(), cmd.Cas); err != nil {
+			return err
+		}
+	case common.RequestAdd:
+		if err := binprot.WriteAddCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metaData.size(), cmd.Cas); err != nil {
+			return err
+		}
+	case common.RequestReplace:
+		if err := binprot.WriteReplaceCmd(h.rw.Writer, metaKey, cmd.Flags, cmd.Exptime, metaData.size(), cmd.Cas); err != nil {
+			return err
+		}
+	default:
+		// I know. It's all wrong. By rights we shouldn't even be here. But we are.
+		panic("Unrecognized request type in realHandleSet!")
+	}
+
+	return writeMetadata(h.rw, metaData)
+}
+
+// writeChunk writes the set command for one chunk of the value without flushing it. Only the
+// data left for the chunk is stored, so the last chunk is usually shorter than the rest.
+func (h Handler) writeChunk(cmd common.SetRequest, chunkNum int, md metadata, r chunkedLimitedReader) error {
+	// Build this chunk's key
+	key := md.chunkKey(cmd.Key, chunkNum)
+	token := md.chunkToken(chunkNum)
+	size := tokenSize + uint32(r.ChunkLen()) + md.chunkTrailer()
+
+	// Write the key
+	if err := binprot.WriteSetCmd(h.rw.Writer, key, cmd.Flags, md.chunkExptime(cmd.Exptime), size, 0); err != nil {
+		return err
+	}
+	// Write token
+	n, err := h.rw.Write(token)
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	if !md.Checksums {
+		// Write value
+		n2, err := io.Copy(h.rw.Writer, r)
+		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n2))
+		return err
+	}
+
+	// Write value and its checksum
+	crc := crc32.NewIEEE()
+	crc.Write(token)
+	n2, err := io.Copy(h.rw.Writer, io.TeeReader(r, crc))
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n2))
+	if err != nil {
+		return err
+	}
+
+	sum := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(sum, crc.Sum32())
+	n, err = h.rw.Write(sum)
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+	return err
+}
+
+// setChunksPipelined writes all of the chunks and then, if withMeta is set, the metadata in one
+// flush and then reads the responses. memcached handles the commands of a connection in order, so
+// the chunks are stored before the metadata is. Every response is read even after one fails so the
+// connection stays in sync.
+func (h Handler) setChunksPipelined(cmd common.SetRequest, reqType common.RequestType, md metadata, r chunkedLimitedReader, withMeta bool) error {
+	responses := 0
+	for chunkNum := 0; r.More(); chunkNum++ {
+		if err := h.writeChunk(cmd, chunkNum, md, r); err != nil {
+			return err
+		}
+		r.NextChunk()
+		responses++
+	}
+
+	if withMeta {
+		if err := h.writeMetadataCmd(cmd, reqType, md); err != nil {
+			return err
+		}
+		responses++
+	}
+
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+
+	var ret error
+	for i := 0; i < responses; i++ {
+		err := simpleCmdLocal(h.rw, false)
+		if err == nil {
+			continue
+		}
+		if !common.IsAppError(err) {
+			return err
+		}
+		if err == common.ErrNoMem {
+			metrics.IncCounter(MetricCmdSetErrorsOOM)
+		}
+		if ret == nil {
+			ret = err
+		}
+	}
+
+	if ret != nil {
+		if ioerr := h.cleanupPartialSet(cmd.Key, md, !withMeta, ret); ioerr != nil {
+			return ioerr
+		}
+	}
+
+	return ret
+}
+
+// cleanupPartialSet handles a set that memcached refused part way, either one of the chunks or
+// the metadata. For a plain set, whatever metadata is stored for the key now points at a partial
+// set of chunks, whether it is that of the item being replaced or the new metadata, written after
+// a failed chunk when pipelining. It is deleted along with all of the chunks so readers see a clean
+// miss instead of a broken item and the chunks that did get written don't take up memory until
+// they are evicted. The deletes are sent together and every response is read. The error of the set
+// is returned as-is by the callers so the orca can decide whether to retry. Only an I/O error is
+// returned from here. Nothing can be cleaned up after one, so an I/O error from the set itself is
+// left alone. The chunks of an add, replace or CAS set are under keys of their own and its
+// metadata is only written after them, so those are deleted and the metadata is left to whichever
+// item has the key.
+func (h Handler) cleanupPartialSet(key []byte, md metadata, conditional bool, err error) error {
+	if !common.IsAppError(err) {
+		return nil
+	}
+
+	if conditional {
+		var keys [][]byte
+		for i := 0; i < md.ownedChunks(); i++ {
+			keys = append(keys, md.chunkKey(key, i))
+		}
+		return h.deleteChunkKeys(keys)
+	}
+
+	metrics.IncCounter(MetricCmdSetPartialCleanup)
+	numChunks := md.ownedChunks()
+
+	// The metadata goes first so no reader finds it while its chunks are being deleted. Its key
+	// is rebuilt because writing the chunks may have reused the same backing array, and it is
+	// copied into the buffer before building the chunk keys can do that again.
+	if ioerr := binprot.WriteDeleteCmd(h.rw.Writer, metaKey(key), 0); ioerr != nil {
+		return ioerr
+	}
+	for i := 0; i < numChunks; i++ {
+		if ioerr := binprot.WriteDeleteCmd(h.rw.Writer, chunkKey(key, i), 0); ioerr != nil {
+			return ioerr
+		}
+	}
+	if ioerr := h.rw.Flush(); ioerr != nil {
+		return ioerr
+	}
+
+	failed := false
+	for i := 0; i <= numChunks; i++ {
+		if ioerr := simpleCmdLocal(h.rw, false); ioerr != nil {
+			if !common.IsAppError(ioerr) {
+				return ioerr
+			}
+			if ioerr != common.ErrKeyNotFound {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		metrics.IncCounter(MetricCmdSetPartialCleanupErrors)
+	}
+	return nil
+}
+
 func (h Handler) Append(cmd common.SetRequest) error {
-	return h.handleAppendPrependCommon(cmd, common.RequestAppend)
+	return h.handleAppendInPlace(cmd)
 }
 
 func (h Handler) Prepend(cmd common.SetRequest) error {
@@ -361,11 +756,17 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 		return err
 	}
 
+	// Fail fast on a CAS mismatch instead of reading in all the data first. The CAS is passed
+	// along with the new metadata below as well in case the item changes in the meantime.
+	if cmd.Cas != 0 && cmd.Cas != metaData.CAS {
+		return common.ErrKeyExists
+	}
+
 	// Write all the get commands before reading
 	cmdSize := int(metaData.NumChunks)*(len(cmd.Key)+4 /* key suffix */ +binprot.ReqHeaderLen) + binprot.ReqHeaderLen /* for the noop */
 	cmdbuf := bytes.NewBuffer(make([]byte, 0, cmdSize))
 	for i := 0; i < int(metaData.NumChunks); i++ {
-		chunkKey := chunkKey(cmd.Key, i)
+		chunkKey := metaData.chunkKey(cmd.Key, i)
 		binprot.WriteGetQCmd(cmdbuf, chunkKey)
 	}
 	binprot.WriteNoopCmd(cmdbuf)
@@ -391,7 +792,7 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 	var lastErr error
 
 	for {
-		opcodeNoop, err := getLocalIntoBuf(h.rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
+		opcodeNoop, err := getLocalIntoBuf(h.rw.Reader, metaData, tokenBuf, dataBuf, chunk)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				if !miss {
@@ -413,7 +814,7 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 			break
 		}
 
-		if !bytes.Equal(metaData.Token[:], tokenBuf) {
+		if !bytes.Equal(metaData.chunkToken(chunk), tokenBuf) {
 			if !miss {
 				switch reqType {
 				case common.RequestAppend:
@@ -436,6 +837,12 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 		return common.ErrKeyNotFound
 	}
 
+	// A value that can't be decrypted or decompressed is as good as gone
+	dataBuf, err = h.decode(cmd.Key, metaData, dataBuf)
+	if err != nil {
+		return common.ErrKeyNotFound
+	}
+
 	// append or prepend, the meat of the request
 	if reqType == common.RequestAppend {
 		dataBuf = append(dataBuf, cmd.Data...)
@@ -449,25 +856,221 @@ func (h Handler) handleAppendPrependCommon(cmd common.SetRequest, reqType common
 		Data:    dataBuf,
 		Flags:   metaData.OrigFlags,
 		Exptime: metaData.Exptime,
+		Cas:     cmd.Cas,
 	}
 	return h.handleSetCommon(setcmd, common.RequestSet)
 }
 
+// maxSegments is how many segments appends in place can leave on an item. The next append
+// rewrites the whole value as one new item instead, which has none.
+const maxSegments = 16
+
+// handleAppendInPlace appends to a chunked item without reading and rewriting the whole value.
+// Only the last chunk is read back. It is written again with the start of the new data, and any
+// overflow goes into new chunks after it, all as a new segment with a fresh token under keys made
+// from that token. Nothing the current metadata points at is overwritten: readers of it still see
+// the old value, and the chunks of racing appends can't mix. The metadata is then switched to the
+// new segment with a CAS, so only one of the racing appends wins. The loser deletes its chunks and,
+// unless the client gave a CAS, starts over by rewriting the whole value. The chunk that was
+// replaced is deleted once the metadata no longer points at it.
+func (h Handler) handleAppendInPlace(cmd common.SetRequest) error {
+	_, metaData, err := getMetadata(h.rw, cmd.Key)
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdAppendMissesMeta)
+		}
+		return err
+	}
+
+	if cmd.Cas != 0 && cmd.Cas != metaData.CAS {
+		return common.ErrKeyExists
+	}
+
+	// The end of compressed or encrypted data can't be extended and the last chunk of a
+	// deduplicated item may be shared, so the whole value is rewritten instead
+	if metaData.Codec != 0 || metaData.Cipher != 0 || metaData.Dedup {
+		return h.handleAppendPrependCommon(cmd, common.RequestAppend)
+	}
+
+	// So is one that has been appended to many times already. The rewritten item has no
+	// segments, so the chunks of the old ones can go.
+	if len(metaData.Segments) >= maxSegments {
+		if err := h.handleAppendPrependCommon(cmd, common.RequestAppend); err != nil {
+			return err
+		}
+		var keys [][]byte
+		for i := int(metaData.Segments[0].Start); i < int(metaData.NumChunks); i++ {
+			keys = append(keys, metaData.chunkKey(cmd.Key, i))
+		}
+		return h.deleteChunkKeys(keys)
+	}
+
+	// An empty value has no last chunk to extend, so the appended data is the whole new value.
+	if metaData.NumChunks == 0 {
+		return h.handleSetCommon(common.SetRequest{
+			Key:     cmd.Key,
+			Data:    cmd.Data,
+			Flags:   metaData.OrigFlags,
+			Exptime: metaData.Exptime,
+			Cas:     metaData.CAS,
+		}, common.RequestSet)
+	}
+
+	lastChunk := int(metaData.NumChunks) - 1
+	length := metaData.Length + uint32(len(cmd.Data))
+	numChunks := (length + metaData.ChunkSize - 1) / metaData.ChunkSize
+
+	// The keys of the new chunks are longer, so a key near the limit can't have them
+	if len(segmentChunkKey(cmd.Key, int(numChunks)-1, [tokenSize]byte{})) > common.MaxKeyLength {
+		return h.handleAppendPrependCommon(cmd, common.RequestAppend)
+	}
+
+	// Read in the last chunk. Treating it as a one chunk value lets getLocalIntoBuf read it
+	// straight into a buffer of the right size.
+	tailMeta := metaData
+	tailMeta.Length = metaData.Length - metaData.ChunkSize*uint32(lastChunk)
+	oldKey := metaData.chunkKey(cmd.Key, lastChunk)
+
+	if err := binprot.WriteGetCmd(h.rw.Writer, oldKey); err != nil {
+		return err
+	}
+	if err := h.rw.Flush(); err != nil {
+		return err
+	}
+
+	tail := make([]byte, int(tailMeta.Length), int(tailMeta.Length)+len(cmd.Data))
+	tokenBuf := make([]byte, tokenSize)
+
+	if _, err := getLocalIntoBuf(h.rw.Reader, tailMeta, tokenBuf, tail, 0); err != nil {
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdAppendMissesChunk)
+		}
+		return err
+	}
+
+	if !bytes.Equal(metaData.chunkToken(lastChunk), tokenBuf) {
+		metrics.IncCounter(MetricCmdAppendMissesToken)
+		return common.ErrKeyNotFound
+	}
+
+	tail = append(tail, cmd.Data...)
+
+	// The new segment starts at the last chunk and replaces any segment that started there. Its
+	// token has to make a different key than the chunk it replaces.
+	token := <-tokens
+	for bytes.Equal(token[:segmentKeyToken], metaData.chunkToken(lastChunk)[:segmentKeyToken]) {
+		token = <-tokens
+	}
+
+	newMeta := metaData
+	newMeta.Segments = nil
+	for _, seg := range metaData.Segments {
+		if int(seg.Start) < lastChunk {
+			newMeta.Segments = append(newMeta.Segments, seg)
+		}
+	}
+	newMeta.Segments = append(newMeta.Segments, segment{Start: uint32(lastChunk), Token: token})
+	newMeta.Length = length
+	newMeta.NumChunks = numChunks
+	newMeta.Instime = uint32(time.Now().Unix())
+
+	// Write the new last chunk and any after it
+	limChunkReader := newChunkLimitedReader(bytes.NewBuffer(tail), int64(metaData.ChunkSize), int64(len(tail)))
+	chunkNum := lastChunk
+	chunkCmd := common.SetRequest{
+		Key:     cmd.Key,
+		Flags:   metaData.OrigFlags,
+		Exptime: metaData.Exptime,
+	}
+
+	var written [][]byte
+	for limChunkReader.More() {
+		if err := h.writeChunk(chunkCmd, chunkNum, newMeta, limChunkReader); err != nil {
+			return err
+		}
+		if err := simpleCmdLocal(h.rw, true); err != nil {
+			if common.IsAppError(err) {
+				if ioerr := h.deleteChunkKeys(written); ioerr != nil {
+					return ioerr
+				}
+			}
+			return err
+		}
+		written = append(written, newMeta.chunkKey(cmd.Key, chunkNum))
+
+		limChunkReader.NextChunk()
+		chunkNum++
+	}
+
+	// Now point the metadata at the new segment. The CAS makes sure the item wasn't replaced or
+	// appended to while the chunks were being written. The meta key is rebuilt here because
+	// building the chunk keys may have reused the same backing array.
+	if err := binprot.WriteSetCmd(h.rw.Writer, metaKey(cmd.Key), newMeta.OrigFlags, newMeta.Exptime, newMeta.size(), metaData.CAS); err != nil {
+		return err
+	}
+	if err := writeMetadata(h.rw, newMeta); err != nil {
+		return err
+	}
+	if err := simpleCmdLocal(h.rw, true); err != nil {
+		if !common.IsAppError(err) {
+			return err
+		}
+		if ioerr := h.deleteChunkKeys(written); ioerr != nil {
+			return ioerr
+		}
+		if err == common.ErrKeyExists && cmd.Cas == 0 {
+			return h.handleAppendPrependCommon(cmd, common.RequestAppend)
+		}
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdAppendInPlace)
+
+	// The replaced chunk is only in the way now
+	return h.deleteChunkKeys([][]byte{oldKey})
+}
+
+// deleteChunkKeys deletes chunks that no metadata points at. The deletes are sent together and
+// every response is read. Chunks that are already gone or can't be deleted are left to the
+// janitor, so only an I/O error is returned.
+func (h Handler) deleteChunkKeys(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		if ioerr := binprot.WriteDeleteCmd(h.rw.Writer, key, 0); ioerr != nil {
+			return ioerr
+		}
+	}
+	if ioerr := h.rw.Flush(); ioerr != nil {
+		return ioerr
+	}
+
+	for range keys {
+		if ioerr := simpleCmdLocal(h.rw, false); ioerr != nil && !common.IsAppError(ioerr) {
+			return ioerr
+		}
+	}
+	return nil
+}
+
 func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
 	// No buffering here so there's not multiple gets in memory
 	dataOut := make(chan common.GetResponse)
 	errorOut := make(chan error)
-	go realHandleGet(cmd, dataOut, errorOut, h.rw)
+	go h.realHandleGet(cmd, dataOut, errorOut)
 	return dataOut, errorOut
 }
 
-func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error, rw *bufio.ReadWriter) {
+func (h Handler) realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error) {
 	// read index
 	// make buf
 	// for numChunks do
 	//   read chunk directly into buffer
 	// send response
 
+	rw := h.rw
 	defer close(errorOut)
 	defer close(dataOut)
 
@@ -496,98 +1099,284 @@ outer:
 
 		missResponse.Flags = metaData.OrigFlags
 
-		cmdSize := int(metaData.NumChunks)*(len(key)+4 /* key suffix */ +binprot.ReqHeaderLen) + binprot.ReqHeaderLen /* for the noop */
-		cmdbuf := bytes.NewBuffer(make([]byte, 0, cmdSize))
-		// Write all the get commands before reading
-		for i := 0; i < int(metaData.NumChunks); i++ {
-			chunkKey := chunkKey(key, i)
-			// bytes.Buffer doesn't error
-			binprot.WriteGetQCmd(cmdbuf, chunkKey)
-		}
+		// Streamed items use Get instead of GetQ so a missing chunk sends back a miss in its
+		// place instead of nothing, and the chunks that do come back can be trusted to be in order.
+		stream := cmd.Stream && h.streamMin > 0 && int(metaData.Length) >= h.streamMin &&
+			metaData.Codec == 0 && metaData.Cipher == 0
 
-		// The final command must be Get or Noop to guarantee a response
-		// We use Noop to make coding easier, but it's (very) slightly less efficient
-		// since we send 24 extra bytes in each direction
-		// bytes.Buffer doesn't error
-		binprot.WriteNoopCmd(cmdbuf)
+		if stream {
+			if err := writeChunkGets(rw, key, metaData, 0, int(metaData.NumChunks), false); err != nil {
+				errorOut <- err
+				return
+			}
+			if err := streamChunks(rw.Reader, metaData, missResponse, dataOut); err != nil {
+				errorOut <- err
+				return
+			}
+			continue outer
+		}
 
-		// bufio's ReadFrom will end up doing an io.Copy(cmdbuf, socket), which is more
-		// efficient than writing directly into the bufio or using cmdbuf.WriteTo(rw)
-		if _, err := rw.ReadFrom(cmdbuf); err != nil {
+		dataBuf := make([]byte, metaData.Length)
+		miss, err := h.fetchChunks(key, metaData, dataBuf)
+		if err != nil {
 			errorOut <- err
 			return
 		}
+		if miss {
+			//fmt.Println("Get miss because of missing chunk")
+			dataOut <- missResponse
+			continue outer
+		}
 
-		// Flush to make sure all the get commands are sent to the server.
-		if err := rw.Flush(); err != nil {
-			errorOut <- err
-			return
+		data, err := h.decode(key, metaData, dataBuf)
+		if err != nil {
+			dataOut <- missResponse
+			continue outer
 		}
 
-		dataBuf := make([]byte, metaData.Length)
-		tokenBuf := make([]byte, tokenSize)
-
-		// Now that all the headers are sent, start reading in the data chunks. We read until the
-		// header for the Noop command comes back, keeping track of how many chunks are read. This
-		// means that there is no fast fail when a chunk is missing, but at least all the data is
-		// read in so there's no problem with unread, buffered data that should have been discarded.
-		// If the number of chunks doesn't match, we throw away the data and call it a miss.
-		chunk := 0
-		miss := false
-		var lastErr error
-
-		for {
-			opcodeNoop, err := getLocalIntoBuf(rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
-			if err != nil {
-				if err == common.ErrKeyNotFound {
-					if !miss {
-						metrics.IncCounter(MetricCmdGetMissesChunk)
-						miss = true
-					}
-					continue
-				} else {
-					lastErr = err
+		dataOut <- common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  metaData.OrigFlags,
+			Cas:    metaData.CAS,
+			Key:    key,
+			Data:   data,
+		}
+	}
+}
+
+// writeChunkGets sends the gets for chunks first up to last of an item, followed by a Noop so that
+// there is always a response to read up to. Quiet gets send nothing back for missing chunks.
+func writeChunkGets(rw *bufio.ReadWriter, key []byte, metaData metadata, first, last int, quiet bool) error {
+	cmdSize := (last-first)*(len(key)+4 /* key suffix */ +binprot.ReqHeaderLen) + binprot.ReqHeaderLen /* for the noop */
+	cmdbuf := bytes.NewBuffer(make([]byte, 0, cmdSize))
+	// Write all the get commands before reading
+	for i := first; i < last; i++ {
+		chunkKey := metaData.chunkKey(key, i)
+		// bytes.Buffer doesn't error
+		if quiet {
+			binprot.WriteGetQCmd(cmdbuf, chunkKey)
+		} else {
+			binprot.WriteGetCmd(cmdbuf, chunkKey)
+		}
+	}
+
+	// The final command must be Get or Noop to guarantee a response
+	// We use Noop to make coding easier, but it's (very) slightly less efficient
+	// since we send 24 extra bytes in each direction
+	// bytes.Buffer doesn't error
+	binprot.WriteNoopCmd(cmdbuf)
+
+	// bufio's ReadFrom will end up doing an io.Copy(cmdbuf, socket), which is more
+	// efficient than writing directly into the bufio or using cmdbuf.WriteTo(rw)
+	if _, err := rw.ReadFrom(cmdbuf); err != nil {
+		return err
+	}
+
+	// Flush to make sure all the get commands are sent to the server.
+	return rw.Flush()
+}
+
+// readChunks reads the responses to the quiet gets for chunks first up to last of an item into
+// their place in dataBuf.
+func readChunks(r *bufio.Reader, metaData metadata, dataBuf []byte, first, last int) (miss bool, err error) {
+	tokenBuf := make([]byte, tokenSize)
+
+	// Now that all the headers are sent, start reading in the data chunks. We read until the
+	// header for the Noop command comes back, keeping track of how many chunks are read. This
+	// means that there is no fast fail when a chunk is missing, but at least all the data is
+	// read in so there's no problem with unread, buffered data that should have been discarded.
+	// If the number of chunks doesn't match, we throw away the data and call it a miss.
+	chunk := first
+	var lastErr error
+
+	for {
+		opcodeNoop, err := getLocalIntoBuf(r, metaData, tokenBuf, dataBuf, chunk)
+		if err != nil {
+			if err == common.ErrKeyNotFound {
+				if !miss {
+					metrics.IncCounter(MetricCmdGetMissesChunk)
+					miss = true
 				}
+				continue
+			} else {
+				lastErr = err
 			}
+		}
 
-			if opcodeNoop {
-				break
+		if opcodeNoop {
+			break
+		}
+
+		if !bytes.Equal(metaData.chunkToken(chunk), tokenBuf) {
+			//fmt.Println(id, "Get miss because of invalid chunk token. Cmd:", cmd)
+			//fmt.Printf("Expected: %v\n", metaData.Token)
+			//fmt.Printf("Got:      %v\n", tokenBuf)
+			if !miss {
+				metrics.IncCounter(MetricCmdGetMissesToken)
+				miss = true
 			}
+		}
+
+		chunk++
+	}
+
+	if lastErr != nil {
+		return false, lastErr
+	}
+	if chunk != last && !miss {
+		metrics.IncCounter(MetricCmdGetMissesChunk)
+		miss = true
+	}
+	return miss, nil
+}
+
+// fetchChunks reads all of the chunks of an item into dataBuf. When the handler has extra
+// connections and the item has enough chunks, the chunks are split into runs, one per connection,
+// that are all fetched at the same time. Either way each connection gets one round trip.
+func (h Handler) fetchChunks(key []byte, metaData metadata, dataBuf []byte) (bool, error) {
+	numChunks := int(metaData.NumChunks)
+	if len(h.fetchers) == 0 || numChunks < h.fetchMin {
+		if err := writeChunkGets(h.rw, key, metaData, 0, numChunks, true); err != nil {
+			return false, err
+		}
+		return readChunks(h.rw.Reader, metaData, dataBuf, 0, numChunks)
+	}
+
+	metrics.IncCounter(MetricCmdGetParallel)
+
+	rws := append([]*bufio.ReadWriter{h.rw}, h.fetchers...)
+	per := (numChunks + len(rws) - 1) / len(rws)
+	misses := make([]bool, len(rws))
+	errs := make([]error, len(rws))
+
+	wg := &sync.WaitGroup{}
+	for i, rw := range rws {
+		first := i * per
+		last := first + per
+		if last > numChunks {
+			last = numChunks
+		}
+		if first >= last {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, rw *bufio.ReadWriter) {
+			defer wg.Done()
+			// Each run fills its own part of dataBuf
+			if errs[i] = writeChunkGets(rw, key, metaData, first, last, true); errs[i] == nil {
+				misses[i], errs[i] = readChunks(rw.Reader, metaData, dataBuf, first, last)
+			}
+		}(i, rw)
+	}
+	wg.Wait()
+
+	miss := false
+	for i := range rws {
+		if errs[i] != nil {
+			return false, errs[i]
+		}
+		miss = miss || misses[i]
+	}
+	return miss, nil
+}
+
+// streamChunks reads the chunks of a get hit one at a time and writes each one to a stream as
+// soon as it is read, so only one chunk of the value is held in memory. The response is sent
+// when the first chunk checks out. From then on a bad or missing chunk can't turn the hit into a
+// miss any more, so the stream fails with common.ErrStreamAborted instead. Like a buffered get,
+// everything up to the Noop is read no matter what happens so the connection stays usable. The
+// chunks must have been requested with Get rather than GetQ so that every one has a response.
+func streamChunks(r *bufio.Reader, metaData metadata, missResponse common.GetResponse, dataOut chan common.GetResponse) error {
+	chunkSize := int(metaData.ChunkSize)
+	buf := make([]byte, chunkSize)
+	tokenBuf := make([]byte, tokenSize)
 
-			if !bytes.Equal(metaData.Token[:], tokenBuf) {
-				//fmt.Println(id, "Get miss because of invalid chunk token. Cmd:", cmd)
-				//fmt.Printf("Expected: %v\n", metaData.Token)
-				//fmt.Printf("Got:      %v\n", tokenBuf)
+	var pw *io.PipeWriter
+	chunk := 0
+	miss := false
+	var lastErr error
+
+	for {
+		// Extra responses shouldn't happen, but they must not make the slicing go out of range
+		start, end := chunkSliceIndices(chunkSize, chunk, int(metaData.Length))
+		if start > end {
+			start = end
+		}
+		chunkMeta := metaData
+		chunkMeta.Length = uint32(end - start)
+
+		opcodeNoop, err := getLocalIntoBuf(r, chunkMeta, tokenBuf, buf, 0)
+		if err != nil {
+			if err == common.ErrKeyNotFound {
 				if !miss {
-					metrics.IncCounter(MetricCmdGetMissesToken)
+					metrics.IncCounter(MetricCmdGetMissesChunk)
 					miss = true
 				}
+				chunk++
+				continue
 			}
+			lastErr = err
+		}
 
-			chunk++
+		if opcodeNoop {
+			break
 		}
 
-		if lastErr != nil {
-			errorOut <- lastErr
-			return
+		if !miss && !bytes.Equal(metaData.chunkToken(chunk), tokenBuf) {
+			if !miss {
+				metrics.IncCounter(MetricCmdGetMissesToken)
+				miss = true
+			}
 		}
-		if miss {
-			//fmt.Println("Get miss because of missing chunk")
-			dataOut <- missResponse
-			continue outer
+
+		if !miss && lastErr == nil {
+			if pw == nil {
+				var pr *io.PipeReader
+				pr, pw = io.Pipe()
+				res := missResponse
+				res.Miss = false
+				res.Cas = metaData.CAS
+				res.Stream = pr
+				res.Length = int(metaData.Length)
+				dataOut <- res
+				metrics.IncCounter(MetricCmdGetStreamed)
+			}
+			// The reader always reads to the end, so this only fails after the stream is closed
+			pw.Write(buf[:end-start])
 		}
 
-		dataOut <- common.GetResponse{
-			Miss:   false,
-			Quiet:  cmd.Quiet[idx],
-			Opaque: cmd.Opaques[idx],
-			Flags:  metaData.OrigFlags,
-			Key:    key,
-			Data:   dataBuf,
+		chunk++
+	}
+
+	if chunk != int(metaData.NumChunks) {
+		miss = true
+	}
+
+	if pw == nil {
+		if lastErr != nil {
+			return lastErr
 		}
+		dataOut <- missResponse
+		return nil
 	}
+
+	if lastErr != nil {
+		pw.CloseWithError(lastErr)
+		return lastErr
+	}
+	if miss {
+		metrics.IncCounter(MetricCmdGetStreamAborted)
+		pw.CloseWithError(common.ErrStreamAborted)
+		return nil
+	}
+	pw.Close()
+	return nil
 }
 
+// GetE is not supported by the chunked handler and fails with ErrNotSupported.
 func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
 	// Being minimalist, not lazy. The chunked handler is not meant to be used with a
 	// backing store that supports the GetE protocol extension. It would be a waste of
@@ -599,20 +1388,31 @@ func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan
 	// for pathological behavior when data size rapidly changes that only happens in
 	// memcached. The chunked handler will not work well with the L2 the EVCache team
 	// uses.
-	panic("GetE not supported in Rend chunked mode")
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error, 1)
+	errorOut <- common.ErrNotSupported
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
 }
 
+// GAT reads the item and extends the TTL of every chunk and the metadata. Like Touch, the metadata
+// is read first but only updated after every chunk has been read and touched, so a missing chunk
+// fails the whole operation instead of extending a broken item. The metadata is then rewritten with
+// the new exptime using the CAS value it was read with. If the item was changed in between, the
+// GAT still returns the data it read, as if it happened just before the change, and the TTL of
+// the new item is left alone.
 func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	missResponse := common.GetResponse{
 		Miss:   true,
-		Quiet:  false,
+		Quiet:  cmd.Quiet,
 		Opaque: cmd.Opaque,
 		Flags:  0,
 		Key:    cmd.Key,
 		Data:   nil,
 	}
 
-	_, metaData, err := getAndTouchMetadata(h.rw, cmd.Key, cmd.Exptime)
+	metaKey, metaData, err := getMetadata(h.rw, cmd.Key)
 	if err != nil {
 		if err == common.ErrKeyNotFound {
 			metrics.IncCounter(MetricCmdGatMissesMeta)
@@ -626,8 +1426,8 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 	// Write all the GAT commands before reading
 	for i := 0; i < int(metaData.NumChunks); i++ {
-		chunkKey := chunkKey(cmd.Key, i)
-		if err := binprot.WriteGATQCmd(h.rw.Writer, chunkKey, cmd.Exptime); err != nil {
+		chunkKey := metaData.chunkKey(cmd.Key, i)
+		if err := binprot.WriteGATQCmd(h.rw.Writer, chunkKey, metaData.chunkExptime(cmd.Exptime)); err != nil {
 			return common.GetResponse{}, err
 		}
 	}
@@ -657,7 +1457,7 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 	var lastErr error
 
 	for {
-		opcodeNoop, err := getLocalIntoBuf(h.rw.Reader, metaData, tokenBuf, dataBuf, chunk, int(metaData.ChunkSize))
+		opcodeNoop, err := getLocalIntoBuf(h.rw.Reader, metaData, tokenBuf, dataBuf, chunk)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				if !miss {
@@ -674,7 +1474,7 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 			break
 		}
 
-		if !bytes.Equal(metaData.Token[:], tokenBuf) {
+		if !bytes.Equal(metaData.chunkToken(chunk), tokenBuf) {
 			//fmt.Println(id, "GAT miss because of invalid chunk token. Cmd:", cmd)
 			//fmt.Printf("Expected: %v\n", metaData.Token)
 			//fmt.Printf("Got:      %v\n", tokenBuf)
@@ -695,13 +1495,41 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 		return missResponse, nil
 	}
 
+	data, err := h.decode(cmd.Key, metaData, dataBuf)
+	if err != nil {
+		return missResponse, nil
+	}
+
+	// Overwrite the metadata with the new expiration time, only if it is unchanged
+	metrics.IncCounter(MetricCmdGatMetaSet)
+	metaData.Exptime, _ = exptime(cmd.Exptime)
+	if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, metaData.OrigFlags, cmd.Exptime, metaData.size(), metaData.CAS); err != nil {
+		return common.GetResponse{}, err
+	}
+	writeMetadata(h.rw, metaData)
+
+	// The rewrite gives the metadata a new CAS value, which is the one a client must use from now
+	// on. If the rewrite lost a race, the old one is returned and will fail as it should.
+	cas, err := storeCmdLocal(h.rw)
+	if err != nil {
+		if err != common.ErrKeyExists && err != common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdGatMetaSetErrors)
+			return common.GetResponse{}, err
+		}
+		metrics.IncCounter(MetricCmdGatMetaSetRaces)
+		cas = metaData.CAS
+	} else {
+		metrics.IncCounter(MetricCmdGatMetaSetSuccesses)
+	}
+
 	return common.GetResponse{
 		Miss:   false,
-		Quiet:  false,
+		Quiet:  cmd.Quiet,
 		Opaque: cmd.Opaque,
 		Flags:  metaData.OrigFlags,
+		Cas:    cas,
 		Key:    cmd.Key,
-		Data:   dataBuf,
+		Data:   data,
 	}, nil
 }
 
@@ -720,8 +1548,12 @@ func (h Handler) Delete(cmd common.DeleteRequest) error {
 		return err
 	}
 
+	if cmd.Cas != 0 && cmd.Cas != metaData.CAS {
+		return common.ErrKeyExists
+	}
+
 	// Delete metadata first
-	if err := binprot.WriteDeleteCmd(h.rw.Writer, metaKey); err != nil {
+	if err := binprot.WriteDeleteCmd(h.rw.Writer, metaKey, cmd.Cas); err != nil {
 		return err
 	}
 	if err := simpleCmdLocal(h.rw, true); err != nil {
@@ -731,10 +1563,15 @@ func (h Handler) Delete(cmd common.DeleteRequest) error {
 		return err
 	}
 
+	// Shared chunks are only deleted once no other item uses them
+	if metaData.Dedup {
+		return h.releaseRefs(metaData.Hashes)
+	}
+
 	// Then delete data chunks
 	for i := 0; i < int(metaData.NumChunks); i++ {
-		chunkKey := chunkKey(cmd.Key, i)
-		if err := binprot.WriteDeleteCmd(h.rw.Writer, chunkKey); err != nil {
+		chunkKey := metaData.chunkKey(cmd.Key, i)
+		if err := binprot.WriteDeleteCmd(h.rw.Writer, chunkKey, 0); err != nil {
 			return err
 		}
 	}
@@ -782,8 +1619,8 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 
 	// First touch all the chunks as a batch
 	for i := 0; i < int(metaData.NumChunks); i++ {
-		chunkKey := chunkKey(cmd.Key, i)
-		if err := binprot.WriteTouchCmd(h.rw.Writer, chunkKey, cmd.Exptime); err != nil {
+		chunkKey := metaData.chunkKey(cmd.Key, i)
+		if err := binprot.WriteTouchCmd(h.rw.Writer, chunkKey, metaData.chunkExptime(cmd.Exptime)); err != nil {
 			return err
 		}
 	}
@@ -809,7 +1646,7 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	// Overwrite the metadata with the new expiration time
 	metrics.IncCounter(MetricCmdTouchMetaSet)
 	metaData.Exptime, _ = exptime(cmd.Exptime)
-	if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, metaData.OrigFlags, cmd.Exptime, metadataSize); err != nil {
+	if err := binprot.WriteSetCmd(h.rw.Writer, metaKey, metaData.OrigFlags, cmd.Exptime, metaData.size(), 0); err != nil {
 		return err
 	}
 
@@ -835,3 +1672,43 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 
 	return nil
 }
+
+// Incr is not supported by the chunked handler. Values are split across multiple memcached items
+// with a header on each, so memcached can't do the arithmetic itself.
+func (h Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return 0, common.ErrNotSupported
+}
+
+// Decr is not supported by the chunked handler for the same reasons as Incr.
+func (h Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return 0, common.ErrNotSupported
+}
+
+// Stats returns the stats of the memcached instance directly. Item counts and sizes are for the
+// individual chunks and metadata items, not for the logical items stored through rend.
+func (h Handler) Stats(group []byte) ([]common.Stat, error) {
+	if err := binprot.WriteStatCmd(h.rw.Writer, group); err != nil {
+		return nil, err
+	}
+	return statsLocal(h.rw)
+}
+
+// Flush flushes the whole memcached instance, so the metadata and chunks for every item go at the
+// same time. With a delay, memcached invalidates everything stored before the flush time. A set
+// that straddles the flush time can lose the chunks it wrote before it and still store its
+// metadata after, which readers treat as a miss like any item with a missing chunk. An add,
+// replace or CAS set writes its metadata first instead, so it can lose that and leave new chunks
+// behind for the janitor or expiry to clean up.
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	if err := binprot.WriteFlushCmd(h.rw.Writer, cmd.Delay); err != nil {
+		return err
+	}
+	return simpleCmdLocal(h.rw, true)
+}
+
+func (h Handler) Version() (string, error) {
+	if err := binprot.WriteVersionCmd(h.rw.Writer); err != nil {
+		return "", err
+	}
+	return versionLocal(h.rw)
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+)
+
+func TestChunkSize(t *testing.T) {
+	h := Handler{chunkMaxSize: DefaultChunkSize}
+	fixed, _ := h.chunkSize(3, 100000)
+	if want := uint32(DefaultChunkSize - chunkOverhead - 3 - tokenSize); fixed != want {
+		t.Fatalf("Expected the fixed chunk size %d, got %d", want, fixed)
+	}
+
+	h = h.WithAdaptiveChunks(512 * 1024)
+
+	if small, _ := h.chunkSize(3, 10); small != fixed {
+		t.Fatalf("Expected a small item to use the base chunk size %d, got %d", fixed, small)
+	}
+
+	// Fits in one chunk of a bigger slab class
+	mid, full := h.chunkSize(3, 5000)
+	if mid < 5000 {
+		t.Fatalf("Expected a 5000 byte item to fit in one chunk, got chunks of %d", mid)
+	}
+	if (int(full)+chunkOverhead+3)%8 != 0 {
+		t.Fatalf("Expected the chunk size to be 8 byte aligned, got %d", int(full)+chunkOverhead+3)
+	}
+	if mid >= 5000*2 {
+		t.Fatalf("Expected the smallest chunk that fits, got %d", mid)
+	}
+
+	// Too big for any single chunk, so it gets the biggest chunks there are
+	big, full := h.chunkSize(3, 4*1024*1024)
+	if int(full)+chunkOverhead+3 > 512*1024 {
+		t.Fatalf("Expected chunks no bigger than the max, got %d", int(full)+chunkOverhead+3)
+	}
+	if big < 512*1024*4/5 {
+		t.Fatalf("Expected chunks within a slab class of the max, got %d", big)
+	}
+}
+
+func TestChunkLimitedReaderNoPadding(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	r := newChunkLimitedReader(bytes.NewReader(data), 8, int64(len(data)))
+
+	var lens []int64
+	var out []byte
+	for r.More() {
+		lens = append(lens, r.ChunkLen())
+		chunk, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Error reading chunk: %v", err)
+		}
+		if int64(len(chunk)) != lens[len(lens)-1] {
+			t.Fatalf("Expected a %d byte chunk, got %d", lens[len(lens)-1], len(chunk))
+		}
+		out = append(out, chunk...)
+		r.NextChunk()
+	}
+
+	if len(lens) != 3 || lens[0] != 8 || lens[1] != 8 || lens[2] != 4 {
+		t.Fatalf("Expected chunks of 8, 8 and 4 bytes, got %v", lens)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("Expected %q, got %q", data, out)
+	}
+}
+
+func TestGetLocalIntoBufChunkLength(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	md := metadata{Length: uint32(len(data)), NumChunks: 3, ChunkSize: 8}
+	copy(md.Token[:], "0123456789abcdef")
+
+	response := func(tail []byte) *bufio.Reader {
+		buf := &bytes.Buffer{}
+		w := bufio.NewWriter(buf)
+		value := append(append([]byte(nil), md.Token[:]...), tail...)
+		res := binprot.NewBinaryResponder(w)
+		res.Get(common.GetResponse{Data: value})
+		res.Noop(0)
+		w.Flush()
+		return bufio.NewReader(buf)
+	}
+
+	tests := []struct {
+		name string
+		r    *bufio.Reader
+		miss bool
+	}{
+		{name: "exact length", r: response(data[16:])},
+		{name: "padded", r: streamResponses(md, [][]byte{data[16:]})},
+		{name: "short", r: response(data[16:19]), miss: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dataBuf := make([]byte, len(data))
+			tokenBuf := make([]byte, tokenSize)
+
+			_, err := getLocalIntoBuf(test.r, md, tokenBuf, dataBuf, 2)
+			if test.miss {
+				if err != common.ErrKeyNotFound {
+					t.Fatalf("Expected a miss, got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Error reading chunk: %v", err)
+				}
+				if !bytes.Equal(dataBuf[16:], data[16:]) {
+					t.Fatalf("Expected %q, got %q", data[16:], dataBuf[16:])
+				}
+			}
+
+			// The whole response has to be consumed either way
+			if noop, err := getLocalIntoBuf(test.r, md, tokenBuf, dataBuf, 2); !noop || err != nil {
+				t.Fatalf("Expected the Noop right after the chunk, got %v", err)
+			}
+		})
+	}
+}
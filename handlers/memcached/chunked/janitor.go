@@ -0,0 +1,323 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricJanitorSweeps        = metrics.AddCounter("chunked_janitor_sweeps", nil)
+	MetricJanitorErrors        = metrics.AddCounter("chunked_janitor_errors", nil)
+	MetricJanitorChunksChecked = metrics.AddCounter("chunked_janitor_chunks_checked", nil)
+	MetricJanitorChunksDeleted = metrics.AddCounter("chunked_janitor_chunks_deleted", nil)
+)
+
+// janitorBatch is how many chunks from the dump are checked at a time. Chunks of the same item
+// in a batch share one metadata lookup.
+const janitorBatch = 1000
+
+// janitorGrace is how long after a chunk was last written or read the janitor leaves it alone.
+// A set writes its chunks before its metadata, so for a while the chunks of a set that is
+// still going look just like orphans.
+const janitorGrace = 10 * time.Minute
+
+// StartJanitor sweeps memcached for orphaned chunks every interval in the background, over
+// connections made with dial. See Sweep.
+func StartJanitor(dial func() (io.ReadWriteCloser, error), interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := Sweep(dial); err != nil {
+				log.Println("Error sweeping for orphaned chunks:", err.Error())
+				metrics.IncCounter(MetricJanitorErrors)
+			}
+		}
+	}()
+}
+
+// Sweep lists every key in memcached with lru_crawler metadump and deletes the chunks that no
+// item points at any more: those whose metadata is gone, those past the end of their item, those
+// with a key or token that doesn't match their metadata. They are left behind by sets that were
+// interrupted or evicted part way, and would otherwise take up memory until they are evicted too.
+// Deletes use the CAS value the chunk was seen with, and a token mismatch is checked against a
+// fresh read of the metadata, so a chunk that is written again during the sweep is left alone.
+// Chunks accessed within janitorGrace are skipped, since they may belong to a set in progress.
+// The dump and the checks each need their own connection.
+func Sweep(dial func() (io.ReadWriteCloser, error)) error {
+	metrics.IncCounter(MetricJanitorSweeps)
+
+	dumpConn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer dumpConn.Close()
+
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	j := &janitor{rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+
+	if _, err := io.WriteString(dumpConn, "lru_crawler metadump all\r\n"); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(dumpConn)
+	batch := make([]dumpedChunk, 0, janitorBatch)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "END" {
+			return j.check(batch)
+		}
+		if !strings.HasPrefix(line, "key=") {
+			// BUSY or ERROR if the crawler is already running or metadump isn't supported
+			return errors.New("Unexpected metadump response: " + line)
+		}
+
+		if c, ok := parseDumpLine(line); ok {
+			batch = append(batch, c)
+		}
+		if len(batch) == janitorBatch {
+			if err := j.check(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+}
+
+// dumpedChunk is a chunk key seen in the metadump. seg is the part of the key that comes from the
+// token of the segment of a chunk written by an append in place. access is the unix time the chunk
+// was last written or read.
+type dumpedChunk struct {
+	key    string
+	chunk  int
+	cas    uint64
+	seg    string
+	access int64
+}
+
+// chunkKey rebuilds the key of the chunk
+func (c dumpedChunk) chunkKey() []byte {
+	key := chunkKey([]byte(c.key), c.chunk)
+	if c.seg != "" {
+		key = append(append(key, segmentKeyPrefix...), c.seg...)
+	}
+	return key
+}
+
+// belongsTo says whether the chunk is one the metadata points at
+func (c dumpedChunk) belongsTo(md metadata, token []byte) bool {
+	return c.chunk < int(md.NumChunks) &&
+		bytes.Equal(c.chunkKey(), md.chunkKey([]byte(c.key), c.chunk)) &&
+		bytes.Equal(token, md.chunkToken(c.chunk))
+}
+
+// parseDumpLine returns the item key, chunk number, CAS value and any segment of a chunk key in a
+// line of metadump output. Any other key, including metadata keys, is skipped.
+func parseDumpLine(line string) (dumpedChunk, bool) {
+	var c dumpedChunk
+	var key string
+
+	for _, field := range strings.Fields(line) {
+		switch {
+		case strings.HasPrefix(field, "key="):
+			k, err := url.PathUnescape(field[len("key="):])
+			if err != nil {
+				return c, false
+			}
+			key = k
+		case strings.HasPrefix(field, "cas="):
+			c.cas, _ = strconv.ParseUint(field[len("cas="):], 10, 64)
+		case strings.HasPrefix(field, "la="):
+			c.access, _ = strconv.ParseInt(field[len("la="):], 10, 64)
+		}
+	}
+
+	if i := strings.LastIndex(key, segmentKeyPrefix); i > 0 && len(key)-i == len(segmentKeyPrefix)+2*segmentKeyToken {
+		if _, err := hex.DecodeString(key[i+len(segmentKeyPrefix):]); err == nil {
+			c.seg = key[i+len(segmentKeyPrefix):]
+			key = key[:i]
+		}
+	}
+
+	dash := strings.LastIndexByte(key, '-')
+	if dash <= 0 {
+		return c, false
+	}
+	chunk, err := strconv.Atoi(key[dash+1:])
+	if err != nil || chunk < 0 {
+		return c, false
+	}
+
+	c.key = key[:dash]
+	c.chunk = chunk
+	return c, true
+}
+
+type janitor struct {
+	rw *bufio.ReadWriter
+}
+
+type lookup struct {
+	md      metadata
+	missing bool
+}
+
+// check deletes the orphans in a batch of chunks from the dump
+func (j *janitor) check(batch []dumpedChunk) error {
+	metas := make(map[string]lookup)
+
+	now := time.Now()
+
+	for _, c := range batch {
+		if now.Sub(time.Unix(c.access, 0)) < janitorGrace {
+			continue
+		}
+		metrics.IncCounter(MetricJanitorChunksChecked)
+
+		m, ok := metas[c.key]
+		if !ok {
+			var err error
+			if m, err = j.meta(c.key); err != nil {
+				return err
+			}
+			metas[c.key] = m
+		}
+
+		key := c.chunkKey()
+
+		if m.missing || c.chunk >= int(m.md.NumChunks) {
+			if err := j.delete(key, c.cas); err != nil {
+				return err
+			}
+			continue
+		}
+
+		token, cas, err := j.token(key)
+		if err != nil {
+			if err == common.ErrKeyNotFound {
+				continue
+			}
+			return err
+		}
+		if c.belongsTo(m.md, token) {
+			continue
+		}
+
+		// The item may have been set again since its metadata was read
+		fresh, err := j.meta(c.key)
+		if err != nil {
+			return err
+		}
+		metas[c.key] = fresh
+		if !fresh.missing && c.belongsTo(fresh.md, token) {
+			continue
+		}
+
+		if err := j.delete(key, cas); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *janitor) meta(key string) (lookup, error) {
+	_, md, err := getMetadata(j.rw, []byte(key))
+	if err == common.ErrKeyNotFound {
+		return lookup{missing: true}, nil
+	}
+	if err != nil {
+		return lookup{}, err
+	}
+	return lookup{md: md}, nil
+}
+
+// token reads the token at the start of a chunk and the chunk's CAS value
+func (j *janitor) token(key []byte) ([]byte, uint64, error) {
+	if err := binprot.WriteGetCmd(j.rw.Writer, key); err != nil {
+		return nil, 0, err
+	}
+	if err := j.rw.Flush(); err != nil {
+		return nil, 0, err
+	}
+
+	resHeader, err := binprot.ReadResponseHeader(j.rw)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	body := int(resHeader.TotalBodyLength)
+	if err := binprot.DecodeError(resHeader); err != nil {
+		n, ioerr := j.rw.Discard(body)
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return nil, 0, ioerr
+		}
+		return nil, 0, err
+	}
+
+	// The flags come before the value, and a chunk too short to hold a token can't match one
+	buf := make([]byte, body)
+	n, err := io.ReadFull(j.rw, buf)
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if err != nil {
+		return nil, 0, err
+	}
+	if body < 4+tokenSize {
+		return nil, resHeader.CASToken, nil
+	}
+	return buf[4 : 4+tokenSize], resHeader.CASToken, nil
+}
+
+// delete deletes a chunk if it still has the CAS value it was checked with
+func (j *janitor) delete(key []byte, cas uint64) error {
+	if err := binprot.WriteDeleteCmd(j.rw.Writer, key, cas); err != nil {
+		return err
+	}
+
+	err := simpleCmdLocal(j.rw, true)
+	switch err {
+	case nil:
+		metrics.IncCounter(MetricJanitorChunksDeleted)
+		return nil
+	case common.ErrKeyNotFound, common.ErrKeyExists:
+		// Gone or written again since it was seen
+		return nil
+	}
+	return err
+}
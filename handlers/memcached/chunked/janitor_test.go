@@ -0,0 +1,175 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+)
+
+func TestParseDumpLine(t *testing.T) {
+	tests := []struct {
+		line string
+		c    dumpedChunk
+		ok   bool
+	}{
+		{"key=foo-0 exp=-1 la=1 cas=5 fetch=no cls=12 size=1184", dumpedChunk{"foo", 0, 5, "", 1}, true},
+		{"key=foo-12 exp=-1 la=1 cas=6 fetch=no cls=12 size=1184", dumpedChunk{"foo", 12, 6, "", 1}, true},
+		{"key=a%2Db-3-1 exp=-1 la=1 cas=7 fetch=no cls=12 size=1184", dumpedChunk{"a-b-3", 1, 7, "", 1}, true},
+		{"key=foo-2-s0a1b2c3d exp=-1 la=1 cas=10 fetch=no cls=12 size=1184", dumpedChunk{"foo", 2, 10, "0a1b2c3d", 1}, true},
+		{"key=foo-2-sxyzxyzxy exp=-1 la=1 cas=11 fetch=no cls=12 size=1184", dumpedChunk{}, false},
+		{"key=foo-meta exp=-1 la=1 cas=8 fetch=no cls=1 size=80", dumpedChunk{}, false},
+		{"key=foo exp=-1 la=1 cas=9 fetch=no cls=1 size=80", dumpedChunk{}, false},
+	}
+
+	for _, test := range tests {
+		c, ok := parseDumpLine(test.line)
+		if ok != test.ok || (ok && c != test.c) {
+			t.Fatalf("Expected %v and %v for %q, got %v and %v", test.c, test.ok, test.line, c, ok)
+		}
+	}
+}
+
+func TestJanitorCheck(t *testing.T) {
+	md := metadata{Length: 10, NumChunks: 2, ChunkSize: 8}
+	copy(md.Token[:], "0123456789abcdef")
+
+	metaBuf := &bytes.Buffer{}
+	writeMetadata(metaBuf, md)
+
+	// Responses in the order the janitor asks for them
+	responses := &bytes.Buffer{}
+	w := bufio.NewWriter(responses)
+	res := binprot.NewBinaryResponder(w)
+	res.Get(common.GetResponse{Data: metaBuf.Bytes()})                                      // foo-meta
+	res.Get(common.GetResponse{Data: append(md.Token[:], "01234567"...), Cas: 10})          // foo-0
+	res.Delete(0, false)                                                                    // foo-3
+	res.Error(0, common.RequestGet, common.ErrKeyNotFound, false)                           // bar-meta
+	res.Delete(0, false)                                                                    // bar-0
+	res.Get(common.GetResponse{Data: append([]byte("xxxxxxxxxxxxxxxx"), "89"...), Cas: 11}) // foo-1
+	res.Get(common.GetResponse{Data: metaBuf.Bytes()})                                      // foo-meta again
+	res.Delete(0, false)                                                                    // foo-1
+	w.Flush()
+
+	written := &bytes.Buffer{}
+	j := &janitor{rw: bufio.NewReadWriter(bufio.NewReader(responses), bufio.NewWriter(written))}
+
+	err := j.check([]dumpedChunk{
+		{"foo", 0, 1, "", 0},
+		{"foo", 3, 2, "", 0},
+		{"bar", 0, 3, "", 0},
+		{"foo", 1, 4, "", 0},
+	})
+	if err != nil {
+		t.Fatalf("Error checking chunks: %v", err)
+	}
+
+	var deletes []common.DeleteRequest
+	br := bufio.NewReader(written)
+	p := binprot.NewBinaryParser(br)
+	for written.Len() > 0 || br.Buffered() > 0 {
+		req, reqType, _, err := p.Parse()
+		if err != nil {
+			t.Fatalf("Error parsing commands: %v", err)
+		}
+		if reqType == common.RequestDelete {
+			deletes = append(deletes, req.(common.DeleteRequest))
+		}
+	}
+
+	expected := []common.DeleteRequest{
+		{Key: []byte("foo-3"), Cas: 2},
+		{Key: []byte("bar-0"), Cas: 3},
+		{Key: []byte("foo-1"), Cas: 11},
+	}
+	if len(deletes) != len(expected) {
+		t.Fatalf("Expected %d deletes, got %d", len(expected), len(deletes))
+	}
+	for i, d := range deletes {
+		if !bytes.Equal(d.Key, expected[i].Key) || d.Cas != expected[i].Cas {
+			t.Fatalf("Expected a delete of %s with CAS %d, got %s with %d", expected[i].Key, expected[i].Cas, d.Key, d.Cas)
+		}
+	}
+}
+
+func TestJanitorCheckSegments(t *testing.T) {
+	md := metadata{Length: 10, NumChunks: 2, ChunkSize: 8}
+	copy(md.Token[:], "0123456789abcdef")
+	seg := segment{Start: 1}
+	copy(seg.Token[:], "fedcba9876543210")
+	md.Segments = []segment{seg}
+
+	metaBuf := &bytes.Buffer{}
+	writeMetadata(metaBuf, md)
+
+	// Responses in the order the janitor asks for them
+	responses := &bytes.Buffer{}
+	w := bufio.NewWriter(responses)
+	res := binprot.NewBinaryResponder(w)
+	res.Get(common.GetResponse{Data: metaBuf.Bytes()})                             // foo-meta
+	res.Get(common.GetResponse{Data: append(md.Token[:], "01234567"...), Cas: 10}) // foo-1
+	res.Get(common.GetResponse{Data: metaBuf.Bytes()})                             // foo-meta again
+	res.Delete(0, false)                                                           // foo-1
+	res.Get(common.GetResponse{Data: append(seg.Token[:], "89"...), Cas: 11})      // foo-1-s66656463
+	w.Flush()
+
+	written := &bytes.Buffer{}
+	j := &janitor{rw: bufio.NewReadWriter(bufio.NewReader(responses), bufio.NewWriter(written))}
+
+	// The chunk an append in place replaced is deleted and the one it wrote is kept
+	err := j.check([]dumpedChunk{
+		{"foo", 1, 1, "", 0},
+		{"foo", 1, 2, "66656463", 0},
+	})
+	if err != nil {
+		t.Fatalf("Error checking chunks: %v", err)
+	}
+
+	var deletes []common.DeleteRequest
+	br := bufio.NewReader(written)
+	p := binprot.NewBinaryParser(br)
+	for written.Len() > 0 || br.Buffered() > 0 {
+		req, reqType, _, err := p.Parse()
+		if err != nil {
+			t.Fatalf("Error parsing commands: %v", err)
+		}
+		if reqType == common.RequestDelete {
+			deletes = append(deletes, req.(common.DeleteRequest))
+		}
+	}
+
+	if len(deletes) != 1 || string(deletes[0].Key) != "foo-1" || deletes[0].Cas != 10 {
+		t.Fatalf("Expected only a delete of foo-1, got %v", deletes)
+	}
+}
+
+func TestJanitorCheckRecent(t *testing.T) {
+	written := &bytes.Buffer{}
+	j := &janitor{rw: bufio.NewReadWriter(bufio.NewReader(&bytes.Buffer{}), bufio.NewWriter(written))}
+
+	// A chunk that was just written may belong to a set whose metadata is still to come
+	if err := j.check([]dumpedChunk{{"foo", 0, 1, "", time.Now().Unix()}}); err != nil {
+		t.Fatalf("Error checking chunks: %v", err)
+	}
+	j.rw.Flush()
+	if written.Len() != 0 {
+		t.Fatalf("Expected a recent chunk to be left alone, got %q", written.Bytes())
+	}
+}
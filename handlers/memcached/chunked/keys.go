@@ -15,6 +15,7 @@
 package chunked
 
 import (
+	"encoding/hex"
 	"math"
 	"strconv"
 )
@@ -39,6 +40,45 @@ func chunkKey(key []byte, chunk int) []byte {
 	return strconv.AppendInt(key, int64(-chunk), 10)
 }
 
+// segmentKeyPrefix starts the part of the key of a chunk in a segment that comes from its token,
+// so it can't be mistaken for the chunk number of a regular chunk key
+const segmentKeyPrefix = "-s"
+
+// segmentKeyToken is how many bytes of the token of a segment go into the keys of its chunks. It
+// only needs to keep racing appends apart, since the whole token is still checked on reads.
+const segmentKeyToken = 4
+
+// segmentChunkKey returns the key of a chunk written by an append in place with the given token.
+// The token keeps the chunks of racing appends, and the chunk it replaces, apart.
+func segmentChunkKey(key []byte, chunk int, token [tokenSize]byte) []byte {
+	k := chunkKey(append([]byte(nil), key...), chunk)
+	k = append(k, segmentKeyPrefix...)
+	return append(k, hex.EncodeToString(token[:segmentKeyToken])...)
+}
+
+// segment returns the segment chunk i of an item is in, if any
+func (md metadata) segment(chunk int) (segment, bool) {
+	for i := len(md.Segments) - 1; i >= 0; i-- {
+		if chunk >= int(md.Segments[i].Start) {
+			return md.Segments[i], true
+		}
+	}
+	return segment{}, false
+}
+
+// chunkKey returns the key chunk i of an item is stored under, which for a deduplicated item is
+// based on the hash of the chunk instead of the item's key and for a chunk written by an append in
+// place includes the token of its segment
+func (md metadata) chunkKey(key []byte, chunk int) []byte {
+	if md.Dedup {
+		return dedupKey(md.Hashes[chunk])
+	}
+	if seg, ok := md.segment(chunk); ok {
+		return segmentChunkKey(key, chunk, seg.Token)
+	}
+	return chunkKey(key, chunk)
+}
+
 func chunkSliceIndices(chunkSize, chunkNum, totalLength int) (int, int) {
 	// Indices for slicing. End is exclusive
 	start := chunkSize * chunkNum
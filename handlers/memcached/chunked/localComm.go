@@ -16,6 +16,8 @@ package chunked
 
 import (
 	"bufio"
+	"encoding/binary"
+	"hash/crc32"
 	"io"
 
 	"github.com/hongst/rend/binprot"
@@ -26,15 +28,6 @@ import (
 // TODO: replace sending new empty metadata on miss with emptyMeta
 var emptyMeta = metadata{}
 
-func getAndTouchMetadata(rw *bufio.ReadWriter, key []byte, exptime uint32) ([]byte, metadata, error) {
-	metaKey := metaKey(key)
-	if err := binprot.WriteGATCmd(rw, metaKey, exptime); err != nil {
-		return nil, emptyMeta, err
-	}
-	metaData, err := getMetadataCommon(rw)
-	return metaKey, metaData, err
-}
-
 func getMetadata(rw *bufio.ReadWriter, key []byte) ([]byte, metadata, error) {
 	metaKey := metaKey(key)
 	if err := binprot.WriteGetCmd(rw, metaKey); err != nil {
@@ -79,10 +72,12 @@ func getMetadataCommon(rw *bufio.ReadWriter) (metadata, error) {
 	rw.Discard(4)
 	metrics.IncCounterBy(common.MetricBytesReadLocal, 4)
 
-	metaData, err := readMetadata(rw)
+	// The body is the 4 bytes of flags and the metadata
+	metaData, err := readMetadata(rw, int(resHeader.TotalBodyLength)-4)
 	if err != nil {
 		return emptyMeta, err
 	}
+	metaData.CAS = resHeader.CASToken
 
 	return metaData, nil
 }
@@ -110,7 +105,64 @@ func simpleCmdLocal(rw *bufio.ReadWriter, flush bool) error {
 	return binprot.DecodeError(resHeader)
 }
 
-func getLocalIntoBuf(rw *bufio.Reader, metaData metadata, tokenBuf, dataBuf []byte, chunkNum, totalDataLength int) (opcodeNoop bool, err error) {
+// storeCmdLocal reads the response to a store command like simpleCmdLocal and also returns the
+// new CAS value of the item.
+func storeCmdLocal(rw *bufio.ReadWriter) (uint64, error) {
+	if err := rw.Flush(); err != nil {
+		return 0, err
+	}
+
+	resHeader, err := binprot.ReadResponseHeader(rw)
+	if err != nil {
+		return 0, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if ioerr != nil {
+		return 0, ioerr
+	}
+
+	if err := binprot.DecodeError(resHeader); err != nil {
+		return 0, err
+	}
+
+	return resHeader.CASToken, nil
+}
+
+// arithCmdLocal reads the response to an increment or decrement and returns the new value and the
+// new CAS value of the counter.
+func arithCmdLocal(rw *bufio.ReadWriter) (uint64, uint64, error) {
+	resHeader, err := binprot.ReadResponseHeader(rw)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	if err := binprot.DecodeError(resHeader); err != nil {
+		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return 0, 0, ioerr
+		}
+		return 0, 0, err
+	}
+
+	buf := make([]byte, 8)
+	n, err := io.ReadFull(rw, buf)
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return binary.BigEndian.Uint64(buf), resHeader.CASToken, nil
+}
+
+// getLocalIntoBuf reads one chunk's response into its place in dataBuf. The stored chunk is
+// allowed to be longer than its share of the data, since older items padded the last chunk out
+// to the full chunk size, but one that is too short to hold it is treated as missing.
+func getLocalIntoBuf(rw *bufio.Reader, metaData metadata, tokenBuf, dataBuf []byte, chunkNum int) (opcodeNoop bool, err error) {
 	resHeader, err := binprot.ReadResponseHeader(rw)
 	if err != nil {
 		return false, err
@@ -162,6 +214,18 @@ func getLocalIntoBuf(rw *bufio.Reader, metaData metadata, tokenBuf, dataBuf []by
 	// read data directly into buf
 	chunkBuf := dataBuf[start:end]
 
+	// Whatever is stored past this chunk's data and before the trailer is padding
+	stored := int(resHeader.TotalBodyLength) - 4 - tokenSize
+	padding := stored - int(metaData.chunkTrailer()) - len(chunkBuf)
+	if padding < 0 {
+		n, ioerr := rw.Discard(stored)
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return false, ioerr
+		}
+		return false, common.ErrKeyNotFound
+	}
+
 	// Read in value
 	n, err := io.ReadAtLeast(rw, chunkBuf, len(chunkBuf))
 	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
@@ -169,9 +233,13 @@ func getLocalIntoBuf(rw *bufio.Reader, metaData metadata, tokenBuf, dataBuf []by
 		return false, err
 	}
 
+	if metaData.Checksums {
+		return false, verifyChunk(rw, tokenBuf, chunkBuf, padding)
+	}
+
 	// consume padding at end of chunk if needed
-	if len(chunkBuf) < totalDataLength {
-		n, ioerr := rw.Discard(totalDataLength - len(chunkBuf))
+	if padding > 0 {
+		n, ioerr := rw.Discard(padding)
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 		if ioerr != nil {
 			return false, ioerr
@@ -180,3 +248,105 @@ func getLocalIntoBuf(rw *bufio.Reader, metaData metadata, tokenBuf, dataBuf []by
 
 	return false, nil
 }
+
+// verifyChunk reads the padding and checksum at the end of a chunk and checks the checksum against
+// the token, data and padding. A chunk that doesn't match is treated as missing so the whole item
+// is a miss.
+func verifyChunk(rw *bufio.Reader, token, data []byte, padding int) error {
+	crc := crc32.NewIEEE()
+	crc.Write(token)
+	crc.Write(data)
+
+	n, err := io.CopyN(crc, rw, int64(padding))
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, checksumSize)
+	n2, err := io.ReadFull(rw, buf)
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n2))
+	if err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(buf) != crc.Sum32() {
+		metrics.IncCounter(MetricChunkChecksumMismatches)
+		return common.ErrKeyNotFound
+	}
+	return nil
+}
+
+// statsLocal reads the stats responses from memcached. Each stat is in its own response, with the
+// name as the key and the value as the value. An empty response marks the end.
+func statsLocal(rw *bufio.ReadWriter) ([]common.Stat, error) {
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	var stats []common.Stat
+
+	for {
+		resHeader, err := binprot.ReadResponseHeader(rw)
+		if err != nil {
+			return nil, err
+		}
+
+		err = binprot.DecodeError(resHeader)
+		if err != nil {
+			n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			binprot.PutResponseHeader(resHeader)
+			if ioerr != nil {
+				return nil, ioerr
+			}
+			return nil, err
+		}
+
+		keyLength := int(resHeader.KeyLength)
+		totalBodyLength := int(resHeader.TotalBodyLength)
+		binprot.PutResponseHeader(resHeader)
+
+		if keyLength == 0 {
+			return stats, nil
+		}
+
+		buf := make([]byte, totalBodyLength)
+		n, err := io.ReadFull(rw, buf)
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, common.Stat{
+			Name:  string(buf[:keyLength]),
+			Value: string(buf[keyLength:]),
+		})
+	}
+}
+
+// versionLocal reads the response to a version command, which is the version string as the body.
+func versionLocal(rw *bufio.ReadWriter) (string, error) {
+	if err := rw.Flush(); err != nil {
+		return "", err
+	}
+
+	resHeader, err := binprot.ReadResponseHeader(rw)
+	if err != nil {
+		return "", err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	buf := make([]byte, resHeader.TotalBodyLength)
+	n, err := io.ReadFull(rw, buf)
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if err != nil {
+		return "", err
+	}
+
+	if err := binprot.DecodeError(resHeader); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
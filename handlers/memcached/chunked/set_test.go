@@ -0,0 +1,301 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/memcached/memcachedtest"
+)
+
+// setKeys parses the commands a set wrote and returns the keys they store, in order
+func setKeys(t *testing.T, written *bytes.Buffer) []string {
+	var keys []string
+	br := bufio.NewReader(written)
+	p := binprot.NewBinaryParser(br)
+	for written.Len() > 0 || br.Buffered() > 0 {
+		req, _, _, err := p.Parse()
+		if err != nil {
+			t.Fatalf("Error parsing command: %v", err)
+		}
+		switch r := req.(type) {
+		case common.SetRequest:
+			keys = append(keys, string(r.Key))
+		case common.GetRequest:
+			keys = append(keys, "get "+string(r.Keys[0]))
+		case common.DeleteRequest:
+			keys = append(keys, "delete "+string(r.Key))
+		}
+	}
+	return keys
+}
+
+func TestSetWritesChunksFirst(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		responses := &bytes.Buffer{}
+		w := bufio.NewWriter(responses)
+		res := binprot.NewBinaryResponder(w)
+		for i := 0; i < 3; i++ {
+			res.Set(0, false)
+		}
+		w.Flush()
+
+		written := &bytes.Buffer{}
+		h := Handler{
+			rw:           bufio.NewReadWriter(bufio.NewReader(responses), bufio.NewWriter(written)),
+			chunkMaxSize: MinChunkSize,
+			pipelined:    pipelined,
+		}
+
+		cmd := common.SetRequest{Key: []byte("foo"), Data: make([]byte, MinChunkSize)}
+		if err := h.Set(cmd); err != nil {
+			t.Fatalf("Error setting: %v", err)
+		}
+		if h.rw.Reader.Buffered() != 0 || responses.Len() != 0 {
+			t.Fatalf("Expected every response to be read")
+		}
+
+		keys := setKeys(t, written)
+		if len(keys) != 3 || keys[0] != "foo-0" || keys[1] != "foo-1" || keys[2] != "foo-meta" {
+			t.Fatalf("Expected the chunks and then the metadata, got %v", keys)
+		}
+	}
+}
+
+func TestAddExistingDeletesChunks(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		responses := &bytes.Buffer{}
+		w := bufio.NewWriter(responses)
+		res := binprot.NewBinaryResponder(w)
+		res.Set(0, false)
+		res.Error(0, common.RequestAdd, common.ErrKeyExists, false)
+		res.Delete(0, false)
+		w.Flush()
+
+		written := &bytes.Buffer{}
+		h := Handler{
+			rw:           bufio.NewReadWriter(bufio.NewReader(responses), bufio.NewWriter(written)),
+			chunkMaxSize: DefaultChunkSize,
+			pipelined:    pipelined,
+		}
+
+		cmd := common.SetRequest{Key: []byte("foo"), Data: []byte("some data")}
+		if err := h.Add(cmd); err != common.ErrKeyExists {
+			t.Fatalf("Expected the add to fail, got %v", err)
+		}
+		if h.rw.Reader.Buffered() != 0 || responses.Len() != 0 {
+			t.Fatalf("Expected every response to be read")
+		}
+
+		// The chunk goes under a key of its own before the metadata and is deleted once the
+		// metadata can't be added
+		keys := setKeys(t, written)
+		if len(keys) != 3 || !strings.HasPrefix(keys[0], "foo-0-s") || keys[1] != "foo-meta" || keys[2] != "delete "+keys[0] {
+			t.Fatalf("Expected the chunk, the metadata and then a delete of the chunk, got %v", keys)
+		}
+	}
+}
+
+func TestConditionalSetKeepsOldChunks(t *testing.T) {
+	s := memcachedtest.NewServer(t)
+	h := NewHandler(s.Dial(t)).WithChunkSize(MinChunkSize)
+
+	old := bytes.Repeat([]byte("a"), 3*MinChunkSize)
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: old}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	md := storedMeta(t, s, "foo")
+
+	// The replace fails on its metadata after all of its chunks are written
+	s.SetHook(func(conn int, req common.Request) error {
+		if r, ok := req.(common.SetRequest); ok && string(r.Key) == "foo-meta" {
+			return common.ErrNoMem
+		}
+		return nil
+	})
+	value := bytes.Repeat([]byte("b"), 3*MinChunkSize)
+	if err := h.Replace(common.SetRequest{Key: []byte("foo"), Data: value}); err != common.ErrNoMem {
+		t.Fatalf("Expected the replace to fail, got %v", err)
+	}
+	s.SetHook(nil)
+
+	// The old item is untouched and the chunks of the replace are gone
+	if res := getValue(t, h, "foo"); res.Miss || !bytes.Equal(res.Data, old) {
+		t.Fatalf("Expected the old value, got miss: %v", res.Miss)
+	}
+	if n := s.Len(); n != int(md.NumChunks)+1 {
+		t.Fatalf("Expected only the old item to be stored, found %d keys", n)
+	}
+
+	if err := h.Replace(common.SetRequest{Key: []byte("foo"), Data: value}); err != nil {
+		t.Fatalf("Error replacing: %v", err)
+	}
+	if res := getValue(t, h, "foo"); res.Miss || !bytes.Equal(res.Data, value) {
+		t.Fatalf("Expected the new value, got miss: %v", res.Miss)
+	}
+}
+
+// getValue reads key through the handler
+func getValue(t *testing.T, h Handler, key string) common.GetResponse {
+	dataOut, errorOut := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	for dataOut != nil || errorOut != nil {
+		select {
+		case r, ok := <-dataOut:
+			if !ok {
+				dataOut = nil
+				continue
+			}
+			res = r
+		case err, ok := <-errorOut:
+			if !ok {
+				errorOut = nil
+				continue
+			}
+			t.Fatalf("Error getting %s: %v", key, err)
+		}
+	}
+	return res
+}
+
+func TestConcurrentAdds(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		s := memcachedtest.NewServer(t)
+		newHandler := NewHandler
+		if pipelined {
+			newHandler = NewPipelinedHandler
+		}
+		a := newHandler(s.Dial(t))
+		b := newHandler(s.Dial(t))
+
+		// b gets its first command through and then waits for a's add to finish before sending
+		// the rest of its own
+		bPaused := make(chan struct{})
+		aDone := make(chan struct{})
+		bCmds := 0
+		s.SetHook(func(conn int, req common.Request) error {
+			if conn != 1 {
+				return nil
+			}
+			if bCmds++; bCmds == 2 {
+				close(bPaused)
+				<-aDone
+			}
+			return nil
+		})
+
+		bErr := make(chan error, 1)
+		go func() {
+			bErr <- b.Add(common.SetRequest{Key: []byte("foo"), Data: bytes.Repeat([]byte("b"), 3*DefaultChunkSize)})
+		}()
+
+		<-bPaused
+		errA := a.Add(common.SetRequest{Key: []byte("foo"), Data: bytes.Repeat([]byte("a"), 3*DefaultChunkSize)})
+		close(aDone)
+		errB := <-bErr
+
+		winner := "a"
+		switch {
+		case errA == nil && errB == common.ErrKeyExists:
+		case errB == nil && errA == common.ErrKeyExists:
+			winner = "b"
+		default:
+			t.Fatalf("Expected exactly one add to succeed, got %v and %v", errA, errB)
+		}
+
+		s.SetHook(nil)
+		res := getValue(t, a, "foo")
+		if res.Miss || !bytes.Equal(res.Data, bytes.Repeat([]byte(winner), 3*DefaultChunkSize)) {
+			t.Fatalf("Expected the value of %s, got miss: %v, %d bytes", winner, res.Miss, len(res.Data))
+		}
+	}
+}
+
+func TestSetPipelinedFailure(t *testing.T) {
+	// The value takes 4 chunks, so command 4 is the metadata
+	for failed := 0; failed <= 4; failed++ {
+		s := memcachedtest.NewServer(t)
+		h := NewPipelinedHandler(s.Dial(t)).WithChunkSize(MinChunkSize)
+
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("old")}); err != nil {
+			t.Fatalf("Error setting: %v", err)
+		}
+		dataSize := int(storedMeta(t, s, "foo").ChunkSize)
+
+		sets, failed := 0, failed
+		s.SetHook(func(conn int, req common.Request) error {
+			if _, ok := req.(common.SetRequest); !ok {
+				return nil
+			}
+			if sets++; sets-1 == failed {
+				return common.ErrNoMem
+			}
+			return nil
+		})
+
+		value := bytes.Repeat([]byte("a"), 4*dataSize)
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: value}); err != common.ErrNoMem {
+			t.Fatalf("Command %d: expected the set to fail, got %v", failed, err)
+		}
+		s.SetHook(nil)
+
+		// The old metadata and every chunk that did get written are cleaned up
+		if n := s.Len(); n != 0 {
+			t.Fatalf("Command %d: expected the item to be deleted, found %d keys", failed, n)
+		}
+		if res := getValue(t, h, "foo"); !res.Miss {
+			t.Fatalf("Command %d: expected a miss, got %q", failed, res.Data)
+		}
+
+		// Every response was read, so the connection is still in sync
+		if err := h.Set(common.SetRequest{Key: []byte("bar"), Data: value}); err != nil {
+			t.Fatalf("Command %d: error setting after the failure: %v", failed, err)
+		}
+		if res := getValue(t, h, "bar"); res.Miss || !bytes.Equal(res.Data, value) {
+			t.Fatalf("Command %d: expected the next set to be read back, got miss: %v", failed, res.Miss)
+		}
+	}
+}
+
+func TestSetPipelinedConnectionLost(t *testing.T) {
+	for failed := 0; failed <= 4; failed++ {
+		s := memcachedtest.NewServer(t)
+		h := NewPipelinedHandler(s.Dial(t)).WithChunkSize(MinChunkSize)
+
+		sets, failed := 0, failed
+		s.SetHook(func(conn int, req common.Request) error {
+			if sets++; sets-1 == failed {
+				return memcachedtest.ErrClose
+			}
+			return nil
+		})
+
+		value := bytes.Repeat([]byte("a"), 4*(MinChunkSize-100))
+		err := h.Set(common.SetRequest{Key: []byte("foo"), Data: value})
+		if err == nil || common.IsAppError(err) {
+			t.Fatalf("Command %d: expected an I/O error, got %v", failed, err)
+		}
+	}
+}
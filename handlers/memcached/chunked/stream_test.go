@@ -0,0 +1,111 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+)
+
+// streamResponses builds what memcached sends back for the chunk gets of an item, padding each
+// chunk out to the chunk size, followed by the Noop that ends the batch. A nil chunk is a miss.
+func streamResponses(md metadata, chunks [][]byte) *bufio.Reader {
+	buf := &bytes.Buffer{}
+	w := bufio.NewWriter(buf)
+	res := binprot.NewBinaryResponder(w)
+
+	for _, c := range chunks {
+		if c == nil {
+			res.Error(0, common.RequestGet, common.ErrKeyNotFound, false)
+			continue
+		}
+		value := append(append([]byte(nil), md.Token[:]...), c...)
+		value = append(value, make([]byte, int(md.ChunkSize)-len(c))...)
+		res.Get(common.GetResponse{Data: value})
+	}
+	res.Noop(0)
+	w.Flush()
+
+	return bufio.NewReader(buf)
+}
+
+func TestStreamChunks(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	md := metadata{Length: uint32(len(data)), NumChunks: 3, ChunkSize: 8}
+	copy(md.Token[:], "0123456789abcdef")
+	chunks := [][]byte{data[:8], data[8:16], data[16:]}
+
+	badToken := md
+	badToken.Token[0] = 'x'
+
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		md      metadata
+		miss    bool
+		aborted bool
+	}{
+		{name: "hit", chunks: chunks, md: md},
+		{name: "first chunk missing", chunks: [][]byte{nil, chunks[1], chunks[2]}, md: md, miss: true},
+		{name: "bad token", chunks: chunks, md: badToken, miss: true},
+		{name: "middle chunk missing", chunks: [][]byte{chunks[0], nil, chunks[2]}, md: md, aborted: true},
+		{name: "short response", chunks: chunks[:2], md: md, aborted: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := streamResponses(md, test.chunks)
+			dataOut := make(chan common.GetResponse)
+			errOut := make(chan error, 1)
+			go func() {
+				errOut <- streamChunks(r, test.md, common.GetResponse{Miss: true}, dataOut)
+				close(dataOut)
+			}()
+
+			res := <-dataOut
+			if res.Miss != test.miss {
+				t.Fatalf("Expected miss to be %v", test.miss)
+			}
+			if !test.miss {
+				if res.Length != len(data) {
+					t.Fatalf("Expected a length of %d, got %d", len(data), res.Length)
+				}
+				got, err := ioutil.ReadAll(res.Stream)
+				if test.aborted {
+					if err != common.ErrStreamAborted {
+						t.Fatalf("Expected the stream to be aborted, got %v", err)
+					}
+				} else if err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("Expected %q, got %q and %v", data, got, err)
+				}
+			}
+
+			if err := <-errOut; err != nil {
+				t.Fatalf("Error streaming chunks: %v", err)
+			}
+			if _, ok := <-dataOut; ok {
+				t.Fatalf("Expected a single response")
+			}
+			if r.Buffered() != 0 {
+				t.Fatalf("Expected every response to be read, %d bytes left", r.Buffered())
+			}
+		})
+	}
+}
@@ -24,6 +24,43 @@ import (
 
 const metadataSize = 24 + tokenSize
 
+// MetricMetadataUnknownVersion counts items whose metadata was written in a layout this version
+// can't read, which are treated as misses
+var MetricMetadataUnknownVersion = metrics.AddCounter("chunked_metadata_unknown_version", nil)
+
+// Metadata is stored as a fixed header, followed by an extension for items that need more than
+// the header holds, like compressed, encrypted or checksummed ones. Other items are stored without
+// it so they can still be read by versions that don't know about it. The extension starts with a
+// version byte that says how to read the rest of it, so its layout can change without making the
+// items already in memcached unreadable. Metadata is always written in the current layout, so an
+// item that is rewritten, e.g. by an append, moves to it.
+//
+// The first extensions had no version byte and were 4 or 8 bytes long. No versioned extension may
+// be either size so those can still be told apart.
+const metadataVersion = 2
+
+// metadataExtSize is the size of the current extension. It is the version, the codec, the cipher,
+// the 2 byte key version, a byte of flags and 3 reserved bytes. The chunk hashes of a
+// deduplicated item follow it.
+const metadataExtSize = 9
+
+// flagChecksums in the extension flags means every chunk ends in a checksum
+const flagChecksums = 1 << 0
+
+// flagDedup in the extension flags means the chunks are stored under the hashes of their content
+const flagDedup = 1 << 1
+
+// flagSegments in the extension flags means some of the chunks were written by appends in place.
+// A 2 byte count of segments follows the extension and any hashes, then each segment as its 4 byte
+// first chunk and its token. Only version 2 extensions have segments.
+const flagSegments = 1 << 2
+
+// segmentSize is the size of a stored segment
+const segmentSize = 4 + tokenSize
+
+// checksumSize is the size of the CRC-32 at the end of each chunk of a checksummed item
+const checksumSize = 4
+
 type metadata struct {
 	Length    uint32
 	OrigFlags uint32
@@ -32,12 +69,147 @@ type metadata struct {
 	Instime   uint32
 	Exptime   uint32
 	Token     [tokenSize]byte
+
+	// Codec is the ID of the codec the data is compressed with, or 0 if it is not compressed.
+	// Cipher is the cipher it is then encrypted with, or 0 if it is not encrypted, and KeyVersion
+	// is the version of the key used. Length, NumChunks and ChunkSize are all for the data as it
+	// is stored.
+	Codec      uint8
+	Cipher     uint8
+	KeyVersion uint16
+	// Checksums is whether each chunk ends in a CRC-32 of the rest of its data, including any
+	// padding older items have in their last chunk
+	Checksums bool
+
+	// Dedup is whether the chunks are shared ones stored under the hashes of their content, which
+	// are in Hashes. See dedup.go.
+	Dedup  bool
+	Hashes [][tokenSize]byte
+
+	// Segments are the runs of chunks written by appends in place, in order. The chunks of a
+	// segment have its token instead of Token and are stored under keys made from it. See
+	// appendInPlace.
+	Segments []segment
+
+	// Version is the version of the extension the metadata was read with, or 0 if it had none or
+	// had one from before versions. It is not used when writing.
+	Version uint8
+
+	// CAS is the CAS value memcached has for the metadata item. It is not part of the stored
+	// record, but is filled in when the metadata is read. The CAS of the metadata doubles as
+	// the CAS for the whole chunked item.
+	CAS uint64
+}
+
+// segment is a run of chunks from Start to the start of the next segment or the end of the item
+// that were written together with their own token
+type segment struct {
+	Start uint32
+	Token [tokenSize]byte
+}
+
+// extended says whether the metadata is stored with the extension
+func (md metadata) extended() bool {
+	return md.Codec != 0 || md.Cipher != 0 || md.Checksums || md.Dedup || len(md.Segments) > 0
+}
+
+// chunkTrailer returns the size of what follows the data in each chunk
+func (md metadata) chunkTrailer() uint32 {
+	if md.Checksums {
+		return checksumSize
+	}
+	return 0
+}
+
+// size returns the size of the stored metadata
+func (md metadata) size() uint32 {
+	if md.extended() {
+		size := metadataSize + metadataExtSize + uint32(len(md.Hashes)*tokenSize)
+		if len(md.Segments) > 0 {
+			size += 2 + uint32(len(md.Segments)*segmentSize)
+		}
+		return size
+	}
+	return metadataSize
+}
+
+// extDecoders read the rest of a versioned extension, after the version byte, into the metadata.
+// They return false if the extension is too short for the version.
+var extDecoders = map[uint8]func(m *metadata, ext []byte) bool{
+	1: decodeExtV1,
+	2: decodeExtV2,
 }
 
-func readMetadata(r io.Reader) (metadata, error) {
-	buf := make([]byte, metadataSize)
+func decodeExtV1(m *metadata, ext []byte) bool {
+	if len(ext) < metadataExtSize-1 {
+		return false
+	}
+	m.Codec = ext[0]
+	m.Cipher = ext[1]
+	m.KeyVersion = binary.BigEndian.Uint16(ext[2:4])
+	m.Checksums = ext[4]&flagChecksums != 0
+
+	if ext[4]&flagDedup != 0 {
+		hashes := ext[metadataExtSize-1:]
+		if len(hashes) < int(m.NumChunks)*tokenSize {
+			return false
+		}
+		m.Dedup = true
+		m.Hashes = make([][tokenSize]byte, m.NumChunks)
+		for i := range m.Hashes {
+			copy(m.Hashes[i][:], hashes[i*tokenSize:])
+		}
+	}
+	return true
+}
+
+// decodeExtV2 reads the segments of items appended to in place, which version 1 didn't have
+func decodeExtV2(m *metadata, ext []byte) bool {
+	if !decodeExtV1(m, ext) {
+		return false
+	}
+	if ext[4]&flagSegments == 0 {
+		return true
+	}
+
+	segs := ext[metadataExtSize-1+len(m.Hashes)*tokenSize:]
+	if len(segs) < 2 {
+		return false
+	}
+	n := int(binary.BigEndian.Uint16(segs))
+	segs = segs[2:]
+	if len(segs) < n*segmentSize {
+		return false
+	}
+	m.Segments = make([]segment, n)
+	for i := range m.Segments {
+		m.Segments[i].Start = binary.BigEndian.Uint32(segs[i*segmentSize:])
+		copy(m.Segments[i].Token[:], segs[i*segmentSize+4:])
+	}
+	return true
+}
+
+// decodeExtLegacy reads an extension from before versions. Compressed and encrypted items were
+// first stored with only the first 4 bytes of it.
+func decodeExtLegacy(m *metadata, ext []byte) {
+	m.Codec = ext[0]
+	m.Cipher = ext[1]
+	m.KeyVersion = binary.BigEndian.Uint16(ext[2:4])
+	if len(ext) >= 8 {
+		m.Checksums = ext[4]&flagChecksums != 0
+	}
+}
+
+// readMetadata reads metadata that takes up length bytes in memcached. Metadata with an extension
+// version this code doesn't know is read in full and returned as common.ErrKeyNotFound, so the
+// item is a miss and the connection stays in sync.
+func readMetadata(r io.Reader, length int) (metadata, error) {
+	if length < metadataSize {
+		length = metadataSize
+	}
+	buf := make([]byte, length)
 
-	n, err := io.ReadAtLeast(r, buf, metadataSize)
+	n, err := io.ReadAtLeast(r, buf, length)
 	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 	if err != nil {
 		return emptyMeta, nil
@@ -50,7 +222,20 @@ func readMetadata(r io.Reader) (metadata, error) {
 	m.ChunkSize = binary.BigEndian.Uint32(buf[12:16])
 	m.Instime = binary.BigEndian.Uint32(buf[16:20])
 	m.Exptime = binary.BigEndian.Uint32(buf[20:24])
-	copy(m.Token[:], buf[24:])
+	copy(m.Token[:], buf[24:metadataSize])
+
+	switch ext := buf[metadataSize:]; len(ext) {
+	case 0:
+	case 4, 8:
+		decodeExtLegacy(&m, ext)
+	default:
+		decode, ok := extDecoders[ext[0]]
+		if !ok || !decode(&m, ext[1:]) {
+			metrics.IncCounter(MetricMetadataUnknownVersion)
+			return emptyMeta, common.ErrKeyNotFound
+		}
+		m.Version = ext[0]
+	}
 
 	return m, nil
 }
@@ -73,5 +258,33 @@ func writeMetadata(w io.Writer, md metadata) error {
 
 	n, err = w.Write(md.Token[:])
 	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
+	if err != nil || !md.extended() {
+		return err
+	}
+
+	ext := make([]byte, metadataExtSize)
+	ext[0] = metadataVersion
+	ext[1] = md.Codec
+	ext[2] = md.Cipher
+	binary.BigEndian.PutUint16(ext[3:5], md.KeyVersion)
+	if md.Checksums {
+		ext[5] |= flagChecksums
+	}
+	if md.Dedup {
+		ext[5] |= flagDedup
+		for _, hash := range md.Hashes {
+			ext = append(ext, hash[:]...)
+		}
+	}
+	if len(md.Segments) > 0 {
+		ext[5] |= flagSegments
+		ext = binary.BigEndian.AppendUint16(ext, uint16(len(md.Segments)))
+		for _, seg := range md.Segments {
+			ext = binary.BigEndian.AppendUint32(ext, seg.Start)
+			ext = append(ext, seg.Token[:]...)
+		}
+	}
+	n, err = w.Write(ext)
+	metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(n))
 	return err
 }
@@ -12,40 +12,337 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package memcached has the constructors for handlers that keep their data in memcached servers.
+// All of them speak the binary protocol to memcached. The chunked handler pipelines the quiet
+// gets for the chunks of an item behind a single noop, so a multi-chunk get is one round trip.
 package memcached
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
+	"time"
 
+	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/handlers"
 	"github.com/hongst/rend/handlers/memcached/chunked"
+	"github.com/hongst/rend/handlers/memcached/sharded"
 	"github.com/hongst/rend/handlers/memcached/std"
 )
 
+// Timeouts bound how long a single read from or write to memcached may take. A connection that
+// hits one is in an unknown state and should be closed, which the handlers.Reconnecting wrapper
+// does. Zero means no limit.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+// Options control how the connection to memcached is made
+type Options struct {
+	Timeouts Timeouts
+	// TCP is applied to connections to memcached over TCP
+	TCP common.TCPOptions
+	// TLS, if set, is used to connect over TLS. If it has no ServerName, the host of the address
+	// is used for SNI and to verify the certificate.
+	TLS *tls.Config
+	// ChunkSize is the size of the chunks the chunked handlers split new items into. Zero means
+	// chunked.DefaultChunkSize.
+	ChunkSize int
+	// MaxChunkSize, if set, lets the chunked handlers pick bigger chunks for bigger items, up to
+	// this size. See chunked.Handler.WithAdaptiveChunks.
+	MaxChunkSize int
+	// Codec, if set, compresses values of at least CompressMin bytes in the chunked handlers
+	// before they are split into chunks.
+	Codec       chunked.Codec
+	CompressMin int
+	// Keyring, if set, is used by the chunked handlers to encrypt values at rest
+	Keyring *chunked.Keyring
+	// Checksums makes the chunked handlers add a checksum to every chunk and check it on reads
+	Checksums bool
+	// StreamMin is the length from which the chunked handlers stream hits. Zero turns it off.
+	StreamMin int
+	// FetchConns is the number of extra connections each chunked handler opens to fetch the
+	// chunks of items with at least FetchMinChunks chunks in parallel. Zero turns it off.
+	FetchConns     int
+	FetchMinChunks int
+	// Dedup makes the chunked handlers store chunks under the hashes of their content so items
+	// with the same data share them
+	Dedup bool
+}
+
+func newChunked(conn io.ReadWriteCloser, pipelined bool, opts Options) chunked.Handler {
+	var h chunked.Handler
+	if pipelined {
+		h = chunked.NewPipelinedHandler(conn)
+	} else {
+		h = chunked.NewHandler(conn)
+	}
+	if opts.ChunkSize > 0 {
+		h = h.WithChunkSize(opts.ChunkSize)
+	}
+	if opts.MaxChunkSize > 0 {
+		h = h.WithAdaptiveChunks(opts.MaxChunkSize)
+	}
+	if opts.Codec != nil {
+		h = h.WithCompression(opts.Codec, opts.CompressMin)
+	}
+	if opts.Keyring != nil {
+		h = h.WithEncryption(opts.Keyring)
+	}
+	if opts.Checksums {
+		h = h.WithChecksums()
+	}
+	if opts.StreamMin > 0 {
+		h = h.WithStreaming(opts.StreamMin)
+	}
+	if opts.Dedup {
+		h = h.WithDedup()
+	}
+	return h
+}
+
+// withFetchConns dials the extra connections a chunked handler fetches chunks over, if any
+func withFetchConns(h chunked.Handler, sock string, opts Options) (handlers.Handler, error) {
+	if opts.FetchConns <= 0 {
+		return h, nil
+	}
+
+	conns := make([]io.ReadWriteCloser, 0, opts.FetchConns)
+	for i := 0; i < opts.FetchConns; i++ {
+		conn, err := dial(sock, opts)
+		if err != nil {
+			log.Println("Error opening connection:", err.Error())
+			for _, c := range conns {
+				c.Close()
+			}
+			h.Close()
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+
+	return h.WithParallelFetch(conns, opts.FetchMinChunks), nil
+}
+
+// NewTLSConfig returns a TLS config that trusts the CA certificates in the PEM file at caFile, or
+// the system roots if it's empty, and sends serverName for SNI if it's not empty.
+func NewTLSConfig(caFile, serverName string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: serverName}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + caFile)
+		}
+	}
+
+	return conf, nil
+}
+
+// timeoutConn sets a deadline before each read and write. Reads only happen while a response is
+// expected, so an idle connection never times out.
+type timeoutConn struct {
+	net.Conn
+	t Timeouts
+}
+
+func (c timeoutConn) Read(p []byte) (int, error) {
+	if c.t.Read > 0 {
+		c.SetReadDeadline(time.Now().Add(c.t.Read))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c timeoutConn) Write(p []byte) (int, error) {
+	if c.t.Write > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.t.Write))
+	}
+	return c.Conn.Write(p)
+}
+
+// dial connects to a TCP address if addr looks like host:port and to a unix socket otherwise
+func dial(addr string, opts Options) (net.Conn, error) {
+	network := "unix"
+	if _, _, err := net.SplitHostPort(addr); err == nil && !strings.HasPrefix(addr, "/") {
+		network = "tcp"
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+
+	if err := opts.TCP.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if opts.TLS != nil {
+		conn, err = handshake(conn, network, addr, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Timeouts.Read > 0 || opts.Timeouts.Write > 0 {
+		return timeoutConn{conn, opts.Timeouts}, nil
+	}
+	return conn, nil
+}
+
+// handshake starts TLS on the connection. The handshake is done here so a bad certificate fails
+// the connection instead of the first request. It is bounded by the read timeout, if any.
+func handshake(conn net.Conn, network, addr string, opts Options) (net.Conn, error) {
+	conf := opts.TLS
+	if conf.ServerName == "" && network == "tcp" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+
+	tconn := tls.Client(conn, conf)
+	if opts.Timeouts.Read > 0 {
+		tconn.SetDeadline(time.Now().Add(opts.Timeouts.Read))
+	}
+	if err := tconn.Handshake(); err != nil {
+		tconn.Close()
+		return nil, err
+	}
+	tconn.SetDeadline(time.Time{})
+
+	return tconn, nil
+}
+
 func Regular(sock string) handlers.HandlerConst {
+	return RegularWithOptions(sock, Options{})
+}
+
+func RegularWithOptions(sock string, opts Options) handlers.HandlerConst {
 	return func() (handlers.Handler, error) {
-		conn, err := net.Dial("unix", sock)
+		conn, err := dial(sock, opts)
 		if err != nil {
-			if conn != nil {
-				conn.Close()
-			}
 			return nil, err
 		}
 		return std.NewHandler(conn), nil
 	}
 }
 
+// Multiplexed sends the requests of all of the handlers it creates over at most conns connections
+// to the memcached at sock, pipelining them instead of opening a connection for each handler.
+// The connections are made when first needed and made again if they fail.
+func Multiplexed(sock string, conns int) handlers.HandlerConst {
+	return MultiplexedWithOptions(sock, conns, Options{})
+}
+
+func MultiplexedWithOptions(sock string, conns int, opts Options) handlers.HandlerConst {
+	m := std.NewMux(func() (io.ReadWriteCloser, error) {
+		return dial(sock, opts)
+	}, conns)
+	return func() (handlers.Handler, error) {
+		return m.Handler(), nil
+	}
+}
+
 func Chunked(sock string) handlers.HandlerConst {
+	return ChunkedWithOptions(sock, Options{})
+}
+
+func ChunkedWithOptions(sock string, opts Options) handlers.HandlerConst {
 	return func() (handlers.Handler, error) {
-		conn, err := net.Dial("unix", sock)
+		conn, err := dial(sock, opts)
+		if err != nil {
+			log.Println("Error opening connection:", err.Error())
+			return nil, err
+		}
+		return withFetchConns(newChunked(conn, false, opts), sock, opts)
+	}
+}
+
+// ChunkedPipelined is the same as Chunked, except that the chunks of a set are sent to
+// memcached all at once instead of one round trip at a time.
+func ChunkedPipelined(sock string) handlers.HandlerConst {
+	return ChunkedPipelinedWithOptions(sock, Options{})
+}
+
+func ChunkedPipelinedWithOptions(sock string, opts Options) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		conn, err := dial(sock, opts)
 		if err != nil {
 			log.Println("Error opening connection:", err.Error())
-			if conn != nil {
-				conn.Close()
-			}
 			return nil, err
 		}
-		return chunked.NewHandler(conn), nil
+		return withFetchConns(newChunked(conn, true, opts), sock, opts)
+	}
+}
+
+// StartChunkJanitor sweeps the memcached at sock for orphaned chunks every interval in the
+// background. It deletes every key that looks like a chunk but isn't part of an item, so that
+// memcached must hold nothing but data written by the chunked handlers. See chunked.Sweep.
+func StartChunkJanitor(sock string, interval time.Duration, opts Options) {
+	chunked.StartJanitor(func() (io.ReadWriteCloser, error) {
+		return dial(sock, opts)
+	}, interval)
+}
+
+// Sharded spreads keys across the memcached servers at the given addresses with consistent
+// hashing. All of the handlers it creates share the health of the servers, so a server that
+// fails is taken out for every connection at once.
+func Sharded(addrs []string) handlers.HandlerConst {
+	return ShardedWithConfig(addrs, sharded.DefaultConfig)
+}
+
+func ShardedWithConfig(addrs []string, conf sharded.Config) handlers.HandlerConst {
+	cluster := sharded.NewCluster(addrs, conf)
+	return func() (handlers.Handler, error) {
+		return sharded.NewHandler(cluster), nil
+	}
+}
+
+// ShardedAutoDiscovered shards keys across the nodes of an AWS ElastiCache memcached cluster,
+// found through the cluster's configuration endpoint. The nodes are fetched again every interval
+// so that nodes added to or removed from the cluster are picked up.
+func ShardedAutoDiscovered(endpoint string, interval time.Duration, conf sharded.Config) handlers.HandlerConst {
+	cluster := sharded.NewCluster(nil, conf)
+	sharded.AutoDiscover(cluster, endpoint, interval)
+	return func() (handlers.Handler, error) {
+		return sharded.NewHandler(cluster), nil
+	}
+}
+
+// ShardedWatched shards keys across the backends given by src, which is asked for them again every
+// interval so the cluster follows backends as they come and go.
+func ShardedWatched(src sharded.Source, interval time.Duration, conf sharded.Config) handlers.HandlerConst {
+	cluster := sharded.NewCluster(nil, conf)
+	sharded.Watch(cluster, src, interval)
+	return func() (handlers.Handler, error) {
+		return sharded.NewHandler(cluster), nil
+	}
+}
+
+// ShardedDiscovered is like ShardedWithConfig, but the names are host:port pairs whose hostnames
+// are resolved again every interval. Backends are added to and removed from the cluster as the
+// set of addresses they resolve to changes.
+func ShardedDiscovered(names []string, interval time.Duration, conf sharded.Config) handlers.HandlerConst {
+	cluster := sharded.NewCluster(nil, conf)
+	sharded.Discover(cluster, names, interval)
+	return func() (handlers.Handler, error) {
+		return sharded.NewHandler(cluster), nil
 	}
 }
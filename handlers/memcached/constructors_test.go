@@ -0,0 +1,250 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memcached_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+	"github.com/hongst/rend/handlers/memcached"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/server"
+)
+
+func TestReadTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rend-timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The server accepts connections and reads requests, but never answers them
+	sock := filepath.Join(dir, "memcached.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go ioutil.ReadAll(conn)
+		}
+	}()
+
+	hc := memcached.RegularWithOptions(sock, memcached.Options{
+		Timeouts: memcached.Timeouts{Read: 20 * time.Millisecond},
+	})
+	h, err := handlers.Reconnecting(hc)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	start := time.Now()
+	err = h.Touch(common.TouchRequest{Key: []byte("foo")})
+	if err != common.ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the request to time out quickly, took %v", d)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	// Borrow the test certificate from an HTTPS test server
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "rend-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Answer one version request
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req := make([]byte, 24)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+
+		version := "1.6.0"
+		res := make([]byte, 24+len(version))
+		res[0] = 0x81
+		res[1] = req[1]
+		binary.BigEndian.PutUint32(res[8:], uint32(len(version)))
+		copy(res[12:16], req[12:16])
+		copy(res[24:], version)
+		conn.Write(res)
+	}()
+
+	conf, err := memcached.NewTLSConfig(caFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := memcached.RegularWithOptions(l.Addr().String(), memcached.Options{TLS: conf})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	v, err := h.Version()
+	if err != nil || v != "1.6.0" {
+		t.Fatalf("Version: %q, %v", v, err)
+	}
+}
+
+func TestMultiplexed(t *testing.T) {
+	// Rend itself over an in-memory L1 stands in for memcached
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	l := server.ListenArgs{Type: server.ListenTCP, Port: port}
+	go server.ListenAndServe(l, server.Default, orcas.L1Only, inmem.New, handlers.NilHandler)
+
+	addr := ln.Addr().String()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("Listener on %s never started", addr)
+		}
+	}
+
+	hc := memcached.Multiplexed(addr, 2)
+
+	// Many handlers at once, each of which must only ever see the responses to its own requests
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			h, err := hc()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer h.Close()
+
+			for j := 0; j < 50; j++ {
+				key := []byte(fmt.Sprintf("mux-%d-%d", i, j))
+				if err := h.Set(common.SetRequest{Key: key, Data: key}); err != nil {
+					t.Errorf("Set %s: %v", key, err)
+					return
+				}
+
+				res, err := h.GAT(common.GATRequest{Key: key})
+				if err != nil || res.Miss || !bytes.Equal(res.Data, key) {
+					t.Errorf("GAT %s: %q, %v", key, res.Data, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// A multiget bigger than a batch
+	h, err := hc()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys [][]byte
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 50; j += 4 {
+			keys = append(keys, []byte(fmt.Sprintf("mux-%d-%d", i, j)))
+		}
+	}
+	keys = append(keys, []byte("mux-missing"))
+
+	dataOut, errorOut := h.Get(common.GetRequest{
+		Keys:    keys,
+		Opaques: make([]uint32, len(keys)),
+		Quiet:   make([]bool, len(keys)),
+	})
+
+	var n int
+	for dataOut != nil || errorOut != nil {
+		select {
+		case res, ok := <-dataOut:
+			if !ok {
+				dataOut = nil
+				continue
+			}
+			if !bytes.Equal(res.Key, keys[n]) {
+				t.Fatalf("Expected %s, got %s", keys[n], res.Key)
+			}
+			if last := n == len(keys)-1; res.Miss != last || (!last && !bytes.Equal(res.Data, res.Key)) {
+				t.Fatalf("Wrong response for %s: %+v", res.Key, res)
+			}
+			n++
+		case err, ok := <-errorOut:
+			if !ok {
+				errorOut = nil
+				continue
+			}
+			t.Fatal(err)
+		}
+	}
+	if n != len(keys) {
+		t.Fatalf("Expected %d responses, got %d", len(keys), n)
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memcachedtest has an in-memory memcached that speaks the binary protocol, for testing
+// the handlers that talk to memcached. Failures can be injected per command to check how the
+// handlers recover from them.
+package memcachedtest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+)
+
+// ErrClose, returned from a Hook, closes the connection instead of answering the command
+var ErrClose = errors.New("memcachedtest: close the connection")
+
+// Hook is called with the number of the connection, counting from 0 in the order they were
+// accepted, and each command before it is handled. An error it returns is sent back instead of
+// handling the command. It may block to hold up the connection.
+type Hook func(conn int, req common.Request) error
+
+type item struct {
+	data  []byte
+	flags uint32
+	cas   uint64
+}
+
+// Server is a fake memcached listening on a local TCP port
+type Server struct {
+	listener net.Listener
+
+	lock    sync.Mutex
+	hook    Hook
+	items   map[string]item
+	nextCAS uint64
+	conns   int
+}
+
+// NewServer starts a Server that is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake memcached: %v", err)
+	}
+
+	s := &Server{
+		listener: l,
+		items:    make(map[string]item),
+	}
+	go s.accept()
+	t.Cleanup(func() { l.Close() })
+
+	return s
+}
+
+// Addr returns the address the Server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Dial opens a connection to the Server that is closed when the test ends
+func (s *Server) Dial(t testing.TB) net.Conn {
+	conn, err := net.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatalf("Error connecting to fake memcached: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// SetHook sets the hook that every command goes through. nil removes it.
+func (s *Server) SetHook(h Hook) {
+	s.lock.Lock()
+	s.hook = h
+	s.lock.Unlock()
+}
+
+// Get returns the value stored under key
+func (s *Server) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	it, ok := s.items[key]
+	return it.data, ok
+}
+
+// Put stores a value under key directly, bypassing the hook
+func (s *Server) Put(key string, data []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.store(key, append([]byte(nil), data...), 0)
+}
+
+// Len returns the number of keys stored
+func (s *Server) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.items)
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.lock.Lock()
+		id := s.conns
+		s.conns++
+		s.lock.Unlock()
+
+		go s.serve(conn, id)
+	}
+}
+
+func (s *Server) serve(conn net.Conn, id int) {
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	p, res := binprot.NewBinaryParserResponder(bufio.NewReader(conn), w)
+
+	for {
+		req, reqType, _, err := p.Parse()
+		if err != nil {
+			return
+		}
+		if set, ok := req.(common.SetRequest); ok && set.Stream != nil {
+			if req, err = common.BufferValue(set); err != nil {
+				return
+			}
+		}
+
+		s.lock.Lock()
+		hook := s.hook
+		s.lock.Unlock()
+
+		if hook != nil {
+			if err := hook(id, req); err == ErrClose {
+				return
+			} else if err != nil {
+				if s.fail(res, req, reqType, err) != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		if s.handle(res, req, reqType) != nil {
+			return
+		}
+		if _, ok := req.(common.QuitRequest); ok {
+			w.Flush()
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// fail answers a command with err. Every key of a get gets the error.
+func (s *Server) fail(res binprot.BinaryResponder, req common.Request, reqType common.RequestType, err error) error {
+	if get, ok := req.(common.GetRequest); ok {
+		for _, opaque := range get.Opaques {
+			if rerr := res.Error(opaque, reqType, err, false); rerr != nil {
+				return rerr
+			}
+		}
+		return res.GetEnd(get.NoopOpaque, get.NoopEnd)
+	}
+	return res.Error(req.GetOpaque(), reqType, err, false)
+}
+
+func (s *Server) handle(res binprot.BinaryResponder, req common.Request, reqType common.RequestType) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch r := req.(type) {
+	case common.SetRequest:
+		if err := s.set(r, reqType); err != nil {
+			return res.Error(r.Opaque, reqType, err, false)
+		}
+		switch reqType {
+		case common.RequestAdd:
+			return res.Add(r.Opaque, r.Quiet)
+		case common.RequestReplace:
+			return res.Replace(r.Opaque, r.Quiet)
+		case common.RequestAppend:
+			return res.Append(r.Opaque, r.Quiet)
+		case common.RequestPrepend:
+			return res.Prepend(r.Opaque, r.Quiet)
+		}
+		return res.Set(r.Opaque, r.Quiet)
+
+	case common.GetRequest:
+		for i, key := range r.Keys {
+			it, ok := s.items[string(key)]
+			var err error
+			if reqType == common.RequestGetE {
+				err = res.GetE(common.GetEResponse{
+					Key:    key,
+					Data:   it.data,
+					Flags:  it.flags,
+					Cas:    it.cas,
+					Opaque: r.Opaques[i],
+					Quiet:  r.Quiet[i],
+					Miss:   !ok,
+				})
+			} else {
+				err = res.Get(common.GetResponse{
+					Key:    key,
+					Data:   it.data,
+					Flags:  it.flags,
+					Cas:    it.cas,
+					Opaque: r.Opaques[i],
+					Quiet:  r.Quiet[i],
+					Miss:   !ok,
+				})
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return res.GetEnd(r.NoopOpaque, r.NoopEnd)
+
+	case common.GATRequest:
+		it, ok := s.items[string(r.Key)]
+		return res.GAT(common.GetResponse{
+			Key:    r.Key,
+			Data:   it.data,
+			Flags:  it.flags,
+			Cas:    it.cas,
+			Opaque: r.Opaque,
+			Quiet:  r.Quiet,
+			Miss:   !ok,
+		})
+
+	case common.DeleteRequest:
+		it, ok := s.items[string(r.Key)]
+		if !ok {
+			return res.Error(r.Opaque, reqType, common.ErrKeyNotFound, false)
+		}
+		if r.Cas != 0 && r.Cas != it.cas {
+			return res.Error(r.Opaque, reqType, common.ErrKeyExists, false)
+		}
+		delete(s.items, string(r.Key))
+		return res.Delete(r.Opaque, r.Quiet)
+
+	case common.TouchRequest:
+		if _, ok := s.items[string(r.Key)]; !ok {
+			return res.Error(r.Opaque, reqType, common.ErrKeyNotFound, false)
+		}
+		return res.Touch(r.Opaque)
+
+	case common.IncrDecrRequest:
+		value, err := s.incrDecr(r, reqType)
+		if err != nil {
+			return res.Error(r.Opaque, reqType, err, false)
+		}
+		if reqType == common.RequestDecr {
+			return res.Decr(r.Opaque, value, r.Quiet)
+		}
+		return res.Incr(r.Opaque, value, r.Quiet)
+
+	case common.NoopRequest:
+		return res.Noop(r.Opaque)
+
+	case common.VersionRequest:
+		return res.Version(r.Opaque, "1.6.0")
+
+	case common.FlushRequest:
+		s.items = make(map[string]item)
+		return res.Flush(r.Opaque, r.Quiet)
+
+	case common.QuitRequest:
+		return res.Quit(r.Opaque, r.Quiet)
+	}
+
+	return res.Error(req.GetOpaque(), reqType, common.ErrUnknownCmd, false)
+}
+
+func (s *Server) set(r common.SetRequest, reqType common.RequestType) error {
+	it, ok := s.items[string(r.Key)]
+
+	switch {
+	case reqType == common.RequestAdd && ok:
+		return common.ErrKeyExists
+	case reqType == common.RequestReplace && !ok:
+		return common.ErrKeyNotFound
+	case (reqType == common.RequestAppend || reqType == common.RequestPrepend) && !ok:
+		return common.ErrItemNotStored
+	case r.Cas != 0 && !ok:
+		return common.ErrKeyNotFound
+	case r.Cas != 0 && r.Cas != it.cas:
+		return common.ErrKeyExists
+	}
+
+	data := append([]byte(nil), r.Data...)
+	flags := r.Flags
+	switch reqType {
+	case common.RequestAppend:
+		data = append(append([]byte(nil), it.data...), r.Data...)
+		flags = it.flags
+	case common.RequestPrepend:
+		data = append(data, it.data...)
+		flags = it.flags
+	}
+
+	s.store(string(r.Key), data, flags)
+	return nil
+}
+
+func (s *Server) incrDecr(r common.IncrDecrRequest, reqType common.RequestType) (uint64, error) {
+	it, ok := s.items[string(r.Key)]
+	if !ok {
+		if r.Exptime == 0xffffffff {
+			return 0, common.ErrKeyNotFound
+		}
+		s.store(string(r.Key), []byte(strconv.FormatUint(r.Initial, 10)), 0)
+		return r.Initial, nil
+	}
+
+	value, err := strconv.ParseUint(string(it.data), 10, 64)
+	if err != nil {
+		return 0, common.ErrBadIncDecValue
+	}
+	if reqType == common.RequestDecr {
+		if r.Delta > value {
+			value = 0
+		} else {
+			value -= r.Delta
+		}
+	} else {
+		value += r.Delta
+	}
+
+	s.store(string(r.Key), []byte(strconv.FormatUint(value, 10)), it.flags)
+	return value, nil
+}
+
+// store must be called with the lock held
+func (s *Server) store(key string, data []byte, flags uint32) {
+	s.nextCAS++
+	s.items[key] = item{data: data, flags: flags, cas: s.nextCAS}
+}
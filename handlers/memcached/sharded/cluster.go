@@ -0,0 +1,307 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricBackendFailures = metrics.AddCounter("sharded_backend_failures", nil)
+	MetricEjections       = metrics.AddCounter("sharded_ejections", nil)
+	MetricRestores        = metrics.AddCounter("sharded_restores", nil)
+	MetricAllEjected      = metrics.AddCounter("sharded_all_ejected", nil)
+
+	// MetricBackendEvents counts the failures, ejections and restores of each backend
+	MetricBackendEvents = metrics.AddCounterFamily("sharded_backend_events", "backend", "event")
+)
+
+// Config holds the health checking settings for a cluster
+type Config struct {
+	// FailureLimit is the number of consecutive failures after which a backend is taken out of
+	// the ring. Its keys are rehashed onto the remaining backends.
+	FailureLimit int
+	// RetryTimeout is how long an ejected backend stays out of the ring. After that it is put
+	// back and gets its keys again. If it still fails, it is ejected again.
+	RetryTimeout time.Duration
+	// TLS, if set, is used to connect to every backend. Each backend's host is used for SNI and
+	// to verify its certificate unless ServerName is set.
+	TLS *tls.Config
+	// TCP is applied to connections to backends over TCP
+	TCP common.TCPOptions
+}
+
+// DefaultConfig ejects a backend after 3 failures in a row and retries it after 30 seconds
+var DefaultConfig = Config{
+	FailureLimit: 3,
+	RetryTimeout: 30 * time.Second,
+}
+
+type health struct {
+	failures     int
+	ejectedUntil time.Time
+}
+
+// Cluster is the set of backends that keys are sharded across. It is shared by the handlers of
+// all connections so they agree on which backends are healthy.
+type Cluster struct {
+	conf  Config
+	addrs []string
+	all   *ring
+	now   func() time.Time
+
+	// gen changes every time the set of backends does, so handlers know to drop connections to
+	// backends that are gone. Read atomically.
+	gen uint64
+
+	mu      sync.Mutex
+	health  map[string]*health
+	ejected int
+	live    *ring
+}
+
+// NewCluster creates a cluster of the backends at the given addresses. An address starting with
+// a / is a unix domain socket, anything else is a TCP host:port.
+func NewCluster(addrs []string, conf Config) *Cluster {
+	h := make(map[string]*health)
+	for _, addr := range addrs {
+		h[addr] = &health{}
+	}
+
+	r := newRing(addrs)
+
+	c := &Cluster{
+		conf:   conf,
+		addrs:  addrs,
+		all:    r,
+		now:    time.Now,
+		health: h,
+		live:   r,
+	}
+	metrics.RegisterHealthCallback(c.backendHealth)
+
+	return c
+}
+
+// backendHealth reports each backend as healthy unless it is ejected from the ring
+func (c *Cluster) backendHealth() []metrics.BackendHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ret := make([]metrics.BackendHealth, 0, len(c.addrs))
+	for _, addr := range c.addrs {
+		h := c.health[addr]
+		ret = append(ret, metrics.BackendHealth{
+			Addr:     addr,
+			Healthy:  h.ejectedUntil.IsZero(),
+			Failures: h.failures,
+		})
+	}
+	return ret
+}
+
+func (c *Cluster) dial(addr string) (io.ReadWriteCloser, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.conf.TCP.Apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if c.conf.TLS == nil {
+		return conn, nil
+	}
+
+	conf := c.conf.TLS
+	if conf.ServerName == "" && network == "tcp" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conf = conf.Clone()
+		conf.ServerName = host
+	}
+	tconn := tls.Client(conn, conf)
+	if err := tconn.Handshake(); err != nil {
+		tconn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// SetAddrs changes the set of backends. Backends that stay keep their health, new ones start out
+// healthy and the keys of removed ones are rehashed onto the rest.
+func (c *Cluster) SetAddrs(addrs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hs := make(map[string]*health, len(addrs))
+	ejected := 0
+	for _, addr := range addrs {
+		h, ok := c.health[addr]
+		if !ok {
+			h = &health{}
+		}
+		if !h.ejectedUntil.IsZero() {
+			ejected++
+		}
+		hs[addr] = h
+	}
+
+	c.addrs = addrs
+	c.health = hs
+	c.ejected = ejected
+	c.all = newRing(addrs)
+	c.rebuild()
+
+	atomic.AddUint64(&c.gen, 1)
+}
+
+// members returns the generation of the set of backends and the backends in it
+func (c *Cluster) members() (uint64, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return atomic.LoadUint64(&c.gen), c.addrs
+}
+
+// pick returns the backend for the key among the ones currently in the ring
+func (c *Cluster) pick(key []byte) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ejected > 0 {
+		c.restoreExpired()
+	}
+
+	return c.live.lookup(key)
+}
+
+// liveAddrs returns the backends currently in the ring, for commands that go to every backend
+func (c *Cluster) liveAddrs() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ejected > 0 {
+		c.restoreExpired()
+	}
+
+	return c.inRing()
+}
+
+// inRing returns the backends that aren't ejected. If every backend has been ejected, all of
+// them are used so requests still have somewhere to go. c.mu must be held.
+func (c *Cluster) inRing() []string {
+	if c.ejected == 0 || c.ejected == len(c.addrs) {
+		return c.addrs
+	}
+
+	var addrs []string
+	for _, addr := range c.addrs {
+		if c.health[addr].ejectedUntil.IsZero() {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// restoreExpired puts back the ejected backends whose retry timeout has passed. c.mu must be held.
+func (c *Cluster) restoreExpired() {
+	now := c.now()
+	restored := false
+
+	for addr, h := range c.health {
+		if !h.ejectedUntil.IsZero() && !now.Before(h.ejectedUntil) {
+			log.Println("Restoring backend", addr, "to the ring")
+			metrics.IncCounter(MetricRestores)
+			MetricBackendEvents.Inc(addr, "restore")
+			h.ejectedUntil = time.Time{}
+			h.failures = 0
+			c.ejected--
+			restored = true
+		}
+	}
+
+	if restored {
+		c.rebuild()
+	}
+}
+
+// rebuild makes the ring out of the backends that aren't ejected. c.mu must be held.
+func (c *Cluster) rebuild() {
+	switch c.ejected {
+	case 0:
+		c.live = c.all
+	case len(c.addrs):
+		metrics.IncCounter(MetricAllEjected)
+		c.live = c.all
+	default:
+		c.live = newRing(c.inRing())
+	}
+}
+
+// failed records a failed request to the backend and ejects it from the ring once it has failed
+// too many times in a row
+func (c *Cluster) failed(addr string) {
+	metrics.IncCounter(MetricBackendFailures)
+	MetricBackendEvents.Inc(addr, "failure")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The backend may have been removed since the request started
+	h, ok := c.health[addr]
+	if !ok || !h.ejectedUntil.IsZero() {
+		return
+	}
+
+	h.failures++
+	if h.failures < c.conf.FailureLimit {
+		return
+	}
+
+	log.Println("Ejecting backend", addr, "from the ring after", h.failures, "failures")
+	metrics.IncCounter(MetricEjections)
+	MetricBackendEvents.Inc(addr, "ejection")
+	h.ejectedUntil = c.now().Add(c.conf.RetryTimeout)
+	c.ejected++
+	c.rebuild()
+}
+
+// succeeded resets the failure count of the backend
+func (c *Cluster) succeeded(addr string) {
+	c.mu.Lock()
+	if h, ok := c.health[addr]; ok {
+		h.failures = 0
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ConsulConfig says which Consul service holds the backends of a cluster
+type ConsulConfig struct {
+	// Addr is the base URL of the Consul agent's HTTP API, e.g. http://127.0.0.1:8500
+	Addr    string
+	Service string
+	// Tag, if set, limits the backends to instances of the service with this tag
+	Tag        string
+	Datacenter string
+	// Token is the ACL token sent with every request. Not sent if empty.
+	Token string
+}
+
+// Consul is a Source that gives the instances of a Consul service that pass their health checks
+type Consul struct {
+	conf   ConsulConfig
+	client *http.Client
+}
+
+func NewConsul(conf ConsulConfig) *Consul {
+	conf.Addr = strings.TrimSuffix(conf.Addr, "/")
+	return &Consul{
+		conf:   conf,
+		client: &http.Client{Timeout: DiscoveryTimeout},
+	}
+}
+
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+func (c *Consul) Backends() ([]string, error) {
+	q := url.Values{}
+	q.Set("passing", "true")
+	if c.conf.Tag != "" {
+		q.Set("tag", c.conf.Tag)
+	}
+	if c.conf.Datacenter != "" {
+		q.Set("dc", c.conf.Datacenter)
+	}
+
+	req, err := http.NewRequest("GET", c.conf.Addr+"/v1/health/service/"+url.PathEscape(c.conf.Service)+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.conf.Token != "" {
+		req.Header.Set("X-Consul-Token", c.conf.Token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("Consul service %s: %s", c.conf.Service, res.Status)
+	}
+
+	var entries []consulEntry
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, e := range entries {
+		// The service address is empty when it's the same as the node's
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+	}
+
+	return addrs, nil
+}
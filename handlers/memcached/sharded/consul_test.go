@@ -0,0 +1,55 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConsul(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/memcached" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("passing") != "true" || r.URL.Query().Get("tag") != "l1" {
+			t.Errorf("Unexpected query %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			t.Errorf("Expected the ACL token, got %q", r.Header.Get("X-Consul-Token"))
+		}
+		w.Write([]byte(`[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 11211}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.1.0.2", "Port": 11212}}
+		]`))
+	}))
+	defer srv.Close()
+
+	c := NewConsul(ConsulConfig{Addr: srv.URL + "/", Service: "memcached", Tag: "l1", Token: "secret"})
+	addrs, err := c.Backends()
+	if err != nil {
+		t.Fatalf("Error getting backends: %v", err)
+	}
+	if want := []string{"10.0.0.1:11211", "10.1.0.2:11212"}; !equal(addrs, want) {
+		t.Fatalf("Expected %v, got %v", want, addrs)
+	}
+
+	c = NewConsul(ConsulConfig{Addr: srv.URL, Service: "other"})
+	if _, err := c.Backends(); err == nil {
+		t.Fatal("Expected an error for a failed request")
+	}
+}
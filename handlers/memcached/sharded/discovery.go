@@ -0,0 +1,159 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricDiscoveryChanges = metrics.AddCounter("sharded_discovery_changes", nil)
+	MetricDiscoveryErrors  = metrics.AddCounter("sharded_discovery_errors", nil)
+)
+
+// DiscoveryTimeout is the longest a discovery source may take to answer
+var DiscoveryTimeout = 5 * time.Second
+
+// Source gives the current set of backends for a cluster, e.g. from DNS or a service registry
+type Source interface {
+	// Backends returns the addresses of all of the backends
+	Backends() ([]string, error)
+}
+
+// Watch keeps the backends of the cluster in sync with the source. The source is asked for the
+// backends before Watch returns and again every interval after that, and the cluster's backends
+// are changed whenever they differ from the last set. If the source fails, the cluster is left
+// as it is until the next try.
+func Watch(c *Cluster, src Source, interval time.Duration) {
+	w := &watcher{
+		c:   c,
+		src: src,
+	}
+	w.refresh()
+
+	go func() {
+		for range time.Tick(interval) {
+			w.refresh()
+		}
+	}()
+}
+
+type watcher struct {
+	c   *Cluster
+	src Source
+	// last is the last set of backends given to the cluster
+	last []string
+}
+
+func (w *watcher) refresh() {
+	addrs, err := w.src.Backends()
+	if err != nil {
+		log.Println("Error getting backends:", err.Error())
+		metrics.IncCounter(MetricDiscoveryErrors)
+		return
+	}
+
+	addrs = dedupe(addrs)
+	if equal(addrs, w.last) {
+		return
+	}
+
+	log.Println("Backends changed to", strings.Join(addrs, ","))
+	metrics.IncCounter(MetricDiscoveryChanges)
+	w.c.SetAddrs(addrs)
+	w.last = addrs
+}
+
+// Discover keeps the backends of the cluster in sync with DNS. Each name is a host:port whose host
+// is resolved every interval, and the cluster gets one backend for each address it resolves to.
+// Names that are already IP addresses or unix socket paths are used as they are. This lets the
+// backends behind something like a Kubernetes headless service change without a restart.
+//
+// When connecting with TLS, the config should have a ServerName, since the backends are dialed
+// by IP address.
+func Discover(c *Cluster, names []string, interval time.Duration) {
+	Watch(c, &dnsSource{
+		names:   names,
+		resolve: net.LookupHost,
+	}, interval)
+}
+
+type dnsSource struct {
+	names   []string
+	resolve func(host string) ([]string, error)
+}
+
+// Backends returns the addresses of all of the backends the names resolve to
+func (d *dnsSource) Backends() ([]string, error) {
+	var addrs []string
+
+	for _, name := range d.names {
+		if strings.HasPrefix(name, "/") {
+			addrs = append(addrs, name)
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(name)
+		if err != nil {
+			return nil, err
+		}
+
+		ips := []string{host}
+		if net.ParseIP(host) == nil {
+			ips, err = d.resolve(host)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+
+	return addrs, nil
+}
+
+// dedupe returns the addresses sorted and without duplicates
+func dedupe(addrs []string) []string {
+	seen := make(map[string]bool, len(addrs))
+	var ret []string
+	for _, addr := range addrs {
+		if !seen[addr] {
+			seen[addr] = true
+			ret = append(ret, addr)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	c := NewCluster(nil, Config{FailureLimit: 1, RetryTimeout: time.Minute})
+
+	records := map[string][]string{
+		"memcached.svc": {"10.0.0.2", "10.0.0.1"},
+	}
+	var resolveErr error
+
+	d := &watcher{
+		c: c,
+		src: &dnsSource{
+			names: []string{"memcached.svc:11211", "10.0.0.9:11211"},
+			resolve: func(host string) ([]string, error) {
+				return records[host], resolveErr
+			},
+		},
+	}
+
+	d.refresh()
+	want := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.9:11211"}
+	if _, addrs := c.members(); !equal(addrs, want) {
+		t.Fatalf("Expected %v, got %v", want, addrs)
+	}
+
+	// Backends that stay keep their health
+	c.failed("10.0.0.1:11211")
+	gen, _ := c.members()
+
+	records["memcached.svc"] = []string{"10.0.0.1", "10.0.0.3"}
+	d.refresh()
+
+	newGen, addrs := c.members()
+	want = []string{"10.0.0.1:11211", "10.0.0.3:11211", "10.0.0.9:11211"}
+	if !equal(addrs, want) {
+		t.Fatalf("Expected %v, got %v", want, addrs)
+	}
+	if newGen == gen {
+		t.Fatal("Expected the generation to change")
+	}
+	if live := c.liveAddrs(); len(live) != 2 {
+		t.Fatalf("Expected the ejected backend to stay out of the ring, got %v", live)
+	}
+
+	// A failed lookup leaves the backends alone
+	resolveErr = errors.New("no such host")
+	d.refresh()
+	if _, addrs := c.members(); !equal(addrs, want) {
+		t.Fatalf("Expected %v after a failed lookup, got %v", want, addrs)
+	}
+
+	// Removed backends don't trip up requests that were already on their way
+	c.failed("10.0.0.2:11211")
+	c.succeeded("10.0.0.2:11211")
+}
+
+func TestEmptyCluster(t *testing.T) {
+	c := NewCluster(nil, DefaultConfig)
+	h := NewHandler(c)
+
+	if _, err := h.Version(); err == nil {
+		t.Fatal("Expected an error with no backends")
+	}
+	if _, _, err := h.backend([]byte("foo")); err == nil {
+		t.Fatal("Expected an error with no backends")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadClusterConfig = errors.New("Bad cluster config response")
+
+// AutoDiscover keeps the backends of the cluster in sync with an AWS ElastiCache memcached
+// cluster. Every interval the configuration endpoint is asked for the nodes in the cluster with
+// "config get cluster", and the cluster's backends are changed when they do. The cluster is
+// bootstrapped before AutoDiscover returns if the endpoint answers.
+//
+// Nodes are dialed by IP address, or by hostname if the cluster uses TLS so their certificates
+// can be verified.
+func AutoDiscover(c *Cluster, endpoint string, interval time.Duration) {
+	Watch(c, &elastiCache{
+		c:        c,
+		endpoint: endpoint,
+	}, interval)
+}
+
+type elastiCache struct {
+	// c is used to connect to the endpoint the same way as to the nodes
+	c        *Cluster
+	endpoint string
+}
+
+// Backends returns the nodes of the cluster the configuration endpoint knows about
+func (e *elastiCache) Backends() ([]string, error) {
+	conn, err := e.c.dial(e.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if dc, ok := conn.(interface {
+		SetDeadline(time.Time) error
+	}); ok {
+		dc.SetDeadline(time.Now().Add(DiscoveryTimeout))
+	}
+
+	if _, err := io.WriteString(conn, "config get cluster\r\n"); err != nil {
+		return nil, err
+	}
+
+	_, addrs, err := readClusterConfig(bufio.NewReader(conn), e.c.conf.TLS != nil)
+	return addrs, err
+}
+
+// readClusterConfig parses the response to "config get cluster", which looks like:
+//
+//	CONFIG cluster 0 <length>\r\n
+//	<version>\n
+//	<hostname>|<ip>|<port> <hostname>|<ip>|<port> ...\n
+//	\r\n
+//	END\r\n
+//
+// The returned addresses are sorted and use the hostnames of the nodes if byName is true, their
+// IP addresses otherwise.
+func readClusterConfig(r *bufio.Reader, byName bool) (int, []string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 1 && strings.HasSuffix(fields[0], "ERROR") {
+		return 0, nil, fmt.Errorf("Endpoint does not support config get cluster: %s", strings.TrimSpace(line))
+	}
+	if len(fields) != 4 || fields[0] != "CONFIG" || fields[1] != "cluster" {
+		return 0, nil, errBadClusterConfig
+	}
+
+	length, err := strconv.Atoi(fields[3])
+	if err != nil || length < 0 {
+		return 0, nil, errBadClusterConfig
+	}
+
+	// The data and the \r\n and END\r\n that follow it
+	buf := make([]byte, length+len("\r\nEND\r\n"))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, err
+	}
+	if string(buf[length:]) != "\r\nEND\r\n" {
+		return 0, nil, errBadClusterConfig
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(buf[:length])), "\n")
+	if len(lines) != 2 {
+		return 0, nil, errBadClusterConfig
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return 0, nil, errBadClusterConfig
+	}
+
+	var addrs []string
+	for _, node := range strings.Fields(lines[1]) {
+		parts := strings.Split(node, "|")
+		if len(parts) != 3 {
+			return 0, nil, errBadClusterConfig
+		}
+
+		host := parts[1]
+		if byName || host == "" {
+			host = parts[0]
+		}
+
+		addrs = append(addrs, net.JoinHostPort(host, parts[2]))
+	}
+
+	sort.Strings(addrs)
+	return version, addrs, nil
+}
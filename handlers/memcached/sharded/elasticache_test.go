@@ -0,0 +1,117 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func clusterConfig(version int, nodes string) string {
+	data := fmt.Sprintf("%d\n%s\n", version, nodes)
+	return fmt.Sprintf("CONFIG cluster 0 %d\r\n%s\r\nEND\r\n", len(data), data)
+}
+
+func TestReadClusterConfig(t *testing.T) {
+	resp := clusterConfig(12, "b.cache.amazonaws.com|10.0.0.2|11211 a.cache.amazonaws.com|10.0.0.1|11211")
+
+	version, addrs, err := readClusterConfig(bufio.NewReader(strings.NewReader(resp)), false)
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	if version != 12 {
+		t.Fatalf("Expected version 12, got %d", version)
+	}
+	want := []string{"10.0.0.1:11211", "10.0.0.2:11211"}
+	if !equal(addrs, want) {
+		t.Fatalf("Expected %v, got %v", want, addrs)
+	}
+
+	_, addrs, err = readClusterConfig(bufio.NewReader(strings.NewReader(resp)), true)
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	want = []string{"a.cache.amazonaws.com:11211", "b.cache.amazonaws.com:11211"}
+	if !equal(addrs, want) {
+		t.Fatalf("Expected %v, got %v", want, addrs)
+	}
+
+	for _, bad := range []string{
+		"ERROR\r\n",
+		"CONFIG cluster 0 5\r\n12\n\r\nEND\r\n",
+		"CONFIG cluster 0 x\r\n",
+		clusterConfig(1, "a.cache.amazonaws.com|11211"),
+	} {
+		if _, _, err := readClusterConfig(bufio.NewReader(strings.NewReader(bad)), false); err == nil {
+			t.Fatalf("Expected an error reading %q", bad)
+		}
+	}
+}
+
+func TestAutoDiscovery(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer ln.Close()
+
+	configs := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			if line, _ := r.ReadString('\n'); line == "config get cluster\r\n" {
+				conn.Write([]byte(<-configs))
+			}
+			conn.Close()
+		}
+	}()
+
+	c := NewCluster(nil, DefaultConfig)
+	d := &watcher{c: c, src: &elastiCache{c: c, endpoint: ln.Addr().String()}}
+
+	configs <- clusterConfig(1, "a||11211 b||11211")
+	d.refresh()
+	gen, addrs := c.members()
+	if want := []string{"a:11211", "b:11211"}; !equal(addrs, want) {
+		t.Fatalf("Expected %v, got %v", want, addrs)
+	}
+
+	// The same nodes don't touch the cluster
+	configs <- clusterConfig(1, "a||11211 b||11211")
+	d.refresh()
+	if newGen, _ := c.members(); newGen != gen {
+		t.Fatal("Expected the cluster to stay the same")
+	}
+
+	configs <- clusterConfig(2, "a||11211 c||11211")
+	d.refresh()
+	if _, addrs := c.members(); !equal(addrs, []string{"a:11211", "c:11211"}) {
+		t.Fatalf("Expected the new backends, got %v", addrs)
+	}
+
+	// A broken response leaves the cluster alone
+	configs <- "SERVER_ERROR oops\r\n"
+	d.refresh()
+	if _, addrs := c.members(); !equal(addrs, []string{"a:11211", "c:11211"}) {
+		t.Fatalf("Expected the backends to stay, got %v", addrs)
+	}
+}
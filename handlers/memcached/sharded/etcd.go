@@ -0,0 +1,110 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// EtcdConfig says where in etcd the backends of a cluster are registered
+type EtcdConfig struct {
+	// Endpoint is the base URL of an etcd v3 server's JSON gateway, e.g. http://127.0.0.1:2379
+	Endpoint string
+	// Prefix is the prefix of the keys the backends are registered under. The value of each key
+	// is the host:port of one backend.
+	Prefix string
+}
+
+// Etcd is a Source that gives the backends registered under a prefix in etcd. Backends usually
+// register with a key attached to a lease, so they drop out when they stop renewing it.
+type Etcd struct {
+	conf   EtcdConfig
+	client *http.Client
+}
+
+func NewEtcd(conf EtcdConfig) *Etcd {
+	conf.Endpoint = strings.TrimSuffix(conf.Endpoint, "/")
+	return &Etcd{
+		conf:   conf,
+		client: &http.Client{Timeout: DiscoveryTimeout},
+	}
+}
+
+// Byte slices are base64 encoded in the JSON gateway's requests and responses, which
+// encoding/json does for []byte.
+type etcdRange struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+func (e *Etcd) Backends() ([]string, error) {
+	body, err := json.Marshal(etcdRange{
+		Key:      []byte(e.conf.Prefix),
+		RangeEnd: prefixEnd([]byte(e.conf.Prefix)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := e.client.Post(e.conf.Endpoint+"/v3/kv/range", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("etcd range %s: %s", e.conf.Prefix, res.Status)
+	}
+
+	var r etcdRangeResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, kv := range r.Kvs {
+		if addr := strings.TrimSpace(string(kv.Value)); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+// prefixEnd returns the end of the range of keys starting with prefix: the prefix up to its last
+// byte below 0xff, with that byte incremented. A range end of \0 means all keys.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
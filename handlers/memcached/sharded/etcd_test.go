@@ -0,0 +1,70 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEtcd(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req etcdRange
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Error decoding request: %v", err)
+		}
+		if r.URL.Path != "/v3/kv/range" || string(req.Key) != "/rend/" || string(req.RangeEnd) != "/rend0" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		// "10.0.0.1:11211" and "10.0.0.2:11211" in base64, plus an empty value
+		w.Write([]byte(`{"kvs": [
+			{"key": "L3JlbmQvYQ==", "value": "MTAuMC4wLjE6MTEyMTE="},
+			{"key": "L3JlbmQvYg==", "value": "MTAuMC4wLjI6MTEyMTE="},
+			{"key": "L3JlbmQvYw==", "value": ""}
+		]}`))
+	}))
+	defer srv.Close()
+
+	e := NewEtcd(EtcdConfig{Endpoint: srv.URL, Prefix: "/rend/"})
+	addrs, err := e.Backends()
+	if err != nil {
+		t.Fatalf("Error getting backends: %v", err)
+	}
+	if want := []string{"10.0.0.1:11211", "10.0.0.2:11211"}; !equal(addrs, want) {
+		t.Fatalf("Expected %v, got %v", want, addrs)
+	}
+
+	e = NewEtcd(EtcdConfig{Endpoint: srv.URL, Prefix: "/other/"})
+	if _, err := e.Backends(); err == nil {
+		t.Fatal("Expected an error for a failed request")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := map[string]string{
+		"":         "\x00",
+		"a":        "b",
+		"a\xff":    "b",
+		"\xff\xff": "\x00",
+	}
+	for prefix, want := range tests {
+		if got := string(prefixEnd([]byte(prefix))); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
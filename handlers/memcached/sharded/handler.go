@@ -0,0 +1,461 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/memcached/std"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricGetBackendErrors = metrics.AddCounter("sharded_get_backend_errors", nil)
+)
+
+// Handler sends each request to the backend its key hashes to. It holds one connection to each
+// backend, opened the first time the backend is needed. A connection that fails is closed and
+// the failure counts against the backend's health in the shared cluster.
+//
+// A failed backend shows up to clients as a temporary failure for mutations and as a miss for
+// gets, so the client connection stays open while the keys are rehashed.
+type Handler struct {
+	cluster *Cluster
+	conns   map[string]std.Handler
+	// gen is the generation of the cluster's backends that conns was last checked against
+	gen uint64
+}
+
+func NewHandler(c *Cluster) *Handler {
+	return &Handler{
+		cluster: c,
+		conns:   make(map[string]std.Handler),
+	}
+}
+
+// backend returns the connection to the backend for the key, dialing it if needed
+func (h *Handler) backend(key []byte) (string, std.Handler, error) {
+	addr := h.cluster.pick(key)
+	conn, err := h.conn(addr)
+	return addr, conn, err
+}
+
+// done records the outcome of a request to a backend. Application errors are normal responses
+// from a healthy backend. Anything else means the connection is broken, so it is closed and
+// the client gets a temporary failure instead.
+func (h *Handler) done(addr string, err error) error {
+	if err == nil || common.IsAppError(err) {
+		h.cluster.succeeded(addr)
+		return err
+	}
+
+	log.Println("Error from backend", addr, err.Error())
+	if conn, ok := h.conns[addr]; ok {
+		conn.Close()
+		delete(h.conns, addr)
+	}
+	h.cluster.failed(addr)
+
+	return common.ErrTempFailure
+}
+
+func (h *Handler) Close() error {
+	var ret error
+	for addr, conn := range h.conns {
+		if err := conn.Close(); err != nil {
+			ret = err
+		}
+		delete(h.conns, addr)
+	}
+	return ret
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return err
+	}
+	return h.done(addr, b.Set(cmd))
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return err
+	}
+	return h.done(addr, b.Add(cmd))
+}
+
+func (h *Handler) Replace(cmd common.SetRequest) error {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return err
+	}
+	return h.done(addr, b.Replace(cmd))
+}
+
+func (h *Handler) Append(cmd common.SetRequest) error {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return err
+	}
+	return h.done(addr, b.Append(cmd))
+}
+
+func (h *Handler) Prepend(cmd common.SetRequest) error {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return err
+	}
+	return h.done(addr, b.Prepend(cmd))
+}
+
+func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+	go h.realHandleGet(cmd, dataOut, errorOut)
+	return dataOut, errorOut
+}
+
+// batch is the part of a multiget that goes to one backend
+type batch struct {
+	addr string
+	conn std.Handler
+	// idxs are the positions of the batch's keys in the original request
+	idxs []int
+	err  error
+}
+
+// batches groups the keys of a get by the backend they hash to, keeping the order of the keys
+// within each backend. Keys whose backend can't be reached are left out.
+func (h *Handler) batches(cmd common.GetRequest) []*batch {
+	var ret []*batch
+	byAddr := make(map[string]*batch)
+
+	for idx, key := range cmd.Keys {
+		addr, conn, err := h.backend(key)
+		if err != nil {
+			continue
+		}
+
+		b, ok := byAddr[addr]
+		if !ok {
+			b = &batch{addr: addr, conn: conn}
+			byAddr[addr] = b
+			ret = append(ret, b)
+		}
+		b.idxs = append(b.idxs, idx)
+	}
+
+	return ret
+}
+
+// request returns the part of the get for the batch's keys
+func (b *batch) request(cmd common.GetRequest) common.GetRequest {
+	req := common.GetRequest{
+		Keys:    make([][]byte, len(b.idxs)),
+		Opaques: make([]uint32, len(b.idxs)),
+		Quiet:   make([]bool, len(b.idxs)),
+	}
+	for i, idx := range b.idxs {
+		req.Keys[i] = cmd.Keys[idx]
+		req.Opaques[i] = cmd.Opaques[idx]
+		req.Quiet[i] = cmd.Quiet[idx]
+	}
+	return req
+}
+
+// realHandleGet sends one pipelined get to each backend holding some of the keys, all at once,
+// and answers in the order of the request. A key on a failed backend is a miss.
+func (h *Handler) realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error) {
+	defer close(errorOut)
+	defer close(dataOut)
+
+	batches := h.batches(cmd)
+	responses := make([]common.GetResponse, len(cmd.Keys))
+	got := make([]bool, len(cmd.Keys))
+
+	var wg sync.WaitGroup
+	for _, b := range batches {
+		wg.Add(1)
+		go func(b *batch) {
+			defer wg.Done()
+
+			// The backend answers every key in order until the first error
+			resChan, errChan := b.conn.Get(b.request(cmd))
+			var n int
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					responses[b.idxs[n]] = res
+					got[b.idxs[n]] = true
+					n++
+				case err, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					b.err = err
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	// Connections are only touched once all the batches are done
+	for _, b := range batches {
+		h.done(b.addr, b.err)
+	}
+
+	for idx, key := range cmd.Keys {
+		if !got[idx] {
+			metrics.IncCounter(MetricGetBackendErrors)
+			dataOut <- common.GetResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    key,
+			}
+			continue
+		}
+
+		dataOut <- responses[idx]
+	}
+}
+
+func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+	go h.realHandleGetE(cmd, dataOut, errorOut)
+	return dataOut, errorOut
+}
+
+// realHandleGetE sends one pipelined getE to each backend holding some of the keys, all at once,
+// and answers in the order of the request. A key on a failed backend is a miss.
+func (h *Handler) realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, errorOut chan error) {
+	defer close(errorOut)
+	defer close(dataOut)
+
+	batches := h.batches(cmd)
+	responses := make([]common.GetEResponse, len(cmd.Keys))
+	got := make([]bool, len(cmd.Keys))
+
+	var wg sync.WaitGroup
+	for _, b := range batches {
+		wg.Add(1)
+		go func(b *batch) {
+			defer wg.Done()
+
+			// The backend answers every key in order until the first error
+			resChan, errChan := b.conn.GetE(b.request(cmd))
+			var n int
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					responses[b.idxs[n]] = res
+					got[b.idxs[n]] = true
+					n++
+				case err, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					b.err = err
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	// Connections are only touched once all the batches are done
+	for _, b := range batches {
+		h.done(b.addr, b.err)
+	}
+
+	for idx, key := range cmd.Keys {
+		if !got[idx] {
+			metrics.IncCounter(MetricGetBackendErrors)
+			dataOut <- common.GetEResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    key,
+			}
+			continue
+		}
+
+		dataOut <- responses[idx]
+	}
+}
+
+func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	res, err := b.GAT(cmd)
+	return res, h.done(addr, err)
+}
+
+func (h *Handler) Delete(cmd common.DeleteRequest) error {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return err
+	}
+	return h.done(addr, b.Delete(cmd))
+}
+
+func (h *Handler) Touch(cmd common.TouchRequest) error {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return err
+	}
+	return h.done(addr, b.Touch(cmd))
+}
+
+func (h *Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return 0, err
+	}
+	val, err := b.Incr(cmd)
+	return val, h.done(addr, err)
+}
+
+func (h *Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	addr, b, err := h.backend(cmd.Key)
+	if err != nil {
+		return 0, err
+	}
+	val, err := b.Decr(cmd)
+	return val, h.done(addr, err)
+}
+
+// conn returns the connection to the given backend, dialing it if needed
+func (h *Handler) conn(addr string) (std.Handler, error) {
+	if atomic.LoadUint64(&h.cluster.gen) != h.gen {
+		h.prune()
+	}
+
+	// The cluster has no backends at all
+	if addr == "" {
+		return std.Handler{}, common.ErrTempFailure
+	}
+
+	if conn, ok := h.conns[addr]; ok {
+		return conn, nil
+	}
+
+	conn, err := h.cluster.dial(addr)
+	if err != nil {
+		log.Println("Error connecting to backend", addr, err.Error())
+		h.cluster.failed(addr)
+		return std.Handler{}, common.ErrTempFailure
+	}
+
+	sh := std.NewHandler(conn)
+	h.conns[addr] = sh
+	return sh, nil
+}
+
+// prune closes the connections to backends that have been removed from the cluster
+func (h *Handler) prune() {
+	gen, addrs := h.cluster.members()
+
+	current := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = true
+	}
+
+	for addr, conn := range h.conns {
+		if !current[addr] {
+			conn.Close()
+			delete(h.conns, addr)
+		}
+	}
+
+	h.gen = gen
+}
+
+// Stats returns the stats of every backend in the ring, each prefixed with the backend's address
+func (h *Handler) Stats(group []byte) ([]common.Stat, error) {
+	var ret []common.Stat
+
+	for _, addr := range h.cluster.liveAddrs() {
+		b, err := h.conn(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		stats, err := b.Stats(group)
+		if err = h.done(addr, err); err != nil {
+			return nil, err
+		}
+
+		for _, s := range stats {
+			s.Name = addr + ":" + s.Name
+			ret = append(ret, s)
+		}
+	}
+
+	return ret, nil
+}
+
+// Flush flushes every backend in the ring
+func (h *Handler) Flush(cmd common.FlushRequest) error {
+	for _, addr := range h.cluster.liveAddrs() {
+		b, err := h.conn(addr)
+		if err != nil {
+			return err
+		}
+
+		if err := h.done(addr, b.Flush(cmd)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Version returns the version of the first backend that answers
+func (h *Handler) Version() (string, error) {
+	err := common.ErrTempFailure
+
+	for _, addr := range h.cluster.liveAddrs() {
+		b, cerr := h.conn(addr)
+		if cerr != nil {
+			continue
+		}
+
+		var version string
+		version, err = b.Version()
+		if err = h.done(addr, err); err == nil {
+			return version, nil
+		}
+	}
+
+	return "", err
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/memcached/memcachedtest"
+)
+
+func TestGetBatchesPerBackend(t *testing.T) {
+	servers := make(map[string]*memcachedtest.Server)
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		s := memcachedtest.NewServer(t)
+		servers[s.Addr()] = s
+		addrs = append(addrs, s.Addr())
+	}
+
+	c := NewCluster(addrs, Config{FailureLimit: 2, RetryTimeout: time.Minute})
+	h := NewHandler(c)
+	defer h.Close()
+
+	cmd := common.GetRequest{
+		Keys:    make([][]byte, 30),
+		Opaques: make([]uint32, 30),
+		Quiet:   make([]bool, 30),
+	}
+	for i := range cmd.Keys {
+		key := fmt.Sprintf("key%d", i)
+		cmd.Keys[i] = []byte(key)
+		cmd.Opaques[i] = uint32(i)
+		if i%3 == 0 {
+			servers[c.pick(cmd.Keys[i])].Put(key, []byte("value"+key))
+		}
+	}
+
+	// Every backend holds up its first get until all of them have one, which only happens if the
+	// batches are sent at the same time
+	var arrived sync.WaitGroup
+	arrived.Add(len(addrs))
+	for _, s := range servers {
+		var once sync.Once
+		s.SetHook(func(conn int, req common.Request) error {
+			if _, ok := req.(common.GetRequest); !ok {
+				return nil
+			}
+			once.Do(arrived.Done)
+
+			all := make(chan struct{})
+			go func() {
+				arrived.Wait()
+				close(all)
+			}()
+			select {
+			case <-all:
+				return nil
+			case <-time.After(time.Second):
+				return common.ErrNoMem
+			}
+		})
+	}
+
+	dataOut, errorOut := h.Get(cmd)
+	var n int
+	for res := range dataOut {
+		hit := n%3 == 0
+		if string(res.Key) != string(cmd.Keys[n]) || res.Opaque != cmd.Opaques[n] {
+			t.Fatalf("Expected response %d to be for %s, got %s", n, cmd.Keys[n], res.Key)
+		}
+		if res.Miss == hit || hit && string(res.Data) != "value"+string(res.Key) {
+			t.Fatalf("Expected %s to be a hit: %v, got miss: %v and %q", res.Key, hit, res.Miss, res.Data)
+		}
+		n++
+	}
+	if err := <-errorOut; err != nil || n != len(cmd.Keys) {
+		t.Fatalf("Expected %d responses, got %d and %v", len(cmd.Keys), n, err)
+	}
+
+	dataOutE, errorOutE := h.GetE(cmd)
+	n = 0
+	for res := range dataOutE {
+		if string(res.Key) != string(cmd.Keys[n]) || res.Miss != (n%3 != 0) {
+			t.Fatalf("Expected response %d of getE to be for %s", n, cmd.Keys[n])
+		}
+		n++
+	}
+	if err := <-errorOutE; err != nil || n != len(cmd.Keys) {
+		t.Fatalf("Expected %d responses to getE, got %d and %v", len(cmd.Keys), n, err)
+	}
+}
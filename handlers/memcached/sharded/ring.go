@@ -0,0 +1,88 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Ketama places each backend at many points on a ring of 32 bit hashes. A key belongs to the
+// first backend point at or after the key's hash. Adding or removing a backend only moves the
+// keys between its points and the ones before them, so most keys stay where they are.
+//
+// The points are made the same way as libketama so the same list of backends shards keys the
+// same way as other ketama clients: 40 MD5 hashes of "<addr>-<i>", each split into 4 points.
+const (
+	hashesPerBackend = 40
+	pointsPerHash    = 4
+)
+
+type point struct {
+	hash uint32
+	addr string
+}
+
+type ring struct {
+	points []point
+}
+
+func newRing(addrs []string) *ring {
+	points := make([]point, 0, len(addrs)*hashesPerBackend*pointsPerHash)
+
+	for _, addr := range addrs {
+		for i := 0; i < hashesPerBackend; i++ {
+			sum := md5.Sum([]byte(addr + "-" + strconv.Itoa(i)))
+			for j := 0; j < pointsPerHash; j++ {
+				points = append(points, point{
+					hash: binary.LittleEndian.Uint32(sum[j*4:]),
+					addr: addr,
+				})
+			}
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].addr < points[j].addr
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	return &ring{points: points}
+}
+
+// lookup returns the backend the key belongs to, or "" if the ring is empty
+func (r *ring) lookup(key []byte) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	sum := md5.Sum(key)
+	hash := binary.LittleEndian.Uint32(sum[:4])
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	// Wrap around to the start of the ring
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.points[i].addr
+}
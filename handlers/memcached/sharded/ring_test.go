@@ -0,0 +1,104 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sharded
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testAddrs = []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211", "10.0.0.4:11211"}
+
+func TestRingDistribution(t *testing.T) {
+	r := newRing(testAddrs)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[r.lookup([]byte("key"+strconv.Itoa(i)))]++
+	}
+
+	for _, addr := range testAddrs {
+		// An even split is 2500 each
+		if counts[addr] < 1500 || counts[addr] > 3500 {
+			t.Errorf("Uneven distribution: %v", counts)
+		}
+	}
+}
+
+func TestRingRemoveOnlyMovesItsKeys(t *testing.T) {
+	full := newRing(testAddrs)
+	less := newRing(testAddrs[1:])
+
+	for i := 0; i < 10000; i++ {
+		key := []byte("key" + strconv.Itoa(i))
+		before := full.lookup(key)
+		after := less.lookup(key)
+
+		if before != testAddrs[0] && before != after {
+			t.Fatalf("Key %s moved from %s to %s", key, before, after)
+		}
+	}
+}
+
+func TestClusterEjectAndRestore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := NewCluster(testAddrs, Config{FailureLimit: 2, RetryTimeout: time.Minute})
+	c.now = func() time.Time { return now }
+
+	// Find a key on the first backend
+	var key []byte
+	for i := 0; ; i++ {
+		key = []byte("key" + strconv.Itoa(i))
+		if c.pick(key) == testAddrs[0] {
+			break
+		}
+	}
+
+	// A success in between resets the count
+	c.failed(testAddrs[0])
+	c.succeeded(testAddrs[0])
+	c.failed(testAddrs[0])
+	if c.pick(key) != testAddrs[0] {
+		t.Fatal("Expected the backend to stay in the ring")
+	}
+
+	c.failed(testAddrs[0])
+	if addr := c.pick(key); addr == testAddrs[0] {
+		t.Fatal("Expected the key to be rehashed after the backend was ejected")
+	}
+	if len(c.liveAddrs()) != len(testAddrs)-1 {
+		t.Fatalf("Expected the ejected backend to be skipped, got %v", c.liveAddrs())
+	}
+
+	now = now.Add(time.Minute)
+	if c.pick(key) != testAddrs[0] {
+		t.Fatal("Expected the backend to be restored after the retry timeout")
+	}
+}
+
+func TestClusterAllEjected(t *testing.T) {
+	c := NewCluster(testAddrs[:2], Config{FailureLimit: 1, RetryTimeout: time.Minute})
+
+	c.failed(testAddrs[0])
+	c.failed(testAddrs[1])
+
+	if c.pick([]byte("foo")) == "" {
+		t.Fatal("Expected a backend when all are ejected")
+	}
+	if len(c.liveAddrs()) != 2 {
+		t.Fatalf("Expected all backends when all are ejected, got %v", c.liveAddrs())
+	}
+}
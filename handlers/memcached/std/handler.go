@@ -58,35 +58,35 @@ func (h Handler) Close() error {
 }
 
 func (h Handler) Set(cmd common.SetRequest) error {
-	if err := binprot.WriteSetCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
+	if err := binprot.WriteSetCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
 }
 
 func (h Handler) Add(cmd common.SetRequest) error {
-	if err := binprot.WriteAddCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
+	if err := binprot.WriteAddCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
 }
 
 func (h Handler) Replace(cmd common.SetRequest) error {
-	if err := binprot.WriteReplaceCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
+	if err := binprot.WriteReplaceCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
 }
 
 func (h Handler) Append(cmd common.SetRequest) error {
-	if err := binprot.WriteAppendCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
+	if err := binprot.WriteAppendCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
 }
 
 func (h Handler) Prepend(cmd common.SetRequest) error {
-	if err := binprot.WritePrependCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data))); err != nil {
+	if err := binprot.WritePrependCmd(h.rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), cmd.Cas); err != nil {
 		return err
 	}
 	return h.handleSetCommon(cmd)
@@ -134,13 +134,17 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 	defer close(errorOut)
 	defer close(dataOut)
 
+	var end int
 	for idx, key := range cmd.Keys {
-		if err := binprot.WriteGetCmd(rw.Writer, key); err != nil {
-			errorOut <- err
-			return
+		if idx == end {
+			end = min(idx+getBatchSize, len(cmd.Keys))
+			if err := writeGets(rw.Writer, cmd.Keys[idx:end], binprot.WriteGetCmd); err != nil {
+				errorOut <- err
+				return
+			}
 		}
 
-		data, flags, _, err := getLocal(rw, false)
+		data, flags, _, cas, err := readGetLocal(rw, false)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				dataOut <- common.GetResponse{
@@ -155,6 +159,9 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 				continue
 			}
 
+			if common.IsAppError(err) {
+				discardGets(rw, end-idx-1)
+			}
 			errorOut <- err
 			return
 		}
@@ -164,6 +171,7 @@ func realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, error
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
 			Flags:  flags,
+			Cas:    cas,
 			Key:    key,
 			Data:   data,
 		}
@@ -181,13 +189,17 @@ func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, err
 	defer close(errorOut)
 	defer close(dataOut)
 
+	var end int
 	for idx, key := range cmd.Keys {
-		if err := binprot.WriteGetECmd(rw.Writer, key); err != nil {
-			errorOut <- err
-			return
+		if idx == end {
+			end = min(idx+getBatchSize, len(cmd.Keys))
+			if err := writeGets(rw.Writer, cmd.Keys[idx:end], binprot.WriteGetECmd); err != nil {
+				errorOut <- err
+				return
+			}
 		}
 
-		data, flags, exp, err := getLocal(rw, true)
+		data, flags, exp, cas, err := readGetLocal(rw, true)
 		if err != nil {
 			if err == common.ErrKeyNotFound {
 				dataOut <- common.GetEResponse{
@@ -203,6 +215,9 @@ func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, err
 				continue
 			}
 
+			if common.IsAppError(err) {
+				discardGets(rw, end-idx-1)
+			}
 			errorOut <- err
 			return
 		}
@@ -213,6 +228,7 @@ func realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, err
 			Opaque:  cmd.Opaques[idx],
 			Flags:   flags,
 			Exptime: exp,
+			Cas:     cas,
 			Key:     key,
 			Data:    data,
 		}
@@ -224,12 +240,12 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 		return common.GetResponse{}, err
 	}
 
-	data, flags, _, err := getLocal(h.rw, false)
+	data, flags, _, cas, err := getLocal(h.rw, false)
 	if err != nil {
 		if err == common.ErrKeyNotFound {
 			return common.GetResponse{
 				Miss:   true,
-				Quiet:  false,
+				Quiet:  cmd.Quiet,
 				Opaque: cmd.Opaque,
 				Flags:  flags,
 				Key:    cmd.Key,
@@ -242,16 +258,17 @@ func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 
 	return common.GetResponse{
 		Miss:   false,
-		Quiet:  false,
+		Quiet:  cmd.Quiet,
 		Opaque: cmd.Opaque,
 		Flags:  flags,
+		Cas:    cas,
 		Key:    cmd.Key,
 		Data:   data,
 	}, nil
 }
 
 func (h Handler) Delete(cmd common.DeleteRequest) error {
-	if err := binprot.WriteDeleteCmd(h.rw.Writer, cmd.Key); err != nil {
+	if err := binprot.WriteDeleteCmd(h.rw.Writer, cmd.Key, cmd.Cas); err != nil {
 		return err
 	}
 	return simpleCmdLocal(h.rw)
@@ -263,3 +280,38 @@ func (h Handler) Touch(cmd common.TouchRequest) error {
 	}
 	return simpleCmdLocal(h.rw)
 }
+
+func (h Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	if err := binprot.WriteIncrCmd(h.rw.Writer, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime); err != nil {
+		return 0, err
+	}
+	return arithLocal(h.rw)
+}
+
+func (h Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	if err := binprot.WriteDecrCmd(h.rw.Writer, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime); err != nil {
+		return 0, err
+	}
+	return arithLocal(h.rw)
+}
+
+func (h Handler) Stats(group []byte) ([]common.Stat, error) {
+	if err := binprot.WriteStatCmd(h.rw.Writer, group); err != nil {
+		return nil, err
+	}
+	return statsLocal(h.rw)
+}
+
+func (h Handler) Version() (string, error) {
+	if err := binprot.WriteVersionCmd(h.rw.Writer); err != nil {
+		return "", err
+	}
+	return versionLocal(h.rw)
+}
+
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	if err := binprot.WriteFlushCmd(h.rw.Writer, cmd.Delay); err != nil {
+		return err
+	}
+	return simpleCmdLocal(h.rw)
+}
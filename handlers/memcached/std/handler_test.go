@@ -0,0 +1,150 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package std
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/memcached/memcachedtest"
+)
+
+func getRequest(n int) common.GetRequest {
+	cmd := common.GetRequest{
+		Keys:    make([][]byte, n),
+		Opaques: make([]uint32, n),
+		Quiet:   make([]bool, n),
+	}
+	for i := range cmd.Keys {
+		cmd.Keys[i] = []byte(fmt.Sprintf("key%d", i))
+		cmd.Opaques[i] = uint32(i)
+	}
+	return cmd
+}
+
+// collect reads all of the responses to a get and the error that ended it, if any
+func collect(dataOut <-chan common.GetResponse, errorOut <-chan error) ([]common.GetResponse, error) {
+	var responses []common.GetResponse
+	var err error
+	for dataOut != nil || errorOut != nil {
+		select {
+		case res, ok := <-dataOut:
+			if !ok {
+				dataOut = nil
+				continue
+			}
+			responses = append(responses, res)
+		case e, ok := <-errorOut:
+			if !ok {
+				errorOut = nil
+				continue
+			}
+			err = e
+		}
+	}
+	return responses, err
+}
+
+// checkResponses checks the responses are for the first keys of the request, in order, and that
+// every third key is a hit
+func checkResponses(t *testing.T, cmd common.GetRequest, responses []common.GetResponse) {
+	t.Helper()
+	for i, res := range responses {
+		if string(res.Key) != string(cmd.Keys[i]) || res.Opaque != cmd.Opaques[i] {
+			t.Fatalf("Expected response %d to be for %s, got %s", i, cmd.Keys[i], res.Key)
+		}
+		hit := i%3 == 0
+		if res.Miss == hit {
+			t.Fatalf("Expected %s to be a hit: %v, got miss: %v", res.Key, hit, res.Miss)
+		}
+		if hit && string(res.Data) != "value"+string(res.Key) {
+			t.Fatalf("Expected the value of %s, got %q", res.Key, res.Data)
+		}
+	}
+}
+
+func newTestHandler(t *testing.T) (*memcachedtest.Server, Handler) {
+	s := memcachedtest.NewServer(t)
+	for i := 0; i < 3*getBatchSize; i += 3 {
+		key := fmt.Sprintf("key%d", i)
+		s.Put(key, []byte("value"+key))
+	}
+	return s, NewHandler(s.Dial(t))
+}
+
+func TestGetBatches(t *testing.T) {
+	_, h := newTestHandler(t)
+
+	// More than two batches, with misses in between the hits
+	cmd := getRequest(2*getBatchSize + getBatchSize/2)
+
+	responses, err := collect(h.Get(cmd))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(responses) != len(cmd.Keys) {
+		t.Fatalf("Expected %d responses, got %d", len(cmd.Keys), len(responses))
+	}
+	checkResponses(t, cmd, responses)
+
+	dataOut, errorOut := h.GetE(cmd)
+	var n int
+	for res := range dataOut {
+		if string(res.Key) != string(cmd.Keys[n]) || res.Miss != (n%3 != 0) {
+			t.Fatalf("Expected response %d of getE to be for %s", n, cmd.Keys[n])
+		}
+		n++
+	}
+	if err := <-errorOut; err != nil || n != len(cmd.Keys) {
+		t.Fatalf("Expected %d responses to getE, got %d and %v", len(cmd.Keys), n, err)
+	}
+}
+
+func TestGetBatchError(t *testing.T) {
+	// Fail the middle of the first batch, the middle of the second and the end of a batch
+	for _, failed := range []int{getBatchSize / 2, getBatchSize + getBatchSize/2, getBatchSize - 1} {
+		s, h := newTestHandler(t)
+
+		failedKey := fmt.Sprintf("key%d", failed)
+		s.SetHook(func(conn int, req common.Request) error {
+			if get, ok := req.(common.GetRequest); ok && string(get.Keys[0]) == failedKey {
+				return common.ErrNoMem
+			}
+			return nil
+		})
+
+		cmd := getRequest(2 * getBatchSize)
+		responses, err := collect(h.Get(cmd))
+		if err != common.ErrNoMem {
+			t.Fatalf("Key %d: expected the get to fail, got %v", failed, err)
+		}
+		if len(responses) != failed {
+			t.Fatalf("Key %d: expected the responses before the failure, got %d", failed, len(responses))
+		}
+		checkResponses(t, cmd, responses)
+
+		// The rest of the batch was discarded, so the next command reads its own response
+		s.SetHook(nil)
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Key %d: error setting after the failure: %v", failed, err)
+		}
+		responses, err = collect(h.Get(getRequest(getBatchSize + 1)))
+		if err != nil || len(responses) != getBatchSize+1 {
+			t.Fatalf("Key %d: expected the next get to work, got %d responses and %v", failed, len(responses), err)
+		}
+		checkResponses(t, cmd, responses)
+	}
+}
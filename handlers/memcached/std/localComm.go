@@ -52,14 +52,14 @@ func simpleCmdLocal(rw *bufio.ReadWriter) error {
 	return err
 }
 
-func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint32, err error) {
+func arithLocal(rw *bufio.ReadWriter) (uint64, error) {
 	if err := rw.Flush(); err != nil {
-		return nil, 0, 0, err
+		return 0, err
 	}
 
 	resHeader, err := binprot.ReadResponseHeader(rw)
 	if err != nil {
-		return nil, 0, 0, err
+		return 0, err
 	}
 	defer binprot.PutResponseHeader(resHeader)
 
@@ -68,9 +68,45 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 		if ioerr != nil {
-			return nil, 0, 0, ioerr
+			return 0, ioerr
 		}
-		return nil, 0, 0, err
+		return 0, err
+	}
+
+	// The body is the 8 byte new value
+	var value uint64
+	if err := binary.Read(rw, binary.BigEndian, &value); err != nil {
+		return 0, err
+	}
+	metrics.IncCounterBy(common.MetricBytesReadLocal, 8)
+
+	return value, nil
+}
+
+func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint32, cas uint64, err error) {
+	if err := rw.Flush(); err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return readGetLocal(rw, readExp)
+}
+
+// readGetLocal reads one get response without flushing first, for gets that were all written
+// before reading any responses
+func readGetLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint32, cas uint64, err error) {
+	resHeader, err := binprot.ReadResponseHeader(rw)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	err = binprot.DecodeError(resHeader)
+	if err != nil {
+		n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if ioerr != nil {
+			return nil, 0, 0, 0, ioerr
+		}
+		return nil, 0, 0, 0, err
 	}
 
 	var serverFlags uint32
@@ -91,8 +127,118 @@ func getLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 	n, err := io.ReadAtLeast(rw, buf, int(dataLen))
 	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 	if err != nil {
-		return nil, 0, 0, err
+		return nil, 0, 0, 0, err
+	}
+
+	return buf, serverFlags, serverExp, resHeader.CASToken, nil
+}
+
+// getBatchSize is the most gets written together before reading their responses. Keys are small,
+// so a batch fits in the socket buffers and memcached can't stall writing large values back while
+// the gets are still being written.
+const getBatchSize = 100
+
+// writeGets writes a get for every key with write and flushes them together, so a multiget takes
+// one round trip to memcached per batch instead of one per key. The responses come back in the
+// same order.
+func writeGets(w *bufio.Writer, keys [][]byte, write func(io.Writer, []byte) error) error {
+	for _, key := range keys {
+		if err := write(w, key); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// discardGets reads and drops the responses to n gets that are still on their way after a failed
+// one, so the connection is left at a clean boundary
+func discardGets(rw *bufio.ReadWriter, n int) {
+	for i := 0; i < n; i++ {
+		resHeader, err := binprot.ReadResponseHeader(rw)
+		if err != nil {
+			return
+		}
+		body := int(resHeader.TotalBodyLength)
+		binprot.PutResponseHeader(resHeader)
+
+		read, err := rw.Discard(body)
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(read))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// statsLocal reads the stats responses from memcached. Each stat is in its own response, with the
+// name as the key and the value as the value. An empty response marks the end.
+func statsLocal(rw *bufio.ReadWriter) ([]common.Stat, error) {
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	var stats []common.Stat
+
+	for {
+		resHeader, err := binprot.ReadResponseHeader(rw)
+		if err != nil {
+			return nil, err
+		}
+
+		err = binprot.DecodeError(resHeader)
+		if err != nil {
+			n, ioerr := rw.Discard(int(resHeader.TotalBodyLength))
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			binprot.PutResponseHeader(resHeader)
+			if ioerr != nil {
+				return nil, ioerr
+			}
+			return nil, err
+		}
+
+		keyLength := int(resHeader.KeyLength)
+		totalBodyLength := int(resHeader.TotalBodyLength)
+		binprot.PutResponseHeader(resHeader)
+
+		if keyLength == 0 {
+			return stats, nil
+		}
+
+		buf := make([]byte, totalBodyLength)
+		n, err := io.ReadFull(rw, buf)
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, common.Stat{
+			Name:  string(buf[:keyLength]),
+			Value: string(buf[keyLength:]),
+		})
+	}
+}
+
+// versionLocal reads the response to a version command, which is the version string as the body.
+func versionLocal(rw *bufio.ReadWriter) (string, error) {
+	if err := rw.Flush(); err != nil {
+		return "", err
+	}
+
+	resHeader, err := binprot.ReadResponseHeader(rw)
+	if err != nil {
+		return "", err
+	}
+	defer binprot.PutResponseHeader(resHeader)
+
+	buf := make([]byte, resHeader.TotalBodyLength)
+	n, err := io.ReadFull(rw, buf)
+	metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+	if err != nil {
+		return "", err
+	}
+
+	if err := binprot.DecodeError(resHeader); err != nil {
+		return "", err
 	}
 
-	return buf, serverFlags, serverExp, nil
+	return string(buf), nil
 }
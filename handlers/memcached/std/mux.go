@@ -0,0 +1,415 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package std
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+// Mux shares a fixed set of connections to memcached between any number of handlers. Requests
+// are pipelined: a request is written to a connection as soon as it comes in, behind the requests
+// that are still waiting on their responses, and memcached answers them in the order they were
+// written. Each request reads its own response once the ones ahead of it have been read.
+type Mux struct {
+	dial  func() (io.ReadWriteCloser, error)
+	slots []muxSlot
+	next  atomic.Uint32
+}
+
+type muxSlot struct {
+	lock sync.Mutex
+	p    *pipe
+}
+
+// pipe is one connection of a Mux. Writes are serialized by the lock of the slot it is in, which
+// also hands out the turns to read.
+type pipe struct {
+	conn io.ReadWriteCloser
+	w    *bufio.Writer
+	// rw reads the responses. The read helpers flush before reading, so its writer is one that
+	// never has anything in it.
+	rw *bufio.ReadWriter
+	// last is closed when the response to the last request written has been read
+	last chan struct{}
+
+	lock sync.Mutex
+	err  error
+}
+
+// turn is a request's place in line for reading its response
+type turn struct {
+	wait <-chan struct{}
+	done chan struct{}
+}
+
+// NewMux creates a Mux over at most conns connections made with dial. Connections are made when
+// they are first needed and made again after they fail.
+func NewMux(dial func() (io.ReadWriteCloser, error), conns int) *Mux {
+	return &Mux{
+		dial:  dial,
+		slots: make([]muxSlot, max(conns, 1)),
+	}
+}
+
+// Handler returns a handler that sends its requests over the Mux's connections. Closing it
+// doesn't close them.
+func (m *Mux) Handler() MuxHandler {
+	return MuxHandler{m: m}
+}
+
+// Close closes all of the Mux's connections. Requests waiting on them fail.
+func (m *Mux) Close() error {
+	for i := range m.slots {
+		s := &m.slots[i]
+		s.lock.Lock()
+		if s.p != nil {
+			s.p.fail(io.ErrClosedPipe)
+		}
+		s.lock.Unlock()
+	}
+	return nil
+}
+
+// send writes a request with write to the next connection and flushes it
+func (m *Mux) send(write func(w *bufio.Writer) error) (*pipe, turn, error) {
+	s := &m.slots[int(m.next.Add(1)%uint32(len(m.slots)))]
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.p == nil || s.p.failed() != nil {
+		conn, err := m.dial()
+		if err != nil {
+			return nil, turn{}, err
+		}
+		s.p = newPipe(conn)
+	}
+	p := s.p
+
+	err := write(p.w)
+	if err == nil {
+		err = p.w.Flush()
+	}
+	if err != nil {
+		p.fail(err)
+		return nil, turn{}, err
+	}
+
+	t := turn{wait: p.last, done: make(chan struct{})}
+	p.last = t.done
+	return p, t, nil
+}
+
+// do sends a request and reads its response with read
+func (m *Mux) do(write func(w *bufio.Writer) error, read func(rw *bufio.ReadWriter) error) error {
+	p, t, err := m.send(write)
+	if err != nil {
+		return err
+	}
+	return p.read(t, read)
+}
+
+func newPipe(conn io.ReadWriteCloser) *pipe {
+	last := make(chan struct{})
+	close(last)
+	return &pipe{
+		conn: conn,
+		w:    bufio.NewWriter(conn),
+		rw:   bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(io.Discard)),
+		last: last,
+	}
+}
+
+// read waits for the turn, then reads the response with read. Anything but a response from
+// memcached leaves the connection at an unknown place in the stream, so it is failed along with
+// every request behind this one.
+func (p *pipe) read(t turn, read func(rw *bufio.ReadWriter) error) error {
+	<-t.wait
+	defer close(t.done)
+
+	if err := p.failed(); err != nil {
+		return err
+	}
+
+	err := read(p.rw)
+	if err != nil && !common.IsAppError(err) {
+		p.fail(err)
+	}
+	return err
+}
+
+func (p *pipe) fail(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err == nil {
+		p.err = err
+		p.conn.Close()
+	}
+}
+
+func (p *pipe) failed() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// MuxHandler is a handler that shares the connections of a Mux with the other handlers of the Mux
+type MuxHandler struct {
+	m *Mux
+}
+
+// Close does nothing, since the connections belong to the Mux
+func (h MuxHandler) Close() error {
+	return nil
+}
+
+type setCmd func(w io.Writer, key []byte, flags, exptime, dataSize uint32, cas uint64) error
+
+func (h MuxHandler) set(write setCmd, cmd common.SetRequest) error {
+	return h.m.do(func(w *bufio.Writer) error {
+		if err := write(w, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), cmd.Cas); err != nil {
+			return err
+		}
+		w.Write(cmd.Data)
+		metrics.IncCounterBy(common.MetricBytesWrittenLocal, uint64(len(cmd.Data)))
+		return nil
+	}, simpleCmdLocal)
+}
+
+func (h MuxHandler) Set(cmd common.SetRequest) error {
+	return h.set(binprot.WriteSetCmd, cmd)
+}
+
+func (h MuxHandler) Add(cmd common.SetRequest) error {
+	return h.set(binprot.WriteAddCmd, cmd)
+}
+
+func (h MuxHandler) Replace(cmd common.SetRequest) error {
+	return h.set(binprot.WriteReplaceCmd, cmd)
+}
+
+func (h MuxHandler) Append(cmd common.SetRequest) error {
+	return h.set(binprot.WriteAppendCmd, cmd)
+}
+
+func (h MuxHandler) Prepend(cmd common.SetRequest) error {
+	return h.set(binprot.WritePrependCmd, cmd)
+}
+
+type muxGet struct {
+	data  []byte
+	flags uint32
+	exp   uint32
+	cas   uint64
+	miss  bool
+}
+
+// gets sends one batch of gets and reads their responses. A batch is a request of its own, so the
+// turn is given up between batches and a big multiget can't stall the connection while its later
+// gets are still being written.
+func (h MuxHandler) gets(keys [][]byte, readExp bool, write func(io.Writer, []byte) error) ([]muxGet, error) {
+	res := make([]muxGet, 0, len(keys))
+	err := h.m.do(func(w *bufio.Writer) error {
+		return writeGets(w, keys, write)
+	}, func(rw *bufio.ReadWriter) error {
+		for i := range keys {
+			data, flags, exp, cas, err := readGetLocal(rw, readExp)
+			if err == common.ErrKeyNotFound {
+				res = append(res, muxGet{flags: flags, exp: exp, miss: true})
+				continue
+			}
+			if err != nil {
+				if common.IsAppError(err) {
+					discardGets(rw, len(keys)-i-1)
+				}
+				return err
+			}
+			res = append(res, muxGet{data: data, flags: flags, exp: exp, cas: cas})
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (h MuxHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		for idx := 0; idx < len(cmd.Keys); idx += getBatchSize {
+			end := min(idx+getBatchSize, len(cmd.Keys))
+			res, err := h.gets(cmd.Keys[idx:end], false, binprot.WriteGetCmd)
+
+			// The responses are sent after the turn is given up so a slow reader doesn't hold
+			// up the connection
+			for i, r := range res {
+				dataOut <- common.GetResponse{
+					Miss:   r.miss,
+					Quiet:  cmd.Quiet[idx+i],
+					Opaque: cmd.Opaques[idx+i],
+					Flags:  r.flags,
+					Cas:    r.cas,
+					Key:    cmd.Keys[idx+i],
+					Data:   r.data,
+				}
+			}
+
+			if err != nil {
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h MuxHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		for idx := 0; idx < len(cmd.Keys); idx += getBatchSize {
+			end := min(idx+getBatchSize, len(cmd.Keys))
+			res, err := h.gets(cmd.Keys[idx:end], true, binprot.WriteGetECmd)
+
+			for i, r := range res {
+				dataOut <- common.GetEResponse{
+					Miss:    r.miss,
+					Quiet:   cmd.Quiet[idx+i],
+					Opaque:  cmd.Opaques[idx+i],
+					Flags:   r.flags,
+					Exptime: r.exp,
+					Cas:     r.cas,
+					Key:     cmd.Keys[idx+i],
+					Data:    r.data,
+				}
+			}
+
+			if err != nil {
+				errorOut <- err
+				return
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h MuxHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var data []byte
+	var flags uint32
+	var cas uint64
+	err := h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteGATCmd(w, cmd.Key, cmd.Exptime)
+	}, func(rw *bufio.ReadWriter) (err error) {
+		data, flags, _, cas, err = readGetLocal(rw, false)
+		return err
+	})
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			return common.GetResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet,
+				Opaque: cmd.Opaque,
+				Flags:  flags,
+				Key:    cmd.Key,
+				Data:   nil,
+			}, nil
+		}
+
+		return common.GetResponse{}, err
+	}
+
+	return common.GetResponse{
+		Miss:   false,
+		Quiet:  cmd.Quiet,
+		Opaque: cmd.Opaque,
+		Flags:  flags,
+		Cas:    cas,
+		Key:    cmd.Key,
+		Data:   data,
+	}, nil
+}
+
+func (h MuxHandler) Delete(cmd common.DeleteRequest) error {
+	return h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteDeleteCmd(w, cmd.Key, cmd.Cas)
+	}, simpleCmdLocal)
+}
+
+func (h MuxHandler) Touch(cmd common.TouchRequest) error {
+	return h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteTouchCmd(w, cmd.Key, cmd.Exptime)
+	}, simpleCmdLocal)
+}
+
+func (h MuxHandler) Incr(cmd common.IncrDecrRequest) (value uint64, err error) {
+	err = h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteIncrCmd(w, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime)
+	}, func(rw *bufio.ReadWriter) (err error) {
+		value, err = arithLocal(rw)
+		return err
+	})
+	return value, err
+}
+
+func (h MuxHandler) Decr(cmd common.IncrDecrRequest) (value uint64, err error) {
+	err = h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteDecrCmd(w, cmd.Key, cmd.Delta, cmd.Initial, cmd.Exptime)
+	}, func(rw *bufio.ReadWriter) (err error) {
+		value, err = arithLocal(rw)
+		return err
+	})
+	return value, err
+}
+
+func (h MuxHandler) Stats(group []byte) (stats []common.Stat, err error) {
+	err = h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteStatCmd(w, group)
+	}, func(rw *bufio.ReadWriter) (err error) {
+		stats, err = statsLocal(rw)
+		return err
+	})
+	return stats, err
+}
+
+func (h MuxHandler) Version() (version string, err error) {
+	err = h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteVersionCmd(w)
+	}, func(rw *bufio.ReadWriter) (err error) {
+		version, err = versionLocal(rw)
+		return err
+	})
+	return version, err
+}
+
+func (h MuxHandler) Flush(cmd common.FlushRequest) error {
+	return h.m.do(func(w *bufio.Writer) error {
+		return binprot.WriteFlushCmd(w, cmd.Delay)
+	}, simpleCmdLocal)
+}
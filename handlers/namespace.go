@@ -0,0 +1,194 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+
+	"github.com/hongst/rend/common"
+)
+
+// Namespaced puts namespace in front of every key sent to the handlers made by hc and takes it off
+// the keys in get responses, so several tenants can share the same backends without their keys
+// colliding. Clients never see the namespace.
+//
+// Flush is refused with ErrNotSupported, since it would empty the backends for every tenant and
+// not just this one. Stats are passed through as they are.
+func Namespaced(hc HandlerConst, namespace string) HandlerConst {
+	ns := []byte(namespace)
+	return func() (Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return namespacedHandler{Handler: h, ns: ns}, nil
+	}
+}
+
+// Namespace returns a Decorator that puts every key in the namespace, like Namespaced
+func Namespace(namespace string) Decorator {
+	return func(hc HandlerConst) HandlerConst {
+		return Namespaced(hc, namespace)
+	}
+}
+
+type namespacedHandler struct {
+	Handler
+	ns []byte
+}
+
+func (h namespacedHandler) key(key []byte) []byte {
+	k := make([]byte, len(h.ns)+len(key))
+	copy(k, h.ns)
+	copy(k[len(h.ns):], key)
+	return k
+}
+
+// strip takes the namespace off a key in a response. Misses may not have the key set at all.
+func (h namespacedHandler) strip(key []byte) []byte {
+	if bytes.HasPrefix(key, h.ns) {
+		return key[len(h.ns):]
+	}
+	return key
+}
+
+func (h namespacedHandler) Set(cmd common.SetRequest) error {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Set(cmd)
+}
+
+func (h namespacedHandler) Add(cmd common.SetRequest) error {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Add(cmd)
+}
+
+func (h namespacedHandler) Replace(cmd common.SetRequest) error {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Replace(cmd)
+}
+
+func (h namespacedHandler) Append(cmd common.SetRequest) error {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Append(cmd)
+}
+
+func (h namespacedHandler) Prepend(cmd common.SetRequest) error {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Prepend(cmd)
+}
+
+// keys returns a copy of the get request with its keys in the namespace. The caller's request is
+// left alone since the orcas use its keys after the handler is done.
+func (h namespacedHandler) keys(cmd common.GetRequest) common.GetRequest {
+	keys := make([][]byte, len(cmd.Keys))
+	for i, key := range cmd.Keys {
+		keys[i] = h.key(key)
+	}
+	cmd.Keys = keys
+	return cmd
+}
+
+func (h namespacedHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		resChan, errChan := h.Handler.Get(h.keys(cmd))
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				res.Key = h.strip(res.Key)
+				dataOut <- res
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				errorOut <- err
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h namespacedHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		resChan, errChan := h.Handler.GetE(h.keys(cmd))
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				res.Key = h.strip(res.Key)
+				dataOut <- res
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				errorOut <- err
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h namespacedHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	cmd.Key = h.key(cmd.Key)
+	res, err := h.Handler.GAT(cmd)
+	res.Key = h.strip(res.Key)
+	return res, err
+}
+
+func (h namespacedHandler) Delete(cmd common.DeleteRequest) error {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Delete(cmd)
+}
+
+func (h namespacedHandler) Touch(cmd common.TouchRequest) error {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Touch(cmd)
+}
+
+func (h namespacedHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Incr(cmd)
+}
+
+func (h namespacedHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	cmd.Key = h.key(cmd.Key)
+	return h.Handler.Decr(cmd)
+}
+
+func (h namespacedHandler) Flush(cmd common.FlushRequest) error {
+	return common.ErrNotSupported
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+)
+
+func getOne(t *testing.T, h handlers.Handler, key string) common.GetResponse {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	for r := range resChan {
+		res = r
+	}
+	for err := range errChan {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return res
+}
+
+func TestNamespaced(t *testing.T) {
+	a, _ := handlers.Namespaced(inmem.New, "tenant-a:")()
+	b, _ := handlers.Namespaced(inmem.New, "tenant-b:")()
+	raw, _ := inmem.New()
+
+	if err := a.Set(common.SetRequest{Key: []byte("ns-foo"), Data: []byte("a")}); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	res := getOne(t, a, "ns-foo")
+	if res.Miss || string(res.Data) != "a" {
+		t.Fatalf("Expected a hit in the same namespace, got %+v", res)
+	}
+	if string(res.Key) != "ns-foo" {
+		t.Fatalf("Expected the namespace to be stripped from the key, got %q", res.Key)
+	}
+
+	if res := getOne(t, b, "ns-foo"); !res.Miss {
+		t.Fatalf("Expected a miss in another namespace, got %+v", res)
+	}
+	if res := getOne(t, raw, "tenant-a:ns-foo"); res.Miss {
+		t.Fatal("Expected the key to be stored with the namespace")
+	}
+
+	gat, err := a.GAT(common.GATRequest{Key: []byte("ns-foo")})
+	if err != nil || string(gat.Key) != "ns-foo" {
+		t.Fatalf("Expected a GAT hit without the namespace, got %+v, %v", gat, err)
+	}
+
+	if err := b.Delete(common.DeleteRequest{Key: []byte("ns-foo")}); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+	if res := getOne(t, a, "ns-foo"); res.Miss {
+		t.Fatal("Expected a delete in another namespace to leave the key alone")
+	}
+	if err := a.Delete(common.DeleteRequest{Key: []byte("ns-foo")}); err != nil {
+		t.Fatalf("Error deleting: %v", err)
+	}
+
+	if err := a.Flush(common.FlushRequest{}); err != common.ErrNotSupported {
+		t.Fatalf("Expected flush to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package null has a handler that stores nothing. Every store succeeds where it would for a real
+// backend with no data in it and every read misses. It stands in for a disabled L2 and lets the
+// proxy itself be load tested without any backend in the way.
+package null
+
+import (
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+type Handler struct{}
+
+func New() (handlers.Handler, error) {
+	return Handler{}, nil
+}
+
+// Set succeeds unless it carries a CAS, which can never match since there is no item
+func (h Handler) Set(cmd common.SetRequest) error {
+	if cmd.Cas != 0 {
+		return common.ErrKeyNotFound
+	}
+	return nil
+}
+
+func (h Handler) Add(cmd common.SetRequest) error {
+	return nil
+}
+
+func (h Handler) Replace(cmd common.SetRequest) error {
+	return common.ErrKeyNotFound
+}
+
+func (h Handler) Append(cmd common.SetRequest) error {
+	return common.ErrKeyNotFound
+}
+
+func (h Handler) Prepend(cmd common.SetRequest) error {
+	return common.ErrKeyNotFound
+}
+
+func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	for idx, key := range cmd.Keys {
+		dataOut <- common.GetResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Key:    key,
+		}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error)
+
+	for idx, key := range cmd.Keys {
+		dataOut <- common.GetEResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Key:    key,
+		}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{
+		Miss:   true,
+		Quiet:  cmd.Quiet,
+		Opaque: cmd.Opaque,
+		Key:    cmd.Key,
+	}, nil
+}
+
+func (h Handler) Delete(cmd common.DeleteRequest) error {
+	return common.ErrKeyNotFound
+}
+
+func (h Handler) Touch(cmd common.TouchRequest) error {
+	return common.ErrKeyNotFound
+}
+
+func (h Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return incrDecrCommon(cmd)
+}
+
+func (h Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return incrDecrCommon(cmd)
+}
+
+// incrDecrCommon behaves as if the item was just created from the initial value, if one was given
+func incrDecrCommon(cmd common.IncrDecrRequest) (uint64, error) {
+	if cmd.Exptime == common.NoInitialExptime {
+		return 0, common.ErrKeyNotFound
+	}
+	return cmd.Initial, nil
+}
+
+func (h Handler) Stats(group []byte) ([]common.Stat, error) {
+	return nil, nil
+}
+
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	return nil
+}
+
+func (h Handler) Version() (string, error) {
+	return "null", nil
+}
+
+func (h Handler) Close() error {
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package null_test
+
+import (
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/null"
+)
+
+func TestNull(t *testing.T) {
+	h, _ := null.New()
+	key := []byte("key")
+
+	if err := h.Set(common.SetRequest{Key: key, Data: []byte("value")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := h.Add(common.SetRequest{Key: key, Data: []byte("value")}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := h.Set(common.SetRequest{Key: key, Data: []byte("value"), Cas: 1}); err != common.ErrKeyNotFound {
+		t.Fatalf("Set with CAS: %v", err)
+	}
+	if err := h.Replace(common.SetRequest{Key: key, Data: []byte("value")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Replace: %v", err)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: key}); err != common.ErrKeyNotFound {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := h.Touch(common.TouchRequest{Key: key}); err != common.ErrKeyNotFound {
+		t.Fatalf("Touch: %v", err)
+	}
+	if _, err := h.Incr(common.IncrDecrRequest{Key: key, Exptime: common.NoInitialExptime}); err != common.ErrKeyNotFound {
+		t.Fatalf("Incr: %v", err)
+	}
+	if v, err := h.Incr(common.IncrDecrRequest{Key: key, Initial: 10}); err != nil || v != 10 {
+		t.Fatalf("Incr with initial value: %d, %v", v, err)
+	}
+
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{key, key},
+		Opaques: []uint32{1, 2},
+		Quiet:   []bool{false, true},
+	})
+	var n int
+	for res := range resChan {
+		if !res.Miss || res.Opaque != uint32(n+1) || res.Quiet != (n == 1) {
+			t.Fatalf("Unexpected response %+v", res)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 responses, got %d", n)
+	}
+	if err, ok := <-errChan; ok {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if res, err := h.GAT(common.GATRequest{Key: key}); err != nil || !res.Miss {
+		t.Fatalf("GAT: %+v, %v", res, err)
+	}
+}
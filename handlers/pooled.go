@@ -0,0 +1,336 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"log"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricPoolCheckouts = metrics.AddCounter("handler_pool_checkouts", nil)
+	MetricPoolWaits     = metrics.AddCounter("handler_pool_waits", nil)
+	MetricPoolOpened    = metrics.AddCounter("handler_pool_opened", nil)
+	MetricPoolDiscarded = metrics.AddCounter("handler_pool_discarded", nil)
+	MetricPoolErrors    = metrics.AddCounter("handler_pool_errors", nil)
+)
+
+// Pooled shares at most size handlers made by hc between all of the connections that use the
+// returned constructor. Each request checks out a handler for as long as it takes and returns
+// it after, so the number of backend connections is bounded by the pool size instead of growing
+// with the number of clients. Requests wait for a handler when all of them are in use.
+//
+// Handlers are created as they are needed. A handler that returns an error other than an
+// application error is assumed to be broken and is closed instead of being put back.
+func Pooled(hc HandlerConst, size int) HandlerConst {
+	p := &pool{
+		hc:    hc,
+		idle:  make(chan Handler, size),
+		slots: make(chan struct{}, size),
+	}
+	return func() (Handler, error) {
+		return pooledHandler{p}, nil
+	}
+}
+
+type pool struct {
+	hc HandlerConst
+	// idle holds the open handlers that are not checked out
+	idle chan Handler
+	// slots has one entry for each open handler
+	slots chan struct{}
+}
+
+func (p *pool) get() (Handler, error) {
+	metrics.IncCounter(MetricPoolCheckouts)
+
+	select {
+	case h := <-p.idle:
+		return h, nil
+	default:
+	}
+
+	select {
+	case h := <-p.idle:
+		return h, nil
+	case p.slots <- struct{}{}:
+		return p.open()
+	default:
+	}
+
+	metrics.IncCounter(MetricPoolWaits)
+
+	select {
+	case h := <-p.idle:
+		return h, nil
+	case p.slots <- struct{}{}:
+		return p.open()
+	}
+}
+
+func (p *pool) open() (Handler, error) {
+	h, err := p.hc()
+	if err != nil {
+		log.Println("Error opening pooled handler:", err.Error())
+		metrics.IncCounter(MetricPoolErrors)
+		<-p.slots
+		return nil, common.ErrTempFailure
+	}
+	metrics.IncCounter(MetricPoolOpened)
+	return h, nil
+}
+
+// put returns the handler to the pool, unless err shows it is broken
+func (p *pool) put(h Handler, err error) {
+	if err != nil && !common.IsAppError(err) {
+		metrics.IncCounter(MetricPoolDiscarded)
+		h.Close()
+		<-p.slots
+		return
+	}
+	p.idle <- h
+}
+
+// pooledHandler is the handler each connection gets. It holds no backend connection itself.
+type pooledHandler struct {
+	p *pool
+}
+
+// Close does nothing, as the pooled handlers outlive the connections that use them
+func (h pooledHandler) Close() error {
+	return nil
+}
+
+func (h pooledHandler) Set(cmd common.SetRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Set(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+func (h pooledHandler) Add(cmd common.SetRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Add(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+func (h pooledHandler) Replace(cmd common.SetRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Replace(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+func (h pooledHandler) Append(cmd common.SetRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Append(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+func (h pooledHandler) Prepend(cmd common.SetRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Prepend(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+// Get keeps the handler checked out until all of the responses have been passed on
+func (h pooledHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	b, err := h.p.get()
+	if err != nil {
+		go func() {
+			close(dataOut)
+			errorOut <- err
+			close(errorOut)
+		}()
+		return dataOut, errorOut
+	}
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		resChan, errChan := b.Get(cmd)
+		var err error
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				dataOut <- res
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				err = e
+				errorOut <- e
+			}
+		}
+
+		h.p.put(b, err)
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE keeps the handler checked out until all of the responses have been passed on
+func (h pooledHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	b, err := h.p.get()
+	if err != nil {
+		go func() {
+			close(dataOut)
+			errorOut <- err
+			close(errorOut)
+		}()
+		return dataOut, errorOut
+	}
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		resChan, errChan := b.GetE(cmd)
+		var err error
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				dataOut <- res
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				err = e
+				errorOut <- e
+			}
+		}
+
+		h.p.put(b, err)
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h pooledHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	b, err := h.p.get()
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	res, err := b.GAT(cmd)
+	h.p.put(b, err)
+	return res, err
+}
+
+func (h pooledHandler) Delete(cmd common.DeleteRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Delete(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+func (h pooledHandler) Touch(cmd common.TouchRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Touch(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+func (h pooledHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	b, err := h.p.get()
+	if err != nil {
+		return 0, err
+	}
+	val, err := b.Incr(cmd)
+	h.p.put(b, err)
+	return val, err
+}
+
+func (h pooledHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	b, err := h.p.get()
+	if err != nil {
+		return 0, err
+	}
+	val, err := b.Decr(cmd)
+	h.p.put(b, err)
+	return val, err
+}
+
+func (h pooledHandler) Stats(group []byte) ([]common.Stat, error) {
+	b, err := h.p.get()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := b.Stats(group)
+	h.p.put(b, err)
+	return stats, err
+}
+
+func (h pooledHandler) Flush(cmd common.FlushRequest) error {
+	b, err := h.p.get()
+	if err != nil {
+		return err
+	}
+	err = b.Flush(cmd)
+	h.p.put(b, err)
+	return err
+}
+
+func (h pooledHandler) Version() (string, error) {
+	b, err := h.p.get()
+	if err != nil {
+		return "", err
+	}
+	version, err := b.Version()
+	h.p.put(b, err)
+	return version, err
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+)
+
+// countingHandler wraps the in-memory handler to track how many are open
+type countingHandler struct {
+	handlers.Handler
+	c      *counts
+	broken bool
+}
+
+type counts struct {
+	sync.Mutex
+	open, max, opened int
+}
+
+func (h countingHandler) Set(cmd common.SetRequest) error {
+	if h.broken {
+		return io.EOF
+	}
+	return h.Handler.Set(cmd)
+}
+
+func (h countingHandler) Close() error {
+	h.c.Lock()
+	h.c.open--
+	h.c.Unlock()
+	return nil
+}
+
+func countingConst(c *counts, broken bool) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, _ := inmem.New()
+		c.Lock()
+		c.open++
+		c.opened++
+		if c.open > c.max {
+			c.max = c.open
+		}
+		c.Unlock()
+		return countingHandler{h, c, broken}, nil
+	}
+}
+
+func TestPooledBounded(t *testing.T) {
+	c := &counts{}
+	hc := handlers.Pooled(countingConst(c, false), 2)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h, _ := hc()
+			defer h.Close()
+
+			for j := 0; j < 100; j++ {
+				if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+
+				resChan, errChan := h.Get(common.GetRequest{
+					Keys:    [][]byte{[]byte("foo")},
+					Opaques: []uint32{0},
+					Quiet:   []bool{false},
+				})
+				for res := range resChan {
+					if string(res.Data) != "bar" {
+						t.Errorf("Unexpected response %+v", res)
+					}
+				}
+				for err := range errChan {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c.max > 2 {
+		t.Fatalf("Expected at most 2 handlers open, got %d", c.max)
+	}
+}
+
+func TestPooledDiscardsBroken(t *testing.T) {
+	c := &counts{}
+	h, _ := handlers.Pooled(countingConst(c, true), 1)()
+
+	for i := 0; i < 3; i++ {
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != io.EOF {
+			t.Fatalf("Expected the handler's error, got %v", err)
+		}
+	}
+
+	// Each broken handler is closed and replaced
+	if c.opened != 3 || c.open != 0 {
+		t.Fatalf("Expected 3 handlers opened and none left open, got %d and %d", c.opened, c.open)
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricQuorumWriteFailures = metrics.AddCounter("handler_quorum_write_failures", nil)
+	MetricQuorumReadFailures  = metrics.AddCounter("handler_quorum_read_failures", nil)
+)
+
+// QuorumConfig holds the settings used by Quorum.
+type QuorumConfig struct {
+	// Writes is how many replicas have to store a write for it to succeed
+	Writes int
+	// Reads is how many replicas have to give the same answer to a read for it to be returned
+	Reads int
+}
+
+// Quorum keeps the same data in every one of the handlers made by hcs, like Replicated, but only
+// trusts an answer that enough replicas agree on. Every request is sent to all of the replicas at
+// once. A write succeeds when conf.Writes replicas stored it, and otherwise fails with the error
+// most of the replicas gave. A write that fails may still have been stored by some replicas.
+//
+// A read returns an answer once conf.Reads replicas gave it. Each memcached server hands out its
+// own CAS values, so answers are compared by value and flags instead. A key the replicas can't
+// agree on is answered as a miss, and a read that too few replicas answered fails with
+// common.ErrTempFailure.
+func Quorum(conf QuorumConfig, hcs ...HandlerConst) HandlerConst {
+	replicated := Replicated(hcs...)
+	return func() (Handler, error) {
+		h, err := replicated()
+		if err != nil {
+			return nil, err
+		}
+		return &quorumHandler{replicatedHandler: h.(*replicatedHandler), conf: conf}, nil
+	}
+}
+
+// quorumHandler is not safe for concurrent use, the same as the handlers it wraps
+type quorumHandler struct {
+	*replicatedHandler
+	conf QuorumConfig
+}
+
+// run runs op on every live replica at the same time. It returns the indexes of the replicas that
+// answered, and the errors from all of them. Replicas that failed are closed.
+func (h *quorumHandler) run(op func(i int, b Handler) error) ([]int, []error) {
+	live := h.live()
+
+	errs := make([]error, len(h.replicas))
+	wg := new(sync.WaitGroup)
+	for _, i := range live {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = op(i, h.replicas[i].h)
+		}(i)
+	}
+	wg.Wait()
+
+	var answered []int
+	for _, i := range live {
+		if errs[i] != nil && !common.IsAppError(errs[i]) {
+			h.replicas[i].fail(errs[i])
+			continue
+		}
+		answered = append(answered, i)
+	}
+	return answered, errs
+}
+
+// agreed returns the index of the first of the answered replicas that at least n of them agree
+// with, or -1 if there is none
+func agreed(answered []int, n int, same func(a, b int) bool) int {
+	for _, a := range answered {
+		count := 0
+		for _, b := range answered {
+			if same(a, b) {
+				count++
+			}
+		}
+		if count >= n {
+			return a
+		}
+	}
+	return -1
+}
+
+// write runs a write on every replica and decides its result
+func (h *quorumHandler) write(op func(b Handler) error) error {
+	answered, errs := h.run(func(_ int, b Handler) error { return op(b) })
+
+	chosen := agreed(answered, h.conf.Writes, func(a, b int) bool { return errs[a] == errs[b] })
+	if chosen != -1 {
+		return errs[chosen]
+	}
+
+	metrics.IncCounter(MetricQuorumWriteFailures)
+
+	// The replicas didn't agree, so the error that the most of them gave is returned
+	var mostErr error
+	most := 0
+	for _, a := range answered {
+		if errs[a] == nil {
+			continue
+		}
+		count := 0
+		for _, b := range answered {
+			if errs[b] == errs[a] {
+				count++
+			}
+		}
+		if count > most {
+			most, mostErr = count, errs[a]
+		}
+	}
+	if mostErr == nil {
+		return common.ErrTempFailure
+	}
+	return mostErr
+}
+
+func (h *quorumHandler) Set(cmd common.SetRequest) error {
+	return h.write(func(b Handler) error { return b.Set(cmd) })
+}
+
+func (h *quorumHandler) Add(cmd common.SetRequest) error {
+	return h.write(func(b Handler) error { return b.Add(cmd) })
+}
+
+func (h *quorumHandler) Replace(cmd common.SetRequest) error {
+	return h.write(func(b Handler) error { return b.Replace(cmd) })
+}
+
+func (h *quorumHandler) Append(cmd common.SetRequest) error {
+	return h.write(func(b Handler) error { return b.Append(cmd) })
+}
+
+func (h *quorumHandler) Prepend(cmd common.SetRequest) error {
+	return h.write(func(b Handler) error { return b.Prepend(cmd) })
+}
+
+func (h *quorumHandler) Delete(cmd common.DeleteRequest) error {
+	return h.write(func(b Handler) error { return b.Delete(cmd) })
+}
+
+func (h *quorumHandler) Touch(cmd common.TouchRequest) error {
+	return h.write(func(b Handler) error { return b.Touch(cmd) })
+}
+
+func (h *quorumHandler) Flush(cmd common.FlushRequest) error {
+	return h.write(func(b Handler) error { return b.Flush(cmd) })
+}
+
+// sameValue says whether two answers to a read are the same for a quorum
+func sameValue(missA, missB bool, flagsA, flagsB uint32, dataA, dataB []byte) bool {
+	if missA || missB {
+		return missA == missB
+	}
+	return flagsA == flagsB && bytes.Equal(dataA, dataB)
+}
+
+// Get reads every key from all of the replicas and answers each with what enough of them agree
+// on. Replicas that fail part way through the request are left out of all of its keys.
+func (h *quorumHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	// Responses are collected before any are passed on, so streams can't be read in time
+	cmd.Stream = false
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		responses := make([][]common.GetResponse, len(h.replicas))
+		answered, errs := h.run(func(i int, b Handler) error {
+			resChan, errChan := b.Get(cmd)
+			var err error
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					responses[i] = append(responses[i], res)
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			return err
+		})
+
+		answered = complete(answered, errs, len(cmd.Keys), func(i int) int { return len(responses[i]) })
+		if len(answered) < h.conf.Reads {
+			metrics.IncCounter(MetricQuorumReadFailures)
+			errorOut <- common.ErrTempFailure
+			return
+		}
+
+		for k := range cmd.Keys {
+			chosen := agreed(answered, h.conf.Reads, func(a, b int) bool {
+				ra, rb := responses[a][k], responses[b][k]
+				return sameValue(ra.Miss, rb.Miss, ra.Flags, rb.Flags, ra.Data, rb.Data)
+			})
+			if chosen == -1 {
+				metrics.IncCounter(MetricQuorumReadFailures)
+				dataOut <- common.GetResponse{
+					Key:    cmd.Keys[k],
+					Opaque: cmd.Opaques[k],
+					Quiet:  cmd.Quiet[k],
+					Miss:   true,
+				}
+				continue
+			}
+			dataOut <- responses[chosen][k]
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE works the same way as Get. Expiration times are not compared, since replicas that stored
+// the same write a moment apart can differ by a second.
+func (h *quorumHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		responses := make([][]common.GetEResponse, len(h.replicas))
+		answered, errs := h.run(func(i int, b Handler) error {
+			resChan, errChan := b.GetE(cmd)
+			var err error
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					responses[i] = append(responses[i], res)
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			return err
+		})
+
+		answered = complete(answered, errs, len(cmd.Keys), func(i int) int { return len(responses[i]) })
+		if len(answered) < h.conf.Reads {
+			metrics.IncCounter(MetricQuorumReadFailures)
+			errorOut <- common.ErrTempFailure
+			return
+		}
+
+		for k := range cmd.Keys {
+			chosen := agreed(answered, h.conf.Reads, func(a, b int) bool {
+				ra, rb := responses[a][k], responses[b][k]
+				return sameValue(ra.Miss, rb.Miss, ra.Flags, rb.Flags, ra.Data, rb.Data)
+			})
+			if chosen == -1 {
+				metrics.IncCounter(MetricQuorumReadFailures)
+				dataOut <- common.GetEResponse{
+					Key:    cmd.Keys[k],
+					Opaque: cmd.Opaques[k],
+					Quiet:  cmd.Quiet[k],
+					Miss:   true,
+				}
+				continue
+			}
+			dataOut <- responses[chosen][k]
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// complete returns the replicas that answered every key of a read without an error
+func complete(answered []int, errs []error, keys int, count func(i int) int) []int {
+	var done []int
+	for _, i := range answered {
+		if errs[i] == nil && count(i) == keys {
+			done = append(done, i)
+		}
+	}
+	return done
+}
+
+// GAT changes the expiration time, so it goes to every replica like a touch. The answer is chosen
+// the same way as for a get.
+func (h *quorumHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	responses := make([]common.GetResponse, len(h.replicas))
+	answered, errs := h.run(func(i int, b Handler) error {
+		var err error
+		responses[i], err = b.GAT(cmd)
+		return err
+	})
+
+	chosen := agreed(answered, h.conf.Reads, func(a, b int) bool {
+		if errs[a] != nil || errs[b] != nil {
+			return errs[a] == errs[b]
+		}
+		ra, rb := responses[a], responses[b]
+		return sameValue(ra.Miss, rb.Miss, ra.Flags, rb.Flags, ra.Data, rb.Data)
+	})
+	if chosen == -1 {
+		metrics.IncCounter(MetricQuorumReadFailures)
+		return common.GetResponse{}, common.ErrTempFailure
+	}
+	return responses[chosen], errs[chosen]
+}
+
+func (h *quorumHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(func(b Handler) (uint64, error) { return b.Incr(cmd) })
+}
+
+func (h *quorumHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(func(b Handler) (uint64, error) { return b.Decr(cmd) })
+}
+
+// arith runs an increment or decrement on every replica. It is a write, but the new value also
+// has to be the same on enough replicas to be returned.
+func (h *quorumHandler) arith(op func(b Handler) (uint64, error)) (uint64, error) {
+	values := make([]uint64, len(h.replicas))
+	answered, errs := h.run(func(i int, b Handler) error {
+		var err error
+		values[i], err = op(b)
+		return err
+	})
+
+	chosen := agreed(answered, h.conf.Writes, func(a, b int) bool {
+		return errs[a] == errs[b] && values[a] == values[b]
+	})
+	if chosen == -1 {
+		metrics.IncCounter(MetricQuorumWriteFailures)
+		return 0, common.ErrTempFailure
+	}
+	return values[chosen], errs[chosen]
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+// mapHandler keeps its data in a map of its own and remembers the exptime of the last set. Sets
+// fail with err if it is set.
+type mapHandler struct {
+	handlers.Handler
+	mu      sync.Mutex
+	data    map[string]string
+	err     error
+	exptime uint32
+}
+
+func newMapHandler() *mapHandler {
+	return &mapHandler{data: make(map[string]string)}
+}
+
+func (h *mapHandler) Set(cmd common.SetRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.err != nil {
+		return h.err
+	}
+	h.data[string(cmd.Key)] = string(cmd.Data)
+	h.exptime = cmd.Exptime
+	return nil
+}
+
+func (h *mapHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := make(chan common.GetResponse, len(cmd.Keys))
+	errs := make(chan error)
+	for i, key := range cmd.Keys {
+		data, ok := h.data[string(key)]
+		res <- common.GetResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte(data), Miss: !ok}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h *mapHandler) Add(cmd common.SetRequest) error {
+	h.mu.Lock()
+	_, ok := h.data[string(cmd.Key)]
+	h.mu.Unlock()
+	if ok {
+		return common.ErrKeyExists
+	}
+	return h.Set(cmd)
+}
+
+func (h *mapHandler) Delete(cmd common.DeleteRequest) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(h.data, string(cmd.Key))
+	return nil
+}
+
+func (h *mapHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := make(chan common.GetEResponse, len(cmd.Keys))
+	errs := make(chan error)
+	for i, key := range cmd.Keys {
+		data, ok := h.data[string(key)]
+		res <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte(data), Miss: !ok}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h *mapHandler) Close() error { return nil }
+
+func mapConsts(replicas ...*mapHandler) []handlers.HandlerConst {
+	var hcs []handlers.HandlerConst
+	for _, r := range replicas {
+		r := r
+		hcs = append(hcs, func() (handlers.Handler, error) { return r, nil })
+	}
+	return hcs
+}
+
+func quorumGet(h handlers.Handler, key string) (common.GetResponse, error) {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			res = r
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			err = e
+		}
+	}
+	return res, err
+}
+
+func TestQuorum(t *testing.T) {
+	conf := handlers.QuorumConfig{Writes: 2, Reads: 2}
+
+	t.Run("Majority", func(t *testing.T) {
+		a, b, c := newMapHandler(), newMapHandler(), newMapHandler()
+		h, _ := handlers.Quorum(conf, mapConsts(a, b, c)...)()
+
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+
+		// One stale replica is outvoted
+		a.data["foo"] = "stale"
+		res, err := quorumGet(h, "foo")
+		if err != nil || res.Miss || string(res.Data) != "bar" {
+			t.Fatalf("Expected the value most replicas have, got %+v and %v", res, err)
+		}
+	})
+
+	t.Run("Disagree", func(t *testing.T) {
+		a, b, c := newMapHandler(), newMapHandler(), newMapHandler()
+		h, _ := handlers.Quorum(conf, mapConsts(a, b, c)...)()
+
+		a.data["foo"] = "one"
+		b.data["foo"] = "two"
+		res, err := quorumGet(h, "foo")
+		if err != nil || !res.Miss {
+			t.Fatalf("Expected a miss, got %+v and %v", res, err)
+		}
+	})
+
+	t.Run("WriteFails", func(t *testing.T) {
+		a, b, c := newMapHandler(), newMapHandler(), newMapHandler()
+		b.err = common.ErrNoMem
+		c.err = common.ErrNoMem
+		h, _ := handlers.Quorum(conf, mapConsts(a, b, c)...)()
+
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != common.ErrNoMem {
+			t.Fatalf("Expected ErrNoMem, got %v", err)
+		}
+	})
+
+	t.Run("TooFewReplicas", func(t *testing.T) {
+		a := newMapHandler()
+		broken := func() (handlers.Handler, error) { return nil, errors.New("broken") }
+		h, _ := handlers.Quorum(conf, append(mapConsts(a), broken, broken)...)()
+
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure for the set, got %v", err)
+		}
+		if _, err := quorumGet(h, "foo"); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure for the get, got %v", err)
+		}
+	})
+}
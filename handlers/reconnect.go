@@ -0,0 +1,418 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricBackendFailures        = metrics.AddCounter("handler_backend_failures", nil)
+	MetricBackendTimeouts        = metrics.AddCounter("handler_backend_timeouts", nil)
+	MetricBackendDeadlines       = metrics.AddCounter("handler_backend_deadlines", nil)
+	MetricBackendReconnects      = metrics.AddCounter("handler_backend_reconnects", nil)
+	MetricBackendReconnectErrors = metrics.AddCounter("handler_backend_reconnect_errors", nil)
+	MetricBackendUnhealthy       = metrics.AddIntGauge("handler_backends_unhealthy", nil)
+)
+
+// ReconnectMinBackoff and ReconnectMaxBackoff bound the time between attempts to reconnect to a
+// backend. The backoff doubles after each failed attempt.
+var (
+	ReconnectMinBackoff = 10 * time.Millisecond
+	ReconnectMaxBackoff = 5 * time.Second
+)
+
+// unhealthy is the number of reconnecting handlers whose backend is currently down
+var unhealthy int64
+
+// Reconnecting wraps the handlers made by hc so that a dead backend connection doesn't take the
+// client connection down with it. When the backend returns an error other than an application
+// error, like an EOF or a timeout, the handler is closed and the backend marked unhealthy.
+// Requests fail fast with ErrTempFailure until a new handler can be made, which is tried again
+// with exponential backoff.
+//
+// A request with a context (see common.WithContext) is also cut off when its deadline passes
+// before the backend answers. The backend connection is closed, since it can't be used again
+// with the answer still on the way, and the request fails with ErrTimeout. A request that arrives
+// with its deadline already passed, like a retry of one that was cut off, fails the same way
+// without reaching the backend.
+func Reconnecting(hc HandlerConst) HandlerConst {
+	return func() (Handler, error) {
+		h := &reconnectingHandler{hc: hc}
+		if b, err := hc(); err == nil {
+			h.h = b
+		} else {
+			log.Println("Error connecting to backend:", err.Error())
+			h.markUnhealthy()
+		}
+		return h, nil
+	}
+}
+
+// reconnectingHandler is not safe for concurrent use, the same as the handlers it wraps
+type reconnectingHandler struct {
+	hc HandlerConst
+	h  Handler
+	// backoff is the wait before the next reconnect attempt after retryAt
+	backoff time.Duration
+	retryAt time.Time
+	closed  bool
+}
+
+func (h *reconnectingHandler) markUnhealthy() {
+	metrics.SetIntGauge(MetricBackendUnhealthy, uint64(atomic.AddInt64(&unhealthy, 1)))
+	h.backoff = ReconnectMinBackoff
+	h.retryAt = time.Now().Add(h.backoff)
+}
+
+// backend returns the current handler, reconnecting if it's broken and the backoff has passed.
+// A request whose context is already done gets ErrTimeout instead, so it neither dials a new
+// connection nor has the current one closed under it by deadline. ctx may be nil.
+func (h *reconnectingHandler) backend(ctx context.Context) (Handler, error) {
+	if ctx != nil && ctx.Err() != nil {
+		return nil, common.ErrTimeout
+	}
+	if h.h != nil {
+		return h.h, nil
+	}
+	if time.Now().Before(h.retryAt) {
+		return nil, common.ErrTempFailure
+	}
+
+	b, err := h.hc()
+	if err != nil {
+		metrics.IncCounter(MetricBackendReconnectErrors)
+		h.backoff *= 2
+		if h.backoff > ReconnectMaxBackoff {
+			h.backoff = ReconnectMaxBackoff
+		}
+		h.retryAt = time.Now().Add(h.backoff)
+		return nil, common.ErrTempFailure
+	}
+
+	metrics.IncCounter(MetricBackendReconnects)
+	metrics.SetIntGauge(MetricBackendUnhealthy, uint64(atomic.AddInt64(&unhealthy, -1)))
+	h.h = b
+	return b, nil
+}
+
+// done checks the error from the backend. Errors that mean the connection is broken close it and
+// are turned into ErrTimeout if the backend was too slow or ErrTempFailure otherwise, so the
+// client only sees that one request fail.
+func (h *reconnectingHandler) done(err error) error {
+	if err == nil || common.IsAppError(err) {
+		return err
+	}
+
+	log.Println("Backend connection failed:", err.Error())
+	metrics.IncCounter(MetricBackendFailures)
+	h.h.Close()
+	h.h = nil
+	h.markUnhealthy()
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		metrics.IncCounter(MetricBackendTimeouts)
+		return common.ErrTimeout
+	}
+	return common.ErrTempFailure
+}
+
+// deadline watches ctx while b works on a request and closes b if the deadline of the request
+// passes first, which unblocks a backend that isn't answering. end must be called once b is done
+// and reports whether b was closed. A request that is canceled instead, like when it is done, is
+// left alone.
+func deadline(ctx context.Context, b Handler) (end func() bool) {
+	if ctx == nil {
+		return func() bool { return false }
+	}
+
+	var lock sync.Mutex
+	var ended, closed bool
+	stop := context.AfterFunc(ctx, func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if !ended && ctx.Err() == context.DeadlineExceeded {
+			b.Close()
+			closed = true
+		}
+	})
+
+	return func() bool {
+		stop()
+		lock.Lock()
+		defer lock.Unlock()
+		ended = true
+		return closed
+	}
+}
+
+// finish is done for a request b was given with a deadline
+func (h *reconnectingHandler) finish(b Handler, end func() bool, err error) error {
+	if !end() {
+		return h.done(err)
+	}
+
+	// b is already closed, and is only forgotten once, whatever number of errors it sent
+	if h.h == b {
+		log.Println("Backend missed the request deadline")
+		metrics.IncCounter(MetricBackendDeadlines)
+		h.h = nil
+		h.markUnhealthy()
+	}
+	return common.ErrTimeout
+}
+
+func (h *reconnectingHandler) Set(cmd common.SetRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Set(cmd))
+}
+
+func (h *reconnectingHandler) Add(cmd common.SetRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Add(cmd))
+}
+
+func (h *reconnectingHandler) Replace(cmd common.SetRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Replace(cmd))
+}
+
+func (h *reconnectingHandler) Append(cmd common.SetRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Append(cmd))
+}
+
+func (h *reconnectingHandler) Prepend(cmd common.SetRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Prepend(cmd))
+}
+
+func (h *reconnectingHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		go func() {
+			close(dataOut)
+			errorOut <- err
+			close(errorOut)
+		}()
+		return dataOut, errorOut
+	}
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		end := deadline(cmd.Ctx, b)
+		var failed bool
+
+		resChan, errChan := b.Get(cmd)
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				dataOut <- res
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				errorOut <- h.finish(b, end, err)
+				failed = true
+			}
+		}
+
+		// The backend can finish the request right as it's cut off
+		if !failed && end() {
+			errorOut <- h.finish(b, end, nil)
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *reconnectingHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		go func() {
+			close(dataOut)
+			errorOut <- err
+			close(errorOut)
+		}()
+		return dataOut, errorOut
+	}
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		end := deadline(cmd.Ctx, b)
+		var failed bool
+
+		resChan, errChan := b.GetE(cmd)
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				dataOut <- res
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				errorOut <- h.finish(b, end, err)
+				failed = true
+			}
+		}
+
+		// The backend can finish the request right as it's cut off
+		if !failed && end() {
+			errorOut <- h.finish(b, end, nil)
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *reconnectingHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	end := deadline(cmd.Ctx, b)
+	res, err := b.GAT(cmd)
+	return res, h.finish(b, end, err)
+}
+
+func (h *reconnectingHandler) Delete(cmd common.DeleteRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Delete(cmd))
+}
+
+func (h *reconnectingHandler) Touch(cmd common.TouchRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Touch(cmd))
+}
+
+func (h *reconnectingHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return 0, err
+	}
+	end := deadline(cmd.Ctx, b)
+	v, err := b.Incr(cmd)
+	return v, h.finish(b, end, err)
+}
+
+func (h *reconnectingHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return 0, err
+	}
+	end := deadline(cmd.Ctx, b)
+	v, err := b.Decr(cmd)
+	return v, h.finish(b, end, err)
+}
+
+func (h *reconnectingHandler) Stats(group []byte) ([]common.Stat, error) {
+	b, err := h.backend(nil)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := b.Stats(group)
+	return stats, h.done(err)
+}
+
+func (h *reconnectingHandler) Flush(cmd common.FlushRequest) error {
+	b, err := h.backend(cmd.Ctx)
+	if err != nil {
+		return err
+	}
+	end := deadline(cmd.Ctx, b)
+	return h.finish(b, end, b.Flush(cmd))
+}
+
+func (h *reconnectingHandler) Version() (string, error) {
+	b, err := h.backend(nil)
+	if err != nil {
+		return "", err
+	}
+	v, err := b.Version()
+	return v, h.done(err)
+}
+
+// Close closes the current backend handler. A handler that is waiting to reconnect no longer
+// counts as unhealthy once its client is gone.
+func (h *reconnectingHandler) Close() error {
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+
+	if h.h == nil {
+		metrics.SetIntGauge(MetricBackendUnhealthy, uint64(atomic.AddInt64(&unhealthy, -1)))
+		return nil
+	}
+	err := h.h.Close()
+	h.h = nil
+	return err
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+)
+
+func TestReconnectingFailsFast(t *testing.T) {
+	defer func(d time.Duration) { handlers.ReconnectMinBackoff = d }(handlers.ReconnectMinBackoff)
+	handlers.ReconnectMinBackoff = time.Hour
+
+	c := &counts{}
+	h, err := handlers.Reconnecting(countingConst(c, true))()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer h.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+	}
+
+	// The broken handler is closed and no new one is made until the backoff has passed
+	if c.opened != 1 || c.open != 0 {
+		t.Fatalf("Expected 1 handler opened and none left open, got %d and %d", c.opened, c.open)
+	}
+}
+
+func TestReconnectingReconnects(t *testing.T) {
+	defer func(d time.Duration) { handlers.ReconnectMinBackoff = d }(handlers.ReconnectMinBackoff)
+	handlers.ReconnectMinBackoff = 0
+
+	c := &counts{}
+	h, _ := handlers.Reconnecting(countingConst(c, true))()
+	defer h.Close()
+
+	for i := 0; i < 3; i++ {
+		h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+	}
+	if c.opened != 3 || c.open != 0 {
+		t.Fatalf("Expected a new handler for each request, got %d opened and %d open", c.opened, c.open)
+	}
+
+	// Requests that don't fail keep using the same handler
+	h.Touch(common.TouchRequest{Key: []byte("foo")})
+	h.Touch(common.TouchRequest{Key: []byte("foo")})
+	if c.opened != 4 || c.open != 1 {
+		t.Fatalf("Expected one more handler opened and kept, got %d opened and %d open", c.opened, c.open)
+	}
+}
+
+// hangingHandler never answers sets, like a backend that stopped responding, until it's closed
+type hangingHandler struct {
+	handlers.Handler
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+func (h hangingHandler) Set(cmd common.SetRequest) error {
+	<-h.closed
+	return common.ErrInternal
+}
+
+func (h hangingHandler) Close() error {
+	h.closeOnce.Do(func() { close(h.closed) })
+	return nil
+}
+
+func TestReconnectingDeadline(t *testing.T) {
+	defer func(d time.Duration) { handlers.ReconnectMinBackoff = d }(handlers.ReconnectMinBackoff)
+	handlers.ReconnectMinBackoff = 0
+
+	var opened int
+	h, _ := handlers.Reconnecting(func() (handlers.Handler, error) {
+		opened++
+		b, _ := inmem.New()
+		return hangingHandler{b, make(chan struct{}), &sync.Once{}}, nil
+	})()
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar"), Ctx: ctx}); err != common.ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+
+	// The hung backend was closed, so the next request gets a new one
+	if err := h.Touch(common.TouchRequest{Key: []byte("foo")}); err == common.ErrTimeout || err == common.ErrTempFailure {
+		t.Fatalf("Expected the backend to answer, got %v", err)
+	}
+	if opened != 2 {
+		t.Fatalf("Expected 2 handlers opened, got %d", opened)
+	}
+
+	// A request that is done before its deadline leaves the backend alone
+	ctx, cancel = context.WithCancel(context.Background())
+	h.Touch(common.TouchRequest{Key: []byte("foo"), Ctx: ctx})
+	cancel()
+	h.Touch(common.TouchRequest{Key: []byte("foo")})
+	if opened != 2 {
+		t.Fatalf("Expected no more handlers opened, got %d", opened)
+	}
+}
+
+func TestReconnectingExpiredContext(t *testing.T) {
+	defer func(d time.Duration) { handlers.ReconnectMinBackoff = d }(handlers.ReconnectMinBackoff)
+	handlers.ReconnectMinBackoff = 0
+
+	var opened int
+	h, _ := handlers.Reconnecting(func() (handlers.Handler, error) {
+		opened++
+		b, _ := inmem.New()
+		return hangingHandler{b, make(chan struct{}), &sync.Once{}}, nil
+	})()
+	defer h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar"), Ctx: ctx})
+
+	// Retries of the expired request don't dial new backends only to have them closed
+	for i := 0; i < 3; i++ {
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar"), Ctx: ctx}); err != common.ErrTimeout {
+			t.Fatalf("Expected ErrTimeout, got %v", err)
+		}
+	}
+	if opened != 1 {
+		t.Fatalf("Expected no more handlers opened, got %d", opened)
+	}
+
+	// Nor do they close a healthy one
+	h.Touch(common.TouchRequest{Key: []byte("foo")})
+	if err := h.Touch(common.TouchRequest{Key: []byte("foo"), Ctx: ctx}); err != common.ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	h.Touch(common.TouchRequest{Key: []byte("foo")})
+	if opened != 2 {
+		t.Fatalf("Expected the new handler to be kept, got %d opened", opened)
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricReplicaFailures = metrics.AddCounter("handler_replica_failures", nil)
+	MetricReplicaReopened = metrics.AddCounter("handler_replica_reopened", nil)
+	MetricReplicaNoneLive = metrics.AddCounter("handler_replica_none_live", nil)
+)
+
+// ReplicaRetryInterval is how long a broken replica is left alone before it is opened again
+var ReplicaRetryInterval = time.Second
+
+// Replicated keeps the same data in every one of the handlers made by hcs. Writes, deletes and
+// touches are sent to all of them at once and reads are served by the first one that works, so a
+// pair of memcached servers can be run active-active behind one proxy.
+//
+// The result of an operation is the one from the first replica that did not fail. A replica that
+// returns an error other than an application error is closed and skipped until it is reopened.
+// Replicas are not repaired when they come back; they fill in again as data is written.
+func Replicated(hcs ...HandlerConst) HandlerConst {
+	return func() (Handler, error) {
+		h := &replicatedHandler{replicas: make([]replica, len(hcs))}
+		for i, hc := range hcs {
+			h.replicas[i].hc = hc
+			h.replicas[i].open()
+		}
+		return h, nil
+	}
+}
+
+type replica struct {
+	hc HandlerConst
+	h  Handler
+	// retryAt is when a broken replica may be opened again
+	retryAt time.Time
+}
+
+func (r *replica) open() {
+	h, err := r.hc()
+	if err != nil {
+		log.Println("Error opening replica:", err.Error())
+		metrics.IncCounter(MetricReplicaFailures)
+		r.retryAt = time.Now().Add(ReplicaRetryInterval)
+		return
+	}
+	r.h = h
+}
+
+func (r *replica) fail(err error) {
+	log.Println("Replica failed:", err.Error())
+	metrics.IncCounter(MetricReplicaFailures)
+	r.h.Close()
+	r.h = nil
+	r.retryAt = time.Now().Add(ReplicaRetryInterval)
+}
+
+// replicatedHandler is not safe for concurrent use, the same as the handlers it wraps
+type replicatedHandler struct {
+	replicas []replica
+}
+
+// live returns the indexes of the working replicas, in order, reopening broken ones that are due
+func (h *replicatedHandler) live() []int {
+	var live []int
+	for i := range h.replicas {
+		r := &h.replicas[i]
+		if r.h == nil && !time.Now().Before(r.retryAt) {
+			r.open()
+			if r.h != nil {
+				metrics.IncCounter(MetricReplicaReopened)
+			}
+		}
+		if r.h != nil {
+			live = append(live, i)
+		}
+	}
+	if len(live) == 0 {
+		metrics.IncCounter(MetricReplicaNoneLive)
+	}
+	return live
+}
+
+// all runs op on every live replica at the same time. It returns the index of the replica whose
+// result should be used and that result.
+func (h *replicatedHandler) all(op func(i int, b Handler) error) (int, error) {
+	live := h.live()
+	if len(live) == 0 {
+		return -1, common.ErrTempFailure
+	}
+
+	errs := make([]error, len(h.replicas))
+	wg := new(sync.WaitGroup)
+	for _, i := range live {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = op(i, h.replicas[i].h)
+		}(i)
+	}
+	wg.Wait()
+
+	chosen := -1
+	for _, i := range live {
+		if errs[i] != nil && !common.IsAppError(errs[i]) {
+			h.replicas[i].fail(errs[i])
+			continue
+		}
+		if chosen == -1 {
+			chosen = i
+		}
+	}
+
+	if chosen == -1 {
+		return -1, errs[live[len(live)-1]]
+	}
+	return chosen, errs[chosen]
+}
+
+// first runs op on one replica at a time until one of them works
+func (h *replicatedHandler) first(op func(b Handler) error) error {
+	live := h.live()
+	if len(live) == 0 {
+		return common.ErrTempFailure
+	}
+
+	var err error
+	for _, i := range live {
+		err = op(h.replicas[i].h)
+		if err == nil || common.IsAppError(err) {
+			return err
+		}
+		h.replicas[i].fail(err)
+	}
+	return err
+}
+
+func (h *replicatedHandler) Set(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Set(cmd) })
+	return err
+}
+
+func (h *replicatedHandler) Add(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Add(cmd) })
+	return err
+}
+
+func (h *replicatedHandler) Replace(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Replace(cmd) })
+	return err
+}
+
+func (h *replicatedHandler) Append(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Append(cmd) })
+	return err
+}
+
+func (h *replicatedHandler) Prepend(cmd common.SetRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Prepend(cmd) })
+	return err
+}
+
+// Get reads all of the responses from a replica before passing any of them on, so that if the
+// replica fails part way through the whole request can be served by the next one instead.
+func (h *replicatedHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	// Responses are collected before any are passed on, so streams can't be read in time
+	cmd.Stream = false
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		var responses []common.GetResponse
+		err := h.first(func(b Handler) error {
+			responses = responses[:0]
+			resChan, errChan := b.Get(cmd)
+			var err error
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					responses = append(responses, res)
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			return err
+		})
+
+		for _, res := range responses {
+			dataOut <- res
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE works the same way as Get
+func (h *replicatedHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		var responses []common.GetEResponse
+		err := h.first(func(b Handler) error {
+			responses = responses[:0]
+			resChan, errChan := b.GetE(cmd)
+			var err error
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					responses = append(responses, res)
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			return err
+		})
+
+		for _, res := range responses {
+			dataOut <- res
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GAT changes the expiration time, so it goes to every replica like a touch
+func (h *replicatedHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	responses := make([]common.GetResponse, len(h.replicas))
+	i, err := h.all(func(i int, b Handler) error {
+		var err error
+		responses[i], err = b.GAT(cmd)
+		return err
+	})
+	if i == -1 {
+		return common.GetResponse{}, err
+	}
+	return responses[i], err
+}
+
+func (h *replicatedHandler) Delete(cmd common.DeleteRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Delete(cmd) })
+	return err
+}
+
+func (h *replicatedHandler) Touch(cmd common.TouchRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Touch(cmd) })
+	return err
+}
+
+func (h *replicatedHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	values := make([]uint64, len(h.replicas))
+	i, err := h.all(func(i int, b Handler) error {
+		var err error
+		values[i], err = b.Incr(cmd)
+		return err
+	})
+	if i == -1 {
+		return 0, err
+	}
+	return values[i], err
+}
+
+func (h *replicatedHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	values := make([]uint64, len(h.replicas))
+	i, err := h.all(func(i int, b Handler) error {
+		var err error
+		values[i], err = b.Decr(cmd)
+		return err
+	})
+	if i == -1 {
+		return 0, err
+	}
+	return values[i], err
+}
+
+func (h *replicatedHandler) Stats(group []byte) ([]common.Stat, error) {
+	var stats []common.Stat
+	err := h.first(func(b Handler) error {
+		var err error
+		stats, err = b.Stats(group)
+		return err
+	})
+	return stats, err
+}
+
+func (h *replicatedHandler) Flush(cmd common.FlushRequest) error {
+	_, err := h.all(func(_ int, b Handler) error { return b.Flush(cmd) })
+	return err
+}
+
+func (h *replicatedHandler) Version() (string, error) {
+	var version string
+	err := h.first(func(b Handler) error {
+		var err error
+		version, err = b.Version()
+		return err
+	})
+	return version, err
+}
+
+func (h *replicatedHandler) Close() error {
+	for i := range h.replicas {
+		if h.replicas[i].h != nil {
+			h.replicas[i].h.Close()
+			h.replicas[i].h = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+	"github.com/hongst/rend/handlers/null"
+)
+
+// recordingHandler stores nothing but remembers the keys that were set
+type recordingHandler struct {
+	handlers.Handler
+	mu   *sync.Mutex
+	keys *[]string
+}
+
+func (h recordingHandler) Set(cmd common.SetRequest) error {
+	h.mu.Lock()
+	*h.keys = append(*h.keys, string(cmd.Key))
+	h.mu.Unlock()
+	return h.Handler.Set(cmd)
+}
+
+func recordingConst(keys *[]string) handlers.HandlerConst {
+	mu := new(sync.Mutex)
+	return func() (handlers.Handler, error) {
+		h, _ := null.New()
+		return recordingHandler{h, mu, keys}, nil
+	}
+}
+
+func TestReplicatedWritesAll(t *testing.T) {
+	var keys []string
+	h, _ := handlers.Replicated(inmem.New, recordingConst(&keys))()
+	defer h.Close()
+
+	if err := h.Set(common.SetRequest{Key: []byte("replicated"), Data: []byte("bar")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "replicated" {
+		t.Fatalf("Expected the set to reach the second replica, got %v", keys)
+	}
+
+	// Reads come from the first replica, which has the data
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("replicated")},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	for res := range resChan {
+		if res.Miss || string(res.Data) != "bar" {
+			t.Fatalf("Unexpected response %+v", res)
+		}
+	}
+	for err := range errChan {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestReplicatedSkipsBroken(t *testing.T) {
+	defer func(d time.Duration) { handlers.ReplicaRetryInterval = d }(handlers.ReplicaRetryInterval)
+	handlers.ReplicaRetryInterval = time.Hour
+
+	c := &counts{}
+	h, _ := handlers.Replicated(countingConst(c, true), inmem.New)()
+	defer h.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Expected the working replica's result, got %v", err)
+		}
+	}
+
+	// The broken replica is closed after the first failure and not reopened until the retry interval
+	if c.opened != 1 || c.open != 0 {
+		t.Fatalf("Expected 1 handler opened and none left open, got %d and %d", c.opened, c.open)
+	}
+
+}
+
+func TestReplicatedReopens(t *testing.T) {
+	defer func(d time.Duration) { handlers.ReplicaRetryInterval = d }(handlers.ReplicaRetryInterval)
+	handlers.ReplicaRetryInterval = 0
+
+	c := &counts{}
+	h, _ := handlers.Replicated(countingConst(c, true), inmem.New)()
+	defer h.Close()
+
+	for i := 0; i < 3; i++ {
+		h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+	}
+
+	if c.opened != 3 || c.open != 0 {
+		t.Fatalf("Expected the broken replica to be reopened for each request, got %d opened and %d open", c.opened, c.open)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricRetries        = metrics.AddCounter("handler_retries", nil)
+	MetricRetrySuccess   = metrics.AddCounter("handler_retry_success", nil)
+	MetricRetryExhausted = metrics.AddCounter("handler_retry_exhausted", nil)
+)
+
+// RetryConfig controls how the Retrying wrapper retries
+type RetryConfig struct {
+	// Retries is the most times a request is retried after the first attempt
+	Retries int
+	// Backoff is the average wait before the first retry. It doubles each retry and each wait is
+	// jittered by up to half in either direction so clients don't retry in lockstep.
+	Backoff time.Duration
+}
+
+var DefaultRetryConfig = RetryConfig{
+	Retries: 2,
+	Backoff: 20 * time.Millisecond,
+}
+
+// Retrying retries the idempotent operations on the handlers made by hc when they fail with a
+// transient error. Those are Get, GetE, GAT, Touch and Delete. Anything that changes data in a
+// way that can't safely be repeated goes straight through.
+//
+// A broken connection stays broken, so retries only help if the handlers reconnect by themselves,
+// like the ones made by Reconnecting. A request whose context (see common.WithContext) is done
+// isn't retried, since nobody is waiting for the answer any more.
+func Retrying(hc HandlerConst, conf RetryConfig) HandlerConst {
+	return func() (Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return retryingHandler{Handler: h, conf: conf}, nil
+	}
+}
+
+// transient decides if an error is worth retrying. IO errors and the errors that the other
+// handler wrappers turn them into are; answers from the backend are not.
+func transient(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !common.IsAppError(err) || err == common.ErrTempFailure || err == common.ErrTimeout
+}
+
+type retryingHandler struct {
+	Handler
+	conf RetryConfig
+}
+
+// retry runs op until it succeeds, fails with an error that isn't transient, runs out of retries
+// or ctx is done. ctx may be nil. The last error is returned.
+func (h retryingHandler) retry(ctx context.Context, op func() error) error {
+	err := op()
+	backoff := h.conf.Backoff
+
+	for i := 0; i < h.conf.Retries && transient(err); i++ {
+		if !wait(ctx, jitter(backoff)) {
+			return err
+		}
+		backoff *= 2
+
+		metrics.IncCounter(MetricRetries)
+		err = op()
+		if err == nil {
+			metrics.IncCounter(MetricRetrySuccess)
+		}
+	}
+
+	if transient(err) && h.conf.Retries > 0 {
+		metrics.IncCounter(MetricRetryExhausted)
+	}
+	return err
+}
+
+// wait sleeps for d and reports whether ctx is still live afterwards. It returns early if ctx is
+// done first.
+func wait(ctx context.Context, d time.Duration) bool {
+	if ctx == nil {
+		time.Sleep(d)
+		return true
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// jitter returns a duration between half and one and a half times d
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)+1))
+}
+
+// Get passes responses on as they arrive. If the backend fails part way through, only the keys
+// that haven't been answered yet are retried.
+func (h retryingHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		err := h.retry(cmd.Ctx, func() error {
+			resChan, errChan := h.Handler.Get(cmd)
+			var err error
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					dataOut <- res
+					cmd = remaining(cmd)
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			return err
+		})
+
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE works the same way as Get
+func (h retryingHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		err := h.retry(cmd.Ctx, func() error {
+			resChan, errChan := h.Handler.GetE(cmd)
+			var err error
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					dataOut <- res
+					cmd = remaining(cmd)
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			return err
+		})
+
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// remaining drops the first key of a get request once it has been answered. Handlers answer the
+// keys of a get in order.
+func remaining(cmd common.GetRequest) common.GetRequest {
+	cmd.Keys = cmd.Keys[1:]
+	cmd.Opaques = cmd.Opaques[1:]
+	cmd.Quiet = cmd.Quiet[1:]
+	return cmd
+}
+
+func (h retryingHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	var res common.GetResponse
+	err := h.retry(cmd.Ctx, func() error {
+		var err error
+		res, err = h.Handler.GAT(cmd)
+		return err
+	})
+	return res, err
+}
+
+func (h retryingHandler) Touch(cmd common.TouchRequest) error {
+	return h.retry(cmd.Ctx, func() error { return h.Handler.Touch(cmd) })
+}
+
+// Delete is retried even though the first attempt may have reached the backend. In that case the
+// retry answers with ErrKeyNotFound, which is the same state the client asked for, so it counts
+// as success. A miss on the first attempt is passed on as usual.
+func (h retryingHandler) Delete(cmd common.DeleteRequest) error {
+	first := true
+	return h.retry(cmd.Ctx, func() error {
+		err := h.Handler.Delete(cmd)
+		if err == common.ErrKeyNotFound && !first {
+			err = nil
+		}
+		first = false
+		return err
+	})
+}
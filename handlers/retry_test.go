@@ -0,0 +1,219 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/null"
+	"github.com/hongst/rend/metrics"
+)
+
+// failingHandler fails the first fails touches, gets and deletes. A failing get answers its first
+// key before failing. A failing delete still removes the key, so a later one misses. The key
+// "missing" is never there to touch.
+type failingHandler struct {
+	handlers.Handler
+	fails    *int
+	attempts *int
+}
+
+func (h failingHandler) Touch(cmd common.TouchRequest) error {
+	*h.attempts++
+	if *h.fails > 0 {
+		*h.fails--
+		return common.ErrTempFailure
+	}
+	if string(cmd.Key) == "missing" {
+		return common.ErrKeyNotFound
+	}
+	return nil
+}
+
+func (h failingHandler) Delete(cmd common.DeleteRequest) error {
+	*h.attempts++
+	if *h.fails > 0 {
+		*h.fails--
+		return common.ErrTempFailure
+	}
+	return common.ErrKeyNotFound
+}
+
+func (h failingHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	*h.attempts++
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	for i, key := range cmd.Keys {
+		if *h.fails > 0 && i == 1 {
+			*h.fails--
+			errorOut <- io.EOF
+			break
+		}
+		dataOut <- common.GetResponse{Key: key, Opaque: cmd.Opaques[i], Miss: true}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func failingConst(fails, attempts *int) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, _ := null.New()
+		return failingHandler{h, fails, attempts}, nil
+	}
+}
+
+func counter(name string) uint64 {
+	for _, c := range metrics.Counters() {
+		if c.Name == name {
+			return c.Val
+		}
+	}
+	return 0
+}
+
+func TestRetrying(t *testing.T) {
+	conf := handlers.RetryConfig{Retries: 2}
+
+	successes := counter("handler_retry_success")
+	fails, attempts := 2, 0
+	h, _ := handlers.Retrying(failingConst(&fails, &attempts), conf)()
+	if err := h.Touch(common.TouchRequest{Key: []byte("foo")}); err != nil {
+		t.Fatalf("Expected the touch to succeed on the last retry, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+	if n := counter("handler_retry_success") - successes; n != 1 {
+		t.Fatalf("Expected 1 retry success, got %d", n)
+	}
+
+	fails, attempts = 3, 0
+	if err := h.Touch(common.TouchRequest{Key: []byte("foo")}); err != common.ErrTempFailure {
+		t.Fatalf("Expected the error once retries are exhausted, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryingGet(t *testing.T) {
+	fails, attempts := 1, 0
+	h, _ := handlers.Retrying(failingConst(&fails, &attempts), handlers.RetryConfig{Retries: 1})()
+
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		Opaques: []uint32{1, 2, 3},
+		Quiet:   []bool{false, false, false},
+	})
+
+	var opaques []uint32
+	for res := range resChan {
+		opaques = append(opaques, res.Opaque)
+	}
+	for err := range errChan {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Each key is answered exactly once
+	if len(opaques) != 3 || opaques[0] != 1 || opaques[1] != 2 || opaques[2] != 3 {
+		t.Fatalf("Unexpected responses %v", opaques)
+	}
+	if attempts != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryingDelete(t *testing.T) {
+	successes := counter("handler_retry_success")
+	fails, attempts := 0, 0
+	h, _ := handlers.Retrying(failingConst(&fails, &attempts), handlers.RetryConfig{Retries: 2})()
+
+	// A miss on the first attempt is a real miss
+	if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+
+	// A miss on a retry means the failed attempt deleted the key
+	fails, attempts = 1, 0
+	if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+		t.Fatalf("Expected the retried delete to succeed, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", attempts)
+	}
+	if n := counter("handler_retry_success") - successes; n != 1 {
+		t.Fatalf("Expected 1 retry success, got %d", n)
+	}
+}
+
+func TestRetryingNotTransient(t *testing.T) {
+	successes := counter("handler_retry_success")
+	fails, attempts := 1, 0
+	h, _ := handlers.Retrying(failingConst(&fails, &attempts), handlers.RetryConfig{Retries: 2})()
+
+	// The retry gets an answer from the backend, but it isn't a success
+	if err := h.Touch(common.TouchRequest{Key: []byte("missing")}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", attempts)
+	}
+	if n := counter("handler_retry_success") - successes; n != 0 {
+		t.Fatalf("Expected no retry successes, got %d", n)
+	}
+}
+
+func TestRetryingContextDone(t *testing.T) {
+	fails, attempts := 2, 0
+	h, _ := handlers.Retrying(failingConst(&fails, &attempts), handlers.RetryConfig{Retries: 2})()
+
+	// The request is already over by the time the first attempt fails
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := h.Touch(common.TouchRequest{Key: []byte("foo"), Ctx: ctx}); err != common.ErrTempFailure {
+		t.Fatalf("Expected the first error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+
+	// The deadline passes while waiting to retry
+	fails, attempts = 2, 0
+	h, _ = handlers.Retrying(failingConst(&fails, &attempts), handlers.RetryConfig{Retries: 2, Backoff: time.Minute})()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := h.Delete(common.DeleteRequest{Key: []byte("foo"), Ctx: ctx}); err != common.ErrTempFailure {
+		t.Fatalf("Expected the first error, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("Expected the backoff to be cut short, took %v", d)
+	}
+}
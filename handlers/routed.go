@@ -0,0 +1,397 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hongst/rend/common"
+)
+
+// PrefixRoute sends the keys that start with Prefix to a handler of their own
+type PrefixRoute struct {
+	Prefix string
+	// Handler makes the handler for the keys with the prefix. If nil, the default handler is
+	// used.
+	Handler HandlerConst
+	// MaxTTL caps the TTL of items with the prefix, in seconds. Items stored without a TTL get
+	// this one. 0 means no cap.
+	MaxTTL uint32
+}
+
+// PrefixRouted sends each command to the handler of the route its key matches, or to the one made
+// by def if there is none, so one port can serve several logical caches. When prefixes overlap the
+// longest one wins. A multiget with keys from several routes is split between their handlers and
+// answered in the order of its keys; its values can't be streamed.
+//
+// The default handler is made up front and the handlers of the routes when they are first used.
+// Stats and version requests go to the default handler, and flushes go to all of them.
+func PrefixRouted(def HandlerConst, routes []PrefixRoute) HandlerConst {
+	sorted := append([]PrefixRoute(nil), routes...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+
+	return func() (Handler, error) {
+		d, err := def()
+		if err != nil {
+			return nil, err
+		}
+
+		h := &routedHandler{
+			routes:   sorted,
+			consts:   make([]HandlerConst, len(sorted)+1),
+			handlers: make([]Handler, len(sorted)+1),
+		}
+		h.handlers[0] = d
+		for i, r := range sorted {
+			h.consts[i+1] = r.Handler
+		}
+		return h, nil
+	}
+}
+
+// routedHandler is not safe for concurrent use, the same as the handlers it wraps. Handler 0 is
+// the default one and handler i+1 belongs to route i.
+type routedHandler struct {
+	routes   []PrefixRoute
+	consts   []HandlerConst
+	handlers []Handler
+}
+
+// route returns the index of the handler for the key and the TTL cap of its route
+func (h *routedHandler) route(key []byte) (int, uint32) {
+	for i, r := range h.routes {
+		if strings.HasPrefix(string(key), r.Prefix) {
+			if r.Handler == nil {
+				return 0, r.MaxTTL
+			}
+			return i + 1, r.MaxTTL
+		}
+	}
+	return 0, 0
+}
+
+// handler returns handler i, making it if it's the first use
+func (h *routedHandler) handler(i int) (Handler, error) {
+	if h.handlers[i] == nil {
+		b, err := h.consts[i]()
+		if err != nil {
+			return nil, err
+		}
+		h.handlers[i] = b
+	}
+	return h.handlers[i], nil
+}
+
+// forKey returns the handler for the key and the key's exptime with the TTL cap applied
+func (h *routedHandler) forKey(key []byte, exptime uint32) (Handler, uint32, error) {
+	i, maxTTL := h.route(key)
+	b, err := h.handler(i)
+	return b, common.CapExptime(exptime, maxTTL), err
+}
+
+func (h *routedHandler) store(cmd common.SetRequest, op func(Handler, common.SetRequest) error) error {
+	b, exptime, err := h.forKey(cmd.Key, cmd.Exptime)
+	if err != nil {
+		return err
+	}
+	cmd.Exptime = exptime
+	return op(b, cmd)
+}
+
+func (h *routedHandler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Set)
+}
+
+func (h *routedHandler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Add)
+}
+
+func (h *routedHandler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Replace)
+}
+
+func (h *routedHandler) Append(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Append)
+}
+
+func (h *routedHandler) Prepend(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Prepend)
+}
+
+func (h *routedHandler) Delete(cmd common.DeleteRequest) error {
+	b, _, err := h.forKey(cmd.Key, 0)
+	if err != nil {
+		return err
+	}
+	return b.Delete(cmd)
+}
+
+func (h *routedHandler) Touch(cmd common.TouchRequest) error {
+	b, exptime, err := h.forKey(cmd.Key, cmd.Exptime)
+	if err != nil {
+		return err
+	}
+	cmd.Exptime = exptime
+	return b.Touch(cmd)
+}
+
+func (h *routedHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	b, exptime, err := h.forKey(cmd.Key, cmd.Exptime)
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	cmd.Exptime = exptime
+	return b.GAT(cmd)
+}
+
+func (h *routedHandler) arith(cmd common.IncrDecrRequest, op func(Handler, common.IncrDecrRequest) (uint64, error)) (uint64, error) {
+	b, exptime, err := h.forKey(cmd.Key, cmd.Exptime)
+	if err != nil {
+		return 0, err
+	}
+	// The exptime only applies when the item is created, and this one means it isn't
+	if cmd.Exptime != common.NoInitialExptime {
+		cmd.Exptime = exptime
+	}
+	return op(b, cmd)
+}
+
+func (h *routedHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(cmd, Handler.Incr)
+}
+
+func (h *routedHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(cmd, Handler.Decr)
+}
+
+// split groups the indexes of the keys by the handler they go to. The groups are in the order of
+// their first key.
+func (h *routedHandler) split(keys [][]byte) (order []int, groups map[int][]int) {
+	groups = make(map[int][]int)
+	for k, key := range keys {
+		i, _ := h.route(key)
+		if _, ok := groups[i]; !ok {
+			order = append(order, i)
+		}
+		groups[i] = append(groups[i], k)
+	}
+	return order, groups
+}
+
+// subRequest returns the part of cmd with the keys at the indexes
+func subRequest(cmd common.GetRequest, idxs []int) common.GetRequest {
+	sub := common.GetRequest{
+		Keys:    make([][]byte, len(idxs)),
+		Opaques: make([]uint32, len(idxs)),
+		Quiet:   make([]bool, len(idxs)),
+	}
+	for j, k := range idxs {
+		sub.Keys[j] = cmd.Keys[k]
+		sub.Opaques[j] = cmd.Opaques[k]
+		sub.Quiet[j] = cmd.Quiet[k]
+	}
+	return sub
+}
+
+func (h *routedHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	order, groups := h.split(cmd.Keys)
+	if len(order) == 1 {
+		b, err := h.handler(order[0])
+		if err != nil {
+			return failedGet(err)
+		}
+		return b.Get(cmd)
+	}
+
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	// Responses are collected before any are passed on, so streams can't be read in time
+	cmd.Stream = false
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		responses := make([]common.GetResponse, len(cmd.Keys))
+		answered := make([]bool, len(cmd.Keys))
+
+		var err error
+		for _, i := range order {
+			var b Handler
+			if b, err = h.handler(i); err != nil {
+				break
+			}
+
+			idxs := groups[i]
+			var n int
+			resChan, errChan := b.Get(subRequest(cmd, idxs))
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					if n < len(idxs) {
+						responses[idxs[n]] = res
+						answered[idxs[n]] = true
+					}
+					n++
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		// The answers stop at the first key that has none, as they would from a single handler
+		for k := range cmd.Keys {
+			if !answered[k] {
+				break
+			}
+			dataOut <- responses[k]
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE works the same way as Get
+func (h *routedHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	order, groups := h.split(cmd.Keys)
+	if len(order) == 1 {
+		b, err := h.handler(order[0])
+		if err != nil {
+			dataOut := make(chan common.GetEResponse)
+			close(dataOut)
+			_, errorOut := failedGet(err)
+			return dataOut, errorOut
+		}
+		return b.GetE(cmd)
+	}
+
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		responses := make([]common.GetEResponse, len(cmd.Keys))
+		answered := make([]bool, len(cmd.Keys))
+
+		var err error
+		for _, i := range order {
+			var b Handler
+			if b, err = h.handler(i); err != nil {
+				break
+			}
+
+			idxs := groups[i]
+			var n int
+			resChan, errChan := b.GetE(subRequest(cmd, idxs))
+			for resChan != nil || errChan != nil {
+				select {
+				case res, ok := <-resChan:
+					if !ok {
+						resChan = nil
+						continue
+					}
+					if n < len(idxs) {
+						responses[idxs[n]] = res
+						answered[idxs[n]] = true
+					}
+					n++
+				case e, ok := <-errChan:
+					if !ok {
+						errChan = nil
+						continue
+					}
+					err = e
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		for k := range cmd.Keys {
+			if !answered[k] {
+				break
+			}
+			dataOut <- responses[k]
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// failedGet returns the channels of a get that failed before it was sent
+func failedGet(err error) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error, 1)
+	errorOut <- err
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (h *routedHandler) Stats(group []byte) ([]common.Stat, error) {
+	return h.handlers[0].Stats(group)
+}
+
+func (h *routedHandler) Version() (string, error) {
+	return h.handlers[0].Version()
+}
+
+func (h *routedHandler) Flush(cmd common.FlushRequest) error {
+	for i := range h.handlers {
+		if i != 0 && h.consts[i] == nil {
+			continue
+		}
+		b, err := h.handler(i)
+		if err != nil {
+			return err
+		}
+		if err := b.Flush(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *routedHandler) Close() error {
+	for i, b := range h.handlers {
+		if b != nil {
+			b.Close()
+			h.handlers[i] = nil
+		}
+	}
+	return nil
+}
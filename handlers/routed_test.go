@@ -0,0 +1,108 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+func TestPrefixRouted(t *testing.T) {
+	def, sess := newMapHandler(), newMapHandler()
+	consts := mapConsts(def, sess)
+	h, _ := handlers.PrefixRouted(consts[0], []handlers.PrefixRoute{
+		{Prefix: "sess:", Handler: consts[1]},
+		{Prefix: "feed:", MaxTTL: 60},
+	})()
+	defer h.Close()
+
+	t.Run("Route", func(t *testing.T) {
+		for _, key := range []string{"sess:1", "foo"} {
+			if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte(key)}); err != nil {
+				t.Fatalf("Expected success, got %v", err)
+			}
+		}
+		if _, ok := sess.data["sess:1"]; !ok || len(sess.data) != 1 {
+			t.Fatalf("Expected only sess:1 in the sess handler, got %v", sess.data)
+		}
+		if _, ok := def.data["foo"]; !ok || len(def.data) != 1 {
+			t.Fatalf("Expected only foo in the default handler, got %v", def.data)
+		}
+	})
+
+	t.Run("Multiget", func(t *testing.T) {
+		keys := []string{"foo", "sess:1", "bar", "sess:2"}
+		req := common.GetRequest{Opaques: make([]uint32, len(keys)), Quiet: make([]bool, len(keys))}
+		for _, key := range keys {
+			req.Keys = append(req.Keys, []byte(key))
+		}
+
+		resChan, errChan := h.Get(req)
+		var got []common.GetResponse
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				got = append(got, res)
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		if len(got) != len(keys) {
+			t.Fatalf("Expected %d responses, got %d", len(keys), len(got))
+		}
+		for i, res := range got {
+			hit := keys[i] == "foo" || keys[i] == "sess:1"
+			if string(res.Key) != keys[i] || res.Miss == hit {
+				t.Fatalf("Expected %s to be answered in order with hit %v, got %+v", keys[i], hit, res)
+			}
+		}
+	})
+
+	t.Run("MaxTTL", func(t *testing.T) {
+		now := uint32(time.Now().Unix())
+		tests := []struct {
+			name     string
+			exptime  uint32
+			min, max uint32
+		}{
+			{"None", 0, 60, 60},
+			{"Shorter", 30, 30, 30},
+			{"Longer", 3600, 60, 60},
+			{"Absolute", now + 3600, now + 60, now + 61},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				if err := h.Set(common.SetRequest{Key: []byte("feed:1"), Exptime: test.exptime}); err != nil {
+					t.Fatalf("Expected success, got %v", err)
+				}
+				if def.exptime < test.min || def.exptime > test.max {
+					t.Fatalf("Expected an exptime between %d and %d, got %d", test.min, test.max, def.exptime)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,493 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package spill keeps large values in an object store instead of memcached. Values above a size
+// threshold are written to the store and memcached only holds a small record pointing at the
+// object. Gets follow the record transparently, so clients never see the difference.
+//
+// Objects are written under a new name on every set, so a reader can never see a record paired
+// with the wrong object. Overwritten and expired objects are not removed by the handler; the
+// bucket should have a lifecycle rule that expires objects after the longest TTL in use.
+package spill
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricSpillPuts         = metrics.AddCounter("spill_puts", nil)
+	MetricSpillPutErrors    = metrics.AddCounter("spill_put_errors", nil)
+	MetricSpillFetches      = metrics.AddCounter("spill_fetches", nil)
+	MetricSpillFetchErrors  = metrics.AddCounter("spill_fetch_errors", nil)
+	MetricSpillFetchMissing = metrics.AddCounter("spill_fetch_missing", nil)
+	MetricSpillBackfills    = metrics.AddCounter("spill_backfills", nil)
+)
+
+// Config controls when values are spilled and what happens when they are read back
+type Config struct {
+	// Threshold is the largest value kept in memcached. Anything bigger goes to the object store.
+	Threshold int
+	// Backfill stores values fetched from the object store back in memcached under the same key,
+	// so later reads are served locally. The inner handler is expected to be able to hold the full
+	// value, e.g. a chunked handler.
+	Backfill bool
+}
+
+// The record stored in memcached in place of a spilled value is the magic bytes followed by the
+// original flags, the value length, the absolute expiration time and the object name. Values
+// written by clients that happen to start with the magic bytes are always spilled so they can't
+// be mistaken for a record.
+var magic = []byte("\x00rend-spill\x00")
+
+const recordHeaderLen = 12
+
+type record struct {
+	flags   uint32
+	length  uint32
+	exptime uint32
+	name    string
+}
+
+func (r record) encode() []byte {
+	buf := make([]byte, len(magic)+recordHeaderLen+len(r.name))
+	n := copy(buf, magic)
+	binary.BigEndian.PutUint32(buf[n:], r.flags)
+	binary.BigEndian.PutUint32(buf[n+4:], r.length)
+	binary.BigEndian.PutUint32(buf[n+8:], r.exptime)
+	copy(buf[n+recordHeaderLen:], r.name)
+	return buf
+}
+
+func decodeRecord(data []byte) (record, bool) {
+	if len(data) < len(magic)+recordHeaderLen || !bytes.HasPrefix(data, magic) {
+		return record{}, false
+	}
+	data = data[len(magic):]
+	return record{
+		flags:   binary.BigEndian.Uint32(data),
+		length:  binary.BigEndian.Uint32(data[4:]),
+		exptime: binary.BigEndian.Uint32(data[8:]),
+		name:    string(data[recordHeaderLen:]),
+	}, true
+}
+
+// objectName is made of a hash of the key, so objects for the same key sort together, and a
+// random suffix that makes every write unique.
+func objectName(key []byte) string {
+	sum := sha256.Sum256(key)
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	return hex.EncodeToString(sum[:16]) + "-" + hex.EncodeToString(suffix[:])
+}
+
+func now() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+// remaining turns the absolute expiration time in a record back into a TTL. It returns false if
+// the time has already passed.
+func remaining(exptime uint32) (uint32, bool) {
+	if exptime == 0 {
+		return 0, true
+	}
+	t := now()
+	if exptime <= t {
+		return 0, false
+	}
+	return exptime - t, true
+}
+
+// Handler wraps another handler, usually a memcached one, and moves large values out of it
+type Handler struct {
+	inner handlers.Handler
+	store ObjectStore
+	conf  Config
+}
+
+// New returns a constructor for handlers that wrap the ones made by inner and spill to the store
+func New(inner handlers.HandlerConst, store ObjectStore, conf Config) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h, err := inner()
+		if err != nil {
+			return nil, err
+		}
+		return Handler{
+			inner: h,
+			store: store,
+			conf:  conf,
+		}, nil
+	}
+}
+
+func (h Handler) shouldSpill(data []byte) bool {
+	return len(data) > h.conf.Threshold || bytes.HasPrefix(data, magic)
+}
+
+// spill writes the value to the object store and returns the request with the data replaced by
+// the record pointing at it.
+func (h Handler) spill(cmd common.SetRequest) (common.SetRequest, error) {
+	rec := record{
+		flags:   cmd.Flags,
+		length:  uint32(len(cmd.Data)),
+		exptime: cmd.Exptime,
+		name:    objectName(cmd.Key),
+	}
+	if rec.exptime != 0 && rec.exptime <= common.MaxRelativeExptime {
+		rec.exptime += now()
+	}
+
+	metrics.IncCounter(MetricSpillPuts)
+	if err := h.store.Put(rec.name, cmd.Data); err != nil {
+		metrics.IncCounter(MetricSpillPutErrors)
+		log.Println("Error writing spilled value to object store:", err.Error())
+		return cmd, common.ErrTempFailure
+	}
+
+	cmd.Data = rec.encode()
+	return cmd, nil
+}
+
+// storeCommon spills the value if needed and then runs the inner operation. If the inner operation
+// fails the object just written is orphaned, so it's removed right away.
+func (h Handler) storeCommon(cmd common.SetRequest, op func(common.SetRequest) error) error {
+	if !h.shouldSpill(cmd.Data) {
+		return op(cmd)
+	}
+
+	spilled, err := h.spill(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := op(spilled); err != nil {
+		rec, _ := decodeRecord(spilled.Data)
+		h.deleteObject(rec.name)
+		return err
+	}
+
+	return nil
+}
+
+func (h Handler) deleteObject(name string) {
+	if err := h.store.Delete(name); err != nil {
+		log.Println("Error deleting spilled value from object store:", err.Error())
+	}
+}
+
+// fetch reads the value a record points at. A missing object is reported as a miss, since the
+// bucket lifecycle may have removed it before the record expired.
+func (h Handler) fetch(rec record) ([]byte, bool, error) {
+	metrics.IncCounter(MetricSpillFetches)
+	data, err := h.store.Get(rec.name)
+	if err == ErrObjectNotFound {
+		metrics.IncCounter(MetricSpillFetchMissing)
+		return nil, false, nil
+	}
+	if err != nil {
+		metrics.IncCounter(MetricSpillFetchErrors)
+		log.Println("Error reading spilled value from object store:", err.Error())
+		return nil, false, err
+	}
+	if uint32(len(data)) != rec.length {
+		metrics.IncCounter(MetricSpillFetchErrors)
+		log.Printf("Spilled value for object %s has length %d, expected %d\n", rec.name, len(data), rec.length)
+		return nil, false, nil
+	}
+
+	return data, true, nil
+}
+
+// backfill writes the fetched value to the inner handler in place of the record. The CAS of the
+// record is checked so a newer value written in the meantime is not overwritten. The expiration
+// time is the one from when the value was spilled; a touch after that only extends the record.
+func (h Handler) backfill(key, data []byte, rec record, cas uint64) {
+	exptime, ok := remaining(rec.exptime)
+	if !ok || cas == 0 {
+		return
+	}
+
+	metrics.IncCounter(MetricSpillBackfills)
+	err := h.inner.Replace(common.SetRequest{
+		Key:     key,
+		Data:    data,
+		Flags:   rec.flags,
+		Exptime: exptime,
+		Cas:     cas,
+	})
+	// A CAS mismatch or a missing key just means the record changed, which is fine
+	if err != nil && !common.IsAppError(err) {
+		log.Println("Error backfilling spilled value:", err.Error())
+	}
+}
+
+// resolve replaces a record with the value it points at. Failures to read the object turn the
+// hit into a miss.
+func (h Handler) resolve(key, data []byte, flags uint32, cas uint64) ([]byte, uint32, bool) {
+	rec, ok := decodeRecord(data)
+	if !ok {
+		return data, flags, true
+	}
+
+	value, ok, err := h.fetch(rec)
+	if err != nil || !ok {
+		return nil, 0, false
+	}
+
+	if h.conf.Backfill {
+		h.backfill(key, value, rec, cas)
+	}
+
+	return value, rec.flags, true
+}
+
+func (h Handler) Set(cmd common.SetRequest) error {
+	return h.storeCommon(cmd, h.inner.Set)
+}
+
+func (h Handler) Add(cmd common.SetRequest) error {
+	return h.storeCommon(cmd, h.inner.Add)
+}
+
+func (h Handler) Replace(cmd common.SetRequest) error {
+	return h.storeCommon(cmd, h.inner.Replace)
+}
+
+func (h Handler) Append(cmd common.SetRequest) error {
+	return h.appendPrependCommon(cmd, true)
+}
+
+func (h Handler) Prepend(cmd common.SetRequest) error {
+	return h.appendPrependCommon(cmd, false)
+}
+
+// appendPrependCommon passes appends and prepends straight through unless the current value is
+// spilled. In that case the new value is put together here and stored with the CAS that was read,
+// so a concurrent change isn't lost.
+func (h Handler) appendPrependCommon(cmd common.SetRequest, isAppend bool) error {
+	cur, err := h.getOne(cmd.Key)
+	if err != nil {
+		return err
+	}
+	if cur.Miss {
+		return common.ErrKeyNotFound
+	}
+
+	rec, ok := decodeRecord(cur.Data)
+	if !ok {
+		if isAppend {
+			return h.inner.Append(cmd)
+		}
+		return h.inner.Prepend(cmd)
+	}
+
+	if cmd.Cas != 0 && cmd.Cas != cur.Cas {
+		return common.ErrKeyExists
+	}
+
+	exptime, ok := remaining(rec.exptime)
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	value, ok, err := h.fetch(rec)
+	if err != nil {
+		return common.ErrTempFailure
+	}
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	if isAppend {
+		value = append(value, cmd.Data...)
+	} else {
+		value = append(cmd.Data, value...)
+	}
+
+	return h.storeCommon(common.SetRequest{
+		Key:     cmd.Key,
+		Data:    value,
+		Flags:   rec.flags,
+		Exptime: exptime,
+		Cas:     cur.Cas,
+	}, h.inner.Replace)
+}
+
+// getOne reads a single key from the inner handler without following records
+func (h Handler) getOne(key []byte) (common.GetResponse, error) {
+	resChan, errChan := h.inner.Get(common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			res = r
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			err = e
+		}
+	}
+
+	return res, err
+}
+
+func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		resChan, errChan := h.inner.Get(cmd)
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				if !res.Miss {
+					res.Data, res.Flags, ok = h.resolve(res.Key, res.Data, res.Flags, res.Cas)
+					res.Miss = !ok
+				}
+				dataOut <- res
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				errorOut <- err
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		resChan, errChan := h.inner.GetE(cmd)
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				if !res.Miss {
+					res.Data, res.Flags, ok = h.resolve(res.Key, res.Data, res.Flags, res.Cas)
+					res.Miss = !ok
+				}
+				dataOut <- res
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				errorOut <- err
+			}
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.inner.GAT(cmd)
+	if err != nil || res.Miss {
+		return res, err
+	}
+
+	var ok bool
+	res.Data, res.Flags, ok = h.resolve(res.Key, res.Data, res.Flags, res.Cas)
+	res.Miss = !ok
+	return res, nil
+}
+
+// Delete removes the record and then the object it points at, if any
+func (h Handler) Delete(cmd common.DeleteRequest) error {
+	cur, err := h.getOne(cmd.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := h.inner.Delete(cmd); err != nil {
+		return err
+	}
+
+	if !cur.Miss {
+		if rec, ok := decodeRecord(cur.Data); ok {
+			h.deleteObject(rec.name)
+		}
+	}
+
+	return nil
+}
+
+func (h Handler) Touch(cmd common.TouchRequest) error {
+	return h.inner.Touch(cmd)
+}
+
+func (h Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.inner.Incr(cmd)
+}
+
+func (h Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.inner.Decr(cmd)
+}
+
+func (h Handler) Stats(group []byte) ([]common.Stat, error) {
+	return h.inner.Stats(group)
+}
+
+// Flush only clears the records. The objects are left for the bucket lifecycle to remove.
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	return h.inner.Flush(cmd)
+}
+
+func (h Handler) Version() (string, error) {
+	return h.inner.Version()
+}
+
+func (h Handler) Close() error {
+	return h.inner.Close()
+}
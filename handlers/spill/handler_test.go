@@ -0,0 +1,252 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spill_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+	"github.com/hongst/rend/handlers/spill"
+)
+
+type memStore struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte)}
+}
+
+func (s *memStore) Put(name string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.objects[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memStore) Get(name string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, spill.ErrObjectNotFound
+	}
+	return data, nil
+}
+
+func (s *memStore) Delete(name string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.objects, name)
+	return nil
+}
+
+func (s *memStore) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.objects)
+}
+
+func newHandler(t *testing.T, store spill.ObjectStore, backfill bool) handlers.Handler {
+	h, err := spill.New(inmem.New, store, spill.Config{Threshold: 16, Backfill: backfill})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func get(t *testing.T, h handlers.Handler, key string) common.GetResponse {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+
+	var res common.GetResponse
+	for resChan != nil || errChan != nil {
+		select {
+		case r, ok := <-resChan:
+			if !ok {
+				resChan = nil
+				continue
+			}
+			res = r
+		case err, ok := <-errChan:
+			if !ok {
+				errChan = nil
+				continue
+			}
+			t.Fatal(err)
+		}
+	}
+	return res
+}
+
+// raw reads the key from the inner handler, bypassing the spill handler
+func raw(t *testing.T, key string) common.GetResponse {
+	h, _ := inmem.New()
+	return get(t, h, key)
+}
+
+func TestSpill(t *testing.T) {
+	store := newMemStore()
+	h := newHandler(t, store, false)
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("l"), 100)
+
+	if err := h.Set(common.SetRequest{Key: []byte("spill-small"), Data: small, Flags: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Set(common.SetRequest{Key: []byte("spill-large"), Data: large, Flags: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.len() != 1 {
+		t.Fatalf("Expected one object, got %d", store.len())
+	}
+	if r := raw(t, "spill-large"); len(r.Data) >= len(large) {
+		t.Fatalf("Expected only a record in the inner handler, got %d bytes", len(r.Data))
+	}
+
+	for key, want := range map[string][]byte{"spill-small": small, "spill-large": large} {
+		res := get(t, h, key)
+		if res.Miss || !bytes.Equal(res.Data, want) {
+			t.Fatalf("Get %s: miss %v, got %q", key, res.Miss, res.Data)
+		}
+	}
+	if res := get(t, h, "spill-large"); res.Flags != 2 {
+		t.Fatalf("Expected the original flags, got %d", res.Flags)
+	}
+
+	if err := h.Append(common.SetRequest{Key: []byte("spill-large"), Data: []byte("tail")}); err != nil {
+		t.Fatal(err)
+	}
+	if res := get(t, h, "spill-large"); !bytes.Equal(res.Data, append(large, "tail"...)) {
+		t.Fatalf("Unexpected value after append: %q", res.Data)
+	}
+
+	if err := h.Delete(common.DeleteRequest{Key: []byte("spill-large")}); err != nil {
+		t.Fatal(err)
+	}
+	if res := get(t, h, "spill-large"); !res.Miss {
+		t.Fatal("Expected a miss after delete")
+	}
+	if store.len() != 1 {
+		t.Fatalf("Expected only the object overwritten by the append to be left, got %d", store.len())
+	}
+}
+
+func TestMissingObject(t *testing.T) {
+	store := newMemStore()
+	h := newHandler(t, store, false)
+
+	if err := h.Set(common.SetRequest{Key: []byte("spill-missing"), Data: bytes.Repeat([]byte("m"), 100)}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Lock()
+	store.objects = make(map[string][]byte)
+	store.Unlock()
+
+	if res := get(t, h, "spill-missing"); !res.Miss {
+		t.Fatal("Expected a miss when the object is gone")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	store := newMemStore()
+	h := newHandler(t, store, true)
+
+	large := bytes.Repeat([]byte("b"), 100)
+	if err := h.Set(common.SetRequest{Key: []byte("spill-backfill"), Data: large, Flags: 3, Exptime: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := get(t, h, "spill-backfill"); !bytes.Equal(res.Data, large) {
+		t.Fatalf("Unexpected value: %q", res.Data)
+	}
+
+	r := raw(t, "spill-backfill")
+	if !bytes.Equal(r.Data, large) || r.Flags != 3 {
+		t.Fatalf("Expected the value to be backfilled, got %d bytes with flags %d", len(r.Data), r.Flags)
+	}
+}
+
+func TestS3(t *testing.T) {
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/bucket/prefix/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = data
+		case "GET":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	s3, err := spill.NewS3(spill.S3Config{
+		Endpoint:  srv.URL,
+		Bucket:    "bucket",
+		Region:    "us-east-1",
+		Prefix:    "prefix/",
+		AccessKey: "AKID",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3.Put("obj", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := s3.Get("obj"); err != nil || string(data) != "value" {
+		t.Fatalf("Get: %q, %v", data, err)
+	}
+	if err := s3.Delete("obj"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.Get("obj"); err != spill.ErrObjectNotFound {
+		t.Fatalf("Expected ErrObjectNotFound, got %v", err)
+	}
+}
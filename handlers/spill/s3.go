@@ -0,0 +1,197 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package spill
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ObjectStore is where the spilled values are kept
+type ObjectStore interface {
+	Put(name string, data []byte) error
+	// Get returns ErrObjectNotFound if there is no object with the name
+	Get(name string) ([]byte, error)
+	Delete(name string) error
+}
+
+var ErrObjectNotFound = errors.New("Object not found")
+
+// S3Config has the details needed to reach an S3 compatible object store
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. https://s3.us-east-1.amazonaws.com. Objects
+	// are addressed path style, as <endpoint>/<bucket>/<name>, which all S3 compatible stores
+	// support.
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Prefix is put in front of every object name
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Timeout   time.Duration
+}
+
+// S3 is an ObjectStore that talks to an S3 compatible service over plain HTTP, signing requests
+// with AWS Signature Version 4.
+type S3 struct {
+	conf   S3Config
+	host   string
+	base   string
+	client *http.Client
+	now    func() time.Time
+}
+
+func NewS3(conf S3Config) (*S3, error) {
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %q has no host", conf.Endpoint)
+	}
+
+	return &S3{
+		conf:   conf,
+		host:   u.Host,
+		base:   strings.TrimSuffix(conf.Endpoint, "/"),
+		client: &http.Client{Timeout: conf.Timeout},
+		now:    time.Now,
+	}, nil
+}
+
+func (s *S3) Put(name string, data []byte) error {
+	res, err := s.do("PUT", name, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("S3 PUT %s: %s", name, res.Status)
+	}
+	return nil
+}
+
+func (s *S3) Get(name string) ([]byte, error) {
+	res, err := s.do("GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, ErrObjectNotFound
+	}
+	if res.StatusCode/100 != 2 {
+		io.Copy(ioutil.Discard, res.Body)
+		return nil, fmt.Errorf("S3 GET %s: %s", name, res.Status)
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (s *S3) Delete(name string) error {
+	res, err := s.do("DELETE", name, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	// Deleting an object that isn't there is not an error in S3
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("S3 DELETE %s: %s", name, res.Status)
+	}
+	return nil
+}
+
+func (s *S3) do(method, name string, body []byte) (*http.Response, error) {
+	path := "/" + s.conf.Bucket + "/" + s.conf.Prefix + name
+
+	req, err := http.NewRequest(method, s.base+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	s.sign(req, path, body)
+	return s.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 headers to the request. The path must already be safe to
+// use in a URL, which the object names made by the handler are.
+func (s *S3) sign(req *http.Request, path string, body []byte) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"", // no query string
+		"host:" + s.host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.conf.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.conf.SecretKey), date)
+	key = hmacSHA256(key, s.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.conf.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
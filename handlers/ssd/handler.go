@@ -0,0 +1,123 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ssd
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/store"
+)
+
+// New opens the store and returns a constructor for handlers that use it
+func New(conf Config) (handlers.HandlerConst, error) {
+	s, err := Open(conf)
+	if err != nil {
+		return nil, err
+	}
+	return store.New(s), nil
+}
+
+func (s *Store) Lock() {
+	s.mu.Lock()
+}
+
+func (s *Store) Unlock() {
+	s.mu.Unlock()
+}
+
+// RLocker returns the read lock, so gets run side by side
+func (s *Store) RLocker() sync.Locker {
+	return s.mu.RLocker()
+}
+
+func (s *Store) Name() string {
+	return "ssd"
+}
+
+func (s *Store) Now() uint32 {
+	return s.now()
+}
+
+func (s *Store) Get(key string, withData bool) (store.Item, bool, error) {
+	e, ok := s.lookup(key)
+	if !ok {
+		return store.Item{}, false, nil
+	}
+
+	item := store.Item{
+		Flags:   e.flags,
+		Exptime: e.exptime,
+		Cas:     e.cas,
+	}
+	if withData {
+		var err error
+		if item.Data, err = s.value(e); err != nil {
+			return store.Item{}, false, err
+		}
+	}
+
+	return item, true, nil
+}
+
+func (s *Store) Put(key string, item store.Item) error {
+	return s.put(key, item.Data, item.Flags, item.Exptime, item.Cas)
+}
+
+// Delete only removes the key from the index. The space is reclaimed when the slab is reused.
+func (s *Store) Delete(key string) error {
+	delete(s.index, key)
+	return nil
+}
+
+// Touch only changes the index. The value stays where it is.
+func (s *Store) Touch(key string, exptime uint32) error {
+	if e, ok := s.lookup(key); ok {
+		e.exptime = exptime
+	}
+	return nil
+}
+
+// Flush only changes the index, like Delete and Touch
+func (s *Store) Flush(at uint32) error {
+	if at == 0 {
+		s.index = make(map[string]*entry)
+		return nil
+	}
+
+	for _, e := range s.index {
+		if e.exptime == 0 || e.exptime > at {
+			e.exptime = at
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) Stats() []common.Stat {
+	var bytes uint64
+	for _, e := range s.index {
+		bytes += uint64(e.length)
+	}
+
+	return []common.Stat{
+		{Name: "curr_items", Value: strconv.Itoa(len(s.index))},
+		{Name: "bytes", Value: strconv.FormatUint(bytes, 10)},
+		{Name: "limit_maxbytes", Value: strconv.FormatInt(int64(s.slabs)*s.conf.SlabSize, 10)},
+		{Name: "slabs", Value: strconv.FormatUint(uint64(s.slabs), 10)},
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ssd is a handler for very large values that keeps them in a preallocated file on an
+// SSD, in the style of fatcache. It has no per-item size classes like memcached's slabs, so
+// values of any size up to nearly the size of the file can be stored without waste.
+//
+// The file is split into large slabs that are filled one after another like a ring. A value is
+// written at the current position and continues into the next slab if it doesn't fit, so it
+// is stored as one or more extents. When the writer moves on to a new slab, whatever was in it
+// is evicted. This makes eviction FIFO and every write sequential, which is what SSDs are best
+// at.
+//
+// The index of items is only kept in memory. It holds the same details as the chunked
+// handler's metadata (length, flags, exptime and CAS) plus where the extents are, so nothing
+// but the value itself is read from the SSD. Changes to the metadata, like a touch, don't touch
+// the file at all. The data does not survive a restart.
+package ssd
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/handlers/store"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricEvictions   = metrics.AddCounter("ssd_evictions", nil)
+	MetricSlabsReused = metrics.AddCounter("ssd_slabs_reused", nil)
+	MetricIOErrors    = metrics.AddCounter("ssd_io_errors", nil)
+)
+
+// Config holds the settings for a store
+type Config struct {
+	// Path is the file the values are kept in. It is created if it doesn't exist, and its old
+	// contents are ignored.
+	Path string
+	// Size is the size of the file in bytes
+	Size int64
+	// SlabSize is the unit of eviction. Larger slabs mean fewer, larger evictions.
+	SlabSize int64
+}
+
+// DefaultSlabSize is used when the config doesn't give a slab size
+const DefaultSlabSize = 8 * 1024 * 1024
+
+// extent is a contiguous piece of a value in one slab
+type extent struct {
+	slab   uint32
+	gen    uint32
+	offset uint32
+	length uint32
+}
+
+type entry struct {
+	length  uint32
+	flags   uint32
+	exptime uint32
+	cas     uint64
+	extents []extent
+}
+
+func (e *entry) isExpired(now uint32) bool {
+	return e.exptime != 0 && e.exptime < now
+}
+
+// inSlab reports whether any of the entry's extents were written in the given generation of
+// the slab
+func (e *entry) inSlab(slab, gen uint32) bool {
+	for _, x := range e.extents {
+		if x.slab == slab && x.gen == gen {
+			return true
+		}
+	}
+	return false
+}
+
+// Store is the slab file and the index of what is in it
+type Store struct {
+	conf  Config
+	now   func() uint32
+	f     *os.File
+	slabs uint32
+
+	mu    sync.RWMutex
+	index map[string]*entry
+	// gens has the number of times each slab has been reused
+	gens []uint32
+	// keys has the keys with data written in each slab, to remove them when it is reused
+	keys [][]string
+	// cur and off are where the next write goes
+	cur uint32
+	off int64
+	cas uint64
+}
+
+// Open creates the slab file at its full size and returns an empty store
+func Open(conf Config) (*Store, error) {
+	if conf.SlabSize == 0 {
+		conf.SlabSize = DefaultSlabSize
+	}
+	if conf.SlabSize > 1<<32-1 {
+		return nil, errors.New("Slab size must fit in 32 bits")
+	}
+	slabs := conf.Size / conf.SlabSize
+	if slabs < 2 {
+		return nil, errors.New("The file must hold at least two slabs")
+	}
+
+	f, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allocate the whole file up front so writes never have to grow it
+	if err := f.Truncate(slabs * conf.SlabSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Store{
+		conf:  conf,
+		now:   func() uint32 { return uint32(time.Now().Unix()) },
+		f:     f,
+		slabs: uint32(slabs),
+		index: make(map[string]*entry),
+		gens:  make([]uint32, slabs),
+		keys:  make([][]string, slabs),
+	}, nil
+}
+
+// maxLength is the largest value that can be stored. A value may start anywhere in the current
+// slab, so it can only count on the slabs after it. Otherwise writing the end of the value
+// would evict its own start.
+func (s *Store) maxLength() int64 {
+	return int64(s.slabs-1) * s.conf.SlabSize
+}
+
+// lookup returns the live entry for the key. s.mu must be held for reading.
+func (s *Store) lookup(key string) (*entry, bool) {
+	e, ok := s.index[key]
+	if !ok || e.isExpired(s.now()) {
+		return nil, false
+	}
+	return e, true
+}
+
+// value reads the entry's value from the file. s.mu must be held for reading.
+func (s *Store) value(e *entry) ([]byte, error) {
+	buf := make([]byte, e.length)
+	var pos uint32
+
+	for _, x := range e.extents {
+		at := int64(x.slab)*s.conf.SlabSize + int64(x.offset)
+		if _, err := s.f.ReadAt(buf[pos:pos+x.length], at); err != nil {
+			metrics.IncCounter(MetricIOErrors)
+			return nil, err
+		}
+		pos += x.length
+	}
+
+	return buf, nil
+}
+
+// nextCas returns a new unique CAS value. s.mu must be held.
+func (s *Store) nextCas() uint64 {
+	s.cas++
+	return s.cas
+}
+
+// put writes the value and points the key at it. A cas of 0 gives the item a new CAS value.
+// s.mu must be held.
+func (s *Store) put(key string, value []byte, flags, exptime uint32, cas uint64) error {
+	if int64(len(value)) > s.maxLength() {
+		return store.ErrTooLarge
+	}
+
+	extents, err := s.write(key, value)
+	if err != nil {
+		return err
+	}
+
+	if cas == 0 {
+		cas = s.nextCas()
+	}
+
+	s.index[key] = &entry{
+		length:  uint32(len(value)),
+		flags:   flags,
+		exptime: exptime,
+		cas:     cas,
+		extents: extents,
+	}
+
+	return nil
+}
+
+// write appends the value at the current position, moving through as many slabs as it takes.
+// s.mu must be held.
+func (s *Store) write(key string, value []byte) ([]extent, error) {
+	var extents []extent
+
+	for {
+		if s.off == s.conf.SlabSize {
+			s.advance()
+		}
+
+		n := s.conf.SlabSize - s.off
+		if n > int64(len(value)) {
+			n = int64(len(value))
+		}
+
+		at := int64(s.cur)*s.conf.SlabSize + s.off
+		if _, err := s.f.WriteAt(value[:n], at); err != nil {
+			metrics.IncCounter(MetricIOErrors)
+			return nil, err
+		}
+
+		extents = append(extents, extent{
+			slab:   s.cur,
+			gen:    s.gens[s.cur],
+			offset: uint32(s.off),
+			length: uint32(n),
+		})
+		s.keys[s.cur] = append(s.keys[s.cur], key)
+		s.off += n
+		value = value[n:]
+
+		if len(value) == 0 {
+			return extents, nil
+		}
+	}
+}
+
+// advance moves the writer to the next slab and evicts everything that was in it. s.mu must be
+// held.
+func (s *Store) advance() {
+	s.cur = (s.cur + 1) % s.slabs
+	s.off = 0
+
+	gen := s.gens[s.cur]
+	if len(s.keys[s.cur]) > 0 {
+		metrics.IncCounter(MetricSlabsReused)
+	}
+
+	for _, key := range s.keys[s.cur] {
+		// The key may have been written again since, somewhere else
+		if e, ok := s.index[key]; ok && e.inSlab(s.cur, gen) {
+			metrics.IncCounter(MetricEvictions)
+			delete(s.index, key)
+		}
+	}
+
+	s.gens[s.cur]++
+	s.keys[s.cur] = nil
+}
+
+// Close closes the file
+func (s *Store) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ssd
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/store"
+)
+
+func open(t *testing.T, slabs int64) (*Store, store.Handler) {
+	s, err := Open(Config{
+		Path:     filepath.Join(t.TempDir(), "slabs"),
+		Size:     slabs * 1024,
+		SlabSize: 1024,
+	})
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	return s, store.NewHandler(s)
+}
+
+func get(t *testing.T, h store.Handler, key string) ([]byte, bool) {
+	resChan, errChan := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	for err := range errChan {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res := <-resChan
+	return res.Data, !res.Miss
+}
+
+func set(t *testing.T, h store.Handler, key string, value []byte) {
+	if err := h.Set(common.SetRequest{Key: []byte(key), Data: value}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func fill(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func TestValueAcrossSlabs(t *testing.T) {
+	s, h := open(t, 4)
+	defer s.Close()
+
+	set(t, h, "small", fill(500, 'a'))
+	big := append(fill(1500, 'b'), fill(500, 'c')...)
+	set(t, h, "big", big)
+
+	if len(s.index["big"].extents) != 3 {
+		t.Fatalf("Expected the value to be split over 3 slabs, got %+v", s.index["big"].extents)
+	}
+	if data, ok := get(t, h, "big"); !ok || !bytes.Equal(data, big) {
+		t.Fatal("Expected the value to be read back whole")
+	}
+	if data, ok := get(t, h, "small"); !ok || !bytes.Equal(data, fill(500, 'a')) {
+		t.Fatal("Expected the small value to be intact")
+	}
+}
+
+func TestFIFOEviction(t *testing.T) {
+	s, h := open(t, 3)
+	defer s.Close()
+
+	set(t, h, "a", fill(1024, 'a'))
+	set(t, h, "b", fill(1024, 'b'))
+	set(t, h, "c", fill(1024, 'c'))
+
+	// Filling the third slab doesn't need the first one yet
+	if _, ok := get(t, h, "a"); !ok {
+		t.Fatal("Expected the first item to still be there")
+	}
+
+	set(t, h, "d", fill(10, 'd'))
+
+	if _, ok := get(t, h, "a"); ok {
+		t.Fatal("Expected the first item to be evicted when its slab was reused")
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if _, ok := get(t, h, key); !ok {
+			t.Fatalf("Expected %s to still be there", key)
+		}
+	}
+}
+
+func TestRewriteSurvivesSlabReuse(t *testing.T) {
+	s, h := open(t, 3)
+	defer s.Close()
+
+	set(t, h, "a", fill(1024, '1'))
+	set(t, h, "a", fill(1024, '2'))
+	set(t, h, "b", fill(1024, 'b'))
+
+	// Reusing the first slab evicts what is in it, but a has been written again since
+	set(t, h, "c", fill(10, 'c'))
+	if data, ok := get(t, h, "a"); !ok || !bytes.Equal(data, fill(1024, '2')) {
+		t.Fatal("Expected the newer version in another slab to stay")
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	s, h := open(t, 3)
+	defer s.Close()
+
+	if err := h.Set(common.SetRequest{Key: []byte("a"), Data: fill(2049, 'a')}); err != common.ErrValueTooBig {
+		t.Fatalf("Expected a value larger than all but one slab to be rejected, got %v", err)
+	}
+	set(t, h, "a", fill(2048, 'a'))
+}
+
+func TestTouchKeepsValue(t *testing.T) {
+	s, h := open(t, 2)
+	defer s.Close()
+
+	set(t, h, "a", fill(100, 'a'))
+	off := s.off
+
+	if err := h.Touch(common.TouchRequest{Key: []byte("a"), Exptime: 100}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if s.off != off || s.index["a"].exptime == 0 {
+		t.Fatal("Expected a touch to only change the index")
+	}
+}
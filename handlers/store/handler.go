@@ -0,0 +1,472 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package store has the handler for backends that keep the data themselves instead of passing the
+// requests on to a server, like the disk and SSD handlers. They only have to provide a Store and
+// the handler turns the memcached commands into calls on it.
+package store
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+// ErrTooLarge is returned by a Store for an item that can never fit in it
+var ErrTooLarge = errors.New("Item is larger than the store")
+
+// Item is what a Store keeps for each key
+type Item struct {
+	Data  []byte
+	Flags uint32
+	// Exptime is the absolute unix time the item expires at, or 0 if it never does
+	Exptime uint32
+	Cas     uint64
+}
+
+// Store is where a Handler keeps the data. The handler holds the lock around every call, so a
+// lookup and the write that depends on it happen together.
+type Store interface {
+	sync.Locker
+
+	// RLocker returns the lock held around calls that only read, Get and Stats. A store whose
+	// reads change things, like an LRU, returns the same lock as Lock.
+	RLocker() sync.Locker
+
+	// Name is used as the version and to tell stores apart in logs
+	Name() string
+
+	// Now returns the unix time that expiration times are compared to
+	Now() uint32
+
+	// Get returns the live item stored under the key. Its data is only read if withData is set.
+	Get(key string, withData bool) (Item, bool, error)
+
+	// Put stores the item under the key. A Cas of 0 gives the item a new CAS value.
+	Put(key string, item Item) error
+
+	// Delete removes the key
+	Delete(key string) error
+
+	// Touch changes when the item expires, keeping its value and CAS
+	Touch(key string, exptime uint32) error
+
+	// Flush removes every item when at is 0. Otherwise every item that would live past at
+	// expires then instead.
+	Flush(at uint32) error
+
+	// Stats returns the general stats of the store
+	Stats() []common.Stat
+}
+
+// Handler serves requests from a Store. All connections share the same store.
+type Handler struct {
+	s Store
+}
+
+// NewHandler returns a handler that uses the store
+func NewHandler(s Store) Handler {
+	return Handler{s: s}
+}
+
+// New returns a constructor for handlers that all use the store
+func New(s Store) handlers.HandlerConst {
+	h := NewHandler(s)
+	return func() (handlers.Handler, error) {
+		return h, nil
+	}
+}
+
+// exptime turns a TTL from a request into the absolute unix time the item expires at
+func (h Handler) exptime(ttl uint32) uint32 {
+	if ttl == 0 || ttl > common.MaxRelativeExptime {
+		return ttl
+	}
+	return h.s.Now() + ttl
+}
+
+// storeErr turns an error from the store into the one returned to the client
+func (h Handler) storeErr(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case ErrTooLarge:
+		return common.ErrValueTooBig
+	default:
+		log.Println("Error accessing", h.s.Name(), "store:", err.Error())
+		return common.ErrInternal
+	}
+}
+
+// checkCas verifies the CAS given in a request against the current item
+func checkCas(item Item, ok bool, cas uint64) error {
+	if cas == 0 {
+		return nil
+	}
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+	if item.Cas != cas {
+		return common.ErrKeyExists
+	}
+	return nil
+}
+
+func (h Handler) Set(cmd common.SetRequest) error {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	item, ok, err := h.s.Get(string(cmd.Key), false)
+	if err != nil {
+		return h.storeErr(err)
+	}
+
+	if err := checkCas(item, ok, cmd.Cas); err != nil {
+		return err
+	}
+
+	return h.storeErr(h.s.Put(string(cmd.Key), Item{
+		Data:    cmd.Data,
+		Flags:   cmd.Flags,
+		Exptime: h.exptime(cmd.Exptime),
+	}))
+}
+
+func (h Handler) Add(cmd common.SetRequest) error {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	_, ok, err := h.s.Get(string(cmd.Key), false)
+	if err != nil {
+		return h.storeErr(err)
+	}
+
+	if ok {
+		return common.ErrKeyExists
+	}
+
+	return h.storeErr(h.s.Put(string(cmd.Key), Item{
+		Data:    cmd.Data,
+		Flags:   cmd.Flags,
+		Exptime: h.exptime(cmd.Exptime),
+	}))
+}
+
+func (h Handler) Replace(cmd common.SetRequest) error {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	item, ok, err := h.s.Get(string(cmd.Key), false)
+	if err != nil {
+		return h.storeErr(err)
+	}
+
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	if err := checkCas(item, ok, cmd.Cas); err != nil {
+		return err
+	}
+
+	return h.storeErr(h.s.Put(string(cmd.Key), Item{
+		Data:    cmd.Data,
+		Flags:   cmd.Flags,
+		Exptime: h.exptime(cmd.Exptime),
+	}))
+}
+
+func (h Handler) Append(cmd common.SetRequest) error {
+	return h.appendPrependCommon(cmd, true)
+}
+
+func (h Handler) Prepend(cmd common.SetRequest) error {
+	return h.appendPrependCommon(cmd, false)
+}
+
+// appendPrependCommon rewrites the whole value, since stores only keep whole items
+func (h Handler) appendPrependCommon(cmd common.SetRequest, isAppend bool) error {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	item, ok, err := h.s.Get(string(cmd.Key), true)
+	if err != nil {
+		return h.storeErr(err)
+	}
+
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	if err := checkCas(item, ok, cmd.Cas); err != nil {
+		return err
+	}
+
+	if isAppend {
+		item.Data = append(item.Data, cmd.Data...)
+	} else {
+		item.Data = append(cmd.Data, item.Data...)
+	}
+	item.Cas = 0
+
+	return h.storeErr(h.s.Put(string(cmd.Key), item))
+}
+
+func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	l := h.s.RLocker()
+	l.Lock()
+	defer l.Unlock()
+	defer close(errorOut)
+	defer close(dataOut)
+
+	for idx, bk := range cmd.Keys {
+		item, ok, err := h.s.Get(string(bk), true)
+		if err != nil {
+			errorOut <- h.storeErr(err)
+			return dataOut, errorOut
+		}
+
+		if !ok {
+			dataOut <- common.GetResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    bk,
+			}
+			continue
+		}
+
+		dataOut <- common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  item.Flags,
+			Cas:    item.Cas,
+			Key:    bk,
+			Data:   item.Data,
+		}
+	}
+
+	return dataOut, errorOut
+}
+
+func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	l := h.s.RLocker()
+	l.Lock()
+	defer l.Unlock()
+	defer close(errorOut)
+	defer close(dataOut)
+
+	for idx, bk := range cmd.Keys {
+		item, ok, err := h.s.Get(string(bk), true)
+		if err != nil {
+			errorOut <- h.storeErr(err)
+			return dataOut, errorOut
+		}
+
+		if !ok {
+			dataOut <- common.GetEResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    bk,
+			}
+			continue
+		}
+
+		dataOut <- common.GetEResponse{
+			Miss:    false,
+			Quiet:   cmd.Quiet[idx],
+			Opaque:  cmd.Opaques[idx],
+			Exptime: item.Exptime,
+			Flags:   item.Flags,
+			Cas:     item.Cas,
+			Key:     bk,
+			Data:    item.Data,
+		}
+	}
+
+	return dataOut, errorOut
+}
+
+func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	item, ok, err := h.s.Get(string(cmd.Key), true)
+	if err != nil {
+		return common.GetResponse{}, h.storeErr(err)
+	}
+
+	if !ok {
+		return common.GetResponse{
+			Miss:   true,
+			Quiet:  cmd.Quiet,
+			Opaque: cmd.Opaque,
+			Key:    cmd.Key,
+		}, nil
+	}
+
+	if err := h.s.Touch(string(cmd.Key), h.exptime(cmd.Exptime)); err != nil {
+		return common.GetResponse{}, h.storeErr(err)
+	}
+
+	return common.GetResponse{
+		Miss:   false,
+		Quiet:  cmd.Quiet,
+		Opaque: cmd.Opaque,
+		Flags:  item.Flags,
+		Cas:    item.Cas,
+		Key:    cmd.Key,
+		Data:   item.Data,
+	}, nil
+}
+
+func (h Handler) Delete(cmd common.DeleteRequest) error {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	item, ok, err := h.s.Get(string(cmd.Key), false)
+	if err != nil {
+		return h.storeErr(err)
+	}
+
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	if err := checkCas(item, ok, cmd.Cas); err != nil {
+		return err
+	}
+
+	return h.storeErr(h.s.Delete(string(cmd.Key)))
+}
+
+func (h Handler) Touch(cmd common.TouchRequest) error {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	_, ok, err := h.s.Get(string(cmd.Key), false)
+	if err != nil {
+		return h.storeErr(err)
+	}
+
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	return h.storeErr(h.s.Touch(string(cmd.Key), h.exptime(cmd.Exptime)))
+}
+
+func (h Handler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecrCommon(cmd, true)
+}
+
+func (h Handler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.incrDecrCommon(cmd, false)
+}
+
+func (h Handler) incrDecrCommon(cmd common.IncrDecrRequest, incr bool) (uint64, error) {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	item, ok, err := h.s.Get(string(cmd.Key), true)
+	if err != nil {
+		return 0, h.storeErr(err)
+	}
+
+	if !ok {
+		if cmd.Exptime == common.NoInitialExptime {
+			return 0, common.ErrKeyNotFound
+		}
+
+		err := h.s.Put(string(cmd.Key), Item{
+			Data:    []byte(strconv.FormatUint(cmd.Initial, 10)),
+			Exptime: h.exptime(cmd.Exptime),
+		})
+		if err != nil {
+			return 0, h.storeErr(err)
+		}
+
+		return cmd.Initial, nil
+	}
+
+	val, err := strconv.ParseUint(string(item.Data), 10, 64)
+	if err != nil {
+		return 0, common.ErrBadIncDecValue
+	}
+
+	// Increments wrap at 64 bits and decrements stop at 0, same as memcached
+	if incr {
+		val += cmd.Delta
+	} else if cmd.Delta > val {
+		val = 0
+	} else {
+		val -= cmd.Delta
+	}
+
+	item.Data = []byte(strconv.FormatUint(val, 10))
+	item.Cas = 0
+	if err := h.s.Put(string(cmd.Key), item); err != nil {
+		return 0, h.storeErr(err)
+	}
+
+	return val, nil
+}
+
+// Version returns the name of the store since there is no separate server behind the handler
+func (h Handler) Version() (string, error) {
+	return h.s.Name(), nil
+}
+
+// Flush removes all the data. With a delay, every current item expires at the flush time instead
+// if it would otherwise live longer.
+func (h Handler) Flush(cmd common.FlushRequest) error {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	if cmd.Delay == 0 {
+		return h.storeErr(h.s.Flush(0))
+	}
+
+	return h.storeErr(h.s.Flush(h.s.Now() + cmd.Delay))
+}
+
+// Stats only has general stats. There are no groups for stores.
+func (h Handler) Stats(group []byte) ([]common.Stat, error) {
+	if len(group) > 0 {
+		return nil, nil
+	}
+
+	l := h.s.RLocker()
+	l.Lock()
+	defer l.Unlock()
+
+	return h.s.Stats(), nil
+}
+
+// Close does nothing, as the store is shared by all connections
+func (h Handler) Close() error {
+	return nil
+}
@@ -0,0 +1,375 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import (
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricTierPromotions      = metrics.AddCounter("handler_tier_promotions", nil)
+	MetricTierPromotionErrors = metrics.AddCounter("handler_tier_promotion_errors", nil)
+)
+
+// PromotePolicy decides how a value found in a lower tier is stored in a higher one
+type PromotePolicy int
+
+const (
+	// PromoteSet sets the value in the tier
+	PromoteSet PromotePolicy = iota
+	// PromoteAdd adds the value to the tier, so it doesn't overwrite a newer one that was set
+	// since the read
+	PromoteAdd
+	// PromoteNone leaves the tier alone, so it only holds what was written to it
+	PromoteNone
+)
+
+// Tier is one level of a Tiered handler
+type Tier struct {
+	Handler HandlerConst
+	// Promote is how values found in the tiers below this one are stored in it
+	Promote PromotePolicy
+}
+
+// Tiered stacks the tiers from fastest to slowest and makes them look like one handler, so an
+// orca's L1 or L2 can be a chain of its own, e.g. a local memcached in front of a remote one.
+// Writes go to the last tier first and then up the chain, the same way the L1L2 orca writes L2
+// before L1, so the last tier has every value and the ones above it hold a subset. Reads go down
+// the chain until a tier has the key, and values are promoted into the tiers above it by their
+// policies.
+//
+// Adds and replaces only need to work in the last tier and set the value in the others.
+// Increments and decrements are done in the last tier and delete the key from the others.
+// Streamed values can't be written twice, so they only go to the last tier and the key is deleted
+// from the others. Each tier hands out its own CAS values, so CAS is not supported. Stats and
+// version requests go to the first tier.
+func Tiered(tiers ...Tier) HandlerConst {
+	return func() (Handler, error) {
+		h := &tieredHandler{
+			tiers:    tiers,
+			handlers: make([]Handler, 0, len(tiers)),
+		}
+		for _, t := range tiers {
+			b, err := t.Handler()
+			if err != nil {
+				h.Close()
+				return nil, err
+			}
+			h.handlers = append(h.handlers, b)
+		}
+		return h, nil
+	}
+}
+
+// tieredHandler is not safe for concurrent use, the same as the handlers it wraps
+type tieredHandler struct {
+	tiers    []Tier
+	handlers []Handler
+}
+
+func (h *tieredHandler) last() Handler {
+	return h.handlers[len(h.handlers)-1]
+}
+
+// upper returns the handlers of all but the last tier, from the slowest to the fastest
+func (h *tieredHandler) upper() []Handler {
+	var upper []Handler
+	for i := len(h.handlers) - 2; i >= 0; i-- {
+		upper = append(upper, h.handlers[i])
+	}
+	return upper
+}
+
+// invalidate deletes a key from every tier but the last. A tier that doesn't have it is fine.
+func (h *tieredHandler) invalidate(key []byte) error {
+	for _, b := range h.upper() {
+		if err := b.Delete(common.DeleteRequest{Key: key}); err != nil && err != common.ErrKeyNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// store writes to the last tier with op and, if that works, to the others with upper. Misses in
+// the other tiers are fine, since they don't have to hold every value.
+func (h *tieredHandler) store(cmd common.SetRequest, op, upper func(Handler, common.SetRequest) error) error {
+	if cmd.Cas != 0 {
+		return common.ErrNotSupported
+	}
+
+	if err := op(h.last(), cmd); err != nil {
+		return err
+	}
+
+	if cmd.Stream != nil {
+		return h.invalidate(cmd.Key)
+	}
+
+	for _, b := range h.upper() {
+		err := upper(b, cmd)
+		if err != nil && err != common.ErrItemNotStored && err != common.ErrKeyNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *tieredHandler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Set, Handler.Set)
+}
+
+func (h *tieredHandler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Add, Handler.Set)
+}
+
+func (h *tieredHandler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Replace, Handler.Set)
+}
+
+func (h *tieredHandler) Append(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Append, Handler.Append)
+}
+
+func (h *tieredHandler) Prepend(cmd common.SetRequest) error {
+	return h.store(cmd, Handler.Prepend, Handler.Prepend)
+}
+
+// Delete deletes the key from every tier. The result is the last tier's.
+func (h *tieredHandler) Delete(cmd common.DeleteRequest) error {
+	if err := h.last().Delete(cmd); err != nil {
+		return err
+	}
+	return h.invalidate(cmd.Key)
+}
+
+// Touch touches the key in every tier. The result is the last tier's.
+func (h *tieredHandler) Touch(cmd common.TouchRequest) error {
+	if err := h.last().Touch(cmd); err != nil {
+		return err
+	}
+	for _, b := range h.upper() {
+		if err := b.Touch(cmd); err != nil && err != common.ErrKeyNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// GAT gets the value from the last tier, which has every value, and touches the key in the others
+func (h *tieredHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.last().GAT(cmd)
+	if err != nil || res.Miss {
+		return res, err
+	}
+	for _, b := range h.upper() {
+		touch := common.TouchRequest{Key: cmd.Key, Exptime: cmd.Exptime}
+		if err := b.Touch(touch); err != nil && err != common.ErrKeyNotFound {
+			return common.GetResponse{}, err
+		}
+	}
+	return res, nil
+}
+
+func (h *tieredHandler) arith(cmd common.IncrDecrRequest, op func(Handler, common.IncrDecrRequest) (uint64, error)) (uint64, error) {
+	value, err := op(h.last(), cmd)
+	if err != nil {
+		return value, err
+	}
+	return value, h.invalidate(cmd.Key)
+}
+
+func (h *tieredHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(cmd, Handler.Incr)
+}
+
+func (h *tieredHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(cmd, Handler.Decr)
+}
+
+// promote stores a value found in tier t in the tiers above it, as their policies say. Failing to
+// promote doesn't fail the read.
+func (h *tieredHandler) promote(t int, res common.GetEResponse) {
+	for u := t - 1; u >= 0; u-- {
+		req := common.SetRequest{
+			Key:     res.Key,
+			Data:    res.Data,
+			Flags:   res.Flags,
+			Exptime: res.Exptime,
+		}
+
+		var err error
+		switch h.tiers[u].Promote {
+		case PromoteSet:
+			err = h.handlers[u].Set(req)
+		case PromoteAdd:
+			err = h.handlers[u].Add(req)
+			if err == common.ErrKeyExists || err == common.ErrItemNotStored {
+				err = nil
+			}
+		default:
+			continue
+		}
+
+		metrics.IncCounter(MetricTierPromotions)
+		if err != nil {
+			metrics.IncCounter(MetricTierPromotionErrors)
+		}
+	}
+}
+
+// getE reads the keys of cmd down the tiers. It returns an answer for each key, in order, up to
+// the first one that couldn't be answered because of an error.
+func (h *tieredHandler) getE(cmd common.GetRequest) ([]common.GetEResponse, error) {
+	results := make([]common.GetEResponse, len(cmd.Keys))
+	answered := make([]bool, len(cmd.Keys))
+
+	pending := make([]int, len(cmd.Keys))
+	for k := range pending {
+		pending[k] = k
+	}
+
+	var err error
+	for t, b := range h.handlers {
+		if len(pending) == 0 {
+			break
+		}
+
+		var responses []common.GetEResponse
+		resChan, errChan := b.GetE(subRequest(cmd, pending))
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				responses = append(responses, res)
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				err = e
+			}
+		}
+		if err != nil {
+			break
+		}
+
+		var misses []int
+		for j, k := range pending {
+			if j >= len(responses) {
+				break
+			}
+			res := responses[j]
+			if res.Miss && t < len(h.handlers)-1 {
+				misses = append(misses, k)
+				continue
+			}
+			if !res.Miss {
+				h.promote(t, res)
+			}
+			results[k] = res
+			answered[k] = true
+		}
+		pending = misses
+	}
+
+	var out []common.GetEResponse
+	for k := range cmd.Keys {
+		if !answered[k] {
+			break
+		}
+		out = append(out, results[k])
+	}
+	return out, err
+}
+
+// Get reads all of the keys down the tiers before passing any of them on, so values can't be
+// streamed
+func (h *tieredHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		responses, err := h.getE(cmd)
+		for _, res := range responses {
+			dataOut <- common.GetResponse{
+				Key:    res.Key,
+				Data:   res.Data,
+				Opaque: res.Opaque,
+				Flags:  res.Flags,
+				Cas:    res.Cas,
+				Miss:   res.Miss,
+				Quiet:  res.Quiet,
+			}
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+// GetE works the same way as Get
+func (h *tieredHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+
+	go func() {
+		defer close(errorOut)
+		defer close(dataOut)
+
+		responses, err := h.getE(cmd)
+		for _, res := range responses {
+			dataOut <- res
+		}
+		if err != nil {
+			errorOut <- err
+		}
+	}()
+
+	return dataOut, errorOut
+}
+
+func (h *tieredHandler) Stats(group []byte) ([]common.Stat, error) {
+	return h.handlers[0].Stats(group)
+}
+
+func (h *tieredHandler) Version() (string, error) {
+	return h.handlers[0].Version()
+}
+
+// Flush flushes every tier, the last one first
+func (h *tieredHandler) Flush(cmd common.FlushRequest) error {
+	for i := len(h.handlers) - 1; i >= 0; i-- {
+		if err := h.handlers[i].Flush(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *tieredHandler) Close() error {
+	for _, b := range h.handlers {
+		b.Close()
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers_test
+
+import (
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+func TestTiered(t *testing.T) {
+	newTiers := func() (*mapHandler, *mapHandler, *mapHandler, handlers.Handler) {
+		first, second, third := newMapHandler(), newMapHandler(), newMapHandler()
+		consts := mapConsts(first, second, third)
+		h, _ := handlers.Tiered(
+			handlers.Tier{Handler: consts[0], Promote: handlers.PromoteSet},
+			handlers.Tier{Handler: consts[1], Promote: handlers.PromoteNone},
+			handlers.Tier{Handler: consts[2]},
+		)()
+		return first, second, third, h
+	}
+
+	t.Run("WritesAll", func(t *testing.T) {
+		first, second, third, h := newTiers()
+
+		if err := h.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		for i, tier := range []*mapHandler{first, second, third} {
+			if tier.data["foo"] != "bar" {
+				t.Fatalf("Expected foo to be set in tier %d", i+1)
+			}
+		}
+
+		if err := h.Delete(common.DeleteRequest{Key: []byte("foo")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		for i, tier := range []*mapHandler{first, second, third} {
+			if _, ok := tier.data["foo"]; ok {
+				t.Fatalf("Expected foo to be deleted from tier %d", i+1)
+			}
+		}
+	})
+
+	t.Run("ReadsDown", func(t *testing.T) {
+		first, second, third, h := newTiers()
+		first.data["a"] = "1"
+		third.data["b"] = "2"
+
+		keys := []string{"a", "b", "c"}
+		req := common.GetRequest{Opaques: make([]uint32, len(keys)), Quiet: make([]bool, len(keys))}
+		for _, key := range keys {
+			req.Keys = append(req.Keys, []byte(key))
+		}
+
+		resChan, errChan := h.Get(req)
+		var got []common.GetResponse
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+					continue
+				}
+				got = append(got, res)
+			case err, ok := <-errChan:
+				if !ok {
+					errChan = nil
+					continue
+				}
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		want := []struct {
+			key  string
+			data string
+			miss bool
+		}{{"a", "1", false}, {"b", "2", false}, {"c", "", true}}
+		if len(got) != len(want) {
+			t.Fatalf("Expected %d responses, got %d", len(want), len(got))
+		}
+		for i, w := range want {
+			if string(got[i].Key) != w.key || string(got[i].Data) != w.data || got[i].Miss != w.miss {
+				t.Fatalf("Expected %+v, got %+v", w, got[i])
+			}
+		}
+
+		if first.data["b"] != "2" {
+			t.Fatalf("Expected b to be promoted into the first tier")
+		}
+		if _, ok := second.data["b"]; ok {
+			t.Fatalf("Expected b not to be promoted into the second tier")
+		}
+	})
+}
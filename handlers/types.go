@@ -34,5 +34,10 @@ type Handler interface {
 	GAT(cmd common.GATRequest) (common.GetResponse, error)
 	Delete(cmd common.DeleteRequest) error
 	Touch(cmd common.TouchRequest) error
+	Incr(cmd common.IncrDecrRequest) (uint64, error)
+	Decr(cmd common.IncrDecrRequest) (uint64, error)
+	Stats(group []byte) ([]common.Stat, error)
+	Flush(cmd common.FlushRequest) error
+	Version() (string, error)
 	Close() error
 }
@@ -0,0 +1,265 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpprot is a small HTTP gateway for services that don't speak memcached. Each item is
+// a resource at /cache/{key}:
+//
+//	GET    /cache/{key} -> get, 200 with the value or 404
+//	PUT    /cache/{key} -> set, 204
+//	DELETE /cache/{key} -> delete, 204 or 404
+//
+// The Content-Type of a PUT is stored in the item's flags and given back on a GET. Only a few
+// common types have a mapping; anything else is stored as application/octet-stream. The raw flags
+// are also returned in the X-Cache-Flags header for items stored by memcached clients. A PUT can
+// set a TTL in seconds with the X-Cache-TTL header. A PUT or DELETE carries its signature, when
+// rend requires them, as hex in the X-Cache-Signature header.
+//
+// A gateway made with WithAuth requires HTTP basic auth on every request and answers others with
+// 401 Unauthorized.
+package httpprot
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/timer"
+)
+
+const (
+	// KeyPrefix is the path prefix for all items. The rest of the path is the key.
+	KeyPrefix = "/cache/"
+
+	// TTLHeader is the request header with the TTL in seconds for a PUT
+	TTLHeader = "X-Cache-TTL"
+
+	// FlagsHeader is the response header with the raw flags of the item for a GET
+	FlagsHeader = "X-Cache-Flags"
+
+	// SignatureHeader is the request header with the hex signature of a PUT or DELETE
+	SignatureHeader = "X-Cache-Signature"
+
+	// maxBodyLen limits the size of a PUT body that will be read into memory
+	maxBodyLen = 64 * 1024 * 1024
+)
+
+// contentTypes maps flags to content types by index
+var contentTypes = []string{
+	"application/octet-stream",
+	"text/plain",
+	"application/json",
+	"text/html",
+}
+
+func flagsForContentType(contentType string) uint32 {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0
+	}
+
+	for i, ct := range contentTypes {
+		if ct == mediaType {
+			return uint32(i)
+		}
+	}
+
+	return 0
+}
+
+func contentTypeForFlags(flags uint32) string {
+	if flags < uint32(len(contentTypes)) {
+		return contentTypes[flags]
+	}
+	return contentTypes[0]
+}
+
+// connState is shared by the parser and responder of a connection
+type connState struct {
+	// close is set when the client asked to close the connection after the current request
+	close bool
+}
+
+type HTTPParser struct {
+	reader *bufio.Reader
+	state  *connState
+	auth   func(user, pass string) bool
+}
+
+// NewHTTPParserResponder creates a parser and responder pair for a single connection. The two
+// share whether the connection should be closed after the current response.
+func NewHTTPParserResponder(reader *bufio.Reader, writer *bufio.Writer) (HTTPParser, HTTPResponder) {
+	state := &connState{}
+	return HTTPParser{
+		reader: reader,
+		state:  state,
+	}, HTTPResponder{
+		writer: writer,
+		state:  state,
+	}
+}
+
+// WithAuth returns a parser that only lets requests through with basic auth credentials that
+// auth accepts. Any other request is read in full and returned as common.ErrAuth.
+func (h HTTPParser) WithAuth(auth func(user, pass string) bool) HTTPParser {
+	h.auth = auth
+	return h
+}
+
+func (h HTTPParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	// The previous response told the client the connection is closing
+	if h.state.close {
+		return nil, common.RequestUnknown, timer.Now(), io.EOF
+	}
+
+	req, err := http.ReadRequest(h.reader)
+	start := timer.Now()
+
+	if err != nil {
+		if err == io.EOF {
+			log.Println("Connection closed")
+		} else {
+			log.Printf("Error while reading HTTP request: %s\n", err.Error())
+		}
+		return nil, common.RequestUnknown, start, err
+	}
+
+	h.state.close = req.Close
+
+	if h.auth != nil {
+		user, pass, ok := req.BasicAuth()
+		if !ok || !h.auth(user, pass) {
+			return nil, common.RequestUnknown, start, discardBody(req, common.ErrAuth)
+		}
+	}
+
+	if !strings.HasPrefix(req.URL.Path, KeyPrefix) || len(req.URL.Path) == len(KeyPrefix) {
+		return nil, common.RequestUnknown, start, discardBody(req, common.ErrBadRequest)
+	}
+	key := []byte(req.URL.Path[len(KeyPrefix):])
+
+	switch req.Method {
+	case http.MethodGet:
+		if err := discardBody(req, nil); err != nil {
+			return nil, common.RequestGet, start, err
+		}
+
+		return common.GetRequest{
+			Keys:    [][]byte{key},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+			NoopEnd: false,
+		}, common.RequestGet, start, nil
+
+	case http.MethodPut:
+		return h.setRequest(req, key, start)
+
+	case http.MethodDelete:
+		sig, err := signature(req)
+		if err = discardBody(req, err); err != nil {
+			return nil, common.RequestDelete, start, err
+		}
+
+		return common.DeleteRequest{
+			Key:       key,
+			Opaque:    uint32(0),
+			Signature: sig,
+		}, common.RequestDelete, start, nil
+
+	default:
+		return nil, common.RequestUnknown, start, discardBody(req, nil)
+	}
+}
+
+func (h HTTPParser) setRequest(req *http.Request, key []byte, start uint64) (common.Request, common.RequestType, uint64, error) {
+	var exptime uint32
+	if ttl := req.Header.Get(TTLHeader); ttl != "" {
+		seconds, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil || seconds < 0 {
+			return nil, common.RequestSet, start, discardBody(req, common.ErrBadExptime)
+		}
+		exptime = common.RelativeExptime(seconds)
+	}
+
+	sig, err := signature(req)
+	if err != nil {
+		return nil, common.RequestSet, start, discardBody(req, err)
+	}
+
+	// Too large a body isn't worth reading just to throw it away, so the connection is closed
+	// after the error response instead
+	if req.ContentLength > maxBodyLen {
+		h.state.close = true
+		return nil, common.RequestSet, start, common.ErrBadLength
+	}
+
+	if req.ContentLength > 0 && common.ValueTooBig(uint64(req.ContentLength)) {
+		return nil, common.RequestSet, start, discardBody(req, common.ErrValueTooBig)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyLen+1))
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(len(data)))
+	if err != nil {
+		return nil, common.RequestSet, start, err
+	}
+	if len(data) > maxBodyLen {
+		h.state.close = true
+		return nil, common.RequestSet, start, common.ErrBadLength
+	}
+	if common.ValueTooBig(uint64(len(data))) {
+		return nil, common.RequestSet, start, common.ErrValueTooBig
+	}
+
+	return common.SetRequest{
+		Key:       key,
+		Data:      data,
+		Flags:     flagsForContentType(req.Header.Get("Content-Type")),
+		Exptime:   exptime,
+		Opaque:    uint32(0),
+		Quiet:     false,
+		Signature: sig,
+	}, common.RequestSet, start, nil
+}
+
+// signature decodes the signature header of a request, if it has one
+func signature(req *http.Request) ([]byte, error) {
+	h := req.Header.Get(SignatureHeader)
+	if h == "" {
+		return nil, nil
+	}
+	sig, err := hex.DecodeString(h)
+	if err != nil {
+		return nil, common.ErrBadRequest
+	}
+	return sig, nil
+}
+
+// discardBody reads the rest of the request body so the next request can be read from the
+// connection. It returns the given error unless there was an error reading the body.
+func discardBody(req *http.Request, err error) error {
+	n, ioerr := io.Copy(ioutil.Discard, req.Body)
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	req.Body.Close()
+	if ioerr != nil {
+		return ioerr
+	}
+	return err
+}
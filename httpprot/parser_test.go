@@ -0,0 +1,156 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpprot_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/httpprot"
+)
+
+func newPair(in string) (httpprot.HTTPParser, httpprot.HTTPResponder, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	p, r := httpprot.NewHTTPParserResponder(bufio.NewReader(bytes.NewBufferString(in)), bufio.NewWriter(out))
+	return p, r, out
+}
+
+func TestPutGet(t *testing.T) {
+	p, r, out := newPair("PUT /cache/foo HTTP/1.1\r\nHost: rend\r\nContent-Type: application/json; charset=utf-8\r\n" +
+		"X-Cache-TTL: 30\r\nContent-Length: 7\r\n\r\n{\"a\":1}" +
+		"GET /cache/foo HTTP/1.1\r\nHost: rend\r\n\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestSet {
+		t.Fatalf("Expected set, got %v %v", reqType, err)
+	}
+	sr := req.(common.SetRequest)
+	if string(sr.Key) != "foo" || string(sr.Data) != `{"a":1}` || sr.Exptime != 30 || sr.Flags != 2 {
+		t.Fatalf("Unexpected request %+v", sr)
+	}
+	r.Set(0, false)
+
+	req, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestGet {
+		t.Fatalf("Expected get, got %v %v", reqType, err)
+	}
+	if gr := req.(common.GetRequest); string(gr.Keys[0]) != "foo" {
+		t.Fatalf("Unexpected request %+v", gr)
+	}
+	r.Get(common.GetResponse{Key: sr.Key, Data: sr.Data, Flags: sr.Flags})
+	r.GetEnd(0, false)
+
+	expected := "HTTP/1.1 204 No Content\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 7\r\nContent-Type: application/json\r\nX-Cache-Flags: 2\r\n\r\n{\"a\":1}"
+	if out.String() != expected {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestDeleteMiss(t *testing.T) {
+	p, r, out := newPair("DELETE /cache/foo HTTP/1.1\r\nHost: rend\r\nConnection: close\r\n\r\n")
+
+	_, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestDelete {
+		t.Fatalf("Expected delete, got %v %v", reqType, err)
+	}
+	r.Error(0, common.RequestDelete, common.ErrKeyNotFound, false)
+
+	if !strings.HasPrefix(out.String(), "HTTP/1.1 404 Not Found\r\nConnection: close\r\n") {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+
+	// The connection closes after the response
+	if _, _, _, err := p.Parse(); err != io.EOF {
+		t.Fatalf("Expected EOF after Connection: close, got %v", err)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	p, _, _ := newPair("GET /other/foo HTTP/1.1\r\nHost: rend\r\n\r\n" +
+		"PUT /cache/foo HTTP/1.1\r\nHost: rend\r\nX-Cache-TTL: soon\r\nContent-Length: 3\r\n\r\nbar" +
+		"POST /cache/foo HTTP/1.1\r\nHost: rend\r\nContent-Length: 3\r\n\r\nbar" +
+		"GET /cache/foo HTTP/1.1\r\nHost: rend\r\n\r\n")
+
+	if _, _, _, err := p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected bad request for a path outside the cache, got %v", err)
+	}
+	if _, _, _, err := p.Parse(); err != common.ErrBadExptime {
+		t.Fatalf("Expected bad exptime for a bad TTL, got %v", err)
+	}
+	if req, reqType, _, err := p.Parse(); req != nil || reqType != common.RequestUnknown || err != nil {
+		t.Fatalf("Expected unknown for POST, got %v %v %v", req, reqType, err)
+	}
+
+	// The bodies of the bad requests were skipped
+	if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestGet {
+		t.Fatalf("Expected get, got %v %v", reqType, err)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	p, _, _ := newPair("PUT /cache/foo HTTP/1.1\r\nHost: rend\r\nX-Cache-Signature: 0102\r\nContent-Length: 3\r\n\r\nbar" +
+		"DELETE /cache/foo HTTP/1.1\r\nHost: rend\r\nX-Cache-Signature: 0304\r\n\r\n" +
+		"PUT /cache/foo HTTP/1.1\r\nHost: rend\r\nX-Cache-Signature: zz\r\nContent-Length: 3\r\n\r\nbar" +
+		"GET /cache/foo HTTP/1.1\r\nHost: rend\r\n\r\n")
+
+	req, _, _, err := p.Parse()
+	if err != nil || !bytes.Equal(req.(common.SetRequest).Signature, []byte{1, 2}) {
+		t.Fatalf("Expected a signed set, got %+v %v", req, err)
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil || !bytes.Equal(req.(common.DeleteRequest).Signature, []byte{3, 4}) {
+		t.Fatalf("Expected a signed delete, got %+v %v", req, err)
+	}
+
+	if _, _, _, err := p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected a bad signature to be rejected, got %v", err)
+	}
+
+	// The body of the rejected PUT was skipped
+	if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestGet {
+		t.Fatalf("Expected get, got %v %v", reqType, err)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	p, r, out := newPair("DELETE /cache/foo HTTP/1.1\r\nHost: rend\r\n\r\n" +
+		"PUT /cache/foo HTTP/1.1\r\nHost: rend\r\nAuthorization: Basic dXNlcjp3cm9uZw==\r\nContent-Length: 3\r\n\r\nbar" +
+		"DELETE /cache/foo HTTP/1.1\r\nHost: rend\r\nAuthorization: Basic dXNlcjpwYXNz\r\n\r\n")
+	p = p.WithAuth(func(user, pass string) bool { return user == "user" && pass == "pass" })
+
+	// Without credentials and with the wrong password, the body is still read past
+	for i := 0; i < 2; i++ {
+		if _, _, _, err := p.Parse(); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+		r.Error(0, common.RequestUnknown, common.ErrAuth, false)
+	}
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestDelete || string(req.(common.DeleteRequest).Key) != "foo" {
+		t.Fatalf("Expected delete, got %v %v", reqType, err)
+	}
+
+	unauthorized := "HTTP/1.1 401 Unauthorized\r\nContent-Length: 13\r\nWww-Authenticate: Basic realm=\"rend\"\r\n\r\nUnauthorized\n"
+	if out.String() != unauthorized+unauthorized {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
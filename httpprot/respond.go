@@ -0,0 +1,198 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpprot
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+// HTTPResponder writes an HTTP response for each request. Responses for request types the
+// HTTPParser never returns panic.
+type HTTPResponder struct {
+	writer *bufio.Writer
+	state  *connState
+}
+
+func (h HTTPResponder) Set(opaque uint32, quiet bool) error {
+	return h.respond(http.StatusNoContent, nil, nil)
+}
+
+func (h HTTPResponder) Add(opaque uint32, quiet bool) error {
+	panic("Add command in HTTP protocol")
+}
+
+func (h HTTPResponder) Replace(opaque uint32, quiet bool) error {
+	panic("Replace command in HTTP protocol")
+}
+
+func (h HTTPResponder) Append(opaque uint32, quiet bool) error {
+	panic("Append command in HTTP protocol")
+}
+
+func (h HTTPResponder) Prepend(opaque uint32, quiet bool) error {
+	panic("Prepend command in HTTP protocol")
+}
+
+func (h HTTPResponder) Get(response common.GetResponse) error {
+	if response.Miss {
+		return h.respondStatus(http.StatusNotFound)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentTypeForFlags(response.Flags))
+	header.Set(FlagsHeader, strconv.FormatUint(uint64(response.Flags), 10))
+
+	return h.respond(http.StatusOK, header, response.Data)
+}
+
+// GetEnd does nothing since an HTTP get is for a single key and the response is complete already
+func (h HTTPResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	return nil
+}
+
+func (h HTTPResponder) GetE(response common.GetEResponse) error {
+	panic("GetE command in HTTP protocol")
+}
+
+func (h HTTPResponder) GAT(response common.GetResponse) error {
+	panic("GAT command in HTTP protocol")
+}
+
+func (h HTTPResponder) Delete(opaque uint32, quiet bool) error {
+	return h.respond(http.StatusNoContent, nil, nil)
+}
+
+func (h HTTPResponder) Touch(opaque uint32) error {
+	panic("Touch command in HTTP protocol")
+}
+
+func (h HTTPResponder) Noop(opaque uint32) error {
+	panic("Noop command in HTTP protocol")
+}
+
+func (h HTTPResponder) Quit(opaque uint32, quiet bool) error {
+	panic("Quit command in HTTP protocol")
+}
+
+func (h HTTPResponder) Version(opaque uint32, version string) error {
+	panic("Version command in HTTP protocol")
+}
+
+func (h HTTPResponder) Incr(opaque uint32, value uint64, quiet bool) error {
+	panic("Incr command in HTTP protocol")
+}
+
+func (h HTTPResponder) Decr(opaque uint32, value uint64, quiet bool) error {
+	panic("Decr command in HTTP protocol")
+}
+
+func (h HTTPResponder) SASLListMechs(opaque uint32, mechs []string) error {
+	panic("SASL list mechanisms command in HTTP protocol")
+}
+
+func (h HTTPResponder) SASLAuth(opaque uint32) error {
+	panic("SASL auth command in HTTP protocol")
+}
+
+func (h HTTPResponder) Stats(opaque uint32, stats []common.Stat) error {
+	panic("Stats command in HTTP protocol")
+}
+
+func (h HTTPResponder) Flush(opaque uint32, quiet bool) error {
+	panic("Flush command in HTTP protocol")
+}
+
+func (h HTTPResponder) Verbosity(opaque uint32, quiet bool) error {
+	panic("Verbosity command in HTTP protocol")
+}
+
+func (h HTTPResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	switch err {
+	case common.ErrKeyNotFound:
+		return h.respondStatus(http.StatusNotFound)
+	case common.ErrAuth:
+		header := http.Header{}
+		header.Set("WWW-Authenticate", `Basic realm="rend"`)
+		return h.respond(http.StatusUnauthorized, header, []byte(http.StatusText(http.StatusUnauthorized)+"\n"))
+	case common.ErrBadRequest, common.ErrBadExptime, common.ErrBadKey, common.ErrInvalidArgs:
+		return h.respondStatus(http.StatusBadRequest)
+	case common.ErrBadLength, common.ErrValueTooBig:
+		return h.respondStatus(http.StatusRequestEntityTooLarge)
+	case common.ErrUnknownCmd:
+		header := http.Header{}
+		header.Set("Allow", "GET, PUT, DELETE")
+		return h.respond(http.StatusMethodNotAllowed, header, []byte(http.StatusText(http.StatusMethodNotAllowed)+"\n"))
+	case common.ErrKeyExists, common.ErrItemNotStored:
+		return h.respondStatus(http.StatusConflict)
+	case common.ErrNoMem:
+		return h.respondStatus(http.StatusInsufficientStorage)
+	case common.ErrBusy, common.ErrTempFailure:
+		return h.respondStatus(http.StatusServiceUnavailable)
+	case common.ErrTimeout:
+		return h.respondStatus(http.StatusGatewayTimeout)
+	default:
+		return h.respondStatus(http.StatusInternalServerError)
+	}
+}
+
+// respondStatus responds with the status text as a plain text body
+func (h HTTPResponder) respondStatus(status int) error {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	return h.respond(status, header, []byte(http.StatusText(status)+"\n"))
+}
+
+func (h HTTPResponder) respond(status int, header http.Header, body []byte) error {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	// A 204 must not have a body or a Content-Length
+	if status != http.StatusNoContent {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if h.state.close {
+		header.Set("Connection", "close")
+	}
+
+	n, err := h.writer.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	if err := header.Write(h.writer); err != nil {
+		return err
+	}
+
+	n, err = h.writer.WriteString("\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	n, err = h.writer.Write(body)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	return h.writer.Flush()
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func init() {
+	http.Handle("/admin/log", http.HandlerFunc(serveLevels))
+}
+
+type levelsBody struct {
+	Default    string            `json:"default"`
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+// serveLevels shows the log levels on GET. A POST or PUT with a level sets the level of the
+// subsystem given, or the default level if there is none.
+func serveLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost, http.MethodPut:
+		l, err := ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if name := r.FormValue("subsystem"); name != "" {
+			SetLevel(name, l)
+		} else {
+			SetDefaultLevel(l)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	def, levels := Levels()
+	body := levelsBody{
+		Default:    def.String(),
+		Subsystems: make(map[string]string, len(levels)),
+	}
+	for name, l := range levels {
+		body.Subsystems[name] = l.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,196 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging gives each part of rend a structured, leveled logger. Every logger belongs to a
+// subsystem, like "server", whose level can be changed while the proxy runs. Subsystems without a
+// level of their own use the default level. Output is text by default or JSON for log shippers.
+//
+// Logging is configured once at startup with Configure. After that, levels can be read and
+// changed over HTTP at /admin/log on the same port as /metrics:
+//
+//	curl localhost:11299/admin/log
+//	curl -X POST 'localhost:11299/admin/log?subsystem=server&level=debug'
+//	curl -X POST 'localhost:11299/admin/log?level=warn'
+//
+// Output from the standard log package goes through the default subsystem so it is formatted the
+// same way.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSubsystem is the subsystem of output from the standard log package
+const DefaultSubsystem = "default"
+
+type subsystem struct {
+	name     string
+	level    slog.LevelVar
+	explicit atomic.Bool
+}
+
+var (
+	defaultLevel slog.LevelVar
+
+	subsystemsLock sync.Mutex
+	subsystems     = make(map[string]*subsystem)
+
+	// base holds the baseHandler every subsystem writes through
+	base atomic.Value
+)
+
+// baseHandler gives every handler stored in base the same type, as atomic.Value needs
+type baseHandler struct {
+	slog.Handler
+}
+
+func init() {
+	base.Store(baseHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})})
+	slog.SetDefault(Logger(DefaultSubsystem))
+}
+
+// Configure sets the output of every logger. JSON output has one object per line, otherwise
+// records are written as key=value pairs.
+func Configure(w io.Writer, json bool) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if json {
+		base.Store(baseHandler{slog.NewJSONHandler(w, opts)})
+	} else {
+		base.Store(baseHandler{slog.NewTextHandler(w, opts)})
+	}
+	slog.SetDefault(Logger(DefaultSubsystem))
+}
+
+func getSubsystem(name string) *subsystem {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+
+	s, ok := subsystems[name]
+	if !ok {
+		s = &subsystem{name: name}
+		subsystems[name] = s
+	}
+	return s
+}
+
+// Logger returns the logger for the subsystem. Loggers are cheap and can be kept in package
+// variables. Every record is tagged with the subsystem name.
+func Logger(name string) *slog.Logger {
+	return slog.New(&handler{sub: getSubsystem(name)})
+}
+
+// ParseLevel reads a level name: debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("Unknown log level %q", s)
+	}
+	return l, nil
+}
+
+// SetDefaultLevel sets the level of every subsystem without a level of its own
+func SetDefaultLevel(l slog.Level) {
+	defaultLevel.Set(l)
+}
+
+// SetLevel sets the level of one subsystem, which no longer follows the default level
+func SetLevel(name string, l slog.Level) {
+	s := getSubsystem(name)
+	s.level.Set(l)
+	s.explicit.Store(true)
+}
+
+// SetLevels sets the levels of subsystems from a comma separated list of subsystem=level pairs,
+// like server=debug,sharded=warn
+func SetLevels(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, level, ok := strings.Cut(part, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("Log level %q is not of the form subsystem=level", part)
+		}
+
+		l, err := ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		SetLevel(name, l)
+	}
+	return nil
+}
+
+// Levels returns the default level and the level of each subsystem that has logged or been
+// given a level
+func Levels() (slog.Level, map[string]slog.Level) {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+
+	ret := make(map[string]slog.Level, len(subsystems))
+	for name, s := range subsystems {
+		ret[name] = s.effective()
+	}
+	return defaultLevel.Level(), ret
+}
+
+func (s *subsystem) effective() slog.Level {
+	if s.explicit.Load() {
+		return s.level.Level()
+	}
+	return defaultLevel.Level()
+}
+
+// handler checks the level of its subsystem and passes records on to the current base handler.
+// The attributes and groups added to a logger are replayed onto the base handler for each record
+// so the base can be swapped by Configure after loggers are made.
+type handler struct {
+	sub *subsystem
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.sub.effective()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	b := base.Load().(baseHandler).WithAttrs([]slog.Attr{slog.String("subsystem", h.sub.name)})
+	for _, op := range h.ops {
+		b = op(b)
+	}
+	return b.Handle(ctx, r)
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{sub: h.sub, ops: append(ops, op)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler { return b.WithGroup(name) })
+}
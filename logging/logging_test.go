@@ -0,0 +1,108 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/logging"
+)
+
+// records reads the JSON records written to out
+func records(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var ret []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var r map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Expected a JSON record, got %q: %v", line, err)
+		}
+		ret = append(ret, r)
+	}
+	out.Reset()
+	return ret
+}
+
+func TestLevels(t *testing.T) {
+	out := &bytes.Buffer{}
+	logging.Configure(out, true)
+	logging.SetDefaultLevel(slog.LevelInfo)
+
+	logger := logging.Logger("levels_test").With("conn", 7)
+
+	logger.Debug("hidden")
+	logger.Info("shown", "key", "value")
+	recs := records(t, out)
+	if len(recs) != 1 || recs[0]["msg"] != "shown" || recs[0]["subsystem"] != "levels_test" ||
+		recs[0]["key"] != "value" || recs[0]["conn"] != float64(7) {
+		t.Fatalf("Expected only the info record with its attributes, got %v", recs)
+	}
+
+	if err := logging.SetLevels("levels_test=debug,other_test=error"); err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+	logger.Debug("now shown")
+	logging.Logger("other_test").Warn("hidden")
+	if recs := records(t, out); len(recs) != 1 || recs[0]["msg"] != "now shown" {
+		t.Fatalf("Expected only the debug record of the subsystem set to debug, got %v", recs)
+	}
+
+	log.Println("from the log package")
+	if recs := records(t, out); len(recs) != 1 || recs[0]["subsystem"] != logging.DefaultSubsystem {
+		t.Fatalf("Expected the standard logger to write through the default subsystem, got %v", recs)
+	}
+
+	for _, bad := range []string{"levels_test", "levels_test=loud", "=debug"} {
+		if err := logging.SetLevels(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestLevelsHTTP(t *testing.T) {
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		return rec
+	}
+
+	if rec := serve("POST", "/admin/log?subsystem=http_test&level=warn"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected success, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var body struct {
+		Default    string
+		Subsystems map[string]string
+	}
+	if err := json.Unmarshal(serve("GET", "/admin/log").Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected JSON, got %v", err)
+	}
+	if body.Subsystems["http_test"] != "WARN" {
+		t.Fatalf("Expected http_test to be at WARN, got %v", body)
+	}
+
+	if rec := serve("POST", "/admin/log?level=loud"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad level to be refused, got %d", rec.Code)
+	}
+}
@@ -15,17 +15,32 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime/debug"
-	"sync"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/hongst/rend/admin"
+	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/disk"
 	"github.com/hongst/rend/handlers/inmem"
 	"github.com/hongst/rend/handlers/memcached"
+	chunkedh "github.com/hongst/rend/handlers/memcached/chunked"
+	"github.com/hongst/rend/handlers/memcached/sharded"
+	"github.com/hongst/rend/handlers/null"
+	"github.com/hongst/rend/handlers/spill"
+	"github.com/hongst/rend/handlers/ssd"
+	"github.com/hongst/rend/logging"
 	"github.com/hongst/rend/metrics"
 	"github.com/hongst/rend/orcas"
 	"github.com/hongst/rend/server"
@@ -46,39 +61,317 @@ func init() {
 		panic("Keyboard Interrupt")
 	}()
 
-	// http debug and metrics endpoint
-	go http.ListenAndServe("localhost:11299", nil)
-
 	// metrics output prefix
 	metrics.SetPrefix("rend_")
 }
 
 // Flags
 var (
-	chunked bool
-	l1sock  string
-	l1inmem bool
+	chunked          bool
+	chunkedPipelined bool
+	chunkSize        int
+	maxChunkSize     int
+	compress         bool
+	compressMin      int
+	encryptionKeys   string
+	chunkChecksums   bool
+	streamMin        int
+	streamSetMin     int
+	fetchConns       int
+	fetchMinChunks   int
+	janitorSec       int
+	chunkDedup       bool
+	l1sock           string
+	l1inmem          bool
+	l1null           bool
+
+	l1backends string
+	l1replicas string
+	poolSize   int
+	muxConns   int
+
+	l1writeQuorum int
+	l1readQuorum  int
+
+	l1routesSpec    string
+	l2routesSpec    string
+	routeMaxTTLSpec string
+	l1routes        map[string]string
+	l2routes        map[string]string
+	routeMaxTTLs    map[string]string
+
+	l3sock      string
+	l2promote   string
+	l2promotion handlers.PromotePolicy
+
+	hotKeyThreshold  int
+	hotKeySampleRate int
+	hotKeyTTLMs      int
+	hotKeyMax        int
+
+	l1backendsRefreshSec int
+
+	l1elasticache           string
+	l1elasticacheRefreshSec int
+
+	l1consulService       string
+	l1consulAddr          string
+	l1consulTag           string
+	l1etcdPrefix          string
+	l1etcdEndpoint        string
+	l1discoveryRefreshSec int
+
+	retries        int
+	retryBackoffMs int
 
-	l2enabled bool
-	l2sock    string
+	namespace string
+
+	l1readTimeoutMs  int
+	l1writeTimeoutMs int
+	l2readTimeoutMs  int
+	l2writeTimeoutMs int
+	l1opts           memcached.Options
+	l2opts           memcached.Options
+
+	l1tls           bool
+	l1tlsCA         string
+	l1tlsServerName string
+	l2tls           bool
+	l2tlsCA         string
+	l2tlsServerName string
+
+	l2enabled      bool
+	l2sock         string
+	l2null         bool
+	l2diskPath     string
+	l2diskMaxBytes uint64
+	l2ssdPath      string
+	l2ssdSize      int64
+
+	l2breaker          bool
+	l2breakerErrorRate float64
+	l2breakerSlowMs    int
+	l2breakerOpenMs    int
+
+	spillThreshold int
+	spillEndpoint  string
+	spillBucket    string
+	spillRegion    string
+	spillPrefix    string
+	spillBackfill  bool
 
 	locked      bool
 	concurrency int
 	multiReader bool
 
+	leasesEnabled bool
+	leaseWaitMs   int
+
 	port            int
 	batchPort       int
+	bindHost        string
+	ipVersion       string
 	useDomainSocket bool
 	sockPath        string
+	sockMode        string
+	sockOwner       string
+	sockGroup       string
+
+	sigSecret string
+	sigWindow int
+
+	oomPolicy    string
+	oomRetries   int
+	oomBackoffMs int
+	oomConf      orcas.OOMConfig
+
+	saslCreds      string
+	batchSASLCreds string
+
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	proxyProtocol bool
+
+	httpPort int
+
+	maxValueSize int
+
+	auditBinary bool
+
+	statsdAddr        string
+	statsdDogStatsD   bool
+	statsdTags        string
+	statsdIntervalSec int
+
+	flushPolicy string
+	flushPol    orcas.FlushPolicy
+
+	orcaName      string
+	batchOrcaName string
+
+	writePolicy      string
+	writeBackWorkers int
+	writeBackQueue   int
+	writeBackMaxMB   int
+	writeBackRetries int
+	writeBackBackoff int
+	writeConf        orcas.WriteConfig
+
+	l1backfillAsync   bool
+	l1backfillWorkers int
+	l1backfillQueue   int
+
+	earlyRefreshPercent     float64
+	earlyRefreshTTLSec      int
+	earlyRefreshProbability float64
+	refreshConf             orcas.EarlyRefreshConfig
+
+	l1maxTTL      int
+	l1TTLOverride int
+	l2maxTTL      int
+	l2TTLOverride int
+	ttlConf       orcas.TTLConfig
+
+	l2coalesce bool
+
+	shadowPercent float64
+	shadowWorkers int
+	shadowQueue   int
+	shadow        *orcas.Shadow
+
+	readRepairPercent float64
+	readRepairWorkers int
+	readRepairQueue   int
+
+	hitPrefixes string
+
+	topKeysSampleRate  int
+	topKeysSize        int
+	topKeysHalfLifeSec int
+
+	flightRecorder int
+
+	accessLogPath       string
+	accessLogSampleRate int
+	accessLogKeys       bool
+	accessLogQueue      int
+
+	logJSON   bool
+	logLevel  string
+	logLevels string
+
+	maxConns         int
+	listenerMaxConns int
+	idleTimeoutSec   int
+	requestTimeoutMs int
+	maxConnRequests  int
+	maxConnAgeSec    int
+
+	shutdownTimeoutSec int
+
+	adminAddr string
+
+	healthCheckL1        bool
+	healthCheckL2        bool
+	healthCheckKey       string
+	healthCheckTimeoutMs int
+
+	rateLimit         float64
+	listenerRateLimit float64
+	clientRateLimit   float64
+	rateLimitWaitMs   int
+
+	allowCIDRs string
+	denyCIDRs  string
+
+	tcpKeepAliveSec        int
+	tcpNagle               bool
+	tcpReadBuffer          int
+	tcpWriteBuffer         int
+	backendTCPKeepAliveSec int
+	backendTCPNagle        bool
+	backendTCPReadBuffer   int
+	backendTCPWriteBuffer  int
 )
 
 func init() {
 	flag.BoolVar(&chunked, "chunked", false, "If --chunked is specified, the chunked handler is used for L1")
+	flag.BoolVar(&chunkedPipelined, "chunked-pipelined", false, "Send all the chunks of a set to L1 before reading the responses. Only used if --chunked is true.")
+	flag.IntVar(&chunkSize, "chunk-size", 0, "Size in bytes each chunk of a new item takes up in L1, including memcached's overhead. Match it to the chunk size of a slab class. Items already stored keep their chunk size. 0 uses 1184, the size of slab class 12, and sizes below 512 are raised to 512. Only used if --chunked is true.")
+	flag.IntVar(&maxChunkSize, "max-chunk-size", 0, "Give bigger items bigger chunks, up to this many bytes, so they take fewer chunks. Sizes grow from --chunk-size by memcached's default slab growth factor of 1.25. Should be no more than memcached's slab chunk max (-o slab_chunk_max). Disabled if 0. Only used if --chunked is true.")
+	flag.BoolVar(&compress, "compress", false, "Compress values with DEFLATE before splitting them into chunks. Values that don't get smaller are stored as they are. Only used if --chunked is true.")
+	flag.IntVar(&compressMin, "compress-min-bytes", 1024, "Smallest value in bytes that --compress compresses")
+	flag.BoolVar(&chunkChecksums, "chunk-checksums", false, "End every chunk with a CRC-32 that is checked on reads, so corrupted data is a miss instead of being returned. Only used if --chunked is true.")
+	flag.IntVar(&streamMin, "stream-min-bytes", 0, "Stream hits of at least this many bytes to clients one chunk at a time instead of reading the whole value first. Compressed and encrypted values are never streamed. A chunk that goes missing mid-stream closes the client connection. Disabled if 0. Only used if --chunked is true and L2 is disabled.")
+	flag.IntVar(&fetchConns, "chunk-fetch-conns", 0, "Open this many more connections to L1 per client connection and fetch the chunks of large items over all of them at once. Disabled if 0. Only used if --chunked is true.")
+	flag.IntVar(&fetchMinChunks, "chunk-fetch-min-chunks", 8, "Smallest number of chunks an item needs to be fetched over --chunk-fetch-conns")
+	flag.IntVar(&janitorSec, "chunk-janitor-interval-sec", 0, "Every this many seconds, list the keys in L1 with lru_crawler metadump and delete chunks that no item points at any more, such as those left by interrupted sets. L1 must hold only chunked data. Disabled if 0. Only used if --chunked is true.")
+	flag.IntVar(&streamSetMin, "stream-set-min-bytes", 0, "Split sets, adds and replaces of at least this many bytes into chunks as they are read from the client instead of reading the whole value first. Signed requests are never streamed, and values are still read whole if they are compressed or encrypted. Disabled if 0. Requires --chunked with a single L1 and no L2 or spilling.")
+	flag.BoolVar(&chunkDedup, "chunk-dedup", false, "Store chunks under a hash of their content so items with the same data share them in L1. Shared chunks don't expire and are deleted when the last item using them is deleted or overwritten. Chunks of items that expire are left for memcached to evict. Only used if --chunked is true.")
+	flag.StringVar(&encryptionKeys, "encryption-keys", "", "File of AES keys to encrypt values in L1 with AES-GCM, one per line as a version and a hex encoded 16, 24 or 32 byte key. New values use the highest version and values written with any key in the file can be read. Only used if --chunked is true.")
 	flag.BoolVar(&l1inmem, "l1-inmem", false, "Use the debug in-memory in-process L1 cache")
-	flag.StringVar(&l1sock, "l1-sock", "invalid.sock", "Specifies the unix socket to connect to L1")
+	flag.BoolVar(&l1null, "l1-null", false, "Use an L1 that stores nothing and misses every get, for load testing the proxy itself")
+	flag.StringVar(&l1sock, "l1-sock", "invalid.sock", "Specifies the unix socket or host:port to connect to L1")
+	flag.StringVar(&l1backends, "l1-backends", "", "Comma separated list of memcached servers (host:port or a unix socket path) to shard L1 across with consistent hashing. Overrides --l1-sock. Cannot be used with --chunked.")
+	flag.IntVar(&l1backendsRefreshSec, "l1-backends-refresh-sec", 0, "Resolve the hostnames in --l1-backends again this often, adding and removing servers as their addresses change. 0 resolves them once at startup.")
+	flag.StringVar(&l1elasticache, "l1-elasticache", "", "host:port of the configuration endpoint of an AWS ElastiCache memcached cluster. L1 is sharded across the nodes of the cluster, which are tracked as they change. Overrides --l1-sock. Cannot be used with --chunked.")
+	flag.IntVar(&l1elasticacheRefreshSec, "l1-elasticache-refresh-sec", 60, "How often to ask --l1-elasticache for the nodes in the cluster")
+	flag.StringVar(&l1consulService, "l1-consul-service", "", "Shard L1 across the healthy instances of this Consul service, tracking them as they change. The ACL token is read from CONSUL_HTTP_TOKEN. Overrides --l1-sock. Cannot be used with --chunked.")
+	flag.StringVar(&l1consulAddr, "l1-consul-addr", "http://127.0.0.1:8500", "Base URL of the Consul agent for --l1-consul-service")
+	flag.StringVar(&l1consulTag, "l1-consul-tag", "", "Only use instances of --l1-consul-service with this tag")
+	flag.StringVar(&l1etcdPrefix, "l1-etcd-prefix", "", "Shard L1 across the servers whose host:port is stored under this key prefix in etcd, tracking them as they change. Overrides --l1-sock. Cannot be used with --chunked.")
+	flag.StringVar(&l1etcdEndpoint, "l1-etcd-endpoint", "http://127.0.0.1:2379", "Base URL of the etcd server for --l1-etcd-prefix")
+	flag.IntVar(&l1discoveryRefreshSec, "l1-discovery-refresh-sec", 10, "How often to ask Consul or etcd for the L1 servers")
+
+	flag.StringVar(&l1replicas, "l1-replicas", "", "Comma separated list of unix sockets of memcached servers that all hold the same L1 data. Writes go to all of them and reads to the first one that works. Overrides --l1-sock.")
+	flag.StringVar(&l3sock, "l3-sock", "", "Socket of a memcached that is a third tier under L2, e.g. a remote cache behind a local L2. Writes reach it before L2 and gets that miss L2 read it. Only used if --l2-enabled is true.")
+	flag.StringVar(&l2promote, "l2-promote", "set", "How values found in --l3-sock are stored in L2. set sets them, add only adds them so a newer value isn't overwritten, and none leaves L2 alone.")
+	flag.StringVar(&l1routesSpec, "l1-routes", "", "Comma separated list of prefix=socket pairs. Keys that start with a prefix go to the L1 memcached at its socket instead of --l1-sock. When prefixes overlap the longest one wins.")
+	flag.StringVar(&l2routesSpec, "l2-routes", "", "Comma separated list of prefix=socket pairs, the same as --l1-routes for L2. Only used if --l2-enabled is true.")
+	flag.StringVar(&routeMaxTTLSpec, "route-max-ttl", "", "Comma separated list of prefix=seconds pairs that cap the TTL of the keys with a prefix in both tiers. Keys stored without a TTL get the cap.")
+	flag.IntVar(&l1writeQuorum, "l1-write-quorum", 0, "Number of --l1-replicas that must store a write for it to succeed. If this or --l1-read-quorum is set, every request goes to all of the replicas. 0 means any one replica.")
+	flag.IntVar(&l1readQuorum, "l1-read-quorum", 0, "Number of --l1-replicas that must give the same answer to a read for it to be returned. Keys they don't agree on are misses. 0 means the first replica that works.")
+	flag.IntVar(&hotKeyThreshold, "hot-key-threshold", 0, "Requests a second that make a key hot. The values of hot keys are served from memory in the proxy so one L1 connection isn't swamped by them. 0 turns hot key detection off.")
+	flag.IntVar(&hotKeySampleRate, "hot-key-sample-rate", 100, "Count one in this many keys requested when looking for hot keys")
+	flag.IntVar(&hotKeyTTLMs, "hot-key-ttl-ms", 1000, "How long the value of a hot key is served from memory before L1 is read again. Writes that don't go through this proxy can be missed for this long.")
+	flag.IntVar(&hotKeyMax, "hot-key-max", 1000, "Most keys that are hot at once. The busiest ones are kept.")
+	flag.IntVar(&l1readTimeoutMs, "l1-read-timeout-ms", 0, "Longest L1 may take to answer before its connection is closed and the request fails with a timeout. 0 means no limit.")
+	flag.IntVar(&l1writeTimeoutMs, "l1-write-timeout-ms", 0, "Longest a write of a request to L1 may take. 0 means no limit.")
+	flag.IntVar(&l2readTimeoutMs, "l2-read-timeout-ms", 0, "Same as --l1-read-timeout-ms, for L2")
+	flag.IntVar(&l2writeTimeoutMs, "l2-write-timeout-ms", 0, "Same as --l1-write-timeout-ms, for L2")
+
+	flag.BoolVar(&l1tls, "l1-tls", false, "Connect to L1 over TLS")
+	flag.StringVar(&l1tlsCA, "l1-tls-ca", "", "CA certificates file used to verify L1. The system roots are used if empty.")
+	flag.StringVar(&l1tlsServerName, "l1-tls-server-name", "", "Server name sent for SNI and checked against the L1 certificate. Defaults to the host in the L1 address.")
+	flag.BoolVar(&l2tls, "l2-tls", false, "Connect to L2 over TLS")
+	flag.StringVar(&l2tlsCA, "l2-tls-ca", "", "Same as --l1-tls-ca, for L2")
+	flag.StringVar(&l2tlsServerName, "l2-tls-server-name", "", "Same as --l1-tls-server-name, for L2")
+	flag.IntVar(&retries, "retries", 0, "Retry gets, touches and deletes to L1 and L2 up to this many times when they fail with a transient error. Disabled if 0.")
+	flag.IntVar(&retryBackoffMs, "retry-backoff-ms", 20, "Average wait in milliseconds before the first retry. Doubles on each retry.")
+	flag.StringVar(&namespace, "namespace", "", "Prefix put in front of every key stored in L1 and L2, so several instances can share the same backends. flush_all is refused when set.")
+	flag.IntVar(&poolSize, "pool-size", 0, "Share a pool of at most this many connections to each of L1 and L2 between all clients instead of opening new ones for each client. Disabled if 0.")
+	flag.IntVar(&muxConns, "backend-mux-conns", 0, "Pipeline the requests of all clients over this many connections to each memcached backend instead of opening new ones for each client. Not used for a chunked L1. Disabled if 0.")
 
 	flag.BoolVar(&l2enabled, "l2-enabled", false, "Specifies if l2 is enabled")
-	flag.StringVar(&l2sock, "l2-sock", "invalid.sock", "Specifies the unix socket to connect to L2. Only used if --l2-enabled is true.")
+	flag.StringVar(&l2sock, "l2-sock", "invalid.sock", "Specifies the unix socket or host:port to connect to L2. Only used if --l2-enabled is true.")
+	flag.BoolVar(&l2null, "l2-null", false, "Use an L2 that stores nothing and misses every get instead of connecting to --l2-sock. Only used if --l2-enabled is true.")
+	flag.BoolVar(&l2breaker, "l2-breaker", false, "Put a circuit breaker in front of L2. While it is open, requests are served from L1 alone. Only used if --l2-enabled is true.")
+	flag.Float64Var(&l2breakerErrorRate, "l2-breaker-error-rate", 0.5, "Fraction of failed L2 requests in a 10 second window that opens the breaker")
+	flag.IntVar(&l2breakerSlowMs, "l2-breaker-slow-ms", 0, "L2 requests slower than this many milliseconds count as failures for the breaker. Disabled if 0.")
+	flag.IntVar(&l2breakerOpenMs, "l2-breaker-open-ms", 5000, "Milliseconds the breaker stays open before probing L2 again")
+	flag.StringVar(&l2diskPath, "l2-disk-path", "", "Keep L2 in this file on local disk instead of connecting to --l2-sock, so it survives restarts. Only used if --l2-enabled is true.")
+	flag.Uint64Var(&l2diskMaxBytes, "l2-disk-max-bytes", 0, "Most data kept in --l2-disk-path before the least recently used items are evicted. 0 means no limit.")
+	flag.StringVar(&l2ssdPath, "l2-ssd-path", "", "Keep L2 in a preallocated file on an SSD, evicting the oldest data first. Suited to very large values. Only used if --l2-enabled is true.")
+	flag.Int64Var(&l2ssdSize, "l2-ssd-size", 1024*1024*1024, "Size in bytes of the file at --l2-ssd-path")
+
+	flag.StringVar(&spillBucket, "spill-s3-bucket", "", "Store values larger than --spill-threshold in this S3 bucket and keep only a record pointing at them in L1. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Disabled if empty.")
+	flag.IntVar(&spillThreshold, "spill-threshold", 512*1024, "Largest value in bytes kept in L1 when --spill-s3-bucket is set")
+	flag.StringVar(&spillEndpoint, "spill-s3-endpoint", "https://s3.amazonaws.com", "Base URL of the S3 compatible service for --spill-s3-bucket")
+	flag.StringVar(&spillRegion, "spill-s3-region", "us-east-1", "Region used to sign requests for --spill-s3-bucket")
+	flag.StringVar(&spillPrefix, "spill-s3-prefix", "", "Prefix for the names of objects written to --spill-s3-bucket")
+	flag.BoolVar(&spillBackfill, "spill-backfill", false, "Store values read from --spill-s3-bucket back in L1 in full. L1 must be able to hold them, e.g. with --chunked.")
 
 	flag.BoolVar(&locked, "locked", false, "Add locking to overall operations (above L1/L2 layers)")
 	flag.IntVar(&concurrency, "concurrency", 8, "Concurrency level. 2^(concurrency) parallel operations permitted, assuming no collisions. Large values (>16) are likely useless and will eat up RAM. Default of 8 means 256 operations (on different keys) can happen in parallel.")
@@ -86,29 +379,685 @@ func init() {
 
 	flag.IntVar(&port, "p", 11211, "External port to listen on")
 	flag.IntVar(&batchPort, "bp", 11212, "External port to listen on for batch systems")
+	flag.StringVar(&bindHost, "bind-host", "", "Host name, IP address or network interface the TCP ports are bound to. Every interface if empty.")
+	flag.StringVar(&ipVersion, "ip-version", "dual", "IP versions the TCP ports accept connections over: dual, 4 or 6")
 	flag.BoolVar(&useDomainSocket, "use-domain-socket", false, "Listen on a domain socket instead of a TCP port. --port will be ignored.")
-	flag.StringVar(&sockPath, "sock-path", "/tmp/invalid.sock", "The socket path to listen on. Only valid in conjunction with --use-domain-socket.")
+	flag.StringVar(&sockPath, "sock-path", "/tmp/invalid.sock", "The socket path to listen on. Only valid in conjunction with --use-domain-socket. A path starting with @ is a socket in the abstract namespace on Linux.")
+	flag.StringVar(&sockMode, "sock-mode", "", "Octal permissions of the socket file, like 0660. Left to the umask if empty.")
+	flag.StringVar(&sockOwner, "sock-owner", "", "User that owns the socket file, by name or ID. Left as is if empty.")
+	flag.StringVar(&sockGroup, "sock-group", "", "Group that owns the socket file, by name or ID. Left as is if empty.")
+
+	flag.BoolVar(&leasesEnabled, "leases", false, "Give a lease to the first meta get with the N flag that misses a key, and make the others that miss it wait for the key to be set. The lease holder is told with the W flag and the others with the Z flag.")
+	flag.IntVar(&leaseWaitMs, "lease-wait-ms", 50, "Longest a get waits for a key another client holds the lease on to be set, for --leases")
+	flag.StringVar(&sigSecret, "sig-secret", "", "Shared secret used to verify HMAC signatures on mutations. Signing is disabled if empty.")
+	flag.IntVar(&sigWindow, "sig-window", 60, "Length in seconds of the expiry window for request signatures. Only used if --sig-secret is set.")
+
+	flag.StringVar(&orcaName, "orca", "", "Name of the orca that orchestrates requests between L1 and L2 on the main and HTTP listeners. Orcas are registered with orcas.Register, and l1only, l1l2 and l1l2batch are built in. If empty, l1l2 is used when L2 is enabled and l1only otherwise.")
+	flag.StringVar(&batchOrcaName, "batch-orca", "l1l2batch", "Name of the orca used on the batch listener. Only used if --l2-enabled is true.")
+	flag.StringVar(&writePolicy, "write-policy", "through", "Which tiers sets are written to. through writes L2 and then L1 before responding, around writes only L2 and deletes the key from L1, and back writes L1, responds, and writes L2 in the background. Adds, replaces, appends and prepends are always written through. Only used if --l2-enabled is true.")
+	flag.IntVar(&writeBackWorkers, "write-back-workers", 4, "Number of connections to L2 that write sets in the background for --write-policy=back")
+	flag.IntVar(&writeBackQueue, "write-back-queue", 10000, "Number of sets that can wait to be written to L2 for --write-policy=back. When it is full, sets are written to L2 before responding.")
+	flag.IntVar(&writeBackMaxMB, "write-back-max-mb", 0, "Most megabytes of keys and data that can wait to be written to L2 for --write-policy=back. When it is full, sets are written to L2 before responding. 0 means only --write-back-queue limits it.")
+	flag.IntVar(&writeBackRetries, "write-back-retries", 3, "How many more times a background write to L2 that failed with an I/O error or a temporary failure is tried before it is dropped, for --write-policy=back")
+	flag.IntVar(&writeBackBackoff, "write-back-backoff-ms", 50, "Wait before the first retry of a background write to L2. It doubles each retry.")
+	flag.BoolVar(&l1backfillAsync, "l1-backfill-async", false, "Put values that miss L1 and hit L2 back into L1 in the background instead of before responding. Only used if --l2-enabled is true and --orca is not set.")
+	flag.IntVar(&l1backfillWorkers, "l1-backfill-workers", 4, "Number of connections to L1 that backfill values in the background for --l1-backfill-async")
+	flag.IntVar(&l1backfillQueue, "l1-backfill-queue", 10000, "Number of values that can wait to be backfilled into L1 for --l1-backfill-async. When it is full, values are not backfilled.")
+	flag.IntVar(&l1maxTTL, "l1-max-ttl", 0, "Longest TTL in seconds of the items stored in L1, including the ones copied from L2. Items stored without a TTL get this one. 0 means no cap.")
+	flag.IntVar(&l1TTLOverride, "l1-ttl-override", 0, "TTL in seconds that replaces the one clients give for the items stored in L1. 0 keeps the client's TTL.")
+	flag.IntVar(&l2maxTTL, "l2-max-ttl", 0, "Same as --l1-max-ttl, for L2")
+	flag.IntVar(&l2TTLOverride, "l2-ttl-override", 0, "Same as --l1-ttl-override, for L2")
+	flag.Float64Var(&earlyRefreshPercent, "early-refresh-percent", 0, "How much of --early-refresh-ttl-sec, at the end of an item's life, gets can be answered as misses so a client refreshes the item before it expires. 0 disables early refresh.")
+	flag.IntVar(&earlyRefreshTTLSec, "early-refresh-ttl-sec", 0, "TTL in seconds that clients set items with, for --early-refresh-percent")
+	flag.Float64Var(&earlyRefreshProbability, "early-refresh-probability", 0.01, "Chance that a get of an item about to expire is answered as a miss for --early-refresh-percent")
+	flag.BoolVar(&l2coalesce, "l2-coalesce", false, "Share one L2 fetch between connections that miss L1 on the same key at the same time. Only used if --l2-enabled is true.")
+	flag.Float64Var(&shadowPercent, "shadow-percent", 0, "Serve everything from L1 and mirror the requests for this percent of the keys to L2 in the background, comparing its answers with L1's in the shadow_* metrics. Used to qualify a new L2 without clients seeing it. 0 disables shadowing. Only used if --l2-enabled is true.")
+	flag.IntVar(&shadowWorkers, "shadow-workers", 4, "Number of connections to L2 that replay mirrored requests for --shadow-percent")
+	flag.IntVar(&shadowQueue, "shadow-queue", 10000, "Number of mirrored requests that can wait to be replayed for --shadow-percent. When it is full, requests are not mirrored.")
+	flag.Float64Var(&readRepairPercent, "read-repair-percent", 0, "Percent of L1 hits that are checked against L2 in the background. Values that differ or are missing from L2 are deleted from L1 and counted in the read_repair_* metrics. 0 disables read repair. Only used if --l2-enabled is true.")
+	flag.IntVar(&readRepairWorkers, "read-repair-workers", 4, "Number of connections to each tier used for --read-repair-percent")
+	flag.IntVar(&readRepairQueue, "read-repair-queue", 10000, "Number of gets that can wait to be checked for --read-repair-percent. When it is full, hits are not checked.")
+	flag.StringVar(&oomPolicy, "oom-policy", "passthrough", "How to handle out of memory or temporary failure errors from the backend on stores. One of passthrough, retry, fallback, or tempfail.")
+	flag.IntVar(&oomRetries, "oom-retries", 3, "Number of retries for --oom-policy=retry")
+	flag.IntVar(&oomBackoffMs, "oom-backoff-ms", 10, "Initial backoff in milliseconds for --oom-policy=retry. Doubles on each retry.")
+
+	flag.StringVar(&saslCreds, "sasl-creds", "", "File of username:password lines. If given, binary connections to the main listener must authenticate with SASL PLAIN, text connections are refused and requests to the HTTP gateway must use basic auth with the same credentials.")
+	flag.StringVar(&batchSASLCreds, "batch-sasl-creds", "", "Same as --sasl-creds, for the batch listener")
+
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file. If given, all listeners only accept TLS connections. Send SIGHUP to reload the certificate and key.")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file. Required with --tls-cert.")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA certificates file. If given, TLS clients must present a certificate signed by one of them.")
+
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol (v1 or v2) header at the start of each connection, as sent by HAProxy and other load balancers")
+
+	flag.IntVar(&httpPort, "http-port", 0, "External port for the HTTP gateway, which serves GET, PUT and DELETE on /cache/{key}. Disabled if 0.")
+
+	flag.IntVar(&maxValueSize, "max-value-size", 1024*1024, "Largest value in bytes accepted from clients. Larger values are rejected with an object too large error. 0 means no limit.")
+
+	flag.BoolVar(&auditBinary, "audit-binary", false, "Check that every binary protocol response has the opaque of its request and valid data type and CAS fields. Violations are logged and counted in the binary_audit_* metrics.")
+
+	flag.StringVar(&statsdAddr, "statsd-addr", "", "host:port of a StatsD agent to send metrics to, for setups that don't scrape the metrics endpoint. Disabled if empty.")
+	flag.BoolVar(&statsdDogStatsD, "statsd-dogstatsd", false, "Send metric tags in the DogStatsD format to --statsd-addr instead of adding them to the metric names")
+	flag.StringVar(&statsdTags, "statsd-tags", "", "Comma separated list of key:value tags added to every metric sent to --statsd-addr. Needs --statsd-dogstatsd.")
+	flag.IntVar(&statsdIntervalSec, "statsd-interval-sec", 10, "How often metrics are sent to --statsd-addr")
+
+	flag.StringVar(&hitPrefixes, "hit-prefixes", "", "Comma separated list of key prefixes whose hits and misses in each tier are counted separately in stats and the prefix_hits_* and prefix_misses_* metrics. Keys are counted under the longest prefix they start with.")
+
+	flag.IntVar(&topKeysSampleRate, "top-keys-sample-rate", 0, "Count one in this many keys of each command to find the busiest keys, shown with \"stats topkeys\". 0 turns it off.")
+	flag.IntVar(&topKeysSize, "top-keys", 20, "Number of the busiest keys shown for each command by \"stats topkeys\"")
+	flag.IntVar(&topKeysHalfLifeSec, "top-keys-half-life-sec", 60, "How often the counts behind \"stats topkeys\" are halved, so keys that are no longer busy drop out")
+
+	flag.IntVar(&flightRecorder, "flight-recorder", 0, "Number of the most recent requests kept in memory with their command, key hash, sizes, latency and result. They are served as JSON at /admin/requests on the metrics port. 0 turns it off.")
+
+	flag.StringVar(&accessLogPath, "access-log", "", "File that a JSON line is appended to for each request, with its command, key hash, sizes, latency, result and client address. Disabled if empty.")
+	flag.IntVar(&accessLogSampleRate, "access-log-sample-rate", 1, "Write one in this many requests to --access-log")
+	flag.BoolVar(&accessLogKeys, "access-log-keys", false, "Write keys to --access-log instead of only their hashes")
+	flag.IntVar(&accessLogQueue, "access-log-queue", 10000, "Number of --access-log lines that can wait to be written. When it is full, lines are dropped and counted in access_log_dropped.")
+
+	flag.BoolVar(&logJSON, "log-json", false, "Write logs as one JSON object per line instead of key=value pairs")
+	flag.StringVar(&logLevel, "log-level", "info", "Lowest level that is logged. One of debug, info, warn or error. Can be changed while running at /admin/log on the metrics port.")
+	flag.StringVar(&logLevels, "log-levels", "", "Comma separated list of subsystem=level pairs for subsystems that log at a different level than --log-level, e.g. server=debug")
+
+	flag.IntVar(&maxConns, "max-conns", 0, "Maximum number of client connections open across all listeners. Connections beyond it are accepted and immediately closed. 0 means no limit.")
+	flag.IntVar(&listenerMaxConns, "listener-max-conns", 0, "Maximum number of client connections open on each listener. 0 means no limit.")
+	flag.IntVar(&idleTimeoutSec, "idle-timeout-sec", 0, "Seconds a client connection can go without sending anything before it's closed. 0 means idle connections are never closed.")
+	flag.IntVar(&maxConnRequests, "max-conn-requests", 0, "Requests after which a client connection is closed, once the last one is answered, so clients reconnect and spread out across a fleet. 0 means no limit.")
+	flag.IntVar(&maxConnAgeSec, "max-conn-age-sec", 0, "Seconds after which a client connection is closed between requests, for the same reason as --max-conn-requests. 0 means no limit.")
+	flag.IntVar(&requestTimeoutMs, "request-timeout-ms", 0, "Longest a request may wait on the backends. A backend that takes longer has its connection closed and the client gets a SERVER_ERROR. 0 means no limit. Cannot be used with a sharded or replicated L1, with a disk or SSD L2 or with --backend-mux-conns.")
+	flag.IntVar(&shutdownTimeoutSec, "shutdown-timeout-sec", 10, "Seconds open connections get to finish their requests after a SIGTERM before they're closed")
+	flag.StringVar(&adminAddr, "admin-addr", "localhost:11299", "Address of the admin HTTP port, with pprof, /metrics, /healthz, /readyz, /admin/config, /admin/maintenance and the other /admin endpoints. Disabled if empty.")
+	flag.BoolVar(&healthCheckL1, "health-check-l1", false, "Make /readyz set, get and delete a key in L1, so the proxy is taken out of rotation when L1 is down")
+	flag.BoolVar(&healthCheckL2, "health-check-l2", false, "Same as --health-check-l1, for L2. Only used if --l2-enabled is true.")
+	flag.StringVar(&healthCheckKey, "health-check-key", "", "Key the health checks write to. Defaults to rend:health: followed by the hostname, so instances sharing backends don't step on each other.")
+	flag.IntVar(&healthCheckTimeoutMs, "health-check-timeout-ms", 500, "Time in milliseconds a health check may take before the tier counts as down")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "Most requests per second the proxy takes across all listeners, with bursts of up to a second's worth. Requests that only the proxy answers, like version, aren't counted. 0 means no limit.")
+	flag.Float64Var(&listenerRateLimit, "listener-rate-limit", 0, "Same as --rate-limit, for each listener")
+	flag.Float64Var(&clientRateLimit, "client-rate-limit", 0, "Same as --rate-limit, for each client IP")
+	flag.IntVar(&rateLimitWaitMs, "rate-limit-wait-ms", 0, "Longest a request over a rate limit waits for its turn. Requests that would wait longer get SERVER_ERROR busy.")
+	flag.StringVar(&allowCIDRs, "allow-cidrs", "", "Comma separated list of networks, like 10.0.0.0/8, that clients may connect from. Clients from anywhere may connect if empty.")
+	flag.StringVar(&denyCIDRs, "deny-cidrs", "", "Comma separated list of networks that clients may not connect from, even if they're in --allow-cidrs")
+	flag.IntVar(&tcpKeepAliveSec, "tcp-keepalive-sec", 0, "Seconds between TCP keepalive probes on client connections. 0 uses 30 seconds and a negative value turns keepalive off.")
+	flag.BoolVar(&tcpNagle, "tcp-nagle", false, "Turn Nagle's algorithm back on for client connections, batching small writes at the cost of latency")
+	flag.IntVar(&tcpReadBuffer, "tcp-read-buffer", 0, "Size in bytes of the socket receive buffer of client connections. 0 leaves the OS default.")
+	flag.IntVar(&tcpWriteBuffer, "tcp-write-buffer", 0, "Size in bytes of the socket send buffer of client connections. 0 leaves the OS default.")
+	flag.IntVar(&backendTCPKeepAliveSec, "backend-tcp-keepalive-sec", 0, "Same as --tcp-keepalive-sec, for connections to memcached backends over TCP")
+	flag.BoolVar(&backendTCPNagle, "backend-tcp-nagle", false, "Same as --tcp-nagle, for connections to memcached backends over TCP")
+	flag.IntVar(&backendTCPReadBuffer, "backend-tcp-read-buffer", 0, "Same as --tcp-read-buffer, for connections to memcached backends over TCP")
+	flag.IntVar(&backendTCPWriteBuffer, "backend-tcp-write-buffer", 0, "Same as --tcp-write-buffer, for connections to memcached backends over TCP")
+	flag.StringVar(&flushPolicy, "flush-policy", "both", "Which tiers flush_all is sent to. One of both, l1, or l2.")
 
 	flag.Parse()
 
+	logging.Configure(os.Stderr, logJSON)
+	level, err := logging.ParseLevel(logLevel)
+	if err != nil {
+		panic(err.Error())
+	}
+	logging.SetDefaultLevel(level)
+	if err := logging.SetLevels(logLevels); err != nil {
+		panic(err.Error())
+	}
+
 	if concurrency >= 64 {
 		panic("Concurrency cannot be more than 2^64")
 	}
+
+	if l2diskPath != "" && l2ssdPath != "" {
+		panic("Only one of --l2-disk-path and --l2-ssd-path can be used")
+	}
+
+	if l1backends != "" && chunked {
+		panic("Sharded L1 backends cannot be used with --chunked")
+	}
+
+	if l1backends != "" && l1replicas != "" {
+		panic("Only one of --l1-backends and --l1-replicas can be used")
+	}
+
+	switch l2promote {
+	case "set":
+		l2promotion = handlers.PromoteSet
+	case "add":
+		l2promotion = handlers.PromoteAdd
+	case "none":
+		l2promotion = handlers.PromoteNone
+	default:
+		panic("Unknown L2 promotion policy " + l2promote)
+	}
+	if l3sock != "" && !l2enabled {
+		panic("--l3-sock only works with --l2-enabled")
+	}
+
+	l1routes = parseRoutes("--l1-routes", l1routesSpec)
+	l2routes = parseRoutes("--l2-routes", l2routesSpec)
+	routeMaxTTLs = parseRoutes("--route-max-ttl", routeMaxTTLSpec)
+	for prefix, ttl := range routeMaxTTLs {
+		if n, err := strconv.ParseUint(ttl, 10, 32); err != nil || n == 0 {
+			panic("--route-max-ttl for " + prefix + " must be a positive number of seconds")
+		}
+	}
+	if len(l2routes) > 0 && (!l2enabled || l2null || l2diskPath != "" || l2ssdPath != "") {
+		panic("--l2-routes only works with a memcached L2")
+	}
+
+	if l1writeQuorum != 0 || l1readQuorum != 0 {
+		n := len(strings.Split(l1replicas, ","))
+		if l1replicas == "" {
+			panic("--l1-write-quorum and --l1-read-quorum only work with --l1-replicas")
+		}
+		if l1writeQuorum < 1 || l1writeQuorum > n || l1readQuorum < 1 || l1readQuorum > n {
+			panic("--l1-write-quorum and --l1-read-quorum must both be between 1 and the number of --l1-replicas")
+		}
+	}
+
+	if hotKeyThreshold < 0 {
+		panic("--hot-key-threshold must not be negative")
+	}
+	if hotKeyThreshold > 0 && (hotKeySampleRate < 1 || hotKeyTTLMs < 1 || hotKeyMax < 1) {
+		panic("--hot-key-sample-rate, --hot-key-ttl-ms and --hot-key-max must be positive")
+	}
+
+	if l1elasticache != "" && (chunked || l1backends != "" || l1replicas != "") {
+		panic("--l1-elasticache cannot be used with --chunked, --l1-backends or --l1-replicas")
+	}
+
+	if l1elasticache != "" && l1elasticacheRefreshSec <= 0 {
+		panic("ElastiCache refresh interval must be positive")
+	}
+
+	if l1consulService != "" || l1etcdPrefix != "" {
+		if l1consulService != "" && l1etcdPrefix != "" {
+			panic("Only one of --l1-consul-service and --l1-etcd-prefix can be used")
+		}
+		if chunked || l1backends != "" || l1replicas != "" || l1elasticache != "" {
+			panic("Consul and etcd discovery cannot be used with --chunked, --l1-backends, --l1-replicas or --l1-elasticache")
+		}
+		if l1discoveryRefreshSec <= 0 {
+			panic("Discovery refresh interval must be positive")
+		}
+	}
+
+	if sigWindow <= 0 {
+		panic("Signature window must be positive")
+	}
+
+	switch oomPolicy {
+	case "passthrough":
+		oomConf.Policy = orcas.OOMPassthrough
+	case "retry":
+		oomConf.Policy = orcas.OOMRetry
+	case "fallback":
+		oomConf.Policy = orcas.OOMFallback
+	case "tempfail":
+		oomConf.Policy = orcas.OOMTempFailure
+	default:
+		panic("Unknown OOM policy " + oomPolicy)
+	}
+
+	switch flushPolicy {
+	case "both":
+		flushPol = orcas.FlushBoth
+	case "l1":
+		flushPol = orcas.FlushL1Only
+	case "l2":
+		flushPol = orcas.FlushL2Only
+	default:
+		panic("Unknown flush policy " + flushPolicy)
+	}
+
+	switch writePolicy {
+	case "through":
+		writeConf.Policy = orcas.WriteThrough
+	case "around":
+		writeConf.Policy = orcas.WriteAround
+	case "back":
+		writeConf.Policy = orcas.WriteBack
+		if writeBackWorkers <= 0 {
+			panic("--write-back-workers must be positive")
+		}
+		if writeBackMaxMB < 0 || writeBackRetries < 0 || writeBackBackoff < 0 {
+			panic("--write-back-max-mb, --write-back-retries and --write-back-backoff-ms must not be negative")
+		}
+	default:
+		panic("Unknown write policy " + writePolicy)
+	}
+	if writeConf.Policy != orcas.WriteThrough && !l2enabled {
+		panic("--write-policy only works with --l2-enabled")
+	}
+	if l1backfillAsync {
+		if !l2enabled {
+			panic("--l1-backfill-async only works with --l2-enabled")
+		}
+		if l1backfillWorkers <= 0 {
+			panic("--l1-backfill-workers must be positive")
+		}
+	}
+
+	if l2coalesce && !l2enabled {
+		panic("--l2-coalesce only works with --l2-enabled")
+	}
+	if shadowPercent < 0 || shadowPercent > 100 {
+		panic("--shadow-percent must be between 0 and 100")
+	}
+	if shadowPercent > 0 {
+		if !l2enabled {
+			panic("--shadow-percent only works with --l2-enabled")
+		}
+		if orcaName != "" || writeConf.Policy != orcas.WriteThrough || l1backfillAsync {
+			panic("--shadow-percent can't be used with --orca, --write-policy or --l1-backfill-async")
+		}
+		if shadowWorkers <= 0 {
+			panic("--shadow-workers must be positive")
+		}
+	}
+	if leasesEnabled && leaseWaitMs < 0 {
+		panic("--lease-wait-ms must not be negative")
+	}
+	if statsdAddr != "" && statsdIntervalSec <= 0 {
+		panic("--statsd-interval-sec must be positive")
+	}
+	if statsdTags != "" && !statsdDogStatsD {
+		panic("--statsd-tags only works with --statsd-dogstatsd")
+	}
+	if readRepairPercent < 0 || readRepairPercent > 100 {
+		panic("--read-repair-percent must be between 0 and 100")
+	}
+	if readRepairPercent > 0 {
+		if !l2enabled || shadowPercent > 0 {
+			panic("--read-repair-percent only works with --l2-enabled and without --shadow-percent")
+		}
+		if readRepairWorkers <= 0 {
+			panic("--read-repair-workers must be positive")
+		}
+	}
+	if accessLogPath != "" && (accessLogSampleRate < 1 || accessLogQueue < 1) {
+		panic("--access-log-sample-rate and --access-log-queue must be positive")
+	}
+	if flightRecorder < 0 {
+		panic("--flight-recorder must not be negative")
+	}
+	if topKeysSampleRate < 0 {
+		panic("--top-keys-sample-rate must not be negative")
+	}
+	if topKeysSampleRate > 0 && (topKeysSize < 1 || topKeysHalfLifeSec < 1) {
+		panic("--top-keys and --top-keys-half-life-sec must be positive")
+	}
+	if maxConns < 0 || listenerMaxConns < 0 {
+		panic("--max-conns and --listener-max-conns must not be negative")
+	}
+	server.MaxTotalConns = maxConns
+	if idleTimeoutSec < 0 {
+		panic("--idle-timeout-sec must not be negative")
+	}
+	if maxConnRequests < 0 || maxConnAgeSec < 0 {
+		panic("--max-conn-requests and --max-conn-age-sec must not be negative")
+	}
+	if rateLimit < 0 || listenerRateLimit < 0 || clientRateLimit < 0 || rateLimitWaitMs < 0 {
+		panic("--rate-limit, --listener-rate-limit, --client-rate-limit and --rate-limit-wait-ms must not be negative")
+	}
+	server.GlobalRateLimit = perSecond(rateLimit)
+	server.ClientRateLimit = perSecond(clientRateLimit)
+	server.RateLimitWait = time.Duration(rateLimitWaitMs) * time.Millisecond
+	if shutdownTimeoutSec < 0 {
+		panic("--shutdown-timeout-sec must not be negative")
+	}
+	if requestTimeoutMs < 0 {
+		panic("--request-timeout-ms must not be negative")
+	}
+	// Only the handlers that connect to a single memcached and reconnect on their own can close a
+	// backend connection that is past the deadline
+	if requestTimeoutMs > 0 && !l1inmem && !l1null &&
+		(l1backends != "" || l1elasticache != "" || l1consulService != "" || l1etcdPrefix != "" || l1replicas != "") {
+		panic("--request-timeout-ms cannot be used with a sharded or replicated L1")
+	}
+	if requestTimeoutMs > 0 && l2enabled && !l2null && (l2diskPath != "" || l2ssdPath != "") {
+		panic("--request-timeout-ms cannot be used with --l2-disk-path or --l2-ssd-path")
+	}
+	// Multiplexed connections are shared by every client, so one request can't close them
+	if requestTimeoutMs > 0 && muxConns > 0 {
+		panic("--request-timeout-ms cannot be used with --backend-mux-conns")
+	}
+	server.RequestTimeout = time.Duration(requestTimeoutMs) * time.Millisecond
+	if healthCheckTimeoutMs <= 0 {
+		panic("--health-check-timeout-ms must be positive")
+	}
+	if healthCheckKey == "" {
+		host, _ := os.Hostname()
+		healthCheckKey = "rend:health:" + host
+	}
+	if earlyRefreshPercent < 0 || earlyRefreshPercent > 100 {
+		panic("--early-refresh-percent must be between 0 and 100")
+	}
+	if earlyRefreshPercent > 0 && earlyRefreshTTLSec <= 0 {
+		panic("--early-refresh-ttl-sec must be positive with --early-refresh-percent")
+	}
+	if earlyRefreshProbability < 0 || earlyRefreshProbability > 1 {
+		panic("--early-refresh-probability must be between 0 and 1")
+	}
+
+	for _, ttl := range []int{l1maxTTL, l1TTLOverride, l2maxTTL, l2TTLOverride} {
+		if ttl < 0 || ttl > common.MaxRelativeExptime {
+			panic("--l1-max-ttl, --l1-ttl-override, --l2-max-ttl and --l2-ttl-override must be between 0 and 30 days")
+		}
+	}
+
+	if tlsCert != "" && tlsKey == "" {
+		panic("--tls-key is required with --tls-cert")
+	}
+
+	if retries < 0 || retryBackoffMs < 0 {
+		panic("Retries and retry backoff must not be negative")
+	}
+
+	if oomRetries < 0 || oomBackoffMs < 0 {
+		panic("OOM retries and backoff must not be negative")
+	}
+
+	if l1readTimeoutMs < 0 || l1writeTimeoutMs < 0 || l2readTimeoutMs < 0 || l2writeTimeoutMs < 0 {
+		panic("Backend timeouts must not be negative")
+	}
+
+	if chunkSize < 0 || maxChunkSize < 0 {
+		panic("Chunk sizes must not be negative")
+	}
+
+	if streamSetMin < 0 {
+		panic("Stream sizes must not be negative")
+	}
+	if fetchConns < 0 {
+		panic("--chunk-fetch-conns must not be negative")
+	}
+	if janitorSec < 0 {
+		panic("--chunk-janitor-interval-sec must not be negative")
+	}
+	if streamSetMin > 0 && (!chunked || l1inmem || l1null || l1replicas != "" || l2enabled || spillBucket != "") {
+		panic("--stream-set-min-bytes only works with a single --chunked L1 and no L2 or spilling")
+	}
+
+	l1opts.ChunkSize = chunkSize
+	l1opts.MaxChunkSize = maxChunkSize
+	if compress {
+		l1opts.Codec = chunkedh.Flate
+		l1opts.CompressMin = compressMin
+	}
+	l1opts.Checksums = chunkChecksums
+	l1opts.StreamMin = streamMin
+	l1opts.FetchConns = fetchConns
+	l1opts.FetchMinChunks = fetchMinChunks
+	l1opts.Dedup = chunkDedup
+	if encryptionKeys != "" {
+		if !chunked {
+			panic("--encryption-keys only works with --chunked")
+		}
+		k, err := chunkedh.LoadKeyring(encryptionKeys)
+		if err != nil {
+			panic("Error loading encryption keys: " + err.Error())
+		}
+		l1opts.Keyring = k
+	}
+	l1opts.Timeouts.Read = time.Duration(l1readTimeoutMs) * time.Millisecond
+	l1opts.Timeouts.Write = time.Duration(l1writeTimeoutMs) * time.Millisecond
+	l2opts.Timeouts.Read = time.Duration(l2readTimeoutMs) * time.Millisecond
+	l2opts.Timeouts.Write = time.Duration(l2writeTimeoutMs) * time.Millisecond
+	if tcpReadBuffer < 0 || tcpWriteBuffer < 0 || backendTCPReadBuffer < 0 || backendTCPWriteBuffer < 0 {
+		panic("TCP buffer sizes must not be negative")
+	}
+	l1opts.TCP = tcpOptions(backendTCPKeepAliveSec, backendTCPNagle, backendTCPReadBuffer, backendTCPWriteBuffer)
+	l2opts.TCP = l1opts.TCP
+
+	if l1tls {
+		l1opts.TLS = backendTLS(l1tlsCA, l1tlsServerName)
+	}
+	if l2tls {
+		l2opts.TLS = backendTLS(l2tlsCA, l2tlsServerName)
+	}
+
+	oomConf.Retries = oomRetries
+	oomConf.Backoff = time.Duration(oomBackoffMs) * time.Millisecond
+
+	refreshConf = orcas.EarlyRefreshConfig{
+		TTL:         time.Duration(earlyRefreshTTLSec) * time.Second,
+		Percent:     earlyRefreshPercent,
+		Probability: earlyRefreshProbability,
+	}
+
+	ttlConf = orcas.TTLConfig{
+		L1: orcas.TierTTL{Max: uint32(l1maxTTL), Override: uint32(l1TTLOverride)},
+		L2: orcas.TierTTL{Max: uint32(l2maxTTL), Override: uint32(l2TTLOverride)},
+	}
 }
 
 // And away we go
+func loadCreds(path string) map[string]string {
+	if path == "" {
+		return nil
+	}
+
+	creds, err := server.LoadCredentials(path)
+	if err != nil {
+		panic("Error loading SASL credentials from " + path + ": " + err.Error())
+	}
+
+	return creds
+}
+
+func backendTLS(caFile, serverName string) *tls.Config {
+	conf, err := memcached.NewTLSConfig(caFile, serverName)
+	if err != nil {
+		panic("Error loading backend TLS CA certificates: " + err.Error())
+	}
+	return conf
+}
+
+// l1Const returns the constructor for handlers that talk to the L1 memcached at sock
+func l1Const(sock string) handlers.HandlerConst {
+	if chunked && chunkedPipelined {
+		return memcached.ChunkedPipelinedWithOptions(sock, l1opts)
+	} else if chunked {
+		return memcached.ChunkedWithOptions(sock, l1opts)
+	}
+	if muxConns > 0 {
+		return memcached.MultiplexedWithOptions(sock, muxConns, l1opts)
+	}
+	return memcached.RegularWithOptions(sock, l1opts)
+}
+
+// l2Const returns the constructor for handlers that talk to the L2 memcached at sock
+func l2Const(sock string) handlers.HandlerConst {
+	if muxConns > 0 {
+		return memcached.MultiplexedWithOptions(sock, muxConns, l2opts)
+	}
+	return memcached.RegularWithOptions(sock, l2opts)
+}
+
+// parseRoutes parses a comma separated list of prefix=value pairs, panicking on a malformed one
+func parseRoutes(name, spec string) map[string]string {
+	routes := make(map[string]string)
+	if spec == "" {
+		return routes
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			panic(name + " must be a comma separated list of prefix=value pairs, got " + pair)
+		}
+		routes[pair[:i]] = pair[i+1:]
+	}
+	return routes
+}
+
+// prefixRouted sends the keys of the prefixes in socks to handlers made by mk, with the same
+// decorators as the default handler hc, and caps their TTLs by routeMaxTTLs. It returns hc when
+// there are no routes.
+func prefixRouted(hc handlers.HandlerConst, socks map[string]string, mk func(sock string) handlers.HandlerConst, decorators []handlers.Decorator) handlers.HandlerConst {
+	var routes []handlers.PrefixRoute
+	for prefix, sock := range socks {
+		routes = append(routes, handlers.PrefixRoute{
+			Prefix:  prefix,
+			Handler: handlers.Chain(mk(sock), decorators...),
+		})
+	}
+	for prefix, ttl := range routeMaxTTLs {
+		maxTTL, _ := strconv.ParseUint(ttl, 10, 32)
+		found := false
+		for i := range routes {
+			if routes[i].Prefix == prefix {
+				routes[i].MaxTTL = uint32(maxTTL)
+				found = true
+			}
+		}
+		if !found {
+			routes = append(routes, handlers.PrefixRoute{Prefix: prefix, MaxTTL: uint32(maxTTL)})
+		}
+	}
+
+	if len(routes) == 0 {
+		return hc
+	}
+	return handlers.PrefixRouted(hc, routes)
+}
+
+// lookupOrca returns the orca registered with the name, panicking if there is none
+func lookupOrca(name string) orcas.OrcaConst {
+	oc, ok := orcas.Lookup(name)
+	if !ok {
+		panic("Unknown orca " + name + ", expected one of " + strings.Join(orcas.Names(), ", "))
+	}
+	return oc
+}
+
+// startJanitor starts sweeping the chunked L1 at sock for orphaned chunks, if enabled
+func startJanitor(sock string) {
+	if chunked && janitorSec > 0 {
+		memcached.StartChunkJanitor(sock, time.Duration(janitorSec)*time.Second, l1opts)
+	}
+}
+
+// tcpOptions makes the TCP options of connections from flags
+func tcpOptions(keepAliveSec int, nagle bool, readBuffer, writeBuffer int) common.TCPOptions {
+	return common.TCPOptions{
+		KeepAlive:   time.Duration(keepAliveSec) * time.Second,
+		Nagle:       nagle,
+		ReadBuffer:  readBuffer,
+		WriteBuffer: writeBuffer,
+	}
+}
+
+// perSecond is a rate limit of rate requests per second with bursts of up to a second's worth
+func perSecond(rate float64) server.RateLimit {
+	return server.RateLimit{Rate: rate, Burst: int(rate)}
+}
+
+// unixOptions makes the options for the socket file of a unix listener from the flags
+func unixOptions(mode, owner, group string) server.UnixOptions {
+	opts := server.UnixOptions{Owner: owner, Group: group}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			panic("--sock-mode must be octal permissions like 0660")
+		}
+		opts.Mode = os.FileMode(m)
+	}
+	return opts
+}
+
 func main() {
+	// http debug, metrics and admin endpoints
+	if adminAddr != "" {
+		admin.Redact("sig-secret", "encryption-keys")
+		go http.ListenAndServe(adminAddr, nil)
+	}
+
+	common.SetMaxValueSize(uint64(maxValueSize))
+	common.SetStreamValueSize(uint64(streamSetMin))
+
+	if statsdAddr != "" {
+		conf := metrics.StatsDConfig{
+			Addr:      statsdAddr,
+			DogStatsD: statsdDogStatsD,
+		}
+		if statsdTags != "" {
+			conf.Tags = strings.Split(statsdTags, ",")
+		}
+		s, err := metrics.NewStatsD(conf)
+		if err != nil {
+			panic("Error setting up StatsD: " + err.Error())
+		}
+		metrics.StartSink(s, time.Duration(statsdIntervalSec)*time.Second)
+	}
+
+	var accessLog orcas.RequestSink
+	if accessLogPath != "" {
+		f, err := os.OpenFile(accessLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			panic("Error opening access log: " + err.Error())
+		}
+		accessLog = orcas.NewAccessLog(f, orcas.AccessLogConfig{
+			SampleRate: accessLogSampleRate,
+			Keys:       accessLogKeys,
+			QueueSize:  accessLogQueue,
+		})
+	}
+
+	acl, err := server.ParseACL(allowCIDRs, denyCIDRs)
+	if err != nil {
+		panic("Error parsing --allow-cidrs or --deny-cidrs: " + err.Error())
+	}
+
+	var ipv server.IPVersion
+	switch ipVersion {
+	case "dual":
+		ipv = server.DualStack
+	case "4":
+		ipv = server.IPv4Only
+	case "6":
+		ipv = server.IPv6Only
+	default:
+		panic("--ip-version must be dual, 4 or 6")
+	}
+
 	var l server.ListenArgs
 
 	if useDomainSocket {
 		l = server.ListenArgs{
-			Type: server.ListenUnix,
-			Path: sockPath,
+			Type:          server.ListenUnix,
+			Path:          sockPath,
+			Unix:          unixOptions(sockMode, sockOwner, sockGroup),
+			Credentials:   loadCreds(saslCreds),
+			TLSCert:       tlsCert,
+			TLSKey:        tlsKey,
+			TLSClientCA:   tlsClientCA,
+			ProxyProtocol: proxyProtocol,
+			AuditBinary:   auditBinary,
+			AccessLog:     accessLog,
+			MaxConns:      listenerMaxConns,
+			IdleTimeout:   time.Duration(idleTimeoutSec) * time.Second,
+			MaxRequests:   maxConnRequests,
+			MaxAge:        time.Duration(maxConnAgeSec) * time.Second,
+			RateLimit:     perSecond(listenerRateLimit),
+			ACL:           acl,
+			TCP:           tcpOptions(tcpKeepAliveSec, tcpNagle, tcpReadBuffer, tcpWriteBuffer),
 		}
 	} else {
 		l = server.ListenArgs{
-			Type: server.ListenTCP,
-			Port: port,
+			Type:          server.ListenTCP,
+			Port:          port,
+			Host:          bindHost,
+			IPVersion:     ipv,
+			Credentials:   loadCreds(saslCreds),
+			TLSCert:       tlsCert,
+			TLSKey:        tlsKey,
+			TLSClientCA:   tlsClientCA,
+			ProxyProtocol: proxyProtocol,
+			AuditBinary:   auditBinary,
+			AccessLog:     accessLog,
+			MaxConns:      listenerMaxConns,
+			IdleTimeout:   time.Duration(idleTimeoutSec) * time.Second,
+			MaxRequests:   maxConnRequests,
+			MaxAge:        time.Duration(maxConnAgeSec) * time.Second,
+			RateLimit:     perSecond(listenerRateLimit),
+			ACL:           acl,
+			TCP:           tcpOptions(tcpKeepAliveSec, tcpNagle, tcpReadBuffer, tcpWriteBuffer),
 		}
 	}
 
@@ -118,20 +1067,245 @@ func main() {
 
 	if l1inmem {
 		h1 = inmem.New
-	} else if chunked {
-		h1 = memcached.Chunked(l1sock)
+	} else if l1null {
+		h1 = null.New
+	} else if l1backends != "" {
+		conf := sharded.DefaultConfig
+		conf.TLS = l1opts.TLS
+		conf.TCP = l1opts.TCP
+		if l1backendsRefreshSec > 0 {
+			interval := time.Duration(l1backendsRefreshSec) * time.Second
+			h1 = memcached.ShardedDiscovered(strings.Split(l1backends, ","), interval, conf)
+		} else {
+			h1 = memcached.ShardedWithConfig(strings.Split(l1backends, ","), conf)
+		}
+	} else if l1elasticache != "" {
+		conf := sharded.DefaultConfig
+		conf.TLS = l1opts.TLS
+		conf.TCP = l1opts.TCP
+		interval := time.Duration(l1elasticacheRefreshSec) * time.Second
+		h1 = memcached.ShardedAutoDiscovered(l1elasticache, interval, conf)
+	} else if l1consulService != "" || l1etcdPrefix != "" {
+		var src sharded.Source
+		if l1consulService != "" {
+			src = sharded.NewConsul(sharded.ConsulConfig{
+				Addr:    l1consulAddr,
+				Service: l1consulService,
+				Tag:     l1consulTag,
+				Token:   os.Getenv("CONSUL_HTTP_TOKEN"),
+			})
+		} else {
+			src = sharded.NewEtcd(sharded.EtcdConfig{
+				Endpoint: l1etcdEndpoint,
+				Prefix:   l1etcdPrefix,
+			})
+		}
+
+		conf := sharded.DefaultConfig
+		conf.TLS = l1opts.TLS
+		conf.TCP = l1opts.TCP
+		interval := time.Duration(l1discoveryRefreshSec) * time.Second
+		h1 = memcached.ShardedWatched(src, interval, conf)
+	} else if l1replicas != "" {
+		var replicas []handlers.HandlerConst
+		for _, sock := range strings.Split(l1replicas, ",") {
+			replicas = append(replicas, l1Const(sock))
+			startJanitor(sock)
+		}
+		if l1writeQuorum > 0 {
+			h1 = handlers.Quorum(handlers.QuorumConfig{Writes: l1writeQuorum, Reads: l1readQuorum}, replicas...)
+		} else {
+			h1 = handlers.Replicated(replicas...)
+		}
 	} else {
-		h1 = memcached.Regular(l1sock)
+		// Sharded and replicated L1s track the health of their backends themselves
+		h1 = handlers.Reconnecting(l1Const(l1sock))
+		startJanitor(l1sock)
 	}
 
-	if l2enabled {
+	if l2enabled && l2null {
+		o = orcas.L1L2
+		h2 = null.New
+	} else if l2enabled && l2diskPath != "" {
+		o = orcas.L1L2
+		var err error
+		h2, err = disk.New(disk.Config{
+			Path:           l2diskPath,
+			MaxBytes:       l2diskMaxBytes,
+			ExpiryInterval: time.Minute,
+		})
+		if err != nil {
+			panic("Error opening L2 disk store: " + err.Error())
+		}
+	} else if l2enabled && l2ssdPath != "" {
+		o = orcas.L1L2
+		var err error
+		h2, err = ssd.New(ssd.Config{
+			Path: l2ssdPath,
+			Size: l2ssdSize,
+		})
+		if err != nil {
+			panic("Error opening L2 SSD store: " + err.Error())
+		}
+	} else if l2enabled {
 		o = orcas.L1L2
-		h2 = memcached.Regular(l2sock)
+		h2 = handlers.Reconnecting(l2Const(l2sock))
 	} else {
 		o = orcas.L1Only
 		h2 = handlers.NilHandler
 	}
 
+	if orcaName != "" {
+		o = lookupOrca(orcaName)
+	} else if shadowPercent > 0 {
+		// As with the backfiller, h2 is only chained below, so it is looked up when the workers
+		// connect
+		shadow = orcas.NewShadow(func() (handlers.Handler, error) { return h2() }, orcas.ShadowConfig{
+			Percent:   shadowPercent,
+			Workers:   shadowWorkers,
+			QueueSize: shadowQueue,
+		})
+		o = orcas.ShadowL1(shadow)
+	} else if l1backfillAsync {
+		// The decorators are only chained onto h1 below, so the backfiller looks it up when its
+		// workers connect instead of taking it now.
+		b := orcas.NewBackfiller(ttlConf.L1.Wrap(func() (handlers.Handler, error) { return h1() }), l1backfillWorkers, l1backfillQueue)
+		o = orcas.L1L2WithBackfill(b)
+	}
+
+	var l1decorators, l2decorators []handlers.Decorator
+
+	// The in-memory, null, disk and SSD handlers are shared already, so only the memcached handlers
+	// are pooled
+	if poolSize > 0 {
+		if !l1inmem && !l1null {
+			l1decorators = append(l1decorators, handlers.Pool(poolSize))
+		}
+		if l2enabled && !l2null && l2diskPath == "" && l2ssdPath == "" {
+			l2decorators = append(l2decorators, handlers.Pool(poolSize))
+		}
+	}
+
+	if retries > 0 {
+		retry := handlers.Retry(handlers.RetryConfig{
+			Retries: retries,
+			Backoff: time.Duration(retryBackoffMs) * time.Millisecond,
+		})
+		l1decorators = append(l1decorators, retry)
+		l2decorators = append(l2decorators, retry)
+	}
+
+	if spillBucket != "" {
+		s3, err := spill.NewS3(spill.S3Config{
+			Endpoint:  spillEndpoint,
+			Bucket:    spillBucket,
+			Region:    spillRegion,
+			Prefix:    spillPrefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Timeout:   10 * time.Second,
+		})
+		if err != nil {
+			panic("Error setting up S3 spillover: " + err.Error())
+		}
+		conf := spill.Config{
+			Threshold: spillThreshold,
+			Backfill:  spillBackfill,
+		}
+		l1decorators = append(l1decorators, func(hc handlers.HandlerConst) handlers.HandlerConst {
+			return spill.New(hc, s3, conf)
+		})
+	}
+
+	var breaker *handlers.Breaker
+	if l2enabled && l2breaker {
+		conf := handlers.DefaultBreakerConfig
+		conf.ErrorRate = l2breakerErrorRate
+		conf.SlowCall = time.Duration(l2breakerSlowMs) * time.Millisecond
+		conf.OpenTimeout = time.Duration(l2breakerOpenMs) * time.Millisecond
+
+		breaker = handlers.NewBreaker(conf)
+		l2decorators = append(l2decorators, breaker.Wrap)
+		o = orcas.BreakerFallback(o, breaker)
+	}
+
+	if namespace != "" {
+		l1decorators = append(l1decorators, handlers.Namespace(namespace))
+		l2decorators = append(l2decorators, handlers.Namespace(namespace))
+	}
+
+	h1 = handlers.Chain(h1, l1decorators...)
+	if l2enabled {
+		h2 = handlers.Chain(h2, l2decorators...)
+	}
+
+	// Routing wraps the decorators so that prefixes are matched against the keys clients send
+	h1 = prefixRouted(h1, l1routes, func(sock string) handlers.HandlerConst {
+		startJanitor(sock)
+		return handlers.Reconnecting(l1Const(sock))
+	}, l1decorators)
+
+	if hotKeyThreshold > 0 {
+		h1 = handlers.HotKeyCached(h1, handlers.NewHotKeys(handlers.HotKeyConfig{
+			SampleRate: hotKeySampleRate,
+			Threshold:  hotKeyThreshold,
+			TTL:        time.Duration(hotKeyTTLMs) * time.Millisecond,
+			MaxKeys:    hotKeyMax,
+		}))
+	}
+
+	if l2enabled {
+		h2 = prefixRouted(h2, l2routes, func(sock string) handlers.HandlerConst {
+			return handlers.Reconnecting(l2Const(sock))
+		}, l2decorators)
+	}
+
+	if l3sock != "" {
+		h2 = handlers.Tiered(
+			handlers.Tier{Handler: h2, Promote: l2promotion},
+			handlers.Tier{Handler: handlers.Chain(handlers.Reconnecting(l2Const(l3sock)), l2decorators...)},
+		)
+	}
+
+	if writeConf.Policy == orcas.WriteBack {
+		writeConf.Behind = orcas.NewWriteBehind(ttlConf.L2.Wrap(h2), orcas.WriteBehindConfig{
+			Workers:   writeBackWorkers,
+			QueueSize: writeBackQueue,
+			MaxBytes:  writeBackMaxMB << 20,
+			Retries:   writeBackRetries,
+			Backoff:   time.Duration(writeBackBackoff) * time.Millisecond,
+		})
+	}
+
+	var repairer *orcas.ReadRepairer
+	if readRepairPercent > 0 {
+		repairer = orcas.NewReadRepairer(h1, h2, orcas.ReadRepairConfig{
+			Percent:   readRepairPercent,
+			Workers:   readRepairWorkers,
+			QueueSize: readRepairQueue,
+		})
+	}
+
+	var prefixes []string
+	if hitPrefixes != "" {
+		prefixes = strings.Split(hitPrefixes, ",")
+	}
+	hits := orcas.NewHitCounter(prefixes)
+
+	o = orcas.WriteHandling(o, writeConf)
+	o = orcas.OOMHandling(o, oomConf)
+	o = orcas.FlushPropagation(o, flushPol)
+	o = orcas.EarlyRefresh(o, refreshConf)
+	o = orcas.TierTTLs(o, ttlConf)
+	o = orcas.ReadRepair(o, repairer)
+	o = orcas.HitCounting(o, hits)
+
+	// Coalescing is added after early refresh so it wraps L2 first and shares what L2 answered,
+	// before each connection decides whether to refresh early
+	if l2coalesce {
+		o = orcas.Coalescing(o, orcas.NewCoalescer())
+	}
+
 	// Add the locking wrapper if requested. The locking wrapper can either allow mutltiple readers
 	// or not, with the same difference in semantics between a sync.Mutex and a sync.RWMutex. If
 	// chunking is enabled, we want to ensure that stricter locking is enabled, since concurrent
@@ -145,26 +1319,153 @@ func main() {
 		}
 	}
 
-	go server.ListenAndServe(l, server.Default, o, h1, h2)
+	// Leasing goes outside the locks so a get waiting on a lease doesn't hold the lock the lease
+	// holder needs to set the key
+	var leases *orcas.Leases
+	if leasesEnabled {
+		leases = orcas.NewLeases(time.Duration(leaseWaitMs) * time.Millisecond)
+		o = orcas.Leasing(o, leases)
+	}
+
+	var topKeys *orcas.TopKeys
+	if topKeysSampleRate > 0 {
+		topKeys = orcas.NewTopKeys(orcas.TopKeysConfig{
+			SampleRate: topKeysSampleRate,
+			Size:       topKeysSize,
+			HalfLife:   time.Duration(topKeysHalfLifeSec) * time.Second,
+		})
+	}
+	o = orcas.TopKeyTracking(o, topKeys)
+
+	var recorder *orcas.Recorder
+	if flightRecorder > 0 {
+		recorder = orcas.NewRecorder(flightRecorder)
+		http.Handle("/admin/requests", recorder)
+	}
+	o = orcas.Recording(o, recorder)
+
+	// Signature verification is done before any locking so that requests
+	// that will be rejected anyway do not contend for locks.
+	if sigSecret != "" {
+		o = orcas.Signed(o, []byte(sigSecret), uint32(sigWindow))
+	}
+
+	listeners := []server.Listener{{Args: l, Server: server.Default, Orca: o, L1: h1, L2: h2}}
+
+	if httpPort != 0 {
+		hl := server.ListenArgs{
+			Type:          server.ListenTCP,
+			Port:          httpPort,
+			Host:          bindHost,
+			IPVersion:     ipv,
+			TLSCert:       tlsCert,
+			TLSKey:        tlsKey,
+			TLSClientCA:   tlsClientCA,
+			ProxyProtocol: proxyProtocol,
+			HTTP:          true,
+			Credentials:   loadCreds(saslCreds),
+			AccessLog:     accessLog,
+			MaxConns:      listenerMaxConns,
+			IdleTimeout:   time.Duration(idleTimeoutSec) * time.Second,
+			MaxRequests:   maxConnRequests,
+			MaxAge:        time.Duration(maxConnAgeSec) * time.Second,
+			RateLimit:     perSecond(listenerRateLimit),
+			ACL:           acl,
+			TCP:           tcpOptions(tcpKeepAliveSec, tcpNagle, tcpReadBuffer, tcpWriteBuffer),
+		}
+		listeners = append(listeners, server.Listener{Args: hl, Server: server.Default, Orca: o, L1: h1, L2: h2})
+	}
 
 	if l2enabled {
 		// If L2 is enabled, start the batch L1 / L2 orchestrator
 		l = server.ListenArgs{
-			Type: server.ListenTCP,
-			Port: batchPort,
+			Type:          server.ListenTCP,
+			Port:          batchPort,
+			Host:          bindHost,
+			IPVersion:     ipv,
+			Credentials:   loadCreds(batchSASLCreds),
+			TLSCert:       tlsCert,
+			TLSKey:        tlsKey,
+			TLSClientCA:   tlsClientCA,
+			ProxyProtocol: proxyProtocol,
+			AuditBinary:   auditBinary,
+			AccessLog:     accessLog,
+			MaxConns:      listenerMaxConns,
+			IdleTimeout:   time.Duration(idleTimeoutSec) * time.Second,
+			MaxRequests:   maxConnRequests,
+			MaxAge:        time.Duration(maxConnAgeSec) * time.Second,
+			RateLimit:     perSecond(listenerRateLimit),
+			ACL:           acl,
+			TCP:           tcpOptions(tcpKeepAliveSec, tcpNagle, tcpReadBuffer, tcpWriteBuffer),
 		}
 
-		o := orcas.L1L2Batch
+		bo := lookupOrca(batchOrcaName)
+		if shadow != nil {
+			bo = orcas.ShadowL1(shadow)
+		}
+		if breaker != nil {
+			bo = orcas.BreakerFallback(bo, breaker)
+		}
+
+		o := orcas.WriteHandling(bo, writeConf)
+		o = orcas.OOMHandling(o, oomConf)
+		o = orcas.FlushPropagation(o, flushPol)
+		o = orcas.EarlyRefresh(o, refreshConf)
+		o = orcas.TierTTLs(o, ttlConf)
+		o = orcas.ReadRepair(o, repairer)
+		o = orcas.HitCounting(o, hits)
+
+		if l2coalesce {
+			o = orcas.Coalescing(o, orcas.NewCoalescer())
+		}
 
 		if locked {
 			o = orcas.LockedWithExisting(o, lockset)
 		}
 
-		go server.ListenAndServe(l, server.Default, o, h1, h2)
+		if leases != nil {
+			o = orcas.Leasing(o, leases)
+		}
+
+		o = orcas.TopKeyTracking(o, topKeys)
+		o = orcas.Recording(o, recorder)
+
+		if sigSecret != "" {
+			o = orcas.Signed(o, []byte(sigSecret), uint32(sigWindow))
+		}
+
+		listeners = append(listeners, server.Listener{Args: l, Server: server.Default, Orca: o, L1: h1, L2: h2})
 	}
 
-	// Block forever
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	wg.Wait()
+	group := server.NewGroup(listeners...)
+	admin.AddReadyCheck("listeners", func() error {
+		if !group.Serving() {
+			return errors.New("not serving")
+		}
+		return nil
+	})
+
+	healthTimeout := time.Duration(healthCheckTimeoutMs) * time.Millisecond
+	if healthCheckL1 {
+		admin.AddReadyCheck("l1", admin.TierCheck(h1, []byte(healthCheckKey), healthTimeout))
+	}
+	if healthCheckL2 && l2enabled {
+		admin.AddReadyCheck("l2", admin.TierCheck(h2, []byte(healthCheckKey), healthTimeout))
+	}
+
+	// On SIGTERM, stop taking new connections and let the open ones finish what they're doing
+	sigterm := make(chan os.Signal, 1)
+	signal.Notify(sigterm, syscall.SIGTERM)
+	go func() {
+		<-sigterm
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeoutSec)*time.Second)
+		defer cancel()
+		if err := group.Shutdown(ctx); err != nil {
+			logging.Logger(logging.DefaultSubsystem).Warn("Connections left open at shutdown were closed", "error", err)
+		}
+	}()
+
+	if err := group.Serve(); err != server.ErrGroupClosed {
+		panic(err)
+	}
 }
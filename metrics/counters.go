@@ -67,6 +67,11 @@ func IncCounterBy(id uint32, amount uint64) {
 	atomic.AddUint64(&counters[id], amount)
 }
 
+// Counters returns the current values of all registered counters
+func Counters() []IntMetric {
+	return getAllCounters()
+}
+
 func getAllCounters() []IntMetric {
 	numIDs := int(atomic.LoadUint32(curCounterID))
 	ret := make([]IntMetric, numIDs)
@@ -79,5 +84,5 @@ func getAllCounters() []IntMetric {
 		}
 	}
 
-	return ret
+	return append(ret, allFamilyMetrics(&counterFamilies)...)
 }
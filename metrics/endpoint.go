@@ -82,6 +82,15 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
+	im, fm := gatherMetrics(true)
+
+	printIntMetrics(w, im)
+	printFloatMetrics(w, fm)
+}
+
+// gatherMetrics reads every metric. Bucketized histograms are left out unless buckets is set.
+// Reading the histograms resets them, so the caller must hold metricsReadLock.
+func gatherMetrics(buckets bool) ([]IntMetric, []FloatMetric) {
 	//////////////////////////
 	// Runtime memory stats
 	//////////////////////////
@@ -124,11 +133,16 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 
 	fm = append(fm, FloatMetric{"gc_gc_cpu_frac", memstats.GCCPUFraction, tagsFloatGauge})
 
-	// circular buffer of recent GC pause durations, most recent at [(NumGC+255)%256]
-	pctls := pausePercentiles(memstats.PauseNs[:], memstats.NumGC)
-	for i := 0; i < 22; i++ {
-		// pre-calculated tags match the 0:5:100,99 pattern that pausePercentiles produces.
-		im = append(im, IntMetric{"gc_pause", pctls[i], percentileTags[i]})
+	// circular buffer of recent GC pause durations, most recent at [(NumGC+255)%256]. There are
+	// none until the first GC.
+	if memstats.NumGC > 0 {
+		im = append(im, IntMetric{"gc_pause_last", memstats.PauseNs[(memstats.NumGC+255)%256], tagsIntGauge})
+
+		pctls := pausePercentiles(memstats.PauseNs[:], memstats.NumGC)
+		for i := 0; i < 22; i++ {
+			// pre-calculated tags match the 0:5:100,99 pattern that pausePercentiles produces.
+			im = append(im, IntMetric{"gc_pause", pctls[i], percentileTags[i]})
+		}
 	}
 
 	// Per-size allocation statistics.
@@ -137,6 +151,19 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 		im = append(im, IntMetric{"alloc_frees", b.Frees, allocTags[i]})
 	}
 
+	//////////////////////////
+	// Runtime and process
+	//////////////////////////
+	im = append(im, IntMetric{"runtime_goroutines", uint64(runtime.NumGoroutine()), tagsIntGauge})
+	im = append(im, IntMetric{"runtime_gomaxprocs", uint64(runtime.GOMAXPROCS(0)), tagsIntGauge})
+	im = append(im, IntMetric{"runtime_cgo_calls", uint64(runtime.NumCgoCall()), tagsIntCounter})
+
+	// File descriptors are only known on some platforms
+	if open, max, ok := fileDescriptors(); ok {
+		im = append(im, IntMetric{"process_open_fds", open, tagsIntGauge})
+		im = append(im, IntMetric{"process_max_fds", max, tagsIntGauge})
+	}
+
 	//////////////////////////
 	// Histograms
 	//////////////////////////
@@ -144,10 +171,17 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 	im = append(im, inth...)
 	fm = append(fm, floath...)
 
+	//////////////////////////
+	// Windowed percentiles
+	//////////////////////////
+	im = append(im, getAllWindowHistograms()...)
+
 	//////////////////////////
 	// Bucketized histograms
 	//////////////////////////
-	im = append(im, getAllBucketHistograms()...)
+	if buckets {
+		im = append(im, getAllBucketHistograms()...)
+	}
 
 	//////////////////////////
 	// Counters
@@ -175,8 +209,7 @@ func printMetrics(w http.ResponseWriter, r *http.Request) {
 	im = append(im, intcb...)
 	fm = append(fm, floatcb...)
 
-	printIntMetrics(w, im)
-	printFloatMetrics(w, fm)
+	return im, fm
 }
 
 func makeTags(typ, dataType, statistic string) Tags {
@@ -0,0 +1,190 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A family is a metric that is kept separately for each combination of the values of its tags.
+// The values are given each time the metric is updated, so metrics kept per backend, per result
+// and the like don't need a metric registered up front for every combination. Each combination
+// is reported as a metric of its own with the same name and the tag values it was updated with.
+//
+// Updating a family costs a map lookup more than a plain metric, and every combination that is
+// ever used is kept until it is removed, so the tag values should come from a small set, like
+// the addresses of the backends, and never from keys or other client data.
+type family struct {
+	name string
+	keys []string
+	tgs  Tags
+
+	lock sync.RWMutex
+	vals map[string]*familyVal
+}
+
+type familyVal struct {
+	val uint64
+	tgs Tags
+}
+
+var (
+	familiesLock    sync.Mutex
+	counterFamilies []*family
+	gaugeFamilies   []*family
+)
+
+func newFamily(name string, tgs Tags, keys []string) *family {
+	return &family{
+		name: name,
+		keys: keys,
+		tgs:  tgs,
+		vals: make(map[string]*familyVal),
+	}
+}
+
+// get returns the value for the tag values, adding it if it is new
+func (f *family) get(values []string) *uint64 {
+	if len(values) != len(f.keys) {
+		panic("Metric " + f.name + " needs a value for each of its tags")
+	}
+	id := strings.Join(values, "\x00")
+
+	f.lock.RLock()
+	v, ok := f.vals[id]
+	f.lock.RUnlock()
+	if ok {
+		return &v.val
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if v, ok := f.vals[id]; ok {
+		return &v.val
+	}
+
+	tgs := copyTags(f.tgs)
+	for i, k := range f.keys {
+		tgs[k] = values[i]
+	}
+	v = &familyVal{tgs: tgs}
+	f.vals[id] = v
+	return &v.val
+}
+
+func (f *family) remove(values []string) {
+	f.lock.Lock()
+	delete(f.vals, strings.Join(values, "\x00"))
+	f.lock.Unlock()
+}
+
+func (f *family) metrics() []IntMetric {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	ret := make([]IntMetric, 0, len(f.vals))
+	for _, v := range f.vals {
+		ret = append(ret, IntMetric{
+			Name: f.name,
+			Val:  atomic.LoadUint64(&v.val),
+			Tgs:  v.tgs,
+		})
+	}
+	return ret
+}
+
+func allFamilyMetrics(families *[]*family) []IntMetric {
+	familiesLock.Lock()
+	fs := *families
+	familiesLock.Unlock()
+
+	var ret []IntMetric
+	for _, f := range fs {
+		ret = append(ret, f.metrics()...)
+	}
+	return ret
+}
+
+// CounterFamily is a counter kept for each combination of the values of its tags
+type CounterFamily struct {
+	f *family
+}
+
+// AddCounterFamily registers a counter with the given tag keys, whose values are given when it is
+// incremented. E.g.:
+//
+//	var (
+//	    MetricBackendErrors = metrics.AddCounterFamily("backend_errors", "backend", "op")
+//	)
+//
+// Then in code:
+//
+//	MetricBackendErrors.Inc(addr, "get")
+func AddCounterFamily(name string, keys ...string) CounterFamily {
+	f := newFamily(name, Tags{
+		TagMetricType: MetricTypeCounter,
+		TagDataType:   DataTypeUint64,
+	}, keys)
+
+	familiesLock.Lock()
+	counterFamilies = append(counterFamilies, f)
+	familiesLock.Unlock()
+
+	return CounterFamily{f}
+}
+
+// Inc increases the counter for the tag values by 1. There must be a value for each tag key, in
+// the order the keys were registered.
+func (c CounterFamily) Inc(values ...string) {
+	atomic.AddUint64(c.f.get(values), 1)
+}
+
+// IncBy increases the counter for the tag values by the given amount
+func (c CounterFamily) IncBy(amount uint64, values ...string) {
+	atomic.AddUint64(c.f.get(values), amount)
+}
+
+// IntGaugeFamily is an integer gauge kept for each combination of the values of its tags
+type IntGaugeFamily struct {
+	f *family
+}
+
+// AddIntGaugeFamily registers an integer gauge with the given tag keys, whose values are given
+// when it is set.
+func AddIntGaugeFamily(name string, keys ...string) IntGaugeFamily {
+	f := newFamily(name, Tags{
+		TagMetricType: MetricTypeGauge,
+		TagDataType:   DataTypeUint64,
+	}, keys)
+
+	familiesLock.Lock()
+	gaugeFamilies = append(gaugeFamilies, f)
+	familiesLock.Unlock()
+
+	return IntGaugeFamily{f}
+}
+
+// Set sets the gauge for the tag values to the value given
+func (g IntGaugeFamily) Set(value uint64, values ...string) {
+	atomic.StoreUint64(g.f.get(values), value)
+}
+
+// Remove stops reporting the gauge for the tag values, e.g. for a backend that is gone
+func (g IntGaugeFamily) Remove(values ...string) {
+	g.f.remove(values)
+}
@@ -0,0 +1,54 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/hongst/rend/metrics"
+)
+
+func TestCounterFamily(t *testing.T) {
+	f := metrics.AddCounterFamily("test_family", "backend", "result")
+
+	f.Inc("a", "hit")
+	f.Inc("a", "hit")
+	f.IncBy(3, "b", "hit")
+	f.Inc("a", "miss")
+
+	vals := make(map[string]uint64)
+	for _, m := range metrics.Counters() {
+		if m.Name == "test_family" {
+			vals[m.Tgs["backend"]+" "+m.Tgs["result"]] = m.Val
+		}
+	}
+
+	expected := map[string]uint64{"a hit": 2, "b hit": 3, "a miss": 1}
+	if len(vals) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, vals)
+	}
+	for k, v := range expected {
+		if vals[k] != v {
+			t.Fatalf("Expected %v, got %v", expected, vals)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected a panic for a missing tag value")
+		}
+	}()
+	f.Inc("a")
+}
@@ -0,0 +1,46 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package metrics
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileDescriptors returns the number of file descriptors the process has open and the most it
+// is allowed to have open at once
+func fileDescriptors() (uint64, uint64, bool) {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, 0, false
+	}
+
+	// The directory read above has a descriptor of its own open
+	return uint64(len(names) - 1), lim.Cur, true
+}
@@ -96,6 +96,7 @@ func getAllGauges() ([]IntMetric, []FloatMetric) {
 			Tgs:  intgtags[i],
 		}
 	}
+	retint = append(retint, allFamilyMetrics(&gaugeFamilies)...)
 
 	numIDs = int(atomic.LoadUint32(curFloatGaugeID))
 	retfloat := make([]FloatMetric, numIDs)
@@ -0,0 +1,54 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import "sync"
+
+// BackendHealth is the state of one backend as seen by the proxy
+type BackendHealth struct {
+	Addr    string `json:"addr"`
+	Healthy bool   `json:"healthy"`
+	// Failures is the number of requests to the backend that failed in a row
+	Failures int `json:"failures"`
+}
+
+// HealthCallback returns the health of a set of backends
+type HealthCallback func() []BackendHealth
+
+var (
+	healthLock sync.Mutex
+	healthCBs  []HealthCallback
+)
+
+// RegisterHealthCallback registers a callback for the health of a set of backends, which will be
+// called every time the health of the backends is requested, e.g. by the /admin/stats endpoint.
+func RegisterHealthCallback(cb HealthCallback) {
+	healthLock.Lock()
+	healthCBs = append(healthCBs, cb)
+	healthLock.Unlock()
+}
+
+// Health returns the health of every backend from all of the registered callbacks
+func Health() []BackendHealth {
+	healthLock.Lock()
+	cbs := healthCBs
+	healthLock.Unlock()
+
+	var ret []BackendHealth
+	for _, cb := range cbs {
+		ret = append(ret, cb()...)
+	}
+	return ret
+}
@@ -0,0 +1,104 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+func init() {
+	http.Handle("/admin/stats", http.HandlerFunc(printJSON))
+}
+
+// jsonSnapshot is the body of the /admin/stats endpoint. Histograms are keyed by name and then by
+// statistic, like percentile50 or count. Everything else is listed with its tags.
+type jsonSnapshot struct {
+	Time       int64                             `json:"time"`
+	Counters   []jsonMetric                      `json:"counters"`
+	Gauges     []jsonMetric                      `json:"gauges"`
+	Histograms map[string]map[string]interface{} `json:"histograms"`
+	Backends   []BackendHealth                   `json:"backends"`
+}
+
+type jsonMetric struct {
+	Name  string      `json:"name"`
+	Tags  Tags        `json:"tags,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// printJSON writes every metric but the bucketized histograms and the health of the backends as
+// one JSON object, for tools that don't read the /metrics format. Histograms are reset when read
+// here the same as by /metrics, so polling both splits the observations between them.
+func printJSON(w http.ResponseWriter, r *http.Request) {
+	metricsReadLock.Lock()
+	im, fm := gatherMetrics(false)
+	metricsReadLock.Unlock()
+
+	snap := jsonSnapshot{
+		Time:       time.Now().Unix(),
+		Counters:   []jsonMetric{},
+		Gauges:     []jsonMetric{},
+		Histograms: make(map[string]map[string]interface{}),
+		Backends:   Health(),
+	}
+	if snap.Backends == nil {
+		snap.Backends = []BackendHealth{}
+	}
+
+	for _, m := range im {
+		snap.add(m.Name, m.Tgs, m.Val)
+	}
+	for _, m := range fm {
+		snap.add(m.Name, m.Tgs, m.Val)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(snap)
+}
+
+func (s *jsonSnapshot) add(name string, tgs Tags, val interface{}) {
+	if stat, ok := tgs[TagStatistic]; ok {
+		h, ok := s.Histograms[name]
+		if !ok {
+			h = make(map[string]interface{})
+			s.Histograms[name] = h
+		}
+		h[stat] = val
+		return
+	}
+
+	// The type tags are shown by which list the metric is in
+	var extra Tags
+	for k, v := range tgs {
+		if k == TagMetricType || k == TagDataType {
+			continue
+		}
+		if extra == nil {
+			extra = make(Tags)
+		}
+		extra[k] = v
+	}
+
+	m := jsonMetric{Name: name, Tags: extra, Value: val}
+	if tgs[TagMetricType] == MetricTypeCounter {
+		s.Counters = append(s.Counters, m)
+	} else {
+		s.Gauges = append(s.Gauges, m)
+	}
+}
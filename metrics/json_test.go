@@ -0,0 +1,80 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hongst/rend/metrics"
+)
+
+// jsonStats is the part of the /admin/stats output the tests look at
+type jsonStats struct {
+	Counters []struct {
+		Name  string
+		Value float64
+	}
+	Gauges     []struct{ Name string }
+	Histograms map[string]map[string]float64
+	Backends   []metrics.BackendHealth
+}
+
+func getJSONStats(t *testing.T) jsonStats {
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/stats", nil))
+
+	var snap jsonStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("Expected JSON, got %v:\n%s", err, rec.Body.String())
+	}
+	return snap
+}
+
+func TestJSONStats(t *testing.T) {
+	c := metrics.AddCounter("json_test_counter", nil)
+	metrics.IncCounterBy(c, 3)
+	h := metrics.AddHistogram("json_test_hist", false, nil)
+	metrics.ObserveHist(h, 10)
+	metrics.RegisterHealthCallback(func() []metrics.BackendHealth {
+		return []metrics.BackendHealth{{Addr: "10.0.0.1:11211", Healthy: false, Failures: 3}}
+	})
+
+	snap := getJSONStats(t)
+
+	found := false
+	for _, m := range snap.Counters {
+		if m.Name == "json_test_counter" {
+			found = m.Value == 3
+		}
+	}
+	if !found {
+		t.Errorf("Expected json_test_counter to be 3 in %v", snap.Counters)
+	}
+
+	if len(snap.Gauges) == 0 {
+		t.Errorf("Expected the runtime gauges")
+	}
+
+	if got := snap.Histograms["hist_json_test_hist"]; got["count"] != 1 || got["average"] != 10 || got["percentile100"] != 10 {
+		t.Errorf("Expected one observation of 10 in hist_json_test_hist, got %v", got)
+	}
+
+	if len(snap.Backends) != 1 || snap.Backends[0].Healthy || snap.Backends[0].Failures != 3 {
+		t.Errorf("Expected the unhealthy backend, got %v", snap.Backends)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"log"
+	"time"
+)
+
+// Sink sends metrics to a system that doesn't scrape the /metrics endpoint
+type Sink interface {
+	Send(ints []IntMetric, floats []FloatMetric) error
+}
+
+// StartSink sends every metric but the bucketized histograms to s once each interval. Histograms
+// are reset each time they are read, so when both a sink and the /metrics endpoint are used, each
+// only sees the observations made since either of them last read them.
+func StartSink(s Sink, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			metricsReadLock.Lock()
+			im, fm := gatherMetrics(false)
+			metricsReadLock.Unlock()
+
+			if err := s.Send(im, fm); err != nil {
+				log.Println("Error sending metrics:", err)
+			}
+		}
+	}()
+}
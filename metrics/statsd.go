@@ -0,0 +1,188 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StatsDConfig holds the settings used by NewStatsD.
+type StatsDConfig struct {
+	// Addr is the host:port the StatsD agent listens for UDP packets on
+	Addr string
+	// DogStatsD sends tags the way the Datadog agent expects them. Plain StatsD has no tags, so
+	// their values are added to the metric names instead.
+	DogStatsD bool
+	// Tags are key:value pairs added to every metric. They are only sent with DogStatsD.
+	Tags []string
+	// MaxPacket is the most bytes sent in one packet. 0 means 1432, which fits in an ethernet
+	// frame.
+	MaxPacket int
+}
+
+// statsdHistStats are the statistics of each histogram that are sent. The rest of the percentiles
+// would only multiply the number of metrics the agent has to handle.
+var statsdHistStats = map[string]bool{
+	"average":        true,
+	"percentile50":   true,
+	"percentile95":   true,
+	"percentile99":   true,
+	"percentile99.9": true,
+	"percentile100":  true,
+	"count":          true,
+}
+
+// StatsD is a Sink that sends metrics to a StatsD or DogStatsD agent. Counters are sent as the
+// change since the last time they were sent, and gauges and the statistics of histograms as they
+// are. The count of a histogram is already the number of observations since it was last read.
+type StatsD struct {
+	conn net.Conn
+	conf StatsDConfig
+	last map[string]uint64
+}
+
+func NewStatsD(conf StatsDConfig) (*StatsD, error) {
+	if conf.MaxPacket <= 0 {
+		conf.MaxPacket = 1432
+	}
+
+	conn, err := net.Dial("udp", conf.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsD{
+		conn: conn,
+		conf: conf,
+		last: make(map[string]uint64),
+	}, nil
+}
+
+func (s *StatsD) Send(ints []IntMetric, floats []FloatMetric) error {
+	var lines []string
+
+	for _, m := range ints {
+		name, tags, ok := s.name(m.Name, m.Tgs)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case m.Tgs[TagStatistic] == "count" && strings.HasPrefix(m.Name, "hist_"):
+			if m.Val > 0 {
+				lines = append(lines, name+":"+strconv.FormatUint(m.Val, 10)+"|c"+tags)
+			}
+
+		case m.Tgs[TagMetricType] == MetricTypeCounter && m.Tgs[TagStatistic] == "":
+			key := name + tags
+			delta := m.Val - s.last[key]
+			if m.Val < s.last[key] {
+				delta = m.Val
+			}
+			s.last[key] = m.Val
+			if delta > 0 {
+				lines = append(lines, name+":"+strconv.FormatUint(delta, 10)+"|c"+tags)
+			}
+
+		default:
+			lines = append(lines, name+":"+strconv.FormatUint(m.Val, 10)+"|g"+tags)
+		}
+	}
+
+	for _, m := range floats {
+		if name, tags, ok := s.name(m.Name, m.Tgs); ok {
+			lines = append(lines, name+":"+strconv.FormatFloat(m.Val, 'f', -1, 64)+"|g"+tags)
+		}
+	}
+
+	return s.write(lines)
+}
+
+// name returns the name and the tag suffix a metric is sent with, and false for the statistics of
+// histograms that aren't sent
+func (s *StatsD) name(name string, tgs Tags) (string, string, bool) {
+	if stat := tgs[TagStatistic]; stat != "" && strings.HasPrefix(name, "hist_") && !statsdHistStats[stat] {
+		return "", "", false
+	}
+
+	var keys []string
+	for k := range tgs {
+		if k != TagMetricType && k != TagDataType {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	name = statsdSanitize(prefix + name)
+
+	if !s.conf.DogStatsD {
+		for _, k := range keys {
+			name += "." + statsdSanitize(tgs[k])
+		}
+		return name, "", true
+	}
+
+	tags := append([]string(nil), s.conf.Tags...)
+	for _, k := range keys {
+		tags = append(tags, statsdSanitize(k)+":"+statsdSanitize(tgs[k]))
+	}
+	if len(tags) == 0 {
+		return name, "", true
+	}
+	return name, "|#" + strings.Join(tags, ","), true
+}
+
+// statsdSanitize replaces the characters that have a meaning in the StatsD protocol
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', ',', '#', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// write sends the lines in as few packets as fit them
+func (s *StatsD) write(lines []string) error {
+	var packet []byte
+	var err error
+
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, werr := s.conn.Write(packet); werr != nil && err == nil {
+			err = werr
+		}
+		packet = packet[:0]
+	}
+
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > s.conf.MaxPacket {
+			flush()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	flush()
+
+	return err
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/metrics"
+)
+
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+
+	read := func() string {
+		buf := make([]byte, 2048)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		return string(buf[:n])
+	}
+
+	counter := metrics.Tags{metrics.TagMetricType: metrics.MetricTypeCounter, metrics.TagDataType: metrics.DataTypeUint64}
+	gauge := metrics.Tags{metrics.TagMetricType: metrics.MetricTypeGauge, metrics.TagDataType: metrics.DataTypeUint64}
+	hist := func(stat string) metrics.Tags {
+		return metrics.Tags{metrics.TagMetricType: metrics.MetricTypeCounter, metrics.TagStatistic: stat}
+	}
+
+	ints := func(val uint64) []metrics.IntMetric {
+		return []metrics.IntMetric{
+			{Name: "cmd_get", Val: val, Tgs: counter},
+			{Name: "conns", Val: 3, Tgs: gauge},
+			{Name: "hist_get", Val: 250, Tgs: hist("percentile99")},
+			{Name: "hist_get", Val: 100, Tgs: hist("percentile10")},
+			{Name: "hist_get", Val: 7, Tgs: hist("count")},
+		}
+	}
+
+	t.Run("Plain", func(t *testing.T) {
+		s, err := metrics.NewStatsD(metrics.StatsDConfig{Addr: conn.LocalAddr().String()})
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+
+		s.Send(ints(5), []metrics.FloatMetric{{Name: "hist_get", Val: 1.5, Tgs: hist("average")}})
+		expected := "cmd_get:5|c\nconns:3|g\nhist_get.percentile99:250|g\nhist_get.count:7|c\nhist_get.average:1.5|g"
+		if got := read(); got != expected {
+			t.Fatalf("Expected %q, got %q", expected, got)
+		}
+
+		// Counters are sent as the change since the last send
+		s.Send(ints(8), nil)
+		if got := read(); !strings.HasPrefix(got, "cmd_get:3|c\n") {
+			t.Fatalf("Expected the counter to go up by 3, got %q", got)
+		}
+	})
+
+	t.Run("DogStatsD", func(t *testing.T) {
+		s, err := metrics.NewStatsD(metrics.StatsDConfig{
+			Addr:      conn.LocalAddr().String(),
+			DogStatsD: true,
+			Tags:      []string{"env:test"},
+		})
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+
+		s.Send(ints(5)[2:3], nil)
+		if got, expected := read(), "hist_get:250|g|#env:test,statistic:percentile99"; got != expected {
+			t.Fatalf("Expected %q, got %q", expected, got)
+		}
+	})
+
+	t.Run("Packets", func(t *testing.T) {
+		s, err := metrics.NewStatsD(metrics.StatsDConfig{Addr: conn.LocalAddr().String(), MaxPacket: 12})
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+
+		s.Send(ints(5)[:2], nil)
+		if got := read(); got != "cmd_get:5|c" {
+			t.Fatalf("Expected a packet for each metric, got %q", got)
+		}
+		if got := read(); got != "conns:3|g" {
+			t.Fatalf("Expected a packet for each metric, got %q", got)
+		}
+	})
+}
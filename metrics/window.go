@@ -0,0 +1,176 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Windowed percentiles are worked out from the bucketized histograms, which count every
+// observation and are never reset. A snapshot of the buckets is taken every windowStep, and the
+// observations in a window are the difference between the buckets now and the snapshot from the
+// start of the window. The value reported for a percentile is the top of the bucket it falls in,
+// so it is at most about a third too high, and it isn't changed by other readers of the metrics.
+const (
+	windowStep  = 10 * time.Second
+	windowSlots = int(5*time.Minute/windowStep) + 1
+)
+
+type window struct {
+	suffix string
+	length time.Duration
+}
+
+var windows = [...]window{
+	{"_1m", time.Minute},
+	{"_5m", 5 * time.Minute},
+}
+
+var windowPercentiles = [...]struct {
+	statistic string
+	// parts per thousand
+	ppt uint64
+}{
+	{"percentile50", 500},
+	{"percentile99", 990},
+	{"percentile99.9", 999},
+}
+
+type bucketSnapshot struct {
+	at      time.Time
+	buckets [][numAtlasBuckets]uint64
+}
+
+var (
+	windowLock  sync.Mutex
+	windowSnaps [windowSlots]bucketSnapshot
+	windowNext  int
+)
+
+func init() {
+	windowSnaps[0] = snapshotBuckets(time.Now())
+	windowNext = 1
+
+	go func() {
+		for now := range time.Tick(windowStep) {
+			s := snapshotBuckets(now)
+
+			windowLock.Lock()
+			windowSnaps[windowNext] = s
+			windowNext = (windowNext + 1) % windowSlots
+			windowLock.Unlock()
+		}
+	}()
+}
+
+func snapshotBuckets(now time.Time) bucketSnapshot {
+	n := int(atomic.LoadUint32(curHistID))
+	s := bucketSnapshot{
+		at:      now,
+		buckets: make([][numAtlasBuckets]uint64, n),
+	}
+	for i := 0; i < n; i++ {
+		s.buckets[i] = extractBHist(bhists[i])
+	}
+	return s
+}
+
+// windowStart returns the oldest snapshot that is still inside the window. Until the proxy has
+// been up for the length of the window, that's the one taken at startup.
+func windowStart(now time.Time, length time.Duration) (bucketSnapshot, bool) {
+	windowLock.Lock()
+	defer windowLock.Unlock()
+
+	var start bucketSnapshot
+	found := false
+	for _, s := range windowSnaps {
+		if s.at.IsZero() || now.Sub(s.at) > length {
+			continue
+		}
+		if !found || s.at.Before(start.at) {
+			start = s
+			found = true
+		}
+	}
+	return start, found
+}
+
+// getAllWindowHistograms returns the windowed percentiles of each histogram as gauges named like
+// hist_get_1m. Histograms with no observations in a window are left out, like in
+// getAllHistograms.
+func getAllWindowHistograms() []IntMetric {
+	now := time.Now()
+	cur := snapshotBuckets(now)
+
+	var ret []IntMetric
+
+	for _, w := range windows {
+		start, ok := windowStart(now, w.length)
+		if !ok {
+			continue
+		}
+
+		for i := range cur.buckets {
+			var diff [numAtlasBuckets]uint64
+			var total uint64
+			for j := range diff {
+				diff[j] = cur.buckets[i][j]
+				if i < len(start.buckets) {
+					diff[j] -= start.buckets[i][j]
+				}
+				total += diff[j]
+			}
+			if total == 0 {
+				continue
+			}
+
+			for _, p := range windowPercentiles {
+				tgs := copyTags(hFloatTagsExpanded[i])
+				tgs[TagMetricType] = MetricTypeGauge
+				tgs[TagDataType] = DataTypeUint64
+				tgs[TagStatistic] = p.statistic
+
+				ret = append(ret, IntMetric{
+					Name: hNames[i] + w.suffix,
+					Val:  bucketPercentile(diff, total, p.ppt),
+					Tgs:  tgs,
+				})
+			}
+		}
+	}
+
+	return ret
+}
+
+// bucketPercentile returns the top of the bucket holding the given fraction, in parts per
+// thousand, of the observations
+func bucketPercentile(buckets [numAtlasBuckets]uint64, total, ppt uint64) uint64 {
+	// the rank of the observation, rounded up so the 99.9th of 10 is the last one
+	rank := (total*ppt + 999) / 1000
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for i, c := range buckets {
+		seen += c
+		if seen >= rank {
+			return uint64(bucketValues[i])
+		}
+	}
+	return uint64(bucketValues[numAtlasBuckets-1])
+}
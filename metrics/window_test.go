@@ -0,0 +1,50 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/hongst/rend/metrics"
+)
+
+func TestWindowPercentiles(t *testing.T) {
+	h := metrics.AddHistogram("window_test", true, nil)
+	for i := uint64(1); i <= 10000; i++ {
+		metrics.ObserveHist(h, i*1000)
+	}
+
+	snap := getJSONStats(t)
+
+	for _, name := range []string{"hist_window_test_1m", "hist_window_test_5m"} {
+		got := snap.Histograms[name]
+
+		// The percentiles are the tops of their buckets, which are at most a third too high
+		for stat, want := range map[string]float64{
+			"percentile50":   5000000,
+			"percentile99":   9900000,
+			"percentile99.9": 9990000,
+		} {
+			if got[stat] < want || got[stat] > want*4/3 {
+				t.Errorf("Expected %s %s to be close to %v, got %v", name, stat, want, got[stat])
+			}
+		}
+	}
+
+	// Reading the histogram resets it, but not the windows
+	if got := getJSONStats(t).Histograms["hist_window_test_1m"]["percentile50"]; got < 5000000 {
+		t.Errorf("Expected the windows to keep their observations, got %v", got)
+	}
+}
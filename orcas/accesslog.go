@@ -0,0 +1,116 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricAccessLogWritten = metrics.AddCounter("access_log_written", nil)
+	MetricAccessLogDropped = metrics.AddCounter("access_log_dropped", nil)
+)
+
+// AccessLogConfig holds the settings used by NewAccessLog
+type AccessLogConfig struct {
+	// SampleRate is how many requests there are for each one that is logged
+	SampleRate int
+	// Keys writes the first key of each request instead of only its hash
+	Keys bool
+	// QueueSize is how many lines can wait to be written. When the queue is full, lines are
+	// dropped and counted in access_log_dropped instead of slowing down requests.
+	QueueSize int
+}
+
+// accessLogFlush is how long written lines can sit in the buffer before they're flushed
+const accessLogFlush = time.Second
+
+// AccessLog writes a sample of the requests made through the proxy as one JSON object per line,
+// with the same fields as the flight recorder and the client address. Lines are queued and
+// written in the background, so a slow disk drops lines rather than slowing requests down. It is
+// shared by all connections.
+type AccessLog struct {
+	conf    AccessLogConfig
+	counter uint64
+	lines   chan []byte
+}
+
+// accessLogLine adds the key, if it's kept, to what the flight recorder keeps
+type accessLogLine struct {
+	RecordedRequest
+	Key string `json:"key,omitempty"`
+}
+
+// NewAccessLog starts writing the access log to w
+func NewAccessLog(w io.Writer, conf AccessLogConfig) *AccessLog {
+	a := &AccessLog{
+		conf:  conf,
+		lines: make(chan []byte, conf.QueueSize),
+	}
+	go a.write(w)
+	return a
+}
+
+func (a *AccessLog) write(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	flush := time.NewTicker(accessLogFlush)
+	defer flush.Stop()
+
+	for {
+		select {
+		case line := <-a.lines:
+			if _, err := bw.Write(line); err != nil {
+				log.Println("Error writing access log:", err.Error())
+				continue
+			}
+			metrics.IncCounter(MetricAccessLogWritten)
+
+		case <-flush.C:
+			if err := bw.Flush(); err != nil {
+				log.Println("Error writing access log:", err.Error())
+			}
+		}
+	}
+}
+
+// Record queues the request to be written if it's sampled
+func (a *AccessLog) Record(rr RecordedRequest) {
+	if atomic.AddUint64(&a.counter, 1)%uint64(a.conf.SampleRate) != 0 {
+		return
+	}
+
+	line := accessLogLine{RecordedRequest: rr}
+	if a.conf.Keys {
+		line.Key = string(rr.key)
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	select {
+	case a.lines <- append(b, '\n'):
+	default:
+		metrics.IncCounter(MetricAccessLogDropped)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// lockedBuffer is written by the access log in the background
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+	out := &lockedBuffer{}
+	a := orcas.NewAccessLog(out, orcas.AccessLogConfig{SampleRate: 2, Keys: true, QueueSize: 10})
+	o := orcas.RecordingTo(orcas.L1Only, a, "10.0.0.1:5000")(newTestMapHandler(), nil, res)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := o.Set(common.SetRequest{Key: []byte(key), Data: []byte("value")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+	}
+
+	// Lines are flushed once a second
+	deadline := time.Now().Add(3 * time.Second)
+	for strings.Count(out.String(), "\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected every second request to be logged, got %q", out.String())
+	}
+
+	var line struct {
+		orcas.RecordedRequest
+		Key string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatalf("Expected JSON, got %v", err)
+	}
+	if line.Op != "set" || line.Key != "b" || line.ValueSize != 5 || line.Client != "10.0.0.1:5000" || line.Result != "ok" {
+		t.Fatalf("Expected the set of b from the client, got %+v", line)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/timer"
+)
+
+// asyncConfig says how asyncSets stores requests and which metrics it keeps
+type asyncConfig struct {
+	// tier names the tier in logs
+	tier string
+	// store is the handler method requests are stored with, e.g. handlers.Handler.Set
+	store func(handlers.Handler, common.SetRequest) error
+
+	// retries is how many more times a request that failed with an I/O error or a temporary
+	// failure is tried, waiting backoff before the first retry and twice as long each time after
+	retries int
+	backoff time.Duration
+
+	hist       uint32
+	success    uint32
+	errors     uint32
+	connErrors uint32
+	// retried and dropped count retries and the requests given up on after all of them. They are
+	// only used with retries.
+	retried uint32
+	dropped uint32
+}
+
+// asyncSets stores requests in a tier in the background with a pool of workers. Each worker has
+// a handler of its own, made when it is first needed and again after an I/O error, and a queue of
+// its own. Requests are spread over the queues by key, so requests for the same key are stored one
+// at a time in the order they were queued. The queues hold at most queueSize requests between
+// them, and if maxBytes is positive at most that many bytes of keys and data.
+type asyncSets struct {
+	queues   []chan asyncSet
+	conf     asyncConfig
+	maxBytes int64
+	bytes    int64
+
+	// lock guards seq and keys, and idle is signalled when a key has nothing left to store
+	lock sync.Mutex
+	idle *sync.Cond
+	seq  uint64
+	keys map[string]*asyncKey
+}
+
+// asyncSet is a queued request with the sequence number it was queued with
+type asyncSet struct {
+	req common.SetRequest
+	seq uint64
+}
+
+// asyncKey tracks the requests for a key that are queued or being stored. Only the request with
+// the latest sequence number is stored, so one that was superseded while it waited or between
+// retries is dropped.
+type asyncKey struct {
+	latest  uint64
+	pending int
+}
+
+func newAsyncSets(hc handlers.HandlerConst, workers, queueSize, maxBytes int, conf asyncConfig) *asyncSets {
+	a := &asyncSets{
+		queues:   make([]chan asyncSet, workers),
+		conf:     conf,
+		maxBytes: int64(maxBytes),
+		keys:     make(map[string]*asyncKey),
+	}
+	a.idle = sync.NewCond(&a.lock)
+
+	perWorker := 0
+	if workers > 0 {
+		perWorker = (queueSize + workers - 1) / workers
+	}
+	for i := range a.queues {
+		a.queues[i] = make(chan asyncSet, perWorker)
+		go a.work(hc, a.queues[i])
+	}
+	return a
+}
+
+func queuedSize(req common.SetRequest) int64 {
+	return int64(len(req.Key) + len(req.Data))
+}
+
+// enqueue queues a request to be stored and returns false if the queue is full. A queued request
+// supersedes any older one for the same key that is still waiting or being retried.
+func (a *asyncSets) enqueue(req common.SetRequest) bool {
+	if len(a.queues) == 0 {
+		return false
+	}
+
+	size := queuedSize(req)
+	if n := atomic.AddInt64(&a.bytes, size); a.maxBytes > 0 && n > a.maxBytes {
+		atomic.AddInt64(&a.bytes, -size)
+		return false
+	}
+
+	// Handlers can build other keys in the spare capacity of the key, so the queued request gets
+	// its own copy. The data isn't touched by handlers.
+	req.Key = append([]byte(nil), req.Key...)
+	req.Quiet = true
+	// The write outlives the request, so it isn't held to the request's deadline
+	req.Ctx = nil
+
+	h := fnv.New32a()
+	h.Write(req.Key)
+	queue := a.queues[h.Sum32()%uint32(len(a.queues))]
+
+	// The lock is held over the send so a worker can't see the request before it is the latest
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	select {
+	case queue <- asyncSet{req: req, seq: a.seq + 1}:
+		a.seq++
+		k := a.keys[string(req.Key)]
+		if k == nil {
+			k = &asyncKey{}
+			a.keys[string(req.Key)] = k
+		}
+		k.latest = a.seq
+		k.pending++
+		return true
+	default:
+		atomic.AddInt64(&a.bytes, -size)
+		return false
+	}
+}
+
+// supersede drops the requests for a key that are queued or being retried, and waits for one
+// that is being stored to finish. Anything written to the tier for the key afterwards can't be
+// overwritten by an older queued request.
+func (a *asyncSets) supersede(key []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if k, ok := a.keys[string(key)]; ok {
+		a.seq++
+		k.latest = a.seq
+	}
+	a.waitLocked(key)
+}
+
+// wait waits until the requests queued for a key so far are stored or dropped
+func (a *asyncSets) wait(key []byte) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.waitLocked(key)
+}
+
+func (a *asyncSets) waitLocked(key []byte) {
+	for {
+		if _, ok := a.keys[string(key)]; !ok {
+			return
+		}
+		a.idle.Wait()
+	}
+}
+
+// latest reports whether a queued request is still the latest for its key
+func (a *asyncSets) latest(s asyncSet) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.keys[string(s.req.Key)].latest == s.seq
+}
+
+// done forgets a queued request once it was stored or dropped
+func (a *asyncSets) done(s asyncSet) {
+	atomic.AddInt64(&a.bytes, -queuedSize(s.req))
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	k := a.keys[string(s.req.Key)]
+	if k.pending--; k.pending == 0 {
+		delete(a.keys, string(s.req.Key))
+		a.idle.Broadcast()
+	}
+}
+
+// retryable decides if a failed background write is worth trying again
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	return !common.IsAppError(err) || err == common.ErrTempFailure || err == common.ErrNoMem
+}
+
+func (a *asyncSets) work(hc handlers.HandlerConst, queue chan asyncSet) {
+	var h handlers.Handler
+	for s := range queue {
+		if !a.latest(s) {
+			a.done(s)
+			continue
+		}
+
+		err := a.store(&h, hc, s.req)
+		backoff := a.conf.backoff
+
+		for i := 0; i < a.conf.retries && retryable(err); i++ {
+			time.Sleep(backoff)
+			backoff *= 2
+
+			if !a.latest(s) {
+				err = nil
+				break
+			}
+
+			metrics.IncCounter(a.conf.retried)
+			err = a.store(&h, hc, s.req)
+		}
+
+		if a.conf.retries > 0 && retryable(err) {
+			metrics.IncCounter(a.conf.dropped)
+		}
+		a.done(s)
+	}
+}
+
+// store stores one request with the worker's handler, which is made first if there is none
+func (a *asyncSets) store(h *handlers.Handler, hc handlers.HandlerConst, req common.SetRequest) error {
+	if *h == nil {
+		var err error
+		if *h, err = hc(); err != nil {
+			log.Println("Error connecting to "+a.conf.tier+" for background writes:", err)
+			metrics.IncCounter(a.conf.connErrors)
+			metrics.IncCounter(a.conf.errors)
+			*h = nil
+			return err
+		}
+	}
+
+	start := timer.Now()
+	err := a.conf.store(*h, req)
+	metrics.ObserveHist(a.conf.hist, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(a.conf.errors)
+		// The connection can't be trusted after an I/O error, so the next request makes a new one
+		if !common.IsAppError(err) {
+			(*h).Close()
+			*h = nil
+		}
+		return err
+	}
+	metrics.IncCounter(a.conf.success)
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricCmdGetBackfillL1          = metrics.AddCounter("cmd_get_backfill_l1", nil)
+	MetricCmdGetBackfillDroppedL1   = metrics.AddCounter("cmd_get_backfill_dropped_l1", nil)
+	MetricCmdGetBackfillSuccessL1   = metrics.AddCounter("cmd_get_backfill_success_l1", nil)
+	MetricCmdGetBackfillNotStoredL1 = metrics.AddCounter("cmd_get_backfill_not_stored_l1", nil)
+	MetricCmdGetBackfillErrorsL1    = metrics.AddCounter("cmd_get_backfill_errors_l1", nil)
+	MetricCmdGetBackfillConnErrorL1 = metrics.AddCounter("cmd_get_backfill_conn_errors_l1", nil)
+)
+
+// Backfiller puts values that missed L1 and hit L2 back into L1 in the background, so the get
+// doesn't wait for the L1 set. It is shared by all connections and has L1 handlers of its own,
+// since the handlers of a connection can't be used outside of it. Values are added instead of set
+// so one that waited in the queue doesn't overwrite a newer set of the same key. When the queue is
+// full the value is skipped, and the next get of the key tries again.
+type Backfiller struct {
+	*asyncSets
+}
+
+// NewBackfiller starts workers that each add the queued values to their own L1 handler made by l1.
+// Up to queueSize values can wait to be added.
+func NewBackfiller(l1 handlers.HandlerConst, workers, queueSize int) *Backfiller {
+	return &Backfiller{newAsyncSets(l1, workers, queueSize, 0, asyncConfig{
+		tier:       "L1",
+		store:      backfillAdd,
+		hist:       HistAddL1,
+		success:    MetricCmdGetBackfillSuccessL1,
+		errors:     MetricCmdGetBackfillErrorsL1,
+		connErrors: MetricCmdGetBackfillConnErrorL1,
+	})}
+}
+
+// backfillAdd adds a value to L1. A key that is already there was set since the get, which is
+// not an error.
+func backfillAdd(h handlers.Handler, req common.SetRequest) error {
+	err := h.Add(req)
+	if err == common.ErrKeyExists {
+		metrics.IncCounter(MetricCmdGetBackfillNotStoredL1)
+		return nil
+	}
+	return err
+}
+
+// backfill queues a value found in L2 to be added to L1
+func (b *Backfiller) backfill(req common.SetRequest) {
+	metrics.IncCounter(MetricCmdGetBackfillL1)
+	if !b.enqueue(req) {
+		metrics.IncCounter(MetricCmdGetBackfillDroppedL1)
+	}
+}
+
+// L1L2WithBackfill returns a constructor for L1L2 orcas that backfill L1 through b on gets that
+// hit L2, instead of setting the value in L1 before responding.
+func L1L2WithBackfill(b *Backfiller) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return &L1L2Orca{
+			l1:       l1,
+			l2:       l2,
+			res:      res,
+			backfill: b,
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testBackfillHandler misses every get, hits every GetE and records the keys set and added
+type testBackfillHandler struct {
+	handlers.Handler
+	lock sync.Mutex
+	sets []string
+	adds []string
+}
+
+func (h *testBackfillHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	res := make(chan common.GetResponse, len(cmd.Keys))
+	errs := make(chan error)
+	for i, key := range cmd.Keys {
+		res <- common.GetResponse{Key: key, Opaque: cmd.Opaques[i], Miss: true}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h *testBackfillHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	res := make(chan common.GetEResponse, len(cmd.Keys))
+	errs := make(chan error)
+	for i, key := range cmd.Keys {
+		res <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte("bar"), Exptime: 100}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h *testBackfillHandler) Set(cmd common.SetRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sets = append(h.sets, string(cmd.Key))
+	return nil
+}
+
+func (h *testBackfillHandler) Add(cmd common.SetRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.adds = append(h.adds, string(cmd.Key))
+	return nil
+}
+
+func (h *testBackfillHandler) addCount() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.adds)
+}
+
+func TestBackfill(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+	req := common.GetRequest{Keys: [][]byte{[]byte("foo")}, Opaques: []uint32{0}, Quiet: []bool{false}}
+
+	t.Run("Sync", func(t *testing.T) {
+		l1, l2 := &testBackfillHandler{}, &testBackfillHandler{}
+		if err := orcas.L1L2(l1, l2, res).Get(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if len(l1.sets) != 1 {
+			t.Fatalf("Expected L1 to be set before responding, got %v", l1.sets)
+		}
+	})
+
+	t.Run("Async", func(t *testing.T) {
+		l1, l2, filler := &testBackfillHandler{}, &testBackfillHandler{}, &testBackfillHandler{}
+		b := orcas.NewBackfiller(func() (handlers.Handler, error) { return filler, nil }, 1, 10)
+		if err := orcas.L1L2WithBackfill(b)(l1, l2, res).Get(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if len(l1.sets) != 0 {
+			t.Fatalf("Expected L1 not to be set before responding, got %v", l1.sets)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for filler.addCount() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if filler.addCount() != 1 {
+			t.Fatalf("Expected the value to be added to L1 in the background")
+		}
+	})
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var MetricCmdBreakerL1Only = metrics.AddCounter("cmd_breaker_l1_only", nil)
+
+// BreakerFallback serves requests as L1Only would while the breaker in front of L2 is open, so a
+// sick L2 is left out entirely instead of failing requests. Writes made in that time only reach
+// L1, so L2 can hold stale data for those keys once it is back; deleted keys in particular can
+// come back from L2 after L1 drops them.
+func BreakerFallback(oc OrcaConst, b *handlers.Breaker) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return breakerOrca{
+			full:   oc(l1, l2, res),
+			l1only: L1Only(l1, l2, res),
+			b:      b,
+		}
+	}
+}
+
+type breakerOrca struct {
+	full   Orca
+	l1only Orca
+	b      *handlers.Breaker
+}
+
+func (o breakerOrca) pick() Orca {
+	if o.b.Open() {
+		metrics.IncCounter(MetricCmdBreakerL1Only)
+		return o.l1only
+	}
+	return o.full
+}
+
+func (o breakerOrca) Set(req common.SetRequest) error {
+	return o.pick().Set(req)
+}
+
+func (o breakerOrca) Add(req common.SetRequest) error {
+	return o.pick().Add(req)
+}
+
+func (o breakerOrca) Replace(req common.SetRequest) error {
+	return o.pick().Replace(req)
+}
+
+func (o breakerOrca) Append(req common.SetRequest) error {
+	return o.pick().Append(req)
+}
+
+func (o breakerOrca) Prepend(req common.SetRequest) error {
+	return o.pick().Prepend(req)
+}
+
+func (o breakerOrca) Delete(req common.DeleteRequest) error {
+	return o.pick().Delete(req)
+}
+
+func (o breakerOrca) Touch(req common.TouchRequest) error {
+	return o.pick().Touch(req)
+}
+
+func (o breakerOrca) Get(req common.GetRequest) error {
+	return o.pick().Get(req)
+}
+
+func (o breakerOrca) GetE(req common.GetRequest) error {
+	return o.pick().GetE(req)
+}
+
+func (o breakerOrca) Gat(req common.GATRequest) error {
+	return o.pick().Gat(req)
+}
+
+func (o breakerOrca) Incr(req common.IncrDecrRequest) error {
+	return o.pick().Incr(req)
+}
+
+func (o breakerOrca) Decr(req common.IncrDecrRequest) error {
+	return o.pick().Decr(req)
+}
+
+func (o breakerOrca) Noop(req common.NoopRequest) error {
+	return o.pick().Noop(req)
+}
+
+func (o breakerOrca) Quit(req common.QuitRequest) error {
+	return o.pick().Quit(req)
+}
+
+func (o breakerOrca) Version(req common.VersionRequest) error {
+	return o.pick().Version(req)
+}
+
+func (o breakerOrca) Verbosity(req common.VerbosityRequest) error {
+	return o.pick().Verbosity(req)
+}
+
+func (o breakerOrca) Stats(req common.StatsRequest) error {
+	return o.pick().Stats(req)
+}
+
+func (o breakerOrca) Flush(req common.FlushRequest) error {
+	return o.pick().Flush(req)
+}
+
+func (o breakerOrca) Unknown(req common.Request) error {
+	return o.pick().Unknown(req)
+}
+
+func (o breakerOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	o.full.Error(req, reqType, err)
+}
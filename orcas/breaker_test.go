@@ -0,0 +1,72 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+func TestBreakerFallback(t *testing.T) {
+	b := handlers.NewBreaker(handlers.BreakerConfig{
+		Window:      time.Hour,
+		MinRequests: 1,
+		ErrorRate:   1,
+		OpenTimeout: time.Hour,
+		Probes:      1,
+	})
+
+	l1 := &testOOMHandler{}
+	l2 := &testOOMHandler{}
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+	o := orcas.BreakerFallback(orcas.L1L2, b)(l1, l2, res)
+
+	if err := o.Set(common.SetRequest{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if l1.sets != 1 || l2.sets != 1 {
+		t.Fatalf("Expected the set to reach both tiers, got %d and %d", l1.sets, l2.sets)
+	}
+
+	// Open the breaker with a single failure
+	broken, _ := b.Wrap(func() (handlers.Handler, error) {
+		return testErrHandler{}, nil
+	})()
+	broken.Set(common.SetRequest{})
+
+	if err := o.Set(common.SetRequest{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if l1.sets != 2 || l2.sets != 1 {
+		t.Fatalf("Expected the set to only reach L1, got %d and %d", l1.sets, l2.sets)
+	}
+}
+
+// testErrHandler fails every set with an IO error
+type testErrHandler struct {
+	handlers.Handler
+}
+
+func (h testErrHandler) Set(cmd common.SetRequest) error {
+	return io.EOF
+}
@@ -0,0 +1,219 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sync"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricCmdGetECoalescedL2 = metrics.AddCounter("cmd_gete_coalesced_l2", nil)
+	MetricCmdGetERefetchL2   = metrics.AddCounter("cmd_gete_refetch_l2", nil)
+)
+
+// Coalescer lets connections that read the same key from L2 at the same time share one fetch.
+// The first connection to ask for a key fetches it and every connection that asks before it is
+// done waits for its answer instead of asking L2 again. It is shared by all connections.
+type Coalescer struct {
+	lock  sync.Mutex
+	calls map[string]*coalescedGet
+}
+
+// coalescedGet is one fetch of a key from L2. res and err are set before done is closed.
+type coalescedGet struct {
+	done chan struct{}
+	res  common.GetEResponse
+	err  error
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{
+		calls: make(map[string]*coalescedGet),
+	}
+}
+
+// join returns the fetch of the key in flight, and true if there was none and the caller has to
+// make it
+func (c *Coalescer) join(key []byte) (*coalescedGet, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if call, ok := c.calls[string(key)]; ok {
+		return call, false
+	}
+
+	call := &coalescedGet{done: make(chan struct{})}
+	c.calls[string(key)] = call
+	return call, true
+}
+
+// finish hands the result of a fetch to the connections waiting on it. Connections that ask for
+// the key after this make a new fetch.
+func (c *Coalescer) finish(key []byte, call *coalescedGet, res common.GetEResponse, err error) {
+	c.lock.Lock()
+	delete(c.calls, string(key))
+	c.lock.Unlock()
+
+	call.res = res
+	call.err = err
+	close(call.done)
+}
+
+// Coalescing wraps the L2 handler given to an orca so that its GetE requests share fetches
+// through c with those of other connections. This is how the L1L2 orca reads L2 on gets that miss
+// L1. If a shared fetch fails, the connections waiting on it fetch the key themselves rather than
+// take on an error from another connection.
+func Coalescing(oc OrcaConst, c *Coalescer) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		if l2 != nil {
+			l2 = coalescingHandler{Handler: l2, c: c}
+		}
+		return oc(l1, l2, res)
+	}
+}
+
+// coalescingHandler intercepts GetE. All other commands go straight through to the embedded
+// handler.
+type coalescingHandler struct {
+	handlers.Handler
+	c *Coalescer
+}
+
+func (h coalescingHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	res := make(chan common.GetEResponse, len(cmd.Keys))
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		calls := make([]*coalescedGet, len(cmd.Keys))
+		leads := make([]bool, len(cmd.Keys))
+		var lead []int
+
+		for i, key := range cmd.Keys {
+			calls[i], leads[i] = h.c.join(key)
+			if leads[i] {
+				lead = append(lead, i)
+			}
+		}
+
+		results := make([]common.GetEResponse, len(cmd.Keys))
+		found := make([]bool, len(cmd.Keys))
+
+		// The keys this connection leads are fetched before waiting on any others, so a key that
+		// is in the request twice waits on this connection's own fetch
+		err := h.fetch(cmd, lead, results, found)
+		for _, i := range lead {
+			if found[i] {
+				h.c.finish(cmd.Keys[i], calls[i], results[i], nil)
+			} else {
+				h.c.finish(cmd.Keys[i], calls[i], common.GetEResponse{}, common.ErrInternal)
+			}
+		}
+
+		var refetch []int
+		for i, call := range calls {
+			if leads[i] {
+				continue
+			}
+
+			<-call.done
+			if call.err != nil {
+				refetch = append(refetch, i)
+				continue
+			}
+
+			metrics.IncCounter(MetricCmdGetECoalescedL2)
+			results[i] = call.res
+			results[i].Key = cmd.Keys[i]
+			results[i].Opaque = cmd.Opaques[i]
+			results[i].Quiet = cmd.Quiet[i]
+			found[i] = true
+		}
+
+		if err == nil && len(refetch) > 0 {
+			metrics.IncCounterBy(MetricCmdGetERefetchL2, uint64(len(refetch)))
+			err = h.fetch(cmd, refetch, results, found)
+		}
+
+		// Orcas expect the keys to be answered in order, so the answers stop at the first key that
+		// has none
+		for i := range cmd.Keys {
+			if !found[i] {
+				break
+			}
+			res <- results[i]
+		}
+
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	return res, errs
+}
+
+// fetch gets the keys of cmd at the indices idxs from the embedded handler into results, marking
+// the ones answered in found
+func (h coalescingHandler) fetch(cmd common.GetRequest, idxs []int, results []common.GetEResponse, found []bool) error {
+	if len(idxs) == 0 {
+		return nil
+	}
+
+	req := common.GetRequest{
+		Keys:    make([][]byte, len(idxs)),
+		Opaques: make([]uint32, len(idxs)),
+		Quiet:   make([]bool, len(idxs)),
+	}
+	for j, i := range idxs {
+		req.Keys[j] = cmd.Keys[i]
+		req.Opaques[j] = cmd.Opaques[i]
+		req.Quiet[j] = cmd.Quiet[i]
+	}
+
+	resE, errsE := h.Handler.GetE(req)
+
+	var answered int
+	var err error
+
+	for resE != nil || errsE != nil {
+		select {
+		case r, ok := <-resE:
+			if !ok {
+				resE = nil
+				continue
+			}
+			if answered < len(idxs) {
+				results[idxs[answered]] = r
+				found[idxs[answered]] = true
+			}
+			answered++
+
+		case getErr, ok := <-errsE:
+			if !ok {
+				errsE = nil
+				continue
+			}
+			err = getErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testCoalesceHandler hits every key, holding each GetE until release is closed. The first fail
+// GetEs fail with an I/O error.
+type testCoalesceHandler struct {
+	handlers.Handler
+	release chan struct{}
+
+	lock  sync.Mutex
+	calls int
+	fail  int
+}
+
+func (h *testCoalesceHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	h.lock.Lock()
+	h.calls++
+	fail := h.fail > 0
+	h.fail--
+	h.lock.Unlock()
+
+	res := make(chan common.GetEResponse, len(cmd.Keys))
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+		<-h.release
+
+		if fail {
+			errs <- io.ErrUnexpectedEOF
+			return
+		}
+		for i, key := range cmd.Keys {
+			res <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte("bar")}
+		}
+	}()
+
+	return res, errs
+}
+
+func (h *testCoalesceHandler) callCount() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.calls
+}
+
+func TestCoalescing(t *testing.T) {
+	req := common.GetRequest{Keys: [][]byte{[]byte("foo")}, Opaques: []uint32{0}, Quiet: []bool{false}}
+
+	// get starts a get of foo on a connection of its own and returns what it responded with
+	get := func(oc orcas.OrcaConst, l2 handlers.Handler) <-chan string {
+		out := make(chan string, 1)
+		go func() {
+			buf := &bytes.Buffer{}
+			w := bufio.NewWriter(buf)
+			if err := oc(&testBackfillHandler{}, l2, textprot.NewTextResponder(w)).Get(req); err != nil {
+				out <- err.Error()
+				return
+			}
+			w.Flush()
+			out <- buf.String()
+		}()
+		return out
+	}
+
+	// waitCalls waits for the handler to be asked for foo n times in all
+	waitCalls := func(l2 *testCoalesceHandler, n int) {
+		deadline := time.Now().Add(time.Second)
+		for l2.callCount() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	t.Run("Shared", func(t *testing.T) {
+		l2 := &testCoalesceHandler{release: make(chan struct{})}
+		oc := orcas.Coalescing(orcas.L1L2, orcas.NewCoalescer())
+
+		first := get(oc, l2)
+		waitCalls(l2, 1)
+		second := get(oc, l2)
+		// Give the second get the time to join the first one's fetch
+		time.Sleep(50 * time.Millisecond)
+		close(l2.release)
+
+		for _, out := range []<-chan string{first, second} {
+			if res := <-out; !strings.HasPrefix(res, "VALUE foo") {
+				t.Fatalf("Expected a hit, got %q", res)
+			}
+		}
+		if l2.callCount() != 1 {
+			t.Fatalf("Expected one fetch from L2, got %d", l2.callCount())
+		}
+	})
+
+	t.Run("Refetch", func(t *testing.T) {
+		l2 := &testCoalesceHandler{release: make(chan struct{}), fail: 1}
+		oc := orcas.Coalescing(orcas.L1L2, orcas.NewCoalescer())
+
+		first := get(oc, l2)
+		waitCalls(l2, 1)
+		second := get(oc, l2)
+		time.Sleep(50 * time.Millisecond)
+		close(l2.release)
+
+		if res := <-first; res != io.ErrUnexpectedEOF.Error() {
+			t.Fatalf("Expected the failed fetch's error, got %q", res)
+		}
+		if res := <-second; !strings.HasPrefix(res, "VALUE foo") {
+			t.Fatalf("Expected a hit, got %q", res)
+		}
+		if l2.callCount() != 2 {
+			t.Fatalf("Expected the waiting get to fetch again, got %d fetches", l2.callCount())
+		}
+	})
+}
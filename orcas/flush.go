@@ -0,0 +1,69 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var MetricCmdFlushSkipped = metrics.AddCounter("cmd_flush_skipped", nil)
+
+// FlushPolicy decides which tiers a flush is sent to.
+type FlushPolicy int
+
+const (
+	// FlushBoth flushes every tier. This is the default behavior of the orcas.
+	FlushBoth FlushPolicy = iota
+	// FlushL1Only flushes L1 and leaves L2 alone. L1 will refill from L2 on
+	// subsequent gets.
+	FlushL1Only
+	// FlushL2Only flushes L2 and leaves L1 alone. This breaks the assumption
+	// that L1 is a subset of L2 until the L1 data expires, so it is only
+	// useful in special cases.
+	FlushL2Only
+)
+
+// FlushPropagation wraps the handlers given to an orca so that a flush only
+// reaches the tiers allowed by the policy. A flush to any other tier succeeds
+// without doing anything, so the orca itself needs no changes.
+func FlushPropagation(oc OrcaConst, policy FlushPolicy) OrcaConst {
+	if policy == FlushBoth {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		if policy == FlushL2Only && l1 != nil {
+			l1 = noFlushHandler{l1}
+		}
+		if policy == FlushL1Only && l2 != nil {
+			l2 = noFlushHandler{l2}
+		}
+
+		return oc(l1, l2, res)
+	}
+}
+
+// noFlushHandler ignores flushes. All other commands go straight through to
+// the embedded handler.
+type noFlushHandler struct {
+	handlers.Handler
+}
+
+func (h noFlushHandler) Flush(cmd common.FlushRequest) error {
+	metrics.IncCounter(MetricCmdFlushSkipped)
+	return nil
+}
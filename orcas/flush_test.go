@@ -0,0 +1,58 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testFlushHandler counts flushes
+type testFlushHandler struct {
+	handlers.Handler
+	flushes int
+}
+
+func (h *testFlushHandler) Flush(cmd common.FlushRequest) error {
+	h.flushes++
+	return nil
+}
+
+func TestFlushPropagation(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+
+	test := func(t *testing.T, policy orcas.FlushPolicy, l1flushes, l2flushes int) {
+		l1 := &testFlushHandler{}
+		l2 := &testFlushHandler{}
+		o := orcas.FlushPropagation(orcas.L1L2, policy)(l1, l2, res)
+
+		if err := o.Flush(common.FlushRequest{}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if l1.flushes != l1flushes || l2.flushes != l2flushes {
+			t.Fatalf("Expected %d L1 and %d L2 flushes, got %d and %d", l1flushes, l2flushes, l1.flushes, l2.flushes)
+		}
+	}
+
+	t.Run("Both", func(t *testing.T) { test(t, orcas.FlushBoth, 1, 1) })
+	t.Run("L1Only", func(t *testing.T) { test(t, orcas.FlushL1Only, 1, 0) })
+	t.Run("L2Only", func(t *testing.T) { test(t, orcas.FlushL2Only, 0, 1) })
+}
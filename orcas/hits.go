@@ -0,0 +1,260 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricTierHitsL1   = metrics.AddCounter("tier_hits_l1", nil)
+	MetricTierMissesL1 = metrics.AddCounter("tier_misses_l1", nil)
+	MetricTierHitsL2   = metrics.AddCounter("tier_hits_l2", nil)
+	MetricTierMissesL2 = metrics.AddCounter("tier_misses_l2", nil)
+)
+
+const (
+	tierL1 = iota
+	tierL2
+)
+
+var tierNames = [...]string{"l1", "l2"}
+
+// HitCounter counts the hits and misses of the keys read from each tier, in total and for each of
+// a configured set of key prefixes. Every get, getE and GAT sent to a tier is counted, whichever
+// command the client sent, so the counts show how well each tier is doing on its own. The totals
+// are kept in the tier_hits_* and tier_misses_* metrics and the prefixes in the prefix_hits_* and
+// prefix_misses_* metrics, tagged with the prefix. The general stats report them all along with
+// the hit ratio of each.
+//
+// A key is counted under the longest of the prefixes it starts with, if any. Prefixes should be
+// a small set of known key spaces, like "user:" or "session:", since each one is kept separately.
+type HitCounter struct {
+	// sorted longest first so the first match is the longest
+	prefixes []prefixHits
+}
+
+type prefixHits struct {
+	prefix []byte
+	hits   [2]uint32
+	misses [2]uint32
+}
+
+var (
+	hitCountersLock sync.Mutex
+	hitCounters     []*HitCounter
+)
+
+// NewHitCounter registers the metrics for each of the prefixes. Duplicate prefixes are only
+// counted once.
+func NewHitCounter(prefixes []string) *HitCounter {
+	uniq := make(map[string]bool)
+	hc := &HitCounter{}
+
+	for _, p := range prefixes {
+		if uniq[p] {
+			continue
+		}
+		uniq[p] = true
+
+		tgs := metrics.Tags{"prefix": p}
+		ph := prefixHits{prefix: []byte(p)}
+		for tier, name := range tierNames {
+			ph.hits[tier] = metrics.AddCounter("prefix_hits_"+name, tgs)
+			ph.misses[tier] = metrics.AddCounter("prefix_misses_"+name, tgs)
+		}
+		hc.prefixes = append(hc.prefixes, ph)
+	}
+
+	sort.SliceStable(hc.prefixes, func(i, j int) bool {
+		return len(hc.prefixes[i].prefix) > len(hc.prefixes[j].prefix)
+	})
+
+	hitCountersLock.Lock()
+	hitCounters = append(hitCounters, hc)
+	hitCountersLock.Unlock()
+
+	return hc
+}
+
+func (hc *HitCounter) count(tier int, key []byte, miss bool) {
+	if miss {
+		if tier == tierL1 {
+			metrics.IncCounter(MetricTierMissesL1)
+		} else {
+			metrics.IncCounter(MetricTierMissesL2)
+		}
+	} else {
+		if tier == tierL1 {
+			metrics.IncCounter(MetricTierHitsL1)
+		} else {
+			metrics.IncCounter(MetricTierHitsL2)
+		}
+	}
+
+	for i := range hc.prefixes {
+		p := &hc.prefixes[i]
+		if len(key) < len(p.prefix) || string(key[:len(p.prefix)]) != string(p.prefix) {
+			continue
+		}
+		if miss {
+			metrics.IncCounter(p.misses[tier])
+		} else {
+			metrics.IncCounter(p.hits[tier])
+		}
+		return
+	}
+}
+
+// hitStats returns the hits, misses and hit ratio of each tier, followed by the same for each
+// prefix of every hit counter, named like prefix:user::hits_l1.
+func hitStats() []common.Stat {
+	vals := make(map[uint32]uint64)
+	for id, c := range metrics.Counters() {
+		vals[uint32(id)] = c.Val
+	}
+
+	var stats []common.Stat
+	stats = appendHitStats(stats, "", "l1", vals[MetricTierHitsL1], vals[MetricTierMissesL1])
+	stats = appendHitStats(stats, "", "l2", vals[MetricTierHitsL2], vals[MetricTierMissesL2])
+
+	hitCountersLock.Lock()
+	defer hitCountersLock.Unlock()
+
+	for _, hc := range hitCounters {
+		for _, p := range hc.prefixes {
+			name := "prefix:" + string(p.prefix) + ":"
+			for tier, tname := range tierNames {
+				stats = appendHitStats(stats, name, tname, vals[p.hits[tier]], vals[p.misses[tier]])
+			}
+		}
+	}
+
+	return stats
+}
+
+func appendHitStats(stats []common.Stat, prefix, tier string, hits, misses uint64) []common.Stat {
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+
+	return append(stats,
+		common.Stat{Name: prefix + "hits_" + tier, Value: strconv.FormatUint(hits, 10)},
+		common.Stat{Name: prefix + "misses_" + tier, Value: strconv.FormatUint(misses, 10)},
+		common.Stat{Name: prefix + "hit_ratio_" + tier, Value: strconv.FormatFloat(ratio, 'f', 4, 64)},
+	)
+}
+
+// HitCounting counts the hits and misses of the reads the orca sends to each tier. A nil hit
+// counter adds nothing.
+func HitCounting(oc OrcaConst, hc *HitCounter) OrcaConst {
+	if hc == nil {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		l1 = hitHandler{Handler: l1, hc: hc, tier: tierL1}
+		if l2 != nil {
+			l2 = hitHandler{Handler: l2, hc: hc, tier: tierL2}
+		}
+		return oc(l1, l2, res)
+	}
+}
+
+// hitHandler counts the responses of reads as they are passed on
+type hitHandler struct {
+	handlers.Handler
+	hc   *HitCounter
+	tier int
+}
+
+func (h hitHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resIn, errsIn := h.Handler.Get(cmd)
+	res := make(chan common.GetResponse)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		for resIn != nil || errsIn != nil {
+			select {
+			case r, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				h.hc.count(h.tier, r.Key, r.Miss)
+				res <- r
+
+			case err, ok := <-errsIn:
+				if !ok {
+					errsIn = nil
+					continue
+				}
+				errs <- err
+			}
+		}
+	}()
+
+	return res, errs
+}
+
+func (h hitHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resIn, errsIn := h.Handler.GetE(cmd)
+	res := make(chan common.GetEResponse)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		for resIn != nil || errsIn != nil {
+			select {
+			case r, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				h.hc.count(h.tier, r.Key, r.Miss)
+				res <- r
+
+			case err, ok := <-errsIn:
+				if !ok {
+					errsIn = nil
+					continue
+				}
+				errs <- err
+			}
+		}
+	}()
+
+	return res, errs
+}
+
+func (h hitHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	r, err := h.Handler.GAT(cmd)
+	if err == nil {
+		h.hc.count(h.tier, cmd.Key, r.Miss)
+	}
+	return r, err
+}
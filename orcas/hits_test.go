@@ -0,0 +1,95 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// prefixCounter returns the value of the counter kept for the prefix
+func prefixCounter(name, prefix string) uint64 {
+	for _, c := range metrics.Counters() {
+		if c.Name == name && c.Tgs["prefix"] == prefix {
+			return c.Val
+		}
+	}
+	return 0
+}
+
+func TestHitCounting(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+	hc := orcas.NewHitCounter([]string{"user:", "user:admin:", "user:"})
+
+	l1 := newTestMapHandler()
+	l2 := newTestMapHandler()
+	l1.data["user:1"] = "a"
+	l2.data["user:2"] = "b"
+	l2.data["user:admin:1"] = "c"
+
+	o := orcas.HitCounting(orcas.L1L2Batch, hc)(l1, l2, res)
+
+	before := map[string]uint64{}
+	names := []string{"tier_hits_l1", "tier_misses_l1", "tier_hits_l2", "tier_misses_l2"}
+	for _, n := range names {
+		before[n] = counter(n)
+	}
+	userBefore := prefixCounter("prefix_misses_l1", "user:")
+	adminBefore := prefixCounter("prefix_hits_l2", "user:admin:")
+
+	keys := [][]byte{[]byte("user:1"), []byte("user:2"), []byte("user:admin:1"), []byte("other")}
+	if err := o.Get(common.GetRequest{Keys: keys, Opaques: make([]uint32, len(keys)), Quiet: make([]bool, len(keys))}); err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+
+	// user:1 hits L1, the rest miss it, user:2 and user:admin:1 hit L2 and other misses both
+	want := map[string]uint64{"tier_hits_l1": 1, "tier_misses_l1": 3, "tier_hits_l2": 2, "tier_misses_l2": 1}
+	for _, n := range names {
+		if got := counter(n) - before[n]; got != want[n] {
+			t.Errorf("Expected %s to go up by %d, got %d", n, want[n], got)
+		}
+	}
+
+	// user:admin:1 is only counted under the longer prefix
+	if got := prefixCounter("prefix_misses_l1", "user:") - userBefore; got != 1 {
+		t.Errorf("Expected 1 L1 miss for user:, got %d", got)
+	}
+	if got := prefixCounter("prefix_hits_l2", "user:admin:") - adminBefore; got != 1 {
+		t.Errorf("Expected 1 L2 hit for user:admin:, got %d", got)
+	}
+
+	t.Run("Stats", func(t *testing.T) {
+		out := &strings.Builder{}
+		w := bufio.NewWriter(out)
+		o := orcas.L1Only(nil, nil, textprot.NewTextResponder(w))
+		if err := o.Stats(common.StatsRequest{}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		w.Flush()
+
+		for _, s := range []string{"STAT hit_ratio_l1 ", "STAT prefix:user::hits_l2 ", "STAT prefix:user:admin::hit_ratio_l2 "} {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("Expected stats to contain %q, got:\n%s", s, out.String())
+			}
+		}
+	})
+}
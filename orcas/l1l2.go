@@ -27,6 +27,8 @@ type L1L2Orca struct {
 	l1  handlers.Handler
 	l2  handlers.Handler
 	res common.Responder
+	// backfill, if set, puts L2 hits back into L1 in the background. See L1L2WithBackfill.
+	backfill *Backfiller
 }
 
 func L1L2(l1, l2 handlers.Handler, res common.Responder) Orca {
@@ -37,7 +39,40 @@ func L1L2(l1, l2 handlers.Handler, res common.Responder) Orca {
 	}
 }
 
+// casL2 does a conditional (CAS) write in L2 only. L2 has the authoritative copy of the item and
+// each tier assigns its own CAS values, so there is no single value that could be checked against
+// both. The key is then deleted from L1 so the next read pulls the new value up from L2, the same
+// as for incr and decr. It is deleted after a CAS mismatch as well, since the client may have
+// gotten its CAS from the copy in L1, so that its retry reads the item and its CAS from L2.
+func casL2(l1 handlers.Handler, key []byte, write func() error) error {
+	metrics.IncCounter(MetricCmdCasL2)
+
+	err := write()
+	if err == common.ErrKeyExists {
+		metrics.IncCounter(MetricCmdCasMismatchesL2)
+	} else if err != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdCasDeleteL1)
+	if derr := l1.Delete(common.DeleteRequest{Key: key}); derr != nil && derr != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdCasDeleteErrorsL1)
+		if err == nil {
+			return derr
+		}
+	}
+
+	return err
+}
+
 func (l *L1L2Orca) Set(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Set(req) }); err != nil {
+			return err
+		}
+		return l.res.Set(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("set", string(req.Key))
 
 	// Try L2 first
@@ -91,6 +126,13 @@ func (l *L1L2Orca) Set(req common.SetRequest) error {
 }
 
 func (l *L1L2Orca) Add(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Add(req) }); err != nil {
+			return err
+		}
+		return l.res.Add(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("add", string(req.Key))
 
 	// Add in L2 first, since it has the larger state
@@ -164,6 +206,13 @@ func (l *L1L2Orca) Add(req common.SetRequest) error {
 }
 
 func (l *L1L2Orca) Replace(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Replace(req) }); err != nil {
+			return err
+		}
+		return l.res.Replace(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("replace", string(req.Key))
 
 	// Replace in L2 first, since it has the larger state
@@ -240,6 +289,13 @@ func (l *L1L2Orca) Replace(req common.SetRequest) error {
 }
 
 func (l *L1L2Orca) Append(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Append(req) }); err != nil {
+			return err
+		}
+		return l.res.Append(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("append", string(req.Key))
 
 	// Ordering of append and prepend operations won't matter much unless
@@ -308,6 +364,13 @@ func (l *L1L2Orca) Append(req common.SetRequest) error {
 }
 
 func (l *L1L2Orca) Prepend(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Prepend(req) }); err != nil {
+			return err
+		}
+		return l.res.Prepend(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("prepend", string(req.Key))
 
 	metrics.IncCounter(MetricCmdPrependL2)
@@ -365,6 +428,13 @@ func (l *L1L2Orca) Prepend(req common.SetRequest) error {
 }
 
 func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Delete(req) }); err != nil {
+			return err
+		}
+		return l.res.Delete(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("delete", string(req.Key))
 
 	// Try L2 first
@@ -418,7 +488,7 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 			metrics.IncCounter(MetricCmdDeleteMissesL1)
 			metrics.IncCounter(MetricCmdDeleteHits)
 			// disregard the miss, don't return the error
-			return l.res.Delete(req.Opaque)
+			return l.res.Delete(req.Opaque, req.Quiet)
 		}
 		metrics.IncCounter(MetricCmdDeleteErrorsL1)
 		metrics.IncCounter(MetricCmdDeleteErrors)
@@ -428,7 +498,7 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 	metrics.IncCounter(MetricCmdDeleteHitsL1)
 	metrics.IncCounter(MetricCmdDeleteHits)
 
-	return l.res.Delete(req.Opaque)
+	return l.res.Delete(req.Opaque, req.Quiet)
 }
 
 func (l *L1L2Orca) Touch(req common.TouchRequest) error {
@@ -501,6 +571,7 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 
 func (l *L1L2Orca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
+	begin := timer.Now()
 	//debugString := "get"
 	//for _, k := range req.Keys {
 	//	debugString += " "
@@ -508,61 +579,72 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 	//}
 	//println(debugString)
 
-	metrics.IncCounter(MetricCmdGetL1)
-	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
-	start := timer.Now()
-
-	resChan, errChan := l.l1.Get(req)
-
 	var err error
 	//var lastres common.GetResponse
 	var l2keys [][]byte
 	var l2opaques []uint32
 	var l2quiets []bool
 
-	// Read all the responses back from L1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					l2keys = append(l2keys, res.Key)
-					l2opaques = append(l2opaques, res.Opaque)
-					l2quiets = append(l2quiets, res.Quiet)
+	if req.Cas {
+		// The CAS of an L1 hit would never match in L2, where CAS writes go, so gets that
+		// return CAS values are served from L2
+		metrics.IncCounter(MetricCmdGetCasL2)
+		l2keys, l2opaques, l2quiets = req.Keys, req.Opaques, req.Quiet
+	} else {
+		metrics.IncCounter(MetricCmdGetL1)
+		metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
+		start := timer.Now()
+
+		resChan, errChan := l.l1.Get(req)
+
+		// Read all the responses back from L1.
+		// The contract is that the resChan will have GetResponse's for get hits and misses,
+		// and the errChan will have any other errors, such as an out of memory error from
+		// memcached. If any receive happens from errChan, there will be no more responses
+		// from resChan.
+		for {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
 				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-					l.res.Get(res)
+					if res.Miss {
+						metrics.IncCounter(MetricCmdGetMissesL1)
+						l2keys = append(l2keys, res.Key)
+						l2opaques = append(l2opaques, res.Opaque)
+						l2quiets = append(l2quiets, res.Quiet)
+					} else {
+						metrics.IncCounter(MetricCmdGetHits)
+						metrics.IncCounter(MetricCmdGetHitsL1)
+
+						// L1's CAS is no use to a client since CAS writes are checked in L2
+						res.Cas = 0
+						l.res.Get(res)
+					}
+				}
+
+			case getErr, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					metrics.IncCounter(MetricCmdGetErrors)
+					metrics.IncCounter(MetricCmdGetErrorsL1)
+					err = getErr
 				}
 			}
 
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
+			if resChan == nil && errChan == nil {
+				break
 			}
 		}
 
-		if resChan == nil && errChan == nil {
-			break
-		}
+		// finish up metrics for overall L1 (batch) get operation
+		metrics.ObserveHist(HistGetL1, timer.Since(start))
 	}
 
-	// finish up metrics for overall L1 (batch) get operation
-	metrics.ObserveHist(HistGetL1, timer.Since(start))
-
 	// leave early on all hits
 	if len(l2keys) == 0 {
+		metrics.ObserveHist(HistGetServedL1, timer.Since(begin))
 		if err != nil {
 			return err
 		}
@@ -580,16 +662,21 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 
 	metrics.IncCounter(MetricCmdGetEL2)
 	metrics.IncCounterBy(MetricCmdGetEKeysL2, uint64(len(l2keys)))
-	start = timer.Now()
+	start := timer.Now()
 
 	resChanE, errChan := l.l2.GetE(req)
 
+	var answered int
+	var timedOut bool
+
 	for {
 		select {
 		case res, ok := <-resChanE:
 			if !ok {
 				resChanE = nil
 			} else {
+				answered++
+
 				if res.Miss {
 					metrics.IncCounter(MetricCmdGetEMissesL2)
 					// Missing L2 means a true miss
@@ -605,19 +692,23 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 						Data:    res.Data,
 					}
 
-					metrics.IncCounter(MetricCmdGetSetL1)
-					start2 := timer.Now()
+					if l.backfill != nil {
+						l.backfill.backfill(setreq)
+					} else {
+						metrics.IncCounter(MetricCmdGetSetL1)
+						start2 := timer.Now()
 
-					err = l.l1.Set(setreq)
+						err = l.l1.Set(setreq)
 
-					metrics.ObserveHist(HistSetL1, timer.Since(start2))
+						metrics.ObserveHist(HistSetL1, timer.Since(start2))
 
-					if err != nil {
-						metrics.IncCounter(MetricCmdGetSetErrorsL1)
-						return err
-					}
+						if err != nil {
+							metrics.IncCounter(MetricCmdGetSetErrorsL1)
+							return err
+						}
 
-					metrics.IncCounter(MetricCmdGetSetSucessL1)
+						metrics.IncCounter(MetricCmdGetSetSucessL1)
+					}
 
 					// overall operation is considered a hit
 					metrics.IncCounter(MetricCmdGetHits)
@@ -630,6 +721,7 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 					Miss:   res.Miss,
 					Opaque: res.Opaque,
 					Quiet:  res.Quiet,
+					Cas:    res.Cas,
 				}
 
 				l.res.Get(getres)
@@ -638,6 +730,10 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 		case getErr, ok := <-errChan:
 			if !ok {
 				errChan = nil
+			} else if getErr == common.ErrTimeout {
+				// A slow L2 shouldn't fail the keys that were already found in L1
+				metrics.IncCounter(MetricCmdGetTimeoutsL2)
+				timedOut = true
 			} else {
 				metrics.IncCounter(MetricCmdGetErrors)
 				metrics.IncCounter(MetricCmdGetEErrorsL2)
@@ -652,6 +748,11 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 
 	// finish up metrics for overall L2 (batch) get operation
 	metrics.ObserveHist(HistGetL2, timer.Since(start))
+	metrics.ObserveHist(HistGetServedL2, timer.Since(begin))
+
+	if err == nil && timedOut {
+		respondMisses(l.res, req, answered)
+	}
 
 	if err == nil {
 		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
@@ -767,6 +868,9 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 	} else {
 		metrics.IncCounter(MetricCmdGatHitsL1)
 
+		// L1's CAS is no use to a client since CAS writes are checked in L2
+		res.Cas = 0
+
 		// Touch in L2. This used to be a set operation, but touch allows the L2
 		// to have more control over the operation than a set does. This helps
 		// migrations internally at Netflix because we can choose to discount
@@ -829,6 +933,94 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 	return l.res.GAT(res)
 }
 
+func (l *L1L2Orca) Incr(req common.IncrDecrRequest) error {
+	//log.Println("incr", string(req.Key))
+
+	// The L2 holds the authoritative value, so the arithmetic is done there
+	metrics.IncCounter(MetricCmdIncrL2)
+	start := timer.Now()
+
+	val, err := l.l2.Incr(req)
+
+	metrics.ObserveHist(HistIncrL2, timer.Since(start))
+
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdIncrMissesL2)
+			metrics.IncCounter(MetricCmdIncrMisses)
+		} else {
+			metrics.IncCounter(MetricCmdIncrErrorsL2)
+			metrics.IncCounter(MetricCmdIncrErrors)
+		}
+		return err
+	}
+	metrics.IncCounter(MetricCmdIncrHitsL2)
+
+	// Doing the same operation in L1 could leave the two with different values if L1 had
+	// already lost or never had the key. Instead the key is deleted from L1 so the next read
+	// will pull the new value up from L2.
+	metrics.IncCounter(MetricCmdIncrDecrDeleteL1)
+	start = timer.Now()
+
+	err = l.l1.Delete(common.DeleteRequest{Key: req.Key})
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	if err != nil && err != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdIncrDecrDeleteErrorsL1)
+		metrics.IncCounter(MetricCmdIncrErrors)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdIncrHits)
+
+	return l.res.Incr(req.Opaque, val, req.Quiet)
+}
+
+func (l *L1L2Orca) Decr(req common.IncrDecrRequest) error {
+	//log.Println("decr", string(req.Key))
+
+	// The L2 holds the authoritative value, so the arithmetic is done there
+	metrics.IncCounter(MetricCmdDecrL2)
+	start := timer.Now()
+
+	val, err := l.l2.Decr(req)
+
+	metrics.ObserveHist(HistDecrL2, timer.Since(start))
+
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdDecrMissesL2)
+			metrics.IncCounter(MetricCmdDecrMisses)
+		} else {
+			metrics.IncCounter(MetricCmdDecrErrorsL2)
+			metrics.IncCounter(MetricCmdDecrErrors)
+		}
+		return err
+	}
+	metrics.IncCounter(MetricCmdDecrHitsL2)
+
+	// Doing the same operation in L1 could leave the two with different values if L1 had
+	// already lost or never had the key. Instead the key is deleted from L1 so the next read
+	// will pull the new value up from L2.
+	metrics.IncCounter(MetricCmdIncrDecrDeleteL1)
+	start = timer.Now()
+
+	err = l.l1.Delete(common.DeleteRequest{Key: req.Key})
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	if err != nil && err != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdIncrDecrDeleteErrorsL1)
+		metrics.IncCounter(MetricCmdDecrErrors)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdDecrHits)
+
+	return l.res.Decr(req.Opaque, val, req.Quiet)
+}
+
 func (l *L1L2Orca) Noop(req common.NoopRequest) error {
 	return l.res.Noop(req.Opaque)
 }
@@ -838,7 +1030,52 @@ func (l *L1L2Orca) Quit(req common.QuitRequest) error {
 }
 
 func (l *L1L2Orca) Version(req common.VersionRequest) error {
-	return l.res.Version(req.Opaque)
+	return l.res.Version(req.Opaque, versionString(l.l1, l.l2))
+}
+
+func (l *L1L2Orca) Verbosity(req common.VerbosityRequest) error {
+	return l.res.Verbosity(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2Orca) Flush(req common.FlushRequest) error {
+	// Flush L2 first for the same reason as delete. If L1 were flushed first, a get could miss
+	// in L1, hit in L2, and put the data back in L1 before L2 is flushed.
+	metrics.IncCounter(MetricCmdFlushL2)
+
+	if err := l.l2.Flush(req); err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL2)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdFlushL1)
+
+	if err := l.l1.Flush(req); err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL1)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	return l.res.Flush(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2Orca) Stats(req common.StatsRequest) error {
+	var stats []common.Stat
+	if len(req.Group) == 0 {
+		stats = rendStats()
+	}
+
+	stats, err := appendBackendStats(stats, "l1:", l.l1, req.Group)
+	if err != nil {
+		return err
+	}
+
+	stats, err = appendBackendStats(stats, "l2:", l.l2, req.Group)
+	if err != nil {
+		return err
+	}
+
+	return l.res.Stats(req.Opaque, stats)
 }
 
 func (l *L1L2Orca) Unknown(req common.Request) error {
@@ -856,3 +1093,17 @@ func (l *L1L2Orca) Error(req common.Request, reqType common.RequestType, err err
 
 	l.res.Error(opaque, reqType, err, quiet)
 }
+
+// respondMisses sends misses for the keys in req from index answered on. It is used when L2 times
+// out part way through a get, which leaves the remaining keys unanswered.
+func respondMisses(res common.Responder, req common.GetRequest, answered int) {
+	for i := answered; i < len(req.Keys); i++ {
+		metrics.IncCounter(MetricCmdGetMisses)
+		res.Get(common.GetResponse{
+			Key:    req.Keys[i],
+			Opaque: req.Opaques[i],
+			Quiet:  req.Quiet[i],
+			Miss:   true,
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/memcached/memcachedtest"
+	"github.com/hongst/rend/handlers/memcached/std"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// lookup reads the key straight from a tier and returns its value and CAS
+func lookup(t *testing.T, h handlers.Handler, key string) (string, uint64, bool) {
+	dataOut, errorOut := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	res := <-dataOut
+	for range dataOut {
+	}
+	if err := <-errorOut; err != nil {
+		t.Fatalf("Error reading %s: %v", key, err)
+	}
+	return string(res.Data), res.Cas, !res.Miss
+}
+
+// gets reads the key through an orca with the text gets command, the way a client gets the CAS
+// value for a later CAS write
+func gets(t *testing.T, oc orcas.OrcaConst, l1, l2 handlers.Handler, key string) (string, uint64, bool) {
+	out := &bytes.Buffer{}
+	w := bufio.NewWriter(out)
+	p, res := textprot.NewTextParserResponder(bufio.NewReader(strings.NewReader("gets "+key+"\r\n")), w)
+
+	req, _, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Error parsing gets: %v", err)
+	}
+	if err := oc(l1, l2, res).Get(req.(common.GetRequest)); err != nil {
+		t.Fatalf("Error reading %s: %v", key, err)
+	}
+	w.Flush()
+
+	if out.String() == "END\r\n" {
+		return "", 0, false
+	}
+	var k, data string
+	var flags, length int
+	var cas uint64
+	if _, err := fmt.Sscanf(out.String(), "VALUE %s %d %d %d\r\n%s\r\nEND\r\n", &k, &flags, &length, &cas, &data); err != nil {
+		t.Fatalf("Unexpected gets response %q: %v", out.String(), err)
+	}
+	return data, cas, true
+}
+
+func TestL1L2Cas(t *testing.T) {
+	for _, oc := range []orcas.OrcaConst{orcas.L1L2, orcas.L1L2Batch} {
+		s1 := memcachedtest.NewServer(t)
+		s2 := memcachedtest.NewServer(t)
+		l1 := std.NewHandler(s1.Dial(t))
+		l2 := std.NewHandler(s2.Dial(t))
+
+		// Start the tiers' CAS values apart
+		for i := 0; i < 10; i++ {
+			s2.Put("other", []byte("x"))
+		}
+
+		o := oc(l1, l2, textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard)))
+
+		if err := o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("v1")}); err != nil {
+			t.Fatalf("Error setting: %v", err)
+		}
+		// L1 has a copy with its own CAS, e.g. from a read that missed it. The batch orca doesn't
+		// write to L1 itself.
+		s1.Put("foo", []byte("v1"))
+		_, l1Cas, _ := lookup(t, l1, "foo")
+
+		// gets answers with L2's CAS even though L1 has the item
+		_, l2Cas, _ := gets(t, oc, l1, l2, "foo")
+		if _, cas, _ := lookup(t, l2, "foo"); l2Cas != cas {
+			t.Fatalf("Expected gets to return L2's CAS %d, got %d", cas, l2Cas)
+		}
+		s1.Put("foo", []byte("v1"))
+
+		// A CAS from L1's copy doesn't match L2, but it sends the retry to L2 for the item
+		err := o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("v2"), Cas: l1Cas})
+		if err != common.ErrKeyExists {
+			t.Fatalf("Expected a CAS from L1 not to match, got %v", err)
+		}
+		if _, _, ok := lookup(t, l1, "foo"); ok {
+			t.Fatal("Expected the key to be deleted from L1 after a mismatch")
+		}
+		s1.Put("foo", []byte("v1"))
+
+		// L2's CAS goes through and L1 is invalidated
+		if err := o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("v2"), Cas: l2Cas}); err != nil {
+			t.Fatalf("Expected the CAS set to work, got %v", err)
+		}
+		if _, _, ok := lookup(t, l1, "foo"); ok {
+			t.Fatal("Expected the key to be deleted from L1")
+		}
+		data, newCas, _ := gets(t, oc, l1, l2, "foo")
+		if data != "v2" {
+			t.Fatalf("Expected the new value in L2, got %q", data)
+		}
+
+		// The old CAS is stale now
+		if err := o.Replace(common.SetRequest{Key: []byte("foo"), Data: []byte("v3"), Cas: l2Cas}); err != common.ErrKeyExists {
+			t.Fatalf("Expected a stale CAS to fail, got %v", err)
+		}
+		if err := o.Append(common.SetRequest{Key: []byte("foo"), Data: []byte("+"), Cas: newCas}); err != nil {
+			t.Fatalf("Expected the CAS append to work, got %v", err)
+		}
+		if data, _, _ := lookup(t, l2, "foo"); data != "v2+" {
+			t.Fatalf("Expected the appended value in L2, got %q", data)
+		}
+
+		// A delete with the current CAS removes the item from both
+		s1.Put("foo", []byte("v2+"))
+		_, newCas, _ = gets(t, oc, l1, l2, "foo")
+		if err := o.Delete(common.DeleteRequest{Key: []byte("foo"), Cas: newCas}); err != nil {
+			t.Fatalf("Expected the CAS delete to work, got %v", err)
+		}
+		if _, _, ok := lookup(t, l1, "foo"); ok {
+			t.Fatal("Expected the key to be deleted from L1")
+		}
+		if _, _, ok := lookup(t, l2, "foo"); ok {
+			t.Fatal("Expected the key to be deleted from L2")
+		}
+
+		if err := o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("v4"), Cas: newCas}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected a CAS set of a missing key to fail, got %v", err)
+		}
+	}
+}
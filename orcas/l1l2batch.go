@@ -38,6 +38,13 @@ func L1L2Batch(l1, l2 handlers.Handler, res common.Responder) Orca {
 }
 
 func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Set(req) }); err != nil {
+			return err
+		}
+		return l.res.Set(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("set", string(req.Key))
 
 	// Try L2 first
@@ -84,6 +91,13 @@ func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
 }
 
 func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Add(req) }); err != nil {
+			return err
+		}
+		return l.res.Add(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("add", string(req.Key))
 
 	// Add in L2 first, since it has the larger state
@@ -140,6 +154,13 @@ func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
 }
 
 func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Replace(req) }); err != nil {
+			return err
+		}
+		return l.res.Replace(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("replace", string(req.Key))
 
 	// Add in L2 first, since it has the larger state
@@ -196,6 +217,13 @@ func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
 }
 
 func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Append(req) }); err != nil {
+			return err
+		}
+		return l.res.Append(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("append", string(req.Key))
 
 	// Ordering of append and prepend operations won't matter much unless
@@ -263,6 +291,13 @@ func (l *L1L2BatchOrca) Append(req common.SetRequest) error {
 }
 
 func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Prepend(req) }); err != nil {
+			return err
+		}
+		return l.res.Prepend(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("prepend", string(req.Key))
 
 	metrics.IncCounter(MetricCmdPrependL2)
@@ -320,6 +355,13 @@ func (l *L1L2BatchOrca) Prepend(req common.SetRequest) error {
 }
 
 func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
+	if req.Cas != 0 {
+		if err := casL2(l.l1, req.Key, func() error { return l.l2.Delete(req) }); err != nil {
+			return err
+		}
+		return l.res.Delete(req.Opaque, req.Quiet)
+	}
+
 	//log.Println("delete", string(req.Key))
 
 	// Try L2 first
@@ -373,7 +415,7 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 			metrics.IncCounter(MetricCmdDeleteMissesL1)
 			metrics.IncCounter(MetricCmdDeleteHits)
 			// disregard the miss, don't return the error
-			return l.res.Delete(req.Opaque)
+			return l.res.Delete(req.Opaque, req.Quiet)
 		}
 		metrics.IncCounter(MetricCmdDeleteErrorsL1)
 		metrics.IncCounter(MetricCmdDeleteErrors)
@@ -383,7 +425,7 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 	metrics.IncCounter(MetricCmdDeleteHitsL1)
 	metrics.IncCounter(MetricCmdDeleteHits)
 
-	return l.res.Delete(req.Opaque)
+	return l.res.Delete(req.Opaque, req.Quiet)
 }
 
 func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
@@ -451,6 +493,7 @@ func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
 
 func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
+	begin := timer.Now()
 	//debugString := "get"
 	//for _, k := range req.Keys {
 	//	debugString += " "
@@ -458,61 +501,72 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 	//}
 	//println(debugString)
 
-	metrics.IncCounter(MetricCmdGetL1)
-	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
-	start := timer.Now()
-
-	resChan, errChan := l.l1.Get(req)
-
 	var err error
 	//var lastres common.GetResponse
 	var l2keys [][]byte
 	var l2opaques []uint32
 	var l2quiets []bool
 
-	// Read all the responses back from L1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					l2keys = append(l2keys, res.Key)
-					l2opaques = append(l2opaques, res.Opaque)
-					l2quiets = append(l2quiets, res.Quiet)
+	if req.Cas {
+		// The CAS of an L1 hit would never match in L2, where CAS writes go, so gets that
+		// return CAS values are served from L2
+		metrics.IncCounter(MetricCmdGetCasL2)
+		l2keys, l2opaques, l2quiets = req.Keys, req.Opaques, req.Quiet
+	} else {
+		metrics.IncCounter(MetricCmdGetL1)
+		metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
+		start := timer.Now()
+
+		resChan, errChan := l.l1.Get(req)
+
+		// Read all the responses back from L1.
+		// The contract is that the resChan will have GetResponse's for get hits and misses,
+		// and the errChan will have any other errors, such as an out of memory error from
+		// memcached. If any receive happens from errChan, there will be no more responses
+		// from resChan.
+		for {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
 				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-					l.res.Get(res)
+					if res.Miss {
+						metrics.IncCounter(MetricCmdGetMissesL1)
+						l2keys = append(l2keys, res.Key)
+						l2opaques = append(l2opaques, res.Opaque)
+						l2quiets = append(l2quiets, res.Quiet)
+					} else {
+						metrics.IncCounter(MetricCmdGetHits)
+						metrics.IncCounter(MetricCmdGetHitsL1)
+
+						// L1's CAS is no use to a client since CAS writes are checked in L2
+						res.Cas = 0
+						l.res.Get(res)
+					}
+				}
+
+			case getErr, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					metrics.IncCounter(MetricCmdGetErrors)
+					metrics.IncCounter(MetricCmdGetErrorsL1)
+					err = getErr
 				}
 			}
 
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
+			if resChan == nil && errChan == nil {
+				break
 			}
 		}
 
-		if resChan == nil && errChan == nil {
-			break
-		}
+		// record metrics before going to L2
+		metrics.ObserveHist(HistGetL1, timer.Since(start))
 	}
 
-	// record metrics before going to L2
-	metrics.ObserveHist(HistGetL1, timer.Since(start))
-
 	// leave early on all hits
 	if len(l2keys) == 0 {
+		metrics.ObserveHist(HistGetServedL1, timer.Since(begin))
 		if err != nil {
 			return err
 		}
@@ -530,9 +584,12 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 
 	metrics.IncCounter(MetricCmdGetL2)
 	metrics.IncCounterBy(MetricCmdGetKeysL2, uint64(len(l2keys)))
-	start = timer.Now()
+	start := timer.Now()
+
+	resChan, errChan := l.l2.Get(req)
 
-	resChan, errChan = l.l2.Get(req)
+	var answered int
+	var timedOut bool
 
 	for {
 		select {
@@ -540,6 +597,8 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 			if !ok {
 				resChan = nil
 			} else {
+				answered++
+
 				if res.Miss {
 					metrics.IncCounter(MetricCmdGetMissesL2)
 					// Missing L2 means a true miss
@@ -563,6 +622,7 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 					Miss:   res.Miss,
 					Opaque: res.Opaque,
 					Quiet:  res.Quiet,
+					Cas:    res.Cas,
 				}
 
 				l.res.Get(getres)
@@ -571,6 +631,10 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 		case getErr, ok := <-errChan:
 			if !ok {
 				errChan = nil
+			} else if getErr == common.ErrTimeout {
+				// A slow L2 shouldn't fail the keys that were already found in L1
+				metrics.IncCounter(MetricCmdGetTimeoutsL2)
+				timedOut = true
 			} else {
 				metrics.IncCounter(MetricCmdGetErrors)
 				metrics.IncCounter(MetricCmdGetEErrorsL2)
@@ -584,6 +648,11 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 	}
 
 	metrics.ObserveHist(HistGetL2, timer.Since(start))
+	metrics.ObserveHist(HistGetServedL2, timer.Since(begin))
+
+	if err == nil && timedOut {
+		respondMisses(l.res, req, answered)
+	}
 
 	if err == nil {
 		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
@@ -667,6 +736,94 @@ func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
 	return l.res.GAT(res)
 }
 
+func (l *L1L2BatchOrca) Incr(req common.IncrDecrRequest) error {
+	//log.Println("incr", string(req.Key))
+
+	// The L2 holds the authoritative value, so the arithmetic is done there
+	metrics.IncCounter(MetricCmdIncrL2)
+	start := timer.Now()
+
+	val, err := l.l2.Incr(req)
+
+	metrics.ObserveHist(HistIncrL2, timer.Since(start))
+
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdIncrMissesL2)
+			metrics.IncCounter(MetricCmdIncrMisses)
+		} else {
+			metrics.IncCounter(MetricCmdIncrErrorsL2)
+			metrics.IncCounter(MetricCmdIncrErrors)
+		}
+		return err
+	}
+	metrics.IncCounter(MetricCmdIncrHitsL2)
+
+	// Doing the same operation in L1 could leave the two with different values if L1 had
+	// already lost or never had the key. Instead the key is deleted from L1 so the next read
+	// will pull the new value up from L2.
+	metrics.IncCounter(MetricCmdIncrDecrDeleteL1)
+	start = timer.Now()
+
+	err = l.l1.Delete(common.DeleteRequest{Key: req.Key})
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	if err != nil && err != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdIncrDecrDeleteErrorsL1)
+		metrics.IncCounter(MetricCmdIncrErrors)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdIncrHits)
+
+	return l.res.Incr(req.Opaque, val, req.Quiet)
+}
+
+func (l *L1L2BatchOrca) Decr(req common.IncrDecrRequest) error {
+	//log.Println("decr", string(req.Key))
+
+	// The L2 holds the authoritative value, so the arithmetic is done there
+	metrics.IncCounter(MetricCmdDecrL2)
+	start := timer.Now()
+
+	val, err := l.l2.Decr(req)
+
+	metrics.ObserveHist(HistDecrL2, timer.Since(start))
+
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdDecrMissesL2)
+			metrics.IncCounter(MetricCmdDecrMisses)
+		} else {
+			metrics.IncCounter(MetricCmdDecrErrorsL2)
+			metrics.IncCounter(MetricCmdDecrErrors)
+		}
+		return err
+	}
+	metrics.IncCounter(MetricCmdDecrHitsL2)
+
+	// Doing the same operation in L1 could leave the two with different values if L1 had
+	// already lost or never had the key. Instead the key is deleted from L1 so the next read
+	// will pull the new value up from L2.
+	metrics.IncCounter(MetricCmdIncrDecrDeleteL1)
+	start = timer.Now()
+
+	err = l.l1.Delete(common.DeleteRequest{Key: req.Key})
+
+	metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+	if err != nil && err != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdIncrDecrDeleteErrorsL1)
+		metrics.IncCounter(MetricCmdDecrErrors)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdDecrHits)
+
+	return l.res.Decr(req.Opaque, val, req.Quiet)
+}
+
 func (l *L1L2BatchOrca) Noop(req common.NoopRequest) error {
 	return l.res.Noop(req.Opaque)
 }
@@ -676,7 +833,52 @@ func (l *L1L2BatchOrca) Quit(req common.QuitRequest) error {
 }
 
 func (l *L1L2BatchOrca) Version(req common.VersionRequest) error {
-	return l.res.Version(req.Opaque)
+	return l.res.Version(req.Opaque, versionString(l.l1, l.l2))
+}
+
+func (l *L1L2BatchOrca) Verbosity(req common.VerbosityRequest) error {
+	return l.res.Verbosity(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2BatchOrca) Flush(req common.FlushRequest) error {
+	// Flush L2 first for the same reason as delete. If L1 were flushed first, a get could miss
+	// in L1, hit in L2, and put the data back in L1 before L2 is flushed.
+	metrics.IncCounter(MetricCmdFlushL2)
+
+	if err := l.l2.Flush(req); err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL2)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdFlushL1)
+
+	if err := l.l1.Flush(req); err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL1)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	return l.res.Flush(req.Opaque, req.Quiet)
+}
+
+func (l *L1L2BatchOrca) Stats(req common.StatsRequest) error {
+	var stats []common.Stat
+	if len(req.Group) == 0 {
+		stats = rendStats()
+	}
+
+	stats, err := appendBackendStats(stats, "l1:", l.l1, req.Group)
+	if err != nil {
+		return err
+	}
+
+	stats, err = appendBackendStats(stats, "l2:", l.l2, req.Group)
+	if err != nil {
+		return err
+	}
+
+	return l.res.Stats(req.Opaque, stats)
 }
 
 func (l *L1L2BatchOrca) Unknown(req common.Request) error {
@@ -15,6 +15,9 @@
 package orcas
 
 import (
+	"io"
+	"io/ioutil"
+
 	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/handlers"
 	"github.com/hongst/rend/metrics"
@@ -179,7 +182,7 @@ func (l *L1OnlyOrca) Delete(req common.DeleteRequest) error {
 		metrics.IncCounter(MetricCmdDeleteHits)
 		metrics.IncCounter(MetricCmdDeleteHitsL1)
 
-		l.res.Delete(req.Opaque)
+		l.res.Delete(req.Opaque, req.Quiet)
 
 	} else if err == common.ErrKeyNotFound {
 		metrics.IncCounter(MetricCmdDeleteMissesL1)
@@ -232,6 +235,11 @@ func (l *L1OnlyOrca) Get(req common.GetRequest) error {
 	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
 	start := timer.Now()
 
+	// Large hits can be written to the client as they are read from L1 instead of all at once
+	if sr, ok := l.res.(common.StreamingResponder); ok && sr.CanStream() {
+		req.Stream = true
+	}
+
 	resChan, errChan := l.l1.Get(req)
 
 	var err error
@@ -254,7 +262,23 @@ func (l *L1OnlyOrca) Get(req common.GetRequest) error {
 					metrics.IncCounter(MetricCmdGetHits)
 					metrics.IncCounter(MetricCmdGetHitsL1)
 				}
-				l.res.Get(res)
+				// Nothing more can go to the client after a broken stream
+				var resErr error
+				if err != common.ErrStreamAborted {
+					resErr = l.res.Get(res)
+				}
+				if res.Stream != nil {
+					// The handler can't move on until the whole stream is read, even if the
+					// client has gone away. Once part of a value is out, any failure means the
+					// client connection has to be dropped.
+					if _, drainErr := io.Copy(ioutil.Discard, res.Stream); drainErr != nil && resErr == nil {
+						resErr = drainErr
+					}
+					if resErr != nil && err != common.ErrStreamAborted {
+						metrics.IncCounter(MetricCmdGetStreamErrors)
+						err = common.ErrStreamAborted
+					}
+				}
 			}
 
 		case getErr, ok := <-errChan:
@@ -263,7 +287,9 @@ func (l *L1OnlyOrca) Get(req common.GetRequest) error {
 			} else {
 				metrics.IncCounter(MetricCmdGetErrors)
 				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
+				if err != common.ErrStreamAborted {
+					err = getErr
+				}
 			}
 		}
 
@@ -378,6 +404,60 @@ func (l *L1OnlyOrca) Gat(req common.GATRequest) error {
 	return err
 }
 
+func (l *L1OnlyOrca) Incr(req common.IncrDecrRequest) error {
+	//log.Println("incr", string(req.Key))
+
+	metrics.IncCounter(MetricCmdIncrL1)
+	start := timer.Now()
+
+	val, err := l.l1.Incr(req)
+
+	metrics.ObserveHist(HistIncrL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(MetricCmdIncrHitsL1)
+		metrics.IncCounter(MetricCmdIncrHits)
+
+		err = l.res.Incr(req.Opaque, val, req.Quiet)
+
+	} else if err == common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdIncrMissesL1)
+		metrics.IncCounter(MetricCmdIncrMisses)
+	} else {
+		metrics.IncCounter(MetricCmdIncrErrorsL1)
+		metrics.IncCounter(MetricCmdIncrErrors)
+	}
+
+	return err
+}
+
+func (l *L1OnlyOrca) Decr(req common.IncrDecrRequest) error {
+	//log.Println("decr", string(req.Key))
+
+	metrics.IncCounter(MetricCmdDecrL1)
+	start := timer.Now()
+
+	val, err := l.l1.Decr(req)
+
+	metrics.ObserveHist(HistDecrL1, timer.Since(start))
+
+	if err == nil {
+		metrics.IncCounter(MetricCmdDecrHitsL1)
+		metrics.IncCounter(MetricCmdDecrHits)
+
+		err = l.res.Decr(req.Opaque, val, req.Quiet)
+
+	} else if err == common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdDecrMissesL1)
+		metrics.IncCounter(MetricCmdDecrMisses)
+	} else {
+		metrics.IncCounter(MetricCmdDecrErrorsL1)
+		metrics.IncCounter(MetricCmdDecrErrors)
+	}
+
+	return err
+}
+
 func (l *L1OnlyOrca) Noop(req common.NoopRequest) error {
 	return l.res.Noop(req.Opaque)
 }
@@ -387,7 +467,37 @@ func (l *L1OnlyOrca) Quit(req common.QuitRequest) error {
 }
 
 func (l *L1OnlyOrca) Version(req common.VersionRequest) error {
-	return l.res.Version(req.Opaque)
+	return l.res.Version(req.Opaque, versionString(l.l1, nil))
+}
+
+func (l *L1OnlyOrca) Verbosity(req common.VerbosityRequest) error {
+	return l.res.Verbosity(req.Opaque, req.Quiet)
+}
+
+func (l *L1OnlyOrca) Flush(req common.FlushRequest) error {
+	metrics.IncCounter(MetricCmdFlushL1)
+
+	if err := l.l1.Flush(req); err != nil {
+		metrics.IncCounter(MetricCmdFlushErrorsL1)
+		metrics.IncCounter(MetricCmdFlushErrors)
+		return err
+	}
+
+	return l.res.Flush(req.Opaque, req.Quiet)
+}
+
+func (l *L1OnlyOrca) Stats(req common.StatsRequest) error {
+	var stats []common.Stat
+	if len(req.Group) == 0 {
+		stats = rendStats()
+	}
+
+	stats, err := appendBackendStats(stats, "l1:", l.l1, req.Group)
+	if err != nil {
+		return err
+	}
+
+	return l.res.Stats(req.Opaque, stats)
 }
 
 func (l *L1OnlyOrca) Unknown(req common.Request) error {
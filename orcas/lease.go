@@ -0,0 +1,250 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricCmdGetLeaseGranted = metrics.AddCounter("cmd_get_lease_granted", nil)
+	MetricCmdGetLeaseHeld    = metrics.AddCounter("cmd_get_lease_held", nil)
+	MetricCmdGetLeaseWaitHit = metrics.AddCounter("cmd_get_lease_wait_hits", nil)
+)
+
+// Leases hands out leases on keys that miss, so that when a popular key expires only one client
+// recomputes it instead of all of them at once. The first client to miss a key gets the lease.
+// Others that miss it while the lease is held wait up to the wait time for the key to be written
+// and get it again, and if it is still missing they are told that another client holds the lease.
+// A lease ends when the key is written or deleted, or after the number of seconds asked for.
+//
+// Only gets that ask for a lease, like meta gets with the N flag, take part. Leases are kept in
+// memory and shared by all connections to this proxy, but not with other proxies. Leases that
+// ran out without the key being written are forgotten every minute.
+type Leases struct {
+	wait   time.Duration
+	lock   sync.Mutex
+	leases map[string]*lease
+	swept  time.Time
+}
+
+type lease struct {
+	expires time.Time
+	// done is closed when the lease ends
+	done chan struct{}
+}
+
+// NewLeases makes an empty set of leases. Clients that miss a key another client has a lease on
+// wait up to wait for it to be written.
+func NewLeases(wait time.Duration) *Leases {
+	return &Leases{
+		wait:   wait,
+		leases: make(map[string]*lease),
+	}
+}
+
+// acquire takes the lease on a key for ttl seconds if no one holds it. Otherwise it returns a
+// channel that is closed when the current lease ends.
+func (l *Leases) acquire(key []byte, ttl uint32) (bool, <-chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) > time.Minute {
+		for k, cur := range l.leases {
+			if !now.Before(cur.expires) {
+				close(cur.done)
+				delete(l.leases, k)
+			}
+		}
+		l.swept = now
+	}
+
+	if cur, ok := l.leases[string(key)]; ok {
+		if now.Before(cur.expires) {
+			return false, cur.done
+		}
+		close(cur.done)
+	}
+
+	l.leases[string(key)] = &lease{
+		expires: now.Add(time.Duration(ttl) * time.Second),
+		done:    make(chan struct{}),
+	}
+	return true, nil
+}
+
+// release ends the lease on a key, if there is one
+func (l *Leases) release(key []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if cur, ok := l.leases[string(key)]; ok {
+		close(cur.done)
+		delete(l.leases, string(key))
+	}
+}
+
+// Leasing wraps an orca so that gets that ask for a lease take one through l, and writes end
+// the leases on their keys.
+func Leasing(oc OrcaConst, l *Leases) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		lr := &leaseResponder{Responder: res}
+		return &leaseOrca{
+			Orca:   oc(l1, l2, lr),
+			res:    res,
+			lr:     lr,
+			leases: l,
+		}
+	}
+}
+
+// leaseResponder holds back the misses and the end of a get while the orca is answering one that
+// asked for a lease, so the lease can be decided after the orca is done.
+type leaseResponder struct {
+	common.Responder
+	holding bool
+	missed  bool
+}
+
+func (r *leaseResponder) Get(response common.GetResponse) error {
+	if r.holding && response.Miss {
+		r.missed = true
+		return nil
+	}
+	return r.Responder.Get(response)
+}
+
+func (r *leaseResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	if r.holding {
+		return nil
+	}
+	return r.Responder.GetEnd(opaque, noopEnd)
+}
+
+func (r *leaseResponder) CanStream() bool {
+	sr, ok := r.Responder.(common.StreamingResponder)
+	return ok && sr.CanStream()
+}
+
+type leaseOrca struct {
+	Orca
+	res    common.Responder
+	lr     *leaseResponder
+	leases *Leases
+}
+
+// get runs the get in the wrapped orca and says whether the key missed
+func (o *leaseOrca) get(req common.GetRequest) (bool, error) {
+	o.lr.missed = false
+	err := o.Orca.Get(req)
+	return o.lr.missed, err
+}
+
+func (o *leaseOrca) Get(req common.GetRequest) error {
+	if req.Lease == 0 || len(req.Keys) != 1 {
+		return o.Orca.Get(req)
+	}
+
+	o.lr.holding = true
+	defer func() { o.lr.holding = false }()
+
+	key := req.Keys[0]
+
+	missed, err := o.get(req)
+	if err != nil || !missed {
+		return o.end(req, err)
+	}
+
+	granted, done := o.leases.acquire(key, req.Lease)
+	if !granted {
+		wait := time.NewTimer(o.leases.wait)
+		select {
+		case <-done:
+		case <-wait.C:
+		}
+		wait.Stop()
+
+		if missed, err = o.get(req); err != nil || !missed {
+			if err == nil {
+				metrics.IncCounter(MetricCmdGetLeaseWaitHit)
+			}
+			return o.end(req, err)
+		}
+		granted, _ = o.leases.acquire(key, req.Lease)
+	}
+
+	response := common.GetResponse{
+		Key:    key,
+		Opaque: req.Opaques[0],
+		Quiet:  req.Quiet[0],
+		Miss:   true,
+		Lease:  common.LeaseHeld,
+	}
+	if granted {
+		metrics.IncCounter(MetricCmdGetLeaseGranted)
+		response.Lease = common.LeaseGranted
+	} else {
+		metrics.IncCounter(MetricCmdGetLeaseHeld)
+	}
+
+	if err := o.res.Get(response); err != nil {
+		return err
+	}
+	return o.end(req, nil)
+}
+
+// end finishes a get that asked for a lease the same way the wrapped orca would have
+func (o *leaseOrca) end(req common.GetRequest, err error) error {
+	if err != nil {
+		return err
+	}
+	return o.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (o *leaseOrca) Set(req common.SetRequest) error {
+	defer o.leases.release(req.Key)
+	return o.Orca.Set(req)
+}
+
+func (o *leaseOrca) Add(req common.SetRequest) error {
+	defer o.leases.release(req.Key)
+	return o.Orca.Add(req)
+}
+
+func (o *leaseOrca) Replace(req common.SetRequest) error {
+	defer o.leases.release(req.Key)
+	return o.Orca.Replace(req)
+}
+
+func (o *leaseOrca) Append(req common.SetRequest) error {
+	defer o.leases.release(req.Key)
+	return o.Orca.Append(req)
+}
+
+func (o *leaseOrca) Prepend(req common.SetRequest) error {
+	defer o.leases.release(req.Key)
+	return o.Orca.Prepend(req)
+}
+
+func (o *leaseOrca) Delete(req common.DeleteRequest) error {
+	defer o.leases.release(req.Key)
+	return o.Orca.Delete(req)
+}
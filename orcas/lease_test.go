@@ -0,0 +1,88 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+func TestLeasing(t *testing.T) {
+	l1 := newTestMapHandler()
+	leases := orcas.NewLeases(10 * time.Millisecond)
+
+	// get runs a meta get that asks for a lease on a connection of its own and returns what the
+	// client was sent
+	get := func(t *testing.T) (orcas.Orca, string) {
+		out := &bytes.Buffer{}
+		w := bufio.NewWriter(out)
+		p, res := textprot.NewTextParserResponder(bufio.NewReader(strings.NewReader("mg foo v N30\r\n")), w)
+
+		req, _, _, err := p.Parse()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		o := orcas.Leasing(orcas.L1Only, leases)(l1, nil, res)
+		if err := o.Get(req.(common.GetRequest)); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		w.Flush()
+		return o, out.String()
+	}
+
+	holder, out := get(t)
+	if out != "VA 0 W\r\n\r\n" {
+		t.Fatalf("Expected the first miss to get the lease, got %q", out)
+	}
+
+	start := time.Now()
+	if _, out := get(t); out != "VA 0 Z\r\n\r\n" {
+		t.Fatalf("Expected the second miss to be told the lease is held, got %q", out)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatalf("Expected the second miss to wait for the lease")
+	}
+
+	// A client that is waiting gets the value as soon as the holder sets it
+	leases = orcas.NewLeases(time.Minute)
+	holder, _ = get(t)
+
+	done := make(chan string)
+	go func() {
+		_, out := get(t)
+		done <- out
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := holder.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+
+	select {
+	case out := <-done:
+		if out != "VA 3\r\nbar\r\n" {
+			t.Fatalf("Expected the waiting client to get the new value, got %q", out)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the set to end the lease")
+	}
+}
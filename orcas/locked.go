@@ -320,6 +320,22 @@ func (l *LockedOrca) Gat(req common.GATRequest) error {
 	return ret
 }
 
+func (l *LockedOrca) Incr(req common.IncrDecrRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	ret := l.wrapped.Incr(req)
+	return ret
+}
+
+func (l *LockedOrca) Decr(req common.IncrDecrRequest) error {
+	lock := l.getlock(req.Key, false)
+	lock.Lock()
+	defer lock.Unlock()
+	ret := l.wrapped.Decr(req)
+	return ret
+}
+
 func (l *LockedOrca) Noop(req common.NoopRequest) error {
 	return l.wrapped.Noop(req)
 }
@@ -332,6 +348,20 @@ func (l *LockedOrca) Version(req common.VersionRequest) error {
 	return l.wrapped.Version(req)
 }
 
+func (l *LockedOrca) Verbosity(req common.VerbosityRequest) error {
+	return l.wrapped.Verbosity(req)
+}
+
+// Flush is not locked. It applies to every key, so there is no single lock to take, and the
+// backends handle a flush atomically on their own.
+func (l *LockedOrca) Flush(req common.FlushRequest) error {
+	return l.wrapped.Flush(req)
+}
+
+func (l *LockedOrca) Stats(req common.StatsRequest) error {
+	return l.wrapped.Stats(req)
+}
+
 func (l *LockedOrca) Unknown(req common.Request) error {
 	return l.wrapped.Unknown(req)
 }
@@ -0,0 +1,203 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricCmdOOMErrors          = metrics.AddCounter("cmd_oom_errors", nil)
+	MetricCmdOOMRetries         = metrics.AddCounter("cmd_oom_retries", nil)
+	MetricCmdOOMRetrySuccess    = metrics.AddCounter("cmd_oom_retry_success", nil)
+	MetricCmdOOMFallbacks       = metrics.AddCounter("cmd_oom_fallbacks", nil)
+	MetricCmdOOMFallbackSuccess = metrics.AddCounter("cmd_oom_fallback_success", nil)
+	MetricCmdOOMTempFailures    = metrics.AddCounter("cmd_oom_temp_failures", nil)
+)
+
+// OOMPolicy decides what happens when a backend responds to a store command
+// with an out of memory or temporary failure error.
+type OOMPolicy int
+
+const (
+	// OOMPassthrough returns the backend's error unchanged. This is the
+	// historical behavior.
+	OOMPassthrough OOMPolicy = iota
+	// OOMRetry retries the command against the same backend with exponential
+	// backoff. If all retries fail, common.ErrTempFailure is returned.
+	OOMRetry
+	// OOMFallback sends a set that L2 has no memory for to L1 instead, and the
+	// orca's own L1 write of the same set is skipped since it is already done.
+	// Only plain sets are redirected since add, replace, append, prepend and
+	// CAS sets depend on the state of the original tier. L1 doesn't fall back to L2,
+	// since the orcas write L2 first and it already has the value. Anything
+	// that can't fall back gets common.ErrTempFailure.
+	OOMFallback
+	// OOMTempFailure returns common.ErrTempFailure to the client immediately
+	// so it knows the request can be retried.
+	OOMTempFailure
+)
+
+// OOMConfig holds the settings used by OOMHandling.
+type OOMConfig struct {
+	Policy OOMPolicy
+	// Retries is the maximum number of retries for the OOMRetry policy.
+	Retries int
+	// Backoff is the delay before the first retry. It doubles each retry.
+	Backoff time.Duration
+}
+
+// OOMHandling wraps the handlers given to an orca so that out of memory and
+// temporary failure errors from the backend are handled according to the
+// given config. The orca itself is unaware of the wrapping, so it sees either
+// success or a single distinct error per request.
+func OOMHandling(oc OrcaConst, conf OOMConfig) OrcaConst {
+	if conf.Policy == OOMPassthrough {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		var wl1, wl2 handlers.Handler
+		fb := &oomFallback{}
+
+		if l1 != nil {
+			wl1 = oomHandler{Handler: l1, conf: conf, fb: fb}
+		}
+		if l2 != nil {
+			wl2 = oomHandler{Handler: l2, other: l1, conf: conf, fb: fb}
+		}
+
+		return oc(wl1, wl2, res)
+	}
+}
+
+func isOOM(err error) bool {
+	return err == common.ErrNoMem || err == common.ErrTempFailure
+}
+
+// oomFallback remembers the key of the last set that L2 sent to L1 instead,
+// so the L1 set the orca does next for the same request is skipped. It is
+// shared by the L1 and L2 handlers of one orca.
+type oomFallback struct {
+	lock    sync.Mutex
+	key     []byte
+	pending bool
+}
+
+func (f *oomFallback) set(key []byte) {
+	f.lock.Lock()
+	f.key = append(f.key[:0], key...)
+	f.pending = true
+	f.lock.Unlock()
+}
+
+// take reports whether the key was just written by a fallback and forgets it
+func (f *oomFallback) take(key []byte) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	done := f.pending && bytes.Equal(f.key, key)
+	f.pending = false
+	return done
+}
+
+// oomHandler intercepts the store commands on a handler. All other commands
+// go straight through to the embedded handler. Only the L2 handler has an
+// other tier to fall back to.
+type oomHandler struct {
+	handlers.Handler
+	other handlers.Handler
+	conf  OOMConfig
+	fb    *oomFallback
+}
+
+func (h oomHandler) Set(cmd common.SetRequest) error {
+	if h.other == nil && h.fb.take(cmd.Key) {
+		return nil
+	}
+	return h.handle(cmd, h.Handler.Set, true)
+}
+
+func (h oomHandler) Add(cmd common.SetRequest) error {
+	return h.handle(cmd, h.Handler.Add, false)
+}
+
+func (h oomHandler) Replace(cmd common.SetRequest) error {
+	return h.handle(cmd, h.Handler.Replace, false)
+}
+
+func (h oomHandler) Append(cmd common.SetRequest) error {
+	return h.handle(cmd, h.Handler.Append, false)
+}
+
+func (h oomHandler) Prepend(cmd common.SetRequest) error {
+	return h.handle(cmd, h.Handler.Prepend, false)
+}
+
+func (h oomHandler) handle(cmd common.SetRequest, f func(common.SetRequest) error, canFallback bool) error {
+	// Any L2 store starts a new request, so a fallback that the orca didn't
+	// follow with an L1 set is forgotten
+	if h.other != nil {
+		h.fb.take(nil)
+	}
+
+	err := f(cmd)
+	// A streamed value has already been read, so there is nothing left to try again with
+	if !isOOM(err) || cmd.Stream != nil {
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdOOMErrors)
+
+	switch h.conf.Policy {
+	case OOMRetry:
+		backoff := h.conf.Backoff
+		for i := 0; i < h.conf.Retries; i++ {
+			time.Sleep(backoff)
+			backoff *= 2
+
+			metrics.IncCounter(MetricCmdOOMRetries)
+			err = f(cmd)
+			if !isOOM(err) {
+				if err == nil {
+					metrics.IncCounter(MetricCmdOOMRetrySuccess)
+				}
+				return err
+			}
+		}
+
+	case OOMFallback:
+		// A CAS value only means something to the tier that handed it out
+		if canFallback && h.other != nil && cmd.Cas == 0 {
+			metrics.IncCounter(MetricCmdOOMFallbacks)
+			err = h.other.Set(cmd)
+			if !isOOM(err) {
+				if err == nil {
+					metrics.IncCounter(MetricCmdOOMFallbackSuccess)
+					h.fb.set(cmd.Key)
+				}
+				return err
+			}
+		}
+	}
+
+	metrics.IncCounter(MetricCmdOOMTempFailures)
+	return common.ErrTempFailure
+}
@@ -0,0 +1,197 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testOOMHandler fails the first n store commands with ErrNoMem, where n is
+// the initial value of fails
+type testOOMHandler struct {
+	handlers.Handler
+	fails int
+	sets  int
+}
+
+func (h *testOOMHandler) Set(cmd common.SetRequest) error {
+	h.sets++
+	if h.fails > 0 {
+		h.fails--
+		return common.ErrNoMem
+	}
+	return nil
+}
+
+func (h *testOOMHandler) Add(cmd common.SetRequest) error {
+	return h.Set(cmd)
+}
+
+// testHandlerOrca passes sets straight through to L1
+type testHandlerOrca struct {
+	testPanicOrca
+	l1 handlers.Handler
+}
+
+func (t testHandlerOrca) Set(req common.SetRequest) error { return t.l1.Set(req) }
+func (t testHandlerOrca) Add(req common.SetRequest) error { return t.l1.Add(req) }
+
+func testHandlerOrcaConst(l1, l2 handlers.Handler, res common.Responder) orcas.Orca {
+	return testHandlerOrca{l1: l1}
+}
+
+// testL2OrcaConst builds an orca that passes sets straight through to L2
+func testL2OrcaConst(l1, l2 handlers.Handler, res common.Responder) orcas.Orca {
+	return testHandlerOrca{l1: l2}
+}
+
+func TestOOMHandling(t *testing.T) {
+	t.Run("Passthrough", func(t *testing.T) {
+		l1 := &testOOMHandler{fails: 1}
+		o := orcas.OOMHandling(testHandlerOrcaConst, orcas.OOMConfig{})(l1, nil, nil)
+
+		if err := o.Set(common.SetRequest{}); err != common.ErrNoMem {
+			t.Fatalf("Expected ErrNoMem, got %v", err)
+		}
+	})
+	t.Run("Retry", func(t *testing.T) {
+		l1 := &testOOMHandler{fails: 2}
+		conf := orcas.OOMConfig{Policy: orcas.OOMRetry, Retries: 2}
+		o := orcas.OOMHandling(testHandlerOrcaConst, conf)(l1, nil, nil)
+
+		if err := o.Set(common.SetRequest{}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if l1.sets != 3 {
+			t.Fatalf("Expected 3 attempts, got %d", l1.sets)
+		}
+	})
+	t.Run("RetryExhausted", func(t *testing.T) {
+		l1 := &testOOMHandler{fails: 3}
+		conf := orcas.OOMConfig{Policy: orcas.OOMRetry, Retries: 2}
+		o := orcas.OOMHandling(testHandlerOrcaConst, conf)(l1, nil, nil)
+
+		if err := o.Set(common.SetRequest{}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+	})
+	t.Run("Fallback", func(t *testing.T) {
+		l1 := &testOOMHandler{}
+		l2 := &testOOMHandler{fails: 1}
+		conf := orcas.OOMConfig{Policy: orcas.OOMFallback}
+		o := orcas.OOMHandling(testL2OrcaConst, conf)(l1, l2, nil)
+
+		if err := o.Set(common.SetRequest{}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if l1.sets != 1 {
+			t.Fatalf("Expected set to fall back to L1")
+		}
+	})
+	t.Run("FallbackL1", func(t *testing.T) {
+		l1 := &testOOMHandler{fails: 1}
+		l2 := &testOOMHandler{}
+		conf := orcas.OOMConfig{Policy: orcas.OOMFallback}
+		o := orcas.OOMHandling(testHandlerOrcaConst, conf)(l1, l2, nil)
+
+		if err := o.Set(common.SetRequest{}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+		if l2.sets != 0 {
+			t.Fatalf("Expected set not to fall back to L2")
+		}
+	})
+	t.Run("FallbackAdd", func(t *testing.T) {
+		l1 := &testOOMHandler{}
+		l2 := &testOOMHandler{fails: 1}
+		conf := orcas.OOMConfig{Policy: orcas.OOMFallback}
+		o := orcas.OOMHandling(testL2OrcaConst, conf)(l1, l2, nil)
+
+		if err := o.Add(common.SetRequest{}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+		if l1.sets != 0 {
+			t.Fatalf("Expected add not to fall back to L1")
+		}
+	})
+	t.Run("FallbackCAS", func(t *testing.T) {
+		l1 := &testOOMHandler{}
+		l2 := &testOOMHandler{fails: 1}
+		conf := orcas.OOMConfig{Policy: orcas.OOMFallback}
+		o := orcas.OOMHandling(testL2OrcaConst, conf)(l1, l2, nil)
+
+		if err := o.Set(common.SetRequest{Cas: 42}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+		if l1.sets != 0 {
+			t.Fatalf("Expected CAS set not to fall back to L1")
+		}
+	})
+	t.Run("TempFailure", func(t *testing.T) {
+		l1 := &testOOMHandler{fails: 1}
+		conf := orcas.OOMConfig{Policy: orcas.OOMTempFailure}
+		o := orcas.OOMHandling(testHandlerOrcaConst, conf)(l1, nil, nil)
+
+		if err := o.Set(common.SetRequest{}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+	})
+}
+
+func TestOOMFallbackL1L2(t *testing.T) {
+	conf := orcas.OOMConfig{Policy: orcas.OOMFallback}
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+	req := common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}
+
+	t.Run("L2", func(t *testing.T) {
+		l1 := &testOOMHandler{}
+		l2 := &testOOMHandler{fails: 1}
+		o := orcas.OOMHandling(orcas.L1L2, conf)(l1, l2, res)
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if l1.sets != 1 {
+			t.Fatalf("Expected 1 set in L1, got %d", l1.sets)
+		}
+
+		// The next set of the same key is written to L1 as usual
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if l1.sets != 2 || l2.sets != 2 {
+			t.Fatalf("Expected 2 sets in each tier, got %d in L1 and %d in L2", l1.sets, l2.sets)
+		}
+	})
+	t.Run("L1", func(t *testing.T) {
+		l1 := &testOOMHandler{fails: 1}
+		l2 := &testOOMHandler{}
+		o := orcas.OOMHandling(orcas.L1L2, conf)(l1, l2, res)
+
+		if err := o.Set(req); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+		if l2.sets != 1 {
+			t.Fatalf("Expected 1 set in L2, got %d", l2.sets)
+		}
+	})
+}
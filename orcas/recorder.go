@@ -0,0 +1,248 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+// RecordedRequest is what a Recorder keeps about one request. Keys are hashed so the recording
+// can be handed around without the client's keys in it.
+type RecordedRequest struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	KeyHash string    `json:"key_hash"`
+	// Keys is the number of keys, which is more than 1 for batch gets. The hash and size are of
+	// the first.
+	Keys      int `json:"keys"`
+	KeySize   int `json:"key_size"`
+	ValueSize int `json:"value_size,omitempty"`
+	// Hits is the number of keys a get found
+	Hits      int    `json:"hits,omitempty"`
+	LatencyUs int64  `json:"latency_us"`
+	Result    string `json:"result"`
+	// Client is the address of the client, if known
+	Client string `json:"client,omitempty"`
+
+	// key is the first key, for sinks that keep keys. It may point into a buffer that is reused
+	// once the request is done, so it must be copied to be kept.
+	key []byte
+}
+
+// RequestSink is given every request made through an orca wrapped by RecordingTo
+type RequestSink interface {
+	Record(rr RecordedRequest)
+}
+
+// Recorder is a flight recorder for the last requests made through the proxy, to see what led up
+// to a problem after the fact. It keeps a fixed number of requests, dropping the oldest, and is
+// shared by all connections. It serves them as JSON over HTTP, oldest first.
+type Recorder struct {
+	lock sync.Mutex
+	reqs []RecordedRequest
+	next int
+	full bool
+}
+
+// NewRecorder makes a recorder that keeps the last size requests
+func NewRecorder(size int) *Recorder {
+	return &Recorder{reqs: make([]RecordedRequest, size)}
+}
+
+// Record adds the request, dropping the oldest one if the recorder is full
+func (r *Recorder) Record(rr RecordedRequest) {
+	rr.key = nil
+
+	r.lock.Lock()
+	r.reqs[r.next] = rr
+	r.next++
+	if r.next == len(r.reqs) {
+		r.next = 0
+		r.full = true
+	}
+	r.lock.Unlock()
+}
+
+// Requests returns the recorded requests, oldest first
+func (r *Recorder) Requests() []RecordedRequest {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.full {
+		return append([]RecordedRequest{}, r.reqs[:r.next]...)
+	}
+	return append(append([]RecordedRequest{}, r.reqs[r.next:]...), r.reqs[:r.next]...)
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(r.Requests())
+}
+
+// Recording records every request sent to the orca in r. A nil r adds nothing.
+func Recording(oc OrcaConst, r *Recorder) OrcaConst {
+	if r == nil {
+		return oc
+	}
+	return RecordingTo(oc, r, "")
+}
+
+// RecordingTo gives every request sent to the orca to the sink, with the address of the client
+// that made it
+func RecordingTo(oc OrcaConst, sink RequestSink, client string) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		rr := &recordingResponder{Responder: res}
+		return recordingOrca{
+			Orca:   oc(l1, l2, rr),
+			rr:     rr,
+			sink:   sink,
+			client: client,
+		}
+	}
+}
+
+// recordingResponder counts the hits of the get being recorded
+type recordingResponder struct {
+	common.Responder
+	hits int
+}
+
+func (r *recordingResponder) Get(response common.GetResponse) error {
+	if !response.Miss {
+		r.hits++
+	}
+	return r.Responder.Get(response)
+}
+
+func (r *recordingResponder) GetE(response common.GetEResponse) error {
+	if !response.Miss {
+		r.hits++
+	}
+	return r.Responder.GetE(response)
+}
+
+func (r *recordingResponder) CanStream() bool {
+	sr, ok := r.Responder.(common.StreamingResponder)
+	return ok && sr.CanStream()
+}
+
+type recordingOrca struct {
+	Orca
+	rr     *recordingResponder
+	sink   RequestSink
+	client string
+}
+
+// do runs the request and records it with how long it took and how it ended
+func (o recordingOrca) do(op string, keys [][]byte, valueSize int, f func() error) error {
+	o.rr.hits = 0
+	start := time.Now()
+	err := f()
+
+	rr := RecordedRequest{
+		Time:      start,
+		Op:        op,
+		Keys:      len(keys),
+		ValueSize: valueSize,
+		LatencyUs: int64(time.Since(start) / time.Microsecond),
+		Result:    "ok",
+		Client:    o.client,
+	}
+	if len(keys) > 0 {
+		h := fnv.New64a()
+		h.Write(keys[0])
+		rr.KeyHash = strconv.FormatUint(h.Sum64(), 16)
+		rr.KeySize = len(keys[0])
+		rr.key = keys[0]
+	}
+	if op == "get" || op == "gete" || op == "gat" {
+		rr.Hits = o.rr.hits
+	}
+	if err != nil {
+		rr.Result = err.Error()
+	}
+
+	o.sink.Record(rr)
+	return err
+}
+
+func setSize(req common.SetRequest) int {
+	if req.Stream != nil {
+		return req.Length
+	}
+	return len(req.Data)
+}
+
+func (o recordingOrca) Set(req common.SetRequest) error {
+	return o.do("set", [][]byte{req.Key}, setSize(req), func() error { return o.Orca.Set(req) })
+}
+
+func (o recordingOrca) Add(req common.SetRequest) error {
+	return o.do("add", [][]byte{req.Key}, setSize(req), func() error { return o.Orca.Add(req) })
+}
+
+func (o recordingOrca) Replace(req common.SetRequest) error {
+	return o.do("replace", [][]byte{req.Key}, setSize(req), func() error { return o.Orca.Replace(req) })
+}
+
+func (o recordingOrca) Append(req common.SetRequest) error {
+	return o.do("append", [][]byte{req.Key}, setSize(req), func() error { return o.Orca.Append(req) })
+}
+
+func (o recordingOrca) Prepend(req common.SetRequest) error {
+	return o.do("prepend", [][]byte{req.Key}, setSize(req), func() error { return o.Orca.Prepend(req) })
+}
+
+func (o recordingOrca) Delete(req common.DeleteRequest) error {
+	return o.do("delete", [][]byte{req.Key}, 0, func() error { return o.Orca.Delete(req) })
+}
+
+func (o recordingOrca) Touch(req common.TouchRequest) error {
+	return o.do("touch", [][]byte{req.Key}, 0, func() error { return o.Orca.Touch(req) })
+}
+
+func (o recordingOrca) Get(req common.GetRequest) error {
+	return o.do("get", req.Keys, 0, func() error { return o.Orca.Get(req) })
+}
+
+func (o recordingOrca) GetE(req common.GetRequest) error {
+	return o.do("gete", req.Keys, 0, func() error { return o.Orca.GetE(req) })
+}
+
+func (o recordingOrca) Gat(req common.GATRequest) error {
+	return o.do("gat", [][]byte{req.Key}, 0, func() error { return o.Orca.Gat(req) })
+}
+
+func (o recordingOrca) Incr(req common.IncrDecrRequest) error {
+	return o.do("incr", [][]byte{req.Key}, 0, func() error { return o.Orca.Incr(req) })
+}
+
+func (o recordingOrca) Decr(req common.IncrDecrRequest) error {
+	return o.do("decr", [][]byte{req.Key}, 0, func() error { return o.Orca.Decr(req) })
+}
+
+func (o recordingOrca) Flush(req common.FlushRequest) error {
+	return o.do("flush", nil, 0, func() error { return o.Orca.Flush(req) })
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+func TestRecorder(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+	r := orcas.NewRecorder(3)
+	o := orcas.Recording(orcas.L1Only, r)(newTestMapHandler(), nil, res)
+
+	get := func(key string) {
+		o.Get(common.GetRequest{Keys: [][]byte{[]byte(key)}, Opaques: []uint32{0}, Quiet: []bool{false}})
+	}
+
+	o.Set(common.SetRequest{Key: []byte("first"), Data: []byte("a")})
+	o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("abc")})
+	get("foo")
+	get("bar")
+	o.Delete(common.DeleteRequest{Key: []byte("bar")})
+
+	reqs := r.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("Expected the last 3 requests, got %d", len(reqs))
+	}
+
+	if reqs[0].Op != "get" || reqs[0].Hits != 1 || reqs[0].KeySize != 3 {
+		t.Errorf("Expected the hit on foo first, got %+v", reqs[0])
+	}
+	if reqs[1].Op != "get" || reqs[1].Hits != 0 || reqs[1].Result != "ok" {
+		t.Errorf("Expected the miss on bar next, got %+v", reqs[1])
+	}
+	if reqs[2].Op != "delete" || reqs[2].Result != common.ErrKeyNotFound.Error() {
+		t.Errorf("Expected the failed delete last, got %+v", reqs[2])
+	}
+	if reqs[1].KeyHash == "" || reqs[1].KeyHash != reqs[2].KeyHash {
+		t.Errorf("Expected the same key to have the same hash, got %q and %q", reqs[1].KeyHash, reqs[2].KeyHash)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/requests", nil))
+
+	var served []orcas.RecordedRequest
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("Expected JSON, got %v", err)
+	}
+	if len(served) != 3 || served[2].Op != "delete" {
+		t.Errorf("Expected the same requests over HTTP, got %+v", served)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var MetricCmdGetEarlyRefresh = metrics.AddCounter("cmd_get_early_refresh", nil)
+
+// EarlyRefreshConfig holds the settings used by EarlyRefresh.
+type EarlyRefreshConfig struct {
+	// TTL is the TTL clients set items with. Backends only say when an item expires, not how long
+	// it was set for, so the window is a part of this TTL instead of each item's own.
+	TTL time.Duration
+	// Percent is how much of the TTL, at the end of an item's life, hits can be turned into misses
+	Percent float64
+	// Probability is the chance that a hit inside the window is turned into a miss
+	Probability float64
+}
+
+// EarlyRefresh wraps the handlers given to an orca so that a hit on an item that is about to
+// expire is now and then answered as a miss. The requester that gets the miss fetches the value
+// from the backing store and sets it again, so a hot key is refreshed by a few requesters before
+// it expires instead of by all of them at once after. A key turned into a miss in L1 is a miss in
+// L2 as well for the same request, since L2 would otherwise answer with the same old value.
+// Streamed gets can't say when an item expires, so large values are not streamed to clients.
+func EarlyRefresh(oc OrcaConst, conf EarlyRefreshConfig) OrcaConst {
+	window := uint32(conf.TTL.Seconds() * conf.Percent / 100)
+	if window == 0 || conf.Probability <= 0 {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		s := &refreshState{
+			window:      window,
+			probability: conf.Probability,
+			refreshing:  make(map[string]struct{}),
+		}
+
+		var wl1, wl2 handlers.Handler
+
+		if l1 != nil {
+			wl1 = refreshHandler{Handler: l1, s: s, first: true}
+		}
+		if l2 != nil {
+			wl2 = refreshHandler{Handler: l2, s: s}
+		}
+
+		return oc(wl1, wl2, noStreamResponder{res})
+	}
+}
+
+// noStreamResponder hides whether the wrapped responder can stream, so orcas don't ask for
+// streamed gets
+type noStreamResponder struct {
+	common.Responder
+}
+
+// refreshState is shared by the handlers of one orca to carry the decisions made in L1 over to L2
+type refreshState struct {
+	window      uint32
+	probability float64
+
+	lock       sync.Mutex
+	refreshing map[string]struct{}
+}
+
+// reset forgets the decisions of the last request
+func (s *refreshState) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k := range s.refreshing {
+		delete(s.refreshing, k)
+	}
+}
+
+// expireEarly decides whether a hit is turned into a miss. Keys turned into misses by the first
+// tier are remembered so the next tier does the same.
+func (s *refreshState) expireEarly(key []byte, exptime uint32, first bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.refreshing[string(key)]; ok && !first {
+		delete(s.refreshing, string(key))
+		return true
+	}
+
+	if exptime == 0 || exptime > uint32(time.Now().Unix())+s.window {
+		return false
+	}
+	if rand.Float64() >= s.probability {
+		return false
+	}
+
+	if first {
+		s.refreshing[string(key)] = struct{}{}
+	}
+	return true
+}
+
+// refreshHandler does gets as GetE to learn when items expire. Streamed gets have no GetE to
+// turn into, so any that are still asked for are left alone, as are gets on handlers that answer
+// GetE with ErrNotSupported. All other commands go straight
+// through to the embedded handler.
+type refreshHandler struct {
+	handlers.Handler
+	s *refreshState
+	// first is set for the handler the orca asks first, which is L1
+	first bool
+}
+
+func (h refreshHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	if h.first {
+		h.s.reset()
+	}
+	if cmd.Stream {
+		return h.Handler.Get(cmd)
+	}
+
+	resE, errsE := h.getE(cmd)
+
+	res := make(chan common.GetResponse, len(cmd.Keys))
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		if !forwardGetE(resE, errsE, res, errs) {
+			return
+		}
+
+		// The handler can't do GetE, so it can't say when items expire either. The get goes
+		// through as a plain get without any early refresh.
+		resG, errsG := h.Handler.Get(cmd)
+		for resG != nil || errsG != nil {
+			select {
+			case r, ok := <-resG:
+				if !ok {
+					resG = nil
+					continue
+				}
+				res <- r
+
+			case err, ok := <-errsG:
+				if !ok {
+					errsG = nil
+					continue
+				}
+				errs <- err
+			}
+		}
+	}()
+
+	return res, errs
+}
+
+// forwardGetE copies the GetE responses over as get responses. It returns true without forwarding
+// anything if the handler answered with ErrNotSupported before any response.
+func forwardGetE(resE <-chan common.GetEResponse, errsE <-chan error, res chan<- common.GetResponse, errs chan<- error) bool {
+	seen := false
+
+	for resE != nil || errsE != nil {
+		select {
+		case r, ok := <-resE:
+			if !ok {
+				resE = nil
+				continue
+			}
+			seen = true
+			res <- common.GetResponse{
+				Key:    r.Key,
+				Data:   r.Data,
+				Opaque: r.Opaque,
+				Flags:  r.Flags,
+				Cas:    r.Cas,
+				Miss:   r.Miss,
+				Quiet:  r.Quiet,
+			}
+
+		case err, ok := <-errsE:
+			if !ok {
+				errsE = nil
+				continue
+			}
+			if err == common.ErrNotSupported && !seen {
+				// drain whatever is left so the handler's goroutines can finish
+				if resE != nil {
+					go func(resE <-chan common.GetEResponse) {
+						for range resE {
+						}
+					}(resE)
+				}
+				for range errsE {
+				}
+				return true
+			}
+			errs <- err
+		}
+	}
+
+	return false
+}
+
+func (h refreshHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if h.first {
+		h.s.reset()
+	}
+	return h.getE(cmd)
+}
+
+func (h refreshHandler) getE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resE, errs := h.Handler.GetE(cmd)
+	res := make(chan common.GetEResponse, len(cmd.Keys))
+
+	go func() {
+		defer close(res)
+
+		for r := range resE {
+			if !r.Miss && h.s.expireEarly(r.Key, r.Exptime, h.first) {
+				metrics.IncCounter(MetricCmdGetEarlyRefresh)
+				r = common.GetEResponse{
+					Key:    r.Key,
+					Opaque: r.Opaque,
+					Miss:   true,
+					Quiet:  r.Quiet,
+				}
+			}
+			res <- r
+		}
+	}()
+
+	return res, errs
+}
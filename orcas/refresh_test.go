@@ -0,0 +1,135 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testRefreshHandler hits every key with the same exptime and counts the sets
+type testRefreshHandler struct {
+	handlers.Handler
+	exptime uint32
+	sets    int
+}
+
+func (h *testRefreshHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	res := make(chan common.GetEResponse, len(cmd.Keys))
+	errs := make(chan error)
+	for i, key := range cmd.Keys {
+		res <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte("bar"), Exptime: h.exptime}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h *testRefreshHandler) Set(cmd common.SetRequest) error {
+	h.sets++
+	return nil
+}
+
+// testNoGetEHandler only does plain gets, like the chunked handler
+type testNoGetEHandler struct {
+	handlers.Handler
+}
+
+func (h testNoGetEHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	res := make(chan common.GetResponse, len(cmd.Keys))
+	errs := make(chan error)
+	for i, key := range cmd.Keys {
+		res <- common.GetResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte("bar")}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h testNoGetEHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	res := make(chan common.GetEResponse)
+	errs := make(chan error, 1)
+	errs <- common.ErrNotSupported
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func TestEarlyRefresh(t *testing.T) {
+	conf := orcas.EarlyRefreshConfig{TTL: 100 * time.Second, Percent: 20, Probability: 1}
+	now := uint32(time.Now().Unix())
+	req := common.GetRequest{Keys: [][]byte{[]byte("foo")}, Opaques: []uint32{0}, Quiet: []bool{false}}
+
+	get := func(oc orcas.OrcaConst, l1, l2 handlers.Handler) string {
+		buf := &bytes.Buffer{}
+		w := bufio.NewWriter(buf)
+		if err := orcas.EarlyRefresh(oc, conf)(l1, l2, textprot.NewTextResponder(w)).Get(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		w.Flush()
+		return buf.String()
+	}
+
+	tests := []struct {
+		name    string
+		exptime uint32
+		refresh bool
+	}{
+		{"InWindow", now + 10, true},
+		{"OutsideWindow", now + 90, false},
+		{"NoExpiry", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := get(orcas.L1Only, &testRefreshHandler{exptime: test.exptime}, nil)
+			if refreshed := !strings.HasPrefix(out, "VALUE"); refreshed != test.refresh {
+				t.Fatalf("Expected early refresh to be %v, got response %q", test.refresh, out)
+			}
+		})
+	}
+
+	t.Run("MissInL2", func(t *testing.T) {
+		// L2 expires later than L1, but the key still has to miss in L2 or it would be served
+		l1 := &testRefreshHandler{exptime: now + 10}
+		l2 := &testRefreshHandler{exptime: now + 90}
+		if out := get(orcas.L1L2, l1, l2); strings.HasPrefix(out, "VALUE") {
+			t.Fatalf("Expected a miss, got response %q", out)
+		}
+		if l1.sets != 0 {
+			t.Fatalf("Expected L1 not to be set, got %d sets", l1.sets)
+		}
+	})
+
+	t.Run("NoGetE", func(t *testing.T) {
+		if out := get(orcas.L1Only, testNoGetEHandler{}, nil); out != "VALUE foo 0 3\r\nbar\r\nEND\r\n" {
+			t.Fatalf("Expected a plain hit, got response %q", out)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		oc := orcas.EarlyRefresh(orcas.L1Only, orcas.EarlyRefreshConfig{TTL: 100 * time.Second})
+		if _, ok := oc(&testRefreshHandler{}, nil, nil).(*orcas.L1OnlyOrca); !ok {
+			t.Fatalf("Expected the orca to be left unwrapped")
+		}
+	})
+}
@@ -0,0 +1,59 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	registryLock sync.RWMutex
+	registry     = map[string]OrcaConst{
+		"l1only":    L1Only,
+		"l1l2":      L1L2,
+		"l1l2batch": L1L2Batch,
+	}
+)
+
+// Register makes an orca available by name, so programs embedding rend can plug in their own
+// orchestration and pick it per listener from configuration. It replaces any orca registered with
+// the same name, including the built in l1only, l1l2 and l1l2batch.
+func Register(name string, oc OrcaConst) {
+	registryLock.Lock()
+	registry[name] = oc
+	registryLock.Unlock()
+}
+
+// Lookup returns the orca registered with the name, if any
+func Lookup(name string) (OrcaConst, bool) {
+	registryLock.RLock()
+	oc, ok := registry[name]
+	registryLock.RUnlock()
+	return oc, ok
+}
+
+// Names returns the names of all of the registered orcas in sorted order
+func Names() []string {
+	registryLock.RLock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryLock.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
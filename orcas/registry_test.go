@@ -0,0 +1,54 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+)
+
+func TestRegistry(t *testing.T) {
+	for _, name := range []string{"l1only", "l1l2", "l1l2batch"} {
+		if _, ok := orcas.Lookup(name); !ok {
+			t.Fatalf("Expected %s to be registered", name)
+		}
+	}
+	if _, ok := orcas.Lookup("custom"); ok {
+		t.Fatalf("Expected custom not to be registered yet")
+	}
+
+	called := false
+	orcas.Register("custom", func(l1, l2 handlers.Handler, res common.Responder) orcas.Orca {
+		called = true
+		return orcas.L1Only(l1, l2, res)
+	})
+
+	oc, ok := orcas.Lookup("custom")
+	if !ok {
+		t.Fatalf("Expected custom to be registered")
+	}
+	oc(nil, nil, nil)
+	if !called {
+		t.Fatalf("Expected the registered orca to be returned")
+	}
+
+	if names := orcas.Names(); !reflect.DeepEqual(names, []string{"custom", "l1l2", "l1l2batch", "l1only"}) {
+		t.Fatalf("Expected the names in order, got %v", names)
+	}
+}
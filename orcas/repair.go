@@ -0,0 +1,297 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/timer"
+)
+
+var (
+	MetricReadRepairChecked       = metrics.AddCounter("read_repair_checked", nil)
+	MetricReadRepairDropped       = metrics.AddCounter("read_repair_dropped", nil)
+	MetricReadRepairDivergentData = metrics.AddCounter("read_repair_divergent_data", nil)
+	MetricReadRepairDivergentMiss = metrics.AddCounter("read_repair_divergent_miss_l2", nil)
+	MetricReadRepairRepaired      = metrics.AddCounter("read_repair_repaired", nil)
+	MetricReadRepairErrors        = metrics.AddCounter("read_repair_errors", nil)
+	MetricReadRepairConnErrors    = metrics.AddCounter("read_repair_conn_errors", nil)
+
+	HistReadRepair = metrics.AddHistogram("read_repair", false, nil)
+)
+
+// ReadRepairConfig holds the settings used by NewReadRepairer.
+type ReadRepairConfig struct {
+	// Percent is how many of the L1 hits are checked against L2, from 0 to 100
+	Percent float64
+	// Workers is the number of connections to each tier used for checking
+	Workers int
+	// QueueSize is how many checks can wait for a worker. Checks that don't fit are skipped.
+	QueueSize int
+}
+
+// ReadRepairer checks a sample of the values that hit L1 against L2 to find copies that have
+// diverged, e.g. after a set that reached L2 and failed in L1. L2 is the source of truth, so when
+// L2 has a different value or none at all the copy in L1 is deleted and the next get refills it
+// from L2. Deleting instead of setting means a check that raced with a newer set can't put an old
+// value back. Checks run in the background after L1 has answered, so clients never wait on them.
+// It is shared by all connections and has handlers of its own.
+type ReadRepairer struct {
+	queue   chan []getSummary
+	percent float64
+}
+
+// NewReadRepairer starts workers that each check the queued L1 hits with their own L2 handler
+// made by l2 and repair them with their own L1 handler made by l1.
+func NewReadRepairer(l1, l2 handlers.HandlerConst, conf ReadRepairConfig) *ReadRepairer {
+	r := &ReadRepairer{
+		queue:   make(chan []getSummary, conf.QueueSize),
+		percent: conf.Percent,
+	}
+	for i := 0; i < conf.Workers; i++ {
+		go r.work(l1, l2)
+	}
+	return r
+}
+
+func (r *ReadRepairer) work(l1c, l2c handlers.HandlerConst) {
+	var l1, l2 handlers.Handler
+	for seen := range r.queue {
+		if l1 == nil || l2 == nil {
+			var err error
+			if l1 == nil {
+				l1, err = l1c()
+			}
+			if err == nil && l2 == nil {
+				l2, err = l2c()
+			}
+			if err != nil {
+				log.Println("Error connecting for read repair:", err)
+				metrics.IncCounter(MetricReadRepairConnErrors)
+				metrics.IncCounter(MetricReadRepairErrors)
+				continue
+			}
+		}
+
+		start := timer.Now()
+		stale, err := check(l2, seen)
+		metrics.ObserveHist(HistReadRepair, timer.Since(start))
+
+		if err != nil {
+			metrics.IncCounter(MetricReadRepairErrors)
+			if !common.IsAppError(err) {
+				l2.Close()
+				l2 = nil
+			}
+			continue
+		}
+
+		for _, key := range stale {
+			err := l1.Delete(common.DeleteRequest{Key: key, Quiet: true})
+			if err == nil || err == common.ErrKeyNotFound {
+				metrics.IncCounter(MetricReadRepairRepaired)
+				continue
+			}
+			metrics.IncCounter(MetricReadRepairErrors)
+			if !common.IsAppError(err) {
+				l1.Close()
+				l1 = nil
+				break
+			}
+		}
+	}
+}
+
+// check gets the keys L1 answered from L2 in one request and returns the ones whose answers
+// differ. The answers come back in the same order as the keys.
+func check(l2 handlers.Handler, seen []getSummary) ([][]byte, error) {
+	req := common.GetRequest{
+		Keys:    make([][]byte, len(seen)),
+		Opaques: make([]uint32, len(seen)),
+		Quiet:   make([]bool, len(seen)),
+	}
+	for i, s := range seen {
+		req.Keys[i] = s.key
+	}
+
+	resC, errC := l2.Get(req)
+
+	var stale [][]byte
+	var answered int
+	var err error
+
+	for resC != nil || errC != nil {
+		select {
+		case res, ok := <-resC:
+			if !ok {
+				resC = nil
+				continue
+			}
+			if answered < len(seen) && bytes.Equal(res.Key, seen[answered].key) {
+				metrics.IncCounter(MetricReadRepairChecked)
+				if !seen[answered].matches(summarize(res)) {
+					if res.Miss {
+						metrics.IncCounter(MetricReadRepairDivergentMiss)
+					} else {
+						metrics.IncCounter(MetricReadRepairDivergentData)
+					}
+					stale = append(stale, seen[answered].key)
+				}
+			}
+			answered++
+
+		case getErr, ok := <-errC:
+			if !ok {
+				errC = nil
+				continue
+			}
+			err = getErr
+		}
+	}
+
+	// Nothing is repaired from an answer that may be incomplete
+	if err != nil {
+		return nil, err
+	}
+	return stale, nil
+}
+
+// sampled picks the L1 hits that are checked
+func (r *ReadRepairer) sampled() bool {
+	return rand.Float64()*100 < r.percent
+}
+
+func (r *ReadRepairer) enqueue(seen []getSummary) {
+	select {
+	case r.queue <- seen:
+	default:
+		metrics.IncCounter(MetricReadRepairDropped)
+	}
+}
+
+// ReadRepair wraps the L1 handler given to an orca so that a sample of its hits is checked
+// against L2 by r. Orcas without an L2 are left alone.
+func ReadRepair(oc OrcaConst, r *ReadRepairer) OrcaConst {
+	if r == nil {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		if l1 != nil && l2 != nil {
+			l1 = repairHandler{Handler: l1, r: r}
+		}
+		return oc(l1, l2, res)
+	}
+}
+
+// repairHandler queues the sampled hits of gets for checking once L1 has answered them all. Gets
+// that failed are not checked.
+type repairHandler struct {
+	handlers.Handler
+	r *ReadRepairer
+}
+
+func (h repairHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resIn, errsIn := h.Handler.Get(cmd)
+	res := make(chan common.GetResponse)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		var seen []getSummary
+		var failed bool
+
+		for resIn != nil || errsIn != nil {
+			select {
+			case r, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				if !r.Miss && h.r.sampled() {
+					seen = append(seen, summarize(r))
+				}
+				res <- r
+
+			case err, ok := <-errsIn:
+				if !ok {
+					errsIn = nil
+					continue
+				}
+				failed = true
+				errs <- err
+			}
+		}
+
+		if !failed && len(seen) > 0 {
+			h.r.enqueue(seen)
+		}
+	}()
+
+	return res, errs
+}
+
+func (h repairHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resIn, errsIn := h.Handler.GetE(cmd)
+	res := make(chan common.GetEResponse)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		var seen []getSummary
+		var failed bool
+
+		for resIn != nil || errsIn != nil {
+			select {
+			case r, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				if !r.Miss && h.r.sampled() {
+					seen = append(seen, summarize(common.GetResponse{
+						Key:   r.Key,
+						Data:  r.Data,
+						Flags: r.Flags,
+					}))
+				}
+				res <- r
+
+			case err, ok := <-errsIn:
+				if !ok {
+					errsIn = nil
+					continue
+				}
+				failed = true
+				errs <- err
+			}
+		}
+
+		if !failed && len(seen) > 0 {
+			h.r.enqueue(seen)
+		}
+	}()
+
+	return res, errs
+}
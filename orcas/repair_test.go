@@ -0,0 +1,74 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+func TestReadRepair(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+
+	l1, l2 := newTestMapHandler(), newTestMapHandler()
+	for _, tier := range []*testMapHandler{l1, l2} {
+		tier.Set(common.SetRequest{Key: []byte("same"), Data: []byte("value")})
+		tier.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")})
+	}
+	// L1 has a stale value for foo and a key L2 doesn't have at all
+	l2.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("newer")})
+	l1.Set(common.SetRequest{Key: []byte("baz"), Data: []byte("qux")})
+
+	r := orcas.NewReadRepairer(
+		func() (handlers.Handler, error) { return l1, nil },
+		func() (handlers.Handler, error) { return l2, nil },
+		orcas.ReadRepairConfig{Percent: 100, Workers: 1, QueueSize: 10},
+	)
+	o := orcas.ReadRepair(orcas.L1L2, r)(l1, l2, res)
+
+	data, miss := counter("read_repair_divergent_data"), counter("read_repair_divergent_miss_l2")
+	repaired := counter("read_repair_repaired")
+
+	req := common.GetRequest{
+		Keys:    [][]byte{[]byte("same"), []byte("foo"), []byte("baz")},
+		Opaques: []uint32{0, 0, 0},
+		Quiet:   []bool{false, false, false},
+	}
+	if err := o.Get(req); err != nil {
+		t.Fatalf("Expected success, got %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for counter("read_repair_repaired") < repaired+2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := counter("read_repair_repaired"); n != repaired+2 {
+		t.Fatalf("Expected 2 repairs, got %d", n-repaired)
+	}
+	if counter("read_repair_divergent_data") != data+1 || counter("read_repair_divergent_miss_l2") != miss+1 {
+		t.Fatalf("Expected one value that differs and one that is missing from L2")
+	}
+	if l1.len() != 1 {
+		t.Fatalf("Expected only the key that matched to be left in L1, got %d keys", l1.len())
+	}
+}
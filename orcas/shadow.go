@@ -0,0 +1,439 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"hash/fnv"
+	"log"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/timer"
+)
+
+var (
+	MetricShadowMirrored   = metrics.AddCounter("shadow_mirrored", nil)
+	MetricShadowDropped    = metrics.AddCounter("shadow_dropped", nil)
+	MetricShadowMatches    = metrics.AddCounter("shadow_matches", nil)
+	MetricShadowMismatches = metrics.AddCounter("shadow_mismatches", nil)
+	MetricShadowErrors     = metrics.AddCounter("shadow_errors", nil)
+	MetricShadowConnErrors = metrics.AddCounter("shadow_conn_errors", nil)
+
+	HistShadow = metrics.AddHistogram("shadow", false, nil)
+)
+
+// ShadowConfig holds the settings used by NewShadow.
+type ShadowConfig struct {
+	// Percent is how many of the keys have their requests mirrored, from 0 to 100
+	Percent float64
+	// Workers is the number of connections to the shadow backend
+	Workers int
+	// QueueSize is how many mirrored requests can wait for a worker. Requests that don't fit are
+	// not mirrored.
+	QueueSize int
+}
+
+// Shadow mirrors requests to a backend that is being qualified and compares its answers with the
+// ones clients got from L1. Keys are picked by hash, so every request for a picked key is mirrored
+// and the shadow backend holds the same data as L1 for them. Mirrored requests are replayed in the
+// background after L1 has answered, so clients never wait on the shadow backend or see its
+// answers. It is shared by all connections.
+type Shadow struct {
+	queue     chan shadowJob
+	threshold uint32
+}
+
+// shadowJob replays a request on the shadow backend and compares the answers. It only returns I/O
+// errors, after which the connection is not used again.
+type shadowJob func(h handlers.Handler) error
+
+// NewShadow starts workers that each replay mirrored requests on their own handler made by hc.
+func NewShadow(hc handlers.HandlerConst, conf ShadowConfig) *Shadow {
+	s := &Shadow{
+		queue:     make(chan shadowJob, conf.QueueSize),
+		threshold: uint32(conf.Percent * 100),
+	}
+	for i := 0; i < conf.Workers; i++ {
+		go s.work(hc)
+	}
+	return s
+}
+
+func (s *Shadow) work(hc handlers.HandlerConst) {
+	var h handlers.Handler
+	for job := range s.queue {
+		if h == nil {
+			var err error
+			if h, err = hc(); err != nil {
+				log.Println("Error connecting to the shadow backend:", err)
+				metrics.IncCounter(MetricShadowConnErrors)
+				metrics.IncCounter(MetricShadowErrors)
+				h = nil
+				continue
+			}
+		}
+
+		start := timer.Now()
+		err := job(h)
+		metrics.ObserveHist(HistShadow, timer.Since(start))
+
+		if err != nil {
+			metrics.IncCounter(MetricShadowErrors)
+			h.Close()
+			h = nil
+		}
+	}
+}
+
+// sampled says whether requests for the key are mirrored
+func (s *Shadow) sampled(key []byte) bool {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32()%10000 < s.threshold
+}
+
+func (s *Shadow) enqueue(job shadowJob) {
+	select {
+	case s.queue <- job:
+		metrics.IncCounter(MetricShadowMirrored)
+	default:
+		metrics.IncCounter(MetricShadowDropped)
+	}
+}
+
+func compared(match bool) {
+	if match {
+		metrics.IncCounter(MetricShadowMatches)
+	} else {
+		metrics.IncCounter(MetricShadowMismatches)
+	}
+}
+
+// ShadowL1 returns a constructor for orcas that serve everything from L1 alone, as L1Only does,
+// and mirror requests to s. The L2 given to the orca is not used.
+func ShadowL1(s *Shadow) OrcaConst {
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return L1Only(shadowHandler{Handler: l1, s: s}, nil, res)
+	}
+}
+
+// shadowHandler mirrors the requests for sampled keys after L1 answers them. Requests that failed
+// in L1 with an I/O error have nothing to compare with and are not mirrored. Stats, flushes and
+// version requests are not mirrored.
+type shadowHandler struct {
+	handlers.Handler
+	s *Shadow
+}
+
+// mirror queues a request for a sampled key that L1 answered with l1err to be replayed by replay
+func (h shadowHandler) mirror(l1err error, replay func(handlers.Handler) error) {
+	if l1err != nil && !common.IsAppError(l1err) {
+		return
+	}
+
+	h.s.enqueue(func(sh handlers.Handler) error {
+		err := replay(sh)
+		if err != nil && !common.IsAppError(err) {
+			return err
+		}
+		compared(err == l1err)
+		return nil
+	})
+}
+
+// store mirrors a store command. Streamed values have been read by L1 already, so they can't be
+// mirrored.
+func (h shadowHandler) store(cmd common.SetRequest, l1 func(common.SetRequest) error, shadow func(handlers.Handler, common.SetRequest) error) error {
+	err := l1(cmd)
+	if cmd.Stream == nil && h.s.sampled(cmd.Key) {
+		// The key of the request can be reused once the request is done, so the mirror gets its
+		// own copy. It also runs after the request is done, so it isn't held to its deadline.
+		cmd.Key = append([]byte(nil), cmd.Key...)
+		cmd.Ctx = nil
+		h.mirror(err, func(sh handlers.Handler) error { return shadow(sh, cmd) })
+	}
+	return err
+}
+
+func (h shadowHandler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, h.Handler.Set, handlers.Handler.Set)
+}
+
+func (h shadowHandler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, h.Handler.Add, handlers.Handler.Add)
+}
+
+func (h shadowHandler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, h.Handler.Replace, handlers.Handler.Replace)
+}
+
+func (h shadowHandler) Append(cmd common.SetRequest) error {
+	return h.store(cmd, h.Handler.Append, handlers.Handler.Append)
+}
+
+func (h shadowHandler) Prepend(cmd common.SetRequest) error {
+	return h.store(cmd, h.Handler.Prepend, handlers.Handler.Prepend)
+}
+
+func (h shadowHandler) Delete(cmd common.DeleteRequest) error {
+	err := h.Handler.Delete(cmd)
+	if h.s.sampled(cmd.Key) {
+		cmd.Key = append([]byte(nil), cmd.Key...)
+		cmd.Ctx = nil
+		h.mirror(err, func(sh handlers.Handler) error { return sh.Delete(cmd) })
+	}
+	return err
+}
+
+func (h shadowHandler) Touch(cmd common.TouchRequest) error {
+	err := h.Handler.Touch(cmd)
+	if h.s.sampled(cmd.Key) {
+		cmd.Key = append([]byte(nil), cmd.Key...)
+		cmd.Ctx = nil
+		h.mirror(err, func(sh handlers.Handler) error { return sh.Touch(cmd) })
+	}
+	return err
+}
+
+func (h shadowHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(cmd, h.Handler.Incr, handlers.Handler.Incr)
+}
+
+func (h shadowHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	return h.arith(cmd, h.Handler.Decr, handlers.Handler.Decr)
+}
+
+func (h shadowHandler) arith(cmd common.IncrDecrRequest, l1 func(common.IncrDecrRequest) (uint64, error), shadow func(handlers.Handler, common.IncrDecrRequest) (uint64, error)) (uint64, error) {
+	value, err := l1(cmd)
+	if (err != nil && !common.IsAppError(err)) || !h.s.sampled(cmd.Key) {
+		return value, err
+	}
+
+	cmd.Key = append([]byte(nil), cmd.Key...)
+	cmd.Ctx = nil
+	h.s.enqueue(func(sh handlers.Handler) error {
+		shadowValue, shadowErr := shadow(sh, cmd)
+		if shadowErr != nil && !common.IsAppError(shadowErr) {
+			return shadowErr
+		}
+		compared(shadowErr == err && shadowValue == value)
+		return nil
+	})
+
+	return value, err
+}
+
+func (h shadowHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.Handler.GAT(cmd)
+	if err != nil || !h.s.sampled(cmd.Key) {
+		return res, err
+	}
+
+	cmd.Key = append([]byte(nil), cmd.Key...)
+	cmd.Ctx = nil
+	l1 := summarize(res)
+	h.s.enqueue(func(sh handlers.Handler) error {
+		shadowRes, err := sh.GAT(cmd)
+		if err != nil {
+			if common.IsAppError(err) {
+				compared(false)
+				return nil
+			}
+			return err
+		}
+		compared(l1.matches(summarize(shadowRes)))
+		return nil
+	})
+
+	return res, err
+}
+
+// getSummary is what is compared between the answers of L1 and the shadow backend to a get
+type getSummary struct {
+	key    []byte
+	miss   bool
+	flags  uint32
+	length int
+	// sum is a hash of the data, or 0 for values that were streamed and not seen
+	sum uint64
+}
+
+func summarize(res common.GetResponse) getSummary {
+	sum := getSummary{
+		key:    append([]byte(nil), res.Key...),
+		miss:   res.Miss,
+		flags:  res.Flags,
+		length: len(res.Data),
+	}
+	if res.Stream != nil {
+		sum.length = res.Length
+	} else if !res.Miss {
+		h := fnv.New64a()
+		h.Write(res.Data)
+		sum.sum = h.Sum64()
+	}
+	return sum
+}
+
+func (s getSummary) matches(o getSummary) bool {
+	if s.miss || o.miss {
+		return s.miss == o.miss
+	}
+	if s.flags != o.flags || s.length != o.length {
+		return false
+	}
+	return s.sum == 0 || o.sum == 0 || s.sum == o.sum
+}
+
+func (h shadowHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resIn, errsIn := h.Handler.Get(cmd)
+	res := make(chan common.GetResponse)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		var seen []getSummary
+		var failed bool
+
+		for resIn != nil || errsIn != nil {
+			select {
+			case r, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				if h.s.sampled(r.Key) {
+					seen = append(seen, summarize(r))
+				}
+				res <- r
+
+			case err, ok := <-errsIn:
+				if !ok {
+					errsIn = nil
+					continue
+				}
+				failed = true
+				errs <- err
+			}
+		}
+
+		if !failed && len(seen) > 0 {
+			h.s.enqueue(shadowGets(seen))
+		}
+	}()
+
+	return res, errs
+}
+
+func (h shadowHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resIn, errsIn := h.Handler.GetE(cmd)
+	res := make(chan common.GetEResponse)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(res)
+
+		var seen []getSummary
+		var failed bool
+
+		for resIn != nil || errsIn != nil {
+			select {
+			case r, ok := <-resIn:
+				if !ok {
+					resIn = nil
+					continue
+				}
+				if h.s.sampled(r.Key) {
+					seen = append(seen, summarize(common.GetResponse{
+						Key:   r.Key,
+						Data:  r.Data,
+						Flags: r.Flags,
+						Miss:  r.Miss,
+					}))
+				}
+				res <- r
+
+			case err, ok := <-errsIn:
+				if !ok {
+					errsIn = nil
+					continue
+				}
+				failed = true
+				errs <- err
+			}
+		}
+
+		if !failed && len(seen) > 0 {
+			h.s.enqueue(shadowGets(seen))
+		}
+	}()
+
+	return res, errs
+}
+
+// shadowGets gets the keys L1 answered from the shadow backend in one request and compares the
+// answers, which come back in the same order
+func shadowGets(seen []getSummary) shadowJob {
+	return func(sh handlers.Handler) error {
+		req := common.GetRequest{
+			Keys:    make([][]byte, len(seen)),
+			Opaques: make([]uint32, len(seen)),
+			Quiet:   make([]bool, len(seen)),
+		}
+		for i, s := range seen {
+			req.Keys[i] = s.key
+		}
+
+		resC, errC := sh.Get(req)
+
+		var answered int
+		var err error
+
+		for resC != nil || errC != nil {
+			select {
+			case r, ok := <-resC:
+				if !ok {
+					resC = nil
+					continue
+				}
+				if answered < len(seen) {
+					compared(bytes.Equal(r.Key, seen[answered].key) && seen[answered].matches(summarize(r)))
+				}
+				answered++
+
+			case getErr, ok := <-errC:
+				if !ok {
+					errC = nil
+					continue
+				}
+				err = getErr
+			}
+		}
+
+		if err != nil && !common.IsAppError(err) {
+			return err
+		}
+		// Keys the shadow backend didn't answer after an error of its own don't match
+		for ; answered < len(seen); answered++ {
+			compared(false)
+		}
+		return nil
+	}
+}
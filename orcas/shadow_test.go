@@ -0,0 +1,153 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testMapHandler keeps sets in a map and answers gets from it
+type testMapHandler struct {
+	handlers.Handler
+	lock sync.Mutex
+	data map[string]string
+}
+
+func newTestMapHandler() *testMapHandler {
+	return &testMapHandler{data: make(map[string]string)}
+}
+
+func (h *testMapHandler) Set(cmd common.SetRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+
+func (h *testMapHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	res := make(chan common.GetResponse, len(cmd.Keys))
+	errs := make(chan error)
+	for i, key := range cmd.Keys {
+		data, ok := h.data[string(key)]
+		res <- common.GetResponse{Key: key, Opaque: cmd.Opaques[i], Data: []byte(data), Miss: !ok}
+	}
+	close(res)
+	close(errs)
+	return res, errs
+}
+
+func (h *testMapHandler) Delete(cmd common.DeleteRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.data[string(cmd.Key)]; !ok {
+		return common.ErrKeyNotFound
+	}
+	delete(h.data, string(cmd.Key))
+	return nil
+}
+
+func (h *testMapHandler) len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.data)
+}
+
+func counter(name string) uint64 {
+	for _, c := range metrics.Counters() {
+		if c.Name == name {
+			return c.Val
+		}
+	}
+	return 0
+}
+
+func TestShadow(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+
+	// waitCounter waits for the counter to reach the value
+	waitCounter := func(name string, value uint64) {
+		deadline := time.Now().Add(time.Second)
+		for counter(name) < value && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if counter(name) != value {
+			t.Fatalf("Expected %s to be %d, got %d", name, value, counter(name))
+		}
+	}
+
+	t.Run("Compare", func(t *testing.T) {
+		l1, shadow := newTestMapHandler(), newTestMapHandler()
+		s := orcas.NewShadow(func() (handlers.Handler, error) { return shadow, nil }, orcas.ShadowConfig{
+			Percent:   100,
+			Workers:   1,
+			QueueSize: 10,
+		})
+		o := orcas.ShadowL1(s)(l1, nil, res)
+
+		matches, mismatches := counter("shadow_matches"), counter("shadow_mismatches")
+
+		if err := o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		waitCounter("shadow_matches", matches+1)
+		if shadow.len() != 1 {
+			t.Fatalf("Expected the set to be mirrored")
+		}
+
+		// A key only L1 has misses in the shadow
+		l1.Set(common.SetRequest{Key: []byte("baz"), Data: []byte("qux")})
+
+		req := common.GetRequest{
+			Keys:    [][]byte{[]byte("foo"), []byte("baz")},
+			Opaques: []uint32{0, 0},
+			Quiet:   []bool{false, false},
+		}
+		if err := o.Get(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		waitCounter("shadow_matches", matches+2)
+		waitCounter("shadow_mismatches", mismatches+1)
+	})
+
+	t.Run("NotSampled", func(t *testing.T) {
+		l1, shadow := newTestMapHandler(), newTestMapHandler()
+		s := orcas.NewShadow(func() (handlers.Handler, error) { return shadow, nil }, orcas.ShadowConfig{
+			Workers:   1,
+			QueueSize: 10,
+		})
+		o := orcas.ShadowL1(s)(l1, nil, res)
+
+		if err := o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if shadow.len() != 0 {
+			t.Fatalf("Expected nothing to be mirrored")
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricCmdSigVerified = metrics.AddCounter("cmd_sig_verified", nil)
+	MetricCmdSigMissing  = metrics.AddCounter("cmd_sig_missing", nil)
+	MetricCmdSigInvalid  = metrics.AddCounter("cmd_sig_invalid", nil)
+)
+
+// SignatureSize is the number of bytes of the HMAC-SHA256 that are kept for a
+// request signature. The full MAC is truncated to keep the wire overhead low.
+const SignatureSize = 8
+
+// Sign calculates the signature for a mutation given the shared secret, the
+// request type, the key being mutated, and the expiry window the signature is
+// valid for. The window is the current unix time divided by the window size
+// in seconds. Clients use the same calculation to produce signatures.
+func Sign(secret []byte, reqType common.RequestType, key []byte, window uint64) []byte {
+	var buf [9]byte
+	buf[0] = byte(reqType)
+	binary.BigEndian.PutUint64(buf[1:], window)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(buf[:])
+	mac.Write(key)
+
+	return mac.Sum(nil)[:SignatureSize]
+}
+
+type SignedOrca struct {
+	wrapped Orca
+	secret  []byte
+	window  uint64
+}
+
+// Signed wraps an orcas.Orca to require a valid HMAC signature on every
+// mutating request before it is passed to the wrapped orca. Reads are passed
+// through without verification. The window param is the length in seconds of
+// each expiry window. Signatures from the current and the immediately previous
+// window are accepted to allow for clock skew and requests in flight.
+func Signed(oc OrcaConst, secret []byte, window uint32) OrcaConst {
+	if window == 0 {
+		panic("Signature window must be at least 1 second")
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return &SignedOrca{
+			wrapped: oc(l1, l2, res),
+			secret:  secret,
+			window:  uint64(window),
+		}
+	}
+}
+
+func (s *SignedOrca) verify(reqType common.RequestType, key, sig []byte) error {
+	if len(sig) == 0 {
+		metrics.IncCounter(MetricCmdSigMissing)
+		return common.ErrAuth
+	}
+
+	cur := uint64(time.Now().Unix()) / s.window
+
+	if hmac.Equal(sig, Sign(s.secret, reqType, key, cur)) ||
+		hmac.Equal(sig, Sign(s.secret, reqType, key, cur-1)) {
+		metrics.IncCounter(MetricCmdSigVerified)
+		return nil
+	}
+
+	metrics.IncCounter(MetricCmdSigInvalid)
+	return common.ErrAuth
+}
+
+func (s *SignedOrca) Set(req common.SetRequest) error {
+	if err := s.verify(common.RequestSet, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Set(req)
+}
+
+func (s *SignedOrca) Add(req common.SetRequest) error {
+	if err := s.verify(common.RequestAdd, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Add(req)
+}
+
+func (s *SignedOrca) Replace(req common.SetRequest) error {
+	if err := s.verify(common.RequestReplace, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Replace(req)
+}
+
+func (s *SignedOrca) Append(req common.SetRequest) error {
+	if err := s.verify(common.RequestAppend, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Append(req)
+}
+
+func (s *SignedOrca) Prepend(req common.SetRequest) error {
+	if err := s.verify(common.RequestPrepend, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Prepend(req)
+}
+
+func (s *SignedOrca) Delete(req common.DeleteRequest) error {
+	if err := s.verify(common.RequestDelete, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Delete(req)
+}
+
+// Flush has no key, so its signature is over an empty key.
+func (s *SignedOrca) Flush(req common.FlushRequest) error {
+	if err := s.verify(common.RequestFlush, nil, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Flush(req)
+}
+
+func (s *SignedOrca) Touch(req common.TouchRequest) error {
+	if err := s.verify(common.RequestTouch, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Touch(req)
+}
+
+func (s *SignedOrca) Get(req common.GetRequest) error {
+	return s.wrapped.Get(req)
+}
+
+func (s *SignedOrca) GetE(req common.GetRequest) error {
+	return s.wrapped.GetE(req)
+}
+
+func (s *SignedOrca) Gat(req common.GATRequest) error {
+	// GAT modifies the TTL of the item, so it is treated as a mutation
+	if err := s.verify(common.RequestGat, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Gat(req)
+}
+
+func (s *SignedOrca) Incr(req common.IncrDecrRequest) error {
+	if err := s.verify(common.RequestIncr, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Incr(req)
+}
+
+func (s *SignedOrca) Decr(req common.IncrDecrRequest) error {
+	if err := s.verify(common.RequestDecr, req.Key, req.Signature); err != nil {
+		return err
+	}
+	return s.wrapped.Decr(req)
+}
+
+func (s *SignedOrca) Noop(req common.NoopRequest) error {
+	return s.wrapped.Noop(req)
+}
+
+func (s *SignedOrca) Quit(req common.QuitRequest) error {
+	return s.wrapped.Quit(req)
+}
+
+func (s *SignedOrca) Version(req common.VersionRequest) error {
+	return s.wrapped.Version(req)
+}
+
+func (s *SignedOrca) Verbosity(req common.VerbosityRequest) error {
+	return s.wrapped.Verbosity(req)
+}
+
+func (s *SignedOrca) Stats(req common.StatsRequest) error {
+	return s.wrapped.Stats(req)
+}
+
+func (s *SignedOrca) Unknown(req common.Request) error {
+	return s.wrapped.Unknown(req)
+}
+
+func (s *SignedOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	s.wrapped.Error(req, reqType, err)
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+)
+
+type testCountOrca struct {
+	testPanicOrca
+	sets int
+}
+
+func (t *testCountOrca) Set(req common.SetRequest) error {
+	t.sets++
+	return nil
+}
+
+func TestSigned(t *testing.T) {
+	secret := []byte("secret")
+	key := []byte("key")
+	inner := &testCountOrca{}
+	oc := func(l1, l2 handlers.Handler, res common.Responder) orcas.Orca { return inner }
+	so := orcas.Signed(oc, secret, 60)(nil, nil, nil)
+
+	window := uint64(time.Now().Unix()) / 60
+
+	t.Run("Missing", func(t *testing.T) {
+		if err := so.Set(common.SetRequest{Key: key}); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		sig := orcas.Sign([]byte("wrong"), common.RequestSet, key, window)
+		if err := so.Set(common.SetRequest{Key: key, Signature: sig}); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+	})
+	t.Run("WrongType", func(t *testing.T) {
+		sig := orcas.Sign(secret, common.RequestDelete, key, window)
+		if err := so.Set(common.SetRequest{Key: key, Signature: sig}); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+	})
+	t.Run("Expired", func(t *testing.T) {
+		sig := orcas.Sign(secret, common.RequestSet, key, window-2)
+		if err := so.Set(common.SetRequest{Key: key, Signature: sig}); err != common.ErrAuth {
+			t.Fatalf("Expected ErrAuth, got %v", err)
+		}
+	})
+	if inner.sets != 0 {
+		t.Fatalf("Rejected requests reached the wrapped orca")
+	}
+	t.Run("Valid", func(t *testing.T) {
+		sig := orcas.Sign(secret, common.RequestSet, key, window)
+		if err := so.Set(common.SetRequest{Key: key, Signature: sig}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if inner.sets != 1 {
+			t.Fatalf("Expected the request to reach the wrapped orca")
+		}
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+)
+
+var startTime = time.Now()
+
+// rendStats returns the general stats for the proxy itself: the same basic stats memcached
+// reports, the hits and misses of each tier, and then all of the counters.
+func rendStats() []common.Stat {
+	now := time.Now()
+
+	stats := []common.Stat{
+		{Name: "pid", Value: strconv.Itoa(os.Getpid())},
+		{Name: "uptime", Value: strconv.FormatInt(int64(now.Sub(startTime)/time.Second), 10)},
+		{Name: "time", Value: strconv.FormatInt(now.Unix(), 10)},
+		{Name: "version", Value: common.VersionString},
+	}
+
+	stats = append(stats, hitStats()...)
+
+	for _, c := range metrics.Counters() {
+		stats = append(stats, common.Stat{
+			Name:  c.Name,
+			Value: strconv.FormatUint(c.Val, 10),
+		})
+	}
+
+	return stats
+}
+
+// appendBackendStats adds the stats of one backend to the list with the given prefix on each
+// name. A nil handler, like the L2 when there is none, adds nothing.
+func appendBackendStats(stats []common.Stat, prefix string, h handlers.Handler, group []byte) ([]common.Stat, error) {
+	if h == nil {
+		return stats, nil
+	}
+
+	bstats, err := h.Stats(group)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range bstats {
+		stats = append(stats, common.Stat{
+			Name:  prefix + s.Name,
+			Value: s.Value,
+		})
+	}
+
+	return stats, nil
+}
+
+// versionString combines the rend version with the versions of the backends, each with the same
+// prefix used for its stats. A backend that fails to answer is reported as unavailable instead of
+// failing the whole command, since clients often send version as a health check.
+func versionString(l1, l2 handlers.Handler) string {
+	version := common.VersionString
+	version += backendVersion(" l1:", l1)
+	version += backendVersion(" l2:", l2)
+	return version
+}
+
+func backendVersion(prefix string, h handlers.Handler) string {
+	if h == nil {
+		return ""
+	}
+
+	v, err := h.Version()
+	if err != nil {
+		return prefix + "unavailable"
+	}
+
+	return prefix + v
+}
@@ -0,0 +1,262 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+// TopKeysConfig holds the settings used by NewTopKeys
+type TopKeysConfig struct {
+	// SampleRate is how many keys there are for each one that is counted
+	SampleRate int
+	// Size is how many of the busiest keys are reported for each command
+	Size int
+	// HalfLife is how often the counts are halved, so keys that stop being busy drop out
+	HalfLife time.Duration
+}
+
+// topKeysCapacity is how many keys are counted for each one that is reported. Keys that are only
+// counted a few times are pushed out by new ones, so the busiest keys need the extra room to
+// build up their counts.
+const topKeysCapacity = 10
+
+// TopKeys finds the busiest keys of each command, like mctop but without watching the traffic
+// from outside. Keys are sampled and counted in a Space-Saving sketch for each command, which
+// keeps a fixed number of keys and gives the count of a new key to the least counted one it
+// pushes out. The counts are estimates and can be too high for keys near the bottom of the list.
+// They are shown, scaled up by the sample rate, with "stats topkeys". It is shared by all
+// connections.
+type TopKeys struct {
+	conf    TopKeysConfig
+	counter uint64
+
+	lock     sync.Mutex
+	sketches map[string]*keySketch
+}
+
+func NewTopKeys(conf TopKeysConfig) *TopKeys {
+	return &TopKeys{
+		conf:     conf,
+		sketches: make(map[string]*keySketch),
+	}
+}
+
+type keySketch struct {
+	counts map[string]uint64
+	halved time.Time
+}
+
+// sample counts one in SampleRate of the keys under the command
+func (tk *TopKeys) sample(cmd string, keys ...[]byte) {
+	for _, key := range keys {
+		if atomic.AddUint64(&tk.counter, 1)%uint64(tk.conf.SampleRate) != 0 {
+			continue
+		}
+
+		tk.lock.Lock()
+		s, ok := tk.sketches[cmd]
+		if !ok {
+			s = &keySketch{
+				counts: make(map[string]uint64),
+				halved: time.Now(),
+			}
+			tk.sketches[cmd] = s
+		}
+		tk.decay(s)
+		tk.add(s, string(key))
+		tk.lock.Unlock()
+	}
+}
+
+// add counts the key, pushing out the least counted key if the sketch is full. It must be called
+// with the lock held.
+func (tk *TopKeys) add(s *keySketch, key string) {
+	if _, ok := s.counts[key]; ok || len(s.counts) < tk.conf.Size*topKeysCapacity {
+		s.counts[key]++
+		return
+	}
+
+	var minKey string
+	var min uint64
+	for k, c := range s.counts {
+		if minKey == "" || c < min {
+			minKey, min = k, c
+		}
+	}
+
+	delete(s.counts, minKey)
+	s.counts[key] = min + 1
+}
+
+// decay halves the counts once for every half life that has passed. It must be called with the
+// lock held.
+func (tk *TopKeys) decay(s *keySketch) {
+	n := time.Since(s.halved) / tk.conf.HalfLife
+	if n == 0 {
+		return
+	}
+	s.halved = s.halved.Add(n * tk.conf.HalfLife)
+
+	for k, c := range s.counts {
+		if n >= 64 || c>>uint(n) == 0 {
+			delete(s.counts, k)
+		} else {
+			s.counts[k] = c >> uint(n)
+		}
+	}
+}
+
+// stats returns the busiest keys of each command, busiest first, named like get:foo
+func (tk *TopKeys) stats() []common.Stat {
+	tk.lock.Lock()
+	defer tk.lock.Unlock()
+
+	cmds := make([]string, 0, len(tk.sketches))
+	for cmd := range tk.sketches {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+
+	type keyCount struct {
+		key   string
+		count uint64
+	}
+
+	var stats []common.Stat
+	for _, cmd := range cmds {
+		s := tk.sketches[cmd]
+		tk.decay(s)
+
+		top := make([]keyCount, 0, len(s.counts))
+		for k, c := range s.counts {
+			top = append(top, keyCount{k, c})
+		}
+		sort.Slice(top, func(i, j int) bool {
+			if top[i].count != top[j].count {
+				return top[i].count > top[j].count
+			}
+			return top[i].key < top[j].key
+		})
+		if len(top) > tk.conf.Size {
+			top = top[:tk.conf.Size]
+		}
+
+		for _, kc := range top {
+			stats = append(stats, common.Stat{
+				Name:  cmd + ":" + kc.key,
+				Value: strconv.FormatUint(kc.count*uint64(tk.conf.SampleRate), 10),
+			})
+		}
+	}
+
+	return stats
+}
+
+// TopKeyTracking samples the keys of every command sent to the orca into tk and answers
+// "stats topkeys" with the busiest ones. A nil tk adds nothing.
+func TopKeyTracking(oc OrcaConst, tk *TopKeys) OrcaConst {
+	if tk == nil {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return topKeysOrca{
+			Orca: oc(l1, l2, res),
+			res:  res,
+			tk:   tk,
+		}
+	}
+}
+
+type topKeysOrca struct {
+	Orca
+	res common.Responder
+	tk  *TopKeys
+}
+
+func (o topKeysOrca) Set(req common.SetRequest) error {
+	o.tk.sample("set", req.Key)
+	return o.Orca.Set(req)
+}
+
+func (o topKeysOrca) Add(req common.SetRequest) error {
+	o.tk.sample("add", req.Key)
+	return o.Orca.Add(req)
+}
+
+func (o topKeysOrca) Replace(req common.SetRequest) error {
+	o.tk.sample("replace", req.Key)
+	return o.Orca.Replace(req)
+}
+
+func (o topKeysOrca) Append(req common.SetRequest) error {
+	o.tk.sample("append", req.Key)
+	return o.Orca.Append(req)
+}
+
+func (o topKeysOrca) Prepend(req common.SetRequest) error {
+	o.tk.sample("prepend", req.Key)
+	return o.Orca.Prepend(req)
+}
+
+func (o topKeysOrca) Delete(req common.DeleteRequest) error {
+	o.tk.sample("delete", req.Key)
+	return o.Orca.Delete(req)
+}
+
+func (o topKeysOrca) Touch(req common.TouchRequest) error {
+	o.tk.sample("touch", req.Key)
+	return o.Orca.Touch(req)
+}
+
+func (o topKeysOrca) Get(req common.GetRequest) error {
+	o.tk.sample("get", req.Keys...)
+	return o.Orca.Get(req)
+}
+
+func (o topKeysOrca) GetE(req common.GetRequest) error {
+	o.tk.sample("get", req.Keys...)
+	return o.Orca.GetE(req)
+}
+
+func (o topKeysOrca) Gat(req common.GATRequest) error {
+	o.tk.sample("gat", req.Key)
+	return o.Orca.Gat(req)
+}
+
+func (o topKeysOrca) Incr(req common.IncrDecrRequest) error {
+	o.tk.sample("incr", req.Key)
+	return o.Orca.Incr(req)
+}
+
+func (o topKeysOrca) Decr(req common.IncrDecrRequest) error {
+	o.tk.sample("decr", req.Key)
+	return o.Orca.Decr(req)
+}
+
+func (o topKeysOrca) Stats(req common.StatsRequest) error {
+	if string(req.Group) == "topkeys" {
+		return o.res.Stats(req.Opaque, o.tk.stats())
+	}
+	return o.Orca.Stats(req)
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+func TestTopKeys(t *testing.T) {
+	// run sends the gets and sets to a new orca and returns what "stats topkeys" answers
+	run := func(t *testing.T, size int, gets []string, sets []string) string {
+		out := &bytes.Buffer{}
+		w := bufio.NewWriter(out)
+		tk := orcas.NewTopKeys(orcas.TopKeysConfig{SampleRate: 1, Size: size, HalfLife: time.Hour})
+		o := orcas.TopKeyTracking(orcas.L1Only, tk)(newTestMapHandler(), nil, textprot.NewTextResponder(w))
+
+		for _, key := range gets {
+			if err := o.Get(common.GetRequest{Keys: [][]byte{[]byte(key)}, Opaques: []uint32{0}, Quiet: []bool{false}}); err != nil {
+				t.Fatalf("Expected success, got %v", err)
+			}
+		}
+		for _, key := range sets {
+			if err := o.Set(common.SetRequest{Key: []byte(key)}); err != nil {
+				t.Fatalf("Expected success, got %v", err)
+			}
+		}
+
+		out.Reset()
+		if err := o.Stats(common.StatsRequest{Group: []byte("topkeys")}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		w.Flush()
+		return out.String()
+	}
+
+	t.Run("ByCommand", func(t *testing.T) {
+		gets := []string{"foo", "bar", "foo", "baz", "foo", "bar"}
+		got := run(t, 2, gets, []string{"foo"})
+		want := "STAT get:foo 3\r\nSTAT get:bar 2\r\nSTAT set:foo 1\r\nEND\r\n"
+		if got != want {
+			t.Fatalf("Expected %q, got %q", want, got)
+		}
+	})
+
+	t.Run("Evicted", func(t *testing.T) {
+		var gets []string
+		for i := 0; i < 10; i++ {
+			gets = append(gets, "hot")
+		}
+		// Each new key takes the count of the one it pushes out, so the cold keys' counts grow
+		// to about how many there are for each place in the sketch
+		for i := 0; i < 30; i++ {
+			gets = append(gets, "cold"+strconv.Itoa(i))
+		}
+		got := run(t, 1, gets, nil)
+		if want := "STAT get:hot 10\r\nEND\r\n"; got != want {
+			t.Fatalf("Expected the busy key to stay on top, got %q", got)
+		}
+	})
+}
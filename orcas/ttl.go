@@ -0,0 +1,125 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+)
+
+// TierTTL changes the TTLs clients give for the items stored in one tier
+type TierTTL struct {
+	// Max caps the TTL in seconds. Items stored without a TTL get the cap. 0 means no cap.
+	Max uint32
+	// Override replaces the TTL clients give with this many seconds. 0 keeps the client's TTL.
+	Override uint32
+}
+
+// TTLConfig holds the TTL rules of each tier. A small L1 that churns can be kept from holding
+// long lived items while L2 honors the TTLs clients ask for.
+type TTLConfig struct {
+	L1 TierTTL
+	L2 TierTTL
+}
+
+// TierTTLs wraps the handlers given to an orca so that the exptime of everything stored in a
+// tier, including the copies the orca makes from one tier into the other, follows that tier's
+// rules.
+func TierTTLs(oc OrcaConst, conf TTLConfig) OrcaConst {
+	if conf == (TTLConfig{}) {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		if l1 != nil && conf.L1 != (TierTTL{}) {
+			l1 = ttlHandler{Handler: l1, ttl: conf.L1}
+		}
+		if l2 != nil && conf.L2 != (TierTTL{}) {
+			l2 = ttlHandler{Handler: l2, ttl: conf.L2}
+		}
+
+		return oc(l1, l2, res)
+	}
+}
+
+// Wrap makes the handlers from hc follow these rules, for the handlers that a tier is written
+// through outside of an orca, like the ones given to a Backfiller or WriteBehind.
+func (t TierTTL) Wrap(hc handlers.HandlerConst) handlers.HandlerConst {
+	if t == (TierTTL{}) {
+		return hc
+	}
+
+	return func() (handlers.Handler, error) {
+		h, err := hc()
+		if err != nil {
+			return nil, err
+		}
+		return ttlHandler{Handler: h, ttl: t}, nil
+	}
+}
+
+func (t TierTTL) exptime(exptime uint32) uint32 {
+	if t.Override != 0 {
+		exptime = t.Override
+	}
+	return common.CapExptime(exptime, t.Max)
+}
+
+// ttlHandler changes the exptime of the commands that carry one. All other commands go straight
+// through to the embedded handler.
+type ttlHandler struct {
+	handlers.Handler
+	ttl TierTTL
+}
+
+func (h ttlHandler) Set(cmd common.SetRequest) error {
+	cmd.Exptime = h.ttl.exptime(cmd.Exptime)
+	return h.Handler.Set(cmd)
+}
+
+func (h ttlHandler) Add(cmd common.SetRequest) error {
+	cmd.Exptime = h.ttl.exptime(cmd.Exptime)
+	return h.Handler.Add(cmd)
+}
+
+func (h ttlHandler) Replace(cmd common.SetRequest) error {
+	cmd.Exptime = h.ttl.exptime(cmd.Exptime)
+	return h.Handler.Replace(cmd)
+}
+
+func (h ttlHandler) Touch(cmd common.TouchRequest) error {
+	cmd.Exptime = h.ttl.exptime(cmd.Exptime)
+	return h.Handler.Touch(cmd)
+}
+
+func (h ttlHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	cmd.Exptime = h.ttl.exptime(cmd.Exptime)
+	return h.Handler.GAT(cmd)
+}
+
+func (h ttlHandler) Incr(cmd common.IncrDecrRequest) (uint64, error) {
+	// The exptime only applies when the item is created, and this one means it isn't
+	if cmd.Exptime != common.NoInitialExptime {
+		cmd.Exptime = h.ttl.exptime(cmd.Exptime)
+	}
+	return h.Handler.Incr(cmd)
+}
+
+func (h ttlHandler) Decr(cmd common.IncrDecrRequest) (uint64, error) {
+	if cmd.Exptime != common.NoInitialExptime {
+		cmd.Exptime = h.ttl.exptime(cmd.Exptime)
+	}
+	return h.Handler.Decr(cmd)
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testTTLHandler remembers the exptime of the last set
+type testTTLHandler struct {
+	handlers.Handler
+	exptime uint32
+}
+
+func (h *testTTLHandler) Set(cmd common.SetRequest) error {
+	h.exptime = cmd.Exptime
+	return nil
+}
+
+func TestTierTTLs(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+
+	test := func(t *testing.T, conf orcas.TTLConfig, exptime, l1exptime, l2exptime uint32) {
+		l1 := &testTTLHandler{}
+		l2 := &testTTLHandler{}
+		o := orcas.TierTTLs(orcas.L1L2, conf)(l1, l2, res)
+
+		if err := o.Set(common.SetRequest{Key: []byte("foo"), Exptime: exptime}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if l1.exptime != l1exptime || l2.exptime != l2exptime {
+			t.Fatalf("Expected exptimes %d in L1 and %d in L2, got %d and %d", l1exptime, l2exptime, l1.exptime, l2.exptime)
+		}
+	}
+
+	capL1 := orcas.TTLConfig{L1: orcas.TierTTL{Max: 60}}
+
+	t.Run("None", func(t *testing.T) { test(t, orcas.TTLConfig{}, 300, 300, 300) })
+	t.Run("Capped", func(t *testing.T) { test(t, capL1, 300, 60, 300) })
+	t.Run("UnderCap", func(t *testing.T) { test(t, capL1, 30, 30, 30) })
+	t.Run("NoExptime", func(t *testing.T) { test(t, capL1, 0, 60, 0) })
+	t.Run("Override", func(t *testing.T) {
+		test(t, orcas.TTLConfig{L2: orcas.TierTTL{Override: 3600}}, 300, 300, 3600)
+	})
+	t.Run("OverrideCapped", func(t *testing.T) {
+		test(t, orcas.TTLConfig{L1: orcas.TierTTL{Max: 60, Override: 600}}, 30, 60, 30)
+	})
+	t.Run("Absolute", func(t *testing.T) {
+		abs := uint32(time.Now().Unix()) + 3600
+		l1 := &testTTLHandler{}
+		o := orcas.TierTTLs(orcas.L1L2, capL1)(l1, &testTTLHandler{}, res)
+
+		if err := o.Set(common.SetRequest{Key: []byte("foo"), Exptime: abs}); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if l1.exptime >= abs || l1.exptime < abs-3600 {
+			t.Fatalf("Expected the absolute exptime to be capped to a minute from now, got %d", l1.exptime)
+		}
+	})
+}
@@ -33,9 +33,14 @@ type Orca interface {
 	Get(req common.GetRequest) error
 	GetE(req common.GetRequest) error
 	Gat(req common.GATRequest) error
+	Incr(req common.IncrDecrRequest) error
+	Decr(req common.IncrDecrRequest) error
 	Noop(req common.NoopRequest) error
 	Quit(req common.QuitRequest) error
 	Version(req common.VersionRequest) error
+	Verbosity(req common.VerbosityRequest) error
+	Stats(req common.StatsRequest) error
+	Flush(req common.FlushRequest) error
 	Unknown(req common.Request) error
 	Error(req common.Request, reqType common.RequestType, err error)
 }
@@ -56,6 +61,9 @@ var (
 	MetricCmdGetKeysL1   = metrics.AddCounter("cmd_get_keys_l1", nil)
 	MetricCmdGetKeysL2   = metrics.AddCounter("cmd_get_keys_l2", nil)
 
+	MetricCmdGetTimeoutsL2   = metrics.AddCounter("cmd_get_timeouts_l2", nil)
+	MetricCmdGetStreamErrors = metrics.AddCounter("cmd_get_stream_errors", nil)
+
 	// Batch L1L2 get metrics
 	MetricCmdGetSetL1       = metrics.AddCounter("cmd_get_set_l1", nil)
 	MetricCmdGetSetErrorsL1 = metrics.AddCounter("cmd_get_set_errors_l1", nil)
@@ -210,6 +218,41 @@ var (
 	MetricCmdGatTouchErrorsL1 = metrics.AddCounter("cmd_gat_touch_errors_l1", nil)
 	MetricCmdGatTouchHitsL1   = metrics.AddCounter("cmd_gat_touch_hits_l1", nil)
 
+	MetricCmdIncrL1       = metrics.AddCounter("cmd_incr_l1", nil)
+	MetricCmdIncrL2       = metrics.AddCounter("cmd_incr_l2", nil)
+	MetricCmdIncrHits     = metrics.AddCounter("cmd_incr_hits", nil)
+	MetricCmdIncrHitsL1   = metrics.AddCounter("cmd_incr_hits_l1", nil)
+	MetricCmdIncrHitsL2   = metrics.AddCounter("cmd_incr_hits_l2", nil)
+	MetricCmdIncrMisses   = metrics.AddCounter("cmd_incr_misses", nil)
+	MetricCmdIncrMissesL1 = metrics.AddCounter("cmd_incr_misses_l1", nil)
+	MetricCmdIncrMissesL2 = metrics.AddCounter("cmd_incr_misses_l2", nil)
+	MetricCmdIncrErrors   = metrics.AddCounter("cmd_incr_errors", nil)
+	MetricCmdIncrErrorsL1 = metrics.AddCounter("cmd_incr_errors_l1", nil)
+	MetricCmdIncrErrorsL2 = metrics.AddCounter("cmd_incr_errors_l2", nil)
+
+	MetricCmdDecrL1       = metrics.AddCounter("cmd_decr_l1", nil)
+	MetricCmdDecrL2       = metrics.AddCounter("cmd_decr_l2", nil)
+	MetricCmdDecrHits     = metrics.AddCounter("cmd_decr_hits", nil)
+	MetricCmdDecrHitsL1   = metrics.AddCounter("cmd_decr_hits_l1", nil)
+	MetricCmdDecrHitsL2   = metrics.AddCounter("cmd_decr_hits_l2", nil)
+	MetricCmdDecrMisses   = metrics.AddCounter("cmd_decr_misses", nil)
+	MetricCmdDecrMissesL1 = metrics.AddCounter("cmd_decr_misses_l1", nil)
+	MetricCmdDecrMissesL2 = metrics.AddCounter("cmd_decr_misses_l2", nil)
+	MetricCmdDecrErrors   = metrics.AddCounter("cmd_decr_errors", nil)
+	MetricCmdDecrErrorsL1 = metrics.AddCounter("cmd_decr_errors_l1", nil)
+	MetricCmdDecrErrorsL2 = metrics.AddCounter("cmd_decr_errors_l2", nil)
+
+	// Secondary metrics under incr / decr for the L1 invalidation in the L1L2 orcas
+	MetricCmdIncrDecrDeleteL1       = metrics.AddCounter("cmd_incr_decr_delete_l1", nil)
+	MetricCmdIncrDecrDeleteErrorsL1 = metrics.AddCounter("cmd_incr_decr_delete_errors_l1", nil)
+
+	// Metrics for conditional (CAS) writes in the L1L2 orcas, which are only done in L2
+	MetricCmdCasL2             = metrics.AddCounter("cmd_cas_l2", nil)
+	MetricCmdCasMismatchesL2   = metrics.AddCounter("cmd_cas_mismatches_l2", nil)
+	MetricCmdCasDeleteL1       = metrics.AddCounter("cmd_cas_delete_l1", nil)
+	MetricCmdCasDeleteErrorsL1 = metrics.AddCounter("cmd_cas_delete_errors_l1", nil)
+	MetricCmdGetCasL2          = metrics.AddCounter("cmd_get_cas_l2", nil)
+
 	// Special metrics
 	MetricInconsistencyDetected = metrics.AddCounter("inconsistency_detected", nil)
 
@@ -228,12 +271,26 @@ var (
 	HistDeleteL2  = metrics.AddHistogram("delete_l2", false, nil)
 	HistTouchL1   = metrics.AddHistogram("touch_l1", false, nil)
 	HistTouchL2   = metrics.AddHistogram("touch_l2", false, nil)
+	HistIncrL1    = metrics.AddHistogram("incr_l1", false, nil)
+	HistIncrL2    = metrics.AddHistogram("incr_l2", false, nil)
+	HistDecrL1    = metrics.AddHistogram("decr_l1", false, nil)
+	HistDecrL2    = metrics.AddHistogram("decr_l2", false, nil)
+
+	MetricCmdFlushL1       = metrics.AddCounter("cmd_flush_l1", nil)
+	MetricCmdFlushL2       = metrics.AddCounter("cmd_flush_l2", nil)
+	MetricCmdFlushErrors   = metrics.AddCounter("cmd_flush_errors", nil)
+	MetricCmdFlushErrorsL1 = metrics.AddCounter("cmd_flush_errors_l1", nil)
+	MetricCmdFlushErrorsL2 = metrics.AddCounter("cmd_flush_errors_l2", nil)
 
 	HistGetL1 = metrics.AddHistogram("get_l1", false, nil) // not sampled until configurable
 	HistGetL2 = metrics.AddHistogram("get_l2", false, nil) // not sampled until configurable
 	//HistGetSingleL1 = metrics.AddHistogram("get_single_l1", false, nil) // not sampled until configurable
 	//HistGetSingleL2 = metrics.AddHistogram("get_single_l2", false, nil) // not sampled until configurable
 
+	// The whole of a get, split by whether L1 had every key or some had to be read from L2
+	HistGetServedL1 = metrics.AddHistogram("get_served_l1", false, nil)
+	HistGetServedL2 = metrics.AddHistogram("get_served_l2", false, nil)
+
 	HistGetEL1 = metrics.AddHistogram("gete_l1", false, nil) // not sampled until configurable
 	HistGetEL2 = metrics.AddHistogram("gete_l2", false, nil) // not sampled until configurable
 	//HistGetESingleL1 = metrics.AddHistogram("gete_single_l1", false, nil) // not sampled until configurable
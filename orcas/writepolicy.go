@@ -0,0 +1,257 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/timer"
+)
+
+var (
+	MetricCmdSetWriteAround          = metrics.AddCounter("cmd_set_write_around", nil)
+	MetricCmdSetWriteAroundErrorsL1  = metrics.AddCounter("cmd_set_write_around_errors_l1", nil)
+	MetricCmdSetWriteBack            = metrics.AddCounter("cmd_set_write_back", nil)
+	MetricCmdSetWriteBackQueueFull   = metrics.AddCounter("cmd_set_write_back_queue_full", nil)
+	MetricCmdSetWriteBackSuccessL2   = metrics.AddCounter("cmd_set_write_back_success_l2", nil)
+	MetricCmdSetWriteBackErrorsL2    = metrics.AddCounter("cmd_set_write_back_errors_l2", nil)
+	MetricCmdSetWriteBackConnErrorL2 = metrics.AddCounter("cmd_set_write_back_conn_errors_l2", nil)
+	MetricCmdSetWriteBackRetriesL2   = metrics.AddCounter("cmd_set_write_back_retries_l2", nil)
+	MetricCmdSetWriteBackDroppedL2   = metrics.AddCounter("cmd_set_write_back_dropped_l2", nil)
+)
+
+// WritePolicy decides which tiers a set is written to and when.
+type WritePolicy int
+
+const (
+	// WriteThrough writes L2 and then L1 before responding. This is the default behavior of the
+	// orcas.
+	WriteThrough WritePolicy = iota
+	// WriteAround writes only L2 and deletes the key from L1, so L1 only fills up with keys that
+	// are read. It suits data that is written much more often than it is read.
+	WriteAround
+	// WriteBack writes L1 and responds, and writes L2 in the background. A set that is lost
+	// before it reaches L2, e.g. because the process stops, only lives in L1 until it is evicted.
+	WriteBack
+)
+
+// WriteConfig holds the settings used by WriteHandling.
+type WriteConfig struct {
+	Policy WritePolicy
+	// Behind does the background L2 writes of the WriteBack policy
+	Behind *WriteBehind
+}
+
+// WriteHandling wraps an orca so that plain sets follow the given write policy. Add, replace,
+// append and prepend depend on what is already stored in each tier, so they go to the orca as
+// they are. So do streamed sets and sets with a CAS value. With the WriteBack policy, those and
+// the other commands that write L2 first wait for the sets of the same key that are still queued,
+// and deletes drop them, so L2 can't be left with an older value.
+func WriteHandling(oc OrcaConst, conf WriteConfig) OrcaConst {
+	if conf.Policy == WriteThrough {
+		return oc
+	}
+
+	return func(l1, l2 handlers.Handler, res common.Responder) Orca {
+		return writeOrca{
+			Orca: oc(l1, l2, res),
+			l1:   l1,
+			l2:   l2,
+			res:  res,
+			conf: conf,
+		}
+	}
+}
+
+// writeOrca intercepts sets. All other commands go straight through to the embedded orca.
+type writeOrca struct {
+	Orca
+	l1   handlers.Handler
+	l2   handlers.Handler
+	res  common.Responder
+	conf WriteConfig
+}
+
+func (o writeOrca) Set(req common.SetRequest) error {
+	if req.Cas != 0 || req.Stream != nil {
+		o.waitBehind(req.Key)
+		return o.Orca.Set(req)
+	}
+
+	switch o.conf.Policy {
+	case WriteAround:
+		return o.setAround(req)
+	case WriteBack:
+		return o.setBack(req)
+	}
+	return o.Orca.Set(req)
+}
+
+func (o writeOrca) Add(req common.SetRequest) error {
+	o.waitBehind(req.Key)
+	return o.Orca.Add(req)
+}
+
+func (o writeOrca) Replace(req common.SetRequest) error {
+	o.waitBehind(req.Key)
+	return o.Orca.Replace(req)
+}
+
+func (o writeOrca) Append(req common.SetRequest) error {
+	o.waitBehind(req.Key)
+	return o.Orca.Append(req)
+}
+
+func (o writeOrca) Prepend(req common.SetRequest) error {
+	o.waitBehind(req.Key)
+	return o.Orca.Prepend(req)
+}
+
+func (o writeOrca) Incr(req common.IncrDecrRequest) error {
+	o.waitBehind(req.Key)
+	return o.Orca.Incr(req)
+}
+
+func (o writeOrca) Decr(req common.IncrDecrRequest) error {
+	o.waitBehind(req.Key)
+	return o.Orca.Decr(req)
+}
+
+func (o writeOrca) Delete(req common.DeleteRequest) error {
+	if o.conf.Policy == WriteBack {
+		o.conf.Behind.supersede(req.Key)
+	}
+	return o.Orca.Delete(req)
+}
+
+// waitBehind waits for the queued background sets of a key to reach L2 before the orca writes it
+func (o writeOrca) waitBehind(key []byte) {
+	if o.conf.Policy == WriteBack {
+		o.conf.Behind.wait(key)
+	}
+}
+
+func (o writeOrca) setAround(req common.SetRequest) error {
+	metrics.IncCounter(MetricCmdSetWriteAround)
+	metrics.IncCounter(MetricCmdSetL2)
+	start := timer.Now()
+
+	err := o.l2.Set(req)
+
+	metrics.ObserveHist(HistSetL2, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdSetErrorsL2)
+		metrics.IncCounter(MetricCmdSetErrors)
+		return err
+	}
+	metrics.IncCounter(MetricCmdSetSuccessL2)
+
+	// The delete comes after the set so a get that misses L1 in between can't fill it with the
+	// old value from L2. If it fails L1 may still have the old value, so the set fails too and
+	// the client can retry it.
+	if err := o.l1.Delete(common.DeleteRequest{Key: req.Key, Opaque: req.Opaque}); err != nil && err != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricCmdSetWriteAroundErrorsL1)
+		metrics.IncCounter(MetricCmdSetErrors)
+		return err
+	}
+
+	metrics.IncCounter(MetricCmdSetSuccess)
+	return o.res.Set(req.Opaque, req.Quiet)
+}
+
+func (o writeOrca) setBack(req common.SetRequest) error {
+	metrics.IncCounter(MetricCmdSetWriteBack)
+	metrics.IncCounter(MetricCmdSetL1)
+	start := timer.Now()
+
+	err := o.l1.Set(req)
+
+	metrics.ObserveHist(HistSetL1, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdSetErrorsL1)
+		metrics.IncCounter(MetricCmdSetErrors)
+		return err
+	}
+	metrics.IncCounter(MetricCmdSetSuccessL1)
+
+	// When the queue is full, in sets or in bytes, the set goes to L2 right away instead, which slows down clients
+	// that write faster than L2 can keep up with instead of dropping their writes. Older sets of the key that are
+	// still queued are dropped first so they can't land after this one.
+	if !o.conf.Behind.enqueue(req) {
+		metrics.IncCounter(MetricCmdSetWriteBackQueueFull)
+		o.conf.Behind.supersede(req.Key)
+		metrics.IncCounter(MetricCmdSetL2)
+		start = timer.Now()
+
+		err = o.l2.Set(req)
+
+		metrics.ObserveHist(HistSetL2, timer.Since(start))
+
+		if err != nil {
+			metrics.IncCounter(MetricCmdSetErrorsL2)
+			metrics.IncCounter(MetricCmdSetErrors)
+			return err
+		}
+		metrics.IncCounter(MetricCmdSetSuccessL2)
+	}
+
+	metrics.IncCounter(MetricCmdSetSuccess)
+	return o.res.Set(req.Opaque, req.Quiet)
+}
+
+// WriteBehindConfig holds the settings used by NewWriteBehind.
+type WriteBehindConfig struct {
+	// Workers is the number of connections to L2 that write sets
+	Workers int
+	// QueueSize is how many sets can wait to be written
+	QueueSize int
+	// MaxBytes caps the keys and data of the sets waiting to be written. 0 means no cap.
+	MaxBytes int
+	// Retries is how many more times a set that failed with an I/O error or a temporary failure
+	// is written before it is dropped
+	Retries int
+	// Backoff is the wait before the first retry. It doubles each retry.
+	Backoff time.Duration
+}
+
+// WriteBehind writes sets to L2 in the background for the WriteBack policy. It is shared by all
+// connections and has L2 handlers of its own, since the handlers of a connection can't be used
+// outside of it. A set that still fails after its retries is dropped and L2 keeps whatever it had
+// for the key, so the drops are counted in cmd_set_write_back_dropped_l2.
+type WriteBehind struct {
+	*asyncSets
+}
+
+// NewWriteBehind starts workers that each write the queued sets to their own L2 handler made by
+// l2.
+func NewWriteBehind(l2 handlers.HandlerConst, conf WriteBehindConfig) *WriteBehind {
+	return &WriteBehind{newAsyncSets(l2, conf.Workers, conf.QueueSize, conf.MaxBytes, asyncConfig{
+		tier:       "L2",
+		store:      handlers.Handler.Set,
+		retries:    conf.Retries,
+		backoff:    conf.Backoff,
+		hist:       HistSetL2,
+		success:    MetricCmdSetWriteBackSuccessL2,
+		errors:     MetricCmdSetWriteBackErrorsL2,
+		connErrors: MetricCmdSetWriteBackConnErrorL2,
+		retried:    MetricCmdSetWriteBackRetriesL2,
+		dropped:    MetricCmdSetWriteBackDroppedL2,
+	})}
+}
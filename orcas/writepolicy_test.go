@@ -0,0 +1,246 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/textprot"
+)
+
+// testWriteHandler records the keys set and deleted and the data set. The first fails sets fail
+// with a temporary failure.
+type testWriteHandler struct {
+	handlers.Handler
+	lock    sync.Mutex
+	sets    []string
+	data    []string
+	deletes []string
+	fails   int
+}
+
+func (h *testWriteHandler) Set(cmd common.SetRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.fails > 0 {
+		h.fails--
+		return common.ErrTempFailure
+	}
+	h.sets = append(h.sets, string(cmd.Key))
+	h.data = append(h.data, string(cmd.Data))
+	return nil
+}
+
+func (h *testWriteHandler) Delete(cmd common.DeleteRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.deletes = append(h.deletes, string(cmd.Key))
+	return common.ErrKeyNotFound
+}
+
+func (h *testWriteHandler) setCount() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.sets)
+}
+
+func (h *testWriteHandler) hasData(data string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, d := range h.data {
+		if d == data {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWriteHandling(t *testing.T) {
+	res := textprot.NewTextResponder(bufio.NewWriter(ioutil.Discard))
+	req := common.SetRequest{Key: []byte("foo"), Data: []byte("bar")}
+
+	t.Run("Through", func(t *testing.T) {
+		l1, l2 := &testWriteHandler{}, &testWriteHandler{}
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteThrough})(l1, l2, res)
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if len(l1.sets) != 1 || len(l2.sets) != 1 {
+			t.Fatalf("Expected a set in both tiers, got %v and %v", l1.sets, l2.sets)
+		}
+	})
+
+	t.Run("Around", func(t *testing.T) {
+		l1, l2 := &testWriteHandler{}, &testWriteHandler{}
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteAround})(l1, l2, res)
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if len(l1.sets) != 0 || len(l1.deletes) != 1 || len(l2.sets) != 1 {
+			t.Fatalf("Expected a set in L2 and a delete in L1, got %v, %v and %v", l1.sets, l1.deletes, l2.sets)
+		}
+	})
+
+	t.Run("Back", func(t *testing.T) {
+		l1, l2, behind := &testWriteHandler{}, &testWriteHandler{}, &testWriteHandler{}
+		wb := orcas.NewWriteBehind(func() (handlers.Handler, error) { return behind, nil }, orcas.WriteBehindConfig{
+			Workers:   1,
+			QueueSize: 10,
+		})
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteBack, Behind: wb})(l1, l2, res)
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if len(l1.sets) != 1 || len(l2.sets) != 0 {
+			t.Fatalf("Expected a set in L1 only, got %v and %v", l1.sets, l2.sets)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for behind.setCount() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if behind.setCount() != 1 {
+			t.Fatalf("Expected the set to reach L2 in the background")
+		}
+	})
+
+	t.Run("BackQueueFull", func(t *testing.T) {
+		l1, l2 := &testWriteHandler{}, &testWriteHandler{}
+		wb := orcas.NewWriteBehind(nil, orcas.WriteBehindConfig{})
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteBack, Behind: wb})(l1, l2, res)
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if len(l1.sets) != 1 || len(l2.sets) != 1 {
+			t.Fatalf("Expected a full queue to write L2 right away, got %v and %v", l1.sets, l2.sets)
+		}
+	})
+
+	t.Run("BackMaxBytes", func(t *testing.T) {
+		l1, l2 := &testWriteHandler{}, &testWriteHandler{}
+		wb := orcas.NewWriteBehind(nil, orcas.WriteBehindConfig{QueueSize: 10, MaxBytes: 5})
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteBack, Behind: wb})(l1, l2, res)
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		if len(l2.sets) != 1 {
+			t.Fatalf("Expected a set larger than the queue allows to write L2 right away, got %v", l2.sets)
+		}
+	})
+
+	backRetry := func(t *testing.T, fails, retries, sets int, dropped uint64) {
+		l1, l2 := &testWriteHandler{}, &testWriteHandler{}
+		behind := &testWriteHandler{fails: fails}
+		wb := orcas.NewWriteBehind(func() (handlers.Handler, error) { return behind, nil }, orcas.WriteBehindConfig{
+			Workers:   1,
+			QueueSize: 10,
+			Retries:   retries,
+			Backoff:   time.Millisecond,
+		})
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteBack, Behind: wb})(l1, l2, res)
+
+		dropped += counter("cmd_set_write_back_dropped_l2")
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for (behind.setCount() < sets || counter("cmd_set_write_back_dropped_l2") < dropped) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		if behind.setCount() != sets {
+			t.Fatalf("Expected %d sets to reach L2, got %d", sets, behind.setCount())
+		}
+		if n := counter("cmd_set_write_back_dropped_l2"); n != dropped {
+			t.Fatalf("Expected cmd_set_write_back_dropped_l2 to be %d, got %d", dropped, n)
+		}
+	}
+
+	t.Run("BackRetry", func(t *testing.T) { backRetry(t, 2, 2, 1, 0) })
+	t.Run("BackDropped", func(t *testing.T) { backRetry(t, 3, 1, 0, 1) })
+
+	t.Run("BackOrdered", func(t *testing.T) {
+		l1, l2, behind := &testWriteHandler{}, &testWriteHandler{}, &testWriteHandler{}
+		wb := orcas.NewWriteBehind(func() (handlers.Handler, error) { return behind, nil }, orcas.WriteBehindConfig{
+			Workers:   4,
+			QueueSize: 100,
+		})
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteBack, Behind: wb})(l1, l2, res)
+
+		for i := 0; i < 50; i++ {
+			if err := o.Set(common.SetRequest{Key: []byte("foo"), Data: []byte(strconv.Itoa(i))}); err != nil {
+				t.Fatalf("Expected success, got %v", err)
+			}
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for !behind.hasData("49") && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		behind.lock.Lock()
+		defer behind.lock.Unlock()
+		last := -1
+		for _, d := range behind.data {
+			n, _ := strconv.Atoi(d)
+			if n <= last {
+				t.Fatalf("Expected sets to reach L2 in order, got %v", behind.data)
+			}
+			last = n
+		}
+		if last != 49 {
+			t.Fatalf("Expected the last set to reach L2, got %v", behind.data)
+		}
+	})
+
+	t.Run("BackDelete", func(t *testing.T) {
+		l1, l2 := &testWriteHandler{}, &testWriteHandler{}
+		behind := &testWriteHandler{fails: 1}
+		wb := orcas.NewWriteBehind(func() (handlers.Handler, error) { return behind, nil }, orcas.WriteBehindConfig{
+			Workers:   1,
+			QueueSize: 10,
+			Retries:   1,
+			Backoff:   10 * time.Millisecond,
+		})
+		o := orcas.WriteHandling(orcas.L1L2, orcas.WriteConfig{Policy: orcas.WriteBack, Behind: wb})(l1, l2, res)
+
+		if err := o.Set(req); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		o.Delete(common.DeleteRequest{Key: req.Key})
+
+		if behind.setCount() != 0 {
+			t.Fatalf("Expected the delete to drop the queued set, got %v", behind.sets)
+		}
+		if len(l2.deletes) != 1 {
+			t.Fatalf("Expected a delete in L2, got %v", l2.deletes)
+		}
+	})
+}
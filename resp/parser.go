@@ -0,0 +1,344 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package resp implements a subset of the Redis serialization protocol (RESP) so Redis clients can
+// use rend as if it were a Redis server. Each supported command maps onto the memcached request it
+// is equivalent to:
+//
+//	GET key                                      -> get
+//	SET key value [EX s|PX ms] [NX|XX] [SIG sig] -> set, add (NX) or replace (XX)
+//	DEL key [SIG sig]                            -> delete
+//	EXPIRE key seconds [SIG sig]                 -> touch, or delete if seconds is not positive
+//	PING                                         -> noop
+//	QUIT                                         -> quit
+//
+// Values are stored with flags set to 0. Anything else is reported as an unknown command. The SIG
+// option carries the hex signature of a mutation when rend requires them. It is made for the
+// memcached request the command maps onto.
+package resp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/timer"
+)
+
+// ErrBadFraming is returned when the input is not valid RESP. The parser can't find the start of
+// the next command after this, so it is treated like an IO error and the connection is closed.
+var ErrBadFraming = errors.New("Bad RESP framing")
+
+const (
+	// maxArgs limits the number of elements in a command array
+	maxArgs = 1024
+
+	// maxBulkLen is the largest bulk string accepted, the same as the Redis default
+	maxBulkLen = 512 * 1024 * 1024
+)
+
+type RESPParser struct {
+	reader *bufio.Reader
+}
+
+func NewRESPParser(reader *bufio.Reader) RESPParser {
+	return RESPParser{
+		reader: reader,
+	}
+}
+
+func (r RESPParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	args, err := r.readCommand()
+	start := timer.Now()
+
+	// Only a SET has an argument big enough to be over the limit
+	if err == common.ErrValueTooBig {
+		return nil, common.RequestSet, start, err
+	}
+
+	if err != nil {
+		if err == io.EOF {
+			log.Println("Connection closed")
+		} else {
+			log.Printf("Error while reading RESP command: %s\n", err.Error())
+		}
+		return nil, common.RequestUnknown, start, err
+	}
+
+	if len(args) == 0 {
+		return nil, common.RequestUnknown, start, common.ErrBadRequest
+	}
+
+	switch strings.ToUpper(string(args[0])) {
+	case "GET":
+		if len(args) != 2 {
+			return nil, common.RequestGet, start, common.ErrBadRequest
+		}
+
+		return common.GetRequest{
+			Keys:    [][]byte{args[1]},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+			NoopEnd: false,
+		}, common.RequestGet, start, nil
+
+	case "SET":
+		return setRequest(args, start)
+
+	case "DEL":
+		// Only single key deletes are supported since each request maps to one delete
+		sig, err := signature(args, 2)
+		if err != nil {
+			return nil, common.RequestDelete, start, err
+		}
+
+		return common.DeleteRequest{
+			Key:       args[1],
+			Opaque:    uint32(0),
+			Signature: sig,
+		}, common.RequestDelete, start, nil
+
+	case "EXPIRE":
+		sig, err := signature(args, 3)
+		if err != nil {
+			return nil, common.RequestTouch, start, err
+		}
+
+		seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			return nil, common.RequestTouch, start, common.ErrBadRequest
+		}
+
+		// Redis deletes the key right away when the TTL is not positive
+		if seconds <= 0 {
+			return common.DeleteRequest{
+				Key:       args[1],
+				Opaque:    uint32(0),
+				Signature: sig,
+			}, common.RequestDelete, start, nil
+		}
+
+		return common.TouchRequest{
+			Key:       args[1],
+			Exptime:   common.RelativeExptime(seconds),
+			Opaque:    uint32(0),
+			Signature: sig,
+		}, common.RequestTouch, start, nil
+
+	case "PING":
+		if len(args) != 1 {
+			return nil, common.RequestNoop, start, common.ErrBadRequest
+		}
+		return common.NoopRequest{
+			Opaque: 0,
+		}, common.RequestNoop, start, nil
+
+	case "QUIT":
+		return common.QuitRequest{
+			Opaque: 0,
+			Quiet:  false,
+		}, common.RequestQuit, start, nil
+
+	default:
+		return nil, common.RequestUnknown, start, nil
+	}
+}
+
+func setRequest(args [][]byte, start uint64) (common.Request, common.RequestType, uint64, error) {
+	// SET key value [EX seconds|PX milliseconds] [NX|XX] [SIG sig]
+	if len(args) < 3 {
+		return nil, common.RequestSet, start, common.ErrBadRequest
+	}
+
+	reqType := common.RequestSet
+	var exp uint32
+	var sig []byte
+
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX", "XX":
+			if reqType != common.RequestSet {
+				return nil, reqType, start, common.ErrBadRequest
+			}
+			if opt == "NX" {
+				reqType = common.RequestAdd
+			} else {
+				reqType = common.RequestReplace
+			}
+
+		case "EX", "PX":
+			if exp != 0 || i+1 == len(args) {
+				return nil, reqType, start, common.ErrBadRequest
+			}
+			i++
+
+			ttl, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || ttl <= 0 {
+				return nil, reqType, start, common.ErrBadExptime
+			}
+
+			// memcached only has second granularity, so round milliseconds up
+			if opt == "PX" {
+				ttl = (ttl + 999) / 1000
+			}
+			exp = common.RelativeExptime(ttl)
+
+		case "SIG":
+			if sig != nil || i+1 == len(args) {
+				return nil, reqType, start, common.ErrBadRequest
+			}
+			i++
+
+			var err error
+			if sig, err = parseSignature(args[i]); err != nil {
+				return nil, reqType, start, err
+			}
+
+		default:
+			return nil, reqType, start, common.ErrBadRequest
+		}
+	}
+
+	return common.SetRequest{
+		Key:       args[1],
+		Data:      args[2],
+		Flags:     0,
+		Exptime:   exp,
+		Opaque:    uint32(0),
+		Quiet:     false,
+		Signature: sig,
+	}, reqType, start, nil
+}
+
+// signature returns the signature given with a SIG option after the first n arguments of a
+// command, which must be all there is besides it
+func signature(args [][]byte, n int) ([]byte, error) {
+	switch {
+	case len(args) == n:
+		return nil, nil
+	case len(args) == n+2 && strings.ToUpper(string(args[n])) == "SIG":
+		return parseSignature(args[n+1])
+	}
+	return nil, common.ErrBadRequest
+}
+
+func parseSignature(arg []byte) ([]byte, error) {
+	sig, err := hex.DecodeString(string(arg))
+	if err != nil || len(sig) == 0 {
+		return nil, common.ErrBadRequest
+	}
+	return sig, nil
+}
+
+// readCommand reads one command as a list of arguments. Commands are normally an array of bulk
+// strings, but a single bulk string is also accepted as a command with no arguments.
+func (r RESPParser) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 || n > maxArgs {
+			return nil, ErrBadFraming
+		}
+
+		// An argument over the maximum value size is skipped, but the rest of the command still
+		// has to be read to get to the next one
+		args := make([][]byte, n)
+		var tooBig bool
+		for i := range args {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			if line[0] != '$' {
+				return nil, ErrBadFraming
+			}
+			if args[i], err = r.readBulk(line); err == common.ErrValueTooBig {
+				tooBig = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if tooBig {
+			return nil, common.ErrValueTooBig
+		}
+		return args, nil
+
+	case '$':
+		arg, err := r.readBulk(line)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{arg}, nil
+
+	default:
+		return nil, ErrBadFraming
+	}
+}
+
+// readLine reads a line without the trailing CRLF. Lines are never empty.
+func (r RESPParser) readLine() (string, error) {
+	line, err := r.reader.ReadString('\n')
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(len(line)))
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.HasSuffix(line, "\r\n") || len(line) == 2 {
+		return "", ErrBadFraming
+	}
+
+	return line[:len(line)-2], nil
+}
+
+// readBulk reads the data of a bulk string given its header line, e.g. "$5"
+func (r RESPParser) readBulk(line string) ([]byte, error) {
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxBulkLen {
+		return nil, ErrBadFraming
+	}
+
+	if common.ValueTooBig(uint64(n)) {
+		read, err := r.reader.Discard(n + 2)
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(read))
+		if err != nil {
+			return nil, err
+		}
+		return nil, common.ErrValueTooBig
+	}
+
+	buf := make([]byte, n+2)
+	read, err := io.ReadFull(r.reader, buf)
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(read))
+	if err != nil {
+		return nil, err
+	}
+
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return nil, ErrBadFraming
+	}
+
+	return buf[:n], nil
+}
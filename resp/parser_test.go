@@ -0,0 +1,174 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/resp"
+)
+
+func newPair(in string) (resp.RESPParser, resp.RESPResponder, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	p := resp.NewRESPParser(bufio.NewReader(bytes.NewBufferString(in)))
+	r := resp.NewRESPResponder(bufio.NewWriter(out))
+	return p, r, out
+}
+
+func TestSet(t *testing.T) {
+	p, r, out := newPair("*5\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n$2\r\nEX\r\n$2\r\n10\r\n" +
+		"*4\r\n$3\r\nset\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n$2\r\nnx\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestSet {
+		t.Fatalf("Expected set, got %v %v", reqType, err)
+	}
+	sr := req.(common.SetRequest)
+	if string(sr.Key) != "foo" || string(sr.Data) != "bar" || sr.Exptime != 10 {
+		t.Fatalf("Unexpected request %+v", sr)
+	}
+	r.Set(0, false)
+
+	req, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestAdd {
+		t.Fatalf("Expected add, got %v %v", reqType, err)
+	}
+	if sr := req.(common.SetRequest); string(sr.Data) != "baz" || sr.Exptime != 0 {
+		t.Fatalf("Unexpected request %+v", sr)
+	}
+	r.Error(0, common.RequestAdd, common.ErrKeyExists, false)
+
+	if out.String() != "+OK\r\n$-1\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestGet(t *testing.T) {
+	p, r, out := newPair("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestGet {
+		t.Fatalf("Expected get, got %v %v", reqType, err)
+	}
+	if gr := req.(common.GetRequest); len(gr.Keys) != 1 || string(gr.Keys[0]) != "foo" {
+		t.Fatalf("Unexpected request %+v", gr)
+	}
+
+	r.Get(common.GetResponse{Key: []byte("foo"), Data: []byte("bar")})
+	r.Get(common.GetResponse{Key: []byte("foo"), Miss: true})
+	r.GetEnd(0, false)
+
+	if out.String() != "$3\r\nbar\r\n$-1\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestDelExpire(t *testing.T) {
+	p, r, out := newPair("*2\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n" +
+		"*3\r\n$6\r\nEXPIRE\r\n$3\r\nfoo\r\n$2\r\n60\r\n" +
+		"*3\r\n$6\r\nEXPIRE\r\n$3\r\nfoo\r\n$1\r\n0\r\n")
+
+	_, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestDelete {
+		t.Fatalf("Expected delete, got %v %v", reqType, err)
+	}
+	r.Error(0, common.RequestDelete, common.ErrKeyNotFound, false)
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestTouch {
+		t.Fatalf("Expected touch, got %v %v", reqType, err)
+	}
+	if tr := req.(common.TouchRequest); tr.Exptime != 60 {
+		t.Fatalf("Unexpected request %+v", tr)
+	}
+	r.Touch(0)
+
+	// A TTL that isn't positive deletes the key
+	_, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestDelete {
+		t.Fatalf("Expected delete, got %v %v", reqType, err)
+	}
+	r.Delete(0, false)
+
+	if out.String() != ":0\r\n:1\r\n:1\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	p, _, _ := newPair("*5\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n$3\r\nSIG\r\n$4\r\n0102\r\n" +
+		"*4\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n$3\r\nsig\r\n$4\r\n0304\r\n" +
+		"*5\r\n$6\r\nEXPIRE\r\n$3\r\nfoo\r\n$2\r\n60\r\n$3\r\nSIG\r\n$4\r\n0506\r\n" +
+		"*4\r\n$3\r\nDEL\r\n$3\r\nfoo\r\n$3\r\nSIG\r\n$2\r\nzz\r\n")
+
+	req, _, _, err := p.Parse()
+	if err != nil || !bytes.Equal(req.(common.SetRequest).Signature, []byte{1, 2}) {
+		t.Fatalf("Expected a signed set, got %+v %v", req, err)
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil || !bytes.Equal(req.(common.DeleteRequest).Signature, []byte{3, 4}) {
+		t.Fatalf("Expected a signed delete, got %+v %v", req, err)
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil || !bytes.Equal(req.(common.TouchRequest).Signature, []byte{5, 6}) {
+		t.Fatalf("Expected a signed touch, got %+v %v", req, err)
+	}
+
+	if _, _, _, err = p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected a bad signature to be rejected, got %v", err)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	p, _, _ := newPair("*1\r\n$8\r\nFLUSHALL\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if req != nil || reqType != common.RequestUnknown || err != nil {
+		t.Fatalf("Expected unknown command, got %v %v %v", req, reqType, err)
+	}
+}
+
+func TestBadFraming(t *testing.T) {
+	for _, in := range []string{
+		"*x\r\n",
+		"*1\r\n+GET\r\n",
+		"*1\r\n$3\r\nGETX\r\n",
+		"*1\n",
+	} {
+		p, _, _ := newPair(in)
+		if _, _, _, err := p.Parse(); err != resp.ErrBadFraming {
+			t.Fatalf("Expected bad framing for %q, got %v", in, err)
+		}
+	}
+}
+
+func TestValueTooBig(t *testing.T) {
+	common.SetMaxValueSize(4)
+	defer common.SetMaxValueSize(0)
+
+	p, _, _ := newPair("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$5\r\nhello\r\n*1\r\n$4\r\nPING\r\n")
+
+	if _, reqType, _, err := p.Parse(); err != common.ErrValueTooBig || reqType != common.RequestSet {
+		t.Fatalf("Expected value too big for a set, got %v %v", reqType, err)
+	}
+	if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestNoop {
+		t.Fatalf("Expected noop after the skipped set, got %v %v", reqType, err)
+	}
+}
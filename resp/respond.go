@@ -0,0 +1,184 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resp
+
+import (
+	"bufio"
+	"strconv"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+// RESPResponder replies the way Redis would to the commands the RESPParser supports. The other
+// responses panic because the parser never returns those request types.
+type RESPResponder struct {
+	writer *bufio.Writer
+}
+
+func NewRESPResponder(writer *bufio.Writer) RESPResponder {
+	return RESPResponder{
+		writer: writer,
+	}
+}
+
+func (r RESPResponder) Set(opaque uint32, quiet bool) error {
+	return r.resp("+OK")
+}
+
+func (r RESPResponder) Add(opaque uint32, quiet bool) error {
+	return r.resp("+OK")
+}
+
+func (r RESPResponder) Replace(opaque uint32, quiet bool) error {
+	return r.resp("+OK")
+}
+
+func (r RESPResponder) Append(opaque uint32, quiet bool) error {
+	panic("Append command in RESP protocol")
+}
+
+func (r RESPResponder) Prepend(opaque uint32, quiet bool) error {
+	panic("Prepend command in RESP protocol")
+}
+
+func (r RESPResponder) Get(response common.GetResponse) error {
+	if response.Miss {
+		return r.resp("$-1")
+	}
+
+	// $<length>\r\n<data>\r\n
+	n, err := r.writer.WriteString("$" + strconv.Itoa(len(response.Data)) + "\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	n, err = r.writer.Write(response.Data)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	return r.resp("")
+}
+
+// GetEnd does nothing since a RESP get is for a single key and the response is complete already
+func (r RESPResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	return nil
+}
+
+func (r RESPResponder) GetE(response common.GetEResponse) error {
+	panic("GetE command in RESP protocol")
+}
+
+func (r RESPResponder) GAT(response common.GetResponse) error {
+	panic("GAT command in RESP protocol")
+}
+
+// Delete replies with the number of keys removed, which is always 1 on success
+func (r RESPResponder) Delete(opaque uint32, quiet bool) error {
+	return r.resp(":1")
+}
+
+// Touch replies with 1 to say the TTL was set
+func (r RESPResponder) Touch(opaque uint32) error {
+	return r.resp(":1")
+}
+
+func (r RESPResponder) Noop(opaque uint32) error {
+	return r.resp("+PONG")
+}
+
+func (r RESPResponder) Quit(opaque uint32, quiet bool) error {
+	return r.resp("+OK")
+}
+
+func (r RESPResponder) Version(opaque uint32, version string) error {
+	panic("Version command in RESP protocol")
+}
+
+func (r RESPResponder) Incr(opaque uint32, value uint64, quiet bool) error {
+	panic("Incr command in RESP protocol")
+}
+
+func (r RESPResponder) Decr(opaque uint32, value uint64, quiet bool) error {
+	panic("Decr command in RESP protocol")
+}
+
+func (r RESPResponder) SASLListMechs(opaque uint32, mechs []string) error {
+	panic("SASL list mechanisms command in RESP protocol")
+}
+
+func (r RESPResponder) SASLAuth(opaque uint32) error {
+	panic("SASL auth command in RESP protocol")
+}
+
+func (r RESPResponder) Stats(opaque uint32, stats []common.Stat) error {
+	panic("Stats command in RESP protocol")
+}
+
+func (r RESPResponder) Flush(opaque uint32, quiet bool) error {
+	panic("Flush command in RESP protocol")
+}
+
+func (r RESPResponder) Verbosity(opaque uint32, quiet bool) error {
+	panic("Verbosity command in RESP protocol")
+}
+
+func (r RESPResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	switch err {
+	case common.ErrKeyNotFound:
+		// DEL and EXPIRE reply with 0 when there was no key. A SET with XX replies with nil.
+		switch reqType {
+		case common.RequestDelete, common.RequestTouch:
+			return r.resp(":0")
+		}
+		return r.resp("$-1")
+	case common.ErrKeyExists, common.ErrItemNotStored:
+		// SET with NX or XX replies with nil when the condition is not met
+		return r.resp("$-1")
+	case common.ErrUnknownCmd:
+		return r.resp("-ERR unknown command")
+	case common.ErrBadRequest, common.ErrBadLength, common.ErrBadFlags:
+		return r.resp("-ERR syntax error")
+	case common.ErrBadKey:
+		return r.resp("-ERR invalid key")
+	case common.ErrBadExptime:
+		return r.resp("-ERR invalid expire time")
+	case common.ErrValueTooBig:
+		return r.resp("-ERR string exceeds maximum allowed size")
+	case common.ErrNoMem:
+		return r.resp("-OOM out of memory")
+	case common.ErrAuth:
+		return r.resp("-NOAUTH authentication required")
+	case common.ErrBusy, common.ErrTempFailure:
+		return r.resp("-ERR server busy, try again")
+	case common.ErrTimeout:
+		return r.resp("-ERR backend timeout, try again")
+	default:
+		return r.resp("-ERR server error")
+	}
+}
+
+func (r RESPResponder) resp(s string) error {
+	n, err := r.writer.WriteString(s + "\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	return r.writer.Flush()
+}
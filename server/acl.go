@@ -0,0 +1,127 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hongst/rend/metrics"
+)
+
+var MetricConnectionsDenied = metrics.AddCounter("conn_rejected_acl", nil)
+
+// ACL decides which client IPs may connect to a listener. An IP in any of the Deny networks is
+// refused. If there are Allow networks, an IP must also be in one of them. Connections over unix
+// sockets have no IP and are always allowed.
+type ACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseACL makes an ACL from comma separated lists of CIDRs, like "10.0.0.0/8,192.168.1.0/24".
+// A plain IP is a network of just that address.
+func ParseACL(allow, deny string) (ACL, error) {
+	var acl ACL
+	var err error
+	if acl.Allow, err = parseNets(allow); err != nil {
+		return ACL{}, err
+	}
+	if acl.Deny, err = parseNets(deny); err != nil {
+		return ACL{}, err
+	}
+	return acl, nil
+}
+
+func parseNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP %q", s)
+			}
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Permits returns whether a client at ip may connect
+func (a ACL) Permits(ip net.IP) bool {
+	for _, n := range a.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, n := range a.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a ACL) empty() bool {
+	return len(a.Allow) == 0 && len(a.Deny) == 0
+}
+
+// permitsAddr returns whether a client at addr may connect. Addresses without an IP are.
+func (a ACL) permitsAddr(addr net.Addr) bool {
+	if a.empty() {
+		return true
+	}
+
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return true
+		}
+		if ip = net.ParseIP(host); ip == nil {
+			return true
+		}
+	}
+
+	if !a.Permits(ip) {
+		metrics.IncCounter(MetricConnectionsDenied)
+		logger.Debug("Refused connection denied by the ACL", "remote", addr)
+		return false
+	}
+	return true
+}
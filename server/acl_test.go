@@ -0,0 +1,90 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/server"
+)
+
+func TestACLPermits(t *testing.T) {
+	acl, err := server.ParseACL("10.0.0.0/8, 192.168.1.5,fd00::/8", "10.1.0.0/16")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		permits bool
+	}{
+		{"10.2.3.4", true},
+		{"10.1.2.3", false},
+		{"192.168.1.5", true},
+		{"192.168.1.6", false},
+		{"fd00::1", true},
+		{"fe80::1", false},
+		{"8.8.8.8", false},
+	}
+	for _, test := range tests {
+		if p := acl.Permits(net.ParseIP(test.ip)); p != test.permits {
+			t.Errorf("Expected %s to be permitted: %v, got %v", test.ip, test.permits, p)
+		}
+	}
+
+	// Without an allow list, only denied IPs are refused
+	acl, _ = server.ParseACL("", "10.0.0.0/8")
+	if !acl.Permits(net.ParseIP("8.8.8.8")) || acl.Permits(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("Expected only the denied network to be refused")
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "not an ip"} {
+		if _, err := server.ParseACL(bad, ""); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestACLListener(t *testing.T) {
+	deny, _ := server.ParseACL("", "127.0.0.0/8")
+	allow, _ := server.ParseACL("127.0.0.1", "")
+
+	for _, test := range []struct {
+		acl    server.ACL
+		closed bool
+	}{
+		{deny, true},
+		{allow, false},
+	} {
+		l := server.ListenArgs{Type: server.ListenTCP, Port: freePort(t), ACL: test.acl}
+		go server.ListenAndServe(l, server.Default, orcas.L1Only, noBackend, noBackend)
+
+		conn, err := net.Dial("tcp", waitListening(t, l.Port))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		if closed := err == io.EOF; closed != test.closed {
+			t.Errorf("Expected the connection to be closed: %v, got %v", test.closed, err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// IPVersion is the IP versions a TCP listener accepts connections over
+type IPVersion int
+
+const (
+	// DualStack accepts both IPv4 and IPv6 where the system supports it
+	DualStack IPVersion = iota
+	IPv4Only
+	IPv6Only
+)
+
+func (v IPVersion) network() string {
+	switch v {
+	case IPv4Only:
+		return "tcp4"
+	case IPv6Only:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// listenTCP listens on the port of l on the host and IP versions it asks for
+func listenTCP(l ListenArgs) (net.Listener, error) {
+	host, err := bindHost(l.Host, l.IPVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(l.Port))
+	listener, err := net.Listen(l.IPVersion.network(), addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error binding to %s: %v", addr, err)
+	}
+	return listener, nil
+}
+
+// bindHost returns the host to bind to. The name of a network interface is replaced by its first
+// address of the IP versions asked for. Anything else is left for net.Listen to resolve.
+func bindHost(host string, v IPVersion) (string, error) {
+	if host == "" || net.ParseIP(host) != nil {
+		return host, nil
+	}
+
+	iface, err := net.InterfaceByName(host)
+	if err != nil {
+		// Not an interface, so it's a host name
+		return host, nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("Error getting the addresses of interface %s: %v", host, err)
+	}
+
+	// Link-local addresses are only used if there's nothing better. IPv6 ones need the interface
+	// as their zone.
+	var linkLocal string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if is4 := ip.To4() != nil; (is4 && v == IPv6Only) || (!is4 && v == IPv4Only) {
+			continue
+		}
+		if ip.IsLinkLocalUnicast() {
+			if linkLocal == "" {
+				linkLocal = ip.String()
+				if ip.To4() == nil {
+					linkLocal += "%" + iface.Name
+				}
+			}
+			continue
+		}
+		return ip.String(), nil
+	}
+
+	if linkLocal != "" {
+		return linkLocal, nil
+	}
+	return "", fmt.Errorf("Interface %s has no address to bind to", host)
+}
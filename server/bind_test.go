@@ -0,0 +1,101 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/server"
+)
+
+// serveTCP serves a group with a listener on a free port bound as l asks until the test ends,
+// and returns the port
+func serveTCP(t *testing.T, l server.ListenArgs) int {
+	l.Type = server.ListenTCP
+	l.Port = freePort(t)
+	ln := listener(0)
+	ln.Args = l
+
+	g := server.NewGroup(ln)
+	served := make(chan error, 1)
+	go func() { served <- g.Serve() }()
+	t.Cleanup(func() { g.Close() })
+
+	// Give the listener a moment to bind or fail
+	select {
+	case err := <-served:
+		t.Fatalf("Error serving: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return l.Port
+}
+
+func reachable(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+func TestBindHost(t *testing.T) {
+	port := serveTCP(t, server.ListenArgs{Host: "127.0.0.1", IPVersion: server.IPv4Only})
+	if !reachable("127.0.0.1:" + strconv.Itoa(port)) {
+		t.Fatal("Expected the listener to be reachable on 127.0.0.1")
+	}
+}
+
+func TestBindInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lo string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			lo = iface.Name
+			break
+		}
+	}
+	if lo == "" {
+		t.Skip("No loopback interface")
+	}
+
+	port := serveTCP(t, server.ListenArgs{Host: lo, IPVersion: server.IPv4Only})
+	if !reachable("127.0.0.1:" + strconv.Itoa(port)) {
+		t.Fatalf("Expected the listener on %s to be reachable on 127.0.0.1", lo)
+	}
+}
+
+func TestBindIPv6Only(t *testing.T) {
+	if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("No IPv6 loopback")
+	} else {
+		ln.Close()
+	}
+
+	port := serveTCP(t, server.ListenArgs{IPVersion: server.IPv6Only})
+	if !reachable("[::1]:" + strconv.Itoa(port)) {
+		t.Fatal("Expected the listener to be reachable on ::1")
+	}
+	if reachable("127.0.0.1:" + strconv.Itoa(port)) {
+		t.Fatal("Expected an IPv6 only listener not to accept IPv4 connections")
+	}
+}
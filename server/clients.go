@@ -0,0 +1,330 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/orcas"
+)
+
+// ClientConn counts the bytes, requests and errors of one client connection so clients that send
+// far more than the rest can be found. The counts of all open connections can be seen with the
+// "stats conns" command, and the same counts added up for each client IP with "stats clients".
+// Connections are forgotten once they are closed.
+type ClientConn struct {
+	net.Conn
+	id     uint64
+	opened time.Time
+
+	bytesRead    uint64
+	bytesWritten uint64
+	requests     uint64
+	errors       uint64
+
+	closeOnce sync.Once
+	// onClose, if set, is called once when the connection is closed
+	onClose func()
+	// idleTimeout, if set, is how long a read waits for the client to send anything before the
+	// connection is given up on
+	idleTimeout time.Duration
+	// maxRequests, if set, is the number of requests after which the connection is closed
+	maxRequests uint64
+
+	// lock guards busy and draining, which let a server that is shutting down close the
+	// connection between requests
+	lock     sync.Mutex
+	busy     bool
+	draining bool
+	// ageTimer, if set, drains the connection once it's been open too long
+	ageTimer *time.Timer
+}
+
+var (
+	clientsLock sync.Mutex
+	clients     = make(map[*ClientConn]struct{})
+	nextConnID  uint64
+)
+
+// NewClientConn wraps a newly accepted connection and adds it to the open connections
+func NewClientConn(conn net.Conn) *ClientConn {
+	c := &ClientConn{
+		Conn:   conn,
+		id:     atomic.AddUint64(&nextConnID, 1),
+		opened: time.Now(),
+	}
+
+	clientsLock.Lock()
+	clients[c] = struct{}{}
+	clientsLock.Unlock()
+
+	return c
+}
+
+func (c *ClientConn) Read(p []byte) (int, error) {
+	if c.idleTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+	n, err := c.Conn.Read(p)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.idleTimeout > 0 {
+		metrics.IncCounter(MetricConnectionsIdleClosed)
+		logger.Debug("Closing idle connection", "remote", c.RemoteAddr(), "idle", c.idleTimeout)
+	}
+	return n, err
+}
+
+func (c *ClientConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+	return n, err
+}
+
+// Close closes the connection and removes it from the open connections
+func (c *ClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		if c.ageTimer != nil {
+			c.ageTimer.Stop()
+		}
+		c.lock.Unlock()
+
+		clientsLock.Lock()
+		delete(clients, c)
+		clientsLock.Unlock()
+
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// ip returns the IP of the client, or the whole remote address if it has no port, like for unix
+// sockets. It's asked for each time since the address of a PROXY protocol connection is only
+// known after its first read.
+func (c *ClientConn) ip() string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Parser wraps the request parser of the connection to count each request it parses. w is the
+// writer the connection's responses go through. Responses the responder held back to send with
+// the next one are flushed from it before a draining connection is closed.
+func (c *ClientConn) Parser(rp common.RequestParser, w *bufio.Writer) common.RequestParser {
+	return clientParser{RequestParser: rp, c: c, w: w}
+}
+
+// Orca wraps the orca of the connection to count each error sent back to the client and to
+// answer "stats conns" and "stats clients" from the open connections. Other stats are passed on.
+func (c *ClientConn) Orca(o orcas.Orca, res common.Responder) orcas.Orca {
+	return clientOrca{Orca: o, c: c, res: res}
+}
+
+type clientParser struct {
+	common.RequestParser
+	c *ClientConn
+	w *bufio.Writer
+}
+
+func (p clientParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	// The previous request is done, so a draining connection can be closed now
+	if !p.c.idle() {
+		if p.w != nil {
+			if err := p.w.Flush(); err != nil {
+				return nil, common.RequestUnknown, 0, err
+			}
+		}
+		return nil, common.RequestUnknown, 0, io.EOF
+	}
+
+	request, reqType, start, err := p.RequestParser.Parse()
+	if err == nil {
+		n := atomic.AddUint64(&p.c.requests, 1)
+		p.c.lock.Lock()
+		p.c.busy = true
+		// The last request allowed is still answered before the connection is closed
+		if p.c.maxRequests > 0 && n >= p.c.maxRequests && !p.c.draining {
+			p.c.draining = true
+			metrics.IncCounter(MetricConnectionsMaxReqClosed)
+		}
+		p.c.lock.Unlock()
+	}
+	return request, reqType, start, err
+}
+
+// idle marks the connection as waiting for its next request and returns false if it's draining
+func (c *ClientConn) idle() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.busy = false
+	return !c.draining
+}
+
+// limit closes the connection between requests after maxRequests requests or once it's been open
+// for about maxAge, whichever comes first, so clients reconnect and spread out again behind a load
+// balancer. Zero turns either off.
+func (c *ClientConn) limit(maxRequests int, maxAge time.Duration) {
+	c.maxRequests = uint64(maxRequests)
+	if maxAge <= 0 {
+		return
+	}
+
+	// Ages are stretched by up to a tenth so connections opened together don't all close together
+	age := maxAge + time.Duration(rand.Int63n(int64(maxAge)/10+1))
+
+	c.lock.Lock()
+	c.ageTimer = time.AfterFunc(age, func() {
+		metrics.IncCounter(MetricConnectionsMaxAgeClosed)
+		c.drain()
+	})
+	c.lock.Unlock()
+}
+
+// drain closes the connection once the request it's working on, if any, is done
+func (c *ClientConn) drain() {
+	c.lock.Lock()
+	c.draining = true
+	busy := c.busy
+	c.lock.Unlock()
+
+	if !busy {
+		c.Close()
+	}
+}
+
+type clientOrca struct {
+	orcas.Orca
+	c   *ClientConn
+	res common.Responder
+}
+
+func (o clientOrca) Stats(req common.StatsRequest) error {
+	switch string(req.Group) {
+	case "conns":
+		return o.res.Stats(req.Opaque, ConnStats())
+	case "clients":
+		return o.res.Stats(req.Opaque, ClientStats())
+	}
+	return o.Orca.Stats(req)
+}
+
+func (o clientOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	// A miss on a delete or touch is sent as an error, but the client did nothing wrong
+	if err != common.ErrKeyNotFound {
+		atomic.AddUint64(&o.c.errors, 1)
+	}
+	o.Orca.Error(req, reqType, err)
+}
+
+// openConns returns the open connections in the order they were opened
+func openConns() []*ClientConn {
+	clientsLock.Lock()
+	conns := make([]*ClientConn, 0, len(clients))
+	for c := range clients {
+		conns = append(conns, c)
+	}
+	clientsLock.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// connCounts are the counts of one connection or the sum of several
+type connCounts struct {
+	bytesRead, bytesWritten, requests, errors uint64
+}
+
+func (c *ClientConn) counts() connCounts {
+	return connCounts{
+		bytesRead:    atomic.LoadUint64(&c.bytesRead),
+		bytesWritten: atomic.LoadUint64(&c.bytesWritten),
+		requests:     atomic.LoadUint64(&c.requests),
+		errors:       atomic.LoadUint64(&c.errors),
+	}
+}
+
+func appendCounts(stats []common.Stat, prefix string, cc connCounts) []common.Stat {
+	return append(stats,
+		common.Stat{Name: prefix + "bytes_read", Value: strconv.FormatUint(cc.bytesRead, 10)},
+		common.Stat{Name: prefix + "bytes_written", Value: strconv.FormatUint(cc.bytesWritten, 10)},
+		common.Stat{Name: prefix + "requests", Value: strconv.FormatUint(cc.requests, 10)},
+		common.Stat{Name: prefix + "errors", Value: strconv.FormatUint(cc.errors, 10)},
+	)
+}
+
+// ConnStats returns the stats of each open connection, named by an id for the connection, e.g.
+// 12:addr and 12:bytes_read.
+func ConnStats() []common.Stat {
+	now := time.Now()
+	var stats []common.Stat
+
+	for _, c := range openConns() {
+		prefix := strconv.FormatUint(c.id, 10) + ":"
+		stats = append(stats,
+			common.Stat{Name: prefix + "addr", Value: c.RemoteAddr().String()},
+			common.Stat{Name: prefix + "age_sec", Value: strconv.FormatInt(int64(now.Sub(c.opened)/time.Second), 10)},
+		)
+		stats = appendCounts(stats, prefix, c.counts())
+	}
+
+	return stats
+}
+
+// ClientStats returns the number of open connections from each client IP and the sum of their
+// stats, named by the IP, e.g. 10.0.0.1:conns and 10.0.0.1:bytes_read.
+func ClientStats() []common.Stat {
+	var ips []string
+	conns := make(map[string]uint64)
+	sums := make(map[string]connCounts)
+
+	for _, c := range openConns() {
+		ip := c.ip()
+		if conns[ip] == 0 {
+			ips = append(ips, ip)
+		}
+		conns[ip]++
+
+		cc, sum := c.counts(), sums[ip]
+		sum.bytesRead += cc.bytesRead
+		sum.bytesWritten += cc.bytesWritten
+		sum.requests += cc.requests
+		sum.errors += cc.errors
+		sums[ip] = sum
+	}
+
+	sort.Strings(ips)
+
+	var stats []common.Stat
+	for _, ip := range ips {
+		stats = append(stats, common.Stat{Name: ip + ":conns", Value: strconv.FormatUint(conns[ip], 10)})
+		stats = appendCounts(stats, ip+":", sums[ip])
+	}
+
+	return stats
+}
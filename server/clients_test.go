@@ -0,0 +1,118 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/server"
+)
+
+// statValue returns the value of the named stat, or "" if it's missing
+func statValue(stats []common.Stat, name string) string {
+	for _, s := range stats {
+		if s.Name == name {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+func TestClientConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ln.Close()
+
+	// connect opens a connection and returns both ends, the accepted one wrapped
+	connect := func() (net.Conn, *server.ClientConn) {
+		remote, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return remote, server.NewClientConn(conn)
+	}
+
+	remote1, c1 := connect()
+	defer remote1.Close()
+	remote2, c2 := connect()
+	defer remote2.Close()
+
+	remote1.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := c1.Read(buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c2.Write([]byte("abc"))
+
+	// One request that fails, one that misses and a parse error
+	rp := c1.Parser(&testRequestParser{reqType: common.RequestDelete, req: common.DeleteRequest{}}, nil)
+	rp.Parse()
+	rp.Parse()
+	o := c1.Orca(&testOrca{called: make(map[string]interface{})}, nil)
+	o.Error(nil, common.RequestUnknown, common.ErrBadRequest)
+	o.Error(common.DeleteRequest{}, common.RequestDelete, common.ErrKeyNotFound)
+
+	stats := server.ConnStats()
+	prefix := func(c net.Conn) string {
+		for _, s := range stats {
+			if strings.HasSuffix(s.Name, ":addr") && s.Value == c.LocalAddr().String() {
+				return strings.TrimSuffix(s.Name, "addr")
+			}
+		}
+		t.Fatalf("Expected a connection from %v in %v", c.LocalAddr(), stats)
+		return ""
+	}
+
+	p1, p2 := prefix(remote1), prefix(remote2)
+	for name, want := range map[string]string{
+		p1 + "bytes_read":    "5",
+		p1 + "requests":      "1",
+		p1 + "errors":        "1",
+		p2 + "bytes_written": "3",
+		p2 + "requests":      "0",
+	} {
+		if got := statValue(stats, name); got != want {
+			t.Errorf("Expected %s to be %s, got %q", name, want, got)
+		}
+	}
+
+	clients := server.ClientStats()
+	if got := statValue(clients, "127.0.0.1:conns"); got == "" {
+		t.Fatalf("Expected 127.0.0.1 in the client stats, got %v", clients)
+	}
+	conns, _ := strconv.Atoi(statValue(clients, "127.0.0.1:conns"))
+	read, _ := strconv.Atoi(statValue(clients, "127.0.0.1:bytes_read"))
+	if conns < 2 || read < 5 {
+		t.Errorf("Expected the client stats to add up both connections, got %v", clients)
+	}
+
+	c1.Close()
+	for _, s := range server.ConnStats() {
+		if s.Name == p1+"addr" {
+			t.Fatalf("Expected a closed connection to be forgotten")
+		}
+	}
+	c2.Close()
+}
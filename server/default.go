@@ -15,9 +15,9 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
 
 	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/metrics"
@@ -43,6 +43,15 @@ func Default(conns []io.Closer, rp common.RequestParser, o orcas.Orca) Server {
 	}
 }
 
+// requestContext gives the request a context that ends after RequestTimeout, if there is one
+func requestContext(req common.Request) (common.Request, context.CancelFunc) {
+	if RequestTimeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+	return common.WithContext(req, ctx), cancel
+}
+
 // Loop acts as a master loop for the connection that it is given. Requests are
 // read using the given common.RequestParser and performed by the given orcas.Orca.
 // The connections will all be closed upon an unrecoverable error.
@@ -50,8 +59,7 @@ func (s *DefaultServer) Loop() {
 	defer func() {
 		if r := recover(); r != nil {
 			if r != io.EOF {
-				log.Println("Recovered from runtime panic:", r)
-				log.Println("Panic location: ", identifyPanic())
+				logger.Error("Recovered from runtime panic", "panic", r, "location", identifyPanic())
 			}
 
 			abort(s.conns, fmt.Errorf("Runtime panic: %v", r))
@@ -64,9 +72,15 @@ func (s *DefaultServer) Loop() {
 			if err == common.ErrBadRequest ||
 				err == common.ErrBadLength ||
 				err == common.ErrBadFlags ||
-				err == common.ErrBadExptime {
+				err == common.ErrBadExptime ||
+				err == common.ErrAuth {
 				s.orca.Error(nil, common.RequestUnknown, err)
 				continue
+			} else if err == common.ErrValueTooBig {
+				// The value has been skipped, but the rest of the request is there to respond to
+				metrics.IncCounter(MetricErrValueTooBig)
+				s.orca.Error(request, reqType, err)
+				continue
 			} else {
 				// Otherwise IO error. Abort!
 				abort(s.conns, err)
@@ -74,8 +88,22 @@ func (s *DefaultServer) Loop() {
 			}
 		}
 
+		// Keys are checked here so no protocol can pass a key to the handlers that memcached
+		// would reject or that would break the text protocol
+		if err := common.ValidateKeys(request); err != nil {
+			metrics.IncCounter(MetricErrBadKey)
+			if err := common.SkipValue(request); err != nil {
+				abort(s.conns, err)
+				return
+			}
+			s.orca.Error(request, reqType, err)
+			continue
+		}
+
 		metrics.IncCounter(MetricCmdTotal)
 
+		request, cancel := requestContext(request)
+
 		// TODO: handle nil
 		switch reqType {
 		case common.RequestSet:
@@ -108,22 +136,47 @@ func (s *DefaultServer) Loop() {
 		case common.RequestGat:
 			metrics.IncCounter(MetricCmdGat)
 			err = s.orca.Gat(request.(common.GATRequest))
+		case common.RequestIncr:
+			metrics.IncCounter(MetricCmdIncr)
+			err = s.orca.Incr(request.(common.IncrDecrRequest))
+		case common.RequestDecr:
+			metrics.IncCounter(MetricCmdDecr)
+			err = s.orca.Decr(request.(common.IncrDecrRequest))
 		case common.RequestNoop:
 			metrics.IncCounter(MetricCmdNoop)
 			err = s.orca.Noop(request.(common.NoopRequest))
 		case common.RequestQuit:
 			metrics.IncCounter(MetricCmdQuit)
 			s.orca.Quit(request.(common.QuitRequest))
+			cancel()
 			abort(s.conns, err)
 			return
 		case common.RequestVersion:
 			metrics.IncCounter(MetricCmdVersion)
 			err = s.orca.Version(request.(common.VersionRequest))
+		case common.RequestVerbosity:
+			metrics.IncCounter(MetricCmdVerbosity)
+			err = s.orca.Verbosity(request.(common.VerbosityRequest))
+		case common.RequestFlush:
+			metrics.IncCounter(MetricCmdFlush)
+			err = s.orca.Flush(request.(common.FlushRequest))
+		case common.RequestStats:
+			metrics.IncCounter(MetricCmdStats)
+			err = s.orca.Stats(request.(common.StatsRequest))
 		case common.RequestUnknown:
 			metrics.IncCounter(MetricCmdUnknown)
 			err = s.orca.Unknown(request)
 		}
 
+		cancel()
+
+		// The handler may not have read all of a streamed value, e.g. if an add failed. The rest
+		// has to be skipped before the next request can be parsed.
+		if serr := common.SkipValue(request); serr != nil {
+			abort(s.conns, serr)
+			return
+		}
+
 		if err != nil {
 			if common.IsAppError(err) {
 				if err != common.ErrKeyNotFound {
@@ -145,6 +198,10 @@ func (s *DefaultServer) Loop() {
 			metrics.ObserveHist(HistAdd, dur)
 		case common.RequestReplace:
 			metrics.ObserveHist(HistReplace, dur)
+		case common.RequestAppend:
+			metrics.ObserveHist(HistAppend, dur)
+		case common.RequestPrepend:
+			metrics.ObserveHist(HistPrepend, dur)
 		case common.RequestDelete:
 			metrics.ObserveHist(HistDelete, dur)
 		case common.RequestTouch:
@@ -155,6 +212,12 @@ func (s *DefaultServer) Loop() {
 			metrics.ObserveHist(HistGetE, dur)
 		case common.RequestGat:
 			metrics.ObserveHist(HistGat, dur)
+		case common.RequestIncr:
+			metrics.ObserveHist(HistIncr, dur)
+		case common.RequestDecr:
+			metrics.ObserveHist(HistDecr, dur)
+		case common.RequestFlush:
+			metrics.ObserveHist(HistFlush, dur)
 		}
 	}
 }
@@ -111,6 +111,14 @@ func (t *testOrca) Gat(req common.GATRequest) error {
 	t.called["Gat"] = nil
 	return t.gatRes
 }
+func (t *testOrca) Incr(req common.IncrDecrRequest) error {
+	t.called["Incr"] = nil
+	return nil
+}
+func (t *testOrca) Decr(req common.IncrDecrRequest) error {
+	t.called["Decr"] = nil
+	return nil
+}
 func (t *testOrca) Noop(req common.NoopRequest) error {
 	t.called["Noop"] = nil
 	return t.noopRes
@@ -123,28 +131,47 @@ func (t *testOrca) Version(req common.VersionRequest) error {
 	t.called["Version"] = nil
 	return t.versionRes
 }
+func (t *testOrca) Verbosity(req common.VerbosityRequest) error {
+	t.called["Verbosity"] = nil
+	return nil
+}
+func (t *testOrca) Stats(req common.StatsRequest) error {
+	t.called["Stats"] = nil
+	return nil
+}
+func (t *testOrca) Flush(req common.FlushRequest) error {
+	t.called["Flush"] = nil
+	return nil
+}
 func (t *testOrca) Unknown(req common.Request) error {
 	t.called["Unknown"] = nil
 	return t.unknownRes
 }
-func (t *testOrca) Error(req common.Request, reqType common.RequestType, err error) {}
+func (t *testOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	t.called["Error"] = nil
+}
 
 type testPanicOrca struct{}
 
-func (t testPanicOrca) Set(req common.SetRequest) error         { panic("test") }
-func (t testPanicOrca) Add(req common.SetRequest) error         { panic("test") }
-func (t testPanicOrca) Replace(req common.SetRequest) error     { panic("test") }
-func (t testPanicOrca) Append(req common.SetRequest) error      { panic("test") }
-func (t testPanicOrca) Prepend(req common.SetRequest) error     { panic("test") }
-func (t testPanicOrca) Delete(req common.DeleteRequest) error   { panic("test") }
-func (t testPanicOrca) Touch(req common.TouchRequest) error     { panic("test") }
-func (t testPanicOrca) Get(req common.GetRequest) error         { panic("test") }
-func (t testPanicOrca) GetE(req common.GetRequest) error        { panic("test") }
-func (t testPanicOrca) Gat(req common.GATRequest) error         { panic("test") }
-func (t testPanicOrca) Noop(req common.NoopRequest) error       { panic("test") }
-func (t testPanicOrca) Quit(req common.QuitRequest) error       { panic("test") }
-func (t testPanicOrca) Version(req common.VersionRequest) error { panic("test") }
-func (t testPanicOrca) Unknown(req common.Request) error        { panic("test") }
+func (t testPanicOrca) Set(req common.SetRequest) error             { panic("test") }
+func (t testPanicOrca) Add(req common.SetRequest) error             { panic("test") }
+func (t testPanicOrca) Replace(req common.SetRequest) error         { panic("test") }
+func (t testPanicOrca) Append(req common.SetRequest) error          { panic("test") }
+func (t testPanicOrca) Prepend(req common.SetRequest) error         { panic("test") }
+func (t testPanicOrca) Delete(req common.DeleteRequest) error       { panic("test") }
+func (t testPanicOrca) Touch(req common.TouchRequest) error         { panic("test") }
+func (t testPanicOrca) Get(req common.GetRequest) error             { panic("test") }
+func (t testPanicOrca) GetE(req common.GetRequest) error            { panic("test") }
+func (t testPanicOrca) Gat(req common.GATRequest) error             { panic("test") }
+func (t testPanicOrca) Incr(req common.IncrDecrRequest) error       { panic("test") }
+func (t testPanicOrca) Decr(req common.IncrDecrRequest) error       { panic("test") }
+func (t testPanicOrca) Noop(req common.NoopRequest) error           { panic("test") }
+func (t testPanicOrca) Quit(req common.QuitRequest) error           { panic("test") }
+func (t testPanicOrca) Version(req common.VersionRequest) error     { panic("test") }
+func (t testPanicOrca) Stats(req common.StatsRequest) error         { panic("test") }
+func (t testPanicOrca) Flush(req common.FlushRequest) error         { panic("test") }
+func (t testPanicOrca) Verbosity(req common.VerbosityRequest) error { panic("test") }
+func (t testPanicOrca) Unknown(req common.Request) error            { panic("test") }
 
 func (t testPanicOrca) Error(req common.Request, reqType common.RequestType, err error) {}
 
@@ -257,6 +284,32 @@ func TestDefaultServer(t *testing.T) {
 			})
 		})
 
+		t.Run("Incr", func(t *testing.T) {
+			testSuccess(t, "Incr", common.RequestIncr, common.IncrDecrRequest{
+				Key:   []byte("key"),
+				Delta: 1,
+			})
+		})
+
+		t.Run("Decr", func(t *testing.T) {
+			testSuccess(t, "Decr", common.RequestDecr, common.IncrDecrRequest{
+				Key:   []byte("key"),
+				Delta: 1,
+			})
+		})
+
+		t.Run("Stats", func(t *testing.T) {
+			testSuccess(t, "Stats", common.RequestStats, common.StatsRequest{})
+		})
+
+		t.Run("Flush", func(t *testing.T) {
+			testSuccess(t, "Flush", common.RequestFlush, common.FlushRequest{})
+		})
+
+		t.Run("Verbosity", func(t *testing.T) {
+			testSuccess(t, "Verbosity", common.RequestVerbosity, common.VerbosityRequest{})
+		})
+
 		t.Run("Noop", func(t *testing.T) {
 			testSuccess(t, "Noop", common.RequestNoop, common.NoopRequest{})
 		})
@@ -272,6 +325,14 @@ func TestDefaultServer(t *testing.T) {
 		t.Run("Unknown", func(t *testing.T) {
 			testSuccess(t, "Unknown", common.RequestUnknown, nil)
 		})
+
+		// Bad keys are rejected before the orca gets the request
+		t.Run("BadKey", func(t *testing.T) {
+			testSuccess(t, "Error", common.RequestSet, common.SetRequest{
+				Key:  []byte("bad key"),
+				Data: []byte("data"),
+			})
+		})
 	})
 
 	t.Run("Panic", func(t *testing.T) {
@@ -317,9 +378,14 @@ func TestDefaultServer(t *testing.T) {
 		t.Run("Get", func(t *testing.T) { testPanic(t, common.RequestGet, common.GetRequest{}) })
 		t.Run("GetE", func(t *testing.T) { testPanic(t, common.RequestGetE, common.GetRequest{}) })
 		t.Run("Gat", func(t *testing.T) { testPanic(t, common.RequestGat, common.GATRequest{}) })
+		t.Run("Incr", func(t *testing.T) { testPanic(t, common.RequestIncr, common.IncrDecrRequest{}) })
+		t.Run("Decr", func(t *testing.T) { testPanic(t, common.RequestDecr, common.IncrDecrRequest{}) })
 		t.Run("Noop", func(t *testing.T) { testPanic(t, common.RequestNoop, common.NoopRequest{}) })
 		t.Run("Quit", func(t *testing.T) { testPanic(t, common.RequestQuit, common.QuitRequest{}) })
 		t.Run("Version", func(t *testing.T) { testPanic(t, common.RequestVersion, common.VersionRequest{}) })
+		t.Run("Stats", func(t *testing.T) { testPanic(t, common.RequestStats, common.StatsRequest{}) })
+		t.Run("Flush", func(t *testing.T) { testPanic(t, common.RequestFlush, common.FlushRequest{}) })
+		t.Run("Verbosity", func(t *testing.T) { testPanic(t, common.RequestVerbosity, common.VerbosityRequest{}) })
 		t.Run("Unknown", func(t *testing.T) { testPanic(t, common.RequestUnknown, nil) })
 	})
 }
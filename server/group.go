@@ -0,0 +1,177 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/orcas"
+)
+
+// ErrGroupClosed is returned by Group.Serve once the group is shut down or closed
+var ErrGroupClosed = errors.New("Server group closed")
+
+// Listener is one of the listeners of a Group, with the orca and handlers its connections are
+// served by
+type Listener struct {
+	Args   ListenArgs
+	Server ServerConst
+	Orca   orcas.OrcaConst
+	L1, L2 handlers.HandlerConst
+}
+
+// Group serves several listeners, like TCP ports and unix sockets, that can each have their own
+// orca and handlers. All of them are started and shut down together.
+type Group struct {
+	listeners []Listener
+
+	lock    sync.Mutex
+	bound   []net.Listener
+	conns   map[*ClientConn]struct{}
+	closing bool
+	// empty is closed once the group is closing and its last connection is gone
+	empty     chan struct{}
+	emptyOnce sync.Once
+}
+
+// NewGroup returns a group of the given listeners. Nothing is bound until Serve is called.
+func NewGroup(listeners ...Listener) *Group {
+	return &Group{
+		listeners: listeners,
+		conns:     make(map[*ClientConn]struct{}),
+		empty:     make(chan struct{}),
+	}
+}
+
+// Serve binds every listener and serves them all until the group is shut down or closed, after
+// which it returns ErrGroupClosed. If any listener can't be bound, the ones that were are closed
+// again and the error is returned.
+func (g *Group) Serve() error {
+	bound := make([]net.Listener, 0, len(g.listeners))
+	for _, ln := range g.listeners {
+		listener, err := ln.Args.listen()
+		if err != nil {
+			for _, b := range bound {
+				b.Close()
+			}
+			return err
+		}
+		bound = append(bound, listener)
+	}
+
+	g.lock.Lock()
+	if g.closing {
+		g.lock.Unlock()
+		for _, b := range bound {
+			b.Close()
+		}
+		return ErrGroupClosed
+	}
+	g.bound = bound
+	g.lock.Unlock()
+
+	wg := sync.WaitGroup{}
+	for i, listener := range bound {
+		wg.Add(1)
+		go func(listener net.Listener, ln Listener) {
+			defer wg.Done()
+			serve(listener, ln, g)
+		}(listener, g.listeners[i])
+	}
+	wg.Wait()
+
+	return ErrGroupClosed
+}
+
+// Serving returns whether every listener is bound and the group isn't shutting down
+func (g *Group) Serving() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.bound != nil && !g.closing
+}
+
+// Shutdown stops accepting connections and closes each open connection once the request it is
+// working on is done. If ctx is done first, the connections that are left are closed right away
+// and the error of ctx is returned.
+func (g *Group) Shutdown(ctx context.Context) error {
+	for _, c := range g.close() {
+		c.drain()
+	}
+
+	select {
+	case <-g.empty:
+		return nil
+	case <-ctx.Done():
+		g.Close()
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes every open connection right away
+func (g *Group) Close() error {
+	for _, c := range g.close() {
+		c.Close()
+	}
+	return nil
+}
+
+// close closes the listeners and returns the connections that are still open
+func (g *Group) close() []*ClientConn {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.closing = true
+	for _, b := range g.bound {
+		b.Close()
+	}
+	g.bound = nil
+
+	conns := make([]*ClientConn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	if len(conns) == 0 {
+		g.emptyOnce.Do(func() { close(g.empty) })
+	}
+	return conns
+}
+
+// track adds a new connection to the group. It returns false if the group is closing, in which
+// case the connection should be closed.
+func (g *Group) track(c *ClientConn) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.closing {
+		return false
+	}
+	g.conns[c] = struct{}{}
+	return true
+}
+
+// untrack removes a connection once it's closed
+func (g *Group) untrack(c *ClientConn) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	delete(g.conns, c)
+	if g.closing && len(g.conns) == 0 {
+		g.emptyOnce.Do(func() { close(g.empty) })
+	}
+}
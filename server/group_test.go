@@ -0,0 +1,106 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/server"
+)
+
+func listener(port int) server.Listener {
+	return server.Listener{
+		Args:   server.ListenArgs{Type: server.ListenTCP, Port: port},
+		Server: server.Default,
+		Orca:   orcas.L1Only,
+		L1:     noBackend,
+		L2:     noBackend,
+	}
+}
+
+func TestGroupShutdown(t *testing.T) {
+	port1, port2 := freePort(t), freePort(t)
+	g := server.NewGroup(listener(port1), listener(port2))
+
+	served := make(chan error, 1)
+	go func() { served <- g.Serve() }()
+
+	addr1 := waitListening(t, port1)
+	addr2 := waitListening(t, port2)
+
+	conns := make([]net.Conn, 0, 2)
+	for _, addr := range []string{addr1, addr2} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	// Give the group a moment to pick up the connections
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Idle connections are closed by the shutdown
+	for _, c := range conns {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected the connection to be closed, got %v", err)
+		}
+	}
+
+	select {
+	case err := <-served:
+		if err != server.ErrGroupClosed {
+			t.Fatalf("Expected ErrGroupClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve didn't return after the shutdown")
+	}
+
+	for _, addr := range []string{addr1, addr2} {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Fatalf("Expected %s to be closed", addr)
+		}
+	}
+}
+
+func TestGroupBindError(t *testing.T) {
+	port := freePort(t)
+	g := server.NewGroup(listener(port), listener(port))
+
+	if err := g.Serve(); err == nil || err == server.ErrGroupClosed {
+		t.Fatalf("Expected an error binding the same port twice, got %v", err)
+	}
+
+	// The listener that was bound is closed again
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("Expected the port to be free again, got %v", err)
+	}
+	ln.Close()
+}
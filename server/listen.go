@@ -16,66 +16,144 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
-	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/hongst/rend/binprot"
 	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/httpprot"
 	"github.com/hongst/rend/metrics"
 	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/resp"
 	"github.com/hongst/rend/textprot"
 )
 
+// ListenAndServe serves connections on the listener described by l until the process exits.
+// It panics if the listener can't be set up. To run several listeners that can be shut down, see
+// Group.
 func ListenAndServe(l ListenArgs, s ServerConst, o orcas.OrcaConst, h1, h2 handlers.HandlerConst) {
+	listener, err := l.listen()
+	if err != nil {
+		logPanic("Error setting up listener", "error", err)
+	}
+	serve(listener, Listener{Args: l, Server: s, Orca: o, L1: h1, L2: h2}, nil)
+}
+
+// listen binds the listener described by l
+func (l ListenArgs) listen() (net.Listener, error) {
 	var listener net.Listener
 	var err error
 
 	switch l.Type {
 	case ListenTCP:
-		listener, err = net.Listen("tcp", fmt.Sprintf(":%d", l.Port))
+		listener, err = listenTCP(l)
 		if err != nil {
-			log.Panicf("Error binding to port %d: %v\n", l.Port, err.Error())
+			return nil, err
 		}
+		listener = keepAliveListener{listener.(*net.TCPListener), l.TCP}
 
 	case ListenUnix:
-		err = os.Remove(l.Path)
-		if err != nil && !os.IsNotExist(err) {
-			log.Panicf("Error removing previous unix socket file at %s\n", l.Path)
-		}
-		listener, err = net.Listen("unix", l.Path)
+		listener, err = listenUnix(l.Path, l.Unix)
 		if err != nil {
-			log.Panicf("Error binding to unix socket at %s: %v\n", l.Path, err.Error())
+			return nil, err
 		}
 
 	default:
-		log.Panicf("Unsupported server listen type: %v", l.Type)
+		return nil, fmt.Errorf("Unsupported listen type %d", l.Type)
 	}
 
+	if l.ProxyProtocol {
+		listener = proxyListener{listener}
+	}
+
+	if l.TLSCert != "" {
+		conf, err := tlsConfig(l)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("Error setting up TLS: %v", err)
+		}
+		listener = tls.NewListener(listener, conf)
+	}
+
+	return listener, nil
+}
+
+// serve accepts connections on listener and serves them as ln describes until listener is
+// closed. If g isn't nil, the connections are tracked by it so they can be shut down with it.
+func serve(listener net.Listener, ln Listener, g *Group) {
+	l, s, o, h1, h2 := ln.Args, ln.Server, ln.Orca, ln.L1, ln.L2
+
+	lim := newLimiter(l)
+
+	// open is the number of connections from this listener that are still open
+	var open int64
+	// backoff is the wait after a failed accept. It grows while accepts keep failing.
+	var backoff time.Duration
+
 	for {
 		remote, err := listener.Accept()
 		if err != nil {
-			log.Println("Error accepting connection from remote:", err.Error())
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if remote != nil {
+				remote.Close()
+			}
+
+			// Errors like running out of file descriptors (EMFILE) or a client hanging up before
+			// it's accepted (ECONNABORTED) pass, so accepting is tried again. The wait keeps a
+			// burst of them from turning into a busy loop.
+			metrics.IncCounter(MetricAcceptErrors)
+			backoff = acceptBackoff(backoff)
+			logger.Warn("Error accepting connection from remote", "error", err, "retry_in", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		// The address of a PROXY protocol connection is only known once its header is read, so
+		// those are checked after the first read instead
+		if !l.ProxyProtocol && !l.ACL.permitsAddr(remote.RemoteAddr()) {
 			remote.Close()
 			continue
 		}
-		metrics.IncCounter(MetricConnectionsEstablishedExt)
 
-		if l.Type == ListenTCP {
-			tcpRemote := remote.(*net.TCPConn)
-			tcpRemote.SetKeepAlive(true)
-			tcpRemote.SetKeepAlivePeriod(30 * time.Second)
+		// Connections over the limits are closed right away so a flood of them can't use up every
+		// file descriptor and take down the connections that are already open
+		if !admit(&open, l.MaxConns) {
+			metrics.IncCounter(MetricConnectionsRejected)
+			logger.Debug("Rejected connection over the connection limit", "remote", remote.RemoteAddr())
+			remote.Close()
+			continue
+		}
+
+		metrics.IncCounter(MetricConnectionsEstablishedExt)
+		logger.Debug("Accepted connection", "remote", remote.RemoteAddr())
+		client := NewClientConn(remote)
+		client.onClose = func() {
+			release(&open)
+			if g != nil {
+				g.untrack(client)
+			}
+		}
+		client.idleTimeout = l.IdleTimeout
+		client.limit(l.MaxRequests, l.MaxAge)
+		if g != nil && !g.track(client) {
+			client.Close()
+			continue
 		}
 
 		// construct L1 handler using given constructor
 		l1, err := h1()
 		if err != nil {
-			log.Println("Error opening connection to L1:", err.Error())
-			remote.Close()
+			logger.Error("Error opening connection to L1", "error", err)
+			client.Close()
 			continue
 		}
 		metrics.IncCounter(MetricConnectionsEstablishedL1)
@@ -83,9 +161,9 @@ func ListenAndServe(l ListenArgs, s ServerConst, o orcas.OrcaConst, h1, h2 handl
 		// construct l2
 		l2, err := h2()
 		if err != nil {
-			log.Println("Error opening connection to L2:", err.Error())
+			logger.Error("Error opening connection to L2", "error", err)
 			l1.Close()
-			remote.Close()
+			client.Close()
 			continue
 		}
 		metrics.IncCounter(MetricConnectionsEstablishedL2)
@@ -94,33 +172,122 @@ func ListenAndServe(l ListenArgs, s ServerConst, o orcas.OrcaConst, h1, h2 handl
 		// The server loop can't be started until the protocol is known. Another goroutine is
 		// necessary here because we don't want to block accepting new connections if the current
 		// new connection doesn't send data immediately.
-		go func(remoteConn net.Conn) {
+		go func(remoteConn *ClientConn) {
 			remoteReader := bufio.NewReader(remoteConn)
 			remoteWriter := bufio.NewWriter(remoteConn)
 
+			if l.ProxyProtocol && !l.ACL.empty() {
+				// Reading anything reads the PROXY protocol header first
+				if _, err := remoteReader.Peek(1); err != nil || !l.ACL.permitsAddr(remoteConn.RemoteAddr()) {
+					abort([]io.Closer{remoteConn, l1, l2}, nil)
+					return
+				}
+			}
+
 			var reqParser common.RequestParser
 			var responder common.Responder
 
-			// A connection is either binary protocol or text. It cannot switch between the two.
+			// An HTTP listener only speaks HTTP, so there's nothing to detect
+			if l.HTTP {
+				p, r := httpprot.NewHTTPParserResponder(remoteReader, remoteWriter)
+				if len(l.Credentials) > 0 {
+					p = p.WithAuth(httpAuth(l.Credentials))
+				}
+				reqParser, responder = p, r
+				server := s([]io.Closer{remoteConn, l1, l2}, remoteConn.Parser(reqParser, remoteWriter), remoteConn.Orca(lim.orca(l.orca(o, remoteConn)(l1, l2, responder), remoteConn), responder))
+				go server.Loop()
+				return
+			}
+
+			// A connection is either binary protocol, text or RESP. It cannot switch between them.
 			// This is the way memcached handles protocols, so it can be as strict here.
 			binary, err := isBinaryRequest(remoteReader)
 			if err != nil {
 				// must be an IO error. Abort!
+				if err != io.EOF {
+					logger.Warn("Error reading first request", "remote", remoteConn.RemoteAddr(), "error", err)
+				}
 				abort([]io.Closer{remoteConn, l1, l2}, err)
 				return
 			}
 
+			// The first byte has already been peeked, so this can't fail
+			redis, _ := isRESPRequest(remoteReader)
+
 			if binary {
-				reqParser = binprot.NewBinaryParser(remoteReader)
-				responder = binprot.NewBinaryResponder(remoteWriter)
+				if l.AuditBinary {
+					reqParser, responder = binprot.NewAuditedBinaryParserResponder(remoteReader, remoteConn)
+				} else {
+					reqParser, responder = binprot.NewBinaryParserResponder(remoteReader, remoteWriter)
+				}
+				if len(l.Credentials) > 0 {
+					reqParser = newSASLParser(reqParser, responder, l.Credentials)
+				}
+			} else if len(l.Credentials) > 0 {
+				// Neither the text protocol nor RESP have a way to authenticate
+				metrics.IncCounter(MetricAuthFailures)
+				abort([]io.Closer{remoteConn, l1, l2}, errTextAuth)
+				return
+			} else if redis {
+				reqParser, responder = resp.NewRESPParser(remoteReader), resp.NewRESPResponder(remoteWriter)
 			} else {
-				reqParser = textprot.NewTextParser(remoteReader)
-				responder = textprot.NewTextResponder(remoteWriter)
+				reqParser, responder = textprot.NewTextParserResponder(remoteReader, remoteWriter)
 			}
 
-			server := s([]io.Closer{remoteConn, l1, l2}, reqParser, o(l1, l2, responder))
+			server := s([]io.Closer{remoteConn, l1, l2}, remoteConn.Parser(reqParser, remoteWriter), remoteConn.Orca(lim.orca(l.orca(o, remoteConn)(l1, l2, responder), remoteConn), responder))
 
 			go server.Loop()
-		}(remote)
+		}(client)
+	}
+}
+
+// Bounds of the wait after a failed accept
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// acceptBackoff returns the wait after a failed accept, given the wait after the one before it
+// or 0 if the one before it didn't fail
+func acceptBackoff(last time.Duration) time.Duration {
+	if last == 0 {
+		return minAcceptBackoff
+	}
+	return min(last*2, maxAcceptBackoff)
+}
+
+// totalConns is the number of client connections open across all listeners
+var totalConns int64
+
+// admit counts a new connection against the listener's limit and MaxTotalConns. If either is
+// reached, it returns false and the connection isn't counted.
+func admit(open *int64, max int) bool {
+	if n := atomic.AddInt64(open, 1); max > 0 && n > int64(max) {
+		atomic.AddInt64(open, -1)
+		return false
+	}
+
+	n := atomic.AddInt64(&totalConns, 1)
+	if MaxTotalConns > 0 && n > int64(MaxTotalConns) {
+		atomic.AddInt64(&totalConns, -1)
+		atomic.AddInt64(open, -1)
+		return false
+	}
+
+	metrics.SetIntGauge(MetricConnectionsOpen, uint64(n))
+	return true
+}
+
+// release uncounts a connection that was admitted once it's closed
+func release(open *int64) {
+	atomic.AddInt64(open, -1)
+	metrics.SetIntGauge(MetricConnectionsOpen, uint64(atomic.AddInt64(&totalConns, -1)))
+}
+
+// orca adds the access log, if there is one, to the orca of a connection
+func (l ListenArgs) orca(o orcas.OrcaConst, conn net.Conn) orcas.OrcaConst {
+	if l.AccessLog == nil {
+		return o
 	}
+	return orcas.RecordingTo(o, l.AccessLog, conn.RemoteAddr().String())
 }
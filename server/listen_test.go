@@ -0,0 +1,204 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/handlers"
+	"github.com/hongst/rend/handlers/inmem"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/server"
+)
+
+func noBackend() (handlers.Handler, error) { return nil, nil }
+
+// freePort returns a TCP port that nothing is listening on
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// waitListening waits for something to listen on the port and returns its address
+func waitListening(t *testing.T, port int) string {
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return addr
+		}
+	}
+	t.Fatalf("Listener on %s never started", addr)
+	return ""
+}
+
+// listen starts a listener with the given args on a free port and returns its address
+func listen(t *testing.T, l server.ListenArgs) string {
+	l.Type = server.ListenTCP
+	l.Port = freePort(t)
+	go server.ListenAndServe(l, server.Default, orcas.L1Only, noBackend, noBackend)
+	return waitListening(t, l.Port)
+}
+
+func TestMaxConns(t *testing.T) {
+	addr := listen(t, server.ListenArgs{MaxConns: 1})
+
+	// The connection used to wait for the listener is released in the background
+	time.Sleep(50 * time.Millisecond)
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer first.Close()
+
+	// open reports whether a connection is left open by the proxy
+	open := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := c.Read(make([]byte, 1))
+		ne, ok := err.(net.Error)
+		return ok && ne.Timeout()
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer second.Close()
+
+	if open(second) {
+		t.Fatalf("Expected the connection over the limit to be closed")
+	}
+	if !open(first) {
+		t.Fatalf("Expected the first connection to stay open")
+	}
+
+	// Once the first connection is gone there's room for another
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	third, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer third.Close()
+
+	if !open(third) {
+		t.Fatalf("Expected a connection under the limit to stay open")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := listen(t, server.ListenArgs{IdleTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the idle connection to be closed, got %v", err)
+	}
+}
+
+// statsConns sends a "stats conns" on conn and reads the answer, which comes from the proxy
+// itself and needs no backend
+func statsConns(conn net.Conn, r *bufio.Reader) error {
+	if _, err := conn.Write([]byte("stats conns\r\n")); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if line == "END\r\n" {
+			return nil
+		}
+	}
+}
+
+func TestMaxRequests(t *testing.T) {
+	addr := listen(t, server.ListenArgs{MaxRequests: 2})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+
+	// The last request allowed is answered before the connection is closed
+	for i := 0; i < 2; i++ {
+		if err := statsConns(conn, r); err != nil {
+			t.Fatalf("Expected request %d to be answered, got %v", i+1, err)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestMaxRequestsPipelined(t *testing.T) {
+	port := freePort(t)
+	go server.ListenAndServe(server.ListenArgs{Type: server.ListenTCP, Port: port, MaxRequests: 1},
+		server.Default, orcas.L1Only, inmem.New, noBackend)
+	addr := waitListening(t, port)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	// The response to the first set is held for the second, which is never run
+	if _, err := conn.Write([]byte("set a 0 0 1\r\nx\r\nset b 0 0 1\r\ny\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	out, err := io.ReadAll(conn)
+	if err != nil || string(out) != "STORED\r\n" {
+		t.Fatalf("Expected the last request allowed to be answered, got %q and %v", out, err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	addr := listen(t, server.ListenArgs{MaxAge: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	r := bufio.NewReader(conn)
+
+	if err := statsConns(conn, r); err != nil {
+		t.Fatalf("Expected a young connection to be answered, got %v", err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("Expected the old connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricProxyProtoV1     = metrics.AddCounter("proxy_proto_v1", nil)
+	MetricProxyProtoV2     = metrics.AddCounter("proxy_proto_v2", nil)
+	MetricProxyProtoLocal  = metrics.AddCounter("proxy_proto_local", nil)
+	MetricProxyProtoErrors = metrics.AddCounter("proxy_proto_errors", nil)
+)
+
+var errBadProxyHeader = errors.New("Invalid PROXY protocol header")
+
+var proxyV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	// The longest possible v1 header, including the CRLF
+	proxyV1MaxLen = 107
+	proxyV2HdrLen = 16
+)
+
+// proxyListener wraps accepted connections so the PROXY protocol header sent by a load balancer
+// is read before anything else. It sits under the TLS listener, if any, because the header is
+// sent in the clear before the TLS handshake.
+type proxyListener struct {
+	net.Listener
+}
+
+func (p proxyListener) Accept() (net.Conn, error) {
+	conn, err := p.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}, nil
+}
+
+// proxyConn reads the PROXY protocol header on the first read, so the accept loop is not blocked
+// waiting on a slow client. After the header is read, RemoteAddr returns the original client
+// address sent by the load balancer. RemoteAddr can be called from other goroutines while the
+// header is read, e.g. for the connection stats, so the address is guarded by a mutex.
+type proxyConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once sync.Once
+	err  error
+
+	mu   sync.Mutex
+	addr net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	addr := c.addr
+	c.mu.Unlock()
+
+	if addr != nil {
+		return addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) readHeader() {
+	addr, err := readProxyHeader(c.r)
+	if err != nil {
+		metrics.IncCounter(MetricProxyProtoErrors)
+		logger.Warn("Error reading PROXY protocol header", "remote", c.Conn.RemoteAddr(), "error", err)
+		c.err = err
+		return
+	}
+
+	c.mu.Lock()
+	c.addr = addr
+	c.mu.Unlock()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header. The returned address is nil if the
+// header doesn't carry one, e.g. for health checks from the load balancer itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyV2Sig) {
+		metrics.IncCounter(MetricProxyProtoV2)
+		return readProxyV2(r)
+	}
+
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		metrics.IncCounter(MetricProxyProtoV1)
+		return readProxyV1(r)
+	}
+
+	return nil, errBadProxyHeader
+}
+
+// readProxyV1 reads the text form of the header, e.g.
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 11211\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(line)), " ")
+
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		metrics.IncCounter(MetricProxyProtoLocal)
+		return nil, nil
+	}
+
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, errBadProxyHeader
+	}
+
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errBadProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the binary form of the header. Only the source address of TCP over IPv4 or
+// IPv6 is used, any other address families or TLVs are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyV2HdrLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	verCmd := hdr[12]
+	fam := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	if verCmd>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL command, the connection is from the load balancer itself
+	if verCmd&0x0F == 0 {
+		metrics.IncCounter(MetricProxyProtoLocal)
+		return nil, nil
+	}
+
+	switch fam {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	}
+
+	return nil, nil
+}
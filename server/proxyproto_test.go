@@ -0,0 +1,221 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyV1(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+		err    error
+	}{
+		{
+			name:   "TCP4",
+			header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 11211\r\n",
+			addr:   "192.168.0.1:56324",
+		},
+		{
+			name:   "TCP6",
+			header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 11211\r\n",
+			addr:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "UNKNOWN",
+			header: "PROXY UNKNOWN\r\n",
+		},
+		{
+			name:   "too long",
+			header: "PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen) + "\r\n",
+			err:    errBadProxyHeader,
+		},
+		{
+			name:   "missing CR",
+			header: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 11211\n",
+			err:    errBadProxyHeader,
+		},
+		{
+			name:   "bad address",
+			header: "PROXY TCP4 192.168.0 192.168.0.11 56324 11211\r\n",
+			err:    errBadProxyHeader,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(test.header + "get foo\r\n"))
+			addr, err := readProxyV1(r)
+			if err != test.err {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			checkProxyAddr(t, addr, test.addr)
+
+			// Nothing past the header is read
+			if rest, _ := io.ReadAll(r); string(rest) != "get foo\r\n" {
+				t.Fatalf("Expected the command after the header to be left, got %q", rest)
+			}
+		})
+	}
+}
+
+// proxyV2 builds a v2 header with the given version and command, address family and body. The
+// length is that of the body unless one is given.
+func proxyV2(verCmd, fam byte, body []byte, length int) []byte {
+	if length < 0 {
+		length = len(body)
+	}
+	hdr := append([]byte(nil), proxyV2Sig...)
+	hdr = append(hdr, verCmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(length))
+	return append(hdr, body...)
+}
+
+func TestReadProxyV2(t *testing.T) {
+	ipv4 := []byte{
+		10, 0, 0, 1, // source
+		10, 0, 0, 2, // destination
+		0x04, 0xD2, // source port 1234
+		0x2B, 0xCB, // destination port 11211
+	}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x04, 0xD2, 0x2B, 0xCB)
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		err    error
+	}{
+		{
+			name:   "LOCAL",
+			header: proxyV2(0x20, 0x00, nil, -1),
+		},
+		{
+			name:   "LOCAL with body",
+			header: proxyV2(0x20, 0x11, ipv4, -1),
+		},
+		{
+			name:   "IPv4",
+			header: proxyV2(0x21, 0x11, ipv4, -1),
+			addr:   "10.0.0.1:1234",
+		},
+		{
+			name:   "IPv6",
+			header: proxyV2(0x21, 0x21, ipv6, -1),
+			addr:   "[2001:db8::1]:1234",
+		},
+		{
+			name:   "IPv4 with TLVs",
+			header: proxyV2(0x21, 0x11, append(append([]byte(nil), ipv4...), 0x04, 0x00, 0x01, 0xFF), -1),
+			addr:   "10.0.0.1:1234",
+		},
+		{
+			name:   "other family",
+			header: proxyV2(0x21, 0x31, make([]byte, 216), -1),
+		},
+		{
+			name:   "short IPv4",
+			header: proxyV2(0x21, 0x11, ipv4[:8], -1),
+			err:    errBadProxyHeader,
+		},
+		{
+			name:   "short IPv6",
+			header: proxyV2(0x21, 0x21, ipv6[:32], -1),
+			err:    errBadProxyHeader,
+		},
+		{
+			name:   "bad version",
+			header: proxyV2(0x11, 0x11, ipv4, -1),
+			err:    errBadProxyHeader,
+		},
+		{
+			name:   "truncated body",
+			header: proxyV2(0x21, 0x11, ipv4[:6], len(ipv4)),
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated header",
+			header: proxyV2(0x21, 0x11, nil, -1)[:14],
+			err:    io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(test.header))
+			addr, err := readProxyV2(r)
+			if err != test.err {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+			if err == nil {
+				checkProxyAddr(t, addr, test.addr)
+			}
+		})
+	}
+}
+
+func checkProxyAddr(t *testing.T, addr net.Addr, expected string) {
+	t.Helper()
+	if expected == "" {
+		if addr != nil {
+			t.Fatalf("Expected no address, got %v", addr)
+		}
+		return
+	}
+	if addr == nil || addr.String() != expected {
+		t.Fatalf("Expected address %s, got %v", expected, addr)
+	}
+}
+
+func TestProxyConnRemoteAddr(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := &proxyConn{Conn: server, r: bufio.NewReader(server)}
+	defer conn.Close()
+
+	// The stats read the address while the connection is reading the header
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			conn.RemoteAddr()
+		}
+	}()
+
+	go client.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 11211\r\nx"))
+
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != nil || buf[0] != 'x' {
+		t.Fatalf("Expected to read past the header, got %q, %v", buf, err)
+	}
+	<-done
+
+	if addr := conn.RemoteAddr().String(); addr != "192.168.0.1:56324" {
+		t.Fatalf("Expected the address from the header, got %s", addr)
+	}
+}
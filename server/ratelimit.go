@@ -0,0 +1,313 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/orcas"
+)
+
+// RateLimit is a token bucket that refills at Rate requests per second and holds up to Burst of
+// them. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// GlobalRateLimit limits the requests of all listeners together and ClientRateLimit the requests
+// of each client IP, across all of its connections. A request over a limit waits up to
+// RateLimitWait for its turn and fails with ErrBusy if it would have to wait longer. All three
+// must be set before any listener is started.
+var (
+	GlobalRateLimit RateLimit
+	ClientRateLimit RateLimit
+	RateLimitWait   time.Duration
+)
+
+var (
+	MetricRateLimitedGlobal   = metrics.AddCounter("cmd_rate_limited", metrics.Tags{"scope": "global"})
+	MetricRateLimitedListener = metrics.AddCounter("cmd_rate_limited", metrics.Tags{"scope": "listener"})
+	MetricRateLimitedClient   = metrics.AddCounter("cmd_rate_limited", metrics.Tags{"scope": "client"})
+	MetricRateLimitDelayed    = metrics.AddCounter("cmd_rate_limit_delayed", nil)
+)
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	burst := float64(max(l.Burst, 1))
+	return &tokenBucket{
+		rate:   l.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+// take takes a token if one is there or will be within maxWait, and returns how long to wait for
+// it. It returns false if there is none to take.
+func (b *tokenBucket) take(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// untake gives back a token that was taken for a request that another limit stopped
+func (b *tokenBucket) untake() {
+	b.lock.Lock()
+	b.tokens = min(b.tokens+1, b.burst)
+	b.lock.Unlock()
+}
+
+// full returns whether the bucket has refilled completely, meaning it's been unused for a while
+func (b *tokenBucket) full(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+var (
+	globalBucketOnce sync.Once
+	globalBucket     *tokenBucket
+
+	clientBucketsLock  sync.Mutex
+	clientBuckets      = make(map[string]*tokenBucket)
+	clientBucketsSwept time.Time
+)
+
+func globalLimit() *tokenBucket {
+	globalBucketOnce.Do(func() {
+		if GlobalRateLimit.Rate > 0 {
+			globalBucket = newTokenBucket(GlobalRateLimit)
+		}
+	})
+	return globalBucket
+}
+
+// clientLimit returns the bucket of a client IP. Buckets that have refilled are forgotten every
+// minute, since a client that comes back gets the same full bucket anyway.
+func clientLimit(ip string, now time.Time) *tokenBucket {
+	if ClientRateLimit.Rate <= 0 {
+		return nil
+	}
+
+	clientBucketsLock.Lock()
+	defer clientBucketsLock.Unlock()
+
+	if now.Sub(clientBucketsSwept) > time.Minute {
+		for k, b := range clientBuckets {
+			if b.full(now) {
+				delete(clientBuckets, k)
+			}
+		}
+		clientBucketsSwept = now
+	}
+
+	b, ok := clientBuckets[ip]
+	if !ok {
+		b = newTokenBucket(ClientRateLimit)
+		clientBuckets[ip] = b
+	}
+	return b
+}
+
+// limiter applies the rate limits to the requests of the connections of one listener
+type limiter struct {
+	listener *tokenBucket
+}
+
+func newLimiter(l ListenArgs) limiter {
+	var lim limiter
+	if l.RateLimit.Rate > 0 {
+		lim.listener = newTokenBucket(l.RateLimit)
+	}
+	return lim
+}
+
+// enabled returns whether any limit applies to the listener
+func (lim limiter) enabled() bool {
+	return lim.listener != nil || globalLimit() != nil || ClientRateLimit.Rate > 0
+}
+
+// allow waits for the turn of a request from the client at ip and returns false if it's over a
+// limit instead
+func (lim limiter) allow(ip string) bool {
+	now := time.Now()
+	var wait time.Duration
+	var taken []*tokenBucket
+
+	buckets := [...]struct {
+		b      *tokenBucket
+		metric uint32
+	}{
+		{clientLimit(ip, now), MetricRateLimitedClient},
+		{lim.listener, MetricRateLimitedListener},
+		{globalLimit(), MetricRateLimitedGlobal},
+	}
+
+	for _, bucket := range buckets {
+		if bucket.b == nil {
+			continue
+		}
+		w, ok := bucket.b.take(now, RateLimitWait)
+		if !ok {
+			metrics.IncCounter(bucket.metric)
+			for _, b := range taken {
+				b.untake()
+			}
+			return false
+		}
+		taken = append(taken, bucket.b)
+		wait = max(wait, w)
+	}
+
+	if wait > 0 {
+		metrics.IncCounter(MetricRateLimitDelayed)
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// orca limits the requests of one connection that go to the backends
+func (lim limiter) orca(o orcas.Orca, c *ClientConn) orcas.Orca {
+	if !lim.enabled() {
+		return o
+	}
+	return limitedOrca{Orca: o, lim: lim, c: c}
+}
+
+type limitedOrca struct {
+	orcas.Orca
+	lim limiter
+	c   *ClientConn
+}
+
+func (o limitedOrca) allow() error {
+	if !o.lim.allow(o.c.ip()) {
+		return common.ErrBusy
+	}
+	return nil
+}
+
+func (o limitedOrca) Set(req common.SetRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Set(req)
+}
+
+func (o limitedOrca) Add(req common.SetRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Add(req)
+}
+
+func (o limitedOrca) Replace(req common.SetRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Replace(req)
+}
+
+func (o limitedOrca) Append(req common.SetRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Append(req)
+}
+
+func (o limitedOrca) Prepend(req common.SetRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Prepend(req)
+}
+
+func (o limitedOrca) Delete(req common.DeleteRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Delete(req)
+}
+
+func (o limitedOrca) Touch(req common.TouchRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Touch(req)
+}
+
+func (o limitedOrca) Get(req common.GetRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Get(req)
+}
+
+func (o limitedOrca) GetE(req common.GetRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.GetE(req)
+}
+
+func (o limitedOrca) Gat(req common.GATRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Gat(req)
+}
+
+func (o limitedOrca) Incr(req common.IncrDecrRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Incr(req)
+}
+
+func (o limitedOrca) Decr(req common.IncrDecrRequest) error {
+	if err := o.allow(); err != nil {
+		return err
+	}
+	return o.Orca.Decr(req)
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/hongst/rend/handlers/inmem"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/server"
+)
+
+func TestListenerRateLimit(t *testing.T) {
+	l := server.ListenArgs{
+		Type:      server.ListenTCP,
+		Port:      freePort(t),
+		RateLimit: server.RateLimit{Rate: 0.1, Burst: 2},
+	}
+	go server.ListenAndServe(l, server.Default, orcas.L1Only, inmem.New, noBackend)
+	addr := waitListening(t, l.Port)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// The burst goes through and the request after it is turned away
+	expected := []string{"END\r\n", "END\r\n", "SERVER_ERROR busy\r\n"}
+	for i, exp := range expected {
+		if _, err := conn.Write([]byte("get foo\r\n")); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if line != exp {
+			t.Fatalf("Expected %q for request %d, got %q", exp, i, line)
+		}
+	}
+
+	// Requests that don't go to the backends aren't limited
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if line, _ := r.ReadString('\n'); line == "SERVER_ERROR busy\r\n" {
+		t.Fatalf("Expected version not to be limited")
+	}
+}
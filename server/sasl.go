@@ -0,0 +1,190 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricAuthSuccesses = metrics.AddCounter("auth_successes", nil)
+	MetricAuthFailures  = metrics.AddCounter("auth_failures", nil)
+	MetricAuthRejected  = metrics.AddCounter("auth_rejected_cmds", nil)
+)
+
+var errTextAuth = errors.New("Text protocol connection refused on a listener that requires authentication")
+
+// saslMechs are the SASL mechanisms supported on the frontend
+var saslMechs = []string{"PLAIN"}
+
+// LoadCredentials reads a SASL credentials file for a listener. Each non-empty line is of the
+// form username:password. Lines starting with # are ignored.
+func LoadCredentials(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, common.ErrInvalidArgs
+		}
+
+		creds[parts[0]] = parts[1]
+	}
+
+	return creds, scanner.Err()
+}
+
+// saslParser wraps the request parser for a binary protocol connection and only lets requests
+// through once the connection has authenticated. SASL requests are answered here directly and
+// any other request before authentication gets an auth error.
+type saslParser struct {
+	rp     common.RequestParser
+	res    common.Responder
+	creds  map[string]string
+	authed bool
+}
+
+func newSASLParser(rp common.RequestParser, res common.Responder, creds map[string]string) *saslParser {
+	return &saslParser{
+		rp:    rp,
+		res:   res,
+		creds: creds,
+	}
+}
+
+func (s *saslParser) Parse() (common.Request, common.RequestType, uint64, error) {
+	for {
+		request, reqType, start, err := s.rp.Parse()
+		if err != nil {
+			return request, reqType, start, err
+		}
+
+		switch reqType {
+		case common.RequestSASLListMechs:
+			err = s.res.SASLListMechs(request.GetOpaque(), saslMechs)
+
+		case common.RequestSASLAuth:
+			req := request.(common.SASLAuthRequest)
+			if s.authenticate(req) {
+				metrics.IncCounter(MetricAuthSuccesses)
+				s.authed = true
+				err = s.res.SASLAuth(req.Opaque)
+			} else {
+				metrics.IncCounter(MetricAuthFailures)
+				s.authed = false
+				err = s.res.Error(req.Opaque, reqType, common.ErrAuth, false)
+			}
+
+		case common.RequestQuit:
+			// Always let clients leave
+			return request, reqType, start, nil
+
+		default:
+			if s.authed {
+				return request, reqType, start, nil
+			}
+
+			metrics.IncCounter(MetricAuthRejected)
+			err = s.reject(request, reqType)
+		}
+
+		if err != nil {
+			return nil, reqType, start, err
+		}
+	}
+}
+
+// reject responds with an auth error to each part of an unauthenticated request. The value of a
+// streamed set is still on the connection and is read past first.
+func (s *saslParser) reject(request common.Request, reqType common.RequestType) error {
+	if request == nil {
+		return s.res.Error(0, reqType, common.ErrAuth, false)
+	}
+	if err := common.SkipValue(request); err != nil {
+		return err
+	}
+
+	// A batch get needs an answer for each key and the noop at the end, if any, so the client
+	// isn't left waiting.
+	switch req := request.(type) {
+	case common.GetRequest:
+		for _, opaque := range req.Opaques {
+			if err := s.res.Error(opaque, reqType, common.ErrAuth, false); err != nil {
+				return err
+			}
+		}
+		return s.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+
+	return s.res.Error(request.GetOpaque(), reqType, common.ErrAuth, false)
+}
+
+// authenticate checks a PLAIN auth request against the configured credentials. The PLAIN data is
+// [authzid] NUL authcid NUL passwd.
+func (s *saslParser) authenticate(req common.SASLAuthRequest) bool {
+	if string(req.Mechanism) != "PLAIN" {
+		return false
+	}
+
+	parts := bytes.Split(req.Data, []byte{0})
+	if len(parts) != 3 {
+		return false
+	}
+
+	return checkCredentials(s.creds, string(parts[1]), parts[2])
+}
+
+// checkCredentials says whether pass is the password of user
+func checkCredentials(creds map[string]string, user string, pass []byte) bool {
+	expected, ok := creds[user]
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), pass) == 1
+}
+
+// httpAuth checks the basic auth credentials of requests to an HTTP listener against the same
+// credentials SASL uses
+func httpAuth(creds map[string]string) func(user, pass string) bool {
+	return func(user, pass string) bool {
+		if checkCredentials(creds, user, []byte(pass)) {
+			metrics.IncCounter(MetricAuthSuccesses)
+			return true
+		}
+		metrics.IncCounter(MetricAuthFailures)
+		return false
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2015 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/handlers/inmem"
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/server"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "rend-creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("# comment\n\nuser:pass\nother:with:colon\n")
+	f.Close()
+
+	creds, err := server.LoadCredentials(f.Name())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(creds) != 2 || creds["user"] != "pass" || creds["other"] != "with:colon" {
+		t.Fatalf("Unexpected credentials %v", creds)
+	}
+}
+
+func TestLoadCredentialsBadLine(t *testing.T) {
+	f, err := ioutil.TempFile("", "rend-creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("nopassword\n")
+	f.Close()
+
+	if _, err := server.LoadCredentials(f.Name()); err == nil {
+		t.Fatal("Expected an error for a line without a password")
+	}
+}
+
+// saslFrame builds a binary protocol SASL request, which binprot has no writer for
+func saslFrame(opcode uint8, mech, data string) []byte {
+	buf := make([]byte, binprot.ReqHeaderLen, binprot.ReqHeaderLen+len(mech)+len(data))
+	buf[0] = binprot.MagicRequest
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(mech)))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(mech)+len(data)))
+	buf = append(buf, mech...)
+	return append(buf, data...)
+}
+
+// saslConn connects to a new listener that requires authentication as user, with password pass
+func saslConn(t *testing.T) (net.Conn, *bufio.Reader) {
+	l := server.ListenArgs{
+		Type:        server.ListenTCP,
+		Port:        freePort(t),
+		Credentials: map[string]string{"user": "pass"},
+	}
+	go server.ListenAndServe(l, server.Default, orcas.L1Only, inmem.New, noBackend)
+	addr := waitListening(t, l.Port)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn, bufio.NewReader(conn)
+}
+
+// readResponse reads one binary protocol response and returns its value and error
+func readResponse(t *testing.T, r *bufio.Reader) ([]byte, error) {
+	t.Helper()
+	res, err := binprot.ReadResponseHeader(r)
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+	body := make([]byte, res.TotalBodyLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("Error reading response body: %v", err)
+	}
+	return body[int(res.KeyLength)+int(res.ExtraLength):], binprot.DecodeError(res)
+}
+
+func TestSASLRequired(t *testing.T) {
+	conn, r := saslConn(t)
+
+	// Each command and how many responses it gets. The batch of quiet gets is answered for
+	// each key and then the noop that ends it.
+	commands := []struct {
+		name      string
+		write     func(w io.Writer) error
+		responses int
+	}{
+		{"get", func(w io.Writer) error { return binprot.WriteGetCmd(w, []byte("foo")) }, 1},
+		{"getq batch", func(w io.Writer) error {
+			binprot.WriteGetQCmd(w, []byte("foo"))
+			binprot.WriteGetQCmd(w, []byte("bar"))
+			return binprot.WriteNoopCmd(w)
+		}, 3},
+		{"gete", func(w io.Writer) error { return binprot.WriteGetECmd(w, []byte("foo")) }, 1},
+		{"gat", func(w io.Writer) error { return binprot.WriteGATCmd(w, []byte("foo"), 10) }, 1},
+		{"set", func(w io.Writer) error {
+			binprot.WriteSetCmd(w, []byte("foo"), 0, 0, 3, 0)
+			_, err := w.Write([]byte("bar"))
+			return err
+		}, 1},
+		{"add", func(w io.Writer) error {
+			binprot.WriteAddCmd(w, []byte("foo"), 0, 0, 3, 0)
+			_, err := w.Write([]byte("bar"))
+			return err
+		}, 1},
+		{"append", func(w io.Writer) error {
+			binprot.WriteAppendCmd(w, []byte("foo"), 0, 0, 3, 0)
+			_, err := w.Write([]byte("bar"))
+			return err
+		}, 1},
+		{"delete", func(w io.Writer) error { return binprot.WriteDeleteCmd(w, []byte("foo"), 0) }, 1},
+		{"touch", func(w io.Writer) error { return binprot.WriteTouchCmd(w, []byte("foo"), 10) }, 1},
+		{"incr", func(w io.Writer) error { return binprot.WriteIncrCmd(w, []byte("foo"), 1, 0, 0) }, 1},
+		{"flush", func(w io.Writer) error { return binprot.WriteFlushCmd(w, 0) }, 1},
+		{"version", binprot.WriteVersionCmd, 1},
+		{"noop", binprot.WriteNoopCmd, 1},
+	}
+
+	for _, c := range commands {
+		if err := c.write(conn); err != nil {
+			t.Fatalf("%s: error writing: %v", c.name, err)
+		}
+		for i := 0; i < c.responses; i++ {
+			_, err := readResponse(t, r)
+			if i == c.responses-1 && c.responses > 1 {
+				// The noop at the end of a batch
+				if err != nil {
+					t.Fatalf("%s: expected the batch to end normally, got %v", c.name, err)
+				}
+				continue
+			}
+			if err != common.ErrAuth {
+				t.Fatalf("%s: expected an auth error, got %v", c.name, err)
+			}
+		}
+	}
+
+	// Listing the mechanisms is allowed
+	conn.Write(saslFrame(binprot.OpcodeSASLListMechs, "", ""))
+	if mechs, err := readResponse(t, r); err != nil || string(mechs) != "PLAIN" {
+		t.Fatalf("Expected the mechanisms, got %q, %v", mechs, err)
+	}
+}
+
+func TestSASLAuth(t *testing.T) {
+	conn, r := saslConn(t)
+
+	get := func() error {
+		binprot.WriteGetCmd(conn, []byte("foo"))
+		_, err := readResponse(t, r)
+		return err
+	}
+	auth := func(mech, data string) error {
+		conn.Write(saslFrame(binprot.OpcodeSASLAuth, mech, data))
+		_, err := readResponse(t, r)
+		return err
+	}
+
+	// Failed attempts leave the connection locked
+	for _, attempt := range []struct{ mech, data string }{
+		{"PLAIN", "\x00user\x00wrong"},
+		{"PLAIN", "\x00nobody\x00pass"},
+		{"PLAIN", "user\x00pass"},
+		{"CRAM-MD5", "\x00user\x00pass"},
+	} {
+		if err := auth(attempt.mech, attempt.data); err != common.ErrAuth {
+			t.Fatalf("Expected %s %q to fail, got %v", attempt.mech, attempt.data, err)
+		}
+		if err := get(); err != common.ErrAuth {
+			t.Fatalf("Expected the connection to stay locked, got %v", err)
+		}
+	}
+
+	// The right password unlocks it
+	if err := auth("PLAIN", "\x00user\x00pass"); err != nil {
+		t.Fatalf("Expected to authenticate, got %v", err)
+	}
+	binprot.WriteSetCmd(conn, []byte("foo"), 0, 0, 3, 0)
+	conn.Write([]byte("bar"))
+	if _, err := readResponse(t, r); err != nil {
+		t.Fatalf("Expected the set to go through, got %v", err)
+	}
+	binprot.WriteGetCmd(conn, []byte("foo"))
+	if data, err := readResponse(t, r); err != nil || !bytes.Equal(data, []byte("bar")) {
+		t.Fatalf("Expected the value back, got %q, %v", data, err)
+	}
+
+	// A failed attempt after that locks it again
+	if err := auth("PLAIN", "\x00user\x00wrong"); err != common.ErrAuth {
+		t.Fatalf("Expected a wrong password to fail, got %v", err)
+	}
+	if err := get(); err != common.ErrAuth {
+		t.Fatalf("Expected the connection to be locked again, got %v", err)
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	l := server.ListenArgs{
+		Type:        server.ListenTCP,
+		Port:        freePort(t),
+		HTTP:        true,
+		Credentials: map[string]string{"user": "pass"},
+	}
+	go server.ListenAndServe(l, server.Default, orcas.L1Only, inmem.New, noBackend)
+	url := "http://" + waitListening(t, l.Port) + "/cache/httpauth"
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	do := func(method, user, pass, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error building request: %v", err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Error sending request: %v", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	// Requests without the right credentials don't reach the cache, and the connection stays up
+	for _, creds := range [][2]string{{"", ""}, {"user", "wrong"}, {"other", "pass"}} {
+		res := do(http.MethodPut, creds[0], creds[1], "bar")
+		if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("Expected 401 with a challenge for %v, got %d", creds, res.StatusCode)
+		}
+	}
+	if res := do(http.MethodGet, "user", "pass", ""); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the unauthorized put not to store anything, got %d", res.StatusCode)
+	}
+
+	if res := do(http.MethodPut, "user", "pass", "bar"); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the put to work, got %d", res.StatusCode)
+	}
+	if res := do(http.MethodGet, "user", "pass", ""); res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the get to work, got %d", res.StatusCode)
+	}
+	if res := do(http.MethodGet, "", "", ""); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected a get without credentials to be refused, got %d", res.StatusCode)
+	}
+}
+
+func TestSASLRequiredStreamedSet(t *testing.T) {
+	common.SetStreamValueSize(4)
+	defer common.SetStreamValueSize(0)
+
+	conn, r := saslConn(t)
+
+	// The rejected value has to be read past, or it would be parsed as the next request
+	value := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	binprot.WriteSetCmd(conn, []byte("foo"), 0, 0, uint32(len(value)), 0)
+	conn.Write(value)
+	if _, err := readResponse(t, r); err != common.ErrAuth {
+		t.Fatalf("Expected an auth error, got %v", err)
+	}
+
+	conn.Write(saslFrame(binprot.OpcodeSASLListMechs, "", ""))
+	if mechs, err := readResponse(t, r); err != nil || string(mechs) != "PLAIN" {
+		t.Fatalf("Expected the mechanisms, got %q, %v", mechs, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+var (
+	MetricTLSCertReloads      = metrics.AddCounter("tls_cert_reloads", nil)
+	MetricTLSCertReloadErrors = metrics.AddCounter("tls_cert_reload_errors", nil)
+)
+
+var errNoClientCAs = errors.New("No client CA certificates found")
+
+// certReloader holds the current certificate for a TLS listener. The certificate is loaded again
+// from the same files on SIGHUP. Existing connections keep the certificate they were established
+// with and new connections get the new one.
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+
+		for range sighup {
+			if err := c.reload(); err != nil {
+				metrics.IncCounter(MetricTLSCertReloadErrors)
+				logger.Error("Error reloading TLS certificate, keeping the old one", "error", err)
+				continue
+			}
+			metrics.IncCounter(MetricTLSCertReloads)
+		}
+	}()
+
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.cert = &cert
+	c.lock.Unlock()
+
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// tlsConfig builds the server side TLS config for a listener. If a client CA file is given,
+// clients must present a certificate signed by one of the CAs in it.
+func tlsConfig(l ListenArgs) (*tls.Config, error) {
+	reloader, err := newCertReloader(l.TLSCert, l.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if l.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(l.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errNoClientCAs
+		}
+
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// keepAliveListener sets the TCP options, including keepalive, on each accepted connection. It
+// sits under the TLS listener, if any, since they have to be set on the raw TCP connection.
+type keepAliveListener struct {
+	*net.TCPListener
+	opts common.TCPOptions
+}
+
+func (k keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := k.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	if err := k.opts.Apply(conn); err != nil {
+		logger.Warn("Error setting TCP options", "remote", conn.RemoteAddr(), "error", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+	"github.com/hongst/rend/server"
+)
+
+// writeCert writes a new self-signed certificate with the given serial number and its key
+func writeCert(t *testing.T, certPath, keyPath string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "rend-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %v", err)
+	}
+
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+}
+
+// presentedSerial connects over TLS, checks a command goes through and returns the serial number
+// of the certificate the listener presented
+func presentedSerial(t *testing.T, addr string) int64 {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error connecting over TLS: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "VERSION") {
+		t.Fatalf("Expected a version response, got %q, %v", line, err)
+	}
+
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func counter(name string) uint64 {
+	for _, c := range metrics.Counters() {
+		if c.Name == name {
+			return c.Val
+		}
+	}
+	return 0
+}
+
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeCert(t, certPath, keyPath, 1)
+
+	addr := listen(t, server.ListenArgs{
+		TLSCert: certPath,
+		TLSKey:  keyPath,
+		TCP:     common.TCPOptions{KeepAlive: time.Second, ReadBuffer: 64 * 1024},
+	})
+
+	if serial := presentedSerial(t, addr); serial != 1 {
+		t.Fatalf("Expected the first certificate, got serial %d", serial)
+	}
+
+	// Swap the files and reload
+	writeCert(t, certPath, keyPath, 2)
+	reloads := counter("tls_cert_reloads")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Error sending SIGHUP: %v", err)
+	}
+	for start := time.Now(); counter("tls_cert_reloads") == reloads; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("The certificate was never reloaded")
+		}
+	}
+
+	if serial := presentedSerial(t, addr); serial != 2 {
+		t.Fatalf("Expected the new certificate after a reload, got serial %d", serial)
+	}
+
+	// A bad certificate file is not loaded and the current one stays
+	if err := ioutil.WriteFile(certPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	errs := counter("tls_cert_reload_errors")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatalf("Error sending SIGHUP: %v", err)
+	}
+	for start := time.Now(); counter("tls_cert_reload_errors") == errs; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("The bad certificate was never tried")
+		}
+	}
+
+	if serial := presentedSerial(t, addr); serial != 2 {
+		t.Fatalf("Expected the old certificate to stay after a failed reload, got serial %d", serial)
+	}
+}
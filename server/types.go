@@ -16,6 +16,7 @@ package server
 
 import (
 	"io"
+	"time"
 
 	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/metrics"
@@ -40,32 +41,102 @@ type ListenArgs struct {
 	Type ListenType
 	// TCP port to listen on, if applicable
 	Port int
-	// Unix domain socket path to listen on, if applicable
+	// Host name or IP address to bind a TCP listener to, or the name of a network interface to
+	// bind to its address. Empty means every interface.
+	Host string
+	// IP versions a TCP listener accepts connections over
+	IPVersion IPVersion
+	// Unix domain socket path to listen on, if applicable. A path starting with @ is a socket in
+	// the abstract namespace on Linux.
 	Path string
+	// Mode and owner of the socket file of a unix listener
+	Unix UnixOptions
+	// SASL credentials for the listener, username to password. If there are any, binary protocol
+	// connections must authenticate with SASL PLAIN, text protocol connections are refused and
+	// HTTP requests must carry the same credentials with basic auth.
+	Credentials map[string]string
+	// TLS certificate and key files. If a certificate is given, the listener only accepts TLS
+	// connections. The certificate is reloaded from the same files on SIGHUP.
+	TLSCert string
+	TLSKey  string
+	// Optional file of CA certificates. If given, clients must present a certificate signed by
+	// one of them.
+	TLSClientCA string
+	// If true, each connection must start with a PROXY protocol (v1 or v2) header. The client
+	// address in the header is used as the remote address of the connection.
+	ProxyProtocol bool
+	// If true, connections speak the HTTP gateway protocol instead of a memcached protocol
+	HTTP bool
+	// If true, every binary protocol response is checked against the request it answers. See
+	// binprot.NewAuditedBinaryParserResponder.
+	AuditBinary bool
+	// Optional access log that every request is given to, with the address of its client
+	AccessLog orcas.RequestSink
+	// Most connections the listener has open at once. Connections over the limit are closed as
+	// soon as they are accepted. 0 means no limit.
+	MaxConns int
+	// How long a connection can go without the client sending anything before it's closed.
+	// 0 means connections are never closed for being idle.
+	IdleTimeout time.Duration
+	// Number of requests after which a connection is closed, once the last one is answered.
+	// 0 means no limit.
+	MaxRequests int
+	// How long a connection can be open before it's closed between requests. Each connection
+	// gets up to a tenth longer so they don't all close at once. 0 means no limit.
+	MaxAge time.Duration
+	// Limit on the requests of all of the listener's connections together, on top of
+	// GlobalRateLimit and ClientRateLimit
+	RateLimit RateLimit
+	// Client IPs that may connect to the listener
+	ACL ACL
+	// Options for the TCP connections of a TCP listener
+	TCP common.TCPOptions
 }
 
+// MaxTotalConns is the most client connections open at once across all listeners, like
+// ListenArgs.MaxConns. 0 means no limit. It must be set before any listener is started.
+var MaxTotalConns int
+
+// RequestTimeout is the longest a request may wait on the backends. A backend that takes longer
+// has its connection closed and the client gets a SERVER_ERROR. 0 means no limit. It must be set
+// before any listener is started.
+var RequestTimeout time.Duration
+
 var (
 	MetricConnectionsEstablishedExt = metrics.AddCounter("conn_established_ext", nil)
 	MetricConnectionsEstablishedL1  = metrics.AddCounter("conn_established_l1", nil)
 	MetricConnectionsEstablishedL2  = metrics.AddCounter("conn_established_l2", nil)
+	MetricConnectionsRejected       = metrics.AddCounter("conn_rejected_max_conns", nil)
+	MetricConnectionsOpen           = metrics.AddIntGauge("conn_open_ext", nil)
+	MetricConnectionsIdleClosed     = metrics.AddCounter("conn_closed_idle", nil)
+	MetricConnectionsMaxReqClosed   = metrics.AddCounter("conn_closed_max_requests", nil)
+	MetricConnectionsMaxAgeClosed   = metrics.AddCounter("conn_closed_max_age", nil)
+	MetricAcceptErrors              = metrics.AddCounter("conn_accept_errors", nil)
 	MetricCmdTotal                  = metrics.AddCounter("cmd_total", nil)
 	MetricErrAppError               = metrics.AddCounter("err_app_err", nil)
 	MetricErrUnrecoverable          = metrics.AddCounter("err_unrecoverable", nil)
+	MetricErrBadKey                 = metrics.AddCounter("err_bad_key", nil)
+	MetricErrValueTooBig            = metrics.AddCounter("err_value_too_big", nil)
 
-	MetricCmdGet     = metrics.AddCounter("cmd_get", nil)
-	MetricCmdGetE    = metrics.AddCounter("cmd_gete", nil)
-	MetricCmdSet     = metrics.AddCounter("cmd_set", nil)
-	MetricCmdAdd     = metrics.AddCounter("cmd_add", nil)
-	MetricCmdReplace = metrics.AddCounter("cmd_replace", nil)
-	MetricCmdAppend  = metrics.AddCounter("cmd_append", nil)
-	MetricCmdPrepend = metrics.AddCounter("cmd_prepend", nil)
-	MetricCmdDelete  = metrics.AddCounter("cmd_delete", nil)
-	MetricCmdTouch   = metrics.AddCounter("cmd_touch", nil)
-	MetricCmdGat     = metrics.AddCounter("cmd_gat", nil)
-	MetricCmdUnknown = metrics.AddCounter("cmd_unknown", nil)
-	MetricCmdNoop    = metrics.AddCounter("cmd_noop", nil)
-	MetricCmdQuit    = metrics.AddCounter("cmd_quit", nil)
-	MetricCmdVersion = metrics.AddCounter("cmd_version", nil)
+	MetricCmdGet       = metrics.AddCounter("cmd_get", nil)
+	MetricCmdGetE      = metrics.AddCounter("cmd_gete", nil)
+	MetricCmdSet       = metrics.AddCounter("cmd_set", nil)
+	MetricCmdAdd       = metrics.AddCounter("cmd_add", nil)
+	MetricCmdReplace   = metrics.AddCounter("cmd_replace", nil)
+	MetricCmdAppend    = metrics.AddCounter("cmd_append", nil)
+	MetricCmdPrepend   = metrics.AddCounter("cmd_prepend", nil)
+	MetricCmdDelete    = metrics.AddCounter("cmd_delete", nil)
+	MetricCmdTouch     = metrics.AddCounter("cmd_touch", nil)
+	MetricCmdGat       = metrics.AddCounter("cmd_gat", nil)
+	MetricCmdIncr      = metrics.AddCounter("cmd_incr", nil)
+	MetricCmdDecr      = metrics.AddCounter("cmd_decr", nil)
+	MetricCmdUnknown   = metrics.AddCounter("cmd_unknown", nil)
+	MetricCmdNoop      = metrics.AddCounter("cmd_noop", nil)
+	MetricCmdQuit      = metrics.AddCounter("cmd_quit", nil)
+	MetricCmdVersion   = metrics.AddCounter("cmd_version", nil)
+	MetricCmdVerbosity = metrics.AddCounter("cmd_verbosity", nil)
+	MetricCmdStats     = metrics.AddCounter("cmd_stats", nil)
+	MetricCmdFlush     = metrics.AddCounter("cmd_flush", nil)
 
 	HistSet     = metrics.AddHistogram("set", false, nil)
 	HistAdd     = metrics.AddHistogram("add", false, nil)
@@ -77,6 +148,9 @@ var (
 	HistGet     = metrics.AddHistogram("get", false, nil)  // not sampled until configurable
 	HistGetE    = metrics.AddHistogram("gete", false, nil) // not sampled until configurable
 	HistGat     = metrics.AddHistogram("gat", false, nil)  // not sampled until configurable
+	HistIncr    = metrics.AddHistogram("incr", false, nil)
+	HistDecr    = metrics.AddHistogram("decr", false, nil)
+	HistFlush   = metrics.AddHistogram("flush", false, nil)
 
 	// TODO: inconsistency metrics for when L1 is not a subset of L2
 )
@@ -0,0 +1,150 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnixOptions control the socket file of a unix listener
+type UnixOptions struct {
+	// Permissions of the socket file. 0 leaves them as the umask makes them.
+	Mode os.FileMode
+	// User and group that own the socket file, by name or ID. Empty leaves them as they are.
+	Owner string
+	Group string
+}
+
+// listenUnix listens on the unix socket at path. A path that starts with @ is a socket in the
+// abstract namespace, which has no file and goes away with the process. Otherwise a socket file
+// left behind by a process that's gone is removed first, but one that something is still
+// listening on or a file that isn't a socket is left alone.
+func listenUnix(path string, opts UnixOptions) (net.Listener, error) {
+	if strings.HasPrefix(path, "@") {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("Abstract unix socket %s is only supported on Linux", path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("Error binding to unix socket %s: %v", path, err)
+		}
+		return listener, nil
+	}
+
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error binding to unix socket %s: %v", path, err)
+	}
+
+	if err := opts.apply(path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// removeStale removes the socket file at path if nothing accepts connections on it
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error checking previous unix socket file %s: %v", path, err)
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("Unix socket path %s exists and isn't a socket", path)
+	}
+	if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("Unix socket %s is in use by another process", path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing previous unix socket file %s: %v", path, err)
+	}
+	return nil
+}
+
+// apply sets the mode and owner of the socket file at path
+func (o UnixOptions) apply(path string) error {
+	if o.Mode != 0 {
+		if err := os.Chmod(path, o.Mode); err != nil {
+			return fmt.Errorf("Error setting the mode of unix socket %s: %v", path, err)
+		}
+	}
+
+	if o.Owner == "" && o.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if o.Owner != "" {
+		id, err := lookupID(o.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Error looking up unix socket owner %s: %v", o.Owner, err)
+		}
+		uid = id
+	}
+	if o.Group != "" {
+		id, err := lookupID(o.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("Error looking up unix socket group %s: %v", o.Group, err)
+		}
+		gid = id
+	}
+
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("Error setting the owner of unix socket %s: %v", path, err)
+	}
+	return nil
+}
+
+// lookupID returns the numeric ID for a user or group given by ID or by name
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hongst/rend/orcas"
+	"github.com/hongst/rend/server"
+)
+
+func unixListener(path string, opts server.UnixOptions) server.Listener {
+	return server.Listener{
+		Args:   server.ListenArgs{Type: server.ListenUnix, Path: path, Unix: opts},
+		Server: server.Default,
+		Orca:   orcas.L1Only,
+		L1:     noBackend,
+		L2:     noBackend,
+	}
+}
+
+// serveUnix serves a group on the unix socket at path until the test ends
+func serveUnix(t *testing.T, path string, opts server.UnixOptions) {
+	g := server.NewGroup(unixListener(path, opts))
+	go g.Serve()
+	t.Cleanup(func() { g.Close() })
+
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return
+		}
+	}
+	t.Fatalf("Listener on %s never started", path)
+}
+
+func TestUnixStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rend.sock")
+
+	// A socket file left behind by a process that's gone
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	serveUnix(t, path, server.UnixOptions{Mode: 0600})
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("Expected mode 0600, got %v", fi.Mode().Perm())
+	}
+
+	// The socket is in use now, so another listener must not take it over
+	g := server.NewGroup(unixListener(path, server.UnixOptions{}))
+	if err := g.Serve(); err == nil || err == server.ErrGroupClosed {
+		t.Fatalf("Expected an error listening on a socket in use, got %v", err)
+	}
+	if c, err := net.Dial("unix", path); err != nil {
+		t.Fatalf("Expected the first listener to still be reachable, got %v", err)
+	} else {
+		c.Close()
+	}
+}
+
+func TestUnixNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rend.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	g := server.NewGroup(unixListener(path, server.UnixOptions{}))
+	if err := g.Serve(); err == nil || err == server.ErrGroupClosed {
+		t.Fatalf("Expected an error listening over a regular file, got %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Fatalf("Expected the file to be left alone, got %q, %v", data, err)
+	}
+}
+
+func TestUnixOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rend.sock")
+
+	// Changing to the owner and group the process already has works without privileges
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	serveUnix(t, path, server.UnixOptions{Owner: uid, Group: gid})
+
+	g := server.NewGroup(unixListener(filepath.Join(t.TempDir(), "rend.sock"), server.UnixOptions{Owner: "no-such-user-rend"}))
+	if err := g.Serve(); err == nil || err == server.ErrGroupClosed {
+		t.Fatalf("Expected an error for an unknown owner, got %v", err)
+	}
+}
+
+func TestUnixAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Abstract unix sockets are Linux only")
+	}
+
+	// There's no file, so serveUnix only returns once something answers on the name
+	serveUnix(t, "@rend-test-"+strconv.Itoa(os.Getpid()), server.UnixOptions{})
+}
@@ -18,13 +18,22 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"runtime"
 	"strings"
 
 	"github.com/hongst/rend/binprot"
+	"github.com/hongst/rend/logging"
 )
 
+var logger = logging.Logger("server")
+
+// logPanic logs the message at error level and panics with it, for errors the listener can't
+// go on from
+func logPanic(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	panic(fmt.Sprint(msg, " ", args))
+}
+
 func isBinaryRequest(reader *bufio.Reader) (bool, error) {
 	headerByte, err := reader.Peek(1)
 	if err != nil {
@@ -33,9 +42,19 @@ func isBinaryRequest(reader *bufio.Reader) (bool, error) {
 	return headerByte[0] == binprot.MagicRequest, nil
 }
 
+// isRESPRequest detects the Redis protocol. Redis clients send commands as an array of bulk strings
+// or, rarely, a single bulk string. No memcached text command starts with either marker.
+func isRESPRequest(reader *bufio.Reader) (bool, error) {
+	headerByte, err := reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return headerByte[0] == '*' || headerByte[0] == '$', nil
+}
+
 func abort(toClose []io.Closer, err error) {
 	if err != nil && err != io.EOF {
-		log.Println("Error while processing request. Closing connection. Error:", err.Error())
+		logger.Warn("Error while processing request, closing connection", "error", err)
 	}
 	for _, c := range toClose {
 		if c != nil {
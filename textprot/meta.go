@@ -0,0 +1,502 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/metrics"
+)
+
+// The meta commands (mg, ms, md, ma, mn) are a newer, more compact form of the text protocol. Each
+// command is followed by a key and a list of single character flags, some of which take a token
+// directly after the flag character, e.g. "mg foo v f T30". The meta commands map onto the same
+// request types as the classic commands, but their responses depend on the flags given. The
+// parser records the flags of the meta command currently being processed in a cmdState that is
+// shared with the responder for the same connection.
+//
+// The mutations (ms, md and ma) take a signature as a token of the same "s:<hex>" form as the
+// classic commands, e.g. "md foo q s:0123456789abcdef". It is made for the request type the
+// command maps onto, so "ms foo 3 ME" is signed as an add.
+
+type metaCmd int
+
+const (
+	metaNone metaCmd = iota
+	metaGet
+	metaSet
+	metaDelete
+	metaArith
+	metaNoop
+)
+
+func (m *cmdState) isMeta() bool {
+	return m != nil && m.cmd != metaNone
+}
+
+func parseMeta(r *bufio.Reader, clParts []string, meta *cmdState, start uint64) (common.Request, common.RequestType, uint64, error) {
+	switch clParts[0] {
+	case "mn":
+		if len(clParts) != 1 {
+			return nil, common.RequestNoop, start, common.ErrBadRequest
+		}
+		meta.cmd = metaNoop
+		return common.NoopRequest{
+			Opaque: 0,
+		}, common.RequestNoop, start, nil
+
+	case "mg":
+		return metaGetRequest(clParts, meta, start)
+
+	case "ms":
+		return metaSetRequest(r, clParts, meta, start)
+
+	case "md":
+		return metaDeleteRequest(clParts, meta, start)
+
+	case "ma":
+		return metaArithRequest(clParts, meta, start)
+	}
+
+	return nil, common.RequestUnknown, start, nil
+}
+
+func metaGetRequest(clParts []string, meta *cmdState, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if len(clParts) < 2 {
+		return nil, common.RequestGet, start, common.ErrBadRequest
+	}
+
+	key := []byte(clParts[1])
+	touch, cas := false, false
+	var exptime, lease uint32
+
+	for _, flag := range clParts[2:] {
+		if len(flag) == 0 {
+			continue
+		}
+
+		switch flag[0] {
+		case 'v':
+			meta.value = true
+		case 'q':
+			meta.quiet = true
+		case 'c', 'f', 'k', 's':
+			meta.ret = append(meta.ret, flag[0])
+			cas = cas || flag[0] == 'c'
+		case 'O':
+			meta.opaque = flag[1:]
+			meta.ret = append(meta.ret, flag[0])
+		case 'T':
+			ttl, err := strconv.ParseUint(flag[1:], 10, 32)
+			if err != nil {
+				return nil, common.RequestGat, start, common.ErrBadExptime
+			}
+			touch = true
+			exptime = uint32(ttl)
+		case 'N':
+			ttl, err := strconv.ParseUint(flag[1:], 10, 32)
+			if err != nil || ttl == 0 {
+				return nil, common.RequestGet, start, common.ErrBadRequest
+			}
+			lease = uint32(ttl)
+		default:
+			return nil, common.RequestGet, start, common.ErrBadRequest
+		}
+	}
+
+	meta.cmd = metaGet
+	meta.key = key
+
+	if touch {
+		return common.GATRequest{
+			Key:     key,
+			Exptime: exptime,
+			Opaque:  uint32(0),
+			Quiet:   meta.quiet,
+		}, common.RequestGat, start, nil
+	}
+
+	return common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{meta.quiet},
+		NoopEnd: false,
+		Lease:   lease,
+		Cas:     cas,
+	}, common.RequestGet, start, nil
+}
+
+func metaSetRequest(r *bufio.Reader, clParts []string, meta *cmdState, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if len(clParts) < 3 {
+		return nil, common.RequestSet, start, common.ErrBadRequest
+	}
+
+	key := []byte(clParts[1])
+
+	length, err := strconv.ParseUint(strings.TrimSpace(clParts[2]), 10, 32)
+	if err != nil {
+		return nil, common.RequestSet, start, common.ErrBadLength
+	}
+
+	reqType := common.RequestSet
+	var flags, exptime, cas uint64
+	var sig []byte
+
+	// The value follows the command line whether or not its flags are valid, so it is skipped
+	// before an error is returned. Otherwise it would be read as the next command.
+	fail := func(err error) (common.Request, common.RequestType, uint64, error) {
+		if ioerr := discardData(r, length); ioerr != nil {
+			return nil, reqType, start, ioerr
+		}
+		return nil, reqType, start, err
+	}
+
+	for _, flag := range clParts[3:] {
+		if len(flag) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(flag, sigPrefix) {
+			if sig, err = parseSignature(flag); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+
+		switch flag[0] {
+		case 'q':
+			meta.quiet = true
+		case 'k':
+			meta.ret = append(meta.ret, flag[0])
+		case 'O':
+			meta.opaque = flag[1:]
+			meta.ret = append(meta.ret, flag[0])
+		case 'C':
+			if cas, err = parseCas(flag[1:]); err != nil {
+				return fail(err)
+			}
+			meta.cas = true
+		case 'F':
+			if flags, err = strconv.ParseUint(flag[1:], 10, 32); err != nil {
+				return fail(common.ErrBadFlags)
+			}
+		case 'T':
+			if exptime, err = strconv.ParseUint(flag[1:], 10, 32); err != nil {
+				return fail(common.ErrBadExptime)
+			}
+		case 'M':
+			if len(flag) != 2 {
+				return fail(common.ErrBadRequest)
+			}
+			switch flag[1] {
+			case 'S', 's':
+				reqType = common.RequestSet
+			case 'E', 'e':
+				reqType = common.RequestAdd
+			case 'R', 'r':
+				reqType = common.RequestReplace
+			case 'A', 'a':
+				reqType = common.RequestAppend
+			case 'P', 'p':
+				reqType = common.RequestPrepend
+			default:
+				return fail(common.ErrBadRequest)
+			}
+		default:
+			return fail(common.ErrBadRequest)
+		}
+	}
+
+	dataBuf, err := readData(r, length)
+	if err != nil {
+		return nil, reqType, start, err
+	}
+
+	meta.cmd = metaSet
+	meta.key = key
+
+	return common.SetRequest{
+		Key:       key,
+		Flags:     uint32(flags),
+		Exptime:   uint32(exptime),
+		Opaque:    uint32(0),
+		Quiet:     meta.quiet,
+		Cas:       cas,
+		Data:      dataBuf,
+		Signature: sig,
+	}, reqType, start, nil
+}
+
+func metaDeleteRequest(clParts []string, meta *cmdState, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if len(clParts) < 2 {
+		return nil, common.RequestDelete, start, common.ErrBadRequest
+	}
+
+	key := []byte(clParts[1])
+	var cas uint64
+	var sig []byte
+
+	for _, flag := range clParts[2:] {
+		if len(flag) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(flag, sigPrefix) {
+			var err error
+			if sig, err = parseSignature(flag); err != nil {
+				return nil, common.RequestDelete, start, err
+			}
+			continue
+		}
+
+		switch flag[0] {
+		case 'q':
+			meta.quiet = true
+		case 'k':
+			meta.ret = append(meta.ret, flag[0])
+		case 'O':
+			meta.opaque = flag[1:]
+			meta.ret = append(meta.ret, flag[0])
+		case 'C':
+			var err error
+			if cas, err = parseCas(flag[1:]); err != nil {
+				return nil, common.RequestDelete, start, err
+			}
+			meta.cas = true
+		default:
+			return nil, common.RequestDelete, start, common.ErrBadRequest
+		}
+	}
+
+	meta.cmd = metaDelete
+	meta.key = key
+
+	return common.DeleteRequest{
+		Key:       key,
+		Opaque:    uint32(0),
+		Quiet:     meta.quiet,
+		Cas:       cas,
+		Signature: sig,
+	}, common.RequestDelete, start, nil
+}
+
+func metaArithRequest(clParts []string, meta *cmdState, start uint64) (common.Request, common.RequestType, uint64, error) {
+	if len(clParts) < 2 {
+		return nil, common.RequestIncr, start, common.ErrBadRequest
+	}
+
+	req := common.IncrDecrRequest{
+		Key:     []byte(clParts[1]),
+		Delta:   1,
+		Exptime: common.NoInitialExptime,
+		Opaque:  uint32(0),
+	}
+	reqType := common.RequestIncr
+
+	for _, flag := range clParts[2:] {
+		if len(flag) == 0 {
+			continue
+		}
+
+		var err error
+
+		if strings.HasPrefix(flag, sigPrefix) {
+			if req.Signature, err = parseSignature(flag); err != nil {
+				return nil, reqType, start, err
+			}
+			continue
+		}
+
+		switch flag[0] {
+		case 'q':
+			meta.quiet = true
+		case 'v':
+			meta.value = true
+		case 'k':
+			meta.ret = append(meta.ret, flag[0])
+		case 'O':
+			meta.opaque = flag[1:]
+			meta.ret = append(meta.ret, flag[0])
+		case 'D':
+			req.Delta, err = strconv.ParseUint(flag[1:], 10, 64)
+		case 'J':
+			req.Initial, err = strconv.ParseUint(flag[1:], 10, 64)
+		case 'N':
+			var ttl uint64
+			ttl, err = strconv.ParseUint(flag[1:], 10, 32)
+			req.Exptime = uint32(ttl)
+		case 'M':
+			switch flag[1:] {
+			case "I", "i", "+":
+				reqType = common.RequestIncr
+			case "D", "d", "-":
+				reqType = common.RequestDecr
+			default:
+				err = common.ErrBadRequest
+			}
+		default:
+			err = common.ErrBadRequest
+		}
+
+		if err != nil {
+			return nil, reqType, start, common.ErrBadRequest
+		}
+	}
+
+	meta.cmd = metaArith
+	meta.key = req.Key
+	req.Quiet = meta.quiet
+
+	return req, reqType, start, nil
+}
+
+// metaRetFlags builds the return flags string for a meta response, including a leading space
+// if there are any flags at all.
+func (m *cmdState) metaRetFlags(response *common.GetResponse) string {
+	var parts []string
+
+	for _, f := range m.ret {
+		switch f {
+		case 'k':
+			parts = append(parts, "k"+string(m.key))
+		case 'O':
+			parts = append(parts, "O"+m.opaque)
+		case 'c':
+			if response != nil {
+				parts = append(parts, "c"+strconv.FormatUint(response.Cas, 10))
+			}
+		case 'f':
+			if response != nil {
+				parts = append(parts, "f"+strconv.FormatUint(uint64(response.Flags), 10))
+			}
+		case 's':
+			if response != nil {
+				parts = append(parts, "s"+strconv.Itoa(len(response.Data)))
+			}
+		}
+	}
+
+	// The lease flags are returned whether they were asked for or not, as memcached does
+	if response != nil {
+		switch response.Lease {
+		case common.LeaseGranted:
+			parts = append(parts, "W")
+		case common.LeaseHeld:
+			parts = append(parts, "Z")
+		}
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return " " + strings.Join(parts, " ")
+}
+
+func (t TextResponder) metaStored() error {
+	if t.state.quiet {
+		return nil
+	}
+	return t.resp("HD" + t.state.metaRetFlags(nil))
+}
+
+// metaGet answers a meta get. A miss that came with a lease answer is sent as an empty hit with
+// the W or Z flag, the same as the item memcached creates for the N flag.
+func (t TextResponder) metaGet(response common.GetResponse) error {
+	if response.Miss && response.Lease == common.LeaseNone {
+		if t.state.quiet {
+			return nil
+		}
+		return t.resp("EN")
+	}
+
+	if !t.state.value {
+		return t.resp("HD" + t.state.metaRetFlags(&response))
+	}
+
+	// VA <size> <flags>*\r\n
+	// <data block>\r\n
+	n, err := t.writer.WriteString("VA " + strconv.Itoa(len(response.Data)) + t.state.metaRetFlags(&response) + "\r\n")
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	n, err = t.writer.Write(response.Data)
+	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+	if err != nil {
+		return err
+	}
+
+	return t.resp("")
+}
+
+func (t TextResponder) metaArith(value uint64) error {
+	if t.state.quiet {
+		return nil
+	}
+
+	if !t.state.value {
+		return t.resp("HD" + t.state.metaRetFlags(nil))
+	}
+
+	v := strconv.FormatUint(value, 10)
+	return t.resp("VA " + strconv.Itoa(len(v)) + t.state.metaRetFlags(nil) + "\r\n" + v)
+}
+
+func (t TextResponder) metaError(err error) (bool, error) {
+	switch t.state.cmd {
+	case metaGet:
+		if err == common.ErrKeyNotFound {
+			return true, t.metaGet(common.GetResponse{Miss: true})
+		}
+
+	case metaSet:
+		if t.state.cas {
+			switch err {
+			case common.ErrKeyExists:
+				return true, t.resp("EX" + t.state.metaRetFlags(nil))
+			case common.ErrKeyNotFound:
+				return true, t.resp("NF" + t.state.metaRetFlags(nil))
+			}
+		}
+
+		switch err {
+		case common.ErrKeyExists, common.ErrKeyNotFound, common.ErrItemNotStored:
+			return true, t.resp("NS" + t.state.metaRetFlags(nil))
+		}
+
+	case metaDelete:
+		switch err {
+		case common.ErrKeyExists:
+			return true, t.resp("EX" + t.state.metaRetFlags(nil))
+		case common.ErrKeyNotFound:
+			if t.state.quiet {
+				return true, nil
+			}
+			return true, t.resp("NF" + t.state.metaRetFlags(nil))
+		}
+
+	case metaArith:
+		if err == common.ErrKeyNotFound {
+			return true, t.resp("NF" + t.state.metaRetFlags(nil))
+		}
+	}
+
+	return false, nil
+}
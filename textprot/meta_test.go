@@ -0,0 +1,244 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot_test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hongst/rend/common"
+	"github.com/hongst/rend/textprot"
+)
+
+func newMetaPair(in string) (textprot.TextParser, textprot.TextResponder, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	r := bufio.NewReader(strings.NewReader(in))
+	w := bufio.NewWriter(out)
+	p, res := textprot.NewTextParserResponder(r, w)
+	return p, res, out
+}
+
+func TestMetaGet(t *testing.T) {
+	p, res, out := newMetaPair("mg foo v f k Oabc\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestGet {
+		t.Fatalf("Expected get, got %v", reqType)
+	}
+	if gr := req.(common.GetRequest); string(gr.Keys[0]) != "foo" {
+		t.Fatalf("Expected key foo, got %s", gr.Keys[0])
+	}
+
+	res.Get(common.GetResponse{Key: []byte("foo"), Data: []byte("bar"), Flags: 5})
+	res.GetEnd(0, false)
+
+	if out.String() != "VA 3 f5 kfoo Oabc\r\nbar\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestMetaGetMiss(t *testing.T) {
+	p, res, out := newMetaPair("mg foo v\r\nmg foo v q\r\n")
+
+	p.Parse()
+	res.Get(common.GetResponse{Key: []byte("foo"), Miss: true})
+	res.GetEnd(0, false)
+
+	p.Parse()
+	res.Get(common.GetResponse{Key: []byte("foo"), Miss: true})
+	res.GetEnd(0, false)
+
+	if out.String() != "EN\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestMetaGetLease(t *testing.T) {
+	p, res, out := newMetaPair("mg foo v N30\r\nmg foo k N30\r\n")
+
+	req, _, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.(common.GetRequest).Lease != 30 {
+		t.Fatalf("Expected a 30 second lease")
+	}
+	res.Get(common.GetResponse{Key: []byte("foo"), Miss: true, Lease: common.LeaseGranted})
+	res.GetEnd(0, false)
+
+	p.Parse()
+	res.Get(common.GetResponse{Key: []byte("foo"), Miss: true, Lease: common.LeaseHeld})
+	res.GetEnd(0, false)
+
+	if out.String() != "VA 0 W\r\n\r\nHD kfoo Z\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestMetaGetTouch(t *testing.T) {
+	p, _, _ := newMetaPair("mg foo T30\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestGat {
+		t.Fatalf("Expected gat, got %v", reqType)
+	}
+	if req.(common.GATRequest).Exptime != 30 {
+		t.Fatalf("Expected exptime 30")
+	}
+}
+
+func TestMetaSet(t *testing.T) {
+	p, res, out := newMetaPair("ms foo 3 T10 F7 ME\r\nbar\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestAdd {
+		t.Fatalf("Expected add, got %v", reqType)
+	}
+
+	sr := req.(common.SetRequest)
+	if string(sr.Data) != "bar" || sr.Flags != 7 || sr.Exptime != 10 {
+		t.Fatalf("Unexpected request %+v", sr)
+	}
+
+	res.Error(0, reqType, common.ErrKeyExists, false)
+
+	if out.String() != "NS\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestMetaSetBadFlag(t *testing.T) {
+	// The value of a set that can't be run must not be read as the next command
+	p, _, _ := newMetaPair("ms foo 9 Z\r\nflush_all\r\nmn\r\n")
+
+	if _, _, _, err := p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected ErrBadRequest, got %v", err)
+	}
+	if _, reqType, _, err := p.Parse(); err != nil || reqType != common.RequestNoop {
+		t.Fatalf("Expected the next command to be the noop, got %v and %v", reqType, err)
+	}
+}
+
+func TestMetaSignatures(t *testing.T) {
+	p, _, _ := newMetaPair("ms foo 3 s:0102 ME\r\nbar\r\nmd foo s:0304 q\r\nma foo s:0506\r\n")
+
+	req, _, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sig := req.(common.SetRequest).Signature; !bytes.Equal(sig, []byte{1, 2}) {
+		t.Fatalf("Expected the set to be signed, got %x", sig)
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sig := req.(common.DeleteRequest).Signature; !bytes.Equal(sig, []byte{3, 4}) {
+		t.Fatalf("Expected the delete to be signed, got %x", sig)
+	}
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sig := req.(common.IncrDecrRequest).Signature; !bytes.Equal(sig, []byte{5, 6}) {
+		t.Fatalf("Expected the arithmetic to be signed, got %x", sig)
+	}
+}
+
+func TestMetaDelete(t *testing.T) {
+	p, res, out := newMetaPair("md foo\r\nmn\r\n")
+
+	p.Parse()
+	res.Error(0, common.RequestDelete, common.ErrKeyNotFound, false)
+
+	p.Parse()
+	res.Noop(0)
+
+	if out.String() != "NF\r\nMN\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestClassicAfterMeta(t *testing.T) {
+	p, res, out := newMetaPair("md foo\r\ndelete foo\r\n")
+
+	p.Parse()
+	res.Delete(0, false)
+
+	p.Parse()
+	res.Delete(0, false)
+
+	if out.String() != "HD\r\nDELETED\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestMetaSetCas(t *testing.T) {
+	p, res, out := newMetaPair("mg foo c v\r\nms foo 3 C42\r\nbar\r\n")
+
+	if req, _, _, _ := p.Parse(); !req.(common.GetRequest).Cas {
+		t.Fatalf("Expected mg with c to ask for CAS values")
+	}
+	res.Get(common.GetResponse{Key: []byte("foo"), Data: []byte("bar"), Cas: 42})
+
+	req, _, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if req.(common.SetRequest).Cas != 42 {
+		t.Fatalf("Expected CAS 42, got %d", req.(common.SetRequest).Cas)
+	}
+	res.Error(0, common.RequestSet, common.ErrKeyExists, false)
+
+	if out.String() != "VA 3 c42\r\nbar\r\nEX\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestMetaArith(t *testing.T) {
+	p, res, out := newMetaPair("ma foo MD D3 J10 N0 v\r\nma foo\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestDecr {
+		t.Fatalf("Expected decr, got %v", reqType)
+	}
+	if ir := req.(common.IncrDecrRequest); ir.Delta != 3 || ir.Initial != 10 || ir.Exptime != 0 {
+		t.Fatalf("Unexpected request %#v", ir)
+	}
+	res.Decr(0, 7, false)
+
+	p.Parse()
+	res.Error(0, common.RequestIncr, common.ErrKeyNotFound, false)
+
+	if out.String() != "VA 1\r\n7\r\nNF\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
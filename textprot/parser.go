@@ -16,7 +16,10 @@ package textprot
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"log"
 	"strconv"
 	"strings"
@@ -26,16 +29,53 @@ import (
 	"github.com/hongst/rend/timer"
 )
 
+// cmdState holds the details of the command currently being processed that the responder needs
+// but that are not part of the common request types, e.g. which flags a meta command was given.
+type cmdState struct {
+	// gets is set for the classic gets command so VALUE lines include the CAS value
+	gets bool
+	// pipelined is set when another complete storage command is already buffered after this
+	// one, so the response can wait to be flushed with the next one
+	pipelined bool
+
+	// The rest is only used for meta commands
+	cmd    metaCmd
+	key    []byte
+	quiet  bool
+	value  bool
+	cas    bool
+	opaque string
+	// ret holds the return flags requested by the client, in the order they were given
+	ret []byte
+}
+
 type TextParser struct {
 	reader *bufio.Reader
+	state  *cmdState
 }
 
+// NewTextParser creates a parser that does not share state with a responder. Meta commands
+// will be parsed, but any responder will reply to them as if they were classic commands. Use
+// NewTextParserResponder to handle meta commands properly.
 func NewTextParser(reader *bufio.Reader) TextParser {
 	return TextParser{
 		reader: reader,
 	}
 }
 
+// NewTextParserResponder creates a parser and responder pair for a single connection. The
+// two share the state of the current meta command so responses match the flags of the request.
+func NewTextParserResponder(reader *bufio.Reader, writer *bufio.Writer) (TextParser, TextResponder) {
+	state := &cmdState{}
+	return TextParser{
+		reader: reader,
+		state:  state,
+	}, TextResponder{
+		writer: writer,
+		state:  state,
+	}
+}
+
 func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error) {
 	data, err := t.reader.ReadString('\n')
 	start := timer.Now()
@@ -52,27 +92,63 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 
 	clParts := strings.Split(strings.TrimSpace(data), " ")
 
+	// Each command starts fresh. The state is only filled in for commands whose responses
+	// depend on more than the request type, like meta commands.
+	state := t.state
+	if state == nil {
+		state = &cmdState{}
+	}
+	*state = cmdState{}
+
 	switch clParts[0] {
+	case "mg", "ms", "md", "mn", "ma":
+		return parseMeta(t.reader, clParts, state, start)
+
 	case "set":
-		return setRequest(t.reader, clParts, common.RequestSet, start)
+		return t.storageRequest(clParts, common.RequestSet, state, start)
 
 	case "add":
-		return setRequest(t.reader, clParts, common.RequestAdd, start)
+		return t.storageRequest(clParts, common.RequestAdd, state, start)
 
 	case "replace":
-		return setRequest(t.reader, clParts, common.RequestReplace, start)
+		return t.storageRequest(clParts, common.RequestReplace, state, start)
 
 	case "append":
-		return setRequest(t.reader, clParts, common.RequestAppend, start)
+		return t.storageRequest(clParts, common.RequestAppend, state, start)
 
 	case "prepend":
-		return setRequest(t.reader, clParts, common.RequestPrepend, start)
+		return t.storageRequest(clParts, common.RequestPrepend, state, start)
+
+	case "cas":
+		// cas <key> <flags> <exptime> <bytes> <cas unique> [s:<signature>] [noreply]
+		if len(clParts) < 6 {
+			return nil, common.RequestSet, start, common.ErrBadRequest
+		}
+
+		cas, err := parseCas(clParts[5])
+		if err != nil {
+			// Skip the value so it isn't read as the next command
+			if length, lerr := strconv.ParseUint(clParts[4], 10, 32); lerr == nil {
+				if derr := discardData(t.reader, length); derr != nil {
+					return nil, common.RequestSet, start, derr
+				}
+			}
+			return nil, common.RequestSet, start, err
+		}
+
+		// The rest is the same as a set without the CAS unique
+		parts := append(append([]string{}, clParts[:5]...), clParts[6:]...)
+		req, reqType, _, err := t.storageRequest(parts, common.RequestSet, state, start)
+		req.Cas = cas
+		return req, reqType, start, err
 
-	case "get":
+	case "get", "gets":
 		if len(clParts) < 2 {
 			return nil, common.RequestGet, start, common.ErrBadRequest
 		}
 
+		state.gets = clParts[0] == "gets"
+
 		var keys [][]byte
 		for _, key := range clParts[1:] {
 			keys = append(keys, []byte(key))
@@ -86,44 +162,98 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 			Opaques: opaques,
 			Quiet:   quiet,
 			NoopEnd: false,
+			Cas:     state.gets,
 		}, common.RequestGet, start, nil
 
-	/*
-	 * Added by zhh
-	 */
-	case "stats":
-		if len(clParts) != 1 {
-			return nil, common.RequestQuit, start, common.ErrBadRequest
+	case "flush_all":
+		// flush_all [delay] [s:sig] [noreply]
+		if len(clParts) > 4 {
+			return nil, common.RequestFlush, start, common.ErrBadRequest
 		}
 
-		var keys [][]byte
-		for _, key := range clParts[0:] {
-			keys = append(keys, []byte(key))
+		var delay uint64
+		var quiet bool
+		var sig []byte
+		for _, part := range clParts[1:] {
+			switch {
+			case part == "noreply":
+				quiet = true
+			case strings.HasPrefix(part, "s:"):
+				if sig, err = parseSignature(part); err != nil {
+					return nil, common.RequestFlush, start, err
+				}
+			default:
+				if delay, err = strconv.ParseUint(part, 10, 32); err != nil {
+					return nil, common.RequestFlush, start, common.ErrBadRequest
+				}
+			}
 		}
 
-		opaques := make([]uint32, len(keys))
-		quiet := make([]bool, len(keys))
+		return common.FlushRequest{
+			Delay:     uint32(delay),
+			Opaque:    uint32(0),
+			Quiet:     quiet,
+			Signature: sig,
+		}, common.RequestFlush, start, nil
+
+	case "verbosity":
+		// verbosity <level> [noreply]
+		if len(clParts) != 2 && len(clParts) != 3 {
+			return nil, common.RequestVerbosity, start, common.ErrBadRequest
+		}
 
-		return common.GetRequest{
-			Keys:    keys,
-			Opaques: opaques,
-			Quiet:   quiet,
-			NoopEnd: false,
-		}, common.RequestGet, start, nil
+		level, err := strconv.ParseUint(clParts[1], 10, 32)
+		if err != nil {
+			return nil, common.RequestVerbosity, start, common.ErrBadRequest
+		}
+
+		quiet := len(clParts) == 3
+		if quiet && clParts[2] != "noreply" {
+			return nil, common.RequestVerbosity, start, common.ErrBadRequest
+		}
+
+		return common.VerbosityRequest{
+			Level:  uint32(level),
+			Opaque: uint32(0),
+			Quiet:  quiet,
+		}, common.RequestVerbosity, start, nil
+
+	case "stats":
+		if len(clParts) > 2 {
+			return nil, common.RequestStats, start, common.ErrBadRequest
+		}
+
+		var group []byte
+		if len(clParts) == 2 {
+			group = []byte(clParts[1])
+		}
+
+		return common.StatsRequest{
+			Group:  group,
+			Opaque: uint32(0),
+		}, common.RequestStats, start, nil
 
 	case "delete":
-		if len(clParts) != 2 {
+		if len(clParts) != 2 && len(clParts) != 3 {
 			return nil, common.RequestDelete, start, common.ErrBadRequest
 		}
 
+		var sig []byte
+		if len(clParts) == 3 {
+			if sig, err = parseSignature(clParts[2]); err != nil {
+				return nil, common.RequestDelete, start, err
+			}
+		}
+
 		return common.DeleteRequest{
-			Key:    []byte(clParts[1]),
-			Opaque: uint32(0),
+			Key:       []byte(clParts[1]),
+			Opaque:    uint32(0),
+			Signature: sig,
 		}, common.RequestDelete, start, nil
 
 	// TODO: Error handling for invalid cmd line
 	case "touch":
-		if len(clParts) != 3 {
+		if len(clParts) != 3 && len(clParts) != 4 {
 			return nil, common.RequestTouch, start, common.ErrBadRequest
 		}
 
@@ -135,11 +265,22 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 			return nil, common.RequestSet, start, common.ErrBadRequest
 		}
 
+		var sig []byte
+		if len(clParts) == 4 {
+			if sig, err = parseSignature(clParts[3]); err != nil {
+				return nil, common.RequestTouch, start, err
+			}
+		}
+
 		return common.TouchRequest{
-			Key:     key,
-			Exptime: uint32(exptime),
-			Opaque:  uint32(0),
+			Key:       key,
+			Exptime:   uint32(exptime),
+			Opaque:    uint32(0),
+			Signature: sig,
 		}, common.RequestTouch, start, nil
+	case "incr", "decr":
+		return incrDecrRequest(clParts, start)
+
 	case "noop":
 		if len(clParts) != 1 {
 			return nil, common.RequestNoop, start, common.ErrBadRequest
@@ -170,30 +311,176 @@ func (t TextParser) Parse() (common.Request, common.RequestType, uint64, error)
 	}
 }
 
+func incrDecrRequest(clParts []string, start uint64) (common.Request, common.RequestType, uint64, error) {
+	reqType := common.RequestIncr
+	if clParts[0] == "decr" {
+		reqType = common.RequestDecr
+	}
+
+	if len(clParts) != 3 && len(clParts) != 4 {
+		return nil, reqType, start, common.ErrBadRequest
+	}
+
+	delta, err := strconv.ParseUint(strings.TrimSpace(clParts[2]), 10, 64)
+	if err != nil {
+		return nil, reqType, start, common.ErrBadIncDecValue
+	}
+
+	var sig []byte
+	if len(clParts) == 4 {
+		if sig, err = parseSignature(clParts[3]); err != nil {
+			return nil, reqType, start, err
+		}
+	}
+
+	// The text protocol has no way to give an initial value, so misses are never filled in
+	return common.IncrDecrRequest{
+		Key:       []byte(clParts[1]),
+		Delta:     delta,
+		Exptime:   common.NoInitialExptime,
+		Opaque:    uint32(0),
+		Signature: sig,
+	}, reqType, start, nil
+}
+
+// storageRequest parses a classic storage command. Clients often batch many sets into a single
+// write, so when the next storage command is already in the buffer the response is left for the
+// next one to flush instead of costing a write each.
+func (t TextParser) storageRequest(clParts []string, reqType common.RequestType, state *cmdState, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
+	req, reqType, start, err := setRequest(t.reader, clParts, reqType, start)
+	// The value of a streamed set is still in the buffer, so nothing after it can be seen yet
+	if err == nil && req.Stream == nil {
+		state.pipelined = storageBuffered(t.reader)
+	}
+	return req, reqType, start, err
+}
+
+// storageBuffered reports whether the reader's buffer holds a full classic storage command,
+// including its data block, so parsing it will not block.
+func storageBuffered(r *bufio.Reader) bool {
+	buf, _ := r.Peek(r.Buffered())
+
+	end := bytes.IndexByte(buf, '\n')
+	if end < 0 {
+		return false
+	}
+
+	// <cmd> <key> <flags> <exptime> <bytes> ...
+	clParts := strings.Fields(string(buf[:end]))
+	if len(clParts) < 5 {
+		return false
+	}
+
+	switch clParts[0] {
+	case "set", "add", "replace", "append", "prepend", "cas":
+	default:
+		return false
+	}
+
+	length, err := strconv.ParseUint(clParts[4], 10, 32)
+	if err != nil {
+		return false
+	}
+
+	return uint64(len(buf)) >= uint64(end+1)+length+2
+}
+
+// setRequest parses <cmd> <key> <flags> <exptime> <bytes> [s:<signature>] [noreply]. Once the
+// length is known, a command that can't be run has its data block skipped before the error is
+// returned so the value isn't read as the next command.
 func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, start uint64) (common.SetRequest, common.RequestType, uint64, error) {
 	// sanity check
-	if len(clParts) != 5 {
+	if len(clParts) < 5 {
 		return common.SetRequest{}, reqType, start, common.ErrBadRequest
 	}
 
+	length, err := strconv.ParseUint(strings.TrimSpace(clParts[4]), 10, 32)
+	if err != nil {
+		log.Printf("Error parsing length for set/add/replace command: %s\n", err.Error())
+		return common.SetRequest{}, reqType, start, common.ErrBadLength
+	}
+
+	fail := func(err error) (common.SetRequest, common.RequestType, uint64, error) {
+		if derr := discardData(r, length); derr != nil {
+			return common.SetRequest{}, reqType, start, derr
+		}
+		return common.SetRequest{}, reqType, start, err
+	}
+
 	key := []byte(clParts[1])
 
 	flags, err := strconv.ParseUint(strings.TrimSpace(clParts[2]), 10, 32)
 	if err != nil {
 		log.Printf("Error parsing flags for set/add/replace command: %s\n", err.Error())
-		return common.SetRequest{}, reqType, start, common.ErrBadFlags
+		return fail(common.ErrBadFlags)
 	}
 
 	exptime, err := strconv.ParseUint(strings.TrimSpace(clParts[3]), 10, 32)
 	if err != nil {
 		log.Printf("Error parsing ttl for set/add/replace command: %s\n", err.Error())
-		return common.SetRequest{}, reqType, start, common.ErrBadExptime
+		return fail(common.ErrBadExptime)
 	}
 
-	length, err := strconv.ParseUint(strings.TrimSpace(clParts[4]), 10, 32)
+	// The signature comes before noreply when both are given
+	opts := clParts[5:]
+	var quiet bool
+	if n := len(opts); n > 0 && opts[n-1] == "noreply" {
+		quiet = true
+		opts = opts[:n-1]
+	}
+	if len(opts) > 1 {
+		return fail(common.ErrBadRequest)
+	}
+
+	var sig []byte
+	if len(opts) == 1 {
+		if sig, err = parseSignature(opts[0]); err != nil {
+			return fail(err)
+		}
+	}
+
+	// Large values of unsigned sets can go to the handler straight from the connection. Appends
+	// and prepends are always read whole.
+	if sig == nil && reqType != common.RequestAppend && reqType != common.RequestPrepend && common.StreamValue(length) {
+		return common.SetRequest{
+			Key:     key,
+			Flags:   uint32(flags),
+			Exptime: uint32(exptime),
+			Opaque:  uint32(0),
+			Quiet:   quiet,
+			Stream:  common.NewValueReader(r, int64(length), 2),
+			Length:  int(length),
+		}, reqType, start, nil
+	}
+
+	dataBuf, err := readData(r, length)
 	if err != nil {
-		log.Printf("Error parsing length for set/add/replace command: %s\n", err.Error())
-		return common.SetRequest{}, reqType, start, common.ErrBadLength
+		return common.SetRequest{}, reqType, start, err
+	}
+
+	return common.SetRequest{
+		Key:       key,
+		Flags:     uint32(flags),
+		Exptime:   uint32(exptime),
+		Opaque:    uint32(0),
+		Quiet:     quiet,
+		Data:      dataBuf,
+		Signature: sig,
+	}, reqType, start, nil
+}
+
+func readData(r *bufio.Reader, length uint64) ([]byte, error) {
+	// Values over the limit are skipped along with the trailing "\r\n" so the connection stays
+	// in sync for the error response
+	if common.ValueTooBig(length) {
+		n, err := io.CopyN(ioutil.Discard, r, int64(length))
+		metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+		if err != nil {
+			return nil, err
+		}
+		r.ReadString(byte('\n'))
+		metrics.IncCounterBy(common.MetricBytesReadRemote, 2)
+		return nil, common.ErrValueTooBig
 	}
 
 	// Read in data
@@ -201,18 +488,48 @@ func setRequest(r *bufio.Reader, clParts []string, reqType common.RequestType, s
 	n, err := io.ReadAtLeast(r, dataBuf, int(length))
 	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
 	if err != nil {
-		return common.SetRequest{}, reqType, start, common.ErrInternal
+		return nil, common.ErrInternal
 	}
 
 	// Consume the last two bytes "\r\n"
 	r.ReadString(byte('\n'))
 	metrics.IncCounterBy(common.MetricBytesReadRemote, 2)
 
-	return common.SetRequest{
-		Key:     key,
-		Flags:   uint32(flags),
-		Exptime: uint32(exptime),
-		Opaque:  uint32(0),
-		Data:    dataBuf,
-	}, reqType, start, nil
+	return dataBuf, nil
+}
+
+// discardData skips a value and its trailing "\r\n" so the connection stays in sync for the error
+// response to a command that can't be run
+func discardData(r *bufio.Reader, length uint64) error {
+	n, err := io.CopyN(ioutil.Discard, r, int64(length)+2)
+	metrics.IncCounterBy(common.MetricBytesReadRemote, uint64(n))
+	return err
+}
+
+// parseCas parses a CAS unique value. Zero is rejected because it would turn a
+// conditional write into an unconditional one.
+func parseCas(tok string) (uint64, error) {
+	cas, err := strconv.ParseUint(strings.TrimSpace(tok), 10, 64)
+	if err != nil || cas == 0 {
+		return 0, common.ErrBadRequest
+	}
+	return cas, nil
+}
+
+// Signatures are sent as an optional trailing token on mutation commands in
+// the form "s:<hex>", e.g. "delete foo s:0123456789abcdef"
+const sigPrefix = "s:"
+
+func parseSignature(tok string) ([]byte, error) {
+	if !strings.HasPrefix(tok, sigPrefix) {
+		return nil, common.ErrBadRequest
+	}
+
+	sig, err := hex.DecodeString(tok[len(sigPrefix):])
+	if err != nil {
+		log.Printf("Error parsing request signature: %s\n", err.Error())
+		return nil, common.ErrBadRequest
+	}
+
+	return sig, nil
 }
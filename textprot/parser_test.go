@@ -0,0 +1,219 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot_test
+
+import (
+	"testing"
+
+	"github.com/hongst/rend/common"
+)
+
+func TestSetSignature(t *testing.T) {
+	p, res, out := newMetaPair("set k 0 0 5 s:abcd\r\nhello\r\nset k 0 0 5 s:abcd noreply\r\nhello\r\nset k 0 0 5 noreply\r\nhello\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestSet {
+		t.Fatalf("Expected set, got %v %v", reqType, err)
+	}
+	set := req.(common.SetRequest)
+	if string(set.Data) != "hello" || string(set.Signature) != "\xab\xcd" || set.Quiet {
+		t.Fatalf("Unexpected set %+v", set)
+	}
+	res.Set(0, set.Quiet)
+
+	for i := 0; i < 2; i++ {
+		req, _, _, err = p.Parse()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		set = req.(common.SetRequest)
+		if string(set.Data) != "hello" || !set.Quiet {
+			t.Fatalf("Expected a set with noreply, got %+v", set)
+		}
+		res.Set(0, set.Quiet)
+	}
+	if set.Signature != nil {
+		t.Fatalf("Expected no signature, got %x", set.Signature)
+	}
+
+	if out.String() != "STORED\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestSetBadOptionSkipsValue(t *testing.T) {
+	for _, line := range []string{
+		"set k 0 0 5 s:zz",
+		"set k 0 0 5 noreply s:abcd",
+		"set k 0 0 5 s:ab s:cd",
+		"set k x 0 5",
+		"set k 0 x 5",
+	} {
+		p, _, _ := newMetaPair(line + "\r\nhello\r\nget k\r\n")
+
+		if _, _, _, err := p.Parse(); err == nil {
+			t.Fatalf("%q: expected an error", line)
+		}
+
+		_, reqType, _, err := p.Parse()
+		if err != nil || reqType != common.RequestGet {
+			t.Fatalf("%q: expected the next command to be a get, got %v %v", line, reqType, err)
+		}
+	}
+}
+
+func TestCasBadUniqueSkipsValue(t *testing.T) {
+	for _, unique := range []string{"x", "0", "-1"} {
+		p, _, _ := newMetaPair("cas foo 0 0 3 " + unique + "\r\nbar\r\nget foo\r\n")
+
+		if _, _, _, err := p.Parse(); err != common.ErrBadRequest {
+			t.Fatalf("%s: expected a bad request, got %v", unique, err)
+		}
+
+		_, reqType, _, err := p.Parse()
+		if err != nil || reqType != common.RequestGet {
+			t.Fatalf("%s: expected the next command to be a get, got %v %v", unique, reqType, err)
+		}
+	}
+}
+
+func TestGetsCas(t *testing.T) {
+	p, res, out := newMetaPair("gets foo\r\ncas foo 0 0 3 42\r\nbar\r\n")
+
+	req, _, _, _ := p.Parse()
+	if !req.(common.GetRequest).Cas {
+		t.Fatalf("Expected gets to ask for CAS values")
+	}
+	res.Get(common.GetResponse{Key: []byte("foo"), Data: []byte("bar"), Cas: 42})
+	res.GetEnd(0, false)
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestSet || req.(common.SetRequest).Cas != 42 {
+		t.Fatalf("Expected a set with CAS 42, got %v %+v", reqType, req)
+	}
+	res.Error(0, reqType, common.ErrKeyExists, false)
+
+	if out.String() != "VALUE foo 0 3 42\r\nbar\r\nEND\r\nEXISTS\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	p, res, out := newMetaPair("incr foo 5\r\ndecr foo 2\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestIncr {
+		t.Fatalf("Expected incr, got %v", reqType)
+	}
+	if ir := req.(common.IncrDecrRequest); ir.Delta != 5 || ir.Exptime != common.NoInitialExptime {
+		t.Fatalf("Unexpected request %#v", ir)
+	}
+	res.Incr(0, 15, false)
+
+	_, reqType, _, err = p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestDecr {
+		t.Fatalf("Expected decr, got %v", reqType)
+	}
+	res.Decr(0, 13, false)
+
+	if out.String() != "15\r\n13\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	p, res, out := newMetaPair("flush_all\r\nflush_all 30 noreply\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestFlush {
+		t.Fatalf("Expected flush, got %v %v", reqType, err)
+	}
+	res.Flush(0, req.(common.FlushRequest).Quiet)
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fr := req.(common.FlushRequest); fr.Delay != 30 || !fr.Quiet {
+		t.Fatalf("Unexpected request %+v", fr)
+	}
+	res.Flush(0, true)
+
+	if out.String() != "OK\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	p, res, out := newMetaPair("verbosity 1\r\nverbosity 1 noreply\r\nverbosity\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestVerbosity {
+		t.Fatalf("Expected verbosity, got %v %v", reqType, err)
+	}
+	res.Verbosity(0, req.(common.VerbosityRequest).Quiet)
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if vr := req.(common.VerbosityRequest); vr.Level != 1 || !vr.Quiet {
+		t.Fatalf("Unexpected request %+v", vr)
+	}
+	res.Verbosity(0, true)
+
+	if _, _, _, err = p.Parse(); err != common.ErrBadRequest {
+		t.Fatalf("Expected bad request for a missing level, got %v", err)
+	}
+
+	if out.String() != "OK\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestValueTooBig(t *testing.T) {
+	common.SetMaxValueSize(4)
+	defer common.SetMaxValueSize(0)
+
+	p, res, out := newMetaPair("set foo 0 0 5\r\nhello\r\nset foo 0 0 4\r\nhell\r\n")
+
+	_, reqType, _, err := p.Parse()
+	if err != common.ErrValueTooBig || reqType != common.RequestSet {
+		t.Fatalf("Expected value too big for a set, got %v %v", reqType, err)
+	}
+	res.Error(0, reqType, err, false)
+
+	// The value was skipped, so the next command parses normally
+	req, _, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sr := req.(common.SetRequest); string(sr.Data) != "hell" {
+		t.Fatalf("Unexpected request %+v", sr)
+	}
+
+	if out.String() != "SERVER_ERROR object too large for value\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
@@ -17,6 +17,8 @@ package textprot
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"strconv"
 
 	"github.com/hongst/rend/common"
 	"github.com/hongst/rend/metrics"
@@ -24,6 +26,7 @@ import (
 
 type TextResponder struct {
 	writer *bufio.Writer
+	state  *cmdState
 }
 
 func NewTextResponder(writer *bufio.Writer) TextResponder {
@@ -33,26 +36,57 @@ func NewTextResponder(writer *bufio.Writer) TextResponder {
 }
 
 func (t TextResponder) Set(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	if t.state.isMeta() {
+		return t.metaStored()
+	}
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Add(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	if t.state.isMeta() {
+		return t.metaStored()
+	}
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Replace(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	if t.state.isMeta() {
+		return t.metaStored()
+	}
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Append(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	if t.state.isMeta() {
+		return t.metaStored()
+	}
+	return t.stored(quiet)
 }
 
 func (t TextResponder) Prepend(opaque uint32, quiet bool) error {
-	return t.resp("STORED")
+	if t.state.isMeta() {
+		return t.metaStored()
+	}
+	return t.stored(quiet)
+}
+
+// stored answers a classic storage command. One sent with noreply gets no answer, but the
+// responses held for it still go out unless another command is queued behind it.
+func (t TextResponder) stored(quiet bool) error {
+	if !quiet {
+		return t.resp("STORED")
+	}
+	if t.state != nil && t.state.pipelined {
+		return nil
+	}
+	return t.writer.Flush()
 }
 
 func (t TextResponder) Get(response common.GetResponse) error {
+	if t.state.isMeta() {
+		return t.metaGet(response)
+	}
+
 	if response.Miss {
 		// A miss is a no-op in the text world
 		return nil
@@ -62,18 +96,40 @@ func (t TextResponder) Get(response common.GetResponse) error {
 	// [VALUE <key> <flags> <bytes>\r\n
 	// <data block>\r\n]*
 	// END\r\n
-	n, err := fmt.Fprintf(t.writer, "VALUE %s %d %d\r\n", response.Key, response.Flags, len(response.Data))
-	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
-	if err != nil {
-		return err
+	// gets adds the CAS value to the end of the VALUE line
+	length := len(response.Data)
+	if response.Stream != nil {
+		length = response.Length
 	}
 
-	n, err = t.writer.Write(response.Data)
+	var n int
+	var err error
+	if t.state != nil && t.state.gets {
+		n, err = fmt.Fprintf(t.writer, "VALUE %s %d %d %d\r\n", response.Key, response.Flags, length, response.Cas)
+	} else {
+		n, err = fmt.Fprintf(t.writer, "VALUE %s %d %d\r\n", response.Key, response.Flags, length)
+	}
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
 		return err
 	}
 
+	if response.Stream != nil {
+		// Copying straight into the bufio.Writer sends the value out as it is read instead of
+		// holding all of it.
+		n64, err := io.CopyN(t.writer, response.Stream, int64(length))
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n64))
+		if err != nil {
+			return err
+		}
+	} else {
+		n, err = t.writer.Write(response.Data)
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+
 	n, err = t.writer.WriteString("\r\n")
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
@@ -84,7 +140,17 @@ func (t TextResponder) Get(response common.GetResponse) error {
 	return nil
 }
 
+// CanStream reports whether the current get can be answered from a GetResponse.Stream. Meta
+// commands always get the whole value.
+func (t TextResponder) CanStream() bool {
+	return !t.state.isMeta()
+}
+
 func (t TextResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	if t.state.isMeta() {
+		// Meta gets have no END marker
+		return nil
+	}
 	return t.resp("END")
 }
 
@@ -93,6 +159,11 @@ func (t TextResponder) GetE(response common.GetEResponse) error {
 }
 
 func (t TextResponder) GAT(response common.GetResponse) error {
+	// A meta get with a T flag is turned into a GAT by the parser
+	if t.state.isMeta() {
+		return t.metaGet(response)
+	}
+
 	// There's two options here.
 	// 1) panic() because this is never supposed to be called
 	// 2) Respond as a normal get
@@ -103,7 +174,10 @@ func (t TextResponder) GAT(response common.GetResponse) error {
 	panic("GAT command in text protocol")
 }
 
-func (t TextResponder) Delete(opaque uint32) error {
+func (t TextResponder) Delete(opaque uint32, quiet bool) error {
+	if t.state.isMeta() {
+		return t.metaStored()
+	}
 	return t.resp("DELETED")
 }
 
@@ -112,9 +186,53 @@ func (t TextResponder) Touch(opaque uint32) error {
 }
 
 func (t TextResponder) Noop(opaque uint32) error {
+	if t.state.isMeta() {
+		return t.resp("MN")
+	}
 	return t.resp("Yep, it works.")
 }
 
+func (t TextResponder) Incr(opaque uint32, value uint64, quiet bool) error {
+	if t.state.isMeta() {
+		return t.metaArith(value)
+	}
+	return t.resp(strconv.FormatUint(value, 10))
+}
+
+func (t TextResponder) Decr(opaque uint32, value uint64, quiet bool) error {
+	if t.state.isMeta() {
+		return t.metaArith(value)
+	}
+	return t.resp(strconv.FormatUint(value, 10))
+}
+
+func (t TextResponder) Flush(opaque uint32, quiet bool) error {
+	if !quiet {
+		return t.resp("OK")
+	}
+	return nil
+}
+
+func (t TextResponder) Stats(opaque uint32, stats []common.Stat) error {
+	for _, stat := range stats {
+		n, err := t.writer.WriteString("STAT " + stat.Name + " " + stat.Value + "\r\n")
+		metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+	return t.resp("END")
+}
+
+// SASL is only part of the binary protocol. The text parser never produces SASL requests.
+func (t TextResponder) SASLListMechs(opaque uint32, mechs []string) error {
+	return t.resp("ERROR")
+}
+
+func (t TextResponder) SASLAuth(opaque uint32) error {
+	return t.resp("ERROR")
+}
+
 func (t TextResponder) Quit(opaque uint32, quiet bool) error {
 	if !quiet {
 		return t.resp("Bye")
@@ -122,26 +240,55 @@ func (t TextResponder) Quit(opaque uint32, quiet bool) error {
 	return nil
 }
 
-func (t TextResponder) Version(opaque uint32) error {
-	return t.resp("VERSION " + common.VersionString)
+func (t TextResponder) Version(opaque uint32, version string) error {
+	return t.resp("VERSION " + version)
+}
+
+func (t TextResponder) Verbosity(opaque uint32, quiet bool) error {
+	if !quiet {
+		return t.resp("OK")
+	}
+	return nil
 }
 
 func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err error, quiet bool) error {
+	if t.state.isMeta() {
+		if handled, merr := t.metaError(err); handled {
+			return merr
+		}
+	}
+
 	switch err {
 	case common.ErrKeyNotFound:
+		// Replace, append and prepend only store when the key is present, so a miss means the
+		// item was not stored rather than not found
+		switch reqType {
+		case common.RequestReplace, common.RequestAppend, common.RequestPrepend:
+			return t.resp("NOT_STORED")
+		}
 		return t.resp("NOT_FOUND")
 	case common.ErrKeyExists:
+		// A plain set never fails because the key exists, so for sets this is a CAS mismatch
+		if reqType == common.RequestSet {
+			return t.resp("EXISTS")
+		}
 		return t.resp("NOT_STORED")
 	case common.ErrItemNotStored:
 		return t.resp("NOT_STORED")
 	case common.ErrValueTooBig:
-		fallthrough
+		return t.resp("SERVER_ERROR object too large for value")
 	case common.ErrInvalidArgs:
 		return t.resp("CLIENT_ERROR bad command line")
 	case common.ErrBadIncDecValue:
 		return t.resp("CLIENT_ERROR invalid numeric delta argument")
 	case common.ErrAuth:
 		return t.resp("CLIENT_ERROR")
+	case common.ErrBusy:
+		return t.resp("SERVER_ERROR busy")
+	case common.ErrTempFailure:
+		return t.resp("SERVER_ERROR temporary failure")
+	case common.ErrTimeout:
+		return t.resp("SERVER_ERROR backend timeout")
 	case common.ErrUnknownCmd:
 		fallthrough
 	case common.ErrNoMem:
@@ -152,11 +299,16 @@ func (t TextResponder) Error(opaque uint32, reqType common.RequestType, err erro
 }
 
 func (t TextResponder) resp(s string) error {
-	n, err := fmt.Fprintf(t.writer, s+"\r\n")
+	n, err := t.writer.WriteString(s + "\r\n")
 	metrics.IncCounterBy(common.MetricBytesWrittenRemote, uint64(n))
 	if err != nil {
 		return err
 	}
 
+	// The next command in a pipelined batch will flush this response
+	if t.state != nil && t.state.pipelined {
+		return nil
+	}
+
 	return t.writer.Flush()
 }
@@ -0,0 +1,108 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package textprot_test
+
+import (
+	"testing"
+
+	"github.com/hongst/rend/common"
+)
+
+func TestAddReplaceNotStored(t *testing.T) {
+	p, res, out := newMetaPair("add foo 0 0 3\r\nbar\r\nreplace foo 0 0 3\r\nbar\r\n")
+
+	_, reqType, _, err := p.Parse()
+	if err != nil || reqType != common.RequestAdd {
+		t.Fatalf("Expected add, got %v %v", reqType, err)
+	}
+	res.Error(0, reqType, common.ErrKeyExists, false)
+
+	_, reqType, _, err = p.Parse()
+	if err != nil || reqType != common.RequestReplace {
+		t.Fatalf("Expected replace, got %v %v", reqType, err)
+	}
+	res.Error(0, reqType, common.ErrKeyNotFound, false)
+
+	if out.String() != "NOT_STORED\r\nNOT_STORED\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestPipelinedSets(t *testing.T) {
+	p, res, out := newMetaPair("set foo 0 0 3\r\nbar\r\nadd baz 0 0 3\r\nqux\r\n" +
+		"cas foo 0 0 3 5\r\nbar\r\nget foo\r\n")
+
+	// The first two responses wait for the next storage command in the buffer
+	for _, want := range []common.RequestType{common.RequestSet, common.RequestAdd} {
+		_, reqType, _, err := p.Parse()
+		if err != nil || reqType != want {
+			t.Fatalf("Expected %v, got %v %v", want, reqType, err)
+		}
+		res.Set(0, false)
+
+		if out.Len() != 0 {
+			t.Fatalf("Expected the response to be held, got %q", out.String())
+		}
+	}
+
+	// The last one in the batch is followed by a get, so everything goes out
+	if _, _, _, err := p.Parse(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res.Error(0, common.RequestSet, common.ErrKeyExists, false)
+
+	if out.String() != "STORED\r\nSTORED\r\nEXISTS\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestPipelinedSetIncomplete(t *testing.T) {
+	// The next set's data isn't all there yet, so the response can't wait for it
+	p, res, out := newMetaPair("set foo 0 0 3\r\nbar\r\nset foo 0 0 3\r\nba")
+
+	if _, _, _, err := p.Parse(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	res.Set(0, false)
+
+	if out.String() != "STORED\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	p, res, out := newMetaPair("stats\r\nstats items\r\n")
+
+	req, reqType, _, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if reqType != common.RequestStats || len(req.(common.StatsRequest).Group) != 0 {
+		t.Fatalf("Expected general stats, got %v %+v", reqType, req)
+	}
+	res.Stats(0, []common.Stat{{Name: "pid", Value: "1"}, {Name: "l1:curr_items", Value: "2"}})
+
+	req, _, _, err = p.Parse()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(req.(common.StatsRequest).Group) != "items" {
+		t.Fatalf("Expected items group, got %+v", req)
+	}
+
+	if out.String() != "STAT pid 1\r\nSTAT l1:curr_items 2\r\nEND\r\n" {
+		t.Fatalf("Unexpected response %q", out.String())
+	}
+}